@@ -0,0 +1,224 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var AbortOnFailure bool
+
+// abort flags
+var (
+	AbortKey      string
+	AbortUploadID string
+	AbortStale    string
+	AbortPrefix   string
+	AbortDryRun   bool
+)
+
+var abortCmd = &cobra.Command{
+	Use:   "abort",
+	Short: "Abort a multipart upload with --upload-id, or all those started more than --stale ago, deleting their parts",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if !AbortDryRun {
+			err = requireOperator("abort uploads")
+		}
+		var cleanup s3iface.S3API
+		if err == nil {
+			cleanup, err = newDestructiveS3Session(Region)
+		}
+		if err == nil {
+			err = Abort(newS3Session(Region), cleanup, BucketName, time.Now())
+		}
+		return err
+	},
+}
+
+func checkAbortFlags() error {
+	if !AbortOnFailure {
+		return nil
+	}
+	if Nodes > 1 {
+		return fmt.Errorf("--abort-on-failure doesn't go with --nodes, one node failing would throw away the parts of the others")
+	}
+	if WriteOnce {
+		return fmt.Errorf("--abort-on-failure doesn't go with --write-once, which doesn't abort anything")
+	}
+	return nil
+}
+
+// unfinishedUploadError is what an upload which failed but was left to be
+// resumed returns.
+type unfinishedUploadError struct {
+	Key      string
+	UploadID string
+	Token    resumeToken
+	Err      error
+}
+
+func (e *unfinishedUploadError) Error() string {
+	return fmt.Sprintf("Upload not aborted, run again to resume it (or with --upload-id %s, or --resume-token %s).  Error: %v", e.UploadID, e.Token, e.Err)
+}
+
+func (e *unfinishedUploadError) Unwrap() error {
+	return e.Err
+}
+
+// abortUnfinished aborts an upload which failed, with --abort-on-failure, so
+// that its parts aren't left behind and billed.
+func abortUnfinished(cleanup s3iface.S3API, bucket string, unfinished *unfinishedUploadError) error {
+	if err := abortUpload(cleanup, bucket, unfinished.Key, unfinished.UploadID); err != nil {
+		return fmt.Errorf("%w; aborting it failed too: %v", unfinished, err)
+	}
+	return fmt.Errorf("Upload %s aborted, its parts are deleted.  Error: %w", unfinished.UploadID, unfinished.Err)
+}
+
+// abortUpload aborts an upload and forgets its journal, if we have it.
+func abortUpload(cleanup s3iface.S3API, bucket string, key string, uploadID string) error {
+	_, err := cleanup.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if isNoSuchUpload(err) {
+		return fmt.Errorf("There's no upload %s of %s, it was completed or aborted already: %w", uploadID, key, err)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to abort the upload %s of %s: %w", uploadID, key, err)
+	}
+
+	journal, err := loadJournal(bucket, key)
+	if err == nil && journal != nil && journal.UploadID == uploadID {
+		if err := journal.Remove(); err != nil {
+			ui.Warnln("Failed to remove the upload journal:", err)
+		}
+	}
+	return nil
+}
+
+// parseAge reads an age like "7d", or anything time.ParseDuration takes.
+func parseAge(spec string) (time.Duration, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(spec, "d")); strings.HasSuffix(spec, "d") && err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	if d, err := time.ParseDuration(spec); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("Invalid age %q, use e.g. 7d or 36h", spec)
+}
+
+// Abort aborts the upload given with --upload-id, or every upload under
+// --prefix started more than --stale ago.
+func Abort(s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, now time.Time) error {
+	if (AbortStale == "") == (AbortUploadID == "") {
+		return fmt.Errorf("Tell us what to abort, either --upload-id or --stale")
+	}
+	if AbortStale == "" {
+		return abortOne(s3session, cleanup, bucket, AbortKey, AbortUploadID)
+	}
+	if AbortKey != "" {
+		return fmt.Errorf("--key goes with --upload-id, use --prefix with --stale")
+	}
+
+	age, err := parseAge(AbortStale)
+	if err != nil {
+		return err
+	}
+	return abortStale(s3session, cleanup, bucket, AbortPrefix, age, AbortDryRun, now)
+}
+
+// abortOne aborts an upload, looking up its key if it isn't given.
+func abortOne(s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, key string, uploadID string) error {
+	if key == "" {
+		var err error
+		if key, err = findUploadKey(s3session, bucket, uploadID); err != nil {
+			return err
+		}
+	}
+
+	if AbortDryRun {
+		ui.Printf("Would abort the upload %s of %s\n", uploadID, key)
+		return nil
+	}
+	if err := abortUpload(cleanup, bucket, key, uploadID); err != nil {
+		return err
+	}
+	ui.Printf("Aborted the upload %s of %s\n", uploadID, key)
+	return nil
+}
+
+// abortStale aborts the uploads under prefix which were started more than
+// age ago, which are likely forgotten.
+func abortStale(s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, prefix string, age time.Duration, dryRun bool, now time.Time) error {
+	uploads, err := listUploads(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	verb := "Aborting"
+	if dryRun {
+		verb = "Would abort"
+	}
+
+	var count int
+	var size int64
+	var cost float64
+	for _, u := range uploads {
+		if now.Sub(u.Initiated) < age {
+			continue
+		}
+		ui.Printf("%s %s, started %s ago (upload ID %s, %d parts, %s)\n", verb, u.Key, formatAge(now.Sub(u.Initiated)), u.UploadID, u.Parts, formatBytes(u.Size))
+		if !dryRun {
+			err := abortUpload(cleanup, bucket, u.Key, u.UploadID)
+			// Completed or aborted in the meantime is as good.
+			if err != nil && !isNoSuchUpload(err) {
+				return err
+			}
+		}
+		count++
+		size += u.Size
+		cost += u.Cost()
+	}
+
+	if dryRun {
+		ui.Printf("Would abort %d uploads, %s, which cost about $%.2f a month\n", count, formatBytes(size), cost)
+	} else {
+		ui.Printf("Aborted %d uploads, %s, which cost about $%.2f a month\n", count, formatBytes(size), cost)
+	}
+	return nil
+}
+
+func init() {
+	abortCmd.Flags().StringVar(&AbortUploadID, "upload-id", "", "the upload to abort")
+	abortCmd.Flags().StringVar(&AbortKey, "key", "", "the key of the --upload-id upload, looked up if not given")
+	abortCmd.Flags().StringVar(&AbortStale, "stale", "", "abort all uploads started longer ago than this, e.g. 7d or 36h")
+	abortCmd.Flags().StringVar(&AbortPrefix, "prefix", "", "with --stale, only abort uploads to keys starting with this")
+	abortCmd.Flags().BoolVar(&AbortDryRun, "dry-run", false, "only show what would be aborted")
+	rootCmd.AddCommand(abortCmd)
+}
@@ -0,0 +1,151 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseAge(t *testing.T) {
+	for spec, want := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+		"90m": 90 * time.Minute,
+	} {
+		if got, err := parseAge(spec); err != nil || got != want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "d", "0d", "-3d", "7 days", "0s"} {
+		if _, err := parseAge(spec); err == nil {
+			t.Errorf("parseAge(%q) was accepted", spec)
+		}
+	}
+}
+
+func TestAbortOnFailure(t *testing.T) {
+	filename := writeTestFile(t, randomData(3*PART_SIZE))
+	fake := &slowS3{fakeS3: newFakeS3(), fail: 3}
+
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "")
+	var unfinished *unfinishedUploadError
+	if !errors.As(err, &unfinished) {
+		t.Fatalf("got %v, want an unfinished upload", err)
+	}
+	if journal, _ := loadJournal("bucket", unfinished.Key); journal == nil {
+		t.Fatal("the failed upload left no journal")
+	}
+
+	err = abortUnfinished(fake, "bucket", unfinished)
+	if err == nil || !strings.Contains(err.Error(), "aborted, its parts are deleted") {
+		t.Errorf("got %v", err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the upload wasn't aborted")
+	}
+	if journal, _ := loadJournal("bucket", unfinished.Key); journal != nil {
+		t.Error("the journal of the aborted upload was kept")
+	}
+}
+
+// staleUploads makes a bucket with uploads started days ago.
+func staleUploads(now time.Time, days ...int) *fakeS3 {
+	fake := newFakeS3()
+	for i, d := range days {
+		id := "upload-" + string(rune('a'+i))
+		fake.uploads[id] = &fakeUpload{key: "backups/" + id, storageClass: s3.StorageClassDeepArchive,
+			parts: map[int64][]byte{1: make([]byte, 100)}, initiated: now.Add(-time.Duration(d) * 24 * time.Hour)}
+	}
+	return fake
+}
+
+func TestAbortStale(t *testing.T) {
+	now := time.Now()
+	fake := staleUploads(now, 1, 8, 30)
+
+	if err := abortStale(fake, fake, "bucket", "", 7*24*time.Hour, true, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.uploads) != 3 {
+		t.Fatalf("--dry-run aborted uploads, %d left", len(fake.uploads))
+	}
+
+	if err := abortStale(fake, fake, "bucket", "", 7*24*time.Hour, false, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.uploads) != 1 || fake.uploads["upload-a"] == nil {
+		t.Errorf("wrong uploads aborted, left: %v", fake.uploads)
+	}
+
+	if err := abortStale(fake, fake, "bucket", "elsewhere/", time.Hour, false, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.uploads) != 1 {
+		t.Error("--prefix wasn't applied")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	defer func() { AbortUploadID, AbortKey, AbortStale = "", "", "" }()
+	now := time.Now()
+	fake := staleUploads(now, 1, 2)
+
+	AbortUploadID = "upload-b"
+	if err := Abort(fake, fake, "bucket", now); err != nil {
+		t.Fatal(err)
+	}
+	if fake.uploads["upload-b"] != nil || fake.uploads["upload-a"] == nil {
+		t.Errorf("wrong upload aborted, left: %v", fake.uploads)
+	}
+
+	if err := Abort(fake, fake, "bucket", now); err == nil || !strings.Contains(err.Error(), "aborted already") {
+		t.Errorf("aborting it again: %v", err)
+	}
+
+	AbortKey = "backups/upload-a"
+	AbortUploadID = "upload-gone"
+	if err := Abort(fake, fake, "bucket", now); err == nil || !strings.Contains(err.Error(), "aborted already") {
+		t.Errorf("aborting a missing upload: %v", err)
+	}
+
+	AbortUploadID, AbortStale = "upload-a", "7d"
+	if err := Abort(fake, fake, "bucket", now); err == nil {
+		t.Error("--upload-id was accepted with --stale")
+	}
+	AbortUploadID, AbortStale = "", ""
+	if err := Abort(fake, fake, "bucket", now); err == nil {
+		t.Error("nothing to abort was accepted")
+	}
+}
+
+func TestCheckAbortFlags(t *testing.T) {
+	defer func() { AbortOnFailure = false; Nodes = 1 }()
+
+	AbortOnFailure = true
+	if err := checkAbortFlags(); err != nil {
+		t.Errorf("--abort-on-failure: %v", err)
+	}
+	Nodes = 3
+	if err := checkAbortFlags(); err == nil {
+		t.Error("--abort-on-failure was accepted with --nodes")
+	}
+}
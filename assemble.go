@@ -0,0 +1,328 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/pkg/uploader"
+	"github.com/spf13/cobra"
+)
+
+var AssembleDescription string
+var AssembleKey string
+
+const DEFAULT_CHUNKED_DESCRIPTION = "object.json"
+
+var assembleCmd = &cobra.Command{
+	Use:   "assemble directory",
+	Short: "Upload a directory of chunk files, cut by another tool, as one object",
+	Long: `Uploads the chunk files in the directory, one after the other, as a single
+object.  What the object is comes from the description, object.json in the
+directory unless --description says otherwise:
+
+  {"key": "vm.img", "size": 3298534883328, "sha256": "...", "etag": "...-3072",
+   "chunks": ["vm.img.000", "vm.img.001", ...]}
+
+Only the key is needed.  Without chunks, every other file in the directory
+is a chunk, in the order of their names.  Size and sha256 are checked before
+anything is uploaded, and etag, the multipart ETag the object had elsewhere,
+once it's uploaded.  Chunks of the same size, apart from a smaller last one,
+which S3 takes as parts are uploaded a part each.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Assemble(newS3Session(Region), lazyCleanup(Region), BucketName, args[0], AssembleDescription, AssembleKey, UploadID)
+	},
+}
+
+// chunkedObject is the description of an object cut into chunk files.
+type chunkedObject struct {
+	Key    string   `json:"key"`
+	Size   int64    `json:"size,omitempty"`
+	SHA256 string   `json:"sha256,omitempty"`
+	ETag   string   `json:"etag,omitempty"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+type chunkFile struct {
+	Path string
+	Size int64
+}
+
+// loadChunkedObject reads the description and finds its chunks.
+func loadChunkedObject(dir string, description string) (*chunkedObject, []chunkFile, error) {
+	if description == "" {
+		description = filepath.Join(dir, DEFAULT_CHUNKED_DESCRIPTION)
+	}
+	data, err := os.ReadFile(description)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the description of the object: %w", err)
+	}
+	var obj chunkedObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the description of the object %s: %w", description, err)
+	}
+
+	names := obj.Chunks
+	if len(names) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		described, _ := filepath.Abs(description)
+		for _, entry := range entries {
+			path, _ := filepath.Abs(filepath.Join(dir, entry.Name()))
+			if entry.Type().IsRegular() && path != described && !strings.HasPrefix(entry.Name(), ".") {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("%s has no chunks", dir)
+	}
+
+	var chunks []chunkFile
+	var size int64
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !stat.Mode().IsRegular() {
+			return nil, nil, fmt.Errorf("The chunk %s isn't a file", path)
+		}
+		chunks = append(chunks, chunkFile{path, stat.Size()})
+		size += stat.Size()
+	}
+	if obj.Size != 0 && obj.Size != size {
+		return nil, nil, fmt.Errorf("The chunks add up to %d bytes, the object is %d", size, obj.Size)
+	}
+	obj.Size = size
+	return &obj, chunks, nil
+}
+
+// chunkPartSize is the size of the chunks if every one of them can be a
+// part, which keeps the ETag the object had when it was cut, or 0.
+func chunkPartSize(chunks []chunkFile) int64 {
+	first := chunks[0].Size
+	if len(chunks) < 2 || len(chunks) > MAX_PARTS || first < MIN_PART_SIZE || first > MAX_PART_SIZE {
+		return 0
+	}
+	for i, chunk := range chunks[1:] {
+		last := i == len(chunks)-2
+		if (!last && chunk.Size != first) || (last && (chunk.Size > first || chunk.Size == 0)) {
+			return 0
+		}
+	}
+	return first
+}
+
+// chunkFilesReader reads the chunks one after the other, opening one at a time.
+type chunkFilesReader struct {
+	chunks []chunkFile
+	file   *os.File
+}
+
+func (r *chunkFilesReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.chunks[0].Path)
+			if err != nil {
+				return 0, err
+			}
+			r.file, r.chunks = f, r.chunks[1:]
+		}
+		n, err := r.file.Read(p)
+		if err == io.EOF {
+			r.file.Close()
+			r.file = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkFilesReader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// chunkProgress moves the bar as parts are done, resumed ones included.
+type chunkProgress struct {
+	mu   sync.Mutex
+	bar  progressBar
+	done int64
+}
+
+func (p *chunkProgress) Started(uploadID string, parts int, size int64) {}
+
+func (p *chunkProgress) PartDone(part int, size int64, resumed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += size
+	p.bar.Set64(p.done)
+}
+
+func chunksSHA256(chunks []chunkFile) (string, error) {
+	r := &chunkFilesReader{chunks: chunks}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func Assemble(s3session s3iface.S3API, cleanup cleanupSession, bucket string, dir string, description string, key string, uploadID string) error {
+	obj, chunks, err := loadChunkedObject(dir, description)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		key = obj.Key
+	}
+	if key == "" {
+		return fmt.Errorf("The description has no key, give it with --key")
+	}
+
+	ui.Printf("Reading %d chunks, %s\n", len(chunks), formatBytes(obj.Size))
+	sum, err := chunksSHA256(chunks)
+	if err != nil {
+		return err
+	}
+	if obj.SHA256 != "" && !strings.EqualFold(obj.SHA256, sum) {
+		return fmt.Errorf("The chunks' SHA-256 is %s, the object's %s", sum, obj.SHA256)
+	}
+
+	metadata, err := metadataFlags()
+	if err != nil {
+		return err
+	}
+	meta := aws.StringMap(metadata)
+	meta[SOURCE_METADATA_SHA256] = aws.String(sum)
+
+	reader := &chunkFilesReader{chunks: chunks}
+	defer reader.Close()
+	var source io.Reader = reader
+	size := obj.Size
+	partSize := chunkPartSize(chunks)
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		meta = encryptionMetadata(meta, c)
+		source = encryptReader(source, c)
+		size = encryptedSize(size)
+		// Parts of encrypted chunks don't line up with the chunks.
+		partSize = 0
+	}
+	if partSize == 0 {
+		auto, err := filePartSize(size)
+		if err != nil {
+			return err
+		}
+		partSize = int64(auto)
+	} else if err := checkPartBuffer(partSize); err != nil {
+		return err
+	}
+	meta = partSizeMetadata(meta, partSize)
+
+	parts := (size + partSize - 1) / partSize
+	bar := ui.ByteBar(size, key)
+	u := newUploader(s3session,
+		uploader.WithPartSize(partSize),
+		uploader.WithConcurrency(Concurrency),
+		uploader.WithReadAhead(ReadAhead),
+		uploader.WithStorageClass(aws.StringValue(uploadStorageClass())),
+		uploader.WithMetadata(aws.StringValueMap(meta)),
+		uploader.WithTagging(aws.StringValue(objectTagging(key))),
+		uploader.WithProgress(&chunkProgress{bar: bar}),
+		uploader.WithVerify(func(resp *s3.CompleteMultipartUploadOutput, etag string, completed []*s3.CompletedPart) error {
+			return verifyCompleted(resp, etag, completed, fmt.Errorf("The uploaded object doesn't match the chunks in %s", dir))
+		}),
+	)
+
+	ui.Printf("Uploading to %s in %d parts of %s\n", key, parts, formatBytes(partSize))
+	var result *uploader.Result
+	if uploadID != "" {
+		result, err = u.Resume(interrupt, bucket, key, uploadID, source, size)
+	} else {
+		result, err = u.Upload(interrupt, bucket, key, source, size)
+	}
+	var failed *uploader.Error
+	if errors.As(err, &failed) {
+		return &unfinishedUploadError{Key: key, UploadID: failed.UploadID, Err: failed.Err}
+	}
+	if err != nil {
+		return err
+	}
+
+	keyID, _ := metadataValue(meta, ENCRYPTION_KEY_ID_METADATA)
+	entry := catalogEntry{
+		Bucket:          bucket,
+		Key:             key,
+		Path:            shortPath(dir),
+		Size:            result.Size,
+		SHA256:          sum,
+		ETag:            result.ETag,
+		EncryptionKeyID: keyID,
+		SSE:             result.ServerSideEncryption,
+		KMSKeyID:        result.SSEKMSKeyID,
+	}
+	recordUpload(entry)
+	if err := uploadCompletionRecord(s3session, entry, result.UploadID); err != nil {
+		return err
+	}
+
+	etag := strings.Trim(result.ETag, "\"")
+	if obj.ETag != "" && !Encrypt && strings.Trim(obj.ETag, "\"") != etag {
+		return fmt.Errorf("%s is uploaded, but its ETag %s isn't the %s it had", key, etag, obj.ETag)
+	}
+	ui.Println(result.Location)
+	return nil
+}
+
+func init() {
+	assembleCmd.Flags().StringVar(&AssembleDescription, "description", "", "description of the object (default object.json in the directory)")
+	assembleCmd.Flags().StringVar(&AssembleKey, "key", "", "upload to this key instead of the description's")
+	assembleCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts to upload in parallel")
+	rootCmd.AddCommand(assembleCmd)
+}
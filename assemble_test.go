@@ -0,0 +1,109 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeChunks cuts data into chunks of size in a new directory, and
+// describes the object with obj.
+func writeChunks(t *testing.T, data []byte, size int, obj chunkedObject) string {
+	dir := t.TempDir()
+	for i := 0; i*size < len(data); i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("vm.img.%03d", i)), data[i*size:end], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	description, _ := json.Marshal(obj)
+	if err := os.WriteFile(filepath.Join(dir, DEFAULT_CHUNKED_DESCRIPTION), description, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestAssemble(t *testing.T) {
+	data := randomData(2*MIN_PART_SIZE + 1024)
+	sizes := []int64{MIN_PART_SIZE, MIN_PART_SIZE, 1024}
+	sum := sha256.Sum256(data)
+	dir := writeChunks(t, data, MIN_PART_SIZE, chunkedObject{Key: "vm.img", SHA256: hex.EncodeToString(sum[:]), ETag: multipartETag(data, sizes)})
+
+	fake := newFakeS3()
+	if err := Assemble(fake, fake.cleanup, "bucket", dir, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	obj := fake.objects["vm.img"]
+	if obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("the chunks weren't uploaded to vm.img")
+	}
+	if len(obj.partSizes) != 3 || obj.partSizes[0] != MIN_PART_SIZE {
+		t.Errorf("uploaded in parts of %v", obj.partSizes)
+	}
+}
+
+func TestAssembleRefusesWrongChunks(t *testing.T) {
+	data := randomData(3 * 1024)
+	for _, obj := range []chunkedObject{
+		{Key: "a", SHA256: strings.Repeat("0", 64)},
+		{Key: "a", Size: 1024},
+		{Key: "a", Chunks: []string{"vm.img.000", "vm.img.007"}},
+		{},
+	} {
+		dir := writeChunks(t, data, 1024, obj)
+		fake := newFakeS3()
+		if err := Assemble(fake, fake.cleanup, "bucket", dir, "", "", ""); err == nil {
+			t.Errorf("%+v was uploaded", obj)
+		}
+		if fake.nextID != 0 || len(fake.objects) != 0 {
+			t.Errorf("%+v started an upload", obj)
+		}
+	}
+}
+
+func TestChunkPartSize(t *testing.T) {
+	for _, c := range []struct {
+		sizes []int64
+		want  int64
+	}{
+		{[]int64{MIN_PART_SIZE, MIN_PART_SIZE, 10}, MIN_PART_SIZE},
+		{[]int64{MIN_PART_SIZE, MIN_PART_SIZE}, MIN_PART_SIZE},
+		{[]int64{MIN_PART_SIZE, 10, MIN_PART_SIZE}, 0},
+		{[]int64{MIN_PART_SIZE, MIN_PART_SIZE + 1}, 0},
+		{[]int64{1024, 1024}, 0},
+		{[]int64{MIN_PART_SIZE}, 0},
+	} {
+		var chunks []chunkFile
+		for _, size := range c.sizes {
+			chunks = append(chunks, chunkFile{Size: size})
+		}
+		if got := chunkPartSize(chunks); got != c.want {
+			t.Errorf("chunks of %v make parts of %d", c.sizes, got)
+		}
+	}
+}
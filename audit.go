@@ -0,0 +1,204 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Every request which destroys something, gets it back out of Glacier or
+// changes how the bucket keeps it is written to an audit log, whichever
+// command or daemon job sent it.  That's retagging and copying objects as
+// well, and publishing the config machines run with.  The log is only ever
+// appended to.
+
+// CLI flags
+var AuditLog string
+var UploadAuditLog bool
+
+// AUDIT_PREFIX is where --upload-audit-log puts the entries, one object each
+// since objects can't be appended to.
+const AUDIT_PREFIX = "audit/"
+
+// auditedOperations are the S3 requests which end up in the audit log.
+var auditedOperations = map[string]bool{
+	"DeleteObject":         true,
+	"DeleteObjects":        true,
+	"AbortMultipartUpload": true,
+	"RestoreObject":        true,
+	"PutBucketIntelligentTieringConfiguration":    true,
+	"DeleteBucketIntelligentTieringConfiguration": true,
+	"PutBucketInventoryConfiguration":             true,
+	"PutBucketLifecycleConfiguration":             true,
+	"PutObjectTagging":                            true,
+	"CopyObject":                                  true,
+}
+
+type auditedKey struct{}
+
+// audited is a request.Option which has the request audited, whatever its
+// operation: an upload which is a config, or completes a copy.
+func audited(r *request.Request) {
+	r.SetContext(context.WithValue(r.Context(), auditedKey{}, true))
+}
+
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Command []string  `json:"command"`
+	Action  string    `json:"action"`
+	Bucket  string    `json:"bucket,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	// Params are all the parameters of the request, as S3 names them.
+	Params    json.RawMessage `json:"params"`
+	RequestID string          `json:"request_id,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// auditRequests writes the audited requests of the session to the audit log
+// once they're done, whether they succeeded or not.  With --upload-audit-log
+// the entries are uploaded with s3session, the session's own client.
+func auditRequests(handlers *request.Handlers, s3session s3iface.S3API) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		if !auditedOperations[r.Operation.Name] && r.Context().Value(auditedKey{}) == nil {
+			return
+		}
+		entry := newAuditEntry(r, time.Now())
+		if err := writeAudit(entry); err != nil {
+			ui.Warnln("Failed to write the audit log:", err)
+		}
+		if UploadAuditLog && entry.Bucket != "" {
+			if err := uploadAuditEntry(s3session, entry.Bucket, entry); err != nil {
+				ui.Warnln("Failed to upload the audit log entry:", err)
+			}
+		}
+	})
+}
+
+func newAuditEntry(r *request.Request, now time.Time) auditEntry {
+	entry := auditEntry{
+		Time:      now.UTC(),
+		User:      auditUser(),
+		Host:      auditHost(),
+		Command:   os.Args,
+		Action:    r.Operation.Name,
+		RequestID: r.RequestID,
+	}
+	entry.Params, _ = json.Marshal(r.Params)
+	var ids struct{ Bucket, Key string }
+	json.Unmarshal(entry.Params, &ids)
+	entry.Bucket, entry.Key = ids.Bucket, ids.Key
+	if r.Error != nil {
+		entry.Error = r.Error.Error()
+	}
+	return entry
+}
+
+func auditUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+func auditHost() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+func auditLogPath() (string, error) {
+	if AuditLog != "" {
+		return AuditLog, nil
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "audit.log"), nil
+}
+
+// writeAudit appends entry to the audit log, one JSON object per line.
+func writeAudit(entry auditEntry) error {
+	path, err := auditLogPath()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// uploadAuditEntry stores entry under AUDIT_PREFIX, keyed by when it
+// happened and where.  It's sent with the credentials of the request it's
+// about, to wherever that went.
+func uploadAuditEntry(s3session s3iface.S3API, bucket string, entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := AUDIT_PREFIX + entry.Time.Format("2006/01/02/150405.000000000") + "-" + entry.Host + ".json"
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	return err
+}
+
+func isAudit(key string) bool {
+	return strings.HasPrefix(key, AUDIT_PREFIX)
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&AuditLog, "audit-log", "", "append deletes, aborts and restores to this file instead of audit.log in the state directory")
+	rootCmd.PersistentFlags().BoolVar(&UploadAuditLog, "upload-audit-log", false, "also upload every audit log entry to the bucket, under "+AUDIT_PREFIX)
+}
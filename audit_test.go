@@ -0,0 +1,145 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestAuditRequests(t *testing.T) {
+	AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	UploadAuditLog = true
+	defer func() { AuditLog, UploadAuditLog = "", false }()
+
+	fake := newFakeS3()
+	var handlers request.Handlers
+	auditRequests(&handlers, fake)
+	for _, r := range []*request.Request{
+		{
+			Operation: &request.Operation{Name: "DeleteObject"},
+			Params:    &s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("photos/a.jpg")},
+			RequestID: "1",
+		},
+		// Uploads aren't audited.
+		{
+			Operation: &request.Operation{Name: "PutObject"},
+			Params:    &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("photos/b.jpg")},
+		},
+		{
+			Operation: &request.Operation{Name: "AbortMultipartUpload"},
+			Params:    &s3.AbortMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("big.tar"), UploadId: aws.String("upload")},
+			Error:     errors.New("AccessDenied"),
+		},
+	} {
+		handlers.Complete.Run(r)
+	}
+	// Unless they're a config.
+	config := &request.Request{
+		Operation:   &request.Operation{Name: "PutObject"},
+		Params:      &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("backup.conf")},
+		HTTPRequest: &http.Request{},
+	}
+	audited(config)
+	handlers.Complete.Run(config)
+
+	file, err := os.Open(AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	deleted, aborted := entries[0], entries[1]
+	if deleted.Action != "DeleteObject" || deleted.Bucket != "bucket" || deleted.Key != "photos/a.jpg" || deleted.RequestID != "1" || deleted.Error != "" {
+		t.Errorf("unexpected entry %+v", deleted)
+	}
+	if deleted.User == "" || len(deleted.Command) == 0 || deleted.Time.IsZero() {
+		t.Errorf("who, what and when are missing: %+v", deleted)
+	}
+	if aborted.Action != "AbortMultipartUpload" || aborted.Error != "AccessDenied" || !strings.Contains(string(aborted.Params), `"UploadId":"upload"`) {
+		t.Errorf("unexpected entry %+v, %s", aborted, aborted.Params)
+	}
+	if published := entries[2]; published.Action != "PutObject" || published.Key != "backup.conf" {
+		t.Errorf("unexpected entry %+v", published)
+	}
+
+	// The entries went to the session which sent the requests.
+	var uploaded int
+	for key := range fake.objects {
+		if isAudit(key) {
+			uploaded++
+		}
+	}
+	if uploaded != 3 {
+		t.Errorf("uploaded %d entries, want 3", uploaded)
+	}
+}
+
+func TestUploadAuditEntry(t *testing.T) {
+	s3session := newFakeS3()
+	s3session.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.jpg"), Body: strings.NewReader("a")})
+
+	entry := auditEntry{Time: time.Date(2022, 5, 1, 12, 30, 0, 0, time.UTC), Host: "backup", Action: "DeleteObject", Bucket: "bucket", Key: "b.jpg"}
+	if err := uploadAuditEntry(s3session, "bucket", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	key := AUDIT_PREFIX + "2022/05/01/123000.000000000-backup.json"
+	obj, ok := s3session.objects[key]
+	if !ok {
+		t.Fatalf("no %s in %v", key, s3session.objects)
+	}
+	if obj.storageClass != s3.StorageClassStandard {
+		t.Errorf("uploaded to %s", obj.storageClass)
+	}
+	var uploaded auditEntry
+	if err := json.Unmarshal(obj.data, &uploaded); err != nil || uploaded.Key != "b.jpg" {
+		t.Errorf("uploaded %s, %v", obj.data, err)
+	}
+
+	// Syncing doesn't see the audit log, and can't delete it.
+	remote, err := listRemote(s3session, "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remote[key]; ok || len(remote) != 1 {
+		t.Errorf("listed %v", remote)
+	}
+}
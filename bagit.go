@@ -0,0 +1,129 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The version of the BagIt specification (RFC 8493) bags follow.
+const BAGIT_VERSION = "1.0"
+
+// writeBag writes dir to w as a BagIt bag in a tar archive, for archives
+// which have to be understood by preservation tools that know nothing of
+// us.  The bag is a directory named after dir, with the files in data/.
+// Their SHA-256 digests are taken while they're archived, so the manifests
+// come after them, at the end of the archive.
+func writeBag(w io.Writer, dir string, now time.Time) error {
+	dir = filepath.Clean(dir)
+	bag := filepath.Base(dir)
+	tw := tar.NewWriter(w)
+
+	tags := map[string][]byte{}
+	writeTag := func(name string, data []byte) error {
+		tags[name] = data
+		hdr := &tar.Header{
+			Name:    path.Join(bag, name),
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		reproducibleHeader(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	version := fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: UTF-8\n", BAGIT_VERSION)
+	if err := writeTag("bagit.txt", []byte(version)); err != nil {
+		return err
+	}
+
+	digests := map[string]*bagDigest{}
+	err := writeTarEntries(tw, dir, path.Join(bag, "data"), func(name string) io.Writer {
+		d := &bagDigest{hash: sha256.New()}
+		digests[strings.TrimPrefix(name, bag+"/")] = d
+		return d
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var payload int64
+	var manifest bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(digests[name].hash.Sum(nil)), bagPath(name))
+		payload += digests[name].size
+	}
+	if err := writeTag("manifest-sha256.txt", manifest.Bytes()); err != nil {
+		return err
+	}
+
+	info := fmt.Sprintf("Bagging-Date: %s\nPayload-Oxum: %d.%d\nBag-Software-Agent: s3-glacier-uploader\nExternal-Identifier: %s\n",
+		now.Format("2006-01-02"), payload, len(digests), bag)
+	if err := writeTag("bag-info.txt", []byte(info)); err != nil {
+		return err
+	}
+
+	var tagManifest bytes.Buffer
+	for _, name := range []string{"bagit.txt", "manifest-sha256.txt", "bag-info.txt"} {
+		sum := sha256.Sum256(tags[name])
+		fmt.Fprintf(&tagManifest, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	if err := writeTag("tagmanifest-sha256.txt", tagManifest.Bytes()); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// bagPath is how a manifest names a file: line breaks, which would end the
+// line, and percent signs are percent-encoded.
+func bagPath(name string) string {
+	return strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(name)
+}
+
+// bagDigest hashes a file of the payload, and counts its size for
+// Payload-Oxum.
+type bagDigest struct {
+	hash hash.Hash
+	size int64
+}
+
+func (d *bagDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
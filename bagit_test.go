@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteBag(t *testing.T) {
+	dir := writeTree(t, tarTree)
+	var archive bytes.Buffer
+	if err := writeBag(&archive, dir, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if _, err := extractTar(&archive, out); err != nil {
+		t.Fatal(err)
+	}
+	bag := filepath.Join(out, filepath.Base(dir))
+	checkExtracted(t, out, filepath.Join(filepath.Base(dir), "data"))
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(bag, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read("bagit.txt"); got != "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n" {
+		t.Errorf("bagit.txt: %q", got)
+	}
+	if got := read("bag-info.txt"); !strings.Contains(got, "Payload-Oxum: 16.3\n") || !strings.Contains(got, "Bagging-Date: 2026-03-01\n") {
+		t.Errorf("bag-info.txt: %q", got)
+	}
+
+	// Every line of the manifests is the digest of a file in the bag.
+	for _, manifest := range []string{"manifest-sha256.txt", "tagmanifest-sha256.txt"} {
+		lines := strings.Split(strings.TrimSpace(read(manifest)), "\n")
+		if manifest == "manifest-sha256.txt" && len(lines) != len(tarTree) {
+			t.Errorf("%s has %d lines", manifest, len(lines))
+		}
+		for _, line := range lines {
+			digest, name, _ := strings.Cut(line, "  ")
+			sum := sha256.Sum256([]byte(read(name)))
+			if hex.EncodeToString(sum[:]) != digest {
+				t.Errorf("%s: %s doesn't match", manifest, name)
+			}
+		}
+	}
+}
+
+func TestBagPath(t *testing.T) {
+	if got := bagPath("data/100%\nreal.txt"); got != "data/100%25%0Areal.txt" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,140 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var Bandwidth string
+
+// Request bodies are handed to the connection in chunks of at most this
+// size, so that the pace stays even.
+const BANDWIDTH_CHUNK = 32 * 1024
+
+// bandwidthLimiter keeps everything sent to and received from S3 below a
+// rate.  Like the request limiter it's shared by every session and worker:
+// each chunk gets the next slot, which is its size worth of time after the
+// previous one, so parallel parts and downloaded chunks get an even share.
+type bandwidthLimiter struct {
+	rate  float64
+	pacer transfer.Pacer
+}
+
+var bandwidth *bandwidthLimiter
+
+func checkBandwidth() error {
+	if Bandwidth == "" {
+		return nil
+	}
+
+	var err error
+	bandwidth, err = parseBandwidth(Bandwidth, "--bandwidth")
+	return err
+}
+
+// parseBandwidth makes a limiter of a rate like 5M, for the setting what.
+func parseBandwidth(value string, what string) (*bandwidthLimiter, error) {
+	// 5MB/s reads as well as 5M.
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %q, use e.g. 2M or 5MB/s", what, value)
+	}
+	if rate < BANDWIDTH_CHUNK {
+		return nil, fmt.Errorf("%s has to be at least %s a second", what, formatBytes(BANDWIDTH_CHUNK))
+	}
+	return &bandwidthLimiter{rate: float64(rate)}, nil
+}
+
+// Wait blocks until n more bytes may be sent.
+func (l *bandwidthLimiter) Wait(n int) {
+	l.pacer.Wait(context.Background(), time.Duration(float64(n)/l.rate*float64(time.Second)))
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	limiters []*bandwidthLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if len(p) > BANDWIDTH_CHUNK {
+		p = p[:BANDWIDTH_CHUNK]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		for _, limiter := range b.limiters {
+			limiter.Wait(n)
+		}
+	}
+	return n, err
+}
+
+// bandwidthTransport paces request bodies as the connection takes them, and
+// response bodies as they're read.  Throttling the part readers instead
+// would slow down the SDK too, which reads every body once to sign it before
+// sending it.  A body has to keep within every one of the limits.
+type bandwidthTransport struct {
+	base     http.RoundTripper
+	limiters []*bandwidthLimiter
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &limitedBody{req.Body, t.limiters}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &limitedBody{resp.Body, t.limiters}
+	}
+	return resp, err
+}
+
+// limitBandwidth keeps a session within --bandwidth and the limits it's
+// given of its own, e.g. a daemon job's.
+func limitBandwidth(config *aws.Config, own ...*bandwidthLimiter) {
+	var limiters []*bandwidthLimiter
+	for _, limiter := range append([]*bandwidthLimiter{bandwidth}, own...) {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if len(limiters) == 0 {
+		return
+	}
+
+	client := &http.Client{}
+	if config.HTTPClient != nil {
+		*client = *config.HTTPClient
+	}
+	base := client.Transport
+	if base == nil {
+		base = baseTransport()
+	}
+	client.Transport = &bandwidthTransport{base, limiters}
+	config.HTTPClient = client
+}
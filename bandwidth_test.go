@@ -0,0 +1,130 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCheckBandwidth(t *testing.T) {
+	defer func() { Bandwidth = ""; bandwidth = nil }()
+
+	for _, value := range []string{"nope", "1K", "5M/h"} {
+		Bandwidth = value
+		if err := checkBandwidth(); err == nil {
+			t.Errorf("--bandwidth %s should be refused", value)
+		}
+	}
+
+	Bandwidth = "2M"
+	if err := checkBandwidth(); err != nil {
+		t.Fatal(err)
+	}
+	if bandwidth.rate != 2*1024*1024 {
+		t.Errorf("rate %v, expected 2 MiB", bandwidth.rate)
+	}
+	Bandwidth = "5MB/s"
+	if err := checkBandwidth(); err != nil {
+		t.Fatal(err)
+	}
+	if bandwidth.rate != 5*1024*1024 {
+		t.Errorf("rate %v, expected 5 MiB", bandwidth.rate)
+	}
+}
+
+func TestBandwidthTransport(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received += len(body)
+	}))
+	defer server.Close()
+
+	defer func() { bandwidth = nil }()
+	bandwidth = &bandwidthLimiter{rate: 1024 * 1024}
+	config := aws.NewConfig()
+	limitBandwidth(config)
+
+	// 256 KiB at 1 MiB a second takes a quarter of a second, less the first
+	// chunk, which goes out right away.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader(make([]byte, 128*1024)))
+		resp, err := config.HTTPClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	elapsed := time.Since(start)
+
+	if received != 256*1024 {
+		t.Errorf("server received %d bytes, expected 256 KiB", received)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("sending 256 KiB at 1 MiB/s took %v", elapsed)
+	}
+}
+
+// Downloads share the limit, with responses paced as they're read.
+func TestBandwidthTransportDownloads(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 128*1024))
+	}))
+	defer server.Close()
+
+	defer func() { bandwidth = nil }()
+	bandwidth = &bandwidthLimiter{rate: 1024 * 1024}
+	config := aws.NewConfig()
+	limitBandwidth(config)
+
+	start := time.Now()
+	received := 0
+	for i := 0; i < 2; i++ {
+		resp, err := config.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		received += len(body)
+	}
+	elapsed := time.Since(start)
+
+	if received != 256*1024 {
+		t.Errorf("received %d bytes, expected 256 KiB", received)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("receiving 256 KiB at 1 MiB/s took %v", elapsed)
+	}
+}
+
+func TestLimitRateAlias(t *testing.T) {
+	if name := normalizeFlagName(nil, "limit-rate"); name != "bandwidth" {
+		t.Errorf("--limit-rate is --%s", name)
+	}
+	if f := rootCmd.PersistentFlags().Lookup("limit-rate"); f == nil || f.Name != "bandwidth" {
+		t.Errorf("looked up %v", f)
+	}
+}
@@ -0,0 +1,61 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+)
+
+// CLI flags
+var MaxRestoreCost float64
+
+// What it costs to download from S3 to the internet, per GB, at the first
+// volume tier.  Downloads to EC2 in the same region are free, but we can't
+// tell where we run.
+const TRANSFER_PRICE_PER_GB = 0.09
+
+// restoreCost estimates restoring the archived ones among the objects with
+// the given tier.
+func restoreCost(objects []archivedObject, tier string) (float64, error) {
+	var cost float64
+	for _, obj := range objects {
+		if !isArchived(obj.StorageClass) {
+			continue
+		}
+		t, err := findTier(obj.StorageClass, tier)
+		if err != nil {
+			return 0, err
+		}
+		cost += t.Cost(1, obj.Size)
+	}
+	return cost, nil
+}
+
+func transferCost(size int64) float64 {
+	return float64(size) / GB * TRANSFER_PRICE_PER_GB
+}
+
+// checkBudget refuses to go ahead with something costing more than
+// --max-restore-cost, before any money is spent.
+func checkBudget(what string, cost float64) error {
+	ui.Warnf("Estimated cost of %s: $%.2f\n", what, cost)
+
+	if MaxRestoreCost > 0 && cost > MaxRestoreCost {
+		return fmt.Errorf("Refusing to spend about $%.2f on %s, --max-restore-cost is $%.2f (raise it, or 0 for no limit)", cost, what, MaxRestoreCost)
+	}
+	return nil
+}
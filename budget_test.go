@@ -0,0 +1,62 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRestoreCost(t *testing.T) {
+	objects := []archivedObject{
+		{Key: "a", Size: 100 * GB, StorageClass: s3.StorageClassDeepArchive},
+		{Key: "b", Size: 100 * GB, StorageClass: s3.StorageClassGlacier},
+		{Key: "c", Size: 100 * GB, StorageClass: s3.StorageClassStandard},
+	}
+
+	cost, err := restoreCost(objects, s3.TierStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 100*0.02 + 0.10/1000 + 100*0.01 + 0.05/1000; math.Abs(cost-want) > 1e-9 {
+		t.Errorf("got $%f, want $%f", cost, want)
+	}
+
+	// Deep Archive has no Expedited tier.
+	if _, err := restoreCost(objects, s3.TierExpedited); err == nil {
+		t.Error("an Expedited restore from Deep Archive was priced")
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	defer func(limit float64) { MaxRestoreCost = limit }(MaxRestoreCost)
+
+	MaxRestoreCost = 100
+	if err := checkBudget("a restore", 99.99); err != nil {
+		t.Error(err)
+	}
+	if err := checkBudget("a restore", 15000); err == nil {
+		t.Error("a $15000 restore went through a $100 budget")
+	}
+
+	MaxRestoreCost = 0
+	if err := checkBudget("a restore", 15000); err != nil {
+		t.Errorf("no limit, but got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CLI flags
+var CaseCollisions string
+
+// What to do about names which only differ by case, like Photo.jpg and
+// photo.jpg.  S3 keeps both, but restored to Windows or macOS, one
+// overwrites the other.
+const (
+	CASE_COLLISIONS_WARN  = "warn"
+	CASE_COLLISIONS_SKIP  = "skip"
+	CASE_COLLISIONS_ERROR = "error"
+)
+
+func checkCaseCollisionFlags() error {
+	switch CaseCollisions {
+	case CASE_COLLISIONS_WARN, CASE_COLLISIONS_SKIP, CASE_COLLISIONS_ERROR:
+		return nil
+	}
+	return fmt.Errorf("--case-collisions is %s, %s or %s", CASE_COLLISIONS_WARN, CASE_COLLISIONS_SKIP, CASE_COLLISIONS_ERROR)
+}
+
+// caseFolder finds names which only differ by case from one it has seen.
+// It's safe to use from several goroutines.
+type caseFolder struct {
+	mu   sync.Mutex
+	seen map[string]string
+}
+
+func newCaseFolder() *caseFolder {
+	return &caseFolder{seen: map[string]string{}}
+}
+
+// foldCase is what names which only differ by case have in common.  Going
+// through upper case first folds more, e.g. ß and ẞ.
+func foldCase(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// Add returns the name seen before which only differs from name by case, or
+// "" if there's none.  The first of them is kept.
+func (f *caseFolder) Add(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	folded := foldCase(name)
+	if other, ok := f.seen[folded]; ok && other != name {
+		return other
+	}
+	f.seen[folded] = name
+	return ""
+}
+
+// caseCollision applies --case-collisions to name, which only differs from
+// other by case.  It returns whether to leave name out.
+func caseCollision(name string, other string) (bool, error) {
+	switch CaseCollisions {
+	case CASE_COLLISIONS_ERROR:
+		return false, fmt.Errorf("%s and %s only differ by case, restored to Windows or macOS one would overwrite the other", name, other)
+	case CASE_COLLISIONS_SKIP:
+		warn(WARNING_SKIPPED, name, "Skipping %s, it only differs from %s by case", name, other)
+		return true, nil
+	}
+	ui.Warnf("%s and %s only differ by case, restored to Windows or macOS one overwrites the other\n", name, other)
+	return false, nil
+}
+
+// syncCaseCollisions applies --case-collisions to the keys of the files of a
+// sync, which may collide with each other, coming from a case-sensitive file
+// system, or with objects already there, e.g. of a file which was renamed.
+// Objects which will be deleted don't count.
+func syncCaseCollisions(files []localFile, remote map[string]archivedObject, deleting bool) ([]localFile, error) {
+	folder := newCaseFolder()
+	local := map[string]bool{}
+	for _, file := range files {
+		local[file.Key] = true
+	}
+	if !deleting {
+		for key := range remote {
+			if !local[key] {
+				folder.Add(key)
+			}
+		}
+	}
+
+	kept := files[:0:0]
+	for _, file := range files {
+		if other := folder.Add(file.Key); other != "" {
+			skip, err := caseCollision(file.Key, other)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+		}
+		kept = append(kept, file)
+	}
+	return kept, nil
+}
@@ -0,0 +1,113 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncCaseCollisions(t *testing.T) {
+	defer func() { CaseCollisions = CASE_COLLISIONS_WARN }()
+
+	files := []localFile{
+		{Path: "a/Photo.jpg", Key: "photos/Photo.jpg"},
+		{Path: "a/photo.jpg", Key: "photos/photo.jpg"},
+		{Path: "a/Report.pdf", Key: "photos/Report.pdf"},
+		{Path: "a/notes.txt", Key: "photos/notes.txt"},
+	}
+	// report.pdf was renamed to Report.pdf, notes.txt is the same file.
+	remote := map[string]archivedObject{
+		"photos/report.pdf": {Key: "photos/report.pdf"},
+		"photos/notes.txt":  {Key: "photos/notes.txt"},
+	}
+
+	for _, test := range []struct {
+		policy   string
+		deleting bool
+		kept     int
+		ok       bool
+	}{
+		{CASE_COLLISIONS_WARN, false, 4, true},
+		{CASE_COLLISIONS_SKIP, false, 2, true},
+		// Deleting report.pdf leaves only the photos colliding.
+		{CASE_COLLISIONS_SKIP, true, 3, true},
+		{CASE_COLLISIONS_ERROR, false, 0, false},
+	} {
+		CaseCollisions = test.policy
+		kept, err := syncCaseCollisions(files, remote, test.deleting)
+		if (err == nil) != test.ok || len(kept) != test.kept {
+			t.Errorf("%s, deleting %v: kept %v, %v", test.policy, test.deleting, kept, err)
+		}
+		if test.ok && kept[0].Key != "photos/Photo.jpg" {
+			t.Errorf("%s: kept %v instead of the first", test.policy, kept)
+		}
+	}
+
+	if len(files) != 4 {
+		t.Error("the files were changed")
+	}
+}
+
+func TestTarCaseCollisions(t *testing.T) {
+	defer func() { CaseCollisions = CASE_COLLISIONS_WARN }()
+	dir := writeTree(t, map[string]string{"Photo.jpg": "first", "photo.jpg": "second", "Other/x": "", "other/y": ""})
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Skip("the temporary directory is case-insensitive")
+	}
+
+	archived := func() []string {
+		t.Helper()
+		var archive bytes.Buffer
+		if err := writeTar(&archive, dir); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tr := tar.NewReader(&archive)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				names = append(names, filepath.Base(hdr.Name))
+			}
+		}
+	}
+
+	if names := archived(); len(names) != 4 {
+		t.Errorf("warning archived %v", names)
+	}
+	CaseCollisions = CASE_COLLISIONS_SKIP
+	// Files in directories which only differ by case don't collide.
+	if names := fmt.Sprint(archived()); names != "[x Photo.jpg y]" {
+		t.Errorf("skipping archived %v", names)
+	}
+	CaseCollisions = CASE_COLLISIONS_ERROR
+	var archive bytes.Buffer
+	if err := writeTar(&archive, dir); err == nil {
+		t.Error("archived both photos")
+	}
+}
@@ -0,0 +1,241 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/cobra"
+)
+
+// Glacier listings are slow, and only have keys and sizes.  The catalog is
+// our own record of every upload, kept next to the other state files: where
+// it came from, when, and how it was encrypted.
+
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "Look through the local record of what was uploaded, without asking S3",
+}
+
+var catalogListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List every upload recorded in the catalog, of --bucket if given",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return CatalogSearch(ui.Writer(), BucketName, "")
+	},
+}
+
+var catalogSearchCmd = &cobra.Command{
+	Use:   "search pattern",
+	Short: "List the uploads whose file or key contains pattern, or matches it with wildcards like *.tar",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return CatalogSearch(ui.Writer(), BucketName, args[0])
+	},
+}
+
+// catalogEntry is an upload which succeeded.  Size is the object's, and
+// SHA256 the file's, for files.
+type catalogEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Path   string `json:"path"`
+	// UnshardedKey is Key without its --shard-prefix shard.
+	UnshardedKey string    `json:"unsharded_key,omitempty"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	ETag         string    `json:"etag"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	Uploaded     time.Time `json:"uploaded"`
+	// EncryptionKeyID is our key's with --encrypt, SSE is how S3 encrypted
+	// the object, with the KMS key if it's aws:kms.
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
+	SSE             string `json:"sse,omitempty"`
+	KMSKeyID        string `json:"kms_key_id,omitempty"`
+	// Verification is the record of a verify-set, which has an entry of
+	// its own.
+	Verification *setVerification `json:"verification,omitempty"`
+}
+
+// catalogMu keeps the uploads of one run from writing over each other.
+var catalogMu sync.Mutex
+
+func catalogPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "catalog.jsonl"), nil
+}
+
+// recordUpload adds an upload to the catalog.  It's a line of JSON appended
+// to the file, so it stays cheap with many uploads.  Losing the record
+// doesn't undo the upload, so it only warns.
+func recordUpload(entry catalogEntry) {
+	// Streams are named after what they come from, like standard input.
+	if _, err := os.Stat(entry.Path); err == nil {
+		if abs, err := filepath.Abs(entry.Path); err == nil {
+			entry.Path = abs
+		}
+	}
+	if entry.UnshardedKey == "" {
+		entry.UnshardedKey = unshardKey(entry.Key)
+	}
+	if entry.StorageClass == "" {
+		entry.StorageClass = aws.StringValue(uploadStorageClass())
+	}
+	if entry.Uploaded.IsZero() {
+		entry.Uploaded = time.Now().UTC()
+	}
+
+	if err := appendCatalog(entry); err != nil {
+		ui.Warnln("Failed to add the upload to the catalog:", err)
+	}
+}
+
+func appendCatalog(entry catalogEntry) error {
+	p, err := catalogPath()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadCatalog reads every upload in the catalog, oldest first.  A line cut
+// short by a crash is skipped.
+func loadCatalog() ([]catalogEntry, error) {
+	p, err := catalogPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []catalogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry catalogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// matches tells whether the entry's file or key matches pattern: as a
+// wildcard pattern, of the whole key or the file's name, or else anywhere
+// in either, ignoring case.
+func (e catalogEntry) matches(pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		for _, name := range []string{e.Key, e.UnshardedKey, path.Base(e.Key), filepath.Base(e.Path), filepath.ToSlash(e.Path)} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	return strings.Contains(strings.ToLower(e.Key), pattern) || strings.Contains(strings.ToLower(e.UnshardedKey), pattern) || strings.Contains(strings.ToLower(e.Path), pattern)
+}
+
+// encryption describes how the object is encrypted.
+func (e catalogEntry) encryption() string {
+	var how []string
+	if e.EncryptionKeyID != "" {
+		how = append(how, "key "+e.EncryptionKeyID)
+	}
+	if e.KMSKeyID != "" {
+		how = append(how, e.SSE+" "+e.KMSKeyID)
+	} else if e.SSE != "" {
+		how = append(how, e.SSE)
+	}
+	if len(how) == 0 {
+		return "-"
+	}
+	return strings.Join(how, ", ")
+}
+
+// CatalogSearch lists the uploads to bucket, or any bucket if it's empty,
+// which match pattern.
+func CatalogSearch(w io.Writer, bucket string, pattern string) error {
+	entries, err := loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var found int
+	var total int64
+	for _, e := range entries {
+		if (bucket != "" && e.Bucket != bucket) || !e.matches(pattern) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%s\t%s\t%s\n", e.Uploaded.Local().Format("2006-01-02 15:04"), formatBytes(e.Size), e.StorageClass, e.Bucket, e.Key, e.Path, e.encryption())
+		found++
+		total += e.Size
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d uploads, %s\n", found, formatBytes(total))
+	return nil
+}
+
+func init() {
+	catalogCmd.AddCommand(catalogListCmd)
+	catalogCmd.AddCommand(catalogSearchCmd)
+	rootCmd.AddCommand(catalogCmd)
+}
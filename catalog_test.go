@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	p, _ := catalogPath()
+	os.Remove(p)
+	defer os.Remove(p)
+
+	fake := newFakeS3()
+	filename := writeTestFile(t, randomData(1000))
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	recordUpload(catalogEntry{Bucket: "other", Key: "photos/2020.tar", Path: "standard input", Size: 2048, SSE: "aws:kms", KMSKeyID: "alias/backups"})
+
+	entries, err := loadCatalog()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("got %+v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.Bucket != "bucket" || e.Key != "archive.bin" || e.Path != filename || e.Size != 1000 || e.SHA256 == "" || e.ETag == "" || e.Uploaded.IsZero() {
+		t.Errorf("recorded %+v", e)
+	}
+
+	for _, c := range []struct {
+		bucket, pattern string
+		want            []string
+	}{
+		{"", "", []string{"bucket/archive.bin", "other/photos/2020.tar"}},
+		{"other", "", []string{"other/photos/2020.tar"}},
+		{"", "PHOTOS", []string{"other/photos/2020.tar"}},
+		{"", "*.bin", []string{"bucket/archive.bin"}},
+		{"", "photos/*", []string{"other/photos/2020.tar"}},
+		{"", "nothing", nil},
+	} {
+		var out bytes.Buffer
+		if err := CatalogSearch(&out, c.bucket, c.pattern); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"bucket/archive.bin", "other/photos/2020.tar"} {
+			want := false
+			for _, k := range c.want {
+				want = want || k == key
+			}
+			if strings.Contains(out.String(), key) != want {
+				t.Errorf("searching %q in %q: %s", c.pattern, c.bucket, out.String())
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	CatalogSearch(&out, "other", "")
+	if !strings.Contains(out.String(), "aws:kms alias/backups") {
+		t.Errorf("no encryption in %s", out.String())
+	}
+}
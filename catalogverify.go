@@ -0,0 +1,211 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// catalog verify flags
+var CatalogVerifyFresh string
+
+var catalogVerifyCmd = &cobra.Command{
+	Use:   "verify [pattern]",
+	Short: "Verify the uploads in the catalog, skipping the ones verified within --fresh",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		return CatalogVerify(newS3Session(Region), BucketName, pattern, CatalogVerifyFresh, time.Now())
+	},
+}
+
+// verifiedObject is what catalog verify found about an object, remembered so
+// that nightly runs don't check it again for --fresh.  ETag is the one the
+// catalog recorded, so an object uploaded again is checked again.
+type verifiedObject struct {
+	VersionID string    `json:"version_id,omitempty"`
+	ETag      string    `json:"etag"`
+	Verified  time.Time `json:"verified"`
+	Result    string    `json:"result"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// verifyCacheFile is what's in the verification cache file.
+type verifyCacheFile struct {
+	Version int                       `json:"version"`
+	Objects map[string]verifiedObject `json:"objects"`
+}
+
+func verifyCachePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "verify-cache.json"), nil
+}
+
+func loadVerifyCache() (map[string]verifiedObject, error) {
+	p, err := verifyCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]verifiedObject{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+
+	file := verifyCacheFile{Objects: map[string]verifiedObject{}}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Failed to read the verification cache %s: %w", p, err)
+	}
+	return file.Objects, nil
+}
+
+func saveVerifyCache(objects map[string]verifiedObject) error {
+	p, err := verifyCachePath()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(p, verifyCacheFile{Version: STATE_VERSION, Objects: objects})
+}
+
+// fresh reports whether a cached verification of e still stands at now.
+// Failures never do, they're checked again every run.
+func (v verifiedObject) fresh(e catalogEntry, window time.Duration, now time.Time) bool {
+	return v.Result != SCRUB_FAILED && v.ETag == e.ETag && now.Sub(v.Verified) < window
+}
+
+// verifyCatalogEntry checks the object of an upload: that it's still the
+// one the catalog recorded, and as thoroughly as scrub does without a
+// restore.
+func verifyCatalogEntry(s3session s3iface.S3API, e catalogEntry, now time.Time) verifiedObject {
+	v := verifiedObject{ETag: e.ETag, Verified: now}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(e.Bucket),
+		Key:    aws.String(e.Key),
+	})
+	if err != nil {
+		v.Result, v.Detail = SCRUB_FAILED, err.Error()
+		return v
+	}
+	v.VersionID = aws.StringValue(head.VersionId)
+	if etag := strings.Trim(aws.StringValue(head.ETag), "\""); e.ETag != "" && etag != strings.Trim(e.ETag, "\"") {
+		v.Result, v.Detail = SCRUB_FAILED, fmt.Sprintf("ETag is %s, the catalog says %s", etag, e.ETag)
+		return v
+	}
+
+	record := verifyObject(s3session, e.Bucket, archivedObject{Key: e.Key, Size: aws.Int64Value(head.ContentLength)}, "", 0)
+	v.Result, v.Detail = record.Result, record.Detail
+	return v
+}
+
+// CatalogVerify verifies the latest upload of every key in the catalog of
+// bucket, or of any bucket if it's empty, which matches pattern.  Uploads
+// verified within fresh are taken from the cache instead of asking S3.
+func CatalogVerify(s3session s3iface.S3API, bucket string, pattern string, fresh string, now time.Time) error {
+	window, err := parseAge(fresh)
+	if err != nil {
+		return fmt.Errorf("Invalid --fresh: %w", err)
+	}
+
+	entries, err := loadCatalog()
+	if err != nil {
+		return err
+	}
+	cache, err := loadVerifyCache()
+	if err != nil {
+		return err
+	}
+
+	// Later uploads of a key replace the earlier ones.
+	latest := map[string]int{}
+	var uploads []catalogEntry
+	for _, e := range entries {
+		if (bucket != "" && e.Bucket != bucket) || !e.matches(pattern) || e.Verification != nil {
+			continue
+		}
+		if i, ok := latest[e.Bucket+"/"+e.Key]; ok {
+			uploads[i] = e
+			continue
+		}
+		latest[e.Bucket+"/"+e.Key] = len(uploads)
+		uploads = append(uploads, e)
+	}
+
+	var stale []catalogEntry
+	var size int64
+	for _, e := range uploads {
+		if !cache[e.Bucket+"/"+e.Key].fresh(e, window, now) {
+			stale = append(stale, e)
+			size += e.Size
+		}
+	}
+	if err := checkBudget("verifying the catalog", transferCost(size)); err != nil {
+		return err
+	}
+
+	results := make([]verifiedObject, len(stale))
+	forEachObject(len(stale), func(i int) error {
+		results[i] = verifyCatalogEntry(s3session, stale[i], now)
+		return nil
+	})
+
+	var failed int
+	for i, e := range stale {
+		cache[e.Bucket+"/"+e.Key] = results[i]
+		if results[i].Result == SCRUB_FAILED {
+			failed++
+		}
+		ui.Printf("%-10s %s/%s %s\n", results[i].Result, e.Bucket, e.Key, results[i].Detail)
+	}
+	if err := saveVerifyCache(cache); err != nil {
+		return err
+	}
+
+	ui.Printf("Checked %d of %d uploads, %d were verified within %s\n", len(stale), len(uploads), len(uploads)-len(stale), fresh)
+	if failed > 0 {
+		return fmt.Errorf("%d uploads failed verification", failed)
+	}
+	return nil
+}
+
+func init() {
+	catalogVerifyCmd.Flags().StringVar(&CatalogVerifyFresh, "fresh", "30d", "don't check uploads again which were verified within this long, e.g. 7d")
+	catalogCmd.AddCommand(catalogVerifyCmd)
+}
@@ -0,0 +1,98 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCatalogVerify(t *testing.T) {
+	catalog, _ := catalogPath()
+	cache, _ := verifyCachePath()
+	os.Remove(catalog)
+	os.Remove(cache)
+	defer os.Remove(catalog)
+	defer os.Remove(cache)
+
+	fake := newFakeS3()
+	for _, key := range []string{"vm.img", "photos/a.jpg"} {
+		fake.PutObject(&s3.PutObjectInput{
+			Bucket:       aws.String("bucket"),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader(randomData(1024)),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+		head, _ := fake.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		recordUpload(catalogEntry{Bucket: "bucket", Key: key, Path: key, Size: 1024, ETag: aws.StringValue(head.ETag)})
+	}
+
+	now := time.Now()
+	if err := CatalogVerify(fake, "bucket", "", "30d", now); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := loadVerifyCache()
+	if err != nil || len(verified) != 2 {
+		t.Fatalf("cached %+v, %v", verified, err)
+	}
+	for key, v := range verified {
+		if v.Result != SCRUB_OK || !v.Verified.Equal(now) {
+			t.Errorf("%s: %+v", key, v)
+		}
+	}
+
+	// Within --fresh nothing is checked again.
+	if err := CatalogVerify(fake, "bucket", "", "30d", now.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	verified, _ = loadVerifyCache()
+	if v := verified["bucket/vm.img"]; !v.Verified.Equal(now) {
+		t.Errorf("checked again within --fresh: %+v", v)
+	}
+
+	// An object which was replaced behind our back fails, and is checked
+	// again however fresh.
+	later := now.Add(31 * 24 * time.Hour)
+	fake.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String("bucket"),
+		Key:          aws.String("vm.img"),
+		Body:         bytes.NewReader(randomData(2048)),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	if err := CatalogVerify(fake, "bucket", "", "30d", later); err == nil {
+		t.Fatal("a replaced object passed")
+	}
+	verified, _ = loadVerifyCache()
+	if v := verified["bucket/vm.img"]; v.Result != SCRUB_FAILED || !v.Verified.Equal(later) {
+		t.Errorf("replaced object: %+v", v)
+	}
+	if v := verified["bucket/photos/a.jpg"]; v.Result != SCRUB_OK || !v.Verified.Equal(later) {
+		t.Errorf("not checked again after --fresh: %+v", v)
+	}
+	if v := verified["bucket/vm.img"]; v.fresh(catalogEntry{ETag: v.ETag}, time.Hour, later) {
+		t.Error("a failure was taken as fresh")
+	}
+
+	if err := CatalogVerify(fake, "bucket", "", "soon", now); err == nil {
+		t.Error("--fresh soon was accepted")
+	}
+}
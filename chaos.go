@@ -0,0 +1,190 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// CLI flags
+var Chaos float64
+var ChaosSeed int64
+
+const (
+	CHAOS_SLOW    = "slow"
+	CHAOS_REFUSED = "refused"
+	CHAOS_LOST    = "lost"
+)
+
+// chaosTransport sits between the SDK and the network and breaks requests
+// on purpose: it delays them, refuses them without sending anything, or sends
+// them and then throws the response away.  The last one is the nasty case of
+// a CompleteMultipartUpload which succeeded although we were told it didn't.
+// Together with --endpoint-url it's a way to exercise the retry, resume and
+// abort logic, ours or that of a wrapper script, against a fake backend.
+type chaosTransport struct {
+	base     http.RoundTripper
+	rate     float64
+	maxDelay time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaosTransport(base http.RoundTripper, rate float64, seed int64) *chaosTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &chaosTransport{
+		base:     base,
+		rate:     rate,
+		maxDelay: 30 * time.Second,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+var chaos *chaosTransport
+
+func checkChaos() error {
+	if Chaos == 0 {
+		return nil
+	}
+	if Chaos < 0 || Chaos > 1 {
+		return fmt.Errorf("Invalid --chaos %v, it's a probability between 0 and 1", Chaos)
+	}
+
+	seed := ChaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ui.Warnf("Chaos mode: breaking %.0f%% of requests, seed %d\n", Chaos*100, seed)
+
+	chaos = newChaosTransport(baseTransport(), Chaos, seed)
+	return nil
+}
+
+// injectChaos routes the session's requests through the chaos transport,
+// keeping any timeout set up by configureRetries.
+func injectChaos(config *aws.Config) {
+	if chaos == nil {
+		return
+	}
+
+	client := &http.Client{}
+	if config.HTTPClient != nil {
+		*client = *config.HTTPClient
+	}
+	client.Transport = chaos
+	config.HTTPClient = client
+}
+
+// pick decides what, if anything, goes wrong with the next request.
+func (c *chaosTransport) pick() (string, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rand.Float64() >= c.rate {
+		return "", 0
+	}
+
+	switch c.rand.Intn(3) {
+	case 0:
+		return CHAOS_SLOW, time.Duration(c.rand.Int63n(int64(c.maxDelay) + 1))
+	case 1:
+		return CHAOS_REFUSED, 0
+	default:
+		return CHAOS_LOST, 0
+	}
+}
+
+func (c *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	failure, delay := c.pick()
+	if failure != "" {
+		ui.Warnf("Chaos: %s %s %s\n", failure, req.Method, describeRequest(req))
+	}
+
+	switch failure {
+	case CHAOS_SLOW:
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return c.base.RoundTrip(req)
+
+	case CHAOS_REFUSED:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return chaosResponse(req, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."), nil
+
+	case CHAOS_LOST:
+		resp, err := c.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return chaosResponse(req, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."), nil
+	}
+
+	return c.base.RoundTrip(req)
+}
+
+// describeRequest names the S3 operation well enough to follow the log.
+func describeRequest(req *http.Request) string {
+	query := req.URL.Query()
+	switch {
+	case query.Get("partNumber") != "":
+		return fmt.Sprintf("%s part %s", req.URL.Path, query.Get("partNumber"))
+	case query.Get("uploadId") != "" && req.Method == http.MethodPost:
+		return fmt.Sprintf("%s complete", req.URL.Path)
+	case strings.Contains(req.URL.RawQuery, "uploads"):
+		return fmt.Sprintf("%s create", req.URL.Path)
+	}
+	return req.URL.Path
+}
+
+// chaosResponse is an error the way S3 would send it.
+func chaosResponse(req *http.Request, status int, code string, message string) *http.Response {
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>%s</Message><RequestId>chaos</RequestId></Error>`, code, message)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/xml"}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
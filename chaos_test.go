@@ -0,0 +1,85 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChaosTransport(t *testing.T) {
+	sent := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	get := func(c *chaosTransport) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/bucket/key?partNumber=3&uploadId=x", nil)
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	calm := newChaosTransport(nil, 0, 1)
+	for i := 0; i < 20; i++ {
+		if resp, body := get(calm); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Fatalf("--chaos 0 broke a request: %d %q", resp.StatusCode, body)
+		}
+	}
+
+	wild := newChaosTransport(nil, 1, 1)
+	wild.maxDelay = time.Millisecond
+	seen := map[int]int{}
+	sent = 0
+	for i := 0; i < 60; i++ {
+		resp, body := get(wild)
+		seen[resp.StatusCode]++
+		if resp.StatusCode != http.StatusOK && !strings.Contains(body, "<Code>") {
+			t.Errorf("status %d without an S3 error: %q", resp.StatusCode, body)
+		}
+	}
+
+	// Slow requests go through, refused ones never reach the server and lost
+	// ones do, but their response is replaced.
+	if seen[http.StatusOK] == 0 || seen[http.StatusServiceUnavailable] == 0 || seen[http.StatusInternalServerError] == 0 {
+		t.Errorf("expected every kind of failure, got %v", seen)
+	}
+	if want := seen[http.StatusOK] + seen[http.StatusInternalServerError]; sent != want {
+		t.Errorf("%d requests reached the server, expected %d", sent, want)
+	}
+}
+
+func TestCheckChaos(t *testing.T) {
+	defer func() { Chaos, chaos = 0, nil }()
+
+	for _, rate := range []float64{-0.1, 1.5} {
+		Chaos = rate
+		if err := checkChaos(); err == nil {
+			t.Errorf("--chaos %v was accepted", rate)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var ChecksumAlgorithm string
+var VerifyUpload string
+
+// What --verify checks a completed upload by.
+const (
+	VERIFY_MD5    = "md5"
+	VERIFY_SHA256 = "sha256"
+	VERIFY_NONE   = "none"
+)
+
+// With SSE-KMS, ETags aren't MD5 digests of the data, so they can't be
+// recomputed from a local file.  S3's additional checksums can be: every
+// part gets a SHA-256 digest, and the object a digest of those.  The SDK we
+// use doesn't calculate them, so we send them ourselves.
+
+func checkChecksumAlgorithm() error {
+	switch strings.ToUpper(ChecksumAlgorithm) {
+	case "":
+	case s3.ChecksumAlgorithmSha256:
+		ChecksumAlgorithm = s3.ChecksumAlgorithmSha256
+	default:
+		return fmt.Errorf("Unsupported --checksum-algorithm %q, only %s is", ChecksumAlgorithm, s3.ChecksumAlgorithmSha256)
+	}
+
+	switch VerifyUpload {
+	case VERIFY_MD5, VERIFY_NONE:
+	case VERIFY_SHA256:
+		ChecksumAlgorithm = s3.ChecksumAlgorithmSha256
+	default:
+		return fmt.Errorf("--verify is %s, %s or %s", VERIFY_MD5, VERIFY_SHA256, VERIFY_NONE)
+	}
+	return nil
+}
+
+// checksumAlgorithm is what to pass to CreateMultipartUpload.
+func checksumAlgorithm() *string {
+	if ChecksumAlgorithm == "" {
+		return nil
+	}
+	return aws.String(ChecksumAlgorithm)
+}
+
+// partChecksum is the checksum to send with a part, if any.
+func partChecksum(data []byte) *string {
+	if ChecksumAlgorithm == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// newChecksumWriter calculates the SHA-256 checksum S3 gives an object
+// uploaded in parts of the given sizes, see Checksum.
+func newChecksumWriter(partSizes []int64) *transfer.PartHasher {
+	return transfer.NewPartHasher(partSizes, sha256.New())
+}
+
+// compositeChecksum is the object's checksum given the checksums of its parts.
+func compositeChecksum(parts []*s3.CompletedPart) (string, error) {
+	h := sha256.New()
+	for _, part := range parts {
+		digest, err := base64.StdEncoding.DecodeString(aws.StringValue(part.ChecksumSHA256))
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("Part %d has no valid SHA-256 checksum", aws.Int64Value(part.PartNumber))
+		}
+		h.Write(digest)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(parts)), nil
+}
+
+// checkCompositeChecksum compares the checksum S3 gave the completed upload
+// with the one its parts add up to.
+func checkCompositeChecksum(resp *s3.CompleteMultipartUploadOutput, parts []*s3.CompletedPart) error {
+	ours, err := compositeChecksum(parts)
+	if err != nil {
+		return err
+	}
+	if theirs := aws.StringValue(resp.ChecksumSHA256); theirs != ours {
+		return fmt.Errorf("The uploaded object's checksum %s doesn't match ours, %s", theirs, ours)
+	}
+	return nil
+}
+
+// verifyCompleted checks the object S3 put together from the parts against
+// what we sent: with --verify md5 its ETag, and with --verify sha256 or
+// --checksum-algorithm its composite SHA-256 checksum, which works for
+// SSE-KMS objects too.  A mismatch is the error given.
+func verifyCompleted(resp *s3.CompleteMultipartUploadOutput, etag string, parts []*s3.CompletedPart, mismatch error) error {
+	if VerifyUpload == VERIFY_NONE {
+		ui.Println("Not verified, --verify is none")
+		return nil
+	}
+
+	if VerifyUpload == VERIFY_MD5 {
+		if respEtag := strings.Trim(aws.StringValue(resp.ETag), "\""); respEtag != etag {
+			ui.Println("Etags don't match!")
+			ui.Println("  AWS: ", respEtag)
+			ui.Println("  Ours:", etag)
+			return mismatch
+		}
+		ui.Println("Etags match!")
+	}
+
+	if ChecksumAlgorithm != "" {
+		if err := checkCompositeChecksum(resp, parts); err != nil {
+			return err
+		}
+		ui.Println("Checksums match!")
+	}
+	return nil
+}
+
+// objectChecksum asks S3 for the object's SHA-256 checksum and the sizes of
+// its parts.  It needs s3:GetObjectAttributes.
+func objectChecksum(s3session s3iface.S3API, bucket string, key string) (string, []int64, error) {
+	var checksum string
+	var partSizes []int64
+	var parts int64
+	var marker *int64
+
+	for {
+		attrs, err := s3session.GetObjectAttributes(&s3.GetObjectAttributesInput{
+			Bucket:           aws.String(bucket),
+			Key:              aws.String(key),
+			ObjectAttributes: aws.StringSlice([]string{s3.ObjectAttributesChecksum, s3.ObjectAttributesObjectParts}),
+			MaxParts:         aws.Int64(1000),
+			PartNumberMarker: marker,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		if attrs.Checksum == nil || attrs.Checksum.ChecksumSHA256 == nil {
+			return "", nil, fmt.Errorf("%w: %s has no SHA-256 checksum, it has to be uploaded with --checksum-algorithm SHA256", errUnverifiable, key)
+		}
+		checksum = *attrs.Checksum.ChecksumSHA256
+
+		if attrs.ObjectParts == nil {
+			break
+		}
+		parts = aws.Int64Value(attrs.ObjectParts.TotalPartsCount)
+		for _, part := range attrs.ObjectParts.Parts {
+			partSizes = append(partSizes, aws.Int64Value(part.Size))
+		}
+		if !aws.BoolValue(attrs.ObjectParts.IsTruncated) {
+			break
+		}
+		marker = attrs.ObjectParts.NextPartNumberMarker
+	}
+
+	if int64(len(partSizes)) != parts {
+		return "", nil, fmt.Errorf("%w: S3 listed %d of the %d parts of %s", errUnverifiable, len(partSizes), parts, key)
+	}
+
+	// GetObjectAttributes leaves out the part count which HEAD and
+	// CompleteMultipartUpload append.
+	if len(partSizes) > 0 && !strings.Contains(checksum, "-") {
+		checksum = fmt.Sprintf("%s-%d", checksum, len(partSizes))
+	}
+
+	return checksum, partSizes, nil
+}
+
+// matchChecksum checks the data in r against the object's checksum.
+func matchChecksum(r io.Reader, checksum string, partSizes []int64) (bool, error) {
+	w := newChecksumWriter(partSizes)
+	if _, err := io.Copy(w, r); err != nil {
+		return false, err
+	}
+	sum, err := w.Checksum()
+	return err == nil && sum == checksum, nil
+}
@@ -0,0 +1,170 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func compositeSHA256(data []byte, sizes []int64) string {
+	var digests []byte
+	for _, size := range sizes {
+		sum := sha256.Sum256(data[:size])
+		digests = append(digests, sum[:]...)
+		data = data[size:]
+	}
+	return fmt.Sprintf("%s-%d", sha256Base64(digests), len(sizes))
+}
+
+func TestCheckChecksumAlgorithm(t *testing.T) {
+	defer func() { ChecksumAlgorithm = "" }()
+
+	ChecksumAlgorithm = "sha256"
+	if err := checkChecksumAlgorithm(); err != nil || ChecksumAlgorithm != s3.ChecksumAlgorithmSha256 {
+		t.Errorf("sha256 became %q, %v", ChecksumAlgorithm, err)
+	}
+
+	ChecksumAlgorithm = "crc32"
+	if err := checkChecksumAlgorithm(); err == nil {
+		t.Error("crc32 was accepted")
+	}
+}
+
+func TestCheckVerify(t *testing.T) {
+	defer func() { ChecksumAlgorithm, VerifyUpload = "", VERIFY_MD5 }()
+
+	VerifyUpload = VERIFY_SHA256
+	if err := checkChecksumAlgorithm(); err != nil || ChecksumAlgorithm != s3.ChecksumAlgorithmSha256 {
+		t.Errorf("--verify sha256 left --checksum-algorithm %q, %v", ChecksumAlgorithm, err)
+	}
+
+	VerifyUpload = "crc32"
+	if err := checkChecksumAlgorithm(); err == nil {
+		t.Error("--verify crc32 was accepted")
+	}
+}
+
+func TestVerifyCompleted(t *testing.T) {
+	defer func() { ChecksumAlgorithm, VerifyUpload = "", VERIFY_MD5 }()
+
+	parts := []*s3.CompletedPart{
+		{PartNumber: aws.Int64(1), ChecksumSHA256: aws.String(sha256Base64([]byte("a")))},
+		{PartNumber: aws.Int64(2), ChecksumSHA256: aws.String(sha256Base64([]byte("b")))},
+	}
+	checksum, err := compositeChecksum(parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatch := errors.New("mismatch")
+
+	for _, c := range []struct {
+		verify    string
+		algorithm string
+		etag      string
+		checksum  string
+		want      error
+	}{
+		{VERIFY_MD5, "", `"ours-2"`, "", nil},
+		{VERIFY_MD5, "", `"theirs-2"`, "", mismatch},
+		{VERIFY_MD5, s3.ChecksumAlgorithmSha256, `"ours-2"`, "other-2", errors.New("checksum")},
+		// SSE-KMS ETags don't matter with sha256.
+		{VERIFY_SHA256, s3.ChecksumAlgorithmSha256, `"theirs-2"`, checksum, nil},
+		{VERIFY_SHA256, s3.ChecksumAlgorithmSha256, `"ours-2"`, "other-2", errors.New("checksum")},
+		{VERIFY_NONE, s3.ChecksumAlgorithmSha256, `"theirs-2"`, "other-2", nil},
+	} {
+		VerifyUpload, ChecksumAlgorithm = c.verify, c.algorithm
+		resp := &s3.CompleteMultipartUploadOutput{ETag: aws.String(c.etag)}
+		if c.checksum != "" {
+			resp.ChecksumSHA256 = aws.String(c.checksum)
+		}
+
+		err := verifyCompleted(resp, "ours-2", parts, mismatch)
+		switch {
+		case c.want == nil && err != nil:
+			t.Errorf("--verify %s, ETag %s, checksum %q: %v", c.verify, c.etag, c.checksum, err)
+		case c.want == mismatch && err != mismatch:
+			t.Errorf("--verify %s, ETag %s: got %v, want the mismatch", c.verify, c.etag, err)
+		case c.want != nil && c.want != mismatch && (err == nil || !strings.Contains(err.Error(), "checksum")):
+			t.Errorf("--verify %s, checksum %q: got %v, want a checksum error", c.verify, c.checksum, err)
+		}
+	}
+}
+
+func TestVerifyKMS(t *testing.T) {
+	defer func() { ChecksumAlgorithm = "" }()
+	ChecksumAlgorithm = s3.ChecksumAlgorithmSha256
+
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1000)
+	filename := writeTestFile(t, data)
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["archive.bin"]
+	if want := compositeSHA256(data, []int64{PART_SIZE, 1000}); obj.checksum != want {
+		t.Fatalf("the object has checksum %q, want %q", obj.checksum, want)
+	}
+
+	// With SSE-KMS, the ETag has nothing to do with the data.
+	obj.sse = s3.ServerSideEncryptionAwsKms
+	obj.etag = "0123456789abcdef0123456789abcdef-2"
+
+	if err := Verify(fake, "bucket", filename, ""); err != nil {
+		t.Error(err)
+	}
+
+	other := append([]byte{}, data...)
+	other[0] ^= 1
+	if err := Verify(fake, "bucket", writeTestFile(t, other), "archive.bin"); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Errorf("a changed file got %v", err)
+	}
+
+	obj.checksum = ""
+	if err := Verify(fake, "bucket", filename, ""); !errors.Is(err, errUnverifiable) {
+		t.Errorf("an object without checksum got %v", err)
+	}
+}
+
+func TestObjectChecksumPages(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(2500)
+	sizes := make([]int64, 2500)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	fake.objects["many"] = &fakeObject{data: data, partSizes: sizes, checksum: compositeSHA256(data, sizes)}
+
+	checksum, got, err := objectChecksum(fake, "bucket", "many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(sizes) {
+		t.Errorf("got %d parts, want %d", len(got), len(sizes))
+	}
+	if checksum != compositeSHA256(data, sizes) {
+		t.Errorf("got checksum %s", checksum)
+	}
+}
@@ -0,0 +1,222 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// add-checksums flags
+var AddChecksumsPrefix string
+var AddChecksumsDryRun bool
+var AddChecksumsRestoreTier string
+var AddChecksumsRestoreDays int64
+
+// Objects uploaded without --checksum-algorithm only have their ETag, an MD5
+// digest at best.  Copying an object onto itself with a checksum algorithm
+// has S3 read it and store its SHA-256 checksum, without the data leaving
+// AWS.  Archived objects can't be copied until they are restored, so those
+// take two runs: one requesting the restores, and one once they're done.
+
+var addChecksumsCmd = &cobra.Command{
+	Use:   "add-checksums",
+	Short: "Give objects uploaded without --checksum-algorithm a SHA-256 checksum",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return AddChecksums(newS3Session(Region), lazyCleanup(Region), BucketName, AddChecksumsPrefix, AddChecksumsRestoreTier, AddChecksumsRestoreDays, AddChecksumsDryRun)
+	},
+}
+
+// hasChecksum reports whether S3 has a SHA-256 checksum of the object.
+func hasChecksum(s3session s3iface.S3API, bucket string, key string) (bool, error) {
+	attrs, err := s3session.GetObjectAttributes(&s3.GetObjectAttributesInput{
+		Bucket:           aws.String(bucket),
+		Key:              aws.String(key),
+		ObjectAttributes: aws.StringSlice([]string{s3.ObjectAttributesChecksum}),
+	})
+	if err != nil {
+		return false, err
+	}
+	return attrs.Checksum != nil && attrs.Checksum.ChecksumSHA256 != nil, nil
+}
+
+// addChecksum copies obj onto itself with a SHA-256 checksum, keeping its
+// storage class, metadata, tags and encryption.  The copy is refused if the
+// object was replaced since head was taken.
+func addChecksum(s3session s3iface.S3API, cleanup cleanupSession, bucket string, obj archivedObject, head *s3.HeadObjectOutput) error {
+	if obj.Size <= MAX_COPY_PART_SIZE {
+		_, err := s3session.CopyObject(&s3.CopyObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(obj.Key),
+			CopySource:           aws.String((&url.URL{Path: bucket + "/" + obj.Key}).EscapedPath()),
+			CopySourceIfMatch:    head.ETag,
+			StorageClass:         aws.String(obj.StorageClass),
+			ServerSideEncryption: head.ServerSideEncryption,
+			SSEKMSKeyId:          head.SSEKMSKeyId,
+			ChecksumAlgorithm:    aws.String(s3.ChecksumAlgorithmSha256),
+		})
+		return err
+	}
+
+	tagging, err := s3session.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return err
+	}
+	var tags *string
+	if len(tagging.TagSet) > 0 {
+		values := url.Values{}
+		for _, tag := range tagging.TagSet {
+			values.Set(*tag.Key, *tag.Value)
+		}
+		tags = aws.String(values.Encode())
+	}
+
+	created, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(obj.Key),
+		StorageClass:         aws.String(obj.StorageClass),
+		Metadata:             head.Metadata,
+		ContentType:          head.ContentType,
+		ServerSideEncryption: head.ServerSideEncryption,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+		Tagging:              tags,
+		ChecksumAlgorithm:    aws.String(s3.ChecksumAlgorithmSha256),
+	})
+	if err != nil {
+		return err
+	}
+	return copyParts(s3session, cleanup, bucket, obj, strings.Trim(aws.StringValue(head.ETag), "\""), created)
+}
+
+// AddChecksums gives every object under prefix without a SHA-256 checksum
+// one.  Archived objects that aren't restored are skipped, or with a tier,
+// restored for days so the next run can copy them.
+func AddChecksums(s3session s3iface.S3API, cleanup cleanupSession, bucket string, prefix string, tier string, days int64, dryRun bool) error {
+	if tier != "" && days < 1 {
+		return errors.New("--restore-days has to be at least 1")
+	}
+
+	var seen, had, restoring int
+	var archived []archivedObject
+
+	err := walkObjects(s3session, bucket, prefix, func(obj archivedObject) error {
+		seen++
+
+		ok, err := hasChecksum(s3session, bucket, obj.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to read the checksum of %s: %w", obj.Key, err)
+		}
+		if ok {
+			had++
+			return nil
+		}
+
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(obj.Key),
+		})
+		if err != nil {
+			return err
+		}
+
+		restore := aws.StringValue(head.Restore)
+		if isArchived(obj.StorageClass) {
+			switch {
+			case strings.Contains(restore, `ongoing-request="true"`):
+				restoring++
+				return nil
+			case restore == "":
+				archived = append(archived, obj)
+				return nil
+			}
+		}
+
+		if dryRun {
+			ui.Println("Would add a checksum to", obj.Key)
+			return nil
+		}
+		if err := addChecksum(s3session, cleanup, bucket, obj, head); err != nil {
+			return fmt.Errorf("Failed to add a checksum to %s: %w", obj.Key, err)
+		}
+		ui.Println("Added a checksum to", obj.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("%d of %d objects needed a checksum\n", seen-had, seen)
+	if restoring > 0 {
+		ui.Printf("%d objects are still being restored, run again once they are\n", restoring)
+	}
+	if len(archived) == 0 {
+		return nil
+	}
+
+	if tier == "" {
+		for _, obj := range archived {
+			ui.Println("Archived, not restored:", obj.Key)
+		}
+		return fmt.Errorf("%d archived objects have to be restored first, run again with --restore-tier", len(archived))
+	}
+
+	var cost float64
+	for _, obj := range archived {
+		t, err := findTier(obj.StorageClass, tier)
+		if err != nil {
+			return err
+		}
+		cost += t.Cost(1, obj.Size)
+	}
+	if err := checkBudget(fmt.Sprintf("restoring %d objects", len(archived)), cost); err != nil {
+		return err
+	}
+
+	for _, obj := range archived {
+		if dryRun {
+			ui.Println("Would restore", obj.Key)
+			continue
+		}
+		if _, err := requestRestore(s3session, bucket, obj.Key, tier, days); err != nil {
+			return fmt.Errorf("Failed to restore %s: %w", obj.Key, err)
+		}
+		ui.Println("Restoring", obj.Key)
+	}
+	if !dryRun {
+		ui.Printf("Run add-checksums again once the %d restores are done\n", len(archived))
+	}
+	return nil
+}
+
+func init() {
+	addChecksumsCmd.Flags().StringVar(&AddChecksumsPrefix, "prefix", "", "only add checksums to objects under this prefix")
+	addChecksumsCmd.Flags().BoolVar(&AddChecksumsDryRun, "dry-run", false, "only show which objects would get a checksum")
+	addChecksumsCmd.Flags().StringVar(&AddChecksumsRestoreTier, "restore-tier", "", "restore archived objects with this tier, so the next run can add their checksums")
+	addChecksumsCmd.Flags().Int64Var(&AddChecksumsRestoreDays, "restore-days", 1, "how many days the restored copies stay readable")
+	rootCmd.AddCommand(addChecksumsCmd)
+}
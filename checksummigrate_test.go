@@ -0,0 +1,75 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestAddChecksums(t *testing.T) {
+	fake := newFakeS3()
+	add := func(key string, storageClass string, restored bool, checksum string) *fakeObject {
+		data := []byte(key)
+		obj := &fakeObject{data: data, etag: md5Hex(data), storageClass: storageClass, restored: restored, checksum: checksum,
+			tags: map[string]string{"project": "photos"}}
+		fake.objects[key] = obj
+		return obj
+	}
+	add("photos/old.tar", s3.StorageClassStandard, false, "")
+	add("photos/new.tar", s3.StorageClassStandard, false, "sum")
+	add("photos/restored.tar", s3.StorageClassGlacier, true, "")
+	add("photos/deep.tar", s3.StorageClassDeepArchive, false, "")
+
+	if err := AddChecksums(fake, fake.cleanup, "bucket", "photos/", "", 1, true); err == nil {
+		t.Error("an archived object was passed over without --restore-tier")
+	}
+	if fake.objects["photos/old.tar"].checksum != "" {
+		t.Error("--dry-run added a checksum")
+	}
+
+	if err := AddChecksums(fake, fake.cleanup, "bucket", "photos/", s3.TierBulk, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"photos/old.tar", "photos/restored.tar"} {
+		obj := fake.objects[key]
+		if obj.checksum != sha256Base64([]byte(key)) {
+			t.Errorf("%s has the checksum %q", key, obj.checksum)
+		}
+		if obj.tags["project"] != "photos" {
+			t.Errorf("%s lost its tags", key)
+		}
+	}
+	if got := fake.objects["photos/restored.tar"].storageClass; got != s3.StorageClassGlacier {
+		t.Errorf("the restored object is now in %s", got)
+	}
+	if got := fake.objects["photos/new.tar"].checksum; got != "sum" {
+		t.Errorf("an object with a checksum was copied again, it has %q", got)
+	}
+
+	deep := fake.objects["photos/deep.tar"]
+	if !deep.restored || deep.checksum != "" {
+		t.Fatalf("the archived object wasn't restored, or copied before it was")
+	}
+	if err := AddChecksums(fake, fake.cleanup, "bucket", "photos/", "", 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["photos/deep.tar"]; got.checksum != sha256Base64([]byte("photos/deep.tar")) || got.storageClass != s3.StorageClassDeepArchive {
+		t.Errorf("once restored, the archived object has the checksum %q in %s", got.checksum, got.storageClass)
+	}
+}
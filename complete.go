@@ -0,0 +1,208 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// complete flags
+var (
+	CompleteKey      string
+	CompleteUploadID string
+)
+
+var completeCmd = &cobra.Command{
+	Use:   "complete [file]",
+	Short: "Complete an upload whose parts were all sent, from the parts S3 has",
+	Long: `Complete an upload whose parts were all sent, but which wasn't completed,
+say because the upload crashed at the very end.  The parts are looked up with
+ListParts.  Given the file, the parts are checked against it first.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var filename string
+		if len(args) > 0 {
+			filename = args[0]
+		}
+		return Complete(newS3Session(Region), BucketName, filename, CompleteKey, CompleteUploadID)
+	},
+}
+
+// completedPartsFrom puts the parts S3 has in the order they're completed
+// in, and works out the ETag of the object they make up, or "" if their
+// ETags aren't MD5 digests, as with SSE-KMS.  The parts have to be numbered
+// from 1 without gaps, and all but the last the same size; size, if known,
+// is what they have to add up to.
+func completedPartsFrom(parts map[int64]*s3.Part, size int64) ([]*s3.CompletedPart, []int64, string, error) {
+	if len(parts) == 0 {
+		return nil, nil, "", fmt.Errorf("S3 has no parts of the upload")
+	}
+
+	var completed []*s3.CompletedPart
+	var sizes []int64
+	var total int64
+	var digests []byte
+	md5s := true
+
+	for i, n := range sortedPartNumbers(parts) {
+		if n != int64(i+1) {
+			return nil, nil, "", fmt.Errorf("Parts %d to %d are missing, parts repair uploads them", i+1, n-1)
+		}
+		part := parts[n]
+		partSize := aws.Int64Value(part.Size)
+		if i > 0 && sizes[i-1] != sizes[0] {
+			return nil, nil, "", fmt.Errorf("Part %d is %d bytes, but part 1 is %d, so it can't be the last part", i, sizes[i-1], sizes[0])
+		}
+		if i > 0 && partSize > sizes[0] {
+			return nil, nil, "", fmt.Errorf("Part %d is %d bytes, more than the %d of part 1", n, partSize, sizes[0])
+		}
+
+		completed = append(completed, &s3.CompletedPart{
+			ETag:           part.ETag,
+			PartNumber:     part.PartNumber,
+			ChecksumSHA256: part.ChecksumSHA256,
+		})
+		sizes = append(sizes, partSize)
+		total += partSize
+
+		digest, err := hex.DecodeString(strings.Trim(aws.StringValue(part.ETag), "\""))
+		if err != nil || len(digest) != 16 {
+			md5s = false
+		}
+		digests = append(digests, digest...)
+	}
+
+	if size > 0 && total != size {
+		return nil, nil, "", fmt.Errorf("The %d parts add up to %s, not %s, parts repair uploads the rest", len(parts), formatBytes(total), formatBytes(size))
+	}
+
+	var etag string
+	if md5s {
+		etag = fmt.Sprintf("%s-%d", calculateMd5Digest(digests), len(parts))
+	}
+	return completed, sizes, etag, nil
+}
+
+// Complete finishes an upload from the parts S3 has of it.  How big the
+// object should be comes from the file, if given, or the journal of the
+// upload; without either, parts missing at the end can't be noticed.
+func Complete(s3session s3iface.S3API, bucket string, filename string, key string, uploadID string) error {
+	if key == "" && uploadID == "" && filename != "" {
+		var err error
+		if key, err = uploadKey(filename); err != nil {
+			return err
+		}
+	}
+	key, uploadID, err := resolveUpload(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	journal, _ := uploadJournalFor(bucket, key, uploadID)
+	if filename != "" {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+	} else if journal != nil {
+		size = journal.Size
+	}
+
+	parts, err := listUploadedParts(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	completedParts, sizes, etag, err := completedPartsFrom(parts, size)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		ui.Printf("Without the file or a journal of the upload, parts after part %d can't be told apart from none\n", len(parts))
+	}
+
+	if filename != "" && etag != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		ours, err := computeETag(f, sizes)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if ours != etag {
+			return fmt.Errorf("The parts S3 has don't match %s, parts repair uploads them again", filename)
+		}
+		ui.Printf("The %d parts match %s\n", len(parts), filename)
+	}
+
+	resp, err := s3session.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to complete upload %s of %s: %w", uploadID, key, err)
+	}
+
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			ui.Warnln("Failed to remove the upload journal:", err)
+		}
+	}
+
+	var total int64
+	for _, s := range sizes {
+		total += s
+	}
+	ui.Printf("Completed %s from %d parts, %s\n", key, len(parts), formatBytes(total))
+
+	if etag == "" {
+		// The parts' checksums are all there is to go by.
+		if VerifyUpload == VERIFY_NONE || completedParts[0].ChecksumSHA256 == nil {
+			ui.Println("Not verified, the parts' ETags aren't MD5 digests")
+		} else if err := checkCompositeChecksum(resp, completedParts); err != nil {
+			return err
+		} else {
+			ui.Println("Checksums match!")
+		}
+	} else if err := verifyCompleted(resp, etag, completedParts, fmt.Errorf("The completed object doesn't match its parts")); err != nil {
+		return err
+	}
+
+	ui.Println(aws.StringValue(resp.Location))
+	return nil
+}
+
+func init() {
+	completeCmd.Flags().StringVar(&CompleteKey, "key", "", "the key of the upload, looked up if not given")
+	completeCmd.Flags().StringVar(&CompleteUploadID, "upload-id", "", "the upload, taken from the journal of --key if not given")
+	rootCmd.AddCommand(completeCmd)
+}
@@ -0,0 +1,152 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// uncompletedS3 fails to complete uploads, as if the upload crashed after
+// sending its last part.
+type uncompletedS3 struct {
+	*fakeS3
+}
+
+func (f *uncompletedS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return nil, awserr.New("InternalError", "We encountered an internal error", nil)
+}
+
+func uncompletedUpload(t *testing.T, filename string) *fakeS3 {
+	fake := &uncompletedS3{newFakeS3()}
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err == nil {
+		t.Fatal("the upload was completed")
+	}
+	return fake.fakeS3
+}
+
+func TestCompletedPartsFrom(t *testing.T) {
+	part := func(n int64, data string) *s3.Part {
+		return &s3.Part{PartNumber: aws.Int64(n), Size: aws.Int64(int64(len(data))), ETag: quote(md5Hex([]byte(data)))}
+	}
+
+	parts := map[int64]*s3.Part{1: part(1, "aaaa"), 2: part(2, "bbbb"), 3: part(3, "cc")}
+	completed, sizes, etag, err := completedPartsFrom(parts, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 3 || *completed[2].PartNumber != 3 {
+		t.Errorf("completed parts %v", completed)
+	}
+	if want := multipartETag([]byte("aaaabbbbcc"), sizes); etag != want {
+		t.Errorf("ETag %s, want %s", etag, want)
+	}
+
+	for _, c := range []struct {
+		parts map[int64]*s3.Part
+		size  int64
+		want  string
+	}{
+		{map[int64]*s3.Part{}, 0, "no parts"},
+		{map[int64]*s3.Part{1: part(1, "aaaa"), 3: part(3, "cc")}, 0, "Parts 2 to 2 are missing"},
+		{map[int64]*s3.Part{2: part(2, "cc")}, 0, "Parts 1 to 1 are missing"},
+		{map[int64]*s3.Part{1: part(1, "aaaa"), 2: part(2, "cc"), 3: part(3, "cc")}, 0, "can't be the last part"},
+		{map[int64]*s3.Part{1: part(1, "aa"), 2: part(2, "cccc")}, 0, "more than"},
+		{map[int64]*s3.Part{1: part(1, "aaaa"), 2: part(2, "bbbb")}, 10, "parts repair"},
+	} {
+		if _, _, _, err := completedPartsFrom(c.parts, c.size); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%d parts of %d bytes: got %v, want %q", len(c.parts), c.size, err, c.want)
+		}
+	}
+
+	parts[2].ETag = aws.String(`"kms-encrypted"`)
+	if _, _, etag, err := completedPartsFrom(parts, 10); err != nil || etag != "" {
+		t.Errorf("SSE-KMS parts: ETag %q, %v", etag, err)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := uncompletedUpload(t, filename)
+
+	if err := Complete(fake, "bucket", filename, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the completed upload doesn't contain the file")
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d uploads left unfinished", len(fake.uploads))
+	}
+	if journal, err := loadJournal("bucket", "archive.bin"); err != nil || journal != nil {
+		t.Errorf("the journal is left behind: %v", err)
+	}
+}
+
+func TestCompleteWithoutFile(t *testing.T) {
+	data := randomData(PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := uncompletedUpload(t, filename)
+
+	// The journal is enough to find the upload and its size.
+	if err := Complete(fake, "bucket", "", "archive.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the completed upload doesn't contain the file")
+	}
+}
+
+func TestCompleteMissingParts(t *testing.T) {
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := interruptedUpload(t, filename)
+
+	err := Complete(fake.fakeS3, "bucket", filename, "", "")
+	if err == nil || !strings.Contains(err.Error(), "parts repair") {
+		t.Errorf("completed an upload missing its last part: %v", err)
+	}
+	if len(fake.uploads) != 1 {
+		t.Error("the upload is gone")
+	}
+}
+
+func TestCompleteChangedFile(t *testing.T) {
+	data := randomData(PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := uncompletedUpload(t, filename)
+
+	data[0]++
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := Complete(fake, "bucket", filename, "", "")
+	if err == nil || !strings.Contains(err.Error(), "don't match") {
+		t.Errorf("completed parts of another file: %v", err)
+	}
+	if _, ok := fake.objects["archive.bin"]; ok {
+		t.Error("the upload was completed")
+	}
+}
@@ -0,0 +1,146 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var CompletionRecord bool
+
+// A completion record is a sidecar in STANDARD next to every archive, signed
+// with the --signing-key, which says what was archived, when, and by whom.
+// It's evidence kept in the bucket itself that this payload was there at
+// that time, for whoever has to prove it later.
+const COMPLETION_RECORD_SUFFIX = ".completion.json"
+
+type completionRecord struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"etag"`
+	// SHA256 is of the file uploaded, ChecksumSHA256 S3's own, with
+	// --checksum-algorithm SHA256.
+	SHA256         string `json:"sha256,omitempty"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	StorageClass   string `json:"storage_class"`
+	UploadID       string `json:"upload_id,omitempty"`
+	Source         string `json:"source"`
+	// Completed is our clock, LastModified S3's.
+	Completed    time.Time  `json:"completed"`
+	LastModified time.Time  `json:"last_modified"`
+	LockMode     string     `json:"object_lock_mode,omitempty"`
+	RetainUntil  *time.Time `json:"retain_until,omitempty"`
+	Tool         string     `json:"tool"`
+	Operator     string     `json:"operator"`
+	Host         string     `json:"host"`
+}
+
+func checkCompletionRecord() error {
+	if CompletionRecord && SigningKey == "" {
+		return fmt.Errorf("--completion-record needs a --signing-key, a record anyone could have written proves nothing")
+	}
+	return nil
+}
+
+// newCompletionRecord describes the upload in entry as S3 has it now.
+func newCompletionRecord(s3session s3iface.S3API, entry catalogEntry, uploadID string, now time.Time) (*completionRecord, error) {
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(entry.Bucket),
+		Key:          aws.String(entry.Key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if etag := strings.Trim(aws.StringValue(head.ETag), "\""); etag != strings.Trim(entry.ETag, "\"") {
+		return nil, fmt.Errorf("%s has changed since it was uploaded, its ETag is %s", entry.Key, etag)
+	}
+
+	storageClass := aws.StringValue(head.StorageClass)
+	if storageClass == "" {
+		storageClass = s3.StorageClassStandard
+	}
+	var retainUntil *time.Time
+	if head.ObjectLockRetainUntilDate != nil {
+		t := head.ObjectLockRetainUntilDate.UTC()
+		retainUntil = &t
+	}
+	return &completionRecord{
+		Bucket:         entry.Bucket,
+		Key:            entry.Key,
+		VersionID:      aws.StringValue(head.VersionId),
+		Size:           aws.Int64Value(head.ContentLength),
+		ETag:           strings.Trim(entry.ETag, "\""),
+		SHA256:         entry.SHA256,
+		ChecksumSHA256: aws.StringValue(head.ChecksumSHA256),
+		StorageClass:   storageClass,
+		UploadID:       uploadID,
+		Source:         entry.Path,
+		Completed:      now.UTC(),
+		LastModified:   aws.TimeValue(head.LastModified).UTC(),
+		LockMode:       aws.StringValue(head.ObjectLockMode),
+		RetainUntil:    retainUntil,
+		Tool:           "s3-glacier-uploader " + Version,
+		Operator:       auditUser(),
+		Host:           auditHost(),
+	}, nil
+}
+
+// uploadCompletionRecord stores the signed completion record of a finished
+// upload next to it.
+func uploadCompletionRecord(s3session s3iface.S3API, entry catalogEntry, uploadID string) error {
+	if !CompletionRecord {
+		return nil
+	}
+	record, err := newCompletionRecord(s3session, entry, uploadID, time.Now())
+	if err != nil {
+		return fmt.Errorf("Failed to make the completion record of %s: %w", entry.Key, err)
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	key := entry.Key + COMPLETION_RECORD_SUFFIX
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(entry.Bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+		Tagging:      objectTagging(entry.Key),
+	})
+	if err == nil {
+		err = putSignature(s3session, entry.Bucket, key, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to upload the completion record of %s: %w", entry.Key, err)
+	}
+	ui.Printf("Uploaded the completion record to %s\n", key)
+	return nil
+}
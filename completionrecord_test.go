@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompletionRecord(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CompletionRecord, signingPrivateKey = true, private
+	defer func() { CompletionRecord, signingPrivateKey = false, nil }()
+
+	fake := newFakeS3()
+	data := randomData(2*PART_SIZE + 10)
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "archive.bin" + COMPLETION_RECORD_SUFFIX
+	var record completionRecord
+	if found, err := getJSON(fake, "bucket", key, &record); !found || err != nil {
+		t.Fatalf("the record wasn't uploaded: %v", err)
+	}
+	obj := fake.objects["archive.bin"]
+	if record.Key != "archive.bin" || record.Size != int64(len(data)) || record.ETag != obj.etag || record.SHA256 != fmt.Sprintf("%x", sha256.Sum256(data)) {
+		t.Errorf("got record %+v", record)
+	}
+	if record.Completed.IsZero() || !strings.HasPrefix(record.Tool, "s3-glacier-uploader ") || record.Operator == "" {
+		t.Errorf("the record doesn't say when or by whom: %+v", record)
+	}
+	if !isSidecar(key) {
+		t.Error("the record isn't a sidecar")
+	}
+
+	// It's signed, and the signature is of the record.
+	if err := verifySignature(fake, "bucket", key, fake.objects[key].data, public); err != nil {
+		t.Error(err)
+	}
+	if err := verifySignature(fake, "bucket", key, []byte("{}"), public); err == nil {
+		t.Error("the signature matches another record")
+	}
+}
+
+func TestCheckCompletionRecord(t *testing.T) {
+	defer func() { CompletionRecord, SigningKey = false, "" }()
+
+	CompletionRecord = true
+	if err := checkCompletionRecord(); err == nil {
+		t.Error("took --completion-record without a --signing-key")
+	}
+	SigningKey = "upload.key"
+	if err := checkCompletionRecord(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,198 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+	"github.com/honza/s3-glacier-uploader/pkg/uploader"
+	"github.com/spf13/cobra"
+)
+
+const (
+	MIN_PART_SIZE      = uploader.MinPartSize
+	MAX_COPY_PART_SIZE = 5 * 1024 * 1024 * 1024
+	MAX_PARTS          = uploader.MaxParts
+)
+
+// compose flags
+var ComposeKey string
+
+var composeCmd = &cobra.Command{
+	Use:   "compose source[:range]...",
+	Short: "Build a new object out of (parts of) existing objects on the server side",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Compose(BucketName, Region, ComposeKey, args)
+	},
+}
+
+type composeSource struct {
+	Key   string
+	ETag  string
+	First int64
+	Last  int64
+}
+
+// parseComposeSource splits "key:100-199" into the key and range.  Keys can
+// contain colons themselves, so the suffix only counts if it's a valid range.
+func parseComposeSource(s3session s3iface.S3API, bucket string, spec string) (composeSource, error) {
+	key, byteRange := spec, ""
+	if i := strings.LastIndex(spec, ":"); i >= 0 && byteRangePattern.MatchString(spec[i+1:]) {
+		key, byteRange = spec[:i], spec[i+1:]
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return composeSource{}, fmt.Errorf("Failed to look up %s: %w", key, err)
+	}
+
+	// Archived objects can't be the source of a copy.
+	if err := checkRestored(key, head); err != nil {
+		return composeSource{}, err
+	}
+
+	first, last, err := parseByteRange(byteRange, *head.ContentLength)
+	if err != nil {
+		return composeSource{}, err
+	}
+
+	return composeSource{key, strings.Trim(*head.ETag, "\""), first, last}, nil
+}
+
+// splitSource cuts a source into as few copy parts as S3 allows, all of about
+// the same size.  Cutting off 5GB parts one after another could leave a tiny
+// remainder, which S3 refuses unless it's the very last part.
+func splitSource(source composeSource) []int64 {
+	size := source.Last - source.First + 1
+	count := (size + MAX_COPY_PART_SIZE - 1) / MAX_COPY_PART_SIZE
+	partSize := (size + count - 1) / count
+
+	return transfer.PartSizes(size, partSize)
+}
+
+func abortCompose(region string, upload *s3.CreateMultipartUploadOutput) error {
+	cleanup, err := newDestructiveS3Session(region)
+	if err != nil {
+		return err
+	}
+
+	_, err = cleanup.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   upload.Bucket,
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	})
+	return err
+}
+
+func Compose(bucket string, region string, key string, specs []string) error {
+	if key == "" {
+		return fmt.Errorf("Tell us which object to create with --key")
+	}
+
+	s3session := newS3Session(region)
+
+	var sources []composeSource
+	for i, spec := range specs {
+		source, err := parseComposeSource(s3session, bucket, spec)
+		if err != nil {
+			return err
+		}
+
+		// Every part but the last has to be at least 5MB.
+		if i < len(specs)-1 && source.Last-source.First+1 < MIN_PART_SIZE {
+			return fmt.Errorf("%s is smaller than 5MB, only the last source can be", spec)
+		}
+
+		sources = append(sources, source)
+	}
+
+	var partCount int
+	for _, source := range sources {
+		partCount += len(splitSource(source))
+	}
+	if partCount > MAX_PARTS {
+		return fmt.Errorf("The sources need %d parts, S3 allows at most %d", partCount, MAX_PARTS)
+	}
+
+	createdResp, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		StorageClass:         uploadStorageClass(),
+		ChecksumAlgorithm:    checksumAlgorithm(),
+		Tagging:              objectTagging(key),
+		ServerSideEncryption: serverSideEncryption(),
+		SSEKMSKeyId:          sseKMSKeyID(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var completedParts []*s3.CompletedPart
+	var partNum = 1
+	var size int64
+
+	for _, source := range sources {
+		offset := source.First
+		for _, length := range splitSource(source) {
+			result := copyPart(s3session, createdResp, bucket, source.Key, source.ETag, offset, length, partNum)
+			if result.err != nil {
+				// Nothing has been sent, so there's nothing worth keeping.
+				err := fmt.Errorf("Failed to copy part %d from %s: %w", partNum, source.Key, result.err)
+				if abortErr := abortCompose(region, createdResp); abortErr != nil {
+					return fmt.Errorf("%w; the upload %s wasn't aborted: %v", err, *createdResp.UploadId, abortErr)
+				}
+				return err
+			}
+
+			completedParts = append(completedParts, result.completedPart)
+			partNum++
+			offset += length
+			size += length
+		}
+	}
+
+	resp, err := s3session.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   createdResp.Bucket,
+		Key:      createdResp.Key,
+		UploadId: createdResp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("Composed %s out of %d parts from %d sources\n", formatBytes(size), len(completedParts), len(sources))
+	ui.Println(*resp.Location)
+
+	return nil
+}
+
+func init() {
+	composeCmd.Flags().StringVar(&ComposeKey, "key", "", "key of the object to create")
+	rootCmd.AddCommand(composeCmd)
+}
@@ -0,0 +1,57 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestSplitSource(t *testing.T) {
+	const GiB = 1024 * 1024 * 1024
+
+	tests := []struct {
+		name  string
+		size  int64
+		parts int
+	}{
+		{"small", 10 * 1024 * 1024, 1},
+		{"exactly the limit", MAX_COPY_PART_SIZE, 1},
+		{"just over the limit", MAX_COPY_PART_SIZE + 1, 2},
+		{"tiny remainder", 2*MAX_COPY_PART_SIZE + 1024, 3},
+		{"large", 100 * GiB, 20},
+	}
+
+	for _, tt := range tests {
+		sizes := splitSource(composeSource{Key: "k", First: 1000, Last: 1000 + tt.size - 1})
+
+		if len(sizes) != tt.parts {
+			t.Errorf("%s: got %d parts, want %d", tt.name, len(sizes), tt.parts)
+		}
+
+		var total int64
+		for i, size := range sizes {
+			total += size
+			if size > MAX_COPY_PART_SIZE {
+				t.Errorf("%s: part %d is %d bytes, over the copy limit", tt.name, i+1, size)
+			}
+			if len(sizes) > 1 && size < MIN_PART_SIZE {
+				t.Errorf("%s: part %d is only %d bytes", tt.name, i+1, size)
+			}
+		}
+		if total != tt.size {
+			t.Errorf("%s: parts add up to %d, want %d", tt.name, total, tt.size)
+		}
+	}
+}
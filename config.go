@@ -0,0 +1,352 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// CLI flags
+var ConfigFile string
+var ConfigProfile string
+
+// config show flags
+var ConfigEffective bool
+
+// Settings come from, in this order: the command line, S3_GLACIER_<FLAG>
+// environment variables and the config file.  Only the main command's flags
+// can be set there, not those of other commands.
+const (
+	CONFIG_ENV_PREFIX = "S3_GLACIER_"
+	SOURCE_DEFAULT    = "default"
+)
+
+// Commands annotated with this are given the main command's flags, and
+// check them themselves instead of failing before they run.
+const ANNOTATION_SHOWS_CONFIG = "shows-config"
+
+// configSources says where the value of every flag came from, for config
+// show.
+var configSources = map[string]string{}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Set up and look into the configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:         "show",
+	Short:       "Show the settings which aren't defaults, or with --effective all of them, where they come from and what's wrong with them",
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{ANNOTATION_SHOWS_CONFIG: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ConfigShow(ui.Writer(), cmd.Root(), ConfigEffective)
+	},
+}
+
+func showsConfig(cmd *cobra.Command) bool {
+	return cmd.Annotations[ANNOTATION_SHOWS_CONFIG] != ""
+}
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "s3-glacier-uploader", "config")
+}
+
+// configEnv is the environment variable setting a flag, e.g.
+// S3_GLACIER_STORAGE_CLASS for --storage-class.
+func configEnv(name string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configSetting is a line of the config file.  Settings of a profile are
+// only used with --profile.
+type configSetting struct {
+	Name    string
+	Value   string
+	Source  string
+	Profile string
+}
+
+// parseConfig reads settings like "storage-class = GLACIER", one per line,
+// with # starting comments.  Flags which can be repeated, like tag, can be
+// set on several lines.  A line like "[photos]" starts the settings of the
+// photos profile.
+func parseConfig(r io.Reader, filename string) ([]configSetting, error) {
+	var settings []configSetting
+	profile := ""
+	lines := bufio.NewScanner(r)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			profile = strings.TrimSpace(line[1 : len(line)-1])
+			if profile == "" {
+				return nil, fmt.Errorf("%s:%d: profiles need a name", filename, n)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: settings look like name = value, got %q", filename, n, line)
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "--")
+		settings = append(settings, configSetting{name, strings.TrimSpace(parts[1]), fmt.Sprintf("%s:%d", filename, n), profile})
+	}
+	return settings, lines.Err()
+}
+
+// profileSettings picks the settings of the profile out of the config
+// file's.  A setting the profile has replaces the one outside of profiles,
+// all of its lines for flags like tag.
+func profileSettings(settings []configSetting, profile string, filename string) ([]configSetting, error) {
+	found := false
+	own := map[string]bool{}
+	for _, s := range settings {
+		if profile != "" && s.Profile == profile {
+			found = true
+			own[s.Name] = true
+		}
+	}
+	if profile != "" && !found {
+		return nil, fmt.Errorf("There's no profile %s in %s", profile, filename)
+	}
+
+	var picked []configSetting
+	for _, s := range settings {
+		if (s.Profile == "" && !own[s.Name]) || (profile != "" && s.Profile == profile) {
+			picked = append(picked, s)
+		}
+	}
+	return picked, nil
+}
+
+// selectedProfile is the profile of the config file to use, from --profile
+// or $S3_GLACIER_PROFILE.
+func selectedProfile() string {
+	if ConfigProfile != "" {
+		return ConfigProfile
+	}
+	return os.Getenv(configEnv("profile"))
+}
+
+// configurableFlag finds a flag settings can be given for.  The main
+// command's own flags, like --key, only count for uploads, other commands
+// have flags of the same name which mean something else.
+func configurableFlag(root *cobra.Command, name string, upload bool) (*pflag.Flag, bool) {
+	if name == "help" || name == "version" || name == "config" || name == "profile" || name == "config-verify-key" {
+		return nil, false
+	}
+	if f := root.PersistentFlags().Lookup(name); f != nil {
+		return f, true
+	}
+	f := root.LocalNonPersistentFlags().Lookup(name)
+	if f == nil {
+		return nil, false
+	}
+	if !upload {
+		return nil, true
+	}
+	return f, true
+}
+
+// applyConfig fills in the flags which weren't given on the command line
+// from the environment and the config file, and records where every value
+// came from.  The flags aren't marked as changed, so they still count as
+// unset where that makes a difference.
+func applyConfig(cmd *cobra.Command) error {
+	root := cmd.Root()
+	upload := !cmd.HasParent() || showsConfig(cmd)
+
+	filename, fromFlag := ConfigFile, ConfigFile != ""
+	if !fromFlag {
+		filename = os.Getenv(configEnv("config"))
+	}
+	explicit := filename != ""
+	if !explicit {
+		filename = defaultConfigFile()
+	}
+
+	var flags []*pflag.Flag
+	root.PersistentFlags().VisitAll(func(f *pflag.Flag) { flags = append(flags, f) })
+	root.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) { flags = append(flags, f) })
+
+	// The command line and the environment come first, so that a config
+	// file in S3 is fetched with the region and credentials they give.
+	configSources = map[string]string{}
+	var rest []*pflag.Flag
+	for _, f := range flags {
+		if g, _ := configurableFlag(root, f.Name, upload); g == nil {
+			continue
+		}
+		if cmd.Flags().Lookup(f.Name) == f && cmd.Flags().Changed(f.Name) {
+			configSources[f.Name] = "--" + f.Name
+			continue
+		}
+
+		if value, ok := os.LookupEnv(configEnv(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				return fmt.Errorf("Invalid $%s: %w", configEnv(f.Name), err)
+			}
+			configSources[f.Name] = "$" + configEnv(f.Name)
+			continue
+		}
+		rest = append(rest, f)
+	}
+
+	settings, err := readConfig(filename, explicit)
+	if err != nil {
+		return err
+	}
+	if settings, err = profileSettings(settings, selectedProfile(), filename); err != nil {
+		return err
+	}
+
+	fromFile := map[string][]configSetting{}
+	for _, s := range settings {
+		if _, known := configurableFlag(root, s.Name, true); !known {
+			return fmt.Errorf("%s: there's no setting %s", s.Source, s.Name)
+		}
+		fromFile[s.Name] = append(fromFile[s.Name], s)
+	}
+
+	for _, f := range rest {
+		if file := fromFile[f.Name]; len(file) > 0 {
+			for _, s := range file {
+				if err := f.Value.Set(s.Value); err != nil {
+					return fmt.Errorf("%s: invalid %s: %w", s.Source, s.Name, err)
+				}
+			}
+			configSources[f.Name] = file[0].Source
+			continue
+		}
+
+		configSources[f.Name] = SOURCE_DEFAULT
+	}
+
+	if fromFlag {
+		configSources["config"] = "--config"
+	} else if explicit {
+		configSources["config"] = "$" + configEnv("config")
+	}
+	return nil
+}
+
+// readConfig reads the settings in the config file, which can be in S3.  A
+// missing file is only an error if one was named.
+func readConfig(filename string, explicit bool) ([]configSetting, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(filename, "s3://") {
+		data, err := fetchRemoteConfig(newS3Session(Region), filename)
+		if err != nil {
+			return nil, err
+		}
+		return parseConfig(bytes.NewReader(data), filename)
+	}
+
+	f, err := os.Open(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("Failed to read the config file: %w", err)
+	}
+	defer f.Close()
+	return parseConfig(f, filename)
+}
+
+// ConfigShow prints every setting with its value and where it came from,
+// then what's wrong with them, checked as they would be for an upload.
+func ConfigShow(w io.Writer, root *cobra.Command, effective bool) error {
+	// Checking comes first, as it also puts values in their usual form,
+	// like storage classes in upper case.
+	var problems []error
+	for _, check := range flagChecks(true) {
+		if err := check(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	var names []string
+	for name, source := range configSources {
+		if name != "config" && (effective || source != SOURCE_DEFAULT) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		f, _ := configurableFlag(root, name, true)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, f.Value.String(), configSources[name])
+	}
+	tw.Flush()
+
+	if source, ok := configSources["config"]; ok {
+		fmt.Fprintf(w, "\nConfig file: %s (from %s)\n", ConfigFileName(), source)
+	} else if filename := defaultConfigFile(); filename != "" {
+		fmt.Fprintf(w, "\nConfig file: %s\n", filename)
+	}
+	if profile := selectedProfile(); profile != "" {
+		fmt.Fprintf(w, "Profile: %s\n", profile)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	for _, err := range problems {
+		fmt.Fprintln(w, "Problem:", err)
+	}
+	return fmt.Errorf("Found %d problems with the settings", len(problems))
+}
+
+// ConfigFileName is the config file in use, if any.
+func ConfigFileName() string {
+	if ConfigFile != "" {
+		return ConfigFile
+	}
+	if filename := os.Getenv(configEnv("config")); filename != "" {
+		return filename
+	}
+	return defaultConfigFile()
+}
+
+func init() {
+	configShowCmd.Flags().BoolVar(&ConfigEffective, "effective", false, "show every setting, defaults included")
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,255 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestConfigEnv(t *testing.T) {
+	if env := configEnv("storage-class"); env != "S3_GLACIER_STORAGE_CLASS" {
+		t.Errorf("got %s", env)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	settings, err := parseConfig(strings.NewReader(`
+# Backups of the laptop
+bucket = backups
+--tag = project=photos
+tag=host=laptop
+`), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configSetting{
+		{"bucket", "backups", "config:3", ""},
+		{"tag", "project=photos", "config:4", ""},
+		{"tag", "host=laptop", "config:5", ""},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("got %+v", settings)
+	}
+
+	if _, err := parseConfig(strings.NewReader("bucket backups\n"), "config"); err == nil || !strings.Contains(err.Error(), "config:1") {
+		t.Errorf("a line without = gave %v", err)
+	}
+}
+
+// configTestCommands is a main command with a few flags like ours, and a
+// command with a --key of its own.
+type configTestCommands struct {
+	root, sub           *cobra.Command
+	bucket, region, key string
+	tags                []string
+	subKey              string
+}
+
+func newConfigTestCommands() *configTestCommands {
+	c := &configTestCommands{
+		root: &cobra.Command{Use: "root"},
+		sub:  &cobra.Command{Use: "sub"},
+	}
+	c.root.PersistentFlags().StringVar(&c.bucket, "bucket", "", "")
+	c.root.PersistentFlags().StringVar(&c.region, "region", "us-east-1", "")
+	c.root.PersistentFlags().StringArrayVar(&c.tags, "tag", nil, "")
+	c.root.Flags().StringVar(&c.key, "key", "", "")
+	c.sub.Flags().StringVar(&c.subKey, "key", "", "")
+	c.root.AddCommand(c.sub)
+	return c
+}
+
+func writeConfig(t *testing.T, config string) string {
+	p := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(p, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func() { ConfigFile = "" }()
+	ConfigFile = writeConfig(t, "bucket = from-file\nregion = eu-central-1\ntag = a=b\ntag = c=d\nkey = archive.tar\n")
+	t.Setenv("S3_GLACIER_REGION", "eu-west-1")
+
+	c := newConfigTestCommands()
+	if err := c.root.ParseFlags([]string{"--bucket", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.root); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.bucket != "from-flag" || c.region != "eu-west-1" || c.key != "archive.tar" || !reflect.DeepEqual(c.tags, []string{"a=b", "c=d"}) {
+		t.Errorf("bucket %s, region %s, key %s, tags %v", c.bucket, c.region, c.key, c.tags)
+	}
+	want := map[string]string{
+		"bucket": "--bucket",
+		"region": "$S3_GLACIER_REGION",
+		"tag":    ConfigFile + ":3",
+		"key":    ConfigFile + ":5",
+		"config": "--config",
+	}
+	if !reflect.DeepEqual(configSources, want) {
+		t.Errorf("sources %v", configSources)
+	}
+	if c.root.Flags().Changed("region") {
+		t.Error("a setting from the environment counts as given on the command line")
+	}
+
+	// The main command's --key is the upload's, not that of other commands.
+	c = newConfigTestCommands()
+	if err := c.sub.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.sub); err != nil {
+		t.Fatal(err)
+	}
+	if c.subKey != "" || c.key != "" || c.bucket != "from-file" {
+		t.Errorf("key %q, the other command's key %q, bucket %s", c.key, c.subKey, c.bucket)
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	defer func() { ConfigFile, ConfigProfile = "", "" }()
+	ConfigFile = writeConfig(t, `
+bucket = backups
+region = eu-west-1
+tag = host=laptop
+
+[photos]
+bucket = photos
+tag = project=photos
+tag = kind=raw
+
+[scratch]
+bucket = scratch
+`)
+
+	c := newConfigTestCommands()
+	if err := c.root.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.root); err != nil {
+		t.Fatal(err)
+	}
+	if c.bucket != "backups" || !reflect.DeepEqual(c.tags, []string{"host=laptop"}) {
+		t.Errorf("without a profile: bucket %s, tags %v", c.bucket, c.tags)
+	}
+
+	// The profile's settings win, the rest still count.
+	ConfigProfile = "photos"
+	c = newConfigTestCommands()
+	if err := c.root.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.root); err != nil {
+		t.Fatal(err)
+	}
+	if c.bucket != "photos" || c.region != "eu-west-1" || !reflect.DeepEqual(c.tags, []string{"project=photos", "kind=raw"}) {
+		t.Errorf("photos: bucket %s, region %s, tags %v", c.bucket, c.region, c.tags)
+	}
+	if configSources["bucket"] != ConfigFile+":7" {
+		t.Errorf("the bucket came from %s", configSources["bucket"])
+	}
+
+	// Flags still win over the profile.
+	c = newConfigTestCommands()
+	if err := c.root.ParseFlags([]string{"--bucket", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.root); err != nil {
+		t.Fatal(err)
+	}
+	if c.bucket != "from-flag" {
+		t.Errorf("bucket %s", c.bucket)
+	}
+
+	ConfigProfile = "videos"
+	if err := applyConfig(newConfigTestCommands().root); err == nil || !strings.Contains(err.Error(), "no profile videos") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	defer func() { ConfigFile = "" }()
+
+	for config, want := range map[string]string{
+		"buckets = backups\n": "there's no setting buckets",
+		"\nhelp = true\n":     ":2",
+	} {
+		ConfigFile = writeConfig(t, config)
+		if err := applyConfig(newConfigTestCommands().root); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", config, err, want)
+		}
+	}
+
+	ConfigFile = filepath.Join(t.TempDir(), "missing")
+	if err := applyConfig(newConfigTestCommands().root); err == nil {
+		t.Error("a missing --config file was ignored")
+	}
+
+	// Without one given, there doesn't have to be a config file.
+	ConfigFile = ""
+	if err := applyConfig(newConfigTestCommands().root); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	defer func(concurrency int) { ConfigFile, Concurrency = "", concurrency }(Concurrency)
+	ConfigFile = writeConfig(t, "bucket = backups\n")
+	t.Setenv("S3_GLACIER_REGION", "eu-west-1")
+
+	c := newConfigTestCommands()
+	if err := c.root.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(c.root); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ConfigShow(&out, c.root, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"bucket  backups    " + ConfigFile + ":1", "region  eu-west-1  $S3_GLACIER_REGION"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q is missing from\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "tag") {
+		t.Errorf("defaults are shown without --effective:\n%s", out.String())
+	}
+
+	out.Reset()
+	Concurrency = 0
+	err := ConfigShow(&out, c.root, true)
+	if err == nil || !strings.Contains(out.String(), "Problem: --concurrency must be at least 1") {
+		t.Errorf("got %v,\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "tag     []") {
+		t.Errorf("--effective leaves out defaults:\n%s", out.String())
+	}
+}
@@ -0,0 +1,337 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// config init flags
+var ConfigInitForce bool
+
+const (
+	CONFIG_TEST_KEY  = ".s3-glacier-uploader-config-test"
+	DEFAULT_SCHEDULE = "0 3 * * *"
+)
+
+var configInitCmd = &cobra.Command{
+	Use:         "init",
+	Short:       "Ask for the bucket, region, storage class, encryption and a schedule, check access and write the config file",
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{ANNOTATION_SHOWS_CONFIG: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := fmt.Errorf("config init asks questions, run it in a terminal")
+		if isTerminal(os.Stdin) {
+			err = ConfigInit(os.Stdin, os.Stderr, ConfigFileName(), ConfigInitForce, configInitSessions)
+		}
+		return err
+	},
+}
+
+// configInitSessions connects to the region the bucket is in.  There's no
+// session to abort the access test with in --write-once mode.
+func configInitSessions(region string) (s3iface.S3API, s3iface.S3API) {
+	cleanup, err := newDestructiveS3Session(region)
+	if err != nil {
+		cleanup = nil
+	}
+	return newS3Session(region), cleanup
+}
+
+// wizard asks questions, one line per answer.
+type wizard struct {
+	in *bufio.Reader
+	w  io.Writer
+}
+
+// ask asks for a value, with def taken for an empty answer.
+func (z *wizard) ask(question string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(z.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(z.w, "%s: ", question)
+	}
+	answer, err := z.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		fmt.Fprintln(z.w)
+		return "", fmt.Errorf("No answer to %q", question)
+	}
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// yes asks a yes/no question until it gets an answer.
+func (z *wizard) yes(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		answer, err := z.ask(question+" ["+choices+"]", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// ConfigInit asks for the settings an upload needs, checks that they work
+// and writes them to filename.  sessions connects to a region, with no
+// cleanup session when nothing may be deleted.
+func ConfigInit(in io.Reader, w io.Writer, filename string, force bool, sessions func(region string) (s3iface.S3API, s3iface.S3API)) error {
+	if filename == "" {
+		return fmt.Errorf("Can't tell where the config file goes, name it with --config")
+	}
+	if strings.HasPrefix(filename, "s3://") {
+		return fmt.Errorf("config init writes a local file, config publish uploads it to S3")
+	}
+	if _, err := os.Stat(filename); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to replace it", filename)
+	}
+
+	z := &wizard{bufio.NewReader(in), w}
+	fmt.Fprintf(w, "Writing %s.  An empty answer takes the value in brackets.\n\n", filename)
+
+	var bucket string
+	for bucket == "" {
+		var err error
+		if bucket, err = z.ask("Bucket", BucketName); err != nil {
+			return err
+		}
+	}
+	region, err := z.ask("Region", Region)
+	if err != nil {
+		return err
+	}
+
+	var storageClass string
+	for storageClass == "" {
+		answer, err := z.ask("Storage class", StorageClass)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if strings.EqualFold(answer, STORAGE_CLASS_NONE) {
+			storageClass = STORAGE_CLASS_NONE
+		} else if storageClass, ok = storageClassNamed(answer); !ok {
+			fmt.Fprintf(w, "Unknown storage class, use one of %s, or %s for the server's default\n", strings.Join(s3.StorageClass_Values(), ", "), STORAGE_CLASS_NONE)
+		}
+	}
+
+	settings := []configSetting{{Name: "bucket", Value: bucket}, {Name: "region", Value: region}, {Name: "storage-class", Value: storageClass}}
+
+	encrypt, err := z.yes("Encrypt files before uploading them?", Encrypt)
+	if err != nil {
+		return err
+	}
+	if encrypt {
+		keyFile, err := askKeyFile(z, filepath.Join(filepath.Dir(filename), "key"))
+		if err != nil {
+			return err
+		}
+		settings = append(settings, configSetting{Name: "encrypt", Value: "true"}, configSetting{Name: "encryption-key-file", Value: keyFile})
+	}
+
+	s3session, cleanup := sessions(region)
+	if err := checkAccess(w, s3session, cleanup, bucket, storageClass); err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		save, err2 := z.yes("Save the settings anyway?", false)
+		if err2 != nil {
+			return err2
+		}
+		if !save {
+			return fmt.Errorf("Nothing written: %w", err)
+		}
+	}
+
+	dir, err := z.ask("Directory to back up on a schedule, if any", "")
+	if err != nil {
+		return err
+	}
+	var schedule string
+	if dir != "" {
+		if dir, err = filepath.Abs(dir); err != nil {
+			return err
+		}
+		for schedule == "" {
+			answer, err := z.ask("When, as a crontab schedule", DEFAULT_SCHEDULE)
+			if err != nil {
+				return err
+			}
+			if len(strings.Fields(answer)) == 5 {
+				schedule = answer
+			} else {
+				fmt.Fprintln(w, "A schedule has five fields: minute, hour, day of the month, month and day of the week")
+			}
+		}
+	}
+
+	if err := saveConfig(filename, settings); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nWrote %s, config show shows what's in effect.\n", filename)
+
+	if schedule != "" {
+		executable, err := os.Executable()
+		if err != nil {
+			executable = "s3-glacier-uploader"
+		}
+		fmt.Fprintf(w, "To back up %s, add this line with crontab -e:\n\n%s\n", dir, crontabLine(schedule, executable, filename, dir))
+	}
+	return nil
+}
+
+// askKeyFile asks for the encryption key file, and offers to create it if
+// it doesn't exist.
+func askKeyFile(z *wizard, def string) (string, error) {
+	for {
+		keyFile, err := z.ask("Encryption key file", def)
+		if err != nil {
+			return "", err
+		}
+		if keyFile, err = filepath.Abs(keyFile); err != nil {
+			return "", err
+		}
+
+		data, err := os.ReadFile(keyFile)
+		switch {
+		case err == nil && len(data) >= 32:
+			return keyFile, nil
+		case err == nil:
+			fmt.Fprintf(z.w, "%s holds less than 32 bytes\n", keyFile)
+			continue
+		case !errors.Is(err, os.ErrNotExist):
+			fmt.Fprintln(z.w, err)
+			continue
+		}
+
+		create, err := z.yes(fmt.Sprintf("%s doesn't exist.  Create it with 32 random bytes?", keyFile), true)
+		if err != nil {
+			return "", err
+		}
+		if !create {
+			continue
+		}
+		if err := createKeyFile(keyFile); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(z.w, "Created %s.  Keep a copy of it somewhere other than this machine, the backups can't be read without it.\n", keyFile)
+		return keyFile, nil
+	}
+}
+
+func createKeyFile(filename string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkAccess makes sure the bucket is there, and that uploads to it with
+// the storage class work, by starting one and aborting it.
+func checkAccess(w io.Writer, s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, storageClass string) error {
+	fmt.Fprintf(w, "Checking access to %s...\n", bucket)
+	if _, err := s3session.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return fmt.Errorf("Can't access bucket %s: %w", bucket, err)
+	}
+	checkBucketKeys(w, s3session, bucket)
+	if cleanup == nil {
+		fmt.Fprintln(w, "Not checking uploads, the test upload couldn't be aborted in --write-once mode")
+		return nil
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(CONFIG_TEST_KEY),
+		ServerSideEncryption: serverSideEncryption(),
+		SSEKMSKeyId:          sseKMSKeyID(),
+	}
+	if storageClass != STORAGE_CLASS_NONE {
+		input.StorageClass = aws.String(storageClass)
+	}
+	upload, err := s3session.CreateMultipartUpload(input)
+	if err != nil {
+		return fmt.Errorf("Can't upload to %s as %s: %w", bucket, storageClass, err)
+	}
+	_, err = cleanup.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to abort the test upload, abort --upload-id %s removes it: %w", aws.StringValue(upload.UploadId), err)
+	}
+	fmt.Fprintln(w, "Uploads work")
+	return nil
+}
+
+// saveConfig writes settings in the form parseConfig reads.
+func saveConfig(filename string, settings []configSetting) error {
+	var b strings.Builder
+	b.WriteString("# Written by s3-glacier-uploader config init\n")
+	for _, setting := range settings {
+		fmt.Fprintf(&b, "%s = %s\n", setting.Name, setting.Value)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0600)
+}
+
+// crontabLine syncs dir on schedule with the settings in configFile.
+func crontabLine(schedule string, executable string, configFile string, dir string) string {
+	return fmt.Sprintf("%s %s --config %s sync %s", schedule, shellQuote(executable), shellQuote(configFile), shellQuote(dir))
+}
+
+func init() {
+	configInitCmd.Flags().BoolVar(&ConfigInitForce, "force", false, "replace an existing config file")
+	configCmd.AddCommand(configInitCmd)
+}
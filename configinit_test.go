@@ -0,0 +1,159 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// missingBucketS3 has no buckets at all.
+type missingBucketS3 struct {
+	*fakeS3
+}
+
+func (f missingBucketS3) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return nil, awserr.New("NotFound", "Not Found", nil)
+}
+
+func fakeSessions(s3session s3iface.S3API, cleanup s3iface.S3API) func(string) (s3iface.S3API, s3iface.S3API) {
+	return func(region string) (s3iface.S3API, s3iface.S3API) {
+		return s3session, cleanup
+	}
+}
+
+func TestConfigInit(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "s3-glacier-uploader", "config")
+	photos := filepath.Join(dir, "photos")
+	answers := strings.Join([]string{
+		"backups", "eu-west-1",
+		// An unknown storage class is asked for again.
+		"COLD", "glacier_ir",
+		// Encrypt, with a new key file in the default place.
+		"y", "", "",
+		photos,
+		// A schedule has five fields.
+		"daily", "",
+	}, "\n") + "\n"
+
+	fake := newFakeS3()
+	var out bytes.Buffer
+	if err := ConfigInit(strings.NewReader(answers), &out, filename, false, fakeSessions(fake, fake)); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "s3-glacier-uploader", "key")
+	config, _ := os.ReadFile(filename)
+	expected := "# Written by s3-glacier-uploader config init\nbucket = backups\nregion = eu-west-1\nstorage-class = GLACIER_IR\nencrypt = true\nencryption-key-file = " + keyFile + "\n"
+	if string(config) != expected {
+		t.Errorf("wrote\n%s", config)
+	}
+	if settings, err := parseConfig(bytes.NewReader(config), filename); err != nil || len(settings) != 5 {
+		t.Errorf("read back %v, %v", settings, err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Size() != 32 || info.Mode().Perm() != 0600 {
+		t.Errorf("key file %v, %v", info, err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the test upload wasn't aborted")
+	}
+
+	for _, want := range []string{"Unknown storage class", "A schedule has five fields", "Uploads work", "--config '" + filename + "' sync '" + photos + "'"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q not in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestConfigInitExisting(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(filename, []byte("bucket = old\n"), 0600)
+
+	answers := "new\neu-west-1\nGLACIER\nn\n\n"
+	fake := newFakeS3()
+	err := ConfigInit(strings.NewReader(answers), &bytes.Buffer{}, filename, false, fakeSessions(fake, fake))
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("got %v", err)
+	}
+
+	if err := ConfigInit(strings.NewReader(answers), &bytes.Buffer{}, filename, true, fakeSessions(fake, fake)); err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := os.ReadFile(filename); !strings.Contains(string(config), "bucket = new\n") {
+		t.Errorf("wrote\n%s", config)
+	}
+}
+
+func TestConfigInitNoAccess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	fake := missingBucketS3{newFakeS3()}
+
+	// Not saving is the default.
+	err := ConfigInit(strings.NewReader("backups\neu-west-1\nGLACIER\nn\n\n"), &bytes.Buffer{}, filename, false, fakeSessions(fake, fake))
+	if err == nil || !strings.Contains(err.Error(), "Can't access bucket backups") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := os.Stat(filename); err == nil {
+		t.Error("wrote the config file")
+	}
+
+	if err := ConfigInit(strings.NewReader("backups\neu-west-1\nGLACIER\nn\ny\n\n"), &bytes.Buffer{}, filename, false, fakeSessions(fake, fake)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigInitWriteOnce(t *testing.T) {
+	fake := newFakeS3()
+	var out bytes.Buffer
+	err := ConfigInit(strings.NewReader("backups\neu-west-1\nGLACIER\nn\n\n"), &out, filepath.Join(t.TempDir(), "config"), false, fakeSessions(fake, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != 0 || !strings.Contains(out.String(), "Not checking uploads") {
+		t.Errorf("started %d uploads, said\n%s", fake.nextID, out.String())
+	}
+}
+
+func TestConfigInitNoAnswer(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	fake := newFakeS3()
+	err := ConfigInit(strings.NewReader("backups\n"), &bytes.Buffer{}, filename, false, fakeSessions(fake, fake))
+	if err == nil || !strings.Contains(err.Error(), `No answer to "Region"`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCrontabLine(t *testing.T) {
+	line := crontabLine("0 3 * * *", "/usr/local/bin/s3-glacier-uploader", "/home/me/.config/s3-glacier-uploader/config", "/home/me/My Photos")
+	expected := `0 3 * * * '/usr/local/bin/s3-glacier-uploader' --config '/home/me/.config/s3-glacier-uploader/config' sync '/home/me/My Photos'`
+	if line != expected {
+		t.Errorf("got %s", line)
+	}
+}
@@ -0,0 +1,56 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"runtime"
+)
+
+// CLI flags
+var DebugAddr string
+
+// startDebugServer serves pprof under /debug/pprof/ and runtime stats (memory,
+// goroutines, the hash implementations in use) under /debug/vars, for
+// looking into runs which go on for days.
+// Both register themselves on the default mux.
+func startDebugServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on --debug-addr %s: %w", addr, err)
+	}
+
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("hashes", expvar.Func(func() interface{} {
+		return hashImplementations()
+	}))
+	ui.Warnln(describeHashImplementations())
+
+	go func() {
+		if err := http.Serve(listener, nil); err != nil {
+			ui.Warnln("Debug server stopped:", err)
+		}
+	}()
+
+	return nil
+}
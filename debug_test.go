@@ -0,0 +1,69 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+	// A port which was free a moment ago.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if err := startDebugServer(addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := startDebugServer(addr); err == nil {
+		t.Error("listened on an address in use")
+	}
+
+	resp, err := http.Get("http://" + addr + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Goroutines int `json:"goroutines"`
+		Memstats   struct {
+			HeapAlloc uint64
+		} `json:"memstats"`
+		Hashes map[string]string `json:"hashes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Goroutines == 0 || vars.Memstats.HeapAlloc == 0 || vars.Hashes["sha256"] == "" {
+		t.Errorf("runtime stats %+v", vars)
+	}
+
+	resp, err = http.Get("http://" + addr + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("pprof answered %s", resp.Status)
+	}
+}
@@ -0,0 +1,73 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var Force bool
+
+// The SHA-256 digest of the file is stored with the object along with its
+// size and modification time, so that running the same upload again can tell
+// that the object has the file's content already.  The modification time
+// doesn't say that: copies and restores of a file get new ones.
+const SOURCE_METADATA_SHA256 = "source-sha256"
+
+// fileSHA256 reads the file to the end for its digest, and goes back to the
+// start.
+func fileSHA256(file io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// alreadyUploaded reports whether key has the content of the file already,
+// by the size and digest stored with the object.  If S3 can't tell us, e.g.
+// without s3:GetObject, the file is uploaded.
+func alreadyUploaded(s3session s3iface.S3API, bucket string, key string, stat os.FileInfo, sum string) bool {
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if !isNoSuchKey(err) {
+			ui.Warnf("Can't tell whether %s is uploaded already: %v\n", key, err)
+		}
+		return false
+	}
+
+	size, _, ok := sourceInfo(head.Metadata)
+	if !ok || size != stat.Size() {
+		return false
+	}
+	stored, ok := metadataValue(head.Metadata, SOURCE_METADATA_SHA256)
+	return ok && stored == sum
+}
@@ -0,0 +1,77 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestUploadSkipsSameContent(t *testing.T) {
+	defer func() { Force = false }()
+
+	fake := newFakeS3()
+	data := randomData(1024)
+	filename := writeTestFile(t, data)
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if got, _ := metadataValue(fake.objects["archive.bin"].metadata, SOURCE_METADATA_SHA256); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("stored the digest %q", got)
+	}
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.partUploads != 1 {
+		t.Errorf("uploaded %d parts, the file was uploaded again", fake.partUploads)
+	}
+
+	Force = true
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.partUploads != 2 {
+		t.Errorf("uploaded %d parts, --force didn't upload the file again", fake.partUploads)
+	}
+	Force = false
+
+	changed := append([]byte{}, data...)
+	changed[0] ^= 0xff
+	if err := os.WriteFile(filename, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.partUploads != 3 {
+		t.Errorf("uploaded %d parts, a changed file of the same size was skipped", fake.partUploads)
+	}
+
+	// Objects uploaded before the digest was stored are uploaded again.
+	delete(fake.objects["archive.bin"].metadata, SOURCE_METADATA_SHA256)
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.partUploads != 4 {
+		t.Errorf("uploaded %d parts, an object without a digest was taken as uploaded", fake.partUploads)
+	}
+}
@@ -0,0 +1,61 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// CLI flags
+var Human bool
+var Raw bool
+
+// showBytes is how list, ls, usage and the reports show a size: 1.5 GiB, or
+// with --raw the number of bytes, for scripts.
+func showBytes(n int64) string {
+	if Raw {
+		return strconv.FormatInt(n, 10)
+	}
+	return formatBytes(n)
+}
+
+// showTime is how they show when something happened: the local time, how
+// long ago with --human, or with --raw RFC 3339 in UTC.
+func showTime(t time.Time) string {
+	switch {
+	case Raw:
+		return t.UTC().Format(time.RFC3339)
+	case Human:
+		return formatAge(time.Since(t)) + " ago"
+	default:
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+}
+
+func checkOutputFlags() error {
+	if Human && Raw {
+		return fmt.Errorf("--human and --raw don't go together")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&Human, "human", false, "in listings and reports, show times as how long ago they were")
+	rootCmd.PersistentFlags().BoolVar(&Raw, "raw", false, "in listings and reports, show sizes in bytes and times in RFC 3339, for scripts")
+}
@@ -0,0 +1,67 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShowBytesAndTimes(t *testing.T) {
+	defer func() { Human, Raw = false, false }()
+	then := time.Now().Add(-50 * time.Hour)
+
+	if showBytes(1536) != "1.5 KiB" || showTime(then) != then.Local().Format("2006-01-02 15:04:05") {
+		t.Errorf("shown as %q and %q by default", showBytes(1536), showTime(then))
+	}
+
+	Human = true
+	if showBytes(1536) != "1.5 KiB" || showTime(then) != "2 days ago" {
+		t.Errorf("shown as %q and %q with --human", showBytes(1536), showTime(then))
+	}
+
+	Human, Raw = false, true
+	if showBytes(1536) != "1536" || showTime(then) != then.UTC().Format(time.RFC3339) {
+		t.Errorf("shown as %q and %q with --raw", showBytes(1536), showTime(then))
+	}
+
+	Human = true
+	if checkOutputFlags() == nil {
+		t.Error("took both --human and --raw")
+	}
+}
+
+func TestLsRaw(t *testing.T) {
+	Raw = true
+	defer func() { Raw = false }()
+
+	fake := newFakeS3()
+	fillFake(fake, []string{"photos/2021/a.jpg", "photos/2021/b.jpg", "photos/2022.tar"})
+	var out bytes.Buffer
+	if err := Ls(&out, fake, "bucket", "photos/", true); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[3] != "Total: 3 objects, 49" {
+		t.Fatalf("got\n%s", out.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 4 || fields[1] != "15" || !strings.HasSuffix(fields[0], "Z") {
+		t.Errorf("the object is listed as %q", lines[1])
+	}
+}
@@ -0,0 +1,409 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var Nodes int
+var NodeIndex int
+var RunID string
+
+const (
+	SHARED_STATE_SUFFIX = ".upload.json"
+	NODE_POLL_INTERVAL  = 30 * time.Second
+)
+
+// sharedUploadState is written by node 0 when it creates the multipart upload.
+// The other nodes wait for it to show up to learn the upload ID.
+type sharedUploadState struct {
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	Nodes    int    `json:"nodes"`
+}
+
+type nodePart struct {
+	Number   int64  `json:"number"`
+	ETag     string `json:"etag"`
+	Digest   string `json:"digest"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// nodeReport is written by every node once it has uploaded its share of the
+// parts.  Node 0 completes the upload when it has seen all of them.
+type nodeReport struct {
+	Node     int        `json:"node"`
+	UploadID string     `json:"upload_id"`
+	Parts    []nodePart `json:"parts"`
+}
+
+// The coordination objects are named after the run, so that leftovers of an
+// earlier run which failed can't be mistaken for the current one.
+func sharedStateKey(key string, runID string) string {
+	return fmt.Sprintf("%s.%s%s", key, runID, SHARED_STATE_SUFFIX)
+}
+
+func nodeReportKey(key string, runID string, node int) string {
+	return fmt.Sprintf("%s.node-%d", sharedStateKey(key, runID), node)
+}
+
+// nodeParts returns the first and last part number this node is responsible
+// for.  Each node gets a contiguous range, so it reads its slice of the file
+// sequentially.
+func nodeParts(size int64, partSize int64, nodes int, node int) (int64, int64) {
+	total := (size + partSize - 1) / partSize
+	per := (total + int64(nodes) - 1) / int64(nodes)
+
+	first := int64(node)*per + 1
+	last := first + per - 1
+	if last > total {
+		last = total
+	}
+	return first, last
+}
+
+func putJSON(s3session s3iface.S3API, bucket string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	return err
+}
+
+// getJSON reads a JSON object into v.  It returns false if the object doesn't
+// exist yet.
+func getJSON(s3session s3iface.S3API, bucket string, key string, v interface{}) (bool, error) {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if isNoSuchKey(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(data, v)
+}
+
+// UploadDistributed uploads a share of a file that several hosts can read
+// (e.g. on a NAS), so that the upload of one huge file can use the uplink of
+// all of them.  Node 0 creates and completes the multipart upload, all nodes
+// coordinate through small JSON objects next to the destination key.
+func UploadDistributed(bucket string, region string, filename string, nodes int, node int, runID string) (err error) {
+	if node < 0 || node >= nodes {
+		return fmt.Errorf("--node has to be between 0 and %d", nodes-1)
+	}
+
+	if runID == "" || strings.Contains(runID, "/") {
+		return fmt.Errorf("Give all nodes the same --run-id, e.g. today's date")
+	}
+
+	s3session := newS3Session(region)
+
+	include, err := includeFile(filename)
+	if err != nil {
+		return err
+	}
+	if !include {
+		ui.Println("Skipping", filename)
+		return nil
+	}
+
+	key, err := uploadKey(filename)
+	if err != nil {
+		return err
+	}
+	stateKey := sharedStateKey(key, runID)
+
+	ctx, span := startSpan(interrupt, "upload", SPAN_KIND_INTERNAL, "file", filename, "key", key, "node", node)
+	defer func() { span.End(err) }()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var state sharedUploadState
+
+	if node == 0 {
+		found, err := getJSON(s3session, bucket, stateKey, &state)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("Run %s has already been started, use a new --run-id", runID)
+		}
+
+		metadata, err := uploadMetadata(filename)
+		if err != nil {
+			return err
+		}
+		metadata = linkPreview(key, metadata)
+		metadata = sourceMetadata(metadata, stat)
+
+		partSize, err := filePartSize(stat.Size())
+		if err != nil {
+			return err
+		}
+		metadata = partSizeMetadata(metadata, int64(partSize))
+
+		createdResp, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			StorageClass:         uploadStorageClass(),
+			Metadata:             metadata,
+			ChecksumAlgorithm:    checksumAlgorithm(),
+			Tagging:              objectTagging(key),
+			ServerSideEncryption: serverSideEncryption(),
+			SSEKMSKeyId:          sseKMSKeyID(),
+		})
+		if err != nil {
+			return err
+		}
+
+		state = sharedUploadState{*createdResp.UploadId, stat.Size(), int64(partSize), nodes}
+		if err := putJSON(s3session, bucket, stateKey, &state); err != nil {
+			return err
+		}
+	} else {
+		ui.Println("Waiting for node 0 to start the upload")
+		limit := waitUntil(time.Now(), 0, "")
+		for {
+			found, err := getJSON(s3session, bucket, stateKey, &state)
+			if err != nil {
+				return err
+			}
+			if found {
+				break
+			}
+			if err := limit.Check(NODE_POLL_INTERVAL, "waiting for node 0 to start the upload"); err != nil {
+				return err
+			}
+			time.Sleep(NODE_POLL_INTERVAL)
+		}
+
+		if state.Nodes != nodes || state.Size != stat.Size() {
+			return fmt.Errorf("Node 0 is uploading %d bytes with %d nodes, we see %d bytes with %d nodes",
+				state.Size, state.Nodes, stat.Size(), nodes)
+		}
+		// Node 0 decides about automatic part sizes.
+		if partSize, _ := configuredPartSize(); partSize != 0 && partSize != state.PartSize {
+			return fmt.Errorf("Node 0 is uploading in %d byte parts, we were given --part-size %d", state.PartSize, partSize)
+		}
+	}
+
+	ui.Println("Upload ID:", state.UploadID)
+
+	upload := &s3.CreateMultipartUploadOutput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+	}
+
+	partSize := state.PartSize
+	first, last := nodeParts(state.Size, partSize, nodes, node)
+	report := nodeReport{Node: node, UploadID: state.UploadID}
+
+	var nodeBytes int64
+	if first <= last {
+		nodeBytes = last*partSize - (first-1)*partSize
+		if last*partSize > state.Size {
+			nodeBytes = state.Size - (first-1)*partSize
+		}
+	}
+	progress.Start(filename, key, nodeBytes, last-first+1)
+	eta := newETATracker(bucket, nodeBytes)
+	progress.Uploading(state.UploadID)
+	defer func() { progress.Finish(err) }()
+
+	if first <= last {
+		ui.Printf("Uploading parts %d to %d\n", first, last)
+
+		if _, err := file.Seek((first-1)*partSize, io.SeekStart); err != nil {
+			return err
+		}
+
+		buffer := make([]byte, partSize)
+		bar := ui.Bar(last-first+1, "")
+		parts := newUploader(s3session)
+
+		for partNum := first; partNum <= last; partNum++ {
+			n, err := io.ReadFull(file, buffer)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("Failed to read part %d: %w", partNum, err)
+			}
+
+			db := md5.Sum(buffer[:n])
+
+			partCtx, partSpan := startSpan(ctx, "part", SPAN_KIND_INTERNAL, "part", partNum, "size", n)
+			part, err := parts.UploadPart(partCtx, bucket, key, *upload.UploadId, int(partNum), buffer[:n])
+			partSpan.End(err)
+			if err != nil {
+				return fmt.Errorf("Upload not aborted.  Error: %w", err)
+			}
+
+			report.Parts = append(report.Parts, nodePart{partNum, *part.ETag, hex.EncodeToString(db[:]), aws.StringValue(part.ChecksumSHA256)})
+			bar.Add(1)
+			progress.Part(n, eta.Sent(n))
+		}
+	}
+
+	if err := putJSON(s3session, bucket, nodeReportKey(key, runID, node), &report); err != nil {
+		return err
+	}
+	eta.Record(bucket, key)
+
+	if node != 0 {
+		ui.Println("Done, node 0 will complete the upload")
+		return nil
+	}
+
+	if err := completeDistributed(s3session, region, upload, nodes, runID); err != nil {
+		return err
+	}
+
+	return uploadPreview(s3session, bucket, key, filename)
+}
+
+// completeDistributed waits for every node to report in, then completes the
+// upload and cleans up the coordination objects.
+func completeDistributed(s3session s3iface.S3API, region string, upload *s3.CreateMultipartUploadOutput, nodes int, runID string) error {
+	bucket, key := *upload.Bucket, *upload.Key
+
+	var parts []nodePart
+
+	limit := waitUntil(time.Now(), 0, "")
+	for node := 0; node < nodes; node++ {
+		var report nodeReport
+		for {
+			found, err := getJSON(s3session, bucket, nodeReportKey(key, runID, node), &report)
+			if err != nil {
+				return err
+			}
+			if found && report.UploadID != *upload.UploadId {
+				return fmt.Errorf("Node %d reported parts of upload %s, not %s", node, report.UploadID, *upload.UploadId)
+			}
+			if found {
+				break
+			}
+			if err := limit.Check(NODE_POLL_INTERVAL, fmt.Sprintf("waiting for node %d to finish", node)); err != nil {
+				return err
+			}
+			ui.Printf("Waiting for node %d to finish\n", node)
+			time.Sleep(NODE_POLL_INTERVAL)
+		}
+		parts = append(parts, report.Parts...)
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+
+	var completedParts []*s3.CompletedPart
+	digestBytes := []byte{}
+
+	for _, p := range parts {
+		part := &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(p.Number),
+		}
+		if p.Checksum != "" {
+			part.ChecksumSHA256 = aws.String(p.Checksum)
+		}
+		completedParts = append(completedParts, part)
+		db, err := hex.DecodeString(p.Digest)
+		if err != nil {
+			return err
+		}
+		digestBytes = append(digestBytes, db...)
+	}
+
+	resp, err := s3session.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   upload.Bucket,
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Println("Success!")
+
+	etag := fmt.Sprintf("%s-%d", calculateMd5Digest(digestBytes), len(parts))
+	if err := verifyCompleted(resp, etag, completedParts, fmt.Errorf("The uploaded object doesn't match the parts the nodes sent")); err != nil {
+		return err
+	}
+
+	ui.Println(*resp.Location)
+
+	keys := []string{sharedStateKey(key, runID)}
+	for node := 0; node < nodes; node++ {
+		keys = append(keys, nodeReportKey(key, runID, node))
+	}
+
+	cleanup, err := newDestructiveS3Session(region)
+	if err != nil {
+		return fmt.Errorf("The upload is complete, but the coordination objects %s are left behind: %w", strings.Join(keys, ", "), err)
+	}
+
+	if err := deleteObjects(cleanup, bucket, keys, func(string) {}); err != nil {
+		return fmt.Errorf("The upload is complete, but the coordination objects are left behind: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestNodeParts(t *testing.T) {
+	tests := []struct {
+		size  int64
+		nodes int
+	}{
+		{PART_SIZE, 1},
+		{10 * PART_SIZE, 3},
+		{10*PART_SIZE + 1, 3},
+		{2 * PART_SIZE, 3},
+		{100*PART_SIZE - 1, 7},
+	}
+
+	for _, tt := range tests {
+		total := (tt.size + PART_SIZE - 1) / PART_SIZE
+
+		// Every part has to be uploaded by exactly one node, in order.
+		next := int64(1)
+		for node := 0; node < tt.nodes; node++ {
+			first, last := nodeParts(tt.size, PART_SIZE, tt.nodes, node)
+			if first > last {
+				continue
+			}
+			if first != next {
+				t.Errorf("size %d, %d nodes: node %d starts at part %d, want %d", tt.size, tt.nodes, node, first, next)
+			}
+			next = last + 1
+		}
+		if next != total+1 {
+			t.Errorf("size %d, %d nodes: parts up to %d covered, want %d", tt.size, tt.nodes, next-1, total)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// CLI flags
+var DNSRefresh time.Duration
+
+// dialer is what dialFastest connects with, the same as http.DefaultTransport.
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// dialingTransport is http.DefaultTransport, connecting with dialFastest.
+var dialingTransport *http.Transport
+
+// dials spreads connections over the addresses a host name has.
+var dials uint32
+
+// lookupHost is net.DefaultResolver's, for the tests to replace.
+var lookupHost = net.DefaultResolver.LookupIPAddr
+
+func checkDNSRefresh() error {
+	if DNSRefresh < 0 {
+		return fmt.Errorf("--dns-refresh can't be negative")
+	}
+
+	if dialingTransport == nil {
+		dialingTransport = http.DefaultTransport.(*http.Transport).Clone()
+		dialingTransport.DialContext = dialFastest
+		if DNSRefresh > 0 {
+			go refreshConnections(DNSRefresh)
+		}
+	}
+	return nil
+}
+
+// refreshConnections drops the idle connections every interval, so that the
+// next requests look the host up again and connect anew.  Go doesn't cache
+// DNS answers itself, but a connection kept alive to an address which has
+// become slow would be used for the rest of a day long upload.  A connection
+// is idle between parts, so none is cut off in the middle of one.
+func refreshConnections(interval time.Duration) {
+	for range time.Tick(interval) {
+		if t, ok := baseTransport().(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// dialFastest looks the host up and connects to an IPv4 and an IPv6 address
+// of it at the same time, keeping whichever connection is made first and
+// closing the other.  Go's own dialer only tries the second family after
+// 300ms, and always the first address of each, which is then used for every
+// connection; we take the next address every time.
+func dialFastest(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+
+	n := int(atomic.AddUint32(&dials, 1))
+	var candidates []string
+	for _, family := range [][]net.IP{v4, v6} {
+		if len(family) > 0 {
+			candidates = append(candidates, net.JoinHostPort(family[n%len(family)].String(), port))
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return race(ctx, network, candidates)
+}
+
+// race connects to all the addresses at once and returns the first
+// connection made.  The others are closed as they come in.
+func race(ctx context.Context, network string, addresses []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			results <- result{conn, err}
+		}(address)
+	}
+
+	var firstErr error
+	for i := range addresses {
+		r := <-results
+		if r.err == nil {
+			// The rest are cancelled, but may have connected already.
+			go func(left int) {
+				for ; left > 0; left-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(len(addresses) - i - 1)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,72 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialFastest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// Nothing listens on the IPv6 address, the IPv4 one wins.
+	defer func(lookup func(context.Context, string) ([]net.IPAddr, error)) { lookupHost = lookup }(lookupHost)
+	var lookups int
+	lookupHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialFastest(context.Background(), "tcp", net.JoinHostPort("s3.example.com", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != listener.Addr().String() {
+			t.Errorf("connected to %s", got)
+		}
+		conn.Close()
+	}
+	if lookups != 2 {
+		t.Errorf("looked the host up %d times for 2 connections", lookups)
+	}
+
+	lookupHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("::1")}}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := dialFastest(ctx, "tcp", net.JoinHostPort("s3.example.com", port)); err == nil {
+		t.Error("connected without an address listening")
+	}
+}
+
+func TestDNSRefreshFlag(t *testing.T) {
+	defer func(refresh time.Duration) { DNSRefresh = refresh }(DNSRefresh)
+	DNSRefresh = -time.Minute
+	if err := checkDNSRefresh(); err == nil {
+		t.Error("--dns-refresh -1m was taken")
+	}
+}
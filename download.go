@@ -0,0 +1,494 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/spf13/cobra"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// download flags
+var DownloadKey string
+var DownloadRange string
+var DownloadOutput string
+var DownloadConcurrency int
+var DownloadDecompress string
+var DownloadExtract string
+var DownloadRaw bool
+
+var downloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download an object, or a byte range of it",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Download(BucketName, Region, DownloadKey, DownloadRange, DownloadOutput, DownloadConcurrency, DownloadDecompress, DownloadExtract, DownloadRaw)
+	},
+}
+
+// Same syntax as an HTTP Range header without the "bytes=": 100-199, 100- or
+// -100 for the last 100 bytes.
+var byteRangePattern = regexp.MustCompile(`^(\d*)-(\d*)$`)
+
+// parseByteRange turns a range spec into the first and last byte offsets
+// (inclusive) of an object of the given size.
+func parseByteRange(spec string, size int64) (int64, int64, error) {
+	if spec == "" {
+		return 0, size - 1, nil
+	}
+
+	m := byteRangePattern.FindStringSubmatch(spec)
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return 0, 0, fmt.Errorf("Invalid range %q, expected something like 0-1048575", spec)
+	}
+
+	var first, last int64
+
+	switch {
+	case m[1] == "":
+		n, _ := strconv.ParseInt(m[2], 10, 64)
+		first, last = size-n, size-1
+		if first < 0 {
+			first = 0
+		}
+	case m[2] == "":
+		first, _ = strconv.ParseInt(m[1], 10, 64)
+		last = size - 1
+	default:
+		first, _ = strconv.ParseInt(m[1], 10, 64)
+		last, _ = strconv.ParseInt(m[2], 10, 64)
+		if last > size-1 {
+			last = size - 1
+		}
+	}
+
+	if first > last {
+		return 0, 0, fmt.Errorf("Range %q is outside of the object (%d bytes)", spec, size)
+	}
+
+	return first, last, nil
+}
+
+// --decompress none keeps a compressed object compressed.
+const DECOMPRESS_NONE = "none"
+
+// The magic numbers gzip and zstd streams start with.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCompression tells how an object was compressed, from the metadata
+// compressed uploads have, or for those uploaded before we stored it, or by
+// other programs, from the magic number of start, its first bytes.
+func detectCompression(metadata map[string]*string, start []byte) string {
+	if format, ok := metadataValue(metadata, COMPRESSION_METADATA); ok {
+		return format
+	}
+	if _, ok := metadataValue(metadata, RECOMPRESS_METADATA_FROM); ok {
+		return COMPRESS_ZSTD
+	}
+
+	switch {
+	case bytes.HasPrefix(start, gzipMagic):
+		return COMPRESS_GZIP
+	case bytes.HasPrefix(start, zstdMagic):
+		return COMPRESS_ZSTD
+	}
+	return ""
+}
+
+// decompressedName is what a download named name is called once it's been
+// decompressed: without the extension of the compression.
+func decompressedName(name string, format string) string {
+	switch {
+	case format == COMPRESS_GZIP && strings.HasSuffix(name, ".tgz"):
+		return strings.TrimSuffix(name, ".tgz") + ".tar"
+	case format == COMPRESS_GZIP && strings.HasSuffix(name, ".gz") && name != ".gz":
+		return strings.TrimSuffix(name, ".gz")
+	case format == COMPRESS_ZSTD && strings.HasSuffix(name, ".zst") && name != ".zst":
+		return strings.TrimSuffix(name, ".zst")
+	}
+	return name
+}
+
+// decompressReader undoes the compression the archive was made with.  Like
+// compressing, zstd takes the zstd program.
+func decompressReader(r io.Reader, format string) (io.Reader, error) {
+	switch format {
+	case "", DECOMPRESS_NONE:
+		return r, nil
+	case COMPRESS_GZIP:
+		return gzip.NewReader(r)
+	case COMPRESS_ZSTD:
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = r
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Failed to run zstd (is it installed?): %w", err)
+		}
+		return &commandReader{stdout, cmd, stderr}, nil
+	default:
+		return nil, fmt.Errorf("Unknown compression format %q, use %s, %s or %s", format, COMPRESS_GZIP, COMPRESS_ZSTD, DECOMPRESS_NONE)
+	}
+}
+
+// checkRestored returns an error if the object lives in an archive storage
+// class and there's no restored copy we could read.
+func checkRestored(key string, head *s3.HeadObjectOutput) error {
+	if head.StorageClass == nil || !isArchived(*head.StorageClass) {
+		return nil
+	}
+
+	if head.Restore == nil {
+		return fmt.Errorf("%s is in %s and has to be restored first", key, *head.StorageClass)
+	}
+
+	if strings.Contains(*head.Restore, `ongoing-request="true"`) {
+		return fmt.Errorf("%s is still being restored", key)
+	}
+
+	return nil
+}
+
+func Download(bucket string, region string, key string, byteRange string, output string, concurrency int, decompress string, extract string, raw bool) error {
+	if key == "" {
+		return fmt.Errorf("Tell us which object to download with --key")
+	}
+	if raw && (decompress != "" || extract != "") {
+		return fmt.Errorf("--raw saves the object as it's stored, it doesn't go with --decompress or --extract")
+	}
+	if DownloadXattrs && extract == "" {
+		return fmt.Errorf("--xattrs only goes with --extract")
+	}
+	if DownloadWindowsACLs && extract == "" {
+		return fmt.Errorf("--windows-acls only goes with --extract")
+	}
+	return downloadObject(newRestoreS3Session(region), bucket, key, byteRange, output, concurrency, decompress, extract, raw)
+}
+
+// downloadObject downloads key, or byteRange of it, to output.  A whole
+// object is decrypted and decompressed however it was uploaded, unless it's
+// raw, or decompress says otherwise: the format it's in, or none.
+func downloadObject(s3session s3iface.S3API, bucket string, key string, byteRange string, output string, concurrency int, decompress string, extract string, raw bool) (err error) {
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if isNoSuchKey(err) {
+		// Objects too large for S3 are uploaded in shards.
+		m, splitErr := loadSplitManifest(s3session, bucket, key)
+		if splitErr != nil {
+			return splitErr
+		}
+		if m != nil {
+			return downloadSplit(s3session, bucket, m, byteRange, output, concurrency, decompress, extract, raw)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// S3 can only restore whole objects, but once the restored copy exists
+	// we only have to transfer the bytes we actually need.
+	if err := checkRestored(key, head); err != nil {
+		return err
+	}
+
+	first, last, err := parseByteRange(byteRange, *head.ContentLength)
+	if err != nil {
+		return err
+	}
+
+	whole := first == 0 && last == *head.ContentLength-1
+
+	encrypted := isEncrypted(head.Metadata) && !raw
+	if encrypted && byteRange != "" {
+		return fmt.Errorf("%s is encrypted, it can only be downloaded whole", key)
+	}
+
+	if err := checkBudget("the download", transferCost(last-first+1)); err != nil {
+		return err
+	}
+
+	// With --verify-key, the object has to be the one described by its
+	// signed manifest.  A whole object is also hashed on the way through.
+	var verifier *transfer.PartHasher
+	var expected string
+	if verifyPublicKey != nil {
+		var partSizes []int64
+		expected, partSizes, err = expectedETag(s3session, bucket, key, head)
+		if err != nil {
+			return err
+		}
+		if etag := strings.Trim(*head.ETag, "\""); !isKMS(head) && etag != expected {
+			return fmt.Errorf("%s has been replaced since its manifest was signed (ETag %s, manifest %s)", key, etag, expected)
+		}
+		if whole {
+			verifier = newETagWriter(partSizes)
+		}
+	}
+
+	// A download of the object as it's stored to a file which was
+	// interrupted goes on where it stopped.
+	var journal *downloadJournal
+	var offset int64
+	var start []byte
+	if whole && extract == "" && output != "-" && !encrypted && (decompress == "" || decompress == DECOMPRESS_NONE) {
+		name := output
+		if name == "" {
+			name = path.Base(key)
+		}
+		journal, offset, start, err = resumedDownload(bucket, key, *head.ETag, *head.ContentLength, name)
+		if err != nil {
+			return err
+		}
+		if journal != nil && !raw && (bytes.HasPrefix(start, []byte(ENCRYPTION_MAGIC)) || decompress == "" && detectCompression(head.Metadata, start) != "") {
+			// It isn't saved as it's stored after all.
+			if err := journal.Discard(); err != nil {
+				return err
+			}
+			journal, offset = nil, 0
+		}
+	}
+	if journal != nil {
+		ui.Printf("Resuming the download of %s after %s\n", key, formatBytes(offset))
+		if verifier != nil {
+			if err := hashSaved(journal.Partial(), offset, verifier); err != nil {
+				return err
+			}
+		}
+	}
+
+	progress.Start(output, key, last-first+1, (last-first+PART_SIZE)/PART_SIZE)
+	progress.Downloading(offset)
+	defer func() { progress.Finish(err) }()
+
+	// The download is a pipeline of readers: ranged parallel GETs feed the
+	// decryption and the decompressor, which feeds the output file or the
+	// tar extractor, so nothing is ever spooled to a temporary file.
+	chunks := newRangeReader(s3session, bucket, key, *head.ETag, first+offset, last, concurrency)
+	meter := transfer.NewMeter(last-first+1-offset, 0)
+	chunks.OnChunk = func(size int) { progress.Part(size, meter.Transferred(int64(size))) }
+	defer chunks.Close()
+
+	bar := ui.ByteBar(last-first+1-offset, "downloading")
+
+	stored := io.TeeReader(chunks, bar)
+	if verifier != nil {
+		stored = io.TeeReader(stored, verifier)
+	}
+
+	// Objects copied without their metadata are still recognized by how
+	// they start.
+	var plain io.Reader = stored
+	if !raw && whole && !encrypted && journal == nil {
+		peek := bufio.NewReader(stored)
+		start, _ := peek.Peek(len(ENCRYPTION_MAGIC))
+		encrypted = bytes.HasPrefix(start, []byte(ENCRYPTION_MAGIC))
+		plain = peek
+	}
+	if encrypted {
+		keyID, _ := metadataValue(head.Metadata, ENCRYPTION_KEY_ID_METADATA)
+		plain = decryptReader(plain, keyID)
+	}
+
+	// A range of a compressed object can't be decompressed on its own, so
+	// it's only done when asked for.
+	format := decompress
+	if format == "" && !raw && whole && journal == nil {
+		peek := bufio.NewReader(plain)
+		start, _ := peek.Peek(len(zstdMagic))
+		format = detectCompression(head.Metadata, start)
+		if format != "" {
+			ui.Warnf("%s is compressed with %s, decompressing it\n", key, format)
+		}
+		plain = peek
+	}
+
+	stream, err := decompressReader(plain, format)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = decompressedName(path.Base(key), format)
+	}
+	progress.Update(func(state *progressState) { state.File = output })
+
+	if extract != "" {
+		count, err := extractTar(stream, extract)
+		if err != nil {
+			return err
+		}
+		ui.Warnln("Extracted", count, "entries to", extract)
+
+		// The decompressor may still be reading raw in the background,
+		// so what the tar reader left goes through it.
+		if _, err := io.Copy(io.Discard, stream); err != nil {
+			return err
+		}
+		return checkDownload(stored, verifier, expected)
+	}
+
+	// What's saved as it's stored goes to the partial file first.
+	asStored := whole && !encrypted && (format == "" || format == DECOMPRESS_NONE)
+	if journal == nil && asStored && output != "-" {
+		journal, err = newDownloadJournal(bucket, key, *head.ETag, output, *head.ContentLength)
+		if err == nil {
+			err = journal.Save()
+		}
+		if err != nil {
+			ui.Warnln("Failed to write the download journal:", err)
+			journal = nil
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	var partial *os.File
+	if journal != nil {
+		partial, err = os.OpenFile(journal.Partial(), os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		defer partial.Close()
+		if err := partial.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		out = partial
+	} else if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	n, err := io.Copy(out, stream)
+	if err != nil {
+		if journal != nil {
+			return fmt.Errorf("Download failed after %d bytes, run it again to resume it: %w", offset+n, err)
+		}
+		return fmt.Errorf("Download failed after %d bytes: %w", n, err)
+	}
+	n += offset
+
+	if journal != nil {
+		if err := partial.Close(); err != nil {
+			return err
+		}
+		if err := checkDownload(stored, verifier, expected); err != nil {
+			journal.Discard()
+			return err
+		}
+		if err := journal.Finish(); err != nil {
+			return err
+		}
+	}
+
+	ui.Warnln("Saved", formatBytes(n), "to", output)
+
+	// A whole file gets its original modification time back, so that sync
+	// sees it as unchanged.
+	if output != "-" && (format == "" || format == DECOMPRESS_NONE) && whole {
+		if size, mtime, ok := sourceInfo(head.Metadata); ok && size == n {
+			if err := os.Chtimes(output, mtime, mtime); err != nil {
+				return err
+			}
+		}
+	}
+
+	if journal != nil {
+		return nil
+	}
+	return checkDownload(stored, verifier, expected)
+}
+
+// hashSaved feeds the first n bytes of what a resumed download saved to the
+// verifier, which has to see the whole object.
+func hashSaved(partial string, n int64, verifier *transfer.PartHasher) error {
+	file, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(verifier, io.LimitReader(file, n))
+	return err
+}
+
+// checkDownload compares the hash of the downloaded data with the signed
+// manifest.  Tar and gzip readers can stop before the end of the object, so
+// whatever is left is read first.
+func checkDownload(raw io.Reader, verifier *transfer.PartHasher, expected string) error {
+	if verifier == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return err
+	}
+
+	ours, err := verifier.Sum()
+	if err != nil {
+		return err
+	}
+	if ours != expected {
+		return fmt.Errorf("The downloaded data hashes to %s, the signed manifest says %s", ours, expected)
+	}
+
+	ui.Warnln("The data matches the signed manifest")
+	return nil
+}
+
+func init() {
+	downloadCmd.Flags().StringVar(&DownloadKey, "key", "", "key of the object to download")
+	downloadCmd.Flags().StringVar(&DownloadRange, "range", "", "only download this byte range, e.g. 0-1048575")
+	downloadCmd.Flags().StringVarP(&DownloadOutput, "output", "o", "", "file to write to, - for stdout (defaults to the key's base name)")
+	downloadCmd.Flags().IntVar(&DownloadConcurrency, "concurrency", 4, "number of chunks to download in parallel")
+	downloadCmd.Flags().StringVar(&DownloadDecompress, "decompress", "", "decompress the download: gzip, zstd (needs the zstd program) or none, detected when not given")
+	downloadCmd.Flags().StringVar(&DownloadExtract, "extract", "", "extract a tar archive into this directory instead of saving it")
+	downloadCmd.Flags().BoolVar(&DownloadWindowsACLs, "windows-acls", false, "with --extract, restore the owners and ACLs archived with --windows-acls")
+	downloadCmd.Flags().BoolVar(&DownloadXattrs, "xattrs", false, "with --extract, restore the extended attributes, ACLs and SELinux contexts archived with --xattrs")
+	downloadCmd.Flags().BoolVar(&DownloadRaw, "raw", false, "save the object as it's stored, without decrypting or decompressing it")
+	rootCmd.AddCommand(downloadCmd)
+}
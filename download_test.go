@@ -0,0 +1,186 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		spec  string
+		size  int64
+		first int64
+		last  int64
+		ok    bool
+	}{
+		{"", 1000, 0, 999, true},
+		{"0-99", 1000, 0, 99, true},
+		{"100-199", 1000, 100, 199, true},
+		{"900-", 1000, 900, 999, true},
+		{"-100", 1000, 900, 999, true},
+		{"-5000", 1000, 0, 999, true},
+		{"500-5000", 1000, 500, 999, true},
+		{"999-999", 1000, 999, 999, true},
+		{"1000-", 1000, 0, 0, false},
+		{"200-100", 1000, 0, 0, false},
+		{"-0", 1000, 0, 0, false},
+		{"-", 1000, 0, 0, false},
+		{"abc", 1000, 0, 0, false},
+		{"1-2-3", 1000, 0, 0, false},
+		{"bytes=0-99", 1000, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		first, last, err := parseByteRange(tt.spec, tt.size)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseByteRange(%q, %d): got error %v, want ok %v", tt.spec, tt.size, err, tt.ok)
+			continue
+		}
+		if tt.ok && (first != tt.first || last != tt.last) {
+			t.Errorf("parseByteRange(%q, %d) = %d-%d, want %d-%d", tt.spec, tt.size, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+// overwritingS3 replaces the object after the first GET, as if another
+// upload to the same key had finished.
+type overwritingS3 struct {
+	*fakeS3
+	once sync.Once
+}
+
+func (f *overwritingS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	out, err := f.fakeS3.GetObject(in)
+	f.once.Do(func() {
+		f.fakeS3.PutObject(&s3.PutObjectInput{Key: in.Key, Body: bytes.NewReader(randomData(10))})
+	})
+	return out, err
+}
+
+func TestDownloadOverwritten(t *testing.T) {
+	fake := &overwritingS3{fakeS3: newFakeS3()}
+	fake.PutObject(&s3.PutObjectInput{Key: aws.String("vm.img"), Body: bytes.NewReader(randomData(2 * PART_SIZE))})
+
+	output := filepath.Join(t.TempDir(), "vm.img")
+	err := downloadObject(fake, "bucket", "vm.img", "", output, 1, "", "", false)
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDownloadZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd isn't installed")
+	}
+
+	data := randomData(1024)
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeS3()
+	fake.PutObject(&s3.PutObjectInput{Key: aws.String("data.zst"), Body: bytes.NewReader(compressed)})
+
+	output := filepath.Join(t.TempDir(), "data")
+	if err := downloadObject(fake, "bucket", "data.zst", "", output, 4, COMPRESS_ZSTD, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decompressed to %d bytes: %v", len(got), err)
+	}
+}
+
+func TestDownloadDetectsCompression(t *testing.T) {
+	data := randomData(1024)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	fake := newFakeS3()
+	fake.PutObject(&s3.PutObjectInput{Key: aws.String("data.gz"), Body: bytes.NewReader(compressed.Bytes())})
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "data")
+	if err := downloadObject(fake, "bucket", "data.gz", "", output, 4, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decompressed to %d bytes: %v", len(got), err)
+	}
+
+	// --raw and --decompress none leave it as it's stored.
+	for _, decompress := range []string{"", DECOMPRESS_NONE} {
+		output := filepath.Join(dir, "data.gz")
+		if err := downloadObject(fake, "bucket", "data.gz", "", output, 4, decompress, "", decompress == ""); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, compressed.Bytes()) {
+			t.Errorf("--decompress %q: got %d bytes: %v", decompress, len(got), err)
+		}
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		metadata map[string]*string
+		start    []byte
+		want     string
+	}{
+		{nil, []byte{0x1f, 0x8b, 8, 0}, COMPRESS_GZIP},
+		{nil, []byte{0x28, 0xb5, 0x2f, 0xfd}, COMPRESS_ZSTD},
+		{nil, []byte("plain"), ""},
+		{map[string]*string{"Compression": aws.String(COMPRESS_ZSTD)}, nil, COMPRESS_ZSTD},
+		{map[string]*string{RECOMPRESS_METADATA_FROM: aws.String(COMPRESS_GZIP)}, nil, COMPRESS_ZSTD},
+	}
+	for _, tt := range tests {
+		if got := detectCompression(tt.metadata, tt.start); got != tt.want {
+			t.Errorf("detectCompression(%v, %x) = %q, want %q", tt.metadata, tt.start, got, tt.want)
+		}
+	}
+
+	names := map[string]string{
+		"photos.tar.gz":  "photos.tar",
+		"photos.tgz":     "photos.tar",
+		"db.sql.zst":     "db.sql",
+		"notes.txt":      "notes.txt",
+		"photos.tar.bz2": "photos.tar.bz2",
+	}
+	for name, want := range names {
+		format := COMPRESS_GZIP
+		if strings.HasSuffix(name, ".zst") {
+			format = COMPRESS_ZSTD
+		}
+		if got := decompressedName(name, format); got != want {
+			t.Errorf("decompressedName(%q, %s) = %q, want %q", name, format, got, want)
+		}
+	}
+}
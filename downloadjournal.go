@@ -0,0 +1,200 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A download to a file is saved under its name with this suffix until it's
+// complete.
+const DOWNLOAD_PARTIAL_SUFFIX = ".partial"
+
+// downloadJournal is a download to a file which hasn't finished.  Like an
+// upload's journal it's kept in the state directory, so that the download
+// can go on from the end of the partial file when it's run again, as long as
+// the object is still the same.
+type downloadJournal struct {
+	Version int    `json:"version"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	ETag    string `json:"etag"`
+	Output  string `json:"output"`
+	Size    int64  `json:"size"`
+
+	path string
+}
+
+func downloadJournalPath(bucket string, key string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "downloads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sum[:16])), nil
+}
+
+// loadDownloadJournal returns the journal of an unfinished download of key,
+// or nil.
+func loadDownloadJournal(bucket string, key string) (*downloadJournal, error) {
+	p, err := downloadJournalPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+
+	journal := &downloadJournal{path: p}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("Failed to read the download journal %s: %w", p, err)
+	}
+	return journal, nil
+}
+
+func newDownloadJournal(bucket string, key string, etag string, output string, size int64) (*downloadJournal, error) {
+	p, err := downloadJournalPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if abs, err := filepath.Abs(output); err == nil {
+		output = abs
+	}
+
+	return &downloadJournal{
+		Bucket: bucket,
+		Key:    key,
+		ETag:   etag,
+		Output: output,
+		Size:   size,
+		path:   p,
+	}, nil
+}
+
+// Partial is the file the download is saved to until it's complete.
+func (j *downloadJournal) Partial() string {
+	return j.Output + DOWNLOAD_PARTIAL_SUFFIX
+}
+
+// Matches tells whether the journal is of a download of this version of the
+// object to output.
+func (j *downloadJournal) Matches(etag string, size int64, output string) bool {
+	if abs, err := filepath.Abs(output); err == nil {
+		output = abs
+	}
+	return j.ETag == etag && j.Size == size && j.Output == output
+}
+
+// Saved returns how much of the object the partial file has, and how it
+// starts, which is how the object starts.
+func (j *downloadJournal) Saved(n int) (int64, []byte, error) {
+	file, err := os.Open(j.Partial())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	start := make([]byte, n)
+	n, err = io.ReadFull(file, start)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return stat.Size(), start[:n], err
+}
+
+func (j *downloadJournal) Save() error {
+	j.Version = STATE_VERSION
+	return writeStateFile(j.path, j)
+}
+
+// Finish puts the complete download in place of the output.
+func (j *downloadJournal) Finish() error {
+	if err := os.Rename(j.Partial(), j.Output); err != nil {
+		return err
+	}
+	return j.Remove()
+}
+
+// Discard gives up on the download, deleting what it saved.
+func (j *downloadJournal) Discard() error {
+	if err := os.Remove(j.Partial()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return j.Remove()
+}
+
+func (j *downloadJournal) Remove() error {
+	err := os.Remove(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// resumedDownload returns the journal of an interrupted download of the
+// object to output, if it can go on: how much of the object was saved, and
+// how it starts.  A journal of another version of the object, or of a
+// download to another file, is discarded with what it saved.
+func resumedDownload(bucket string, key string, etag string, size int64, output string) (*downloadJournal, int64, []byte, error) {
+	journal, err := loadDownloadJournal(bucket, key)
+	if err != nil || journal == nil {
+		return nil, 0, nil, err
+	}
+
+	if NoResume {
+		return nil, 0, nil, journal.Discard()
+	}
+	if !journal.Matches(etag, size, output) {
+		ui.Printf("The interrupted download of %s was of another version of it, or to another file, starting over\n", key)
+		return nil, 0, nil, journal.Discard()
+	}
+
+	saved, start, err := journal.Saved(len(ENCRYPTION_MAGIC))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil, journal.Remove()
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if saved > size {
+		return nil, 0, nil, journal.Discard()
+	}
+	return journal, saved, start, nil
+}
@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// rangeRecordingS3 records the ranges of the GETs.
+type rangeRecordingS3 struct {
+	*fakeS3
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (f *rangeRecordingS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	f.ranges = append(f.ranges, aws.StringValue(in.Range))
+	f.mu.Unlock()
+	return f.fakeS3.GetObject(in)
+}
+
+func TestDownloadResumes(t *testing.T) {
+	data := randomData(3000)
+	fake := &rangeRecordingS3{fakeS3: newFakeS3()}
+	fake.PutObject(&s3.PutObjectInput{Key: aws.String("vm.img"), Body: bytes.NewReader(data)})
+	head, _ := fake.HeadObject(&s3.HeadObjectInput{Key: aws.String("vm.img")})
+
+	// An earlier run saved the first 1000 bytes.
+	output := filepath.Join(t.TempDir(), "vm.img")
+	journal, err := newDownloadJournal("bucket", "vm.img", *head.ETag, output, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journal.Partial(), data[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadObject(fake, "bucket", "vm.img", "", output, 2, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("saved %d bytes: %v", len(got), err)
+	}
+	if len(fake.ranges) != 1 || fake.ranges[0] != "bytes=1000-2999" {
+		t.Errorf("fetched %v", fake.ranges)
+	}
+	if _, err := os.Stat(journal.Partial()); err == nil {
+		t.Error("the partial file is still there")
+	}
+	if j, err := loadDownloadJournal("bucket", "vm.img"); err != nil || j != nil {
+		t.Errorf("the journal is still there: %v %v", j, err)
+	}
+}
+
+func TestDownloadStartsOver(t *testing.T) {
+	data := randomData(3000)
+	fake := &rangeRecordingS3{fakeS3: newFakeS3()}
+	fake.PutObject(&s3.PutObjectInput{Key: aws.String("vm.img"), Body: bytes.NewReader(data)})
+
+	// The object has been replaced since.
+	output := filepath.Join(t.TempDir(), "vm.img")
+	journal, err := newDownloadJournal("bucket", "vm.img", `"0123"`, output, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Save()
+	os.WriteFile(journal.Partial(), bytes.Repeat([]byte{'x'}, 1000), 0644)
+
+	if err := downloadObject(fake, "bucket", "vm.img", "", output, 2, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("saved %d bytes: %v", len(got), err)
+	}
+	if len(fake.ranges) != 1 || !strings.HasPrefix(fake.ranges[0], "bytes=0-") {
+		t.Errorf("fetched %v", fake.ranges)
+	}
+}
@@ -0,0 +1,189 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var DriftThreshold float64
+
+// A run whose plan or duration is this far from what's usual for its job,
+// e.g. ten times the data, is flagged.  Below these, it isn't worth it,
+// however many times the usual that is.
+const (
+	DRIFT_MIN_BYTES   = 100 << 20
+	DRIFT_MIN_SECONDS = 10 * 60
+)
+
+// runDrift is whether the run was compared with the earlier runs of its job,
+// and what was off, for the metrics.
+var runDrift struct {
+	checked bool
+	found   []string
+}
+
+// runExpectation is what a run of a job is expected to look like: the
+// median of the bytes its latest complete runs planned, and of how long
+// they took.
+type runExpectation struct {
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds,omitempty"`
+	Runs    int     `json:"runs"`
+}
+
+// recentRuns are the latest n complete runs of job, newest first.  Repaired
+// runs are left out, their time is spread over two sittings.
+func recentRuns(s3session s3iface.S3API, bucket string, job string, n int) ([]runDescriptor, error) {
+	objects, err := listAll(s3session, bucket, RUNS_PREFIX+job+"/")
+	if err != nil {
+		return nil, err
+	}
+	// The keys start with the time the run started.
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	var runs []runDescriptor
+	for i := len(objects) - 1; i >= 0 && len(runs) < n; i-- {
+		var run runDescriptor
+		if _, err := getJSON(s3session, bucket, objects[i].Key, &run); err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %w", objects[i].Key, err)
+		}
+		if run.Status == RUN_COMPLETE && run.Repaired == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+func expectRun(previous []runDescriptor) *runExpectation {
+	if len(previous) == 0 {
+		return nil
+	}
+	var bytes, seconds []float64
+	for _, run := range previous {
+		bytes = append(bytes, float64(run.Bytes))
+		if run.Finished != nil {
+			seconds = append(seconds, run.Finished.Sub(run.Started).Seconds())
+		}
+	}
+	return &runExpectation{Bytes: int64(median(bytes)), Seconds: median(seconds), Runs: len(previous)}
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// drifted describes value, if it's at least --drift-threshold times usual,
+// or that much less.
+func drifted(what string, value float64, usual float64, least float64, format func(float64) string) string {
+	if DriftThreshold <= 1 || usual <= 0 || (value < least && usual < least) {
+		return ""
+	}
+	ratio := value / usual
+	if ratio < DriftThreshold && ratio > 1/DriftThreshold {
+		return ""
+	}
+	return fmt.Sprintf("%s %s, %.1fx the usual %s", what, format(value), ratio, format(usual))
+}
+
+func driftBytes(n float64) string {
+	return formatBytes(int64(n))
+}
+
+func driftSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Second).String()
+}
+
+// expect compares the run's plan with what earlier runs of the job planned,
+// before anything is uploaded.
+func (r *runDescriptor) expect(previous []runDescriptor) {
+	r.Expected = expectRun(previous)
+	runDrift.checked = r.Expected != nil
+	if r.Expected == nil {
+		return
+	}
+	if d := drifted("planned", float64(r.Bytes), float64(r.Expected.Bytes), DRIFT_MIN_BYTES, driftBytes); d != "" {
+		r.noteDrift(d)
+	}
+}
+
+// expectDuration compares how long the finished run took with earlier runs.
+func (r *runDescriptor) expectDuration() {
+	if r.Expected == nil || r.Finished == nil {
+		return
+	}
+	if d := drifted("took", r.Finished.Sub(r.Started).Seconds(), r.Expected.Seconds, DRIFT_MIN_SECONDS, driftSeconds); d != "" {
+		r.noteDrift(d)
+	}
+}
+
+func (r *runDescriptor) noteDrift(d string) {
+	r.Drift = append(r.Drift, d)
+	runDrift.found = r.Drift
+	ui.Warnf("Warning: this run of %s %s, going by its last %d runs\n", r.Job, d, r.Expected.Runs)
+}
+
+// jobDrift is the drift of the latest run of every job, for the report.
+func jobDrift(s3session s3iface.S3API, bucket string) ([]reportDrift, error) {
+	objects, err := listAll(s3session, bucket, RUNS_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]string{}
+	for _, obj := range objects {
+		job := strings.SplitN(strings.TrimPrefix(obj.Key, RUNS_PREFIX), "/", 2)[0]
+		if obj.Key > latest[job] {
+			latest[job] = obj.Key
+		}
+	}
+
+	var drift []reportDrift
+	for _, key := range latest {
+		var run runDescriptor
+		if _, err := getJSON(s3session, bucket, key, &run); err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %w", key, err)
+		}
+		for _, d := range run.Drift {
+			drift = append(drift, reportDrift{run.Job, run.Started, d})
+		}
+	}
+	sort.SliceStable(drift, func(i, j int) bool {
+		return drift[i].Job < drift[j].Job
+	})
+	return drift, nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Float64Var(&DriftThreshold, "drift-threshold", 10, "with sync --track-run, flag runs which plan this many times the data their job's last runs did, or take this many times as long, or as much less (0 not to)")
+}
@@ -0,0 +1,98 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrifted(t *testing.T) {
+	for _, c := range []struct {
+		value, usual float64
+		drifted      bool
+	}{
+		{5 << 30, 1 << 30, false},
+		{10 << 30, 1 << 30, true},
+		{100 << 20, 1 << 30, true},
+		{0, 1 << 30, true},
+		{50 << 20, 1 << 20, false},
+		{1 << 30, 0, false},
+	} {
+		d := drifted("planned", c.value, c.usual, DRIFT_MIN_BYTES, driftBytes)
+		if (d != "") != c.drifted {
+			t.Errorf("%v against %v: %q", c.value, c.usual, d)
+		}
+	}
+
+	defer func(threshold float64) { DriftThreshold = threshold }(DriftThreshold)
+	DriftThreshold = 0
+	if d := drifted("planned", 100<<30, 1<<30, DRIFT_MIN_BYTES, driftBytes); d != "" {
+		t.Errorf("flagged %q with --drift-threshold 0", d)
+	}
+}
+
+func TestRunDrift(t *testing.T) {
+	defer func() { runDrift.checked, runDrift.found = false, nil }()
+
+	fake := newFakeS3()
+	for day := 1; day <= 4; day++ {
+		started := time.Date(2026, 10, day, 2, 0, 0, 0, time.UTC)
+		finished := started.Add(time.Hour)
+		run := runDescriptor{Job: "photos", Host: "nas", Started: started, Bytes: 200 << 20, Status: RUN_COMPLETE, Finished: &finished}
+		if day == 4 {
+			run.Bytes, run.Status = 50<<30, RUN_FAILED
+		}
+		if err := putJSON(fake, "bucket", runKey(run.Job, started, run.Host), run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous, err := recentRuns(fake, "bucket", "photos", RUN_HISTORY_USED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previous) != 3 || !previous[0].Started.After(previous[1].Started) {
+		t.Fatalf("unexpected earlier runs %+v", previous)
+	}
+
+	run := &runDescriptor{Job: "photos", Host: "nas", Started: time.Date(2026, 10, 5, 2, 0, 0, 0, time.UTC), Bytes: 3 << 30, Status: RUN_STARTED}
+	run.expect(previous)
+	if run.Expected == nil || run.Expected.Bytes != 200<<20 || run.Expected.Seconds != 3600 || run.Expected.Runs != 3 {
+		t.Errorf("unexpected expectation %+v", run.Expected)
+	}
+	if len(run.Drift) != 1 || !strings.Contains(run.Drift[0], "15.4x the usual 200.0 MiB") {
+		t.Errorf("unexpected drift %q", run.Drift)
+	}
+
+	// Twice as long isn't far enough off.
+	if err := run.finish(fake, "bucket", nil, run.Started.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Drift) != 1 || !runDrift.checked || len(runDrift.found) != 1 {
+		t.Errorf("unexpected drift %q", run.Drift)
+	}
+
+	drift, err := jobDrift(fake, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 1 || drift[0].Job != "photos" || drift[0].Detail != run.Drift[0] {
+		t.Errorf("unexpected report %+v", drift)
+	}
+}
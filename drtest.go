@@ -0,0 +1,315 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// dr-test flags
+var DRPrefix string
+var DRCount int
+var DRTier string
+var DRDays int64
+var DRPollInterval time.Duration
+var DRReport string
+var DRTimeout time.Duration
+
+var drTestCmd = &cobra.Command{
+	Use:   "dr-test",
+	Short: "Rehearse a disaster recovery by restoring and verifying a few objects",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return DRTest(newRestoreS3Session(Region), BucketName, DRPrefix, DRCount, DRTier, DRDays, DRPollInterval, DRTimeout, DRReport)
+	},
+}
+
+type drResult struct {
+	Key          string        `json:"key"`
+	Size         int64         `json:"size"`
+	RestoreTime  time.Duration `json:"restore_time"`
+	DownloadTime time.Duration `json:"download_time"`
+	Pass         bool          `json:"pass"`
+	Detail       string        `json:"detail,omitempty"`
+}
+
+// latestSet picks the objects which belong to the most recent backup: the
+// newest object under the prefix, and everything uploaded within a day
+// before it.
+func latestSet(objects []archivedObject) []archivedObject {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].LastModified.After(objects[j].LastModified)
+	})
+
+	cutoff := objects[0].LastModified.Add(-24 * time.Hour)
+
+	var set []archivedObject
+	for _, obj := range objects {
+		if obj.LastModified.Before(cutoff) {
+			break
+		}
+		set = append(set, obj)
+	}
+	return set
+}
+
+// waitForRestore polls until the restored copy of an object is readable, or
+// limit passes.
+func waitForRestore(s3session s3iface.S3API, bucket string, key string, interval time.Duration, limit waitLimit) error {
+	for {
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+
+		if checkRestored(key, head) == nil {
+			return nil
+		}
+
+		if err := limit.Check(interval, "waiting for the restore of "+key); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkRecovered downloads a restored object the way a recovery would, and
+// checks its data against the ETag.  Encrypted objects are decrypted too,
+// which authenticates every chunk, and compared with the checksum of the
+// file in the part manifest if there is one: the data being intact is no use
+// when the key to it is lost.
+func checkRecovered(s3session s3iface.S3API, bucket string, obj archivedObject) (string, error) {
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// An object we can't check doesn't pass a recovery test.
+	expected, partSizes, err := expectedETag(s3session, bucket, obj.Key, head)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := newRangeReader(s3session, bucket, obj.Key, *head.ETag, 0, obj.Size-1, 4)
+	defer chunks.Close()
+
+	if !isEncrypted(head.Metadata) {
+		ours, err := computeETag(chunks, partSizes)
+		if err != nil {
+			return "", err
+		}
+		if ours != expected {
+			return "", fmt.Errorf("ETag is %s, data hashes to %s", expected, ours)
+		}
+		return "", nil
+	}
+
+	// The data is hashed and decrypted in one pass.  A failed decryption
+	// closes the pipe, which stops the download.
+	keyID, _ := metadataValue(head.Metadata, ENCRYPTION_KEY_ID_METADATA)
+	pr, pw := io.Pipe()
+	plain := sha256.New()
+	decrypted := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(plain, decryptReader(pr, keyID))
+		if err == nil {
+			// The rest still has to be hashed for the ETag.
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		decrypted <- err
+	}()
+
+	ours, err := computeETag(io.TeeReader(chunks, pw), partSizes)
+	pw.CloseWithError(err)
+	if decryptErr := <-decrypted; decryptErr != nil {
+		return "", decryptErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if ours != expected {
+		return "", fmt.Errorf("ETag is %s, data hashes to %s", expected, ours)
+	}
+
+	m, err := loadPartManifest(s3session, bucket, obj.Key)
+	if err != nil && !isNoSuchKey(err) {
+		return "", err
+	}
+	sum := hex.EncodeToString(plain.Sum(nil))
+	if m == nil || m.PlainSHA256 == "" {
+		return "decrypted, no checksum of the file to compare with", nil
+	}
+	if sum != m.PlainSHA256 {
+		return "", fmt.Errorf("decrypted to SHA-256 %s, the file had %s", sum, m.PlainSHA256)
+	}
+	return "decrypted", nil
+}
+
+// explainDenied points out what a rehearsal with --restore-profile or
+// --restore-role found out when S3 refuses it: the disaster recovery account
+// couldn't get the archive back.
+func explainDenied(err error) error {
+	var aerr awserr.Error
+	if (RestoreProfile == "" && RestoreRole == "") || !errors.As(err, &aerr) || aerr.Code() != "AccessDenied" {
+		return err
+	}
+	if RestoreRole != "" {
+		return fmt.Errorf("%w; the role %s isn't allowed to, its policy has to grant s3:ListBucket, s3:GetObject and s3:RestoreObject on the bucket", err, RestoreRole)
+	}
+	return fmt.Errorf("%w; the %s profile isn't allowed to, the bucket policy has to grant its account s3:ListBucket, s3:GetObject and s3:RestoreObject", err, RestoreProfile)
+}
+
+func DRTest(s3session s3iface.S3API, bucket string, prefix string, count int, tier string, days int64, interval time.Duration, timeout time.Duration, report string) error {
+	if RestoreRole != "" {
+		ui.Printf("Restoring as the role %s\n", RestoreRole)
+	} else if RestoreProfile != "" {
+		ui.Printf("Restoring with the credentials of the %s profile\n", RestoreProfile)
+	}
+	objects, err := collectObjects(s3session, bucket, prefix, nil)
+	if err != nil {
+		return explainDenied(err)
+	}
+
+	if len(objects) == 0 {
+		if prefix == "" {
+			return fmt.Errorf("There are no objects in %s", bucket)
+		}
+		return fmt.Errorf("There are no objects under %q", prefix)
+	}
+
+	set := latestSet(objects)
+	backupTime := set[0].LastModified
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(len(set), func(i, j int) {
+		set[i], set[j] = set[j], set[i]
+	})
+	if count < len(set) {
+		set = set[:count]
+	}
+
+	ui.Printf("Testing %d objects from the backup made on %s\n", len(set), backupTime.Format(time.RFC1123))
+
+	cost, err := restoreCost(set, tier)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, obj := range set {
+		size += obj.Size
+	}
+	if err := checkBudget("restoring and downloading them", cost+transferCost(size)); err != nil {
+		return err
+	}
+
+	// Kick off all the restores up front, they take hours and run in
+	// parallel on the AWS side.
+	for _, obj := range set {
+		if isArchived(obj.StorageClass) {
+			if _, err := requestRestore(s3session, bucket, obj.Key, tier, days); err != nil {
+				return fmt.Errorf("Failed to restore %s: %w", obj.Key, explainDenied(err))
+			}
+		}
+	}
+
+	start := time.Now()
+	limit := waitUntil(start, timeout, "--timeout")
+	var results []drResult
+
+	for _, obj := range set {
+		result := drResult{Key: obj.Key, Size: obj.Size}
+
+		if err := waitForRestore(s3session, bucket, obj.Key, interval, limit); err != nil {
+			result.Detail = explainDenied(err).Error()
+			results = append(results, result)
+			continue
+		}
+		result.RestoreTime = time.Since(start)
+
+		downloadStart := time.Now()
+		detail, err := checkRecovered(s3session, bucket, obj)
+		result.DownloadTime = time.Since(downloadStart)
+		if err != nil {
+			result.Detail = explainDenied(err).Error()
+		} else {
+			result.Pass, result.Detail = true, detail
+		}
+
+		results = append(results, result)
+	}
+
+	var failed int
+	for _, r := range results {
+		status := "PASS"
+		if !r.Pass {
+			status = "FAIL"
+			failed++
+		}
+		ui.Printf("%s %s (%s, restored after %s, downloaded in %s) %s\n", status, r.Key,
+			formatBytes(r.Size), r.RestoreTime.Round(time.Minute), r.DownloadTime.Round(time.Second), r.Detail)
+	}
+
+	if report != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(report, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Disaster recovery test FAILED for %d of %d objects", failed, len(results))
+	}
+
+	ui.Println("Disaster recovery test PASSED")
+
+	return nil
+}
+
+func init() {
+	drTestCmd.Flags().StringVar(&DRPrefix, "prefix", "", "prefix the backups are stored under")
+	drTestCmd.Flags().IntVar(&DRCount, "count", 3, "number of objects to restore and verify")
+	drTestCmd.Flags().StringVar(&DRTier, "tier", s3.TierBulk, "retrieval tier to use")
+	drTestCmd.Flags().Int64Var(&DRDays, "days", 1, "number of days to keep restored copies")
+	drTestCmd.Flags().DurationVar(&DRPollInterval, "poll-interval", 15*time.Minute, "how often to check whether restores have finished")
+	drTestCmd.Flags().DurationVar(&DRTimeout, "timeout", 72*time.Hour, "give up on restores which haven't finished after this long")
+	drTestCmd.Flags().StringVar(&DRReport, "report", "", "write a JSON report to this file")
+	rootCmd.AddCommand(drTestCmd)
+}
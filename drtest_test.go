@@ -0,0 +1,106 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDRTestDecrypts(t *testing.T) {
+	defer func() { PartManifest = false }()
+	useSecret(t, "")
+	Encrypt, PartManifest = true, true
+
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(PART_SIZE+1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	Encrypt = false
+
+	// Without --prefix, the latest backup is looked for in the whole
+	// bucket.
+	fake.restoreHeads = 2
+	if err := DRTest(fake, "bucket", "", 3, s3.TierBulk, 1, time.Millisecond, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Intact data is no use without the key to it.
+	useSecret(t, "not the key file")
+	if err := DRTest(fake, "bucket", "", 3, s3.TierBulk, 1, time.Millisecond, time.Hour, ""); err == nil {
+		t.Error("the test passed with the wrong key")
+	}
+	secret = nil
+	if err := DRTest(fake, "bucket", "", 3, s3.TierBulk, 1, time.Millisecond, time.Hour, ""); err == nil {
+		t.Error("the test passed without a key")
+	}
+}
+
+func TestDRTestUnverifiable(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(1024)
+	fake.objects["backups/db.dump"] = &fakeObject{data: data, etag: "0123456789abcdef0123456789abcdef",
+		storageClass: s3.StorageClassStandard, sse: s3.ServerSideEncryptionAwsKms, modified: time.Now()}
+
+	// SSE-KMS without a part manifest: the data comes back, but there's
+	// nothing to check it against.
+	err := DRTest(fake, "bucket", "backups/", 3, s3.TierBulk, 1, time.Millisecond, time.Hour, "")
+	if err == nil {
+		t.Error("an unverifiable object passed")
+	}
+}
+
+func TestDRTestTimeout(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(1024)
+	fake.objects["backups/db.dump"] = &fakeObject{data: data, etag: md5Hex(data),
+		storageClass: s3.StorageClassDeepArchive, modified: time.Now()}
+	fake.restoreHeads = 100
+
+	err := DRTest(fake, "bucket", "backups/", 3, s3.TierBulk, 1, time.Second, time.Millisecond, "")
+	if err == nil || !strings.Contains(err.Error(), "FAILED") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// readOnlyS3 is the fake as seen with credentials which may read, but not
+// restore.
+type readOnlyS3 struct {
+	*fakeS3
+}
+
+func (f readOnlyS3) RestoreObject(in *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	return nil, awserr.New("AccessDenied", "Access Denied", nil)
+}
+
+func TestDRTestRestoreProfile(t *testing.T) {
+	defer func() { RestoreProfile = "" }()
+	RestoreProfile = "dr"
+
+	fake := newFakeS3()
+	fake.objects["backups/db.dump"] = &fakeObject{data: randomData(1024), etag: "0123456789abcdef0123456789abcdef",
+		storageClass: s3.StorageClassDeepArchive, modified: time.Now()}
+
+	err := DRTest(readOnlyS3{fake}, "bucket", "backups/", 3, s3.TierBulk, 1, time.Millisecond, time.Hour, "")
+	if err == nil || !strings.Contains(err.Error(), "the dr profile isn't allowed to") {
+		t.Errorf("got %v", err)
+	}
+}
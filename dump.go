@@ -0,0 +1,256 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// dump flags
+var DumpKey string
+var DumpExpectedSize string
+var DumpHelperImage string
+
+const DEFAULT_DUMP_KEY = "dumps/{name}/{name}-{time}"
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump postgres|mysql|mongodb database | dump docker-volume|docker-image|podman-volume|podman-image name | dump - | dump -- program [args...]",
+	Short: "Stream a database dump, a container volume or image, or any program's output, into an upload",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		source, err := newDumpSource(args, cmd.ArgsLenAtDash())
+		if err == nil {
+			err = checkSpoolSpace()
+		}
+		if err == nil {
+			err = Dump(BucketName, Region, source, DumpKey, DumpExpectedSize, time.Now())
+		}
+		return err
+	},
+}
+
+// dumpSource is what's uploaded: a program's output, or stdin without one.
+// Kind and Source are stored with the object, to tell what it's a dump of.
+type dumpSource struct {
+	Name    string
+	Command []string
+	Ext     string
+	Kind    string
+	Source  string
+}
+
+// Metadata of dumps.
+const (
+	DUMP_METADATA_KIND   = "dump-kind"
+	DUMP_METADATA_SOURCE = "dump-source"
+)
+
+// containerName makes an image like registry.example.com/app:1.2 usable in
+// a key.
+func containerName(name string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(name)
+}
+
+// newDumpSource picks the program for a kind of database.  The dump tools
+// take their credentials the usual way: ~/.pgpass and PG* variables,
+// ~/.my.cnf, or a --uri given to mongodump after --.
+func newDumpSource(args []string, dash int) (dumpSource, error) {
+	if dash == 0 {
+		return dumpSource{filepath.Base(args[0]), args, ".out", "command", strings.Join(args, " ")}, nil
+	}
+	if args[0] == "-" && len(args) == 1 {
+		return dumpSource{"stdin", nil, ".out", "stdin", ""}, nil
+	}
+	if len(args) != 2 {
+		return dumpSource{}, fmt.Errorf("Expected the kind of database and its name, e.g. dump postgres mydb")
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "postgres":
+		return dumpSource{name, []string{"pg_dump", "--format=custom", name}, ".dump", args[0], name}, nil
+	case "mysql":
+		return dumpSource{name, []string{"mysqldump", "--single-transaction", "--routines", "--triggers", name}, ".sql", args[0], name}, nil
+	case "mongodb":
+		return dumpSource{name, []string{"mongodump", "--archive", "--db=" + name}, ".archive", args[0], name}, nil
+
+	// A volume is archived by a throwaway container which has it mounted
+	// read only.  Stop the containers writing to it first for a
+	// consistent copy.
+	case "docker-volume", "podman-volume":
+		engine := strings.TrimSuffix(args[0], "-volume")
+		command := []string{engine, "run", "--rm", "--volume", name + ":/volume:ro", DumpHelperImage, "tar", "-C", "/volume", "-cf", "-", "."}
+		return dumpSource{containerName(name), command, ".tar", args[0], name}, nil
+
+	// docker save writes the layers and the image's manifest.json, which
+	// docker load reads back.
+	case "docker-image", "podman-image":
+		engine := strings.TrimSuffix(args[0], "-image")
+		return dumpSource{containerName(name), []string{engine, "save", name}, ".tar", args[0], name}, nil
+	}
+	return dumpSource{}, fmt.Errorf("Unknown kind %s, expected postgres, mysql, mongodb, docker-volume, docker-image, podman-volume or podman-image, or a program after --", args[0])
+}
+
+// dumpKey expands {name}, {date} and {time} in the key template, and adds
+// the extension of the dump and of its compression.
+func dumpKey(template string, source dumpSource, compress string, now time.Time) string {
+	now = now.UTC()
+	key := strings.NewReplacer(
+		"{name}", source.Name,
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("20060102T150405Z"),
+	).Replace(template)
+
+	if template != DEFAULT_DUMP_KEY {
+		return key
+	}
+	key += source.Ext
+	switch compress {
+	case COMPRESS_GZIP:
+		key += ".gz"
+	case COMPRESS_ZSTD:
+		key += ".zst"
+	}
+	return key
+}
+
+// dumpPartSize is the part size for a stream of about expected bytes.
+// Streams are cut into PART_SIZE parts, which limits them to 10,000 of
+// those; larger ones need larger parts, decided before the first is sent.
+// A quarter is added in case the dump grew.
+func dumpPartSize(expected int64) int {
+	partSize := int64(PART_SIZE)
+	needed := (expected + expected/4 + MAX_PARTS - 1) / MAX_PARTS
+	if needed > partSize {
+		const mib = 1024 * 1024
+		partSize = (needed + mib - 1) / mib * mib
+	}
+	return int(partSize)
+}
+
+// commandReader is the output of a program, which fails if the program
+// does, so that a dump which broke off isn't taken for a whole one.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("%s failed: %w: %s", c.cmd.Args[0], waitErr, strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func startCommand(args []string) (io.Reader, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run %s: %w", args[0], err)
+	}
+	return &commandReader{stdout, cmd, stderr}, nil
+}
+
+func Dump(bucket string, region string, source dumpSource, template string, expectedSize string, now time.Time) error {
+	return dump(newS3Session(region), lazyCleanup(region), bucket, source, template, expectedSize, now)
+}
+
+// dump streams source, compressed and encrypted as asked for, into an
+// upload to a key stamped with the time.
+func dump(s3session s3iface.S3API, cleanup cleanupSession, bucket string, source dumpSource, template string, expectedSize string, now time.Time) error {
+	if Compress != "" && Compress != COMPRESS_GZIP && Compress != COMPRESS_ZSTD {
+		return fmt.Errorf("--compress is either %s or %s", COMPRESS_GZIP, COMPRESS_ZSTD)
+	}
+
+	var expected int64
+	if expectedSize != "" {
+		var err error
+		if expected, err = parseSize(expectedSize); err != nil {
+			return err
+		}
+	}
+	partSize := streamPartSize(expected)
+
+	key := dumpKey(template, source, Compress, now)
+
+	var output io.Reader = os.Stdin
+	if source.Command != nil {
+		ui.Println("Running", strings.Join(source.Command, " "))
+		var err error
+		if output, err = startCommand(source.Command); err != nil {
+			return err
+		}
+	}
+
+	name := "standard input"
+	if source.Command != nil {
+		name = source.Command[0]
+	}
+	input := newStreamInput(name, expected, Compress != "")
+	stream := pipeStream(Compress, func(w io.Writer) error {
+		_, err := io.Copy(w, input.Reader(output))
+		return err
+	})
+	defer stream.Close()
+
+	metadata := map[string]*string{DUMP_METADATA_KIND: aws.String(source.Kind)}
+	if source.Source != "" {
+		metadata[DUMP_METADATA_SOURCE] = aws.String(source.Source)
+	}
+	metadata = compressionMetadata(metadata, Compress)
+
+	var r io.Reader = stream
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		metadata = encryptionMetadata(metadata, c)
+		r = encryptReader(stream, c)
+	}
+
+	return uploadStream(s3session, cleanup, bucket, key, r, input, metadata, partSize)
+}
+
+func init() {
+	dumpCmd.Flags().StringVar(&DumpKey, "key", DEFAULT_DUMP_KEY, "key to upload to; {name}, {date} and {time} are expanded")
+	dumpCmd.Flags().StringVar(&Compress, "compress", "", "compress the dump: gzip or zstd (needs the zstd program)")
+	dumpCmd.Flags().StringVar(&DumpExpectedSize, "expected-size", "", "about how large the dump will be, e.g. 2T, to pick parts large enough")
+	dumpCmd.Flags().StringVar(&DumpHelperImage, "helper-image", "docker.io/library/alpine", "image of the container archiving docker-volume and podman-volume")
+	dumpCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts to upload in parallel")
+	rootCmd.AddCommand(dumpCmd)
+}
@@ -0,0 +1,119 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewDumpSource(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		dash int
+		want dumpSource
+	}{
+		{[]string{"postgres", "shop"}, -1, dumpSource{"shop", []string{"pg_dump", "--format=custom", "shop"}, ".dump", "postgres", "shop"}},
+		{[]string{"mongodb", "logs"}, -1, dumpSource{"logs", []string{"mongodump", "--archive", "--db=logs"}, ".archive", "mongodb", "logs"}},
+		{[]string{"-"}, -1, dumpSource{"stdin", nil, ".out", "stdin", ""}},
+		{[]string{"/usr/bin/sqlite3", "app.db", ".dump"}, 0, dumpSource{"sqlite3", []string{"/usr/bin/sqlite3", "app.db", ".dump"}, ".out", "command", "/usr/bin/sqlite3 app.db .dump"}},
+		{[]string{"podman-image", "ghcr.io/acme/app:1.2"}, -1, dumpSource{"ghcr.io_acme_app_1.2", []string{"podman", "save", "ghcr.io/acme/app:1.2"}, ".tar", "podman-image", "ghcr.io/acme/app:1.2"}},
+	} {
+		got, err := newDumpSource(c.args, c.dash)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %+v %v, want %+v", c.args, got, err, c.want)
+		}
+	}
+
+	DumpHelperImage = "alpine"
+	volume, err := newDumpSource([]string{"docker-volume", "nextcloud_data"}, -1)
+	want := []string{"docker", "run", "--rm", "--volume", "nextcloud_data:/volume:ro", "alpine", "tar", "-C", "/volume", "-cf", "-", "."}
+	if err != nil || !reflect.DeepEqual(volume.Command, want) || volume.Ext != ".tar" {
+		t.Errorf("docker-volume: got %+v %v", volume, err)
+	}
+
+	for _, args := range [][]string{{"oracle", "db"}, {"postgres"}, {"postgres", "a", "b"}} {
+		if _, err := newDumpSource(args, -1); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+}
+
+func TestDumpKey(t *testing.T) {
+	now := time.Date(2026, 10, 16, 3, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	source := dumpSource{Name: "shop", Ext: ".sql"}
+
+	if key := dumpKey(DEFAULT_DUMP_KEY, source, COMPRESS_ZSTD, now); key != "dumps/shop/shop-20261016T010000Z.sql.zst" {
+		t.Errorf("default key %s", key)
+	}
+	if key := dumpKey("db/{date}/{name}.sql.gz", source, COMPRESS_GZIP, now); key != "db/2026-10-16/shop.sql.gz" {
+		t.Errorf("templated key %s", key)
+	}
+}
+
+func TestDumpPartSize(t *testing.T) {
+	if size := dumpPartSize(100 << 30); size != PART_SIZE {
+		t.Errorf("100 GiB in %d byte parts", size)
+	}
+
+	const expected = 2 << 40
+	size := dumpPartSize(expected)
+	if int64(size)*MAX_PARTS < expected+expected/4 || size%(1<<20) != 0 {
+		t.Errorf("2 TiB in %d byte parts", size)
+	}
+}
+
+func TestDump(t *testing.T) {
+	defer func() { Compress = "" }()
+	now := time.Date(2026, 10, 16, 3, 0, 0, 0, time.UTC)
+
+	Compress = COMPRESS_GZIP
+	fake := newFakeS3()
+	source := dumpSource{"test", []string{"sh", "-c", "printf hello"}, ".out", "command", "sh -c printf hello"}
+	if err := dump(fake, fake.cleanup, "bucket", source, DEFAULT_DUMP_KEY, "", now); err != nil {
+		t.Fatal(err)
+	}
+	obj := fake.objects["dumps/test/test-20261016T030000Z.out.gz"]
+	if obj == nil {
+		t.Fatalf("no dump in %v", fake.objects)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(obj.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(gz); err != nil || string(data) != "hello" {
+		t.Errorf("dump contains %q: %v", data, err)
+	}
+	if kind, _ := metadataValue(obj.metadata, DUMP_METADATA_KIND); kind != "command" {
+		t.Errorf("dump of kind %q", kind)
+	}
+
+	// A dump which failed halfway isn't kept.
+	Compress = ""
+	fake = newFakeS3()
+	source = dumpSource{Name: "test", Command: []string{"sh", "-c", "printf partial; exit 3"}, Ext: ".out", Kind: "command"}
+	if err := dump(fake, fake.cleanup, "bucket", source, DEFAULT_DUMP_KEY, "", now); err == nil {
+		t.Error("a failed dump was uploaded")
+	}
+	if len(fake.objects) != 0 || len(fake.uploads) != 0 {
+		t.Error("the failed dump was left behind")
+	}
+}
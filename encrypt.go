@@ -0,0 +1,444 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// CLI flags
+var Encrypt bool
+var EncryptionKeyFile string
+var PassphraseFile string
+
+// The passphrase can also come from the environment, so that it doesn't
+// have to be written to a file.
+const PASSPHRASE_ENV = "S3_GLACIER_PASSPHRASE"
+
+// Encrypted objects start with a header saying how their key was derived,
+// followed by chunks of up to ENCRYPTION_CHUNK bytes of the file, each
+// sealed with AES-256-GCM on its own.  A chunk is its nonce followed by the
+// ciphertext and the tag.  The chunk's number, and whether it's the last
+// one, are authenticated with it, so chunks can't be reordered, dropped or
+// cut off at the end without decryption failing.
+const (
+	ENCRYPTION_MAGIC    = "S3GLENC1"
+	ENCRYPTION_CHUNK    = 64 * 1024
+	ENCRYPTION_NONCE    = 12
+	ENCRYPTION_OVERHEAD = ENCRYPTION_NONCE + 16
+	ENCRYPTION_SALT     = 16
+	ENCRYPTION_HEADER   = len(ENCRYPTION_MAGIC) + 1 + ENCRYPTION_SALT
+
+	ENCRYPTION_METADATA        = "encryption"
+	ENCRYPTION_KEY_ID_METADATA = "encryption-key-id"
+	ENCRYPTION_SCHEME          = "aes-256-gcm-chunked"
+)
+
+// How the key was derived from the secret, the byte after the magic.
+// KDF_SCRYPT ran scrypt for every object, KDF_SCRYPT_HKDF runs it once per
+// bucket and derives the keys of objects from the result with HKDF.  The
+// salt of those is half the bucket's, for scrypt, and half the object's.
+const (
+	KDF_KEY_FILE    = 1
+	KDF_SCRYPT      = 2
+	KDF_SCRYPT_HKDF = 3
+)
+
+// encryptionSecret is what --encryption-key-file or the passphrase gave us.
+// Every object gets keys of its own, derived from it and a salt.
+type encryptionSecret struct {
+	kdf      byte
+	keyFile  []byte
+	password []byte
+
+	// masters are the scrypt keys of the password, by salt, so that it
+	// only takes its time once per run.
+	mu      sync.Mutex
+	masters map[string][]byte
+}
+
+// scryptKey derives a key from the password, or returns the one it derived
+// before with the same salt.
+func (s *encryptionSecret) scryptKey(salt []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.masters[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(s.password, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	if s.masters == nil {
+		s.masters = map[string][]byte{}
+	}
+	s.masters[string(salt)] = key
+	return key, nil
+}
+
+var secret *encryptionSecret
+
+// loadEncryptionSecret reads the key file or the passphrase up front, like
+// the signing keys, so that a missing one doesn't surface after a day of
+// uploading.
+func loadEncryptionSecret() error {
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if PassphraseFile != "" {
+		data, err := os.ReadFile(PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read --passphrase-file: %w", err)
+		}
+		passphrase = strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	}
+
+	switch {
+	case EncryptionKeyFile != "" && passphrase != "":
+		return fmt.Errorf("Give either --encryption-key-file or a passphrase, not both")
+	case EncryptionKeyFile != "":
+		data, err := os.ReadFile(EncryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read --encryption-key-file: %w", err)
+		}
+		if len(data) < 32 {
+			return fmt.Errorf("--encryption-key-file has to hold at least 32 bytes, e.g. from head -c 32 /dev/urandom")
+		}
+		sum := sha256.Sum256(data)
+		secret = &encryptionSecret{kdf: KDF_KEY_FILE, keyFile: sum[:]}
+	case passphrase != "":
+		secret = &encryptionSecret{kdf: KDF_SCRYPT_HKDF, password: []byte(passphrase)}
+	}
+
+	if Encrypt {
+		if secret == nil {
+			return fmt.Errorf("--encrypt needs --encryption-key-file, --passphrase-file or %s", PASSPHRASE_ENV)
+		}
+		if PreviewSize != "" || PreviewCommand != "" {
+			return fmt.Errorf("A preview would be stored unencrypted, so it can't be used with --encrypt")
+		}
+		if Nodes > 1 {
+			return fmt.Errorf("--encrypt can't be used with --nodes yet")
+		}
+	}
+	return nil
+}
+
+// objectCipher encrypts and decrypts one object.
+type objectCipher struct {
+	kdf      byte
+	salt     []byte
+	aead     cipher.AEAD
+	nonceKey []byte
+	id       string
+}
+
+func hmacSHA256(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// hkdfKey derives the key for purpose from master with HKDF-SHA256.
+func hkdfKey(master []byte, salt []byte, purpose string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, master, salt, []byte(purpose)), key)
+	return key
+}
+
+func deriveCipher(s *encryptionSecret, kdf byte, salt []byte) (*objectCipher, error) {
+	switch kdf {
+	case KDF_KEY_FILE:
+		if s.keyFile == nil {
+			return nil, fmt.Errorf("It was encrypted with a key file, not a passphrase")
+		}
+	case KDF_SCRYPT, KDF_SCRYPT_HKDF:
+		if s.password == nil {
+			return nil, fmt.Errorf("It was encrypted with a passphrase, not a key file")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown key derivation %d", kdf)
+	}
+
+	var encryptKey, nonceKey, idKey []byte
+	switch kdf {
+	case KDF_KEY_FILE:
+		master := hmacSHA256(s.keyFile, salt)
+		encryptKey, nonceKey, idKey = hmacSHA256(master, []byte("encrypt")), hmacSHA256(master, []byte("nonce")), hmacSHA256(master, []byte("id"))
+	case KDF_SCRYPT:
+		master, err := scrypt.Key(s.password, salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		encryptKey, nonceKey, idKey = hmacSHA256(master, []byte("encrypt")), hmacSHA256(master, []byte("nonce")), hmacSHA256(master, []byte("id"))
+	case KDF_SCRYPT_HKDF:
+		half := ENCRYPTION_SALT / 2
+		master, err := s.scryptKey(salt[:half])
+		if err != nil {
+			return nil, err
+		}
+		objectSalt := salt[half:]
+		encryptKey, nonceKey, idKey = hkdfKey(master, objectSalt, "encrypt"), hkdfKey(master, objectSalt, "nonce"), hkdfKey(master, objectSalt, "id")
+	}
+
+	block, err := aes.NewCipher(encryptKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectCipher{
+		kdf:      kdf,
+		salt:     salt,
+		aead:     aead,
+		nonceKey: nonceKey,
+		id:       hex.EncodeToString(idKey[:8]),
+	}, nil
+}
+
+// newObjectCipher is the cipher for uploading to key.  The salt comes from
+// the bucket and the key, so that uploading the same file there again
+// encrypts it the same way: resumed uploads, --base and verify compare the
+// parts by their digests.  With a passphrase, the first half of it only
+// comes from the bucket, so scrypt runs once for all of its objects.
+func newObjectCipher(bucket string, key string) (*objectCipher, error) {
+	if secret == nil {
+		return nil, fmt.Errorf("%s is encrypted, give --encryption-key-file, --passphrase-file or %s", key, PASSPHRASE_ENV)
+	}
+	salt := sha256.Sum256([]byte("s3-glacier-uploader\x00" + bucket + "/" + key))
+	if secret.kdf == KDF_SCRYPT_HKDF {
+		bucketSalt := sha256.Sum256([]byte("s3-glacier-uploader\x00" + bucket))
+		copy(salt[:ENCRYPTION_SALT/2], bucketSalt[:])
+	}
+	return deriveCipher(secret, secret.kdf, salt[:ENCRYPTION_SALT])
+}
+
+func (c *objectCipher) header() []byte {
+	header := append([]byte(ENCRYPTION_MAGIC), c.kdf)
+	return append(header, c.salt...)
+}
+
+func chunkData(index uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// seal encrypts a chunk.  The nonce is derived from the chunk and its
+// position, which makes it unique for as long as the plaintext is.
+func (c *objectCipher) seal(dst []byte, index uint64, final bool, plain []byte) []byte {
+	ad := chunkData(index, final)
+	nonce := hmacSHA256(c.nonceKey, ad, plain)[:ENCRYPTION_NONCE]
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, plain, ad)
+}
+
+func (c *objectCipher) open(dst []byte, index uint64, final bool, chunk []byte) ([]byte, error) {
+	if len(chunk) < ENCRYPTION_OVERHEAD {
+		return nil, fmt.Errorf("The encrypted data is cut off")
+	}
+	plain, err := c.aead.Open(dst, chunk[:ENCRYPTION_NONCE], chunk[ENCRYPTION_NONCE:], chunkData(index, final))
+	if err != nil {
+		return nil, fmt.Errorf("Decryption failed, the key is wrong or the data is damaged")
+	}
+	return plain, nil
+}
+
+// encryptedSize is how large a file of size bytes is once encrypted.
+func encryptedSize(size int64) int64 {
+	chunks := (size + ENCRYPTION_CHUNK - 1) / ENCRYPTION_CHUNK
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(ENCRYPTION_HEADER) + chunks*ENCRYPTION_OVERHEAD + size
+}
+
+// uploadedSize is how large a file of size bytes is in the bucket.
+func uploadedSize(size int64) int64 {
+	if Encrypt {
+		return encryptedSize(size)
+	}
+	return size
+}
+
+func encryptionMetadata(metadata map[string]*string, c *objectCipher) map[string]*string {
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	scheme, id := ENCRYPTION_SCHEME, c.id
+	metadata[ENCRYPTION_METADATA] = &scheme
+	metadata[ENCRYPTION_KEY_ID_METADATA] = &id
+	return metadata
+}
+
+func isEncrypted(metadata map[string]*string) bool {
+	_, ok := metadataValue(metadata, ENCRYPTION_METADATA)
+	return ok
+}
+
+// chunkReader reads fixed size chunks and tells whether each is the last.
+type chunkReader struct {
+	src *bufio.Reader
+	buf []byte
+}
+
+func (r *chunkReader) next() ([]byte, bool, error) {
+	n, err := io.ReadFull(r.src, r.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return r.buf[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := r.src.Peek(1); err == io.EOF {
+		return r.buf[:n], true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return r.buf[:n], false, nil
+}
+
+type encryptingReader struct {
+	chunks chunkReader
+	c      *objectCipher
+	index  uint64
+	out    []byte
+	sealed []byte
+	done   bool
+}
+
+// encryptReader encrypts r as it's read.
+func encryptReader(r io.Reader, c *objectCipher) io.Reader {
+	return &encryptingReader{
+		chunks: chunkReader{bufio.NewReader(r), make([]byte, ENCRYPTION_CHUNK)},
+		c:      c,
+		out:    c.header(),
+		sealed: make([]byte, 0, ENCRYPTION_CHUNK+ENCRYPTION_OVERHEAD),
+	}
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		plain, final, err := e.chunks.next()
+		if err != nil {
+			return 0, err
+		}
+		e.out = e.c.seal(e.sealed[:0], e.index, final, plain)
+		e.index++
+		e.done = final
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+type decryptingReader struct {
+	chunks chunkReader
+	c      *objectCipher
+	keyID  string
+	index  uint64
+	out    []byte
+	plain  []byte
+	done   bool
+}
+
+// decryptReader decrypts r, an object which was encrypted with the key
+// keyID.  The key is derived again from the salt in the header.
+func decryptReader(r io.Reader, keyID string) io.Reader {
+	return &decryptingReader{
+		chunks: chunkReader{bufio.NewReader(r), make([]byte, ENCRYPTION_CHUNK+ENCRYPTION_OVERHEAD)},
+		keyID:  keyID,
+		plain:  make([]byte, 0, ENCRYPTION_CHUNK),
+	}
+}
+
+func (d *decryptingReader) readHeader() error {
+	if secret == nil {
+		return fmt.Errorf("The object is encrypted, give --encryption-key-file, --passphrase-file or %s", PASSPHRASE_ENV)
+	}
+
+	header := make([]byte, ENCRYPTION_HEADER)
+	if _, err := io.ReadFull(d.chunks.src, header); err != nil {
+		return fmt.Errorf("Failed to read the encryption header: %w", err)
+	}
+	if !bytes.HasPrefix(header, []byte(ENCRYPTION_MAGIC)) {
+		return fmt.Errorf("The object doesn't start with an encryption header")
+	}
+
+	c, err := deriveCipher(secret, header[len(ENCRYPTION_MAGIC)], header[len(ENCRYPTION_MAGIC)+1:])
+	if err != nil {
+		return err
+	}
+	if d.keyID != "" && c.id != d.keyID {
+		return fmt.Errorf("The object was encrypted with another key")
+	}
+	d.c = c
+	return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.c == nil {
+		if err := d.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		chunk, final, err := d.chunks.next()
+		if err != nil {
+			return 0, err
+		}
+		if d.out, err = d.c.open(d.plain[:0], d.index, final, chunk); err != nil {
+			return 0, err
+		}
+		d.index++
+		d.done = final
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
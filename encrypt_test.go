@@ -0,0 +1,214 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSecret sets up encryption with a key file, or a passphrase, for the
+// rest of the test.
+func useSecret(t *testing.T, passphrase string) {
+	t.Helper()
+	EncryptionKeyFile, PassphraseFile, secret = "", "", nil
+	t.Cleanup(func() { EncryptionKeyFile, PassphraseFile, secret, Encrypt = "", "", nil, false })
+
+	if passphrase != "" {
+		PassphraseFile = filepath.Join(t.TempDir(), "passphrase")
+		if err := os.WriteFile(PassphraseFile, []byte(passphrase+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		EncryptionKeyFile = filepath.Join(t.TempDir(), "key")
+		if err := os.WriteFile(EncryptionKeyFile, randomData(32), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadEncryptionSecret(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encryptBytes(t *testing.T, c *objectCipher, data []byte) []byte {
+	t.Helper()
+	encrypted, err := io.ReadAll(encryptReader(bytes.NewReader(data), c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		useSecret(t, passphrase)
+		c, err := newObjectCipher("bucket", "archive.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []int{0, 1, ENCRYPTION_CHUNK, ENCRYPTION_CHUNK + 1, 3 * ENCRYPTION_CHUNK} {
+			data := randomData(size)
+			encrypted := encryptBytes(t, c, data)
+			if int64(len(encrypted)) != encryptedSize(int64(size)) {
+				t.Errorf("%d bytes encrypted to %d, expected %d", size, len(encrypted), encryptedSize(int64(size)))
+			}
+			if size > 0 && bytes.Contains(encrypted, data) {
+				t.Errorf("%d bytes: the plaintext is in the output", size)
+			}
+
+			// Encrypting the same file for the same key gives the same
+			// parts, which is what resuming relies on.
+			if again := encryptBytes(t, c, data); !bytes.Equal(again, encrypted) {
+				t.Errorf("%d bytes: encrypting again gave something else", size)
+			}
+
+			decrypted, err := io.ReadAll(decryptReader(bytes.NewReader(encrypted), c.id))
+			if err != nil || !bytes.Equal(decrypted, data) {
+				t.Errorf("%d bytes: decrypted %d bytes: %v", size, len(decrypted), err)
+			}
+		}
+	}
+}
+
+func TestPassphraseKeys(t *testing.T) {
+	useSecret(t, "correct horse battery staple")
+
+	a, err := newObjectCipher("bucket", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newObjectCipher("bucket", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.kdf != KDF_SCRYPT_HKDF || a.id == b.id {
+		t.Errorf("kdf %d, key ids %s and %s", a.kdf, a.id, b.id)
+	}
+	// scrypt ran once for the bucket, not for every object.
+	if len(secret.masters) != 1 {
+		t.Errorf("%d scrypt keys", len(secret.masters))
+	}
+
+	// Objects encrypted with scrypt for every object still decrypt.
+	old, err := deriveCipher(secret, KDF_SCRYPT, randomData(ENCRYPTION_SALT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(ENCRYPTION_CHUNK + 1)
+	decrypted, err := io.ReadAll(decryptReader(bytes.NewReader(encryptBytes(t, old, data)), old.id))
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("decrypted %d bytes: %v", len(decrypted), err)
+	}
+}
+
+func TestDecryptDamaged(t *testing.T) {
+	useSecret(t, "")
+	c, err := newObjectCipher("bucket", "archive.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encryptBytes(t, c, randomData(3*ENCRYPTION_CHUNK))
+
+	flipped := append([]byte(nil), encrypted...)
+	flipped[ENCRYPTION_HEADER+100] ^= 1
+
+	chunk := ENCRYPTION_CHUNK + ENCRYPTION_OVERHEAD
+	for name, data := range map[string][]byte{
+		"flipped bit":     flipped,
+		"last chunk gone": encrypted[:ENCRYPTION_HEADER+2*chunk],
+		"cut off":         encrypted[:len(encrypted)-10],
+		"no header":       encrypted[ENCRYPTION_HEADER:],
+	} {
+		if _, err := io.ReadAll(decryptReader(bytes.NewReader(data), c.id)); err == nil {
+			t.Errorf("%s: decrypted without an error", name)
+		}
+	}
+
+	if _, err := io.ReadAll(decryptReader(bytes.NewReader(encrypted), "0123456789abcdef")); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("decrypting with the wrong key: %v", err)
+	}
+
+	useSecret(t, "a passphrase")
+	if _, err := io.ReadAll(decryptReader(bytes.NewReader(encrypted), "")); err == nil {
+		t.Error("decrypted a key file object with a passphrase")
+	}
+}
+
+func TestLoadEncryptionSecret(t *testing.T) {
+	defer func() { Encrypt, PreviewSize, EncryptionKeyFile, secret = false, "", "", nil }()
+
+	Encrypt = true
+	if err := loadEncryptionSecret(); err == nil {
+		t.Error("--encrypt without a key")
+	}
+
+	EncryptionKeyFile = filepath.Join(t.TempDir(), "short")
+	os.WriteFile(EncryptionKeyFile, []byte("hunter2"), 0o600)
+	if err := loadEncryptionSecret(); err == nil {
+		t.Error("accepted a 7 byte key file")
+	}
+
+	os.WriteFile(EncryptionKeyFile, randomData(32), 0o600)
+	PreviewSize = "1M"
+	if err := loadEncryptionSecret(); err == nil {
+		t.Error("--encrypt with an unencrypted preview")
+	}
+}
+
+func TestUploadEncrypted(t *testing.T) {
+	useSecret(t, "")
+	Encrypt = true
+
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+
+	// The third part fails, and running again resumes the upload.
+	fake := interruptedUpload(t, filename)
+	if err := uploadFile(fake.fakeS3, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.partUploads != 1 {
+		t.Errorf("the resumed upload sent %d parts, want only the third", fake.partUploads)
+	}
+
+	obj := fake.objects["archive.bin"]
+	if obj == nil || int64(len(obj.data)) != encryptedSize(int64(len(data))) {
+		t.Fatal("the encrypted object is missing or of the wrong size")
+	}
+	if !isEncrypted(obj.metadata) {
+		t.Error("the object isn't marked as encrypted")
+	}
+
+	keyID, _ := metadataValue(obj.metadata, ENCRYPTION_KEY_ID_METADATA)
+	decrypted, err := io.ReadAll(decryptReader(bytes.NewReader(obj.data), keyID))
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("the object doesn't decrypt to the file: %v", err)
+	}
+
+	if err := Verify(fake.fakeS3, "bucket", filename, ""); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	os.WriteFile(filename, randomData(len(data)-1), 0o644)
+	if err := Verify(fake.fakeS3, "bucket", filename, ""); err == nil {
+		t.Error("a changed file verified")
+	}
+}
@@ -0,0 +1,123 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// CLI flags
+var ForcePathStyle bool
+var NoVerifySSL bool
+
+// STORAGE_CLASS_NONE leaves the storage class to the server, for S3
+// compatible ones without Glacier.
+const STORAGE_CLASS_NONE = "none"
+
+// insecureTransport is what requests go through with --no-verify-ssl.
+var insecureTransport *http.Transport
+
+func checkEndpoint() error {
+	if S3Endpoint != "" {
+		u, err := url.Parse(S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid --endpoint-url %q, use e.g. https://s3.us-west-1.wasabisys.com", S3Endpoint)
+		}
+
+		// Glacier is AWS only, so the default doesn't apply elsewhere.
+		if configSources["storage-class"] == SOURCE_DEFAULT {
+			StorageClass = STORAGE_CLASS_NONE
+		}
+	}
+
+	if NoVerifySSL && insecureTransport == nil {
+		ui.Warnln("Not verifying TLS certificates (--no-verify-ssl), anyone in between can read and change what's sent")
+		insecureTransport = baseTransport().(*http.Transport).Clone()
+		insecureTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return nil
+}
+
+// baseTransport is what every request goes through in the end.
+func baseTransport() http.RoundTripper {
+	if insecureTransport != nil {
+		return insecureTransport
+	}
+	if dialingTransport != nil {
+		return dialingTransport
+	}
+	return http.DefaultTransport
+}
+
+// usesPathStyle tells whether buckets go in the path rather than the host
+// name.  Servers on localhost, an IP address or a host name without a domain,
+// like MinIO in a container, can't have buckets as subdomains.
+func usesPathStyle(endpoint string) bool {
+	if ForcePathStyle {
+		return true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	return host == "localhost" || net.ParseIP(host) != nil || !strings.Contains(host, ".")
+}
+
+// configureEndpoint points the session at --endpoint-url.
+func configureEndpoint(config *aws.Config) {
+	if S3Endpoint != "" {
+		config.Endpoint = aws.String(S3Endpoint)
+		config.S3ForcePathStyle = aws.Bool(usesPathStyle(S3Endpoint))
+	} else if ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	if transport := baseTransport(); transport != http.DefaultTransport {
+		client := &http.Client{}
+		if config.HTTPClient != nil {
+			*client = *config.HTTPClient
+		}
+		client.Transport = transport
+		config.HTTPClient = client
+	}
+}
+
+// uploadStorageClass is the storage class to ask for, if any.
+func uploadStorageClass() *string {
+	if StorageClass == STORAGE_CLASS_NONE {
+		return nil
+	}
+	return aws.String(StorageClass)
+}
+
+// explainStorageClass says what to do when a server turns down the storage
+// class, which S3 compatible ones do for the Glacier classes.
+func explainStorageClass(r *request.Request) {
+	if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == "InvalidStorageClass" {
+		r.Error = awserr.New(aerr.Code(), fmt.Sprintf("The server doesn't support the %s storage class, use --storage-class %s for its default", StorageClass, STORAGE_CLASS_NONE), aerr)
+	}
+}
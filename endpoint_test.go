@@ -0,0 +1,128 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestUsesPathStyle(t *testing.T) {
+	for endpoint, expected := range map[string]bool{
+		"http://localhost:4566":                     true,
+		"http://127.0.0.1:9000":                     true,
+		"http://[::1]:9000":                         true,
+		"http://minio:9000":                         true,
+		"https://s3.us-west-1.wasabisys.com":        false,
+		"https://s3.eu-central-003.backblazeb2.com": false,
+	} {
+		if usesPathStyle(endpoint) != expected {
+			t.Errorf("%s uses path style: %v", endpoint, !expected)
+		}
+	}
+
+	defer func() { ForcePathStyle = false }()
+	ForcePathStyle = true
+	if !usesPathStyle("https://minio.example.com") {
+		t.Error("--force-path-style was ignored")
+	}
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	defer func(class string, source string) {
+		S3Endpoint, StorageClass, configSources["storage-class"] = "", class, source
+	}(StorageClass, configSources["storage-class"])
+
+	S3Endpoint = "minio:9000"
+	if err := checkEndpoint(); err == nil {
+		t.Error("an endpoint without a scheme was accepted")
+	}
+
+	// The default Glacier class is left out, one that was asked for isn't.
+	S3Endpoint = "http://localhost:9000"
+	StorageClass, configSources["storage-class"] = s3.StorageClassDeepArchive, SOURCE_DEFAULT
+	if err := checkEndpoint(); err != nil || StorageClass != STORAGE_CLASS_NONE || uploadStorageClass() != nil {
+		t.Errorf("got %s, %v", StorageClass, err)
+	}
+	StorageClass, configSources["storage-class"] = s3.StorageClassGlacier, "--storage-class"
+	if err := checkEndpoint(); err != nil || StorageClass != s3.StorageClassGlacier {
+		t.Errorf("got %s, %v", StorageClass, err)
+	}
+
+	StorageClass = "NONE"
+	if err := checkStorageClass(); err != nil || StorageClass != STORAGE_CLASS_NONE {
+		t.Errorf("got %s, %v", StorageClass, err)
+	}
+}
+
+func TestNoVerifySSL(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	get := func() error {
+		config := &aws.Config{}
+		configureEndpoint(config)
+		client := config.HTTPClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(); err == nil {
+		t.Error("a self-signed certificate was accepted")
+	}
+
+	defer func() { NoVerifySSL, insecureTransport = false, nil }()
+	NoVerifySSL = true
+	checkEndpoint()
+	if err := get(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUploadWithoutStorageClass(t *testing.T) {
+	defer func(class string) { StorageClass = class }(StorageClass)
+	StorageClass = STORAGE_CLASS_NONE
+
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if class := fake.objects["archive.bin"].storageClass; class != "" {
+		t.Errorf("asked for %s", class)
+	}
+}
+
+func TestExplainStorageClass(t *testing.T) {
+	r := &request.Request{Error: awserr.New("InvalidStorageClass", "The storage class you specified is not valid", nil)}
+	explainStorageClass(r)
+	if !strings.Contains(r.Error.Error(), "--storage-class none") {
+		t.Errorf("got %v", r.Error)
+	}
+}
@@ -0,0 +1,196 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CLI flags
+var DryRun bool
+
+// uploadEstimate is what an upload would take and cost, worked out without
+// sending anything.
+type uploadEstimate struct {
+	StorageClass string
+	Size         int64
+	Objects      int
+	Parts        int64
+	PartSize     int64
+	// Requests counts the parts and the requests starting and completing
+	// every upload, Sidecars the small objects stored next to them.
+	Requests    int64
+	Sidecars    int64
+	RequestCost float64
+	MonthlyCost float64
+	MinimumDays int
+	MinimumCost float64
+}
+
+// estimateUpload plans uploading objects of the given sizes: files are cut
+// into parts like uploadObject does, streams like uploadStream.
+func estimateUpload(storageClass string, sizes []int64, stream bool) (*uploadEstimate, error) {
+	e := &uploadEstimate{StorageClass: storageClass, Objects: len(sizes)}
+
+	for _, size := range sizes {
+		var partSize int64
+		if stream {
+			partSize = int64(streamPartSize(size))
+		} else {
+			n, err := filePartSize(size)
+			if err != nil {
+				return nil, err
+			}
+			partSize = int64(n)
+		}
+		parts := (size + partSize - 1) / partSize
+		if parts == 0 {
+			parts = 1
+		}
+		if parts > MAX_PARTS {
+			return nil, fmt.Errorf("%s doesn't fit in %d parts of %s", formatBytes(size), MAX_PARTS, formatBytes(partSize))
+		}
+
+		e.Size += size
+		e.Parts += parts
+		if partSize > e.PartSize {
+			e.PartSize = partSize
+		}
+		e.Requests += parts + 2
+	}
+
+	if PartManifest {
+		e.Sidecars += int64(len(sizes))
+	}
+	if wantPreview() {
+		e.Sidecars += int64(len(sizes))
+	}
+	if preservationTemplate != nil {
+		e.Sidecars += int64(len(sizes))
+	}
+	if len(sizes) > 1 {
+		e.Sidecars++
+	}
+
+	// Parts and sidecars at the STANDARD rate, starting and completing the
+	// uploads at the storage class's.
+	objects := int64(len(sizes))
+	e.RequestCost = requestCost(s3.StorageClassStandard, e.Parts+e.Sidecars) + requestCost(storageClass, 2*objects)
+	e.MonthlyCost = storageCost(storageClass, objects, e.Size)
+	if days, ok := minimumStorageDays[storageClass]; ok {
+		e.MinimumDays = days
+		e.MinimumCost = e.MonthlyCost * float64(days) / 30
+	}
+	return e, nil
+}
+
+// EstimateUpload is --dry-run: it shows how filename would be uploaded and
+// what that would cost, without calling S3.
+func EstimateUpload(bucket string, filename string) error {
+	var size int64
+	stream := false
+	switch {
+	case filename == STDIN || isRemoteSource(filename):
+		if ExpectedSize == "" {
+			return fmt.Errorf("Standard input and remote files have no size to plan with, give it with --expected-size")
+		}
+		var err error
+		if size, err = parseSize(ExpectedSize); err != nil {
+			return fmt.Errorf("Invalid --expected-size: %w", err)
+		}
+		stream = true
+	case Tar:
+		var err error
+		if size, err = treeSize(filename); err != nil {
+			return err
+		}
+		stream = true
+	default:
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory, upload it as one archive with --tar, or file by file with sync", filename)
+		}
+		size = info.Size()
+	}
+	if Encrypt {
+		size = encryptedSize(size)
+	}
+
+	sizes := []int64{size}
+	if splitBytes > 0 && size > splitBytes {
+		sizes = nil
+		for left := size; left > 0; left -= splitBytes {
+			if left < splitBytes {
+				sizes = append(sizes, left)
+			} else {
+				sizes = append(sizes, splitBytes)
+			}
+		}
+		stream = true
+	}
+
+	storageClass := StorageClass
+	if storageClass == STORAGE_CLASS_NONE {
+		storageClass = s3.StorageClassStandard
+	}
+	e, err := estimateUpload(storageClass, sizes, stream)
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("Plan for %s (%s) to %s:\n", filename, formatBytes(e.Size), e.StorageClass)
+	if e.Objects > 1 {
+		ui.Printf("  Objects:      %d shards of at most %s\n", e.Objects, formatBytes(splitBytes))
+	}
+	ui.Printf("  Parts:        %d of %s\n", e.Parts, formatBytes(e.PartSize))
+	ui.Printf("  Requests:     %d, and %d for sidecars\n", e.Requests, e.Sidecars)
+	ui.Printf("  Request cost: $%.2f\n", e.RequestCost)
+	ui.Printf("  Storage:      $%.2f a month\n", e.MonthlyCost)
+	if e.MinimumDays > 0 {
+		ui.Printf("  Minimum:      %d days, $%.2f even if deleted sooner\n", e.MinimumDays, e.MinimumCost)
+	}
+	if Tar && Compress != "" {
+		ui.Println("The sizes are before --compress, the archive will be smaller")
+	}
+
+	history, err := loadRunHistory()
+	if err != nil {
+		ui.Warnln("Failed to read the upload history:", err)
+	}
+	if rate, runs := historicalRate(history, bucket); runs > 0 {
+		took := time.Duration(float64(e.Size) / rate * float64(time.Second))
+		ui.Printf("Expected to take %s at %s/s, going by the last %d uploads\n", took.Round(time.Minute), formatBytes(int64(rate)), runs)
+	}
+
+	if Region == "us-east-1" {
+		ui.Println("Prices are list prices.  Nothing was uploaded.")
+	} else {
+		ui.Printf("Prices are us-east-1 list prices, those of %s may differ.  Nothing was uploaded.\n", Region)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.Flags().BoolVar(&DryRun, "dry-run", false, "only show how the file would be uploaded, and estimate what that costs")
+}
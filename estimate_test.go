@@ -0,0 +1,65 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestEstimateUpload(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+
+	const TiB = 1024 * 1024 * 1024 * 1024
+	e, err := estimateUpload(s3.StorageClassDeepArchive, []int64{2 * TiB}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Parts > MAX_PARTS || e.Parts*e.PartSize < 2*TiB || (e.Parts-1)*e.PartSize >= 2*TiB {
+		t.Errorf("2 TiB in %d parts of %d", e.Parts, e.PartSize)
+	}
+	if e.Requests != e.Parts+2 {
+		t.Errorf("%d requests for %d parts", e.Requests, e.Parts)
+	}
+	if want := float64(e.Parts)/1000*0.005 + 2.0/1000*0.05; math.Abs(e.RequestCost-want) > 1e-9 {
+		t.Errorf("the requests cost $%f, want $%f", e.RequestCost, want)
+	}
+	if e.MinimumDays != 180 || math.Abs(e.MinimumCost-6*e.MonthlyCost) > 1e-9 {
+		t.Errorf("billed for at least %d days, $%f", e.MinimumDays, e.MinimumCost)
+	}
+
+	e, err = estimateUpload(s3.StorageClassStandard, []int64{4 * TiB, 4 * TiB, TiB}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Objects != 3 || e.Requests != e.Parts+6 || e.Sidecars != 1 || e.MinimumDays != 0 {
+		t.Errorf("3 shards: %+v", e)
+	}
+
+	PartSize = "5M"
+	if _, err := estimateUpload(s3.StorageClassDeepArchive, []int64{TiB}, false); err == nil {
+		t.Error("1 TiB in 5 MiB parts was planned")
+	}
+}
+
+func TestEstimateUploadStdin(t *testing.T) {
+	if err := EstimateUpload("bucket", STDIN); err == nil {
+		t.Error("planned standard input without --expected-size")
+	}
+}
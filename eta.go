@@ -0,0 +1,250 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var Deadline string
+
+// How many finished uploads we remember, and how many of the latest ones the
+// prediction is based on.
+const (
+	RUN_HISTORY_SIZE = 100
+	RUN_HISTORY_USED = 10
+)
+
+// runRecord is a finished upload.  Only the bytes we actually sent count;
+// parts copied from a --base go much faster and would skew the throughput.
+type runRecord struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Finished time.Time `json:"finished"`
+	Bytes    int64     `json:"bytes"`
+	Seconds  float64   `json:"seconds"`
+}
+
+func runHistoryPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "runs.json"), nil
+}
+
+func loadRunHistory() ([]runRecord, error) {
+	p, err := runHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+
+	// Version 1 was only the list.
+	var history runHistoryFile
+	if stateVersion(data) == 1 {
+		err = json.Unmarshal(data, &history.Runs)
+	} else {
+		err = json.Unmarshal(data, &history)
+	}
+	return history.Runs, err
+}
+
+// runHistoryFile is what's in the run history file.
+type runHistoryFile struct {
+	Version int         `json:"version"`
+	Runs    []runRecord `json:"runs"`
+}
+
+func saveRunHistory(history []runRecord) error {
+	p, err := runHistoryPath()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(p, runHistoryFile{Version: STATE_VERSION, Runs: history})
+}
+
+func saveRunRecord(record runRecord) error {
+	history, err := loadRunHistory()
+	if err != nil {
+		return err
+	}
+
+	history = append(history, record)
+	if len(history) > RUN_HISTORY_SIZE {
+		history = history[len(history)-RUN_HISTORY_SIZE:]
+	}
+	return saveRunHistory(history)
+}
+
+// historicalRate is the throughput, in bytes per second, of the latest
+// uploads to the bucket, or of the latest uploads anywhere if there are none.
+// It returns how many uploads it's based on.
+func historicalRate(history []runRecord, bucket string) (float64, int) {
+	var ours []runRecord
+	for _, r := range history {
+		if r.Bucket == bucket && r.Bytes > 0 && r.Seconds > 0 {
+			ours = append(ours, r)
+		}
+	}
+	if len(ours) == 0 {
+		for _, r := range history {
+			if r.Bytes > 0 && r.Seconds > 0 {
+				ours = append(ours, r)
+			}
+		}
+	}
+	if len(ours) > RUN_HISTORY_USED {
+		ours = ours[len(ours)-RUN_HISTORY_USED:]
+	}
+
+	var bytes int64
+	var seconds float64
+	for _, r := range ours {
+		bytes += r.Bytes
+		seconds += r.Seconds
+	}
+	if seconds == 0 {
+		return 0, 0
+	}
+	return float64(bytes) / seconds, len(ours)
+}
+
+// parseDeadline reads the end of the backup window: a time of day like
+// "06:00", which is the next time the clock shows it, a duration from now
+// like "4h", or a full RFC 3339 timestamp.
+func parseDeadline(spec string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("15:04", spec, now.Location()); err == nil {
+		deadline := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !deadline.After(now) {
+			deadline = deadline.AddDate(0, 0, 1)
+		}
+		return deadline, nil
+	}
+
+	if d, err := time.ParseDuration(spec); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid --deadline %q, use e.g. 06:00, 4h or 2026-10-17T06:00:00+02:00", spec)
+}
+
+// etaTracker predicts when an upload will be done.  It starts out with the
+// throughput of earlier uploads and moves over to what it measures as the
+// upload goes on, and warns when that's past --deadline.
+type etaTracker struct {
+	transfer.Meter
+	deadline time.Time
+	warned   bool
+}
+
+func newETATracker(bucket string, size int64) *etaTracker {
+	eta := &etaTracker{Meter: *transfer.NewMeter(size, 0)}
+
+	if Deadline != "" {
+		// Checked in checkDeadline already.
+		eta.deadline, _ = parseDeadline(Deadline, eta.Started)
+	}
+
+	history, err := loadRunHistory()
+	if err != nil {
+		ui.Warnln("Failed to read the upload history:", err)
+	}
+
+	rate, runs := historicalRate(history, bucket)
+	if runs == 0 {
+		return eta
+	}
+	eta.Historical = rate
+
+	finish := eta.Predict(eta.Started)
+	ui.Printf("Expected to take %s at %s/s, going by the last %d uploads\n",
+		finish.Sub(eta.Started).Round(time.Minute), formatBytes(int64(rate)), runs)
+	eta.check(finish)
+
+	return eta
+}
+
+// check warns, once, as soon as the upload looks like it will run past the
+// deadline.
+func (e *etaTracker) check(finish time.Time) {
+	if e.warned || e.deadline.IsZero() || finish.IsZero() || !finish.After(e.deadline) {
+		return
+	}
+	e.warned = true
+	ui.Warnf("Warning: this upload won't finish before the deadline of %s, expect it to be done around %s\n",
+		e.deadline.Format("Mon 15:04"), finish.Format("Mon 15:04"))
+}
+
+// Sent counts a part we uploaded, Copied one the server copied for us.  Both
+// return the new prediction.
+func (e *etaTracker) Sent(n int) time.Time {
+	finish := e.Transferred(int64(n))
+	e.check(finish)
+	return finish
+}
+
+func (e *etaTracker) Copied(n int) time.Time {
+	finish := e.Skipped(int64(n))
+	e.check(finish)
+	return finish
+}
+
+// Record adds the finished upload to the history.
+func (e *etaTracker) Record(bucket string, key string) {
+	record := runRecord{
+		Bucket:   bucket,
+		Key:      key,
+		Finished: time.Now(),
+		Bytes:    e.Done,
+		Seconds:  time.Since(e.Started).Seconds(),
+	}
+	if err := saveRunRecord(record); err != nil {
+		ui.Warnln("Failed to update the upload history:", err)
+	}
+}
+
+func checkDeadline() error {
+	if Deadline == "" {
+		return nil
+	}
+	_, err := parseDeadline(Deadline, time.Now())
+	return err
+}
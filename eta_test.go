@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+func TestHistoricalRate(t *testing.T) {
+	history := []runRecord{
+		{Bucket: "other", Bytes: 1000, Seconds: 1},
+		{Bucket: "bucket", Bytes: 100, Seconds: 1},
+		{Bucket: "bucket", Bytes: 0, Seconds: 0},
+		{Bucket: "bucket", Bytes: 300, Seconds: 3},
+	}
+
+	if rate, runs := historicalRate(history, "bucket"); rate != 100 || runs != 2 {
+		t.Errorf("rate %v from %d runs, expected 100 from 2", rate, runs)
+	}
+	if rate, runs := historicalRate(history, "new"); rate != 1400.0/5 || runs != 3 {
+		t.Errorf("a new bucket got rate %v from %d runs", rate, runs)
+	}
+	if _, runs := historicalRate(nil, "bucket"); runs != 0 {
+		t.Errorf("no history gave %d runs", runs)
+	}
+
+	// Only the latest uploads count.
+	history = nil
+	for i := 0; i < RUN_HISTORY_USED; i++ {
+		history = append(history, runRecord{Bucket: "bucket", Bytes: 10, Seconds: 1})
+	}
+	history = append([]runRecord{{Bucket: "bucket", Bytes: 1000000, Seconds: 1}}, history...)
+	if rate, _ := historicalRate(history, "bucket"); rate != 10 {
+		t.Errorf("an old upload still counts, rate %v", rate)
+	}
+}
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2026, 10, 16, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"23:00", time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)},
+		{"06:00", time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC)},
+		{"22:30", time.Date(2026, 10, 17, 22, 30, 0, 0, time.UTC)},
+		{"4h", now.Add(4 * time.Hour)},
+		{"2026-10-18T06:00:00Z", time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got, err := parseDeadline(test.spec, now)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseDeadline(%q) = %v, %v, expected %v", test.spec, got, err, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "tomorrow", "-4h", "25:00"} {
+		if _, err := parseDeadline(spec, now); err == nil {
+			t.Errorf("parseDeadline(%q) was accepted", spec)
+		}
+	}
+}
+
+func TestETATrackerRate(t *testing.T) {
+	started := time.Now()
+	eta := &etaTracker{Meter: transfer.Meter{Started: started, Remaining: 1000, Historical: 10}}
+
+	if rate := eta.Rate(started); rate != 10 {
+		t.Errorf("before the first part the rate is %v", rate)
+	}
+	if finish := eta.Predict(started); !finish.Equal(started.Add(100 * time.Second)) {
+		t.Errorf("predicted %v", finish.Sub(started))
+	}
+
+	// A quarter done at 20 bytes per second.
+	eta.Done, eta.Remaining = 250, 750
+	if rate := eta.Rate(started.Add(12500 * time.Millisecond)); rate != 12.5 {
+		t.Errorf("a quarter of the way the rate is %v", rate)
+	}
+
+	eta.Historical = 0
+	if rate := eta.Rate(started.Add(12500 * time.Millisecond)); rate != 20 {
+		t.Errorf("without history the rate is %v", rate)
+	}
+}
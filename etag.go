@@ -0,0 +1,100 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// errUnverifiable is returned when we can't work out how an object was split
+// into parts, so its ETag can't be recomputed from the data.
+var errUnverifiable = errors.New("The ETag can't be recomputed")
+
+// newETagWriter calculates the ETag S3 would give the data written to it if
+// it was uploaded in parts of the given sizes.
+func newETagWriter(partSizes []int64) *transfer.PartHasher {
+	return transfer.NewPartHasher(partSizes, md5.New())
+}
+
+// computeETag calculates the ETag of the data in r, see transfer.PartHasher.
+func computeETag(r io.Reader, partSizes []int64) (string, error) {
+	w := newETagWriter(partSizes)
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	return w.Sum()
+}
+
+// etagPartCount returns the number of parts recorded in a multipart ETag, or
+// 0 for a single part upload.
+func etagPartCount(etag string) (int, error) {
+	etag = strings.Trim(etag, "\"")
+
+	i := strings.LastIndex(etag, "-")
+	if i < 0 {
+		return 0, nil
+	}
+
+	parts, err := strconv.Atoi(etag[i+1:])
+	if err != nil || parts < 1 {
+		return 0, fmt.Errorf("%w: malformed ETag %s", errUnverifiable, etag)
+	}
+	return parts, nil
+}
+
+// objectPartSizes finds out how an object with the given ETag was split into
+// parts.  Parts don't have to be of the same size (see compose), so every part
+// is looked up.  It returns nil for objects uploaded in one go.
+func objectPartSizes(s3session s3iface.S3API, bucket string, key string, etag string) ([]int64, error) {
+	parts, err := etagPartCount(etag)
+	if err != nil || parts == 0 {
+		return nil, err
+	}
+
+	var sizes []int64
+
+	for partNum := 1; partNum <= parts; partNum++ {
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int64(int64(partNum)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if head.PartsCount == nil || *head.PartsCount != int64(parts) {
+			return nil, fmt.Errorf("%w: the ETag has %d parts, S3 reports %d", errUnverifiable,
+				parts, aws.Int64Value(head.PartsCount))
+		}
+
+		sizes = append(sizes, *head.ContentLength)
+	}
+
+	return sizes, nil
+}
@@ -0,0 +1,112 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"testing"
+	"testing/iotest"
+)
+
+// multipartETag builds the ETag of data split at the given sizes by hand.
+func multipartETag(data []byte, sizes []int64) string {
+	var digests []byte
+	for _, size := range sizes {
+		sum := md5.Sum(data[:size])
+		digests = append(digests, sum[:]...)
+		data = data[size:]
+	}
+	return fmt.Sprintf("%x-%d", md5.Sum(digests), len(sizes))
+}
+
+func TestComputeETag(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	tests := []struct {
+		name  string
+		sizes []int64
+		want  string
+	}{
+		{"single part", nil, fmt.Sprintf("%x", md5.Sum(data))},
+		{"uniform parts", []int64{300, 300, 300, 100}, multipartETag(data, []int64{300, 300, 300, 100})},
+		{"uneven parts", []int64{100, 700, 200}, multipartETag(data, []int64{100, 700, 200})},
+		{"one part", []int64{1000}, multipartETag(data, []int64{1000})},
+	}
+
+	for _, tt := range tests {
+		got, err := computeETag(bytes.NewReader(data), tt.sizes)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestETagWriterSmallWrites(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefg"), 50)
+	sizes := []int64{100, 150, 100}
+
+	got, err := computeETag(iotest.OneByteReader(bytes.NewReader(data)), sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := multipartETag(data, sizes); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestComputeETagSizeMismatch(t *testing.T) {
+	data := make([]byte, 1000)
+
+	if _, err := computeETag(bytes.NewReader(data), []int64{600, 600}); err == nil {
+		t.Error("accepted data shorter than its parts")
+	}
+	if _, err := computeETag(bytes.NewReader(data), []int64{600, 300}); err == nil {
+		t.Error("accepted data longer than its parts")
+	}
+}
+
+func TestEtagPartCount(t *testing.T) {
+	tests := []struct {
+		etag  string
+		parts int
+		ok    bool
+	}{
+		{`"9e107d9d372bb6826bd81d3542a419d6"`, 0, true},
+		{`"9e107d9d372bb6826bd81d3542a419d6-12"`, 12, true},
+		{"9e107d9d372bb6826bd81d3542a419d6-1", 1, true},
+		{"9e107d9d372bb6826bd81d3542a419d6-", 0, false},
+		{"9e107d9d372bb6826bd81d3542a419d6-x", 0, false},
+		{"9e107d9d372bb6826bd81d3542a419d6-0", 0, false},
+	}
+
+	for _, tt := range tests {
+		parts, err := etagPartCount(tt.etag)
+		if (err == nil) != tt.ok || parts != tt.parts {
+			t.Errorf("etagPartCount(%s) = %d, %v", tt.etag, parts, err)
+		}
+		if err != nil && !errors.Is(err, errUnverifiable) {
+			t.Errorf("etagPartCount(%s): %v is not errUnverifiable", tt.etag, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var ExpireAfter string
+var ExpiryRule bool
+
+// expireAfterDays is --expire-after in days, 0 for objects which stay.
+var expireAfterDays int64
+
+// EXPIRE_TAG marks objects which are meant to go, e.g. escrow copies kept
+// until a migration is over.  Its value is the number of days, like 180d,
+// which is what the lifecycle rule for them matches on.
+const EXPIRE_TAG = "s3-glacier-uploader-expire-after"
+
+// expiryCommands upload, so they're the ones which install the rule.
+var expiryCommands = map[string]bool{
+	"upload":   true,
+	"sync":     true,
+	"watch":    true,
+	"dump":     true,
+	"complete": true,
+	"compose":  true,
+}
+
+func checkExpiryFlags() error {
+	expireAfterDays = 0
+	if ExpireAfter == "" {
+		if ExpiryRule {
+			return fmt.Errorf("--expiry-rule goes with --expire-after")
+		}
+		return nil
+	}
+	age, err := parseAge(ExpireAfter)
+	if err != nil {
+		return err
+	}
+	if age%(24*time.Hour) != 0 {
+		return fmt.Errorf("Lifecycle rules count whole days, give --expire-after like 180d")
+	}
+	expireAfterDays = int64(age / (24 * time.Hour))
+
+	for _, spec := range Tags {
+		if strings.HasPrefix(spec, EXPIRE_TAG+"=") {
+			return fmt.Errorf("The tag %s is set by --expire-after", EXPIRE_TAG)
+		}
+	}
+	if len(Tags)+1 > MAX_TAGS {
+		return fmt.Errorf("S3 allows at most %d tags per object, --expire-after takes one of them", MAX_TAGS)
+	}
+	return nil
+}
+
+func expiryTagValue(days int64) string {
+	return strconv.FormatInt(days, 10) + "d"
+}
+
+// expiryRule expires what's tagged with days, and the noncurrent versions
+// those leave behind in a versioned bucket a day later.
+func expiryRule(days int64) *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:     aws.String("s3-glacier-uploader-expire-" + expiryTagValue(days)),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Tag: &s3.Tag{Key: aws.String(EXPIRE_TAG), Value: aws.String(expiryTagValue(days))},
+		},
+		Expiration:                  &s3.LifecycleExpiration{Days: aws.Int64(days)},
+		NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(1)},
+	}
+}
+
+// installExpiryRule adds the rule for --expire-after to the bucket's
+// lifecycle configuration, unless it's there.  S3 only takes the
+// configuration whole, so the rules it has are kept as they are.
+func installExpiryRule(s3session s3iface.S3API, cleanup cleanupSession, bucket string, days int64) error {
+	rule := expiryRule(days)
+
+	var rules []*s3.LifecycleRule
+	resp, err := s3session.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var aerr awserr.Error
+	if err == nil {
+		rules = resp.Rules
+	} else if !errors.As(err, &aerr) || aerr.Code() != "NoSuchLifecycleConfiguration" {
+		return fmt.Errorf("Failed to read the bucket's lifecycle rules: %w", err)
+	}
+	for _, r := range rules {
+		if aws.StringValue(r.ID) == aws.StringValue(rule.ID) {
+			return nil
+		}
+	}
+
+	session, err := cleanup()
+	if err != nil {
+		return err
+	}
+	_, err = session.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: append(rules, rule)},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to add the lifecycle rule %s: %w", aws.StringValue(rule.ID), err)
+	}
+	ui.Printf("Added the lifecycle rule %s, expiring objects tagged %s=%s after %d days\n", aws.StringValue(rule.ID), EXPIRE_TAG, expiryTagValue(days), days)
+	return nil
+}
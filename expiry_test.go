@@ -0,0 +1,81 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestExpiryTags(t *testing.T) {
+	defer func() { ExpireAfter, Tags, expireAfterDays = "", nil, 0 }()
+	ExpireAfter, Tags = "180d", []string{"project=escrow"}
+	if err := checkExpiryFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := url.ParseQuery(aws.StringValue(objectTagging("escrow/db.tar")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get(EXPIRE_TAG) != "180d" || values.Get("project") != "escrow" {
+		t.Errorf("tagged %v", values)
+	}
+
+	for _, c := range []struct {
+		expireAfter string
+		tags        []string
+	}{
+		{"36h", nil},
+		{"180d", []string{EXPIRE_TAG + "=1d"}},
+		{"180d", []string{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6", "g=7", "h=8", "i=9", "j=10"}},
+	} {
+		ExpireAfter, Tags = c.expireAfter, c.tags
+		if err := checkExpiryFlags(); err == nil {
+			t.Errorf("--expire-after %s with tags %v was accepted", c.expireAfter, c.tags)
+		}
+	}
+}
+
+func TestInstallExpiryRule(t *testing.T) {
+	fake := newFakeS3()
+	fake.lifecycle = []*s3.LifecycleRule{{ID: aws.String("deep-archive"), Status: aws.String(s3.ExpirationStatusEnabled)}}
+
+	for i := 0; i < 2; i++ {
+		if err := installExpiryRule(fake, fake.cleanup, "bucket", 180); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.lifecycle) != 2 || *fake.lifecycle[0].ID != "deep-archive" {
+		t.Fatalf("rules %v", fake.lifecycle)
+	}
+	rule := fake.lifecycle[1]
+	if *rule.Expiration.Days != 180 || *rule.Filter.Tag.Key != EXPIRE_TAG || *rule.Filter.Tag.Value != "180d" {
+		t.Errorf("added %v", rule)
+	}
+
+	fake = newFakeS3()
+	if err := installExpiryRule(fake, fake.cleanup, "bucket", 30); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.lifecycle) != 1 {
+		t.Errorf("rules %v", fake.lifecycle)
+	}
+}
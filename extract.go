@@ -0,0 +1,226 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// safeJoin resolves a path from an archive inside dir, refusing anything that
+// would end up outside of it.
+func safeJoin(dir string, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if !within(dir, target) {
+		return "", fmt.Errorf("Refusing to extract %s outside of %s", name, dir)
+	}
+	return target, nil
+}
+
+// within reports whether path is dir or something below it.  It only looks at
+// the strings, symlinks on the way are checked by checkParents.
+func within(dir string, path string) bool {
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// checkParents makes sure that none of the directories between dir and target
+// is a symlink, so that an archive can't plant a link and then write through
+// it.  Directories which don't exist yet will be created by us.
+func checkParents(dir string, target string) error {
+	if target == filepath.Clean(dir) {
+		return nil
+	}
+
+	rel, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	current := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to extract %s through the symlink %s", target, current)
+		}
+	}
+
+	return nil
+}
+
+// replace removes whatever is at target, unless it's a directory, so that a
+// new file or link is created rather than written through an existing one.
+func replace(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(target)
+}
+
+// extractTar unpacks a tar stream into dir, restoring the permissions and
+// modification times recorded in the archive, and with --xattrs and
+// --windows-acls the extended attributes and security descriptors.  It
+// returns the number of entries extracted.
+func extractTar(r io.Reader, dir string) (int, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	dir = longPath(dir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	tr := tar.NewReader(r)
+
+	// Directory mtimes change every time we write into them, so they're
+	// fixed up after everything has been extracted.
+	dirTimes := map[string]time.Time{}
+	var count int
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("Failed to read the archive: %w", err)
+		}
+
+		target, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			return count, err
+		}
+		if err := checkParents(dir, target); err != nil {
+			return count, err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return count, fmt.Errorf("Refusing to extract %s through the symlink %s", hdr.Name, target)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return count, err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return count, err
+			}
+			restoreXattrs(hdr, target)
+			restoreSecurityDescriptor(hdr, target)
+			dirTimes[target] = hdr.ModTime
+			count++
+			continue
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return count, err
+			}
+			if err := replace(target); err != nil {
+				return count, err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if err != nil {
+				return count, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return count, fmt.Errorf("Failed to extract %s: %w", hdr.Name, err)
+			}
+			// The umask may have stripped some bits on create.
+			if err := os.Chmod(target, mode); err != nil {
+				return count, err
+			}
+			restoreXattrs(hdr, target)
+			restoreSecurityDescriptor(hdr, target)
+
+		case tar.TypeSymlink:
+			// Links may only point at something inside of dir, otherwise
+			// a later entry could be written through them.
+			if filepath.IsAbs(hdr.Linkname) || !within(dir, filepath.Join(filepath.Dir(target), filepath.FromSlash(hdr.Linkname))) {
+				return count, fmt.Errorf("Refusing to extract the symlink %s pointing outside of %s", hdr.Name, dir)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return count, err
+			}
+			if err := replace(target); err != nil {
+				return count, err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return count, err
+			}
+			count++
+			continue
+
+		case tar.TypeLink:
+			source, err := safeJoin(dir, hdr.Linkname)
+			if err != nil {
+				return count, err
+			}
+			if err := checkParents(dir, source); err != nil {
+				return count, err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return count, err
+			}
+			if err := replace(target); err != nil {
+				return count, err
+			}
+			if err := os.Link(source, target); err != nil {
+				return count, err
+			}
+
+		default:
+			warn(WARNING_SKIPPED, hdr.Name, "Skipping %s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	for target, mtime := range dirTimes {
+		if err := os.Chtimes(target, mtime, mtime); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,157 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"sub/dir/a.txt", true},
+		{"./a.txt", true},
+		{"sub/../a.txt", true},
+		{"../a.txt", false},
+		{"sub/../../a.txt", false},
+		{"/etc/passwd", true}, // joined below dir, like tar does
+	}
+
+	for _, tt := range tests {
+		_, err := safeJoin("/restore", tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("safeJoin(%q): got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+
+	count, err := extractTar(makeTar(t, []tarEntry{
+		{name: "sub", typeflag: tar.TypeDir},
+		{name: "sub/a.txt", typeflag: tar.TypeReg, body: "hello"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "sub/a.txt"},
+		{name: "hard", typeflag: tar.TypeLink, linkname: "sub/a.txt"},
+	}), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("extracted %d entries, want 4", count)
+	}
+
+	for _, name := range []string{"sub/a.txt", "link", "hard"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != "hello" {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestExtractTarRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dot dot", []tarEntry{
+			{name: "../x", typeflag: tar.TypeReg, body: "pwned"},
+		}},
+		{"absolute symlink", []tarEntry{
+			{name: "evil", typeflag: tar.TypeSymlink, linkname: "/etc"},
+			{name: "evil/cron.d/x", typeflag: tar.TypeReg, body: "pwned"},
+		}},
+		{"relative symlink", []tarEntry{
+			{name: "evil", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "evil/x", typeflag: tar.TypeReg, body: "pwned"},
+		}},
+		{"write through symlink", []tarEntry{
+			{name: "sub", typeflag: tar.TypeDir},
+			{name: "evil", typeflag: tar.TypeSymlink, linkname: "sub"},
+			{name: "evil/x", typeflag: tar.TypeReg, body: "pwned"},
+		}},
+		{"hard link outside", []tarEntry{
+			{name: "evil", typeflag: tar.TypeLink, linkname: "../outside/x"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := extractTar(makeTar(t, tt.entries), filepath.Join(root, "out"))
+			if err == nil {
+				t.Fatal("extracted an archive which escapes the target directory")
+			}
+
+			if _, err := os.Stat(filepath.Join(outside, "x")); err == nil {
+				t.Error("wrote outside of the target directory")
+			}
+			if _, err := os.Stat(filepath.Join(root, "x")); err == nil {
+				t.Error("wrote outside of the target directory")
+			}
+			if _, err := os.Stat(filepath.Join(root, "out", "sub", "x")); err == nil {
+				t.Error("wrote through a symlink")
+			}
+		})
+	}
+}
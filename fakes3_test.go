@@ -0,0 +1,744 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of S3 we use.  Calling
+// anything it doesn't implement panics through the nil embedded interface.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+	copies  int
+	// listings counts ListObjectsV2 calls, partUploads UploadPart calls
+	// and deleteBatches DeleteObjects calls.
+	listings      int
+	partUploads   int
+	deleteBatches int
+	// refuseDeletes are keys DeleteObjects fails to delete.
+	refuseDeletes map[string]bool
+	// restoreHeads is how many HeadObject calls a restore takes to finish.
+	restoreHeads int
+	// encryption is the bucket's default encryption, if it has one.
+	encryption *s3.ServerSideEncryptionConfiguration
+	// location is the bucket's location constraint, versioning its
+	// versioning status and lifecycle its lifecycle rules, if any.
+	location   string
+	versioning string
+	lifecycle  []*s3.LifecycleRule
+}
+
+type fakeObject struct {
+	data         []byte
+	etag         string
+	partSizes    []int64
+	storageClass string
+	metadata     map[string]*string
+	modified     time.Time
+	// restored makes an archived object readable, as if a restore had
+	// finished.
+	restored  bool
+	restoring int
+	// checksum is the SHA-256 checksum of objects uploaded with one, sse
+	// the server side encryption.
+	checksum string
+	sse      string
+	kmsKeyID string
+	tags     map[string]string
+	// lockMode and retainUntil are the object's Object Lock retention,
+	// legalHold whether it's under legal hold.
+	lockMode    string
+	retainUntil time.Time
+	legalHold   bool
+}
+
+type fakeUpload struct {
+	key               string
+	storageClass      string
+	metadata          map[string]*string
+	checksumAlgorithm string
+	sse               string
+	kmsKeyID          string
+	tags              map[string]string
+	parts             map[int64][]byte
+	initiated         time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]*fakeObject{}, uploads: map[string]*fakeUpload{}}
+}
+
+// cleanup hands out the fake as the destructive session.
+func (f *fakeS3) cleanup() (s3iface.S3API, error) {
+	return f, nil
+}
+
+func quote(etag string) *string {
+	return aws.String(`"` + etag + `"`)
+}
+
+func md5Hex(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func noSuchKey(key string) error {
+	return awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil)
+}
+
+// fakeTags parses the tags uploads are given.
+func fakeTags(tagging *string) map[string]string {
+	if tagging == nil {
+		return nil
+	}
+	values, err := url.ParseQuery(*tagging)
+	if err != nil {
+		panic(err)
+	}
+	tags := map[string]string{}
+	for k := range values {
+		tags[k] = values.Get(k)
+	}
+	return tags
+}
+
+func (f *fakeS3) object(key string) (*fakeObject, error) {
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, noSuchKey(key)
+	}
+	return obj, nil
+}
+
+var fakeRangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+
+func fakeRange(spec *string, size int) (int, int, error) {
+	if spec == nil {
+		return 0, size, nil
+	}
+	m := fakeRangePattern.FindStringSubmatch(*spec)
+	if m == nil {
+		return 0, 0, fmt.Errorf("bad range %s", *spec)
+	}
+	first, _ := strconv.Atoi(m[1])
+	last, _ := strconv.Atoi(m[2])
+	if last >= size {
+		last = size - 1
+	}
+	return first, last + 1, nil
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	etag := md5Hex(data)
+	f.objects[*in.Key] = &fakeObject{data: data, etag: etag, storageClass: aws.StringValue(in.StorageClass), metadata: in.Metadata, modified: time.Now(), tags: fakeTags(in.Tagging)}
+	return &s3.PutObjectOutput{ETag: quote(etag)}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return f.PutObject(in)
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return f.GetObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.IfMatch != nil && *in.IfMatch != *quote(obj.etag) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the preconditions you specified did not hold", nil)
+	}
+
+	first, end, err := fakeRange(in.Range, len(obj.data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(obj.data[first:end])),
+		ContentLength: aws.Int64(int64(end - first)),
+		ETag:          quote(obj.etag),
+	}, nil
+}
+
+func (f *fakeS3) RestoreObject(in *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !isArchived(obj.storageClass) {
+		return nil, awserr.New("InvalidObjectState", "Restore is not allowed for the object's current storage class", nil)
+	}
+	if obj.restoring > 0 {
+		return nil, awserr.New("RestoreAlreadyInProgress", "Object restore is already in progress", nil)
+	}
+	if !obj.restored {
+		obj.restoring = f.restoreHeads
+		obj.restored = f.restoreHeads == 0
+	}
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ETag:          quote(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+		Metadata:      obj.metadata,
+	}
+	if obj.storageClass != s3.StorageClassStandard {
+		out.StorageClass = aws.String(obj.storageClass)
+	}
+	if obj.sse != "" {
+		out.ServerSideEncryption = aws.String(obj.sse)
+	}
+	if obj.kmsKeyID != "" {
+		out.SSEKMSKeyId = aws.String(obj.kmsKeyID)
+	}
+	if obj.lockMode != "" {
+		out.ObjectLockMode = aws.String(obj.lockMode)
+		out.ObjectLockRetainUntilDate = aws.Time(obj.retainUntil)
+	}
+	if obj.legalHold {
+		out.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	if obj.restoring > 0 {
+		obj.restoring--
+		obj.restored = obj.restoring == 0
+		if !obj.restored {
+			out.Restore = aws.String(`ongoing-request="true"`)
+		}
+	}
+	if obj.restored {
+		out.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+	}
+
+	if in.PartNumber != nil && len(obj.partSizes) > 0 {
+		out.ContentLength = aws.Int64(obj.partSizes[*in.PartNumber-1])
+		out.PartsCount = aws.Int64(int64(len(obj.partSizes)))
+	}
+
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// DeleteObjects refuses the keys in refuseDeletes, like S3 does keys under
+// Object Lock.
+func (f *fakeS3) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(in.Delete.Objects) > MAX_DELETE_BATCH {
+		return nil, awserr.New("MalformedXML", "The XML you provided was not well-formed", nil)
+	}
+	f.deleteBatches++
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range in.Delete.Objects {
+		if f.refuseDeletes[*obj.Key] {
+			out.Errors = append(out.Errors, &s3.Error{Key: obj.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+			continue
+		}
+		delete(f.objects, *obj.Key)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	prefix, delimiter := aws.StringValue(in.Prefix), aws.StringValue(in.Delimiter)
+
+	f.mu.Lock()
+	f.listings++
+	var keys []string
+	prefixes := map[string]bool{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Pages are small, so that paging gets exercised.
+	var pages []*s3.ListObjectsV2Output
+	page := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		if len(page.Contents) == 100 {
+			pages = append(pages, page)
+			page = &s3.ListObjectsV2Output{}
+		}
+		obj := f.objects[key]
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         quote(obj.etag),
+			StorageClass: aws.String(obj.storageClass),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	for p := range prefixes {
+		page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+	}
+	pages = append(pages, page)
+	f.mu.Unlock()
+
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(in *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{key: *in.Key, storageClass: aws.StringValue(in.StorageClass), metadata: in.Metadata,
+		checksumAlgorithm: aws.StringValue(in.ChecksumAlgorithm), sse: aws.StringValue(in.ServerSideEncryption),
+		kmsKeyID: aws.StringValue(in.SSEKMSKeyId), tags: fakeTags(in.Tagging), parts: map[int64][]byte{}, initiated: time.Now()}
+
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return f.CreateMultipartUpload(in)
+}
+
+func (f *fakeS3) upload(id *string) (*fakeUpload, error) {
+	upload, ok := f.uploads[*id]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	return upload, nil
+}
+
+func (f *fakeS3) UploadPart(in *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return f.UploadPartWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload, err := f.upload(in.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.UploadPartOutput{ETag: quote(md5Hex(data))}
+	if upload.checksumAlgorithm != "" {
+		if in.ChecksumSHA256 == nil {
+			return nil, awserr.New("InvalidRequest", "The upload was created using a sha256 checksum", nil)
+		}
+		out.ChecksumSHA256 = aws.String(sha256Base64(data))
+	}
+	if in.ChecksumSHA256 != nil && *in.ChecksumSHA256 != sha256Base64(data) {
+		return nil, awserr.New("BadDigest", "The sha256 you specified did not match the calculated checksum", nil)
+	}
+
+	upload.parts[*in.PartNumber] = data
+	f.partUploads++
+	return out, nil
+}
+
+func (f *fakeS3) ListPartsPages(in *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	f.mu.Lock()
+	upload, err := f.upload(in.UploadId)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	if upload.key != *in.Key {
+		f.mu.Unlock()
+		return awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+
+	page := &s3.ListPartsOutput{}
+	for num, data := range upload.parts {
+		part := &s3.Part{PartNumber: aws.Int64(num), ETag: quote(md5Hex(data)), Size: aws.Int64(int64(len(data)))}
+		if upload.checksumAlgorithm != "" {
+			part.ChecksumSHA256 = aws.String(sha256Base64(data))
+		}
+		page.Parts = append(page.Parts, part)
+	}
+	sort.Slice(page.Parts, func(i, j int) bool {
+		return *page.Parts[i].PartNumber < *page.Parts[j].PartNumber
+	})
+	f.mu.Unlock()
+
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) ListPartsPagesWithContext(ctx aws.Context, in *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, opts ...request.Option) error {
+	return f.ListPartsPages(in, fn)
+}
+
+func (f *fakeS3) ListMultipartUploadsPages(in *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	f.mu.Lock()
+	page := &s3.ListMultipartUploadsOutput{}
+	for id, upload := range f.uploads {
+		if !strings.HasPrefix(upload.key, aws.StringValue(in.Prefix)) {
+			continue
+		}
+		page.Uploads = append(page.Uploads, &s3.MultipartUpload{Key: aws.String(upload.key), UploadId: aws.String(id),
+			Initiated: aws.Time(upload.initiated), StorageClass: aws.String(upload.storageClass)})
+	}
+	sort.Slice(page.Uploads, func(i, j int) bool {
+		return *page.Uploads[i].Key < *page.Uploads[j].Key
+	})
+	f.mu.Unlock()
+
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) ListMultipartUploads(in *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	var out *s3.ListMultipartUploadsOutput
+	err := f.ListMultipartUploadsPages(in, func(page *s3.ListMultipartUploadsOutput, last bool) bool {
+		out = page
+		return false
+	})
+	return out, err
+}
+
+func (f *fakeS3) UploadPartCopy(in *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload, err := f.upload(in.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := url.PathUnescape(*in.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	source = source[strings.Index(source, "/")+1:]
+
+	obj, err := f.object(source)
+	if err != nil {
+		return nil, err
+	}
+	if in.CopySourceIfMatch != nil && *in.CopySourceIfMatch != *quote(obj.etag) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the preconditions you specified did not hold", nil)
+	}
+
+	first, end, err := fakeRange(in.CopySourceRange, len(obj.data))
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, obj.data[first:end]...)
+	upload.parts[*in.PartNumber] = data
+	f.copies++
+
+	result := &s3.CopyPartResult{ETag: quote(md5Hex(data))}
+	if upload.checksumAlgorithm != "" {
+		result.ChecksumSHA256 = aws.String(sha256Base64(data))
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: result}, nil
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(ctx aws.Context, in *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	return f.UploadPartCopy(in)
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return f.CompleteMultipartUpload(in)
+}
+
+func (f *fakeS3) CompleteMultipartUpload(in *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload, err := f.upload(in.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	var data, digests, checksums []byte
+	var partSizes []int64
+
+	for i, part := range in.MultipartUpload.Parts {
+		if *part.PartNumber != int64(i+1) {
+			return nil, awserr.New("InvalidPartOrder", "The list of parts was not in ascending order", nil)
+		}
+		partData, ok := upload.parts[*part.PartNumber]
+		if !ok || *quote(md5Hex(partData)) != *part.ETag {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("Part %d is missing or its ETag doesn't match", i+1), nil)
+		}
+		sum := md5.Sum(partData)
+		digests = append(digests, sum[:]...)
+		if upload.checksumAlgorithm != "" {
+			if aws.StringValue(part.ChecksumSHA256) != sha256Base64(partData) {
+				return nil, awserr.New("InvalidPart", fmt.Sprintf("Part %d has the wrong checksum", i+1), nil)
+			}
+			checksum := sha256.Sum256(partData)
+			checksums = append(checksums, checksum[:]...)
+		}
+		data = append(data, partData...)
+		partSizes = append(partSizes, int64(len(partData)))
+	}
+
+	etag := fmt.Sprintf("%s-%d", md5Hex(digests), len(partSizes))
+	obj := &fakeObject{data: data, etag: etag, partSizes: partSizes, storageClass: upload.storageClass, metadata: upload.metadata, modified: time.Now(), tags: upload.tags,
+		sse: upload.sse, kmsKeyID: upload.kmsKeyID}
+	f.objects[upload.key] = obj
+	delete(f.uploads, *in.UploadId)
+
+	out := &s3.CompleteMultipartUploadOutput{
+		ETag:     quote(etag),
+		Location: aws.String("https://" + *in.Bucket + ".s3.amazonaws.com/" + upload.key),
+	}
+	if upload.checksumAlgorithm != "" {
+		obj.checksum = fmt.Sprintf("%s-%d", sha256Base64(checksums), len(partSizes))
+		out.ChecksumSHA256 = aws.String(obj.checksum)
+	}
+	if upload.sse != "" {
+		out.ServerSideEncryption = aws.String(upload.sse)
+	}
+	if upload.kmsKeyID != "" {
+		out.SSEKMSKeyId = aws.String(upload.kmsKeyID)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) CopyObject(in *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	source, err := url.PathUnescape(*in.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	// The fake has one bucket, whatever it's called.
+	obj, err := f.object(source[strings.Index(source, "/")+1:])
+	if err != nil {
+		return nil, err
+	}
+	if isArchived(obj.storageClass) && !obj.restored {
+		return nil, awserr.New(s3.ErrCodeInvalidObjectState, "Operation is not valid for the source object's storage class", nil)
+	}
+
+	copied := *obj
+	copied.storageClass = aws.StringValue(in.StorageClass)
+	copied.modified = time.Now()
+	copied.restored = false
+	if in.ChecksumAlgorithm != nil {
+		copied.checksum = sha256Base64(obj.data)
+		copied.partSizes = nil
+	}
+	f.objects[*in.Key] = &copied
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{ETag: quote(obj.etag)}}, nil
+}
+
+func (f *fakeS3) GetObjectTagging(in *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{}}
+	for k, v := range obj.tags {
+		out.TagSet = append(out.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) PutObjectTagging(in *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj.tags = map[string]string{}
+	for _, tag := range in.Tagging.TagSet {
+		obj.tags[*tag.Key] = *tag.Value
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+// HeadBucket finds every bucket, the fake keeps no list of them.
+func (f *fakeS3) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) GetBucketLocation(in *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	out := &s3.GetBucketLocationOutput{}
+	if f.location != "" {
+		out.LocationConstraint = aws.String(f.location)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetBucketVersioning(in *s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	out := &s3.GetBucketVersioningOutput{}
+	if f.versioning != "" {
+		out.Status = aws.String(f.versioning)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetBucketLifecycleConfiguration(in *s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if f.lifecycle == nil {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", nil)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: f.lifecycle}, nil
+}
+
+func (f *fakeS3) PutBucketLifecycleConfiguration(in *s3.PutBucketLifecycleConfigurationInput) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	f.lifecycle = in.LifecycleConfiguration.Rules
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (f *fakeS3) GetBucketEncryption(in *s3.GetBucketEncryptionInput) (*s3.GetBucketEncryptionOutput, error) {
+	if f.encryption == nil {
+		return nil, awserr.New("ServerSideEncryptionConfigurationNotFoundError", "The server side encryption configuration was not found", nil)
+	}
+	return &s3.GetBucketEncryptionOutput{ServerSideEncryptionConfiguration: f.encryption}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.upload(in.UploadId); err != nil {
+		return nil, err
+	}
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// GetObjectAttributes returns the checksum without the part count, like S3,
+// and pages through the parts.
+func (f *fakeS3) GetObjectAttributes(in *s3.GetObjectAttributesInput) (*s3.GetObjectAttributesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, err := f.object(*in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectAttributesOutput{ETag: aws.String(obj.etag), ObjectSize: aws.Int64(int64(len(obj.data)))}
+	if obj.checksum != "" {
+		checksum := obj.checksum
+		if i := strings.Index(checksum, "-"); i >= 0 {
+			checksum = checksum[:i]
+		}
+		out.Checksum = &s3.Checksum{ChecksumSHA256: aws.String(checksum)}
+	}
+
+	if len(obj.partSizes) > 0 {
+		first := aws.Int64Value(in.PartNumberMarker)
+		last := first + aws.Int64Value(in.MaxParts)
+		if last > int64(len(obj.partSizes)) {
+			last = int64(len(obj.partSizes))
+		}
+
+		parts := &s3.GetObjectAttributesParts{
+			TotalPartsCount:      aws.Int64(int64(len(obj.partSizes))),
+			IsTruncated:          aws.Bool(last < int64(len(obj.partSizes))),
+			NextPartNumberMarker: aws.Int64(last),
+		}
+		for i := first; i < last; i++ {
+			parts.Parts = append(parts.Parts, &s3.ObjectPart{PartNumber: aws.Int64(i + 1), Size: aws.Int64(obj.partSizes[i])})
+		}
+		out.ObjectParts = parts
+	}
+
+	return out, nil
+}
@@ -0,0 +1,105 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Go's crypto packages pick the fastest instructions the CPU has on their
+// own, and we always hash through them, so there's nothing to switch on.
+// What there is to know is which they picked: on big archives hashing is a
+// good part of the time, and a build with an old Go or a CPU without SHA
+// extensions hashes several times slower.
+
+// sha256Implementation is what crypto/sha256 of this build uses on this CPU.
+func sha256Implementation() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		// SHA-NI is only used since Go 1.21.
+		if cpuHasSHANI() && goVersionAtLeast(runtime.Version(), 1, 21) {
+			return "SHA-NI"
+		}
+		if cpu.X86.HasAVX2 && cpu.X86.HasBMI2 {
+			return "AVX2"
+		}
+		return "SSSE3 assembly"
+	case "arm64":
+		if cpu.ARM64.HasSHA2 {
+			return "ARMv8 SHA2 instructions"
+		}
+	case "s390x":
+		if cpu.S390X.HasSHA256 {
+			return "CPACF"
+		}
+	case "386", "ppc64le":
+		return "assembly"
+	}
+	return "generic Go"
+}
+
+// md5Implementation is what crypto/md5 uses.  MD5 has no instructions of
+// its own anywhere, but assembly beats Go.
+func md5Implementation() string {
+	switch runtime.GOARCH {
+	case "amd64", "386", "arm", "arm64", "ppc64", "ppc64le", "s390x":
+		return "assembly"
+	}
+	return "generic Go"
+}
+
+func hashImplementations() map[string]string {
+	return map[string]string{
+		"sha256": sha256Implementation(),
+		"md5":    md5Implementation(),
+	}
+}
+
+func describeHashImplementations() string {
+	return fmt.Sprintf("Hashing SHA-256 with %s and MD5 with %s (%s, %s/%s)", sha256Implementation(), md5Implementation(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// goVersionAtLeast tells whether version, as in runtime.Version, is at
+// least major.minor.  Development builds are taken to be new.
+func goVersionAtLeast(version string, major int, minor int) bool {
+	if !strings.HasPrefix(version, "go") {
+		return true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(version, "go"), ".", 3)
+	if len(parts) < 2 {
+		return true
+	}
+	gotMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return true
+	}
+	// Release candidates look like go1.21rc2.
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits >= 0 {
+		parts[1] = parts[1][:digits]
+	}
+	gotMinor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return true
+	}
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
@@ -0,0 +1,34 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestGoVersionAtLeast(t *testing.T) {
+	for version, want := range map[string]bool{
+		"go1.18.10":             false,
+		"go1.21.0":              true,
+		"go1.21rc2":             true,
+		"go1.20":                false,
+		"go2.0":                 true,
+		"devel go1.22-abcdef12": true,
+	} {
+		if got := goVersionAtLeast(version, 1, 21); got != want {
+			t.Errorf("%s is at least 1.21: %v", version, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// CLI flags
+var KeyCommand string
+var FilterCommand string
+var MetadataCommand string
+var ObjectKey string
+var KeyPrefix string
+var Metadata []string
+
+// S3 allows 2 KiB of user metadata per object, keys and values together.
+const MAX_METADATA_SIZE = 2048
+
+// Hooks are external programs which get the file name as their only argument
+// and the bucket in $S3_GLACIER_BUCKET.  That's all the plugin mechanism there
+// is: any language will do, and there's nothing to build against.
+func runHook(command string, filename string) ([]byte, error) {
+	cmd := exec.Command(command, filename)
+	cmd.Env = append(os.Environ(), "S3_GLACIER_BUCKET="+BucketName)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// uploadKey names the object a file is uploaded to.  By default that's the
+// file's base name, --key or --key-command can say something else, and
+// --prefix goes in front of either.  --shard-prefix puts what the file's name
+// or --key-command gives under its shard, but --key is taken as it is.
+func uploadKey(filename string) (string, error) {
+	if ObjectKey != "" {
+		return KeyPrefix + ObjectKey, nil
+	}
+	if KeyCommand == "" {
+		return KeyPrefix + shardedName(filepath.Base(filename)), nil
+	}
+
+	out, err := runHook(KeyCommand, filename)
+	if err != nil {
+		return "", fmt.Errorf("--key-command failed for %s: %w", filename, err)
+	}
+
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", fmt.Errorf("--key-command printed no key for %s", filename)
+	}
+	return KeyPrefix + shardedName(key), nil
+}
+
+func checkKeyFlags() error {
+	if ObjectKey != "" && KeyCommand != "" {
+		return fmt.Errorf("--key and --key-command can't be combined")
+	}
+	if strings.HasPrefix(KeyPrefix+ObjectKey, "/") {
+		return fmt.Errorf("Keys starting with / make an empty first directory, leave it out")
+	}
+	return nil
+}
+
+// metadataFlags parses --metadata key=value, checking what S3 would
+// otherwise refuse after the upload has started.
+func metadataFlags() (map[string]string, error) {
+	metadata := map[string]string{}
+	size := 0
+	for _, spec := range Metadata {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Metadata looks like key=value, got %q", spec)
+		}
+		key, value := strings.ToLower(parts[0]), parts[1]
+		if strings.ContainsAny(key, " \t\r\n:") {
+			return nil, fmt.Errorf("The metadata key %q isn't a valid header name", parts[0])
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("The metadata %s is given more than once", key)
+		}
+		metadata[key] = value
+		size += len(key) + len(value)
+	}
+	if size > MAX_METADATA_SIZE {
+		return nil, fmt.Errorf("S3 allows %d bytes of metadata per object, --metadata is %d", MAX_METADATA_SIZE, size)
+	}
+	return metadata, nil
+}
+
+// includeFile asks --filter-command whether a file should be uploaded: exit
+// status 0 means yes, 1 means skip it, anything else is an error.
+func includeFile(filename string) (bool, error) {
+	if FilterCommand == "" {
+		return true, nil
+	}
+
+	_, err := runHook(FilterCommand, filename)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("--filter-command failed for %s: %w", filename, err)
+	}
+	return true, nil
+}
+
+// uploadMetadata collects the user metadata to store with the object: the
+// --metadata flags, and what --metadata-command prints as a JSON object of
+// strings, which wins where they overlap, and how long --retain keeps it.
+func uploadMetadata(filename string) (map[string]*string, error) {
+	metadata, err := metadataFlags()
+	if err != nil {
+		return nil, err
+	}
+	if MetadataCommand == "" {
+		if len(metadata) == 0 {
+			return retainMetadata(filename, nil), nil
+		}
+		return retainMetadata(filename, aws.StringMap(metadata)), nil
+	}
+
+	out, err := runHook(MetadataCommand, filename)
+	if err != nil {
+		return nil, fmt.Errorf("--metadata-command failed for %s: %w", filename, err)
+	}
+
+	var printed map[string]string
+	if err := json.Unmarshal(out, &printed); err != nil {
+		return nil, fmt.Errorf("--metadata-command didn't print a JSON object of strings for %s: %w", filename, err)
+	}
+	for k, v := range printed {
+		metadata[k] = v
+	}
+	return retainMetadata(filename, aws.StringMap(metadata)), nil
+}
@@ -0,0 +1,150 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeHook(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts here")
+	}
+	p := filepath.Join(t.TempDir(), "hook")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUploadKey(t *testing.T) {
+	defer func() { KeyCommand, BucketName = "", "" }()
+
+	if key, err := uploadKey("/data/photos.tar"); err != nil || key != "photos.tar" {
+		t.Errorf("default key: got %q, %v", key, err)
+	}
+
+	KeyCommand = writeHook(t, `echo "$S3_GLACIER_BUCKET/$(basename "$1")"`)
+	BucketName = "b"
+	if key, err := uploadKey("/data/photos.tar"); err != nil || key != "b/photos.tar" {
+		t.Errorf("--key-command: got %q, %v", key, err)
+	}
+
+	KeyCommand = writeHook(t, "true")
+	if _, err := uploadKey("/data/photos.tar"); err == nil {
+		t.Error("accepted an empty key")
+	}
+}
+
+func TestUploadKeyFlags(t *testing.T) {
+	defer func() { ObjectKey, KeyPrefix, KeyCommand = "", "", "" }()
+
+	KeyPrefix = "laptop/"
+	if key, err := uploadKey("/data/photos.tar"); err != nil || key != "laptop/photos.tar" {
+		t.Errorf("--prefix: got %q, %v", key, err)
+	}
+
+	ObjectKey = "2022/photos.tar"
+	if key, err := uploadKey("/data/photos.tar"); err != nil || key != "laptop/2022/photos.tar" {
+		t.Errorf("--prefix and --key: got %q, %v", key, err)
+	}
+	if err := checkKeyFlags(); err != nil {
+		t.Error(err)
+	}
+
+	KeyCommand = writeHook(t, `echo "$1"`)
+	if err := checkKeyFlags(); err == nil {
+		t.Error("--key and --key-command were combined")
+	}
+
+	ObjectKey, KeyCommand, KeyPrefix = "", "", "/laptop/"
+	if err := checkKeyFlags(); err == nil {
+		t.Error("accepted a key starting with /")
+	}
+}
+
+func TestMetadataFlags(t *testing.T) {
+	defer func() { Metadata = nil }()
+
+	Metadata = []string{"Host=laptop", "path=/data/photos.tar", "empty="}
+	metadata, err := metadataFlags()
+	if err != nil || len(metadata) != 3 || metadata["host"] != "laptop" || metadata["path"] != "/data/photos.tar" {
+		t.Errorf("got %v, %v", metadata, err)
+	}
+
+	for _, bad := range [][]string{
+		{"host"},
+		{"=laptop"},
+		{"the host=laptop"},
+		{"host=a", "Host=b"},
+		{"host=" + strings.Repeat("x", MAX_METADATA_SIZE)},
+	} {
+		Metadata = bad
+		if _, err := metadataFlags(); err == nil {
+			t.Errorf("accepted --metadata %v", bad)
+		}
+	}
+}
+
+func TestIncludeFile(t *testing.T) {
+	defer func() { FilterCommand = "" }()
+
+	FilterCommand = writeHook(t, `case "$1" in *.tmp) exit 1;; *.bad) exit 2;; esac`)
+
+	tests := []struct {
+		filename string
+		include  bool
+		ok       bool
+	}{
+		{"a.tar", true, true},
+		{"a.tmp", false, true},
+		{"a.bad", false, false},
+	}
+
+	for _, tt := range tests {
+		include, err := includeFile(tt.filename)
+		if include != tt.include || (err == nil) != tt.ok {
+			t.Errorf("includeFile(%q) = %v, %v", tt.filename, include, err)
+		}
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	defer func() { MetadataCommand = "" }()
+
+	MetadataCommand = writeHook(t, `echo '{"project": "apollo"}'`)
+	metadata, err := uploadMetadata("a.tar")
+	if err != nil || *metadata["project"] != "apollo" {
+		t.Errorf("got %v, %v", metadata, err)
+	}
+
+	Metadata = []string{"project=gemini", "host=laptop"}
+	defer func() { Metadata = nil }()
+	metadata, err = uploadMetadata("a.tar")
+	if err != nil || *metadata["project"] != "apollo" || *metadata["host"] != "laptop" {
+		t.Errorf("with --metadata: got %v, %v", metadata, err)
+	}
+
+	MetadataCommand = writeHook(t, `echo '{"count": 3}'`)
+	if _, err := uploadMetadata("a.tar"); err == nil {
+		t.Error("accepted metadata which isn't a string")
+	}
+}
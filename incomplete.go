@@ -0,0 +1,99 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var IncompleteAlert string
+
+// How often serve adds up the parts of the bucket's unfinished uploads.
+const INCOMPLETE_CHECK_INTERVAL = time.Hour
+
+// incompleteUploads is what the bucket's unfinished uploads hold, which is
+// billed until they're completed or aborted, and nothing shows in the
+// bucket's listing.  Warning is set once that's over --incomplete-alert.
+type incompleteUploads struct {
+	Uploads int
+	Bytes   int64
+	Cost    float64
+	Checked time.Time
+	Warning string
+}
+
+func checkIncompleteAlert() error {
+	if _, err := parseSize(IncompleteAlert); err != nil {
+		return fmt.Errorf("Invalid --incomplete-alert: %w", err)
+	}
+	return nil
+}
+
+// summarizeIncomplete adds up uploads, and warns about them in bucket if
+// they hold more than --incomplete-alert.
+func summarizeIncomplete(bucket string, uploads []pendingUpload, now time.Time) incompleteUploads {
+	in := incompleteUploads{Uploads: len(uploads), Checked: now}
+	for _, u := range uploads {
+		in.Bytes += u.Size
+		in.Cost += u.Cost()
+	}
+
+	// Checked in checkIncompleteAlert already.
+	alert, _ := parseSize(IncompleteAlert)
+	if alert > 0 && in.Bytes > alert {
+		in.Warning = fmt.Sprintf("%d unfinished uploads in %s hold %s, about $%.2f a month, more than --incomplete-alert %s.  Resume them, or abort those which won't be with abort --stale",
+			in.Uploads, bucket, formatBytes(in.Bytes), in.Cost, formatBytes(alert))
+	}
+	return in
+}
+
+// watchIncomplete checks the daemon's bucket for unfinished uploads every
+// INCOMPLETE_CHECK_INTERVAL, for as long as it runs.
+func (d *daemon) watchIncomplete(s3session s3iface.S3API) {
+	d.checkIncomplete(s3session, time.Now())
+	for now := range time.Tick(INCOMPLETE_CHECK_INTERVAL) {
+		d.checkIncomplete(s3session, now)
+	}
+}
+
+// checkIncomplete notes what the unfinished uploads hold, for the web UI,
+// and warns when that first goes over --incomplete-alert.  The daemon's own
+// uploads in flight count too, they're unfinished until they're done.
+func (d *daemon) checkIncomplete(s3session s3iface.S3API, now time.Time) {
+	uploads, err := listUploads(s3session, d.bucket, "")
+	if err != nil {
+		ui.Warnf("Failed to list the unfinished uploads in %s: %v\n", d.bucket, err)
+		return
+	}
+	in := summarizeIncomplete(d.bucket, uploads, now)
+
+	d.mu.Lock()
+	warned := d.incomplete.Warning != ""
+	d.incomplete = in
+	d.mu.Unlock()
+	if in.Warning != "" && !warned {
+		ui.Warnln(in.Warning)
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&IncompleteAlert, "incomplete-alert", "10G", "warn in list uploads and serve when the bucket's unfinished uploads hold more than this (0 not to)")
+}
@@ -0,0 +1,57 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckIncomplete(t *testing.T) {
+	defer func(alert string) { IncompleteAlert = alert }(IncompleteAlert)
+	IncompleteAlert = "1K"
+
+	now := time.Now()
+	fake := newFakeS3()
+	fake.uploads["stray"] = &fakeUpload{key: "backup.tar", parts: map[int64][]byte{1: make([]byte, 1024), 2: make([]byte, 1024)}, initiated: now.Add(-time.Hour)}
+
+	d := newDaemon(nil, "bucket", "")
+	d.checkIncomplete(fake, now)
+	if d.incomplete.Uploads != 1 || d.incomplete.Bytes != 2048 || !strings.Contains(d.incomplete.Warning, "1 unfinished uploads in bucket hold 2.0 KiB") {
+		t.Errorf("unexpected %+v", d.incomplete)
+	}
+	var page bytes.Buffer
+	if err := uiTemplate.Execute(&page, d.uiPage(now)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "more than --incomplete-alert") {
+		t.Error("the web UI doesn't warn about the unfinished uploads")
+	}
+
+	delete(fake.uploads, "stray")
+	d.checkIncomplete(fake, now)
+	if d.incomplete.Uploads != 0 || d.incomplete.Warning != "" {
+		t.Errorf("unexpected %+v", d.incomplete)
+	}
+
+	IncompleteAlert = "0"
+	if in := summarizeIncomplete("bucket", []pendingUpload{{Size: 1 << 40}}, now); in.Warning != "" {
+		t.Errorf("warned with --incomplete-alert 0: %s", in.Warning)
+	}
+}
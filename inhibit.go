@@ -0,0 +1,39 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+)
+
+// CLI flags
+var InhibitSleep bool
+
+const INHIBIT_REASON = "Uploading to S3 Glacier"
+
+// startInhibitingSleep keeps the machine awake for as long as the returned
+// function hasn't been called.  A laptop suspending halfway through leaves a
+// multipart upload behind, which costs money until it's aborted.  If we exit
+// without calling it, the inhibition goes away with the process.
+func startInhibitingSleep() (func(), error) {
+	release, err := inhibitSleep(INHIBIT_REASON)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to keep the machine awake (drop --inhibit-sleep to upload anyway): %w", err)
+	}
+	ui.Warnln("Keeping the machine awake until the upload is done")
+	return release, nil
+}
@@ -0,0 +1,70 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// inhibitSleep runs the platform's tool for this next to us.  caffeinate
+// watches our PID; systemd-inhibit holds the lock for as long as cat runs,
+// and cat stops when the pipe to it is closed, which happens when we exit
+// for whatever reason.
+func inhibitSleep(reason string) (func(), error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("caffeinate", "-i", "-w", strconv.Itoa(os.Getpid()))
+	case "linux":
+		cmd = exec.Command("systemd-inhibit", "--what=sleep:idle", "--who=s3-glacier-uploader", "--why="+reason, "--mode=block", "cat")
+	default:
+		return nil, fmt.Errorf("Not supported on %s", runtime.GOOS)
+	}
+
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// Without a running logind, systemd-inhibit gives up right away.
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		return nil, fmt.Errorf("%s stopped: %v", cmd.Args[0], err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	return func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		<-exited
+	}, nil
+}
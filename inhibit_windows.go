@@ -0,0 +1,59 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const (
+	ES_CONTINUOUS      = 0x80000000
+	ES_SYSTEM_REQUIRED = 0x00000001
+)
+
+// inhibitSleep uses SetThreadExecutionState, which applies to the calling
+// thread until it's reset or the thread ends.  Goroutines move between
+// threads, so one of them is pinned to its thread and holds the state there.
+func inhibitSleep(reason string) (func(), error) {
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("SetThreadExecutionState")
+	if err := proc.Find(); err != nil {
+		return nil, err
+	}
+
+	started := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		if r, _, err := proc.Call(ES_CONTINUOUS | ES_SYSTEM_REQUIRED); r == 0 {
+			started <- err
+			return
+		}
+		started <- nil
+
+		<-done
+		proc.Call(ES_CONTINUOUS)
+	}()
+
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return func() { close(done) }, nil
+}
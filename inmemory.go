@@ -0,0 +1,64 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CLI flags
+var InMemory bool
+
+// snapshotMountRoot is where snapshots are mounted: the temp dir, which
+// --in-memory takes away from the programs we run.  A mount point holds no
+// data.
+var snapshotMountRoot string
+
+// checkInMemory makes sure nothing of what's uploaded is written to local
+// disk on the way, e.g. for hosts where only the source volume is
+// encrypted.  We keep parts in memory anyway; compressing, encrypting and
+// archiving are pipes.  What's left are the programs we run, zstd and the
+// dump programs, which could spool to the temp dir: it's pointed below
+// /dev/null, where nothing can be created, so they fail instead.
+func checkInMemory() error {
+	if !InMemory {
+		return nil
+	}
+	if TempDir != "" {
+		return fmt.Errorf("--temp-dir doesn't go with --in-memory, which doesn't allow temporary files")
+	}
+	snapshotMountRoot = os.TempDir()
+
+	nowhere := filepath.Join(os.DevNull, "tmp")
+	vars := []string{"TMPDIR"}
+	if runtime.GOOS == "windows" {
+		vars = []string{"TMP", "TEMP"}
+	}
+	for _, name := range vars {
+		if err := os.Setenv(name, nowhere); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&InMemory, "in-memory", false, "make sure no data is written to temporary files, not even by the programs we run")
+}
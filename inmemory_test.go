@@ -0,0 +1,46 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckInMemory(t *testing.T) {
+	defer func() { InMemory, TempDir, snapshotMountRoot = false, "", "" }()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	InMemory = true
+	if err := checkInMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := os.MkdirTemp("", "spool"); err == nil {
+		t.Errorf("could make %s in the temp dir", dir)
+	}
+	if f, err := os.CreateTemp("", "spool"); err == nil {
+		t.Errorf("could write %s in the temp dir", f.Name())
+	}
+	if snapshotMountRoot == "" {
+		t.Error("snapshots have nowhere to be mounted")
+	}
+
+	TempDir = t.TempDir()
+	if err := checkInMemory(); err == nil {
+		t.Error("--temp-dir was accepted")
+	}
+}
@@ -0,0 +1,74 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// TestIntegration runs an upload against a real S3 compatible server, e.g.
+//
+//	docker run -p 4566:4566 localstack/localstack
+//	S3_GLACIER_TEST_ENDPOINT=http://localhost:4566 AWS_ACCESS_KEY_ID=test \
+//	    AWS_SECRET_ACCESS_KEY=test go test -run Integration
+//
+// The server has to accept the DEEP_ARCHIVE storage class, which MinIO
+// doesn't.
+func TestIntegration(t *testing.T) {
+	endpoint := os.Getenv("S3_GLACIER_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_GLACIER_TEST_ENDPOINT isn't set")
+	}
+
+	S3Endpoint = endpoint
+	defer func() { S3Endpoint = "" }()
+
+	s3session := newS3Session("us-east-1")
+	bucket := fmt.Sprintf("s3-glacier-uploader-test-%d", time.Now().UnixNano())
+
+	if _, err := s3session.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(PART_SIZE + 1024)
+	if err := uploadFile(s3session, lazyCleanup("us-east-1"), bucket, writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("archive.bin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	etag := strings.Trim(*head.ETag, `"`)
+	ours, err := downloadETag(s3session, bucket, "archive.bin", etag, int64(len(data)), transfer.PartSizes(int64(len(data)), PART_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ours != etag {
+		t.Errorf("the server has ETag %s, the data hashes to %s", etag, ours)
+	}
+}
@@ -0,0 +1,58 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import "sync"
+
+// BufferPool hands out up to n buffers of a chunk's size, allocating them
+// only when they're first needed.  Taking one blocks while all n are in use,
+// which is what bounds the memory a transfer takes; a small file, or an
+// upload which is mostly resumed, never allocates the rest.
+type BufferPool struct {
+	mu        sync.Mutex
+	size      int
+	allocated int
+	n         int
+	free      chan []byte
+}
+
+func NewBufferPool(n int, size int) *BufferPool {
+	return &BufferPool{size: size, n: n, free: make(chan []byte, n)}
+}
+
+// Get returns a buffer of the pool's size.
+func (p *BufferPool) Get() []byte {
+	select {
+	case buffer := <-p.free:
+		return buffer
+	default:
+	}
+
+	p.mu.Lock()
+	if p.allocated < p.n {
+		p.allocated++
+		p.mu.Unlock()
+		return make([]byte, p.size)
+	}
+	p.mu.Unlock()
+	return <-p.free
+}
+
+// Put gives a buffer Get returned back, for the next chunk.
+func (p *BufferPool) Put(buffer []byte) {
+	p.free <- buffer[:cap(buffer)]
+}
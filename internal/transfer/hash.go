@@ -0,0 +1,132 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+)
+
+// MultipartETag is the ETag S3 gives an object uploaded in parts: the MD5
+// digest of the parts' MD5 digests, one after the other, and the number of
+// parts.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html
+func MultipartETag(digests []byte, parts int) string {
+	return fmt.Sprintf("%x-%d", md5.Sum(digests), parts)
+}
+
+// PartHasher calculates the ETag S3 would give the data written to it if it
+// was uploaded in parts of the given sizes, the same way whether the data is
+// being uploaded, downloaded or read from a local file to verify an object.
+// Without parts, it's a single part upload which just gets the plain MD5
+// digest.
+//
+// With another hash function, it calculates S3's composite checksums the same
+// way, see Checksum.
+type PartHasher struct {
+	partSizes []int64
+	part      int
+	remaining int64
+	h         hash.Hash
+	digests   []byte
+}
+
+// NewPartHasher hashes parts of partSizes with h, md5.New() for ETags.
+func NewPartHasher(partSizes []int64, h hash.Hash) *PartHasher {
+	w := &PartHasher{partSizes: partSizes, h: h}
+	if len(partSizes) > 0 {
+		w.remaining = partSizes[0]
+	}
+	return w
+}
+
+func (w *PartHasher) Write(p []byte) (int, error) {
+	if len(w.partSizes) == 0 {
+		return w.h.Write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		if w.part == len(w.partSizes) {
+			return written, fmt.Errorf("The data is longer than its %d parts", len(w.partSizes))
+		}
+
+		n := int64(len(p))
+		if n > w.remaining {
+			n = w.remaining
+		}
+		w.h.Write(p[:n])
+		w.remaining -= n
+		written += int(n)
+		p = p[n:]
+
+		if w.remaining == 0 {
+			w.digests = w.h.Sum(w.digests)
+			w.h.Reset()
+			w.part++
+			if w.part < len(w.partSizes) {
+				w.remaining = w.partSizes[w.part]
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Sum returns the ETag of everything written so far, which has to fill all
+// the parts.
+func (w *PartHasher) Sum() (string, error) {
+	digest, err := w.digest()
+	if err != nil || len(w.partSizes) == 0 {
+		return fmt.Sprintf("%x", digest), err
+	}
+	return fmt.Sprintf("%x-%d", digest, len(w.partSizes)), nil
+}
+
+// Checksum returns the composite checksum of everything written so far, the
+// way S3 gives it: base64, with the number of parts appended like in an
+// ETag.
+func (w *PartHasher) Checksum() (string, error) {
+	digest, err := w.digest()
+	if err != nil {
+		return "", err
+	}
+
+	checksum := base64.StdEncoding.EncodeToString(digest)
+	if len(w.partSizes) > 0 {
+		checksum = fmt.Sprintf("%s-%d", checksum, len(w.partSizes))
+	}
+	return checksum, nil
+}
+
+// digest hashes the digests of the parts, or returns the only digest.
+func (w *PartHasher) digest() ([]byte, error) {
+	if len(w.partSizes) == 0 {
+		return w.h.Sum(nil), nil
+	}
+
+	if w.part < len(w.partSizes) {
+		return nil, fmt.Errorf("The data ends in part %d of %d", w.part+1, len(w.partSizes))
+	}
+
+	w.h.Reset()
+	w.h.Write(w.digests)
+	return w.h.Sum(nil), nil
+}
@@ -0,0 +1,74 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import "time"
+
+// Meter predicts when a transfer finishes.  It blends the rate earlier
+// transfers went at, if there's one, with the rate measured so far,
+// trusting the measurement more the more of the transfer it covers.  It
+// isn't safe for concurrent use.
+type Meter struct {
+	Started    time.Time
+	Remaining  int64
+	Done       int64
+	Historical float64
+}
+
+func NewMeter(size int64, historical float64) *Meter {
+	return &Meter{Started: time.Now(), Remaining: size, Historical: historical}
+}
+
+// Rate is the expected rate in bytes a second.
+func (m *Meter) Rate(now time.Time) float64 {
+	elapsed := now.Sub(m.Started).Seconds()
+	if m.Done == 0 || elapsed <= 0 {
+		return m.Historical
+	}
+
+	measured := float64(m.Done) / elapsed
+	if m.Historical == 0 {
+		return measured
+	}
+
+	weight := float64(m.Done) / float64(m.Done+m.Remaining)
+	return m.Historical*(1-weight) + measured*weight
+}
+
+// Predict returns when the transfer is expected to finish, or the zero time
+// while there's nothing to go by.
+func (m *Meter) Predict(now time.Time) time.Time {
+	rate := m.Rate(now)
+	if rate <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(float64(m.Remaining) / rate * float64(time.Second)))
+}
+
+// Transferred counts n bytes which went over the network, Skipped n which
+// didn't have to, e.g. copied by S3 or resumed.  Both return the new
+// prediction.
+func (m *Meter) Transferred(n int64) time.Time {
+	m.Done += n
+	m.Remaining -= n
+	return m.Predict(time.Now())
+}
+
+func (m *Meter) Skipped(n int64) time.Time {
+	m.Remaining -= n
+	return m.Predict(time.Now())
+}
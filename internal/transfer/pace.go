@@ -0,0 +1,63 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pacer spaces out what it's shared by: every request, or chunk of a body,
+// gets the next slot, which is its cost after the slot before.  Everyone
+// waiting takes turns that way, so parallel transfers get an even share.
+type Pacer struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// Reserve books a slot of cost and returns when it starts.
+func (p *Pacer) Reserve(cost time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	slot := p.next
+	p.next = p.next.Add(cost)
+	return slot
+}
+
+// Wait books a slot of cost and waits for it, or until ctx is done.
+func (p *Pacer) Wait(ctx context.Context, cost time.Duration) error {
+	delay := time.Until(p.Reserve(cost))
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
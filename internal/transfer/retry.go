@@ -0,0 +1,139 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Breaker stops the retries of every chunk once one of them failed in a way
+// retrying won't fix, like uploader.CircuitBreaker.
+type Breaker interface {
+	// Allow returns an error once the breaker has tripped.
+	Allow() error
+	// Failure tells the breaker about a failed attempt.
+	Failure(err error)
+}
+
+// Retrier tries the request for a chunk until it succeeds, the same way in
+// every direction.
+type Retrier struct {
+	// Retries is how many times a failed attempt is tried again, with
+	// Delay(try, err) in between.
+	Retries int
+	Delay   func(try int, err error) time.Duration
+	// StallRetries is how many times an attempt which stalled is tried
+	// again right away, on top of the Retries.  The S3 client never retries
+	// a request we cancelled ourselves.
+	StallRetries int
+	// Breaker, if set, is asked before every attempt.
+	Breaker Breaker
+	// OnFailure, if set, is told about every failed attempt.  When it
+	// returns true, the attempt is tried again without counting it, e.g.
+	// because the network is back after an outage.
+	OnFailure func(err error, stalled bool) bool
+	// OnRetry, if set, is told about every failed attempt which is tried
+	// again, before it is.
+	OnRetry func(err error, stalled bool)
+}
+
+// Attempt is one try at a chunk, after retries retries and stalls stalls.  It
+// reports whether it was cancelled because it stalled.
+type Attempt func(ctx context.Context, retries int, stalls int) (stalled bool, err error)
+
+// permanentError is a failure no retry is going to fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as a failure which isn't worth retrying, e.g. a
+// download of an object which has been replaced.  Do returns err itself.
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// Do calls attempt until it succeeds, the retries run out or ctx is done,
+// and returns the last error.
+func (r *Retrier) Do(ctx context.Context, attempt Attempt) error {
+	var retries, stalls int
+	for {
+		if r.Breaker != nil {
+			if err := r.Breaker.Allow(); err != nil {
+				return err
+			}
+		}
+
+		stalled, err := attempt(ctx, retries, stalls)
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			if err == error(permanent) {
+				return permanent.err
+			}
+			return err
+		}
+
+		// An error retrying won't fix isn't waited out.
+		if r.Breaker != nil {
+			r.Breaker.Failure(err)
+			if tripped := r.Breaker.Allow(); tripped != nil {
+				return tripped
+			}
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if r.OnFailure != nil && r.OnFailure(err, stalled) {
+			r.retry(err, stalled)
+			continue
+		}
+		if stalled && stalls < r.StallRetries {
+			stalls++
+			r.retry(err, stalled)
+			continue
+		}
+		if retries >= r.Retries {
+			return err
+		}
+		r.retry(err, stalled)
+
+		var delay time.Duration
+		if r.Delay != nil {
+			delay = r.Delay(retries, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		retries++
+	}
+}
+
+func (r *Retrier) retry(err error, stalled bool) {
+	if r.OnRetry != nil {
+		r.OnRetry(err, stalled)
+	}
+}
@@ -0,0 +1,61 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package transfer is the engine every transfer of s3-glacier-uploader runs
+// on, whichever way the data goes: uploads, downloads, copies within S3 and
+// verification.  It cuts objects into chunks, hashes them the way S3 does,
+// retries the requests for them, paces them and measures how they go, so
+// that all of those behave the same, and a fix to one fixes them all.  The
+// requests themselves, and what the flags make of these, are its users'.
+package transfer
+
+// Chunk is a piece of an object transferred with a request of its own: a
+// part of an upload or of a copy, or a ranged GET.  Numbers start at 1, like
+// part numbers.
+type Chunk struct {
+	Number int
+	Offset int64
+	Size   int64
+}
+
+// Last is the offset of the chunk's last byte.
+func (c Chunk) Last() int64 {
+	return c.Offset + c.Size - 1
+}
+
+// Chunks cuts the bytes first to last (inclusive) into chunks of size, the
+// last one shorter.
+func Chunks(first int64, last int64, size int64) []Chunk {
+	var chunks []Chunk
+	for offset := first; offset <= last; offset += size {
+		n := size
+		if n > last-offset+1 {
+			n = last - offset + 1
+		}
+		chunks = append(chunks, Chunk{Number: len(chunks) + 1, Offset: offset, Size: n})
+	}
+	return chunks
+}
+
+// PartSizes is the sizes of the parts of an object of size bytes uploaded in
+// parts of partSize, the last one shorter.
+func PartSizes(size int64, partSize int64) []int64 {
+	var sizes []int64
+	for _, chunk := range Chunks(0, size-1, partSize) {
+		sizes = append(sizes, chunk.Size)
+	}
+	return sizes
+}
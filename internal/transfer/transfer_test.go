@@ -0,0 +1,162 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChunks(t *testing.T) {
+	chunks := Chunks(100, 349, 100)
+	want := []Chunk{{1, 100, 100}, {2, 200, 100}, {3, 300, 50}}
+	if fmt.Sprint(chunks) != fmt.Sprint(want) {
+		t.Errorf("got %v", chunks)
+	}
+	if last := chunks[2].Last(); last != 349 {
+		t.Errorf("the last chunk ends at %d", last)
+	}
+	if chunks := Chunks(0, -1, 100); len(chunks) != 0 {
+		t.Errorf("got %v for an empty object", chunks)
+	}
+}
+
+func TestPartSizes(t *testing.T) {
+	got := fmt.Sprint(PartSizes(250, 100))
+	if got != "[100 100 50]" {
+		t.Errorf("got %s", got)
+	}
+	if sizes := PartSizes(0, 100); len(sizes) != 0 {
+		t.Errorf("got %v for an empty object", sizes)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(2, 8)
+
+	a := pool.Get()
+	pool.Put(a[:3])
+	// A buffer which is free is handed out again, rather than another one
+	// allocated.
+	if b := pool.Get(); len(b) != 8 || &b[0] != &a[0] || pool.allocated != 1 {
+		t.Errorf("got %d bytes, %d allocated", len(b), pool.allocated)
+	}
+	pool.Get()
+
+	got := make(chan []byte)
+	go func() { got <- pool.Get() }()
+	select {
+	case <-got:
+		t.Fatal("got a third buffer from a pool of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.Put(a)
+	if b := <-got; &b[0] != &a[0] {
+		t.Error("didn't get the buffer which was put back")
+	}
+}
+
+// tripOn is a Breaker tripping on one error.
+type tripOn struct {
+	err     error
+	tripped error
+}
+
+func (b *tripOn) Allow() error { return b.tripped }
+
+func (b *tripOn) Failure(err error) {
+	if errors.Is(err, b.err) {
+		b.tripped = err
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	failure := errors.New("failure")
+	fail := func(times int) (Attempt, *int) {
+		calls := 0
+		return func(ctx context.Context, retries int, stalls int) (bool, error) {
+			calls++
+			if calls <= times {
+				return false, failure
+			}
+			return false, nil
+		}, &calls
+	}
+	noDelay := func(int, error) time.Duration { return 0 }
+
+	r := &Retrier{Retries: 2, Delay: noDelay}
+	if attempt, calls := fail(2); r.Do(context.Background(), attempt) != nil || *calls != 3 {
+		t.Errorf("two failures and a success took %d calls", *calls)
+	}
+	if attempt, calls := fail(3); r.Do(context.Background(), attempt) != failure || *calls != 3 {
+		t.Errorf("three failures took %d calls", *calls)
+	}
+
+	// Failures OnFailure wants retried don't count.
+	r.OnFailure = func(err error, stalled bool) bool { return true }
+	if attempt, calls := fail(5); r.Do(context.Background(), attempt) != nil || *calls != 6 {
+		t.Errorf("five failures retried for free took %d calls", *calls)
+	}
+	r.OnFailure = nil
+
+	// OnRetry is told about the failures which are tried again, not the
+	// last one.
+	var retried int
+	r.OnRetry = func(err error, stalled bool) { retried++ }
+	if attempt, _ := fail(3); r.Do(context.Background(), attempt) != failure || retried != 2 {
+		t.Errorf("OnRetry was told about %d retries", retried)
+	}
+	r.OnRetry = nil
+
+	// Neither do permanent errors nor tripped breakers get another try.
+	calls := 0
+	err := r.Do(context.Background(), func(ctx context.Context, retries int, stalls int) (bool, error) {
+		calls++
+		return false, Permanent(failure)
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("a permanent error took %d calls and returned %v", calls, err)
+	}
+
+	r.Breaker = &tripOn{err: failure}
+	if attempt, calls := fail(3); r.Do(context.Background(), attempt) != failure || *calls != 1 {
+		t.Errorf("the breaker let %d calls through", *calls)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	var p Pacer
+	start := time.Now()
+	first := p.Reserve(100 * time.Millisecond)
+	second := p.Reserve(100 * time.Millisecond)
+
+	if first.Sub(start) > 10*time.Millisecond {
+		t.Errorf("the first slot is %v away", first.Sub(start))
+	}
+	if d := second.Sub(first); d != 100*time.Millisecond {
+		t.Errorf("the second slot is %v after the first", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Wait(ctx, time.Second); err != context.Canceled {
+		t.Errorf("waiting for a slot after a cancel returned %v", err)
+	}
+}
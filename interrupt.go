@@ -0,0 +1,94 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// CLI flags
+var AbortOnInterrupt bool
+
+// interrupt is done once we've been asked to stop, with Ctrl-C or SIGTERM.
+// Uploads run in it, so that the parts in flight are cancelled.
+var interrupt = context.Background()
+
+// trapInterrupts cancels interrupt on the first SIGINT or SIGTERM, which
+// leaves the upload to be resumed, journal and all.  A second one quits
+// straight away.  Call stop once the upload is over.
+func trapInterrupts() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		ui.Warnf("Got %s, stopping the upload (once more to quit right away)\n", sig)
+		cancel()
+
+		if _, ok := <-signals; ok {
+			os.Exit(130)
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel()
+	}
+}
+
+// interrupted tells whether we've been asked to stop.
+func interrupted() bool {
+	return interrupt.Err() != nil
+}
+
+// interruptedUploadError is an upload stopped by an interrupt, which says
+// exactly how to go on with it.
+type interruptedUploadError struct {
+	*unfinishedUploadError
+	Filename string
+}
+
+func (e *interruptedUploadError) Error() string {
+	return fmt.Sprintf("Interrupted, the upload %s is left to be resumed.  Run the same command again, or:\n\n  s3-glacier-uploader --resume-token %s %s", e.UploadID, e.Token, shellQuote(e.Filename))
+}
+
+// stopInterrupted turns the error of an upload that was interrupted into
+// instructions to resume it, or with --abort-on-interrupt aborts it.
+func stopInterrupted(cleanup cleanupSession, bucket string, filename string, unfinished *unfinishedUploadError) error {
+	if !AbortOnInterrupt {
+		return &interruptedUploadError{unfinished, filename}
+	}
+
+	session, err := cleanup()
+	if err != nil {
+		return fmt.Errorf("%w; %v", unfinished, err)
+	}
+	if err := abortUpload(session, bucket, unfinished.Key, unfinished.UploadID); err != nil {
+		return fmt.Errorf("Interrupted, and aborting the upload %s failed: %v", unfinished.UploadID, err)
+	}
+	return fmt.Errorf("Interrupted, the upload %s is aborted and its parts are deleted", unfinished.UploadID)
+}
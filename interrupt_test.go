@@ -0,0 +1,55 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUploadInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer func(ctx context.Context) { interrupt = ctx }(interrupt)
+	interrupt = ctx
+
+	filename := writeTestFile(t, randomData(3*PART_SIZE))
+	fake := newFakeS3()
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "")
+	var unfinished *unfinishedUploadError
+	if !interrupted() || !errors.As(err, &unfinished) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want an unfinished upload", err)
+	}
+
+	// The upload is left to be resumed, and we say how.
+	err = stopInterrupted(fake.cleanup, "bucket", filename, unfinished)
+	if err == nil || !strings.Contains(err.Error(), "--resume-token "+unfinished.Token.String()) || len(fake.uploads) != 1 {
+		t.Errorf("got %v", err)
+	}
+	if journal, _ := loadJournal("bucket", unfinished.Key); journal == nil {
+		t.Error("the interrupted upload left no journal")
+	}
+
+	defer func() { AbortOnInterrupt = false }()
+	AbortOnInterrupt = true
+	err = stopInterrupted(fake.cleanup, "bucket", filename, unfinished)
+	if err == nil || !strings.Contains(err.Error(), "is aborted") || len(fake.uploads) != 0 {
+		t.Errorf("--abort-on-interrupt: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// Inventory is a manifest.json of an S3 Inventory report, or the location
+// "inventory enable" registers, under which S3 puts a dated manifest every
+// day.
+var Inventory string
+
+var InventoryDestination string
+var InventoryID string
+
+// inventoryFields are the optional fields the report has.  S3 names the
+// checksum field but aws-sdk-go doesn't have a constant for it yet.
+var inventoryFields = []string{
+	s3.InventoryOptionalFieldSize,
+	s3.InventoryOptionalFieldLastModifiedDate,
+	s3.InventoryOptionalFieldStorageClass,
+	s3.InventoryOptionalFieldEtag,
+	s3.InventoryOptionalFieldIsMultipartUploaded,
+	s3.InventoryOptionalFieldObjectLockRetainUntilDate,
+	s3.InventoryOptionalFieldObjectLockMode,
+	s3.InventoryOptionalFieldObjectLockLegalHoldStatus,
+	"ChecksumAlgorithm",
+}
+
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "Set up S3 Inventory reports of the bucket",
+}
+
+var inventoryEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Have S3 write a daily CSV inventory of the bucket and use it for usage",
+	Long: `Configures a daily S3 Inventory report of the bucket in CSV format, with
+sizes, storage classes, ETags, checksum algorithms and Object Lock fields,
+written under --destination.  The report's location is then written to the
+config file as "inventory", so usage reads the latest report instead of
+listing the bucket.  The first report takes up to 48 hours.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return EnableInventory(BucketName, Region, InventoryID, InventoryDestination, ConfigFileName())
+	},
+}
+
+func inventoryConfig(id string, destination string) (*s3.InventoryConfiguration, error) {
+	if id == "" {
+		return nil, fmt.Errorf("The inventory configuration needs an --id")
+	}
+	destBucket, destPrefix, err := parseInventoryDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := &s3.InventoryS3BucketDestination{
+		Bucket: aws.String("arn:aws:s3:::" + destBucket),
+		Format: aws.String(s3.InventoryFormatCsv),
+	}
+	if destPrefix != "" {
+		dest.Prefix = aws.String(destPrefix)
+	}
+	return &s3.InventoryConfiguration{
+		Id:                     aws.String(id),
+		IsEnabled:              aws.Bool(true),
+		IncludedObjectVersions: aws.String(s3.InventoryIncludedObjectVersionsCurrent),
+		Schedule:               &s3.InventorySchedule{Frequency: aws.String(s3.InventoryFrequencyDaily)},
+		OptionalFields:         aws.StringSlice(inventoryFields),
+		Destination:            &s3.InventoryDestination{S3BucketDestination: dest},
+	}, nil
+}
+
+// parseInventoryDestination takes s3://bucket or s3://bucket/prefix.
+func parseInventoryDestination(destination string) (string, string, error) {
+	if destination == "" {
+		return "", "", fmt.Errorf("Give the bucket the reports go to with --destination s3://bucket/prefix")
+	}
+	// Unlike parseS3URL's, the key may be left out.
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("Expected an s3://bucket/prefix URL, got %q", destination)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// inventoryLocation is where S3 writes the reports of the configuration:
+// prefix/source-bucket/id/, with a dated directory and manifest.json a day.
+func inventoryLocation(bucket string, id string, destination string) (string, error) {
+	destBucket, destPrefix, err := parseInventoryDestination(destination)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{destBucket}
+	if destPrefix != "" {
+		parts = append(parts, destPrefix)
+	}
+	return "s3://" + strings.Join(append(parts, bucket, id), "/") + "/", nil
+}
+
+// resolveInventory turns --inventory into the manifest to read, the newest
+// one if it's a location.  If the location holds reports of another bucket
+// there's nothing to read, and usage lists the bucket instead.
+func resolveInventory(s3session s3iface.S3API, inventory string, bucket string) (string, error) {
+	if inventory == "" || strings.HasSuffix(inventory, "/manifest.json") {
+		return inventory, nil
+	}
+
+	destBucket, prefix, err := parseS3URL(strings.TrimSuffix(inventory, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	objects, err := listAll(s3session, destBucket, prefix)
+	if err != nil {
+		return "", fmt.Errorf("Failed to list the inventory reports: %w", err)
+	}
+	var latest string
+	for _, obj := range objects {
+		if key := obj.Key; strings.HasSuffix(key, "/manifest.json") && key > latest {
+			latest = key
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("There's no inventory report under %s yet, the first one takes up to 48 hours", inventory)
+	}
+
+	manifest, err := loadInventoryManifest(s3session, destBucket, latest)
+	if err != nil {
+		return "", err
+	}
+	if manifest.SourceBucket != bucket {
+		ui.Warnf("The inventory under %s is of %s, not %s, listing the bucket instead\n", inventory, manifest.SourceBucket, bucket)
+		return "", nil
+	}
+	return "s3://" + destBucket + "/" + latest, nil
+}
+
+// EnableInventory replaces whatever inventory configuration of that ID there
+// was, so it counts as destructive.
+func EnableInventory(bucket string, region string, id string, destination string, configFile string) error {
+	config, err := inventoryConfig(id, destination)
+	if err != nil {
+		return err
+	}
+	location, err := inventoryLocation(bucket, id, destination)
+	if err != nil {
+		return err
+	}
+
+	s3session, err := newDestructiveS3Session(region)
+	if err != nil {
+		return err
+	}
+	_, err = s3session.PutBucketInventoryConfiguration(&s3.PutBucketInventoryConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		Id:                     aws.String(id),
+		InventoryConfiguration: config,
+	})
+	if err != nil {
+		return err
+	}
+	ui.Printf("Configured a daily CSV inventory of %s, written under %s\n", bucket, location)
+
+	destBucket, _, _ := parseInventoryDestination(destination)
+	ui.Printf("%s has to let S3 write there, with a bucket policy allowing s3:PutObject for the service principal s3.amazonaws.com, conditioned on aws:SourceArn arn:aws:s3:::%s\n", destBucket, bucket)
+
+	if configFile == "" || strings.HasPrefix(configFile, "s3://") {
+		ui.Printf("Set inventory = %s in the config file to use it\n", location)
+		return nil
+	}
+	if err := setConfigValue(configFile, "inventory", location); err != nil {
+		return err
+	}
+	ui.Printf("Wrote inventory = %s to %s\n", location, configFile)
+	return nil
+}
+
+// setConfigValue sets name outside any profile, replacing the line that
+// set it before, or adding one ahead of the first profile.
+func setConfigValue(filename string, name string, value string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	line := name + " = " + value
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	at := len(lines)
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "[") {
+			at = i
+			break
+		}
+		if parts := strings.SplitN(l, "=", 2); len(parts) == 2 && strings.TrimSpace(parts[0]) == name {
+			lines[i] = line
+			return writeConfigLines(filename, lines)
+		}
+	}
+
+	lines = append(lines[:at], append([]string{line}, lines[at:]...)...)
+	return writeConfigLines(filename, lines)
+}
+
+func writeConfigLines(filename string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&Inventory, "inventory", "", "S3 Inventory report to read instead of listing the bucket, a manifest.json or the location inventory enable registers (s3://...)")
+
+	inventoryEnableCmd.Flags().StringVar(&InventoryDestination, "destination", "", "bucket and prefix the reports go to (s3://bucket/prefix)")
+	inventoryEnableCmd.Flags().StringVar(&InventoryID, "id", "s3-glacier-uploader", "name of the inventory configuration")
+	inventoryCmd.AddCommand(inventoryEnableCmd)
+	rootCmd.AddCommand(inventoryCmd)
+}
@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestInventoryConfig(t *testing.T) {
+	config, err := inventoryConfig("daily", "s3://logs/inventory/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := config.Destination.S3BucketDestination
+	if *dest.Bucket != "arn:aws:s3:::logs" || *dest.Prefix != "inventory" || *dest.Format != s3.InventoryFormatCsv {
+		t.Errorf("destination %v", dest)
+	}
+	if *config.Schedule.Frequency != s3.InventoryFrequencyDaily || len(config.OptionalFields) != len(inventoryFields) {
+		t.Errorf("got %v", config)
+	}
+
+	if _, err := inventoryConfig("daily", ""); err == nil {
+		t.Error("a configuration without a destination was accepted")
+	}
+
+	for destination, want := range map[string]string{
+		"s3://logs/inventory": "s3://logs/inventory/backups/daily/",
+		"s3://logs":           "s3://logs/backups/daily/",
+	} {
+		if got, err := inventoryLocation("backups", "daily", destination); err != nil || got != want {
+			t.Errorf("location for %s is %q, %v", destination, got, err)
+		}
+	}
+}
+
+func TestResolveInventory(t *testing.T) {
+	fake := newFakeS3()
+	put := func(key string, body string) {
+		fake.PutObject(&s3.PutObjectInput{Bucket: aws.String("logs"), Key: aws.String(key), Body: bytes.NewReader([]byte(body))})
+	}
+	manifest := `{"sourceBucket": "backups", "fileFormat": "CSV", "fileSchema": "Bucket, Key, Size, StorageClass", "files": []}`
+	put("inventory/backups/daily/2026-10-14T01-00Z/manifest.json", manifest)
+	put("inventory/backups/daily/2026-10-15T01-00Z/manifest.json", manifest)
+	put("inventory/backups/daily/data/1.csv.gz", "")
+
+	got, err := resolveInventory(fake, "s3://logs/inventory/backups/daily/", "backups")
+	if want := "s3://logs/inventory/backups/daily/2026-10-15T01-00Z/manifest.json"; err != nil || got != want {
+		t.Errorf("resolved to %q, %v", got, err)
+	}
+	if got, err := resolveInventory(fake, "s3://logs/inventory/backups/daily/", "photos"); err != nil || got != "" {
+		t.Errorf("the inventory of another bucket resolved to %q, %v", got, err)
+	}
+	if _, err := resolveInventory(fake, "s3://logs/inventory/photos/daily/", "photos"); err == nil {
+		t.Error("a location without reports was accepted")
+	}
+	if got, _ := resolveInventory(fake, "s3://logs/x/manifest.json", "backups"); got != "s3://logs/x/manifest.json" {
+		t.Errorf("a manifest resolved to %q", got)
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config")
+	check := func(want string) {
+		t.Helper()
+		if err := setConfigValue(p, "inventory", "s3://logs/b/"); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(p)
+		if string(data) != want {
+			t.Errorf("got %q, want %q", data, want)
+		}
+	}
+
+	check("inventory = s3://logs/b/\n")
+
+	os.WriteFile(p, []byte("bucket = b\n[photos]\nprefix = p/\n"), 0600)
+	check("bucket = b\ninventory = s3://logs/b/\n[photos]\nprefix = p/\n")
+
+	os.WriteFile(p, []byte("bucket = b\ninventory = s3://old/\n# comment\n"), 0600)
+	check("bucket = b\ninventory = s3://logs/b/\n# comment\n")
+}
@@ -0,0 +1,213 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CLI flags
+var NoResume bool
+
+// uploadJournal is what we know about an upload in progress.  It's written
+// next to the run history as parts finish, so that after a crash the upload
+// can be resumed without the user having noted down its ID.
+type uploadJournal struct {
+	Version  int             `json:"version"`
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	Filename string          `json:"filename"`
+	UploadID string          `json:"upload_id"`
+	PartSize int64           `json:"part_size"`
+	Size     int64           `json:"size"`
+	ModTime  time.Time       `json:"mtime"`
+	Parts    []journaledPart `json:"parts"`
+
+	// Stream is set for streams, which resume from a checkpoint instead
+	// of the file.
+	Stream *streamCheckpoint `json:"stream,omitempty"`
+
+	path string
+}
+
+type journaledPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// journalPath is one file per bucket and key, as S3 only allows one object
+// under a key anyway.
+func journalPath(bucket string, key string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "uploads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sum[:16])), nil
+}
+
+// loadJournal returns the journal of an unfinished upload to key, or nil.
+func loadJournal(bucket string, key string) (*uploadJournal, error) {
+	p, err := journalPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := loadJournalFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return journal, err
+}
+
+// loadJournalFile reads a journal, of any state version up to ours.  Version
+// 1 only lacks the version.
+func loadJournalFile(p string) (*uploadJournal, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+
+	journal := &uploadJournal{path: p}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("Failed to read the upload journal %s: %w", p, err)
+	}
+	return journal, nil
+}
+
+func newJournal(bucket string, key string, filename string, uploadID string, stat os.FileInfo, partSize int) (*uploadJournal, error) {
+	p, err := journalPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+
+	return &uploadJournal{
+		Bucket:   bucket,
+		Key:      key,
+		Filename: filename,
+		UploadID: uploadID,
+		PartSize: int64(partSize),
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		path:     p,
+	}, nil
+}
+
+// Matches tells whether the journal is of an upload of this version of the
+// file, in parts of the same size.
+func (j *uploadJournal) Matches(stat os.FileInfo, partSize int) bool {
+	return j.PartSize == int64(partSize) && j.Size == stat.Size() && j.ModTime.Equal(stat.ModTime())
+}
+
+// Record adds a finished part and writes the journal out.  The file is
+// replaced by a rename, so a crash never leaves half of it behind.
+func (j *uploadJournal) Record(part *s3.CompletedPart, offset int64, size int) error {
+	j.Parts = append(j.Parts, journaledPart{
+		Number: aws.Int64Value(part.PartNumber),
+		ETag:   aws.StringValue(part.ETag),
+		Offset: offset,
+		Size:   int64(size),
+	})
+	sort.Slice(j.Parts, func(a, b int) bool { return j.Parts[a].Number < j.Parts[b].Number })
+
+	return j.Save()
+}
+
+func (j *uploadJournal) Save() error {
+	j.Version = STATE_VERSION
+	return writeStateFile(j.path, j)
+}
+
+func (j *uploadJournal) Remove() error {
+	err := os.Remove(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// startOver gives up on the journaled upload.  It's aborted first, S3 would
+// keep its parts, and bill for them, until a lifecycle rule cleans them up.
+func (j *uploadJournal) startOver(cleanup cleanupSession) error {
+	session, err := cleanup()
+	if err == nil {
+		_, err = session.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(j.Bucket),
+			Key:      aws.String(j.Key),
+			UploadId: aws.String(j.UploadID),
+		})
+	}
+	if err != nil && !isNoSuchUpload(err) {
+		ui.Warnf("Failed to abort the interrupted upload %s: %v\n", j.UploadID, err)
+	}
+	return j.Remove()
+}
+
+// journaledUpload returns the ID of an interrupted upload of this file to
+// key, if there's one to resume.  On a terminal the user is asked first.
+// An upload which isn't resumed is aborted.
+func journaledUpload(cleanup cleanupSession, bucket string, key string, stat os.FileInfo, partSize int) (string, error) {
+	journal, err := loadJournal(bucket, key)
+	if err != nil || journal == nil {
+		return "", err
+	}
+
+	if NoResume {
+		return "", journal.startOver(cleanup)
+	}
+	if journal.PartSize != int64(partSize) {
+		ui.Printf("The interrupted upload %s to %s was in %s parts, not %s, starting over\n", journal.UploadID, key, formatBytes(journal.PartSize), formatBytes(int64(partSize)))
+		return "", journal.startOver(cleanup)
+	}
+	if !journal.Matches(stat, partSize) {
+		ui.Printf("The interrupted upload %s to %s was of another version of the file, starting over\n", journal.UploadID, key)
+		return "", journal.startOver(cleanup)
+	}
+
+	question := fmt.Sprintf("Found an interrupted upload to %s with %d parts done.  Resume it?", key, len(journal.Parts))
+	if isTerminal(os.Stdin) && !confirm(question, os.Stdin) {
+		return "", journal.startOver(cleanup)
+	}
+
+	ui.Println("Found an interrupted upload, resuming it")
+	return journal.UploadID, nil
+}
@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// interruptedUpload leaves an upload of the file whose third part failed, and
+// its journal.
+func interruptedUpload(t *testing.T, filename string) *slowS3 {
+	fake := &slowS3{fakeS3: newFakeS3(), fail: 3}
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err == nil {
+		t.Fatal("the upload didn't fail")
+	}
+	fake.partUploads = 0
+	return fake
+}
+
+func TestJournalResume(t *testing.T) {
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := interruptedUpload(t, filename)
+
+	journal, err := loadJournal("bucket", "archive.bin")
+	if err != nil || journal == nil {
+		t.Fatalf("no journal of the failed upload: %v", err)
+	}
+	if journal.UploadID != "upload-1" || len(journal.Parts) != 2 {
+		t.Fatalf("journal of %s with %d parts", journal.UploadID, len(journal.Parts))
+	}
+	if p := journal.Parts[1]; p.Number != 2 || p.Offset != PART_SIZE || p.Size != PART_SIZE || p.ETag == "" {
+		t.Errorf("second part journaled as %+v", p)
+	}
+
+	if err := uploadFile(fake.fakeS3, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the resumed upload doesn't contain the file")
+	}
+	if fake.partUploads != 1 {
+		t.Errorf("uploaded %d parts, want only the third", fake.partUploads)
+	}
+	if journal, _ := loadJournal("bucket", "archive.bin"); journal != nil {
+		t.Error("the journal is still there after the upload finished")
+	}
+}
+
+func TestJournalStartOver(t *testing.T) {
+	defer func() { NoResume = false }()
+
+	data := randomData(2*PART_SIZE + 1024)
+
+	for name, prepare := range map[string]func(t *testing.T, filename string, fake *slowS3){
+		"changed file": func(t *testing.T, filename string, fake *slowS3) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(filename, later, later); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"aborted upload": func(t *testing.T, filename string, fake *slowS3) {
+			delete(fake.uploads, "upload-1")
+		},
+		"--no-resume": func(t *testing.T, filename string, fake *slowS3) {
+			NoResume = true
+		},
+	} {
+		NoResume = false
+		filename := writeTestFile(t, data)
+		fake := interruptedUpload(t, filename)
+		prepare(t, filename, fake)
+
+		if err := uploadFile(fake.fakeS3, fake.cleanup, "bucket", filename, ""); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+			t.Errorf("%s: the object doesn't contain the file", name)
+		}
+		if fake.partUploads != 3 {
+			t.Errorf("%s: uploaded %d parts, want all 3", name, fake.partUploads)
+		}
+		if _, ok := fake.uploads["upload-1"]; ok {
+			t.Errorf("%s: the interrupted upload wasn't aborted", name)
+		}
+	}
+}
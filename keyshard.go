@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// CLI flags
+var ShardPrefix int
+
+// S3 scales its request rate, and we our listings, per prefix, so millions
+// of objects under one prefix are slow to list and restore, and easily
+// throttled.  --shard-prefix n spreads keys over n sub-prefixes named after
+// a hash of the rest of the key, like photos/3a/2022/a.jpg: the same file
+// always lands in the same one, so sync still finds what's uploaded.
+const MAX_SHARD_PREFIX = 4096
+
+func checkShardPrefix() error {
+	if ShardPrefix < 0 || ShardPrefix > MAX_SHARD_PREFIX {
+		return fmt.Errorf("--shard-prefix is a number of prefixes up to %d, got %d", MAX_SHARD_PREFIX, ShardPrefix)
+	}
+	return nil
+}
+
+// keyShard is the sub-prefix name goes under, in as many hex digits as the
+// last of the --shard-prefix shards needs.
+func keyShard(name string) string {
+	width := len(fmt.Sprintf("%x", ShardPrefix-1))
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%0*x", width, h.Sum32()%uint32(ShardPrefix))
+}
+
+// shardedName puts name under its shard with --shard-prefix.
+func shardedName(name string) string {
+	if ShardPrefix <= 1 {
+		return name
+	}
+	return keyShard(name) + "/" + name
+}
+
+// unshardKey leaves the shard out of key, for looking it up by the name it
+// would have without --shard-prefix.  The shard is the first directory which
+// is the shard of everything after it.  It's "" if key has none.
+func unshardKey(key string) string {
+	if ShardPrefix <= 1 {
+		return ""
+	}
+	start := 0
+	for {
+		slash := strings.Index(key[start:], "/")
+		if slash < 0 {
+			return ""
+		}
+		dir, rest := key[start:start+slash], key[start+slash+1:]
+		if rest != "" && dir == keyShard(rest) {
+			return key[:start] + rest
+		}
+		start += slash + 1
+	}
+}
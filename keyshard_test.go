@@ -0,0 +1,94 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestShardedName(t *testing.T) {
+	defer func() { ShardPrefix = 0 }()
+
+	if name := shardedName("2022/a.jpg"); name != "2022/a.jpg" {
+		t.Errorf("sharded without --shard-prefix: %s", name)
+	}
+
+	ShardPrefix = 256
+	name := shardedName("2022/a.jpg")
+	if len(name) != len("3a/2022/a.jpg") || name[2:] != "/2022/a.jpg" {
+		t.Fatalf("sharded to %s", name)
+	}
+	if again := shardedName("2022/a.jpg"); again != name {
+		t.Errorf("the same name went to %s and %s", name, again)
+	}
+
+	shards := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		shards[keyShard(string(rune('a'+i%26))+string(rune(i)))] = true
+	}
+	if len(shards) < 200 {
+		t.Errorf("2000 names only went to %d shards", len(shards))
+	}
+
+	ShardPrefix = 4096
+	if shard := keyShard("a"); len(shard) != 3 {
+		t.Errorf("shard %s of 4096", shard)
+	}
+}
+
+func TestUnshardKey(t *testing.T) {
+	defer func() { ShardPrefix = 0 }()
+
+	ShardPrefix = 16
+	key := "laptop/" + shardedName("2022/a.jpg")
+	if unsharded := unshardKey(key); unsharded != "laptop/2022/a.jpg" {
+		t.Errorf("%s unsharded is %q", key, unsharded)
+	}
+	if unsharded := unshardKey("laptop/x/2022/a.jpg"); unsharded != "" {
+		t.Errorf("found a shard in an unsharded key: %s", unsharded)
+	}
+
+	ShardPrefix = 0
+	if unsharded := unshardKey(key); unsharded != "" {
+		t.Errorf("found a shard without --shard-prefix: %s", unsharded)
+	}
+}
+
+func TestShardPrefixFlag(t *testing.T) {
+	defer func() { ShardPrefix = 0 }()
+
+	for _, n := range []int{-1, MAX_SHARD_PREFIX + 1} {
+		ShardPrefix = n
+		if err := checkShardPrefix(); err == nil {
+			t.Errorf("--shard-prefix %d was accepted", n)
+		}
+	}
+	ShardPrefix = 64
+	if err := checkShardPrefix(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSyncKeyShard(t *testing.T) {
+	defer func() { ShardPrefix = 0 }()
+
+	ShardPrefix = 64
+	key, err := syncKey("/data", "/data/2022/a.jpg", "photos")
+	if err != nil || key != "photos/"+shardedName("2022/a.jpg") {
+		t.Errorf("synced to %q, %v", key, err)
+	}
+}
@@ -0,0 +1,182 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var KMSRequestRate string
+
+// With SSE-KMS, S3 asks KMS for a data key for every part it stores or
+// reads, and KMS allows only so many requests a second per account.  At a
+// high --concurrency, or with several uploads at once, S3 passes KMS's
+// throttling on to us.  Those requests are spaced out by a limiter of their
+// own, which slows down whenever KMS throttles and speeds up again while it
+// doesn't, never going faster than --kms-request-rate.
+const (
+	KMS_MIN_INTERVAL = 10 * time.Millisecond
+	KMS_MAX_INTERVAL = 5 * time.Second
+)
+
+// kmsOperations are the requests for which S3 calls KMS.
+var kmsOperations = map[string]bool{
+	"CreateMultipartUpload": true,
+	"UploadPart":            true,
+	"UploadPartCopy":        true,
+	"PutObject":             true,
+	"CopyObject":            true,
+	"GetObject":             true,
+}
+
+// kmsLimiter is a requestLimiter whose interval changes as KMS throttles.
+type kmsLimiter struct {
+	requestLimiter
+	floor  time.Duration
+	warned bool
+}
+
+var kms = &kmsLimiter{}
+
+func checkKMSRequestRate() error {
+	kms = &kmsLimiter{}
+	if KMSRequestRate == "" {
+		return nil
+	}
+
+	interval, err := parseRequestRate(KMSRequestRate)
+	if err != nil {
+		return fmt.Errorf("Invalid --kms-request-rate %q, use e.g. 50/s or 3000/m", KMSRequestRate)
+	}
+	kms.floor = interval
+	kms.interval = interval
+	return nil
+}
+
+// isKMSThrottle reports whether err is S3 passing on KMS's throttling.  S3
+// sends it as SlowDown, or with the code KMS gave it.
+func isKMSThrottle(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if strings.HasPrefix(aerr.Code(), "KMS.") && strings.Contains(aerr.Code(), "Throttl") {
+		return true
+	}
+	return strings.Contains(aerr.Message(), "rate at which you may call KMS")
+}
+
+// Throttled halves the rate of requests which call KMS.
+func (l *kmsLimiter) Throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.warned {
+		ui.Warnln("KMS is throttling requests, slowing down.  S3 Bucket Keys make SSE-KMS call KMS far less often.")
+		l.warned = true
+	}
+	l.interval *= 2
+	if l.interval < KMS_MIN_INTERVAL {
+		l.interval = KMS_MIN_INTERVAL
+	}
+	if l.interval > KMS_MAX_INTERVAL {
+		l.interval = KMS_MAX_INTERVAL
+	}
+}
+
+// Succeeded speeds up a little again, up to --kms-request-rate.
+func (l *kmsLimiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.interval <= l.floor {
+		return
+	}
+	l.interval -= l.interval / 20
+	if l.interval < KMS_MIN_INTERVAL || l.interval < l.floor {
+		l.interval = l.floor
+	}
+}
+
+// limitKMS spaces out the requests of the session which call KMS, and has
+// every attempt of them tell the limiter how it went.
+func limitKMS(handlers *request.Handlers) {
+	handlers.Sign.PushFront(func(r *request.Request) {
+		if kmsOperations[r.Operation.Name] {
+			kms.Wait(r)
+		}
+	})
+	handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+		if !kmsOperations[r.Operation.Name] {
+			return
+		}
+		switch {
+		case isKMSThrottle(r.Error):
+			kms.Throttled()
+		case r.Error == nil:
+			kms.Succeeded()
+		}
+	})
+}
+
+// explainKMSThrottling says what to do when KMS throttling outlasted the
+// retries.
+func explainKMSThrottling(r *request.Request) {
+	if aerr, ok := r.Error.(awserr.Error); ok && isKMSThrottle(aerr) {
+		r.Error = awserr.New(aerr.Code(), "KMS kept throttling the requests of SSE-KMS; lower --concurrency or --kms-request-rate, or enable S3 Bucket Keys on the bucket", aerr)
+	}
+}
+
+// checkBucketKeys points out when the bucket encrypts with SSE-KMS by default
+// without S3 Bucket Keys, so every part costs a KMS request.
+func checkBucketKeys(w io.Writer, s3session s3iface.S3API, bucket string) {
+	resp, err := s3session.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != "ServerSideEncryptionConfigurationNotFoundError" {
+			fmt.Fprintf(w, "Can't tell how %s is encrypted: %v\n", bucket, err)
+		}
+		return
+	}
+	if resp.ServerSideEncryptionConfiguration == nil {
+		return
+	}
+
+	for _, rule := range resp.ServerSideEncryptionConfiguration.Rules {
+		sse := rule.ApplyServerSideEncryptionByDefault
+		if sse == nil || !strings.HasPrefix(aws.StringValue(sse.SSEAlgorithm), s3.ServerSideEncryptionAwsKms) {
+			continue
+		}
+		if aws.BoolValue(rule.BucketKeyEnabled) {
+			fmt.Fprintln(w, "The bucket uses SSE-KMS with S3 Bucket Keys")
+		} else {
+			fmt.Fprintln(w, "The bucket uses SSE-KMS without S3 Bucket Keys: every part is a KMS request, which KMS may throttle.  Enabling Bucket Keys avoids that, and lowers the KMS bill.")
+		}
+		return
+	}
+}
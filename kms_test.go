@@ -0,0 +1,119 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestIsKMSThrottle(t *testing.T) {
+	kmsSlowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "You have exceeded the rate at which you may call KMS. Reduce the frequency of your calls.", nil), 503, "")
+	kmsCode := awserr.NewRequestFailure(awserr.New("KMS.ThrottlingException", "Rate exceeded", nil), 400, "")
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+
+	if !isKMSThrottle(kmsSlowDown) || !isKMSThrottle(kmsCode) {
+		t.Error("KMS throttling wasn't recognized")
+	}
+	if isKMSThrottle(slowDown) || isKMSThrottle(nil) {
+		t.Error("S3's own throttling was taken for KMS's")
+	}
+	if kind := retryKind(kmsSlowDown); kind != RETRY_KMS {
+		t.Errorf("counted KMS throttling as %s", kind)
+	}
+}
+
+func TestKMSLimiter(t *testing.T) {
+	defer func() { KMSRequestRate = ""; checkKMSRequestRate() }()
+
+	KMSRequestRate = "fast"
+	if err := checkKMSRequestRate(); err == nil {
+		t.Error("--kms-request-rate fast was accepted")
+	}
+
+	KMSRequestRate = "50/s"
+	if err := checkKMSRequestRate(); err != nil {
+		t.Fatal(err)
+	}
+	if kms.interval != 20*time.Millisecond {
+		t.Fatalf("50/s is an interval of %s", kms.interval)
+	}
+
+	kms.Throttled()
+	kms.Throttled()
+	if kms.interval != 80*time.Millisecond {
+		t.Errorf("throttled twice, the interval is %s", kms.interval)
+	}
+	for i := 0; i < 30; i++ {
+		kms.Throttled()
+	}
+	if kms.interval != KMS_MAX_INTERVAL {
+		t.Errorf("the interval grew to %s", kms.interval)
+	}
+
+	for i := 0; i < 1000; i++ {
+		kms.Succeeded()
+	}
+	if kms.interval != 20*time.Millisecond {
+		t.Errorf("sped up to an interval of %s, past --kms-request-rate", kms.interval)
+	}
+
+	// Without --kms-request-rate, it goes back to not waiting at all.
+	KMSRequestRate = ""
+	checkKMSRequestRate()
+	kms.Throttled()
+	if kms.interval != KMS_MIN_INTERVAL {
+		t.Errorf("the first slowdown is to %s", kms.interval)
+	}
+	for i := 0; i < 100; i++ {
+		kms.Succeeded()
+	}
+	if kms.interval != 0 {
+		t.Errorf("sped up to an interval of %s", kms.interval)
+	}
+}
+
+func TestCheckBucketKeys(t *testing.T) {
+	fake := newFakeS3()
+	var out bytes.Buffer
+	checkBucketKeys(&out, fake, "bucket")
+	if out.Len() != 0 {
+		t.Errorf("said %q about a bucket without default encryption", out.String())
+	}
+
+	rule := &s3.ServerSideEncryptionRule{
+		ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(s3.ServerSideEncryptionAwsKms)},
+	}
+	fake.encryption = &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{rule}}
+	checkBucketKeys(&out, fake, "bucket")
+	if !strings.Contains(out.String(), "without S3 Bucket Keys") {
+		t.Errorf("said %q about SSE-KMS without Bucket Keys", out.String())
+	}
+
+	out.Reset()
+	rule.BucketKeyEnabled = aws.Bool(true)
+	checkBucketKeys(&out, fake, "bucket")
+	if !strings.Contains(out.String(), "with S3 Bucket Keys") {
+		t.Errorf("said %q about SSE-KMS with Bucket Keys", out.String())
+	}
+}
@@ -0,0 +1,216 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var ListConcurrency int
+
+// A bucket is split into shards along "/" until there are enough of them to
+// keep ListConcurrency listings busy, but not deeper than this.
+const LIST_SHARD_DEPTH = 3
+
+// LIST_BUFFER is how many listed objects may wait for processing, which is
+// what bounds the memory a listing takes.
+const LIST_BUFFER = 10000
+
+// How often a long listing reports how far it got.
+var listProgressInterval = 10 * time.Second
+
+// listShard lists one level under prefix, handing the objects found there to
+// found and returning the "directories" below it.
+func listShard(s3session s3iface.S3API, bucket string, prefix string, found func(archivedObject) bool) ([]string, error) {
+	var prefixes []string
+	err := s3session.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, *p.Prefix)
+		}
+		return listPage(page, found)
+	})
+	return prefixes, err
+}
+
+func listPage(page *s3.ListObjectsV2Output, found func(archivedObject) bool) bool {
+	for _, obj := range page.Contents {
+		if !found(archivedObject{*obj.Key, *obj.Size, aws.StringValue(obj.StorageClass), *obj.LastModified}) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkObjects calls fn for every object under prefix, in no particular
+// order.  The bucket is listed by several goroutines at once, each taking a
+// shard of the key space, but fn is only ever called from one goroutine and
+// the objects aren't collected anywhere, so buckets with millions of objects
+// can be processed in constant memory.  The first error, from S3 or fn, stops
+// the walk.
+func walkObjects(s3session s3iface.S3API, bucket string, prefix string, fn func(archivedObject) error) error {
+	objects := make(chan archivedObject, LIST_BUFFER)
+	done := make(chan struct{})
+
+	var errOnce sync.Once
+	var walkErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			walkErr = err
+			close(done)
+		})
+	}
+
+	found := func(obj archivedObject) bool {
+		select {
+		case objects <- obj:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	var listed int64
+	go func() {
+		defer close(objects)
+
+		// Split the key space breadth first, listing the objects at each
+		// level on the way.
+		shards := []string{prefix}
+		for depth := 0; depth < LIST_SHARD_DEPTH && len(shards) > 0 && len(shards) < ListConcurrency; depth++ {
+			var deeper []string
+			for _, shard := range shards {
+				prefixes, err := listShard(s3session, bucket, shard, found)
+				if err != nil {
+					fail(fmt.Errorf("Failed to list %s: %w", shard, err))
+					return
+				}
+				deeper = append(deeper, prefixes...)
+			}
+			shards = deeper
+		}
+
+		var wg sync.WaitGroup
+		queue := make(chan string)
+		for i := 0; i < ListConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for shard := range queue {
+					err := s3session.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+						Bucket: aws.String(bucket),
+						Prefix: aws.String(shard),
+					}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+						return listPage(page, found)
+					})
+					if err != nil {
+						fail(fmt.Errorf("Failed to list %s: %w", shard, err))
+					}
+				}
+			}()
+		}
+
+	shards:
+		for _, shard := range shards {
+			select {
+			case queue <- shard:
+			case <-done:
+				break shards
+			}
+		}
+		close(queue)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(listProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case obj, ok := <-objects:
+			if !ok {
+				return walkErr
+			}
+			atomic.AddInt64(&listed, 1)
+			if err := fn(obj); err != nil {
+				fail(err)
+				// Let the listings notice and wind down.
+				for range objects {
+				}
+				return walkErr
+			}
+		case <-ticker.C:
+			ui.Warnf("Listed %d objects so far...\n", atomic.LoadInt64(&listed))
+		}
+	}
+}
+
+// listAll returns every object under prefix, in key order.
+func listAll(s3session s3iface.S3API, bucket string, prefix string) ([]archivedObject, error) {
+	var objects []archivedObject
+	err := walkObjects(s3session, bucket, prefix, func(obj archivedObject) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, err
+}
+
+// forEachObject calls fn for the indexes of count objects, ListConcurrency
+// at a time, for the requests listings don't save us, like HeadObject.  It
+// returns the error of the first object which failed.
+func forEachObject(count int, fn func(i int) error) error {
+	indexes := make(chan int)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for w := 0; w < ListConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
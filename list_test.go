@@ -0,0 +1,105 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fillFake creates the keys as small objects.
+func fillFake(fake *fakeS3, keys []string) {
+	for _, key := range keys {
+		fake.objects[key] = &fakeObject{data: []byte(key), etag: md5Hex([]byte(key)), storageClass: s3.StorageClassDeepArchive}
+	}
+}
+
+func TestWalkObjects(t *testing.T) {
+	fake := newFakeS3()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("set%d/year%d/file%d", i%7, i%3, i))
+	}
+	keys = append(keys, "top.txt", "set1/loose.txt")
+	fillFake(fake, keys)
+
+	seen := map[string]int{}
+	err := walkObjects(fake, "bucket", "", func(obj archivedObject) error {
+		seen[obj.Key]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(keys) {
+		t.Errorf("walked %d of %d objects", len(seen), len(keys))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("%s was walked %d times", key, n)
+		}
+	}
+
+	// The 7 sets aren't enough shards for 8 listings, so it goes one
+	// level deeper: 1 + 7 listings to find the 21 shards, then one for each.
+	if fake.listings != 1+7+21 {
+		t.Errorf("listed %d times", fake.listings)
+	}
+
+	objects, err := listAll(fake, "bucket", "set1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 144 || objects[0].Key != "set1/loose.txt" {
+		t.Errorf("got %d objects under set1/, starting with %s", len(objects), objects[0].Key)
+	}
+}
+
+func TestWalkObjectsStopsOnError(t *testing.T) {
+	fake := newFakeS3()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("set%d/file%d", i%20, i))
+	}
+	fillFake(fake, keys)
+
+	stop := errors.New("stop")
+	var calls int
+	err := walkObjects(fake, "bucket", "", func(obj archivedObject) error {
+		calls++
+		if calls == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("got %v", err)
+	}
+	if calls != 10 {
+		t.Errorf("called %d times after failing", calls)
+	}
+}
+
+func TestListAllEmpty(t *testing.T) {
+	objects, err := listAll(newFakeS3(), "bucket", "")
+	if err != nil || len(objects) != 0 {
+		t.Errorf("got %v, %v", objects, err)
+	}
+}
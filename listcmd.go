@@ -0,0 +1,224 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// list flags
+var ListPrefix string
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List unfinished multipart uploads or stored objects",
+}
+
+var listUploadsCmd = &cobra.Command{
+	Use:   "uploads",
+	Short: "List multipart uploads which were started but never completed or aborted, and what their parts cost",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ListUploads(ui.Writer(), newS3Session(Region), BucketName, ListPrefix, time.Now())
+	},
+}
+
+var listObjectsCmd = &cobra.Command{
+	Use:   "objects",
+	Short: "List stored objects, all of them or with --storage-class those in one storage class",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var storageClass string
+		if cmd.Flags().Changed("storage-class") {
+			storageClass = StorageClass
+		}
+		return ListObjects(ui.Writer(), newS3Session(Region), BucketName, ListPrefix, storageClass)
+	},
+}
+
+// pendingUpload is a multipart upload which was neither completed nor
+// aborted, with what its parts add up to.
+type pendingUpload struct {
+	Key          string
+	UploadID     string
+	Initiated    time.Time
+	StorageClass string
+	Parts        int
+	Size         int64
+}
+
+// Cost is what the parts cost a month.  Parts of uploads to the archive
+// storage classes are billed at the STANDARD rate until the upload is
+// completed.
+func (u pendingUpload) Cost() float64 {
+	if isArchived(u.StorageClass) {
+		return storageCost(s3.StorageClassStandard, 0, u.Size)
+	}
+	return storageCost(u.StorageClass, 0, u.Size)
+}
+
+// listUploads returns the unfinished uploads under prefix, oldest first,
+// listing the parts of each.
+func listUploads(s3session s3iface.S3API, bucket string, prefix string) ([]pendingUpload, error) {
+	var uploads []pendingUpload
+	err := s3session.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			uploads = append(uploads, pendingUpload{
+				Key:          aws.StringValue(u.Key),
+				UploadID:     aws.StringValue(u.UploadId),
+				Initiated:    aws.TimeValue(u.Initiated),
+				StorageClass: aws.StringValue(u.StorageClass),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list multipart uploads: %w", err)
+	}
+
+	for i := range uploads {
+		u := &uploads[i]
+		err := s3session.ListPartsPages(&s3.ListPartsInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(u.Key),
+			UploadId: aws.String(u.UploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				u.Parts++
+				u.Size += aws.Int64Value(part.Size)
+			}
+			return true
+		})
+		// The upload may have been completed or aborted since it was
+		// listed, which leaves it without parts.
+		if err != nil && !isNoSuchUpload(err) {
+			return nil, fmt.Errorf("Failed to list the parts of %s: %w", u.Key, err)
+		}
+	}
+
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
+
+// findUploadKey looks up the key of an upload by listing them.
+func findUploadKey(s3session s3iface.S3API, bucket string, uploadID string) (string, error) {
+	uploads, err := listUploads(s3session, bucket, "")
+	if err != nil {
+		return "", err
+	}
+	for _, u := range uploads {
+		if u.UploadID == uploadID {
+			return u.Key, nil
+		}
+	}
+	return "", fmt.Errorf("There's no upload %s, it was completed or aborted already", uploadID)
+}
+
+func formatAge(age time.Duration) string {
+	switch days := int(age.Hours() / 24); {
+	case age < time.Hour:
+		return fmt.Sprintf("%d minutes", int(age.Minutes()))
+	case days < 1:
+		return fmt.Sprintf("%d hours", int(age.Hours()))
+	case days == 1:
+		return "1 day"
+	default:
+		return fmt.Sprintf("%d days", days)
+	}
+}
+
+// resumeHint tells how an upload can be resumed: by running the upload again
+// if this machine has its journal, or with --upload-id otherwise.
+func resumeHint(bucket string, u pendingUpload) string {
+	journal, err := loadJournal(bucket, u.Key)
+	if err == nil && journal != nil && journal.UploadID == u.UploadID {
+		return "resumes when " + journal.Filename + " is uploaded again"
+	}
+	return "resume with --upload-id " + u.UploadID
+}
+
+// ListUploads prints the unfinished multipart uploads under prefix, whose
+// parts are billed until they're completed or aborted.
+func ListUploads(w io.Writer, s3session s3iface.S3API, bucket string, prefix string, now time.Time) error {
+	uploads, err := listUploads(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if len(uploads) == 0 {
+		fmt.Fprintln(w, "No unfinished uploads")
+		return nil
+	}
+
+	var parts int
+	var size int64
+	var cost float64
+	for _, u := range uploads {
+		fmt.Fprintf(w, "%-19s %10s %5d parts %10s  %s\n    upload ID %s, %s\n",
+			showTime(u.Initiated), formatAge(now.Sub(u.Initiated)), u.Parts, showBytes(u.Size), u.Key,
+			u.UploadID, resumeHint(bucket, u))
+		parts += u.Parts
+		size += u.Size
+		cost += u.Cost()
+	}
+	fmt.Fprintf(w, "\nTotal: %d uploads, %d parts, %s, about $%.2f a month\n", len(uploads), parts, showBytes(size), cost)
+	// Only the whole bucket is held to --incomplete-alert.
+	if in := summarizeIncomplete(bucket, uploads, now); prefix == "" && in.Warning != "" {
+		ui.Warnln(in.Warning)
+	}
+	return nil
+}
+
+// ListObjects prints every object under prefix, or only those in
+// storageClass if it isn't empty.
+func ListObjects(w io.Writer, s3session s3iface.S3API, bucket string, prefix string, storageClass string) error {
+	objects, err := listAll(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	var total lsEntry
+	for _, obj := range objects {
+		if storageClass != "" && obj.StorageClass != storageClass {
+			continue
+		}
+		fmt.Fprintln(w, formatLsEntry(lsEntry{Name: obj.Key, Object: obj}, false))
+		total.Objects++
+		total.Object.Size += obj.Size
+	}
+	fmt.Fprintf(w, "\nTotal: %d objects, %s\n", total.Objects, showBytes(total.Object.Size))
+	return nil
+}
+
+func init() {
+	listCmd.PersistentFlags().StringVar(&ListPrefix, "prefix", "", "only list keys starting with this")
+	listCmd.AddCommand(listUploadsCmd)
+	listCmd.AddCommand(listObjectsCmd)
+	rootCmd.AddCommand(listCmd)
+}
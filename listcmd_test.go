@@ -0,0 +1,126 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestListUploads(t *testing.T) {
+	filename := writeTestFile(t, randomData(3*PART_SIZE))
+	fake := interruptedUpload(t, filename)
+
+	now := time.Now()
+	fake.uploads["stray"] = &fakeUpload{key: "old/backup.tar", storageClass: s3.StorageClassDeepArchive,
+		parts: map[int64][]byte{1: make([]byte, 1024), 2: make([]byte, 1024)}, initiated: now.Add(-40 * 24 * time.Hour)}
+	fake.uploads["other"] = &fakeUpload{key: "elsewhere/backup.tar", parts: map[int64][]byte{}, initiated: now}
+
+	var out bytes.Buffer
+	if err := ListUploads(&out, fake, "bucket", "", now); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+
+	for _, want := range []string{
+		"40 days     2 parts    2.0 KiB  old/backup.tar\n    upload ID stray, resume with --upload-id stray\n",
+		"resumes when " + filename + " is uploaded again\n",
+		"Total: 3 uploads, 4 parts, 100.0 MiB, about $",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, "old/backup.tar") > strings.Index(got, "elsewhere/backup.tar") {
+		t.Errorf("uploads aren't oldest first:\n%s", got)
+	}
+
+	out.Reset()
+	if err := ListUploads(&out, fake, "bucket", "old/", now); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "elsewhere") || !strings.Contains(out.String(), "Total: 1 uploads") {
+		t.Errorf("--prefix wasn't applied:\n%s", out.String())
+	}
+}
+
+func TestListUploadsNone(t *testing.T) {
+	var out bytes.Buffer
+	if err := ListUploads(&out, newFakeS3(), "bucket", "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "No unfinished uploads\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestPendingUploadCost(t *testing.T) {
+	archived := pendingUpload{StorageClass: s3.StorageClassDeepArchive, Size: GB}
+	standard := pendingUpload{StorageClass: s3.StorageClassStandard, Size: GB}
+	if archived.Cost() != standard.Cost() {
+		t.Errorf("parts of a DEEP_ARCHIVE upload cost %v, want the STANDARD %v", archived.Cost(), standard.Cost())
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	for age, want := range map[time.Duration]string{
+		5 * time.Minute:      "5 minutes",
+		3 * time.Hour:        "3 hours",
+		30 * time.Hour:       "1 day",
+		9 * 24 * time.Hour:   "9 days",
+		400 * 24 * time.Hour: "400 days",
+	} {
+		if got := formatAge(age); got != want {
+			t.Errorf("formatAge(%v) = %q, want %q", age, got, want)
+		}
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	fake := newFakeS3()
+	for key, class := range map[string]string{
+		"a.tar":          s3.StorageClassDeepArchive,
+		"b/c.tar":        s3.StorageClassDeepArchive,
+		"b/manifest.txt": s3.StorageClassStandard,
+	} {
+		fake.objects[key] = &fakeObject{data: []byte(key), etag: md5Hex([]byte(key)), storageClass: class}
+	}
+
+	var out bytes.Buffer
+	if err := ListObjects(&out, fake, "bucket", "", s3.StorageClassDeepArchive); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "a.tar") || !strings.Contains(got, "b/c.tar") || strings.Contains(got, "manifest") {
+		t.Errorf("wrong objects listed:\n%s", got)
+	}
+	if !strings.Contains(got, "Total: 2 objects, 12 B") {
+		t.Errorf("wrong total:\n%s", got)
+	}
+
+	out.Reset()
+	if err := ListObjects(&out, fake, "bucket", "b/", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Total: 2 objects") || strings.Contains(out.String(), "a.tar") {
+		t.Errorf("--prefix wasn't applied:\n%s", out.String())
+	}
+}
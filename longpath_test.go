@@ -0,0 +1,69 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLongPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		for p, want := range map[string]string{
+			`C:\shares\finance`:       `\\?\C:\shares\finance`,
+			`\\files\finance\2019`:    `\\?\UNC\files\finance\2019`,
+			`\\?\C:\already\extended`: `\\?\C:\already\extended`,
+		} {
+			if got := longPath(p); got != want || shortPath(got) != strings.TrimPrefix(p, `\\?\`) {
+				t.Errorf("%s: got %s and back %s", p, got, shortPath(got))
+			}
+		}
+	}
+
+	// A tree deeper than the 260 characters Windows used to allow.
+	dir := t.TempDir()
+	deep := longPath(dir)
+	for i := 0; i < 10; i++ {
+		deep = filepath.Join(deep, strings.Repeat("d", 40))
+	}
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(deep, "ledger.csv"), []byte("1,2,3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := scanDirectory(longPath(dir), "finance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(files[0].Key, "finance/dddd") || !strings.HasSuffix(files[0].Key, "/ledger.csv") {
+		t.Fatalf("found %+v", files)
+	}
+
+	var archive bytes.Buffer
+	if err := writeTar(&archive, longPath(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractTar(&archive, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath turns p into an extended-length path, \\?\C:\dir or
+// \\?\UNC\server\share\dir, which Windows doesn't limit to 260 characters.
+// The os package does the same for long absolute paths on drives, but not
+// for relative ones or those on shares, and not for what we ask Windows
+// ourselves.  Paths made by joining onto the result are extended-length too,
+// so it's enough to do it to the files and directories we're given.
+func longPath(p string) string {
+	if p == STDIN || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// shortPath is p without what longPath added, for what people read.
+func shortPath(p string) string {
+	if strings.HasPrefix(p, `\\?\UNC\`) {
+		return `\\` + p[len(`\\?\UNC\`):]
+	}
+	return strings.TrimPrefix(p, `\\?\`)
+}
@@ -0,0 +1,121 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// ls flags
+var LsSummarize bool
+
+var lsCmd = &cobra.Command{
+	Use:   "ls [prefix]",
+	Short: "List one level of the bucket, with directories for common prefixes",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var prefix string
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		return Ls(ui.Writer(), newS3Session(Region), BucketName, prefix, LsSummarize)
+	},
+}
+
+// lsEntry is a line of ls output, an object or a directory.  Directories only
+// have a size with --summarize.
+type lsEntry struct {
+	Name    string
+	Dir     bool
+	Objects int64
+	Object  archivedObject
+}
+
+func formatLsEntry(entry lsEntry, summarize bool) string {
+	if entry.Dir {
+		if !summarize {
+			return fmt.Sprintf("%-19s %10s %-19s %s", "", "DIR", "", entry.Name)
+		}
+		return fmt.Sprintf("%-19s %10s %-19s %s (%d objects)", "", showBytes(entry.Object.Size), "", entry.Name, entry.Objects)
+	}
+	return fmt.Sprintf("%-19s %10s %-19s %s",
+		showTime(entry.Object.LastModified), showBytes(entry.Object.Size), entry.Object.StorageClass, entry.Name)
+}
+
+// Ls lists what's directly under prefix.  A prefix that doesn't end in "/"
+// is taken as a directory if that's all it can be, like "photos" for
+// "photos/".
+func Ls(w io.Writer, s3session s3iface.S3API, bucket string, prefix string, summarize bool) error {
+	var entries []lsEntry
+	dirs, err := listShard(s3session, bucket, prefix, func(obj archivedObject) bool {
+		entries = append(entries, lsEntry{Name: obj.Key[len(prefix):], Object: obj})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 && len(dirs) == 1 && dirs[0] == prefix+"/" {
+		return Ls(w, s3session, bucket, prefix+"/", summarize)
+	}
+
+	var total lsEntry
+	for _, entry := range entries {
+		total.Objects++
+		total.Object.Size += entry.Object.Size
+	}
+
+	for _, dir := range dirs {
+		entry := lsEntry{Name: dir[len(prefix):], Dir: true}
+		if summarize {
+			err := walkObjects(s3session, bucket, dir, func(obj archivedObject) error {
+				entry.Objects++
+				entry.Object.Size += obj.Size
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			total.Objects += entry.Objects
+			total.Object.Size += entry.Object.Size
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	for _, entry := range entries {
+		fmt.Fprintln(w, formatLsEntry(entry, summarize))
+	}
+
+	if summarize {
+		fmt.Fprintf(w, "\nTotal: %d objects, %s\n", total.Objects, showBytes(total.Object.Size))
+	}
+	return nil
+}
+
+func init() {
+	lsCmd.Flags().BoolVar(&LsSummarize, "summarize", false, "add up the size of everything under each directory, and in total")
+	rootCmd.AddCommand(lsCmd)
+}
@@ -0,0 +1,56 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLs(t *testing.T) {
+	fake := newFakeS3()
+	fillFake(fake, []string{"photos/2021/a.jpg", "photos/2021/b.jpg", "photos/2022.tar", "photos/2022.tar.parts.json", "mail.mbox"})
+
+	var out bytes.Buffer
+	if err := Ls(&out, fake, "bucket", "", false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " mail.mbox") || !strings.Contains(lines[1], "DIR") || !strings.HasSuffix(lines[1], " photos/") {
+		t.Errorf("got\n%s", out.String())
+	}
+
+	// photos is taken as photos/.
+	out.Reset()
+	if err := Ls(&out, fake, "bucket", "photos", true); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got\n%s", out.String())
+	}
+	if !strings.HasSuffix(lines[0], " 2021/ (2 objects)") || !strings.Contains(lines[0], "34 B") {
+		t.Errorf("the directory is listed as %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " 2022.tar") || !strings.Contains(lines[1], "DEEP_ARCHIVE") {
+		t.Errorf("the object is listed as %q", lines[1])
+	}
+	if lines[4] != "Total: 4 objects, 75 B" {
+		t.Errorf("the total is %q", lines[4])
+	}
+}
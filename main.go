@@ -17,44 +17,161 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/pkg/uploader"
 
-	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const (
-	PART_SIZE = 50 * 1024 * 1024
-	RETRIES   = 2
+	PART_SIZE = uploader.DefaultPartSize
 )
 
 // CLI flags
 var BucketName string
 var Region string
 var UploadID string
+var DestructiveProfile string
+var RestoreProfile string
+var AWSProfile string
+var S3Endpoint string
+var Concurrency int
+var ReadAhead int
 
 var rootCmd = &cobra.Command{
-	Use:   "s3-glacier-uploader file",
+	Use:   "s3-glacier-uploader file|-",
 	Short: "s3-glacier-uploader",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := Upload(BucketName, Region, args[0], UploadID)
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyConfig(cmd); err != nil {
+			return err
+		}
+		if err := checkFormat(); err != nil {
+			return err
+		}
+		if Format == FORMAT_JSON {
+			cmd.SilenceUsage = true
+		}
+		// config show reports what's wrong rather than failing on it, and
+		// config init replaces it.
+		if showsConfig(cmd) {
+			cmd.SilenceUsage = true
+			return nil
+		}
+		metricsCommand = metricsCommandName(cmd)
+		for _, check := range flagChecks(!cmd.HasParent()) {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+		// What fails from here on is the command, not how it was called.
+		cmd.SilenceUsage = true
+		startCommandTimeout()
+		if ProgressSocket != "" {
+			if err := startProgressSocket(ProgressSocket); err != nil {
+				return err
+			}
+		}
+		if err := loadKeys(); err != nil {
+			return err
+		}
+		if err := loadEncryptionSecret(); err != nil {
+			return err
+		}
+		if OTLPEndpoint != "" {
+			startTracing(OTLPEndpoint, cmd.CommandPath())
+		}
+		if DebugAddr != "" {
+			if err := startDebugServer(DebugAddr); err != nil {
+				return err
+			}
+		}
+		if CheckBucket {
+			// The test upload can't be aborted in write-once mode.
+			cleanup, _ := newDestructiveS3Session(Region)
+			if err := checkBucket(ui.Writer(), newS3Session(Region), cleanup, BucketName, Region); err != nil {
+				return err
+			}
+		}
+		if ExpiryRule && expiryCommands[metricsCommand] && !DryRun {
+			if err := installExpiryRule(newS3Session(Region), lazyCleanup(Region), BucketName, expireAfterDays); err != nil {
+				return err
+			}
+		}
+		if WriteOnce {
+			return checkWriteOnce(newS3Session(Region), BucketName)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if DryRun {
+			return EstimateUpload(BucketName, args[0])
+		}
+
+		if VerifyOnly {
+			return VerifyUploaded(BucketName, Region, args[0])
+		}
+
+		var err error
+		if err := checkNetworkCost(args[0]); err != nil {
+			return err
+		}
+
+		if InhibitSleep {
+			release, err := startInhibitingSleep()
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+
+		// The snapshot is released as soon as the upload is done.
+		filename, releaseSnapshot := args[0], func() {}
+		if filename != STDIN && !isRemoteSource(filename) {
+			filename, releaseSnapshot, err = sourceSnapshot(filename)
+			filename = longPath(filename)
+		}
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			return err
+		}
+
+		stopTrapping := trapInterrupts()
+		if filename == STDIN {
+			err = UploadStdin(BucketName, Region)
+		} else if isRemoteSource(filename) {
+			err = UploadRemote(BucketName, Region, filename)
+		} else if ResumeToken != "" {
+			err = ResumeFromToken(Region, filename)
+		} else if Tar {
+			err = UploadTar(BucketName, Region, filename)
+		} else if Recompress != "" {
+			err = UploadRecompressed(BucketName, Region, filename)
+		} else if Nodes > 1 {
+			err = UploadDistributed(BucketName, Region, filename, Nodes, NodeIndex, RunID)
+		} else {
+			err = Upload(BucketName, Region, filename, UploadID)
 		}
+		stopTrapping()
+		releaseSnapshot()
+		reportRetries()
+		return err
 	},
 }
 
@@ -67,167 +184,700 @@ func calculateMd5Digest(input []byte) string {
 	return fmt.Sprintf("%x", md5.Sum(input))
 }
 
-func Upload(bucket string, region string, filename string, uploadID string) error {
-	s3session := s3.New(session.Must(session.NewSession(&aws.Config{
+func newS3Session(region string) s3iface.S3API {
+	return newS3SessionWithProfile(region, AWSProfile)
+}
+
+// newDestructiveS3Session is used for everything that deletes or aborts.  It
+// can be given its own credentials, so that routine uploads run with keys
+// which can't destroy the archive.  In write-once mode there's no such thing.
+func newDestructiveS3Session(region string) (s3iface.S3API, error) {
+	if WriteOnce {
+		return nil, fmt.Errorf("Refusing to delete anything in --write-once mode")
+	}
+	if DestructiveProfile == "" {
+		return newS3Session(region), nil
+	}
+	return newS3SessionWithProfile(region, DestructiveProfile), nil
+}
+
+// newRestoreS3Session is used for restoring and downloading.  It can be given
+// the credentials of another account, e.g. read-only ones kept for disaster
+// recovery, to find out whether those can get the archive back.
+func newRestoreS3Session(region string) s3iface.S3API {
+	profile := AWSProfile
+	if RestoreProfile != "" {
+		profile = RestoreProfile
+	}
+	if RestoreRole != "" {
+		return assumeRestoreRole(newAWSSession(region, profile))
+	}
+	return newS3SessionWithProfile(region, profile)
+}
+
+// cleanupSession hands out the destructive session when an abort or delete
+// actually needs it, so that --write-once only stops what it should.
+type cleanupSession func() (s3iface.S3API, error)
+
+func lazyCleanup(region string) cleanupSession {
+	return func() (s3iface.S3API, error) {
+		return newDestructiveS3Session(region)
+	}
+}
+
+func newS3SessionWithProfile(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API {
+	return s3.New(newAWSSession(region, profile, limiters...))
+}
+
+// newAWSSession is a session with the credentials of profile, and everything
+// the flags say about how to talk to S3.
+func newAWSSession(region string, profile string, limiters ...*bandwidthLimiter) *session.Session {
+	config := &aws.Config{
 		Region: aws.String(region),
-	})))
+	}
+	configureRetries(config)
+	configureEndpoint(config)
+	injectChaos(config)
+	limitBandwidth(config, limiters...)
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	limitRequests(&sess.Handlers)
+	limitKMS(&sess.Handlers)
+	pacePrefixes(&sess.Handlers)
+	traceRequests(&sess.Handlers)
+	auditRequests(&sess.Handlers, s3.New(sess))
+	countTransfers(&sess.Handlers)
+	sess.Handlers.Complete.PushBack(explainStorageClass)
+	sess.Handlers.Complete.PushBack(explainKMSThrottling)
+	return sess
+}
+
+// flagChecks are what's checked about the flags before any command runs.
+// Some flags are the upload's own, other commands have flags of the same
+// name, like --compress, or don't care.
+func flagChecks(upload bool) []func() error {
+	checks := []func() error{
+		checkVariables,
+		checkRetryFlags,
+		checkRequestRate,
+		checkKMSRequestRate,
+		checkBandwidth,
+		checkVSS,
+		checkTempDir,
+		checkInMemory,
+		checkDNSRefresh,
+		checkEndpoint,
+		checkRestoreRole,
+		checkCaseCollisionFlags,
+		checkOperatorFlags,
+		checkShardPrefix,
+		checkTimeouts,
+	}
+	if upload {
+		checks = append(checks, checkTarFlags, checkRecompressFlags, checkAbortFlags, checkKeyFlags, checkSplitFlags, checkUploadSpace)
+	}
+	checks = append(checks, checkPartSize)
+	if upload {
+		checks = append(checks, checkResumeToken)
+	}
+	return append(checks,
+		checkSnapshotFlags,
+		checkDeadline,
+		checkPreviewFlags,
+		checkPreservationFlags,
+		checkCompletionRecord,
+		func() error {
+			if ListConcurrency < 1 {
+				return fmt.Errorf("--list-concurrency must be at least 1")
+			}
+			if StaleReadRetries < 0 {
+				return fmt.Errorf("--stale-read-retries can't be negative")
+			}
+			if ScanWorkers < 1 {
+				return fmt.Errorf("--scan-workers must be at least 1")
+			}
+			if Concurrency < 1 {
+				return fmt.Errorf("--concurrency must be at least 1")
+			}
+			if ReadAhead < 0 {
+				return fmt.Errorf("--read-ahead can't be negative")
+			}
+			return nil
+		},
+		checkTags,
+		checkExpiryFlags,
+		checkRetainFlags,
+		checkOutputFlags,
+		checkIncompleteAlert,
+		func() error {
+			_, err := metadataFlags()
+			return err
+		},
+		checkStorageClass,
+		checkExpeditedFlags,
+		checkChecksumAlgorithm,
+		checkSSEFlags,
+		checkChaos,
+	)
+}
+
+// flagAliases are other names flags go by, e.g. the ones curl and rsync use.
+var flagAliases = map[string]string{
+	"limit-rate": "bandwidth",
+	"tags":       "tag",
+}
 
-	key := path.Base(filename)
+// normalizeFlagName turns an alias into the name of the flag it stands for.
+func normalizeFlagName(f *pflag.FlagSet, name string) pflag.NormalizedName {
+	if alias, ok := flagAliases[name]; ok {
+		name = alias
+	}
+	return pflag.NormalizedName(name)
+}
 
-	file, err := os.Open(filename)
+// stateDir is where we keep the files which have to survive between runs.
+func stateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "s3-glacier-uploader")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+func Upload(bucket string, region string, filename string, uploadID string) error {
+	err := uploadFile(newS3Session(region), lazyCleanup(region), bucket, filename, uploadID)
+
+	var unfinished *unfinishedUploadError
+	if interrupted() && errors.As(err, &unfinished) {
+		return stopInterrupted(lazyCleanup(region), bucket, filename, unfinished)
+	}
+	if AbortOnFailure && errors.As(err, &unfinished) {
+		cleanup, cleanupErr := newDestructiveS3Session(region)
+		if cleanupErr != nil {
+			return fmt.Errorf("%w; %v", err, cleanupErr)
+		}
+		return abortUnfinished(cleanup, bucket, unfinished)
+	}
+	return err
+}
+
+func uploadFile(s3session s3iface.S3API, cleanup cleanupSession, bucket string, filename string, uploadID string) (err error) {
+	include, err := includeFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if !include {
+		ui.Println("Skipping", filename)
+		return nil
+	}
 
-	stat, err := file.Stat()
+	key, err := uploadKey(filename)
 	if err != nil {
 		return err
 	}
-	fileSize := stat.Size()
 
-	approximateChunkCount := (fileSize / PART_SIZE) + 1
+	if splitBytes > 0 {
+		if info, err := os.Stat(filename); err == nil && !info.IsDir() && info.Size() > splitBytes {
+			return uploadSplitFile(s3session, cleanup, bucket, filename, key, info.Size())
+		}
+	}
 
-	fmt.Println("File to upload:", filename)
+	return uploadObject(s3session, cleanup, bucket, filename, key, uploadID)
+}
 
-	if uploadID != "" {
-		return fmt.Errorf("We can't resume uploads yet.  It's on the roadmap.")
+// uploadObject uploads filename to key, with everything it takes: the part
+// manifest, the preview, progress reports and so on.
+func uploadObject(s3session s3iface.S3API, cleanup cleanupSession, bucket string, filename string, key string, uploadID string) (err error) {
+	metadata, err := uploadMetadata(filename)
+	if err != nil {
+		return err
 	}
+	metadata = linkPreview(key, metadata)
 
-	createdResp, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
-		Bucket:       aws.String(bucket),
-		Key:          aws.String(key),
-		StorageClass: aws.String(s3.ObjectStorageClassDeepArchive),
-	})
+	ctx, span := startSpan(interrupt, "upload", SPAN_KIND_INTERNAL, "file", filename, "key", key)
+	defer func() { span.End(err) }()
 
+	file, err := openSource(filename)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	fmt.Println("Upload ID:", *createdResp.UploadId)
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory, upload it as one archive with --tar, or file by file with sync", filename)
+	}
 
-	var partNum = 1
-	var completedParts []*s3.CompletedPart
+	if ValidateArchive {
+		checked, err := validateArchive(filename)
+		if err != nil {
+			return err
+		}
+		if checked != "" {
+			ui.Printf("%s is intact (%s)\n", filename, checked)
+		}
+	}
+	fileSize := stat.Size()
+	metadata = sourceMetadata(metadata, stat)
 
-	buffer := make([]byte, PART_SIZE)
-	reader := bufio.NewReader(file)
+	// Running the same upload again only has to read the file.
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return err
+	}
+	if !Force && alreadyUploaded(s3session, bucket, key, stat, sum) {
+		ui.Printf("%s is already uploaded to %s, skipping it\n", filename, key)
+		return nil
+	}
+	metadata[SOURCE_METADATA_SHA256] = aws.String(sum)
+
+	// Parts are cut from the encrypted file, so everything below counts
+	// its bytes.
+	var source io.Reader = file
+	var digest *fileDigest
+	if preservationTemplate != nil {
+		digest = newFileDigest()
+		source = io.TeeReader(file, digest)
+	}
+	var plain hash.Hash
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		metadata = encryptionMetadata(metadata, c)
+		plain = sha256.New()
+		source = encryptReader(io.TeeReader(source, plain), c)
+		fileSize = encryptedSize(fileSize)
+	}
 
-	// When an object is uploaded as a multipart upload, the ETag for the object is
-	// not an MD5 digest of the entire object. Amazon S3 calculates the MD5 digest
-	// of each individual part as it is uploaded. The MD5 digests are used to
-	// determine the ETag for the final object. Amazon S3 concatenates the bytes for
-	// the MD5 digests together and then calculates the MD5 digest of these
-	// concatenated values. The final step for creating the ETag is when Amazon S3
-	// adds a dash with the total number of parts to the end.
-	//
-	// https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html
-	digestBytes := []byte{}
+	partSize, err := filePartSize(fileSize)
+	if err != nil {
+		return err
+	}
 
-	bar := progressbar.Default(int64(approximateChunkCount))
+	// When re-uploading a changed version of a file, parts which haven't
+	// changed are copied from the previous upload on the server side.
+	// That takes parts of the same size, which automatic ones follow.
+	var base *partManifest
+	if BaseKey != "" {
+		base, err = loadPartManifest(s3session, bucket, BaseKey)
+		if err != nil {
+			return err
+		}
 
-	for {
-		n, err := reader.Read(buffer)
+		if base.PartSize != int64(partSize) {
+			if PartSize != PART_SIZE_AUTO || checkPartCount(fileSize, base.PartSize) != nil {
+				return fmt.Errorf("%s was uploaded in %d byte parts, we use %d", BaseKey, base.PartSize, partSize)
+			}
+			partSize = int(base.PartSize)
+		}
 
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(BaseKey),
+		})
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("Failed to read a chunk: %w", err)
+			return err
 		}
 
-		// If we've read less than the chunk size, truncate the buffer.
-		if n < PART_SIZE {
-			buffer = buffer[:n]
+		// Archived objects can't be the source of a copy.
+		if err := checkRestored(BaseKey, head); err != nil {
+			return err
 		}
 
-		db := md5.Sum(buffer)
-		for _, b := range db {
-			digestBytes = append(digestBytes, b)
+		// If the base has been overwritten since, the digests in the
+		// manifest describe data which isn't there any more.
+		if etag := strings.Trim(*head.ETag, "\""); etag != base.ETag {
+			return fmt.Errorf("%s has changed since its part manifest was written (ETag %s, manifest %s)", BaseKey, etag, base.ETag)
 		}
+	}
 
-		result := uploadToS3(s3session, createdResp, buffer, partNum)
+	metadata = partSizeMetadata(metadata, int64(partSize))
+	file.SetPartSize(int64(partSize))
+	approximateChunkCount := (fileSize / int64(partSize)) + 1
 
-		if result.err != nil {
-			return fmt.Errorf("Upload not aborted.  You can resume it.  Not implemented yet.  Error: %w", result.err)
-		}
+	progress.Start(filename, key, fileSize, (fileSize+int64(partSize)-1)/int64(partSize))
+	defer func() { progress.Finish(err) }()
 
-		completedParts = append(completedParts, result.completedPart)
-		partNum++
+	ui.Println("File to upload:", filename)
 
-		bar.Add(1)
+	// An upload which was interrupted is picked up where it stopped: parts
+	// S3 already has are checked against the file and only the rest is
+	// sent.  Without --upload-id, we look for it in the journal.
+	journaled := false
+	if uploadID == "" {
+		uploadID, err = journaledUpload(cleanup, bucket, key, stat, partSize)
+		if err != nil {
+			return err
+		}
+		journaled = uploadID != ""
 	}
 
-	etag := fmt.Sprintf("%s-%d", calculateMd5Digest(digestBytes), partNum-1)
+	reporter := &uploadReporter{
+		bucket:   bucket,
+		key:      key,
+		filename: filename,
+		stat:     stat,
+		partSize: partSize,
+		bar:      ui.Bar(int64(approximateChunkCount), ""),
+		eta:      newETATracker(bucket, fileSize),
+	}
+	opts := []uploader.Option{
+		uploader.WithPartSize(int64(partSize)),
+		uploader.WithConcurrency(Concurrency),
+		uploader.WithReadAhead(ReadAhead),
+		uploader.WithStorageClass(aws.StringValue(uploadStorageClass())),
+		uploader.WithMetadata(aws.StringValueMap(metadata)),
+		uploader.WithTagging(aws.StringValue(objectTagging(key))),
+		uploader.WithEvents(reporter),
+		uploader.WithVerify(func(resp *s3.CompleteMultipartUploadOutput, etag string, parts []*s3.CompletedPart) error {
+			return verifyCompleted(resp, etag, parts, fmt.Errorf("The uploaded object doesn't match %s", filename))
+		}),
+	}
+	if base != nil {
+		opts = append(opts, uploader.WithBase(&uploader.Base{
+			Key:      BaseKey,
+			ETag:     base.ETag,
+			Size:     base.Size,
+			PartSize: base.PartSize,
+			Parts:    base.Parts,
+		}))
+	}
+	u := newUploader(s3session, opts...)
 
-	// Signalling AWS S3 that the multiPartUpload is finished
-	resp, err := s3session.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
-		Bucket:   createdResp.Bucket,
-		Key:      createdResp.Key,
-		UploadId: createdResp.UploadId,
-		MultipartUpload: &s3.CompletedMultipartUpload{
-			Parts: completedParts,
-		},
-	})
+	var result *uploader.Result
+	var failed *uploader.Error
+	if uploadID != "" {
+		ui.Println("Resuming the upload", uploadID)
+		result, err = u.Resume(ctx, bucket, key, uploadID, source, fileSize)
+		// Resume hasn't read anything of the file unless it failed with
+		// an uploader.Error.
+		if journaled && isNoSuchUpload(err) && !errors.As(err, &failed) {
+			ui.Printf("The interrupted upload %s is gone, starting over\n", uploadID)
+			uploadID = ""
+		}
+	}
+	if uploadID == "" {
+		result, err = u.Upload(ctx, bucket, key, source, fileSize)
+	}
 
+	var otherSize *uploader.PartSizeError
+	if errors.As(err, &otherSize) {
+		return fmt.Errorf("%w, resume it with --part-size %d", err, otherSize.PartSize)
+	}
+	if errors.As(err, &failed) {
+		return &unfinishedUploadError{Key: key, UploadID: failed.UploadID, Token: reporter.token, Err: failed.Err}
+	}
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Success!")
-	respEtag := strings.Trim(*resp.ETag, "\"")
+	if reporter.journal != nil {
+		if err := reporter.journal.Remove(); err != nil {
+			ui.Warnln("Failed to remove the upload journal:", err)
+		}
+	}
 
-	if respEtag == etag {
-		fmt.Println("Etags match!")
-	} else {
-		fmt.Println("Etags don't match!")
-		fmt.Println("  AWS: ", respEtag)
-		fmt.Println("  Ours:", etag)
+	ui.Println("Success!")
+	reporter.eta.Record(bucket, key)
+
+	if base != nil {
+		ui.Printf("Copied %d of %d parts from %s\n", result.Copied, result.Parts, BaseKey)
+	}
+	if uploadID != "" {
+		ui.Printf("Resumed %d of %d parts\n", result.Resumed, result.Parts)
+	}
+
+	if PartManifest || base != nil {
+		m := &partManifest{
+			Key:          key,
+			Size:         result.Size,
+			PartSize:     int64(partSize),
+			ETag:         result.ETag,
+			Parts:        result.PartDigests,
+			UnshardedKey: unshardKey(key),
+		}
+		if plain != nil {
+			m.PlainSHA256 = hex.EncodeToString(plain.Sum(nil))
+		}
+		if err := savePartManifest(s3session, bucket, m); err != nil {
+			return fmt.Errorf("Failed to save the part manifest: %w", err)
+		}
+	}
+
+	if err := uploadPreview(s3session, bucket, key, filename); err != nil {
+		return err
+	}
+	if err := uploadPreservation(s3session, bucket, key, filename, stat, digest, result.ETag, result.UploadID); err != nil {
+		return err
+	}
+
+	keyID, _ := metadataValue(metadata, ENCRYPTION_KEY_ID_METADATA)
+	entry := catalogEntry{
+		Bucket:          bucket,
+		Key:             key,
+		Path:            shortPath(filename),
+		Size:            result.Size,
+		SHA256:          sum,
+		ETag:            result.ETag,
+		EncryptionKeyID: keyID,
+		SSE:             result.ServerSideEncryption,
+		KMSKeyID:        result.SSEKMSKeyID,
+	}
+	recordUpload(entry)
+	if err := uploadCompletionRecord(s3session, entry, result.UploadID); err != nil {
+		return err
 	}
 
-	fmt.Println(*resp.Location)
+	ui.Println(result.Location)
+	ui.Event(uploadDoneEvent{
+		Event:             "upload_done",
+		Bucket:            bucket,
+		Key:               key,
+		UploadID:          result.UploadID,
+		Location:          result.Location,
+		ETag:              strings.Trim(result.ETag, "\""),
+		Size:              result.Size,
+		ChecksumAlgorithm: ChecksumAlgorithm,
+		Verified:          VerifyUpload != VERIFY_NONE,
+	})
 
 	return nil
 }
 
-func uploadToS3(s3session *s3.S3, resp *s3.CreateMultipartUploadOutput, fileBytes []byte, partNum int) partUploadResult {
-	var try int
-	for try <= RETRIES {
-		uploadRes, err := s3session.UploadPart(&s3.UploadPartInput{
-			Body:          bytes.NewReader(fileBytes),
-			Bucket:        resp.Bucket,
-			Key:           resp.Key,
-			PartNumber:    aws.Int64(int64(partNum)),
-			UploadId:      resp.UploadId,
-			ContentLength: aws.Int64(int64(len(fileBytes))),
-		})
+// uploadReporter shows how an upload of a file goes, on the progress bar and
+// socket and as events, and keeps its journal and resume token up to date.
+type uploadReporter struct {
+	bucket   string
+	key      string
+	filename string
+	stat     os.FileInfo
+	partSize int
+	bar      progressBar
+	eta      *etaTracker
+
+	// mu protects what the parts report.
+	mu      sync.Mutex
+	token   resumeToken
+	journal *uploadJournal
+}
 
-		if err != nil {
-			fmt.Println(err)
-			if try == RETRIES {
-				return partUploadResult{nil, err}
-			} else {
-				try++
-				time.Sleep(time.Duration(time.Second * 15))
-			}
-		} else {
-			return partUploadResult{
-				&s3.CompletedPart{
-					ETag:       uploadRes.ETag,
-					PartNumber: aws.Int64(int64(partNum)),
-				}, nil,
-			}
+func (r *uploadReporter) OnStart(uploadID string, parts int, size int64) {
+	ui.Println("Upload ID:", uploadID)
+	ui.Event(uploadStartedEvent{Event: "upload_started", Bucket: r.bucket, Key: r.key, UploadID: uploadID, Parts: parts, Size: size})
+	progress.Uploading(uploadID)
+
+	r.token = resumeToken{Bucket: r.bucket, Key: r.key, UploadID: uploadID, PartSize: int64(r.partSize)}
+	ui.Println("Resume token:", r.token)
+
+	// Losing the journal only costs the automatic resume, so it doesn't
+	// stop the upload.
+	journal, err := newJournal(r.bucket, r.key, r.filename, uploadID, r.stat, r.partSize)
+	if err == nil {
+		err = journal.Save()
+	}
+	if err != nil {
+		ui.Warnln("Failed to write the upload journal:", err)
+		journal = nil
+	}
+	r.journal = journal
+}
+
+func (r *uploadReporter) OnPartStart(part uploader.Part) {}
+
+func (r *uploadReporter) OnPartDone(part uploader.Part) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.token.Done += part.Size
+
+	if r.journal != nil {
+		if err := r.journal.Record(part.Completed, part.Offset, int(part.Size)); err != nil {
+			ui.Warnln("Failed to update the upload journal:", err)
+			r.journal = nil
 		}
 	}
 
-	return partUploadResult{}
+	var finish time.Time
+	if part.Source == uploader.PartSent {
+		finish = r.eta.Sent(int(part.Size))
+	} else {
+		finish = r.eta.Copied(int(part.Size))
+	}
+
+	ui.Event(partDoneEvent{
+		Event:  "part_done",
+		Part:   part.Number,
+		ETag:   strings.Trim(aws.StringValue(part.Completed.ETag), "\""),
+		Offset: part.Offset,
+		Size:   part.Size,
+		Source: partSources[part.Source],
+	})
+	r.bar.Add(1)
+	progress.Part(int(part.Size), finish)
+}
+
+// OnRetry leaves telling why to newUploader's failure hook, which the other
+// uploads share.
+func (r *uploadReporter) OnRetry(number int, err error, stalled bool) {
+	ui.Event(partRetryEvent{Event: "part_retry", Part: number, Error: err.Error(), Stalled: stalled})
+}
+
+func (r *uploadReporter) OnComplete(result *uploader.Result, err error) {}
+
+var partSources = map[uploader.PartSource]string{
+	uploader.PartSent:    "sent",
+	uploader.PartResumed: "resumed",
+	uploader.PartCopied:  "copied",
+}
+
+// newUploader makes an uploader which retries parts as the flags say.  It
+// has a circuit breaker of its own, so make one per upload.
+func newUploader(s3session s3iface.S3API, opts ...uploader.Option) *uploader.Uploader {
+	return uploader.New(s3session, append([]uploader.Option{
+		uploader.WithRetries(partRetries(), retryDelay),
+		uploader.WithStallTimeout(StallTimeout, MaxAttempts-1),
+		uploader.WithSpeedFloor(minPartSpeed*int64(MinPartSpeedWindow/time.Second), MinPartSpeedWindow),
+		uploader.WithChecksum(ChecksumAlgorithm),
+		uploader.WithServerSideEncryption(SSE, SSEKMSKeyID),
+		uploader.WithCircuitBreaker(uploader.NewCircuitBreaker()),
+		uploader.WithTracer(traceUpload),
+		uploader.WithFailureHook(func(part int, err error, stalled bool) bool {
+			ui.Println(err)
+			if stalled {
+				ui.Printf("Part %d stalled, sending it again on a new connection\n", part)
+			}
+			return isNetworkError(err) && waitForNetwork(s3Endpoint(s3session), NETWORK_POLL_INTERVAL, WaitForNetwork)
+		}),
+	}, opts...)...)
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&BucketName, "bucket", "", "")
 	rootCmd.PersistentFlags().StringVar(&Region, "region", "us-east-1", "")
-	rootCmd.PersistentFlags().StringVar(&UploadID, "upload-id", "", "")
+	rootCmd.PersistentFlags().StringVar(&UploadID, "upload-id", "", "resume this interrupted upload")
+	rootCmd.PersistentFlags().BoolVar(&NoResume, "no-resume", false, "start over instead of resuming an interrupted upload of the file")
+	rootCmd.PersistentFlags().StringVar(&S3Endpoint, "endpoint-url", "", "talk to this S3 compatible endpoint instead of AWS, e.g. http://localhost:4566")
+	rootCmd.PersistentFlags().BoolVar(&ForcePathStyle, "force-path-style", false, "put the bucket in the path rather than the host name, for S3 compatible servers that need it")
+	rootCmd.PersistentFlags().BoolVar(&NoVerifySSL, "no-verify-ssl", false, "don't verify TLS certificates, e.g. of a MinIO server with a self-signed one")
+	rootCmd.PersistentFlags().DurationVar(&DNSRefresh, "dns-refresh", 5*time.Minute, "close idle connections this often, so new ones look S3 up again (0 to keep them)")
+	rootCmd.PersistentFlags().StringVar(&StorageClass, "storage-class", s3.StorageClassDeepArchive, "storage class to upload to, e.g. INTELLIGENT_TIERING")
+	rootCmd.PersistentFlags().BoolVar(&WriteOnce, "write-once", false, "require Object Lock in compliance mode and never delete anything")
+	rootCmd.PersistentFlags().StringVar(&DestructiveProfile, "destructive-profile", "", "AWS profile to use for deleting and aborting")
+	rootCmd.PersistentFlags().StringVar(&RestoreProfile, "restore-profile", "", "AWS profile to use for restoring and downloading, e.g. a read-only one of a disaster recovery account")
+	rootCmd.PersistentFlags().BoolVar(&PartManifest, "part-manifest", false, "store the digest of every part next to the archive")
+	rootCmd.PersistentFlags().BoolVar(&Force, "force", false, "upload files even if their object has the same content already")
+	rootCmd.PersistentFlags().StringVar(&BaseKey, "base", "", "copy unchanged parts from this earlier upload of the file")
+	rootCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts to upload in parallel")
+	rootCmd.Flags().IntVar(&ReadAhead, "read-ahead", uploader.DefaultReadAhead, "number of parts to read and hash ahead of those being uploaded")
+	rootCmd.Flags().BoolVar(&Tar, "tar", false, "upload a directory as a tar archive, streamed without a temporary file")
+	rootCmd.Flags().BoolVar(&BagIt, "bagit", false, "with --tar, package the directory as a BagIt bag, with SHA-256 manifests")
+	rootCmd.Flags().BoolVar(&TarXattrs, "xattrs", false, "with --tar, archive extended attributes, POSIX ACLs and SELinux contexts too (Linux only)")
+	rootCmd.Flags().BoolVar(&TarWindowsACLs, "windows-acls", false, "with --tar, archive the owners and ACLs of the files too (Windows only)")
+	rootCmd.Flags().BoolVar(&Reproducible, "reproducible", false, "with --tar, archive unchanged files byte for byte the same every time: no owners, times from SOURCE_DATE_EPOCH")
+	rootCmd.Flags().BoolVar(&Seekable, "seekable", false, "with --tar --compress zstd, start every part with a zstd frame and store an index of the frames, for any part of the archive to be decompressed without the rest")
+	rootCmd.Flags().StringVar(&Compress, "compress", "", "compress the --tar archive: gzip or zstd (needs the zstd program)")
+	rootCmd.Flags().StringVar(&Recompress, "recompress", "", "decompress gzip files and upload them compressed with zstd instead")
+	rootCmd.PersistentFlags().StringVar(&ConfigFile, "config", "", "read settings from this file instead of ~/.config/s3-glacier-uploader/config")
+	rootCmd.PersistentFlags().StringVar(&ConfigProfile, "profile", "", "use the settings of this profile of the config file as well")
+	rootCmd.PersistentFlags().StringVar(&AWSProfile, "aws-profile", "", "AWS profile with the credentials to use, instead of $AWS_PROFILE or the default one")
+	rootCmd.PersistentFlags().StringVar(&Format, "format", FORMAT_HUMAN, "how to print output: human (with progress bars), plain (for logs) or json (one object per line)")
+	rootCmd.PersistentFlags().StringVar(&Bandwidth, "bandwidth", "", "send or receive at most this much a second to and from S3, e.g. 2M or 2MB/s")
+	rootCmd.PersistentFlags().IntVar(&ShardPrefix, "shard-prefix", 0, "spread keys over this many sub-prefixes named after their hash, for millions of objects")
+	rootCmd.PersistentFlags().IntVar(&ListConcurrency, "list-concurrency", 8, "number of parallel listings of large buckets")
+	rootCmd.PersistentFlags().IntVar(&ScanWorkers, "scan-workers", 8, "number of directories read at the same time when scanning a tree")
+	rootCmd.PersistentFlags().StringVar(&CaseCollisions, "case-collisions", CASE_COLLISIONS_WARN, "what to do about files whose keys only differ by case, which collide restored to Windows or macOS: warn, skip or error")
+	rootCmd.PersistentFlags().BoolVar(&SkipSnapshotDirs, "skip-snapshot-dirs", false, "leave out .snapshot, .snapshots and .zfs directories of the trees uploaded")
+	rootCmd.PersistentFlags().StringVar(&ExpireAfter, "expire-after", "", "tag uploaded objects as temporary, to be deleted this long after upload, e.g. 180d")
+	rootCmd.PersistentFlags().BoolVar(&ExpiryRule, "expiry-rule", false, "with --expire-after, add a lifecycle rule to the bucket which deletes the tagged objects")
+	rootCmd.PersistentFlags().StringArrayVar(&Tags, "tag", nil, "cost allocation tag for uploaded objects, key=value; {set}, {run} and the other variables in the value are expanded (can be repeated)")
+	rootCmd.PersistentFlags().StringVar(&PreviewSize, "preview-size", "", "also upload the first this many bytes to STANDARD as a preview, e.g. 10M")
+	rootCmd.PersistentFlags().StringVar(&PreviewCommand, "preview-command", "", "program printing a preview of the file to upload to STANDARD")
+	rootCmd.PersistentFlags().StringVar(&PreservationMetadata, "preservation-metadata", "", "upload preservation metadata next to every file: mets, or a template file of your own")
+	rootCmd.PersistentFlags().BoolVar(&CompletionRecord, "completion-record", false, "upload a completion record next to every archive, signed with --signing-key: what was archived, when and by whom")
+	rootCmd.PersistentFlags().StringVar(&VerifyUpload, "verify", VERIFY_MD5, "how to check uploads once S3 put them together: md5 (the ETag), sha256 (S3's SHA-256 checksums, also for SSE-KMS) or none")
+	rootCmd.PersistentFlags().StringVar(&ChecksumAlgorithm, "checksum-algorithm", "", "also have S3 store this checksum of every part (SHA256), needed to verify SSE-KMS objects")
+	rootCmd.Flags().BoolVar(&AbortOnFailure, "abort-on-failure", false, "abort a failed upload instead of keeping its parts to resume it")
+	rootCmd.Flags().BoolVar(&AbortOnInterrupt, "abort-on-interrupt", false, "abort the upload when stopped with Ctrl-C, deleting its parts, instead of leaving it to be resumed")
+	rootCmd.Flags().StringVar(&ResumeToken, "resume-token", "", "resume the upload a failed run printed the token of")
+	rootCmd.PersistentFlags().StringVar(&PartSize, "part-size", PART_SIZE_AUTO, "size of the uploaded parts, e.g. 128M, or auto: 50 MiB, larger for files which wouldn't fit in 10,000 of those")
+	rootCmd.PersistentFlags().BoolVar(&ValidateArchive, "validate-archive", false, "read tar, gzip and zstd files in full before uploading them, refusing damaged ones")
+	rootCmd.PersistentFlags().BoolVar(&Encrypt, "encrypt", false, "encrypt files before uploading them (AES-256-GCM)")
+	rootCmd.PersistentFlags().StringVar(&EncryptionKeyFile, "encryption-key-file", "", "file holding the secret to encrypt and decrypt with, at least 32 random bytes")
+	rootCmd.PersistentFlags().StringVar(&PassphraseFile, "passphrase-file", "", "file whose first line is the passphrase to encrypt and decrypt with")
+	rootCmd.PersistentFlags().StringVar(&SigningKey, "signing-key", "", "sign manifests with this ed25519 private key")
+	rootCmd.PersistentFlags().StringVar(&VerifyKey, "verify-key", "", "require manifests to be signed by this ed25519 public key")
+	rootCmd.PersistentFlags().IntVar(&Nodes, "nodes", 1, "number of hosts sharing the upload of this file")
+	rootCmd.PersistentFlags().IntVar(&NodeIndex, "node", 0, "which of the --nodes hosts this is, starting at 0")
+	rootCmd.PersistentFlags().StringVar(&RunID, "run-id", "", "name of this distributed upload, the same on all nodes")
+	rootCmd.PersistentFlags().StringVar(&RetryMode, "retry-mode", RETRY_MODE_SDK, "who retries failed requests: sdk (exponential backoff) or tool (resend the part, with the same backoff)")
+	rootCmd.PersistentFlags().IntVar(&MaxAttempts, "max-attempts", 5, "maximum number of attempts for each request")
+	rootCmd.PersistentFlags().IntVar(&MaxRetries, "max-retries", -1, "maximum number of retries of each request, instead of --max-attempts")
+	rootCmd.PersistentFlags().DurationVar(&RetryBackoff, "retry-backoff", RETRY_MIN_DELAY, "pause before the first retry, doubled with every one after it")
+	rootCmd.PersistentFlags().DurationVar(&StallTimeout, "stall-timeout", 2*time.Minute, "retry a part when no data has been sent for this long (0 to disable)")
+	rootCmd.PersistentFlags().StringVar(&MinPartSpeed, "min-part-speed", "", "retry a part on a new connection when it's sent slower than this, e.g. 100K/s")
+	rootCmd.PersistentFlags().DurationVar(&MinPartSpeedWindow, "min-part-speed-window", time.Minute, "how long a part may be slower than --min-part-speed")
+	rootCmd.PersistentFlags().DurationVar(&WaitTimeout, "wait-timeout", 0, "give up waiting for restores and other nodes after this long, exiting with 124 (0 to wait as long as it takes)")
+	rootCmd.PersistentFlags().DurationVar(&CommandTimeout, "command-timeout", 0, "end the command after this long, exiting with 124 (0 for no limit)")
+	rootCmd.PersistentFlags().DurationVar(&WaitForNetwork, "wait-for-network", 12*time.Hour, "pause this long at most when S3 can't be reached (0 to fail right away)")
+	rootCmd.PersistentFlags().DurationVar(&RequestTimeout, "request-timeout", 0, "give up on a single request after this long (0 for no limit)")
+	rootCmd.PersistentFlags().Float64Var(&MaxRestoreCost, "max-restore-cost", 100, "refuse restores and downloads estimated to cost more dollars than this (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&ExpeditedUnavailable, "expedited-unavailable", EXPEDITED_STANDARD, "when there's no Expedited retrieval capacity: standard (use the Standard tier), wait (try again with backoff) or fail")
+	rootCmd.PersistentFlags().DurationVar(&ExpeditedWait, "expedited-wait", time.Hour, "how long --expedited-unavailable wait keeps trying")
+	rootCmd.PersistentFlags().StringVar(&RequestRate, "request-rate", "", "send at most this many S3 requests, e.g. 10/s or 300/m")
+	rootCmd.PersistentFlags().StringVar(&KMSRequestRate, "kms-request-rate", "", "send requests S3 needs KMS for (with SSE-KMS) at most this often, e.g. 50/s; KMS throttling slows them down further")
+	rootCmd.PersistentFlags().Float64Var(&Chaos, "chaos", 0, "for testing: break this fraction of requests on purpose, e.g. 0.1")
+	rootCmd.PersistentFlags().Int64Var(&ChaosSeed, "chaos-seed", 0, "seed for --chaos, to repeat a run")
+	rootCmd.PersistentFlags().StringVar(&KeyCommand, "key-command", "", "program printing the key to upload a file to")
+	rootCmd.PersistentFlags().StringVar(&FilterCommand, "filter-command", "", "program deciding whether to upload a file (exit 0) or skip it (exit 1)")
+	rootCmd.PersistentFlags().StringVar(&MetadataCommand, "metadata-command", "", "program printing a JSON object of metadata to store with a file")
+	rootCmd.PersistentFlags().StringArrayVar(&Metadata, "metadata", nil, "metadata to store with uploaded objects, key=value, with variables like {hostname} expanded (can be repeated)")
+	rootCmd.Flags().StringVar(&SplitSize, "split-size", "", "upload files and streams larger than this as several objects of this size, e.g. 4T, with a manifest to put them back together")
+	rootCmd.Flags().StringVar(&ObjectKey, "key", "", "upload to this key instead of the file's name")
+	rootCmd.Flags().StringVar(&KeyPrefix, "prefix", "", "put this in front of the key, e.g. {hostname}/")
+	rootCmd.PersistentFlags().BoolVar(&RefuseOnMetered, "refuse-on-metered", false, "don't upload when the OS says the connection is metered")
+	rootCmd.PersistentFlags().StringVar(&ConfirmOver, "confirm-over", "", "ask before uploading files larger than this, e.g. 10G")
+	rootCmd.PersistentFlags().StringVar(&Deadline, "deadline", "", "warn if the upload won't be done by then, e.g. 06:00 or 4h")
+	rootCmd.PersistentFlags().BoolVar(&VSS, "vss", false, "on Windows, upload from a Volume Shadow Copy so that open files are consistent")
+	rootCmd.PersistentFlags().StringVar(&Snapshot, "snapshot", "", "upload from a snapshot of the file system: zfs, btrfs, lvm or command")
+	rootCmd.PersistentFlags().StringVar(&SnapshotCommand, "snapshot-command", "", "program taking a snapshot of the source and printing where the source is in it")
+	rootCmd.PersistentFlags().StringVar(&SnapshotReleaseCommand, "snapshot-release-command", "", "program removing the snapshot, given what --snapshot-command printed")
+	rootCmd.PersistentFlags().StringVar(&SnapshotSize, "snapshot-size", "10G", "how much the LVM volume may change before the snapshot is invalid")
+	rootCmd.PersistentFlags().BoolVar(&InhibitSleep, "inhibit-sleep", false, "keep the machine from going to sleep during the upload")
+	rootCmd.PersistentFlags().StringVar(&ProgressSocket, "progress-socket", "", "publish progress as JSON lines on this Unix socket")
+	rootCmd.PersistentFlags().StringVar(&OTLPEndpoint, "otlp-endpoint", "", "send traces to this OpenTelemetry collector, e.g. http://localhost:4318")
+	rootCmd.SetGlobalNormalizationFunc(normalizeFlagName)
+	rootCmd.PersistentFlags().StringVar(&DebugAddr, "debug-addr", "", "serve pprof and runtime stats on this address, e.g. localhost:6060")
 }
 
+// main is where every command ends: commands return their error, which exit
+// reports.
 func main() {
-	rootCmd.Execute()
+	// Cobra's own error messages aren't JSON, so exit prints them too.
+	rootCmd.SilenceErrors = true
+	exit(rootCmd.Execute())
+}
+
+// exit reports err, in JSON with --format json, writes what's left of the
+// command's output and exits with the code telling what went wrong.
+func exit(err error) {
+	if err != nil {
+		ui.Error(err)
+	}
+	summarizeWarnings()
+	stopProgressSocket()
+	stopTracing()
+	writeMetrics(err == nil)
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
 }
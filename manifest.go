@@ -0,0 +1,196 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var PartManifest bool
+var BaseKey string
+
+const PART_MANIFEST_SUFFIX = ".parts.json"
+
+// partManifest records the MD5 digest of every part of an upload.  It's stored
+// next to the archive in the STANDARD storage class, so that it can be read
+// without restoring anything, and lets a later upload of a slightly changed
+// file find out which parts it can copy instead of sending them again.
+// Encrypted uploads also record the SHA-256 of the file itself, which dr-test
+// checks what it decrypts against.
+type partManifest struct {
+	Key         string   `json:"key"`
+	Size        int64    `json:"size"`
+	PartSize    int64    `json:"part_size"`
+	ETag        string   `json:"etag"`
+	Parts       []string `json:"parts"`
+	PlainSHA256 string   `json:"plain_sha256,omitempty"`
+	// UnshardedKey is Key without its --shard-prefix shard.
+	UnshardedKey string `json:"unsharded_key,omitempty"`
+}
+
+// Matches reports whether the part with the given number has the same
+// content as in the manifest.  Part numbers start at 1.
+func (m *partManifest) Matches(partNum int, length int, digest string) bool {
+	if m == nil || partNum > len(m.Parts) {
+		return false
+	}
+
+	offset := int64(partNum-1) * m.PartSize
+	expected := m.PartSize
+	if offset+expected > m.Size {
+		expected = m.Size - offset
+	}
+
+	return int64(length) == expected && m.Parts[partNum-1] == digest
+}
+
+// isSidecar reports whether a key holds one of the small objects we store
+// next to archives, rather than an archive itself.
+func isSidecar(key string) bool {
+	return strings.HasSuffix(key, PART_MANIFEST_SUFFIX) ||
+		strings.HasSuffix(key, SIGNATURE_SUFFIX) ||
+		strings.HasSuffix(key, PREVIEW_SUFFIX) ||
+		strings.HasSuffix(key, PRESERVATION_SUFFIX) ||
+		strings.HasSuffix(key, SPLIT_MANIFEST_SUFFIX) ||
+		strings.HasSuffix(key, FRAME_INDEX_SUFFIX) ||
+		strings.HasSuffix(key, COMPLETION_RECORD_SUFFIX) ||
+		strings.Contains(key, SHARED_STATE_SUFFIX)
+}
+
+// isNoSuchKey reports whether err says that an object doesn't exist.  HEAD
+// responses have no body to carry the error code, so they're just NotFound.
+func isNoSuchKey(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
+
+func isNoSuchUpload(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+func loadPartManifest(s3session s3iface.S3API, bucket string, key string) (*partManifest, error) {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key + PART_MANIFEST_SUFFIX),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the part manifest of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSignature(s3session, bucket, key+PART_MANIFEST_SUFFIX, data); err != nil {
+		return nil, err
+	}
+
+	var m partManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse the part manifest of %s: %w", key, err)
+	}
+
+	// A validly signed manifest of another object could have been copied
+	// here.
+	if m.Key != key {
+		return nil, fmt.Errorf("The part manifest of %s describes %s", key, m.Key)
+	}
+
+	return &m, nil
+}
+
+// isKMS reports whether an object is encrypted with SSE-KMS.
+func isKMS(head *s3.HeadObjectOutput) bool {
+	return head.ServerSideEncryption != nil && *head.ServerSideEncryption == s3.ServerSideEncryptionAwsKms
+}
+
+// expectedETag works out what the data of an object has to hash to, and how
+// it was split into parts.  The ETag in the part manifest was recorded at
+// upload time, so it's used whenever there is a manifest; with --verify-key,
+// there has to be a signed one.  Otherwise we go by what S3 reports now.
+func expectedETag(s3session s3iface.S3API, bucket string, key string, head *s3.HeadObjectOutput) (string, []int64, error) {
+	m, err := loadPartManifest(s3session, bucket, key)
+	if err != nil && (verifyPublicKey != nil || !isNoSuchKey(err)) {
+		return "", nil, err
+	}
+
+	if m != nil {
+		parts, err := etagPartCount(m.ETag)
+		if err != nil {
+			return "", nil, err
+		}
+		if parts == 0 {
+			return m.ETag, nil, nil
+		}
+		return m.ETag, transfer.PartSizes(m.Size, m.PartSize), nil
+	}
+
+	// With SSE-KMS the ETag isn't an MD5 digest.
+	if isKMS(head) {
+		return "", nil, fmt.Errorf("%w: SSE-KMS object without a part manifest", errUnverifiable)
+	}
+
+	etag := strings.Trim(*head.ETag, "\"")
+	partSizes, err := objectPartSizes(s3session, bucket, key, etag)
+	return etag, partSizes, err
+}
+
+func savePartManifest(s3session s3iface.S3API, bucket string, m *partManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(m.Key + PART_MANIFEST_SUFFIX),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	if err != nil {
+		return err
+	}
+
+	return putSignature(s3session, bucket, m.Key+PART_MANIFEST_SUFFIX, data)
+}
+
+// copyPart fills in a part of a multipart upload with a byte range of an
+// existing object in sourceBucket, without sending the data again.  If
+// sourceETag is given, S3 refuses the copy when the source has been replaced
+// in the meantime.  Failed copies are retried like uploaded parts.
+func copyPart(s3session s3iface.S3API, resp *s3.CreateMultipartUploadOutput, sourceBucket string, sourceKey string, sourceETag string, offset int64, length int64, partNum int) partUploadResult {
+	part, err := newUploader(s3session).CopyPartFrom(context.Background(), *resp.Bucket, *resp.Key, *resp.UploadId, partNum, sourceBucket, sourceKey, sourceETag, offset, length)
+	return partUploadResult{part, err}
+}
@@ -0,0 +1,71 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestPartManifestMatches(t *testing.T) {
+	m := &partManifest{
+		Key:      "vm.img",
+		Size:     250,
+		PartSize: 100,
+		Parts:    []string{"aaa", "bbb", "ccc"},
+	}
+
+	tests := []struct {
+		name    string
+		partNum int
+		length  int
+		digest  string
+		want    bool
+	}{
+		{"same first part", 1, 100, "aaa", true},
+		{"same last part", 3, 50, "ccc", true},
+		{"changed digest", 2, 100, "xxx", false},
+		{"digest of another part", 2, 100, "aaa", false},
+		{"last part grew", 3, 100, "ccc", false},
+		{"file got longer", 4, 100, "ddd", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Matches(tt.partNum, tt.length, tt.digest); got != tt.want {
+			t.Errorf("%s: Matches(%d, %d, %s) = %v", tt.name, tt.partNum, tt.length, tt.digest, got)
+		}
+	}
+
+	var none *partManifest
+	if none.Matches(1, 100, "aaa") {
+		t.Error("a missing manifest matched")
+	}
+}
+
+func TestIsSidecar(t *testing.T) {
+	tests := map[string]bool{
+		"vm.img":                               false,
+		"vm.img.parts.json":                    true,
+		"vm.img.parts.json.sig":                true,
+		"vm.img.2022-06-01.upload.json":        true,
+		"vm.img.2022-06-01.upload.json.node-2": true,
+		"parts.json.tar":                       false,
+	}
+
+	for key, want := range tests {
+		if got := isSidecar(key); got != want {
+			t.Errorf("isSidecar(%q) = %v", key, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CLI flags
+var RefuseOnMetered bool
+var ConfirmOver string
+
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGTP]?)(?:I?B)?$`)
+
+// parseSize reads sizes like "500G" or "1.5TiB".  Units are powers of 1024,
+// like the ones formatBytes prints.
+func parseSize(spec string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(spec)))
+	if m == nil {
+		return 0, fmt.Errorf("Invalid size %q, use e.g. 500M or 10G", spec)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %q, use e.g. 500M or 10G", spec)
+	}
+
+	multiplier := int64(1)
+	if m[2] != "" {
+		for i := strings.Index("KMGTP", m[2]); i >= 0; i-- {
+			multiplier *= 1024
+		}
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// connectionMetered asks the OS whether the connection is billed by the
+// byte, like a phone hotspot.  The second value is false when we can't tell,
+// which is the case everywhere except Linux with NetworkManager.
+func connectionMetered() (bool, bool) {
+	if runtime.GOOS != "linux" {
+		return false, false
+	}
+
+	out, err := exec.Command("busctl", "get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false, false
+	}
+	return parseNMMetered(string(out))
+}
+
+// parseNMMetered reads NetworkManager's NMMetered enum as busctl prints it,
+// e.g. "u 4".  NetworkManager guesses from the kind of device, and we trust
+// its guesses.
+func parseNMMetered(out string) (bool, bool) {
+	switch strings.TrimSpace(out) {
+	case "u 1", "u 3":
+		return true, true
+	case "u 2", "u 4":
+		return false, true
+	}
+	return false, false
+}
+
+// confirm asks a yes/no question, defaulting to no.
+func confirm(question string, in io.Reader) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// checkNetworkCost stops uploads which would be expensive on the current
+// connection before a single byte is sent.
+func checkNetworkCost(filename string) error {
+	if RefuseOnMetered {
+		metered, known := connectionMetered()
+		if !known {
+			ui.Warnln("Can't tell whether the connection is metered, uploading anyway")
+		} else if metered {
+			return fmt.Errorf("Refusing to upload over a metered connection (--refuse-on-metered)")
+		}
+	}
+
+	// There's no telling how much standard input or a remote file will
+	// bring.
+	if ConfirmOver == "" || filename == STDIN || isRemoteSource(filename) {
+		return nil
+	}
+
+	limit, err := parseSize(ConfirmOver)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= limit {
+		return nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("%s is %s, over --confirm-over %s, and there's no terminal to confirm", filename, formatBytes(stat.Size()), ConfirmOver)
+	}
+	if !confirm(fmt.Sprintf("%s is %s.  Upload it?", filename, formatBytes(stat.Size())), os.Stdin) {
+		return fmt.Errorf("Upload of %s cancelled", filename)
+	}
+
+	return nil
+}
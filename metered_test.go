@@ -0,0 +1,80 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		spec string
+		want int64
+	}{
+		{"100", 100},
+		{"100B", 100},
+		{"10K", 10 * 1024},
+		{"500M", 500 * 1024 * 1024},
+		{"10G", 10 * 1024 * 1024 * 1024},
+		{"10GiB", 10 * 1024 * 1024 * 1024},
+		{"10gb", 10 * 1024 * 1024 * 1024},
+		{"1.5T", 3 * 512 * 1024 * 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		got, err := parseSize(test.spec)
+		if err != nil || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, expected %d", test.spec, got, err, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "G", "10X", "-5G", "ten"} {
+		if _, err := parseSize(spec); err == nil {
+			t.Errorf("parseSize(%q) was accepted", spec)
+		}
+	}
+}
+
+func TestParseNMMetered(t *testing.T) {
+	tests := []struct {
+		out           string
+		metered, know bool
+	}{
+		{"u 0\n", false, false},
+		{"u 1\n", true, true},
+		{"u 2\n", false, true},
+		{"u 3\n", true, true},
+		{"u 4\n", false, true},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		metered, known := parseNMMetered(test.out)
+		if metered != test.metered || known != test.know {
+			t.Errorf("parseNMMetered(%q) = %v, %v", test.out, metered, known)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false} {
+		if got := confirm("Upload?", strings.NewReader(answer)); got != want {
+			t.Errorf("confirm with %q = %v", answer, got)
+		}
+	}
+}
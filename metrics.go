@@ -0,0 +1,265 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/spf13/cobra"
+)
+
+var MetricsFile string
+
+// metricsCommand is what the run's metrics are labelled with, empty for
+// commands which don't write any.
+var metricsCommand string
+
+// transferCounts are what the run sent to and got from S3, counted as
+// requests complete.  They're updated atomically.
+type transferCounts struct {
+	UploadedBytes     int64
+	UploadedObjects   int64
+	DownloadedBytes   int64
+	DownloadedObjects int64
+	Requests          int64
+	Retries           int64
+	FailedRequests    int64
+}
+
+var transfers transferCounts
+
+func (c *transferCounts) load() transferCounts {
+	return transferCounts{
+		UploadedBytes:     atomic.LoadInt64(&c.UploadedBytes),
+		UploadedObjects:   atomic.LoadInt64(&c.UploadedObjects),
+		DownloadedBytes:   atomic.LoadInt64(&c.DownloadedBytes),
+		DownloadedObjects: atomic.LoadInt64(&c.DownloadedObjects),
+		Requests:          atomic.LoadInt64(&c.Requests),
+		Retries:           atomic.LoadInt64(&c.Retries),
+		FailedRequests:    atomic.LoadInt64(&c.FailedRequests),
+	}
+}
+
+const METRICS_PREFIX = "s3_glacier_uploader_"
+
+// metricsHelp are the metrics we write, in order.  last_success is kept
+// from the previous file when a run fails, which is what freshness alerts
+// look at.
+var metricsHelp = []struct{ name, help string }{
+	{"last_run_timestamp_seconds", "When the last run finished."},
+	{"last_run_success", "Whether the last run succeeded."},
+	{"last_run_duration_seconds", "How long the last run took."},
+	{"last_run_uploaded_bytes", "Bytes the last run uploaded."},
+	{"last_run_uploaded_objects", "Objects the last run uploaded."},
+	{"last_success_timestamp_seconds", "When the last successful run finished."},
+	{"last_run_drift", "Whether the last run planned or took far more or less than usual for its job."},
+	{"last_run_warnings", "Warnings the last run had, like files it skipped."},
+}
+
+type metricSample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+// metricsCommandName is the command's path without the program's name, and
+// upload for the root command.
+func metricsCommandName(cmd *cobra.Command) string {
+	if !cmd.HasParent() {
+		return "upload"
+	}
+	path := strings.Fields(cmd.CommandPath())
+	return strings.Join(path[1:], " ")
+}
+
+// countTransfers counts requests, and the bytes and objects which made it
+// to or from S3.  A download's bytes are counted as they're promised, the
+// body is read after the request completes.
+func countTransfers(handlers *request.Handlers) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		atomic.AddInt64(&transfers.Requests, 1)
+		atomic.AddInt64(&transfers.Retries, int64(r.RetryCount))
+		if r.Error != nil {
+			atomic.AddInt64(&transfers.FailedRequests, 1)
+			return
+		}
+		switch r.Operation.Name {
+		case "PutObject":
+			atomic.AddInt64(&transfers.UploadedObjects, 1)
+			fallthrough
+		case "UploadPart":
+			if r.HTTPRequest != nil && r.HTTPRequest.ContentLength > 0 {
+				atomic.AddInt64(&transfers.UploadedBytes, r.HTTPRequest.ContentLength)
+			}
+		case "CompleteMultipartUpload":
+			atomic.AddInt64(&transfers.UploadedObjects, 1)
+		case "GetObject":
+			atomic.AddInt64(&transfers.DownloadedObjects, 1)
+			if r.HTTPResponse != nil && r.HTTPResponse.ContentLength > 0 {
+				atomic.AddInt64(&transfers.DownloadedBytes, r.HTTPResponse.ContentLength)
+			}
+		}
+	})
+}
+
+// writeMetrics writes the run's metrics in the node_exporter textfile
+// collector's format, keeping those of other commands and buckets, and the
+// stats of transfer commands.  It's the last thing a run does, so errors
+// are only warned about.
+func writeMetrics(ok bool) {
+	if metricsCommand == "" || DryRun {
+		return
+	}
+	now, counts := time.Now(), transfers.load()
+	if MetricsFile != "" {
+		labels := fmt.Sprintf("bucket=%q,command=%q", BucketName, metricsCommand)
+		run := runMetrics(ok, labels, now, counts.UploadedBytes, counts.UploadedObjects)
+		if runDrift.checked {
+			drift := 0.0
+			if len(runDrift.found) > 0 {
+				drift = 1
+			}
+			run = append(run, metricSample{METRICS_PREFIX + "last_run_drift", labels, drift})
+		}
+		run = append(run, metricSample{METRICS_PREFIX + "last_run_warnings", labels, float64(len(collectedWarnings()))})
+		if err := updateMetricsFile(MetricsFile, labels, run); err != nil {
+			ui.Warnf("Failed to write the metrics to %s: %v\n", MetricsFile, err)
+		}
+	}
+	if StatsFile != "" && transferCommands[metricsCommand] {
+		stats := newRunStats(metricsCommand, BucketName, ok, now, counts)
+		if err := writeStatsFile(StatsFile, stats); err != nil {
+			ui.Warnf("Failed to write the stats to %s: %v\n", StatsFile, err)
+		}
+	}
+}
+
+func runMetrics(ok bool, labels string, now time.Time, bytes int64, objects int64) []metricSample {
+	success := 0.0
+	if ok {
+		success = 1
+	}
+	samples := []metricSample{
+		{METRICS_PREFIX + "last_run_timestamp_seconds", labels, float64(now.Unix())},
+		{METRICS_PREFIX + "last_run_success", labels, success},
+		{METRICS_PREFIX + "last_run_duration_seconds", labels, now.Sub(runStarted).Seconds()},
+		{METRICS_PREFIX + "last_run_uploaded_bytes", labels, float64(bytes)},
+		{METRICS_PREFIX + "last_run_uploaded_objects", labels, float64(objects)},
+	}
+	if ok {
+		samples = append(samples, metricSample{METRICS_PREFIX + "last_success_timestamp_seconds", labels, float64(now.Unix())})
+	}
+	return samples
+}
+
+// updateMetricsFile replaces the samples labelled labels with run.  The
+// file is replaced whole, so node_exporter never reads half of it.
+func updateMetricsFile(filename string, labels string, run []metricSample) error {
+	old, err := readMetricsFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	samples := map[string][]metricSample{}
+	replaced := map[string]bool{}
+	for _, s := range run {
+		samples[s.name] = append(samples[s.name], s)
+		replaced[s.name] = true
+	}
+	for _, s := range old {
+		// A failed run has no last_success of its own.
+		if s.labels != labels || !replaced[s.name] {
+			samples[s.name] = append(samples[s.name], s)
+		}
+	}
+
+	var b strings.Builder
+	for _, m := range metricsHelp {
+		name := METRICS_PREFIX + m.name
+		if len(samples[name]) == 0 {
+			continue
+		}
+		sort.Slice(samples[name], func(i, j int) bool { return samples[name][i].labels < samples[name][j].labels })
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, m.help, name)
+		for _, s := range samples[name] {
+			fmt.Fprintf(&b, "%s{%s} %s\n", s.name, s.labels, strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+
+	return replaceFile(filename, []byte(b.String()))
+}
+
+// replaceFile writes a temporary file next to filename and renames it, so
+// that readers see either the old or the new file.
+func replaceFile(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// readMetricsFile reads back the samples writeMetrics wrote, skipping
+// anything else.
+func readMetricsFile(filename string) ([]metricSample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var samples []metricSample
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := lines.Text()
+		start, end, space := strings.Index(line, "{"), strings.LastIndex(line, "}"), strings.LastIndex(line, " ")
+		if !strings.HasPrefix(line, METRICS_PREFIX) || start < 0 || end < start || space < end {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, metricSample{line[:start], line[start+1 : end], value})
+	}
+	return samples, lines.Err()
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&MetricsFile, "metrics-file", "", "after each run, write its outcome for node_exporter's textfile collector to this file (e.g. /var/lib/node_exporter/textfile_collector/s3-glacier-uploader.prom)")
+}
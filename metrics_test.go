@@ -0,0 +1,83 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateMetricsFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "uploader.prom")
+	sync := `bucket="backups",command="sync"`
+	scrub := `bucket="backups",command="scrub"`
+	first := runStarted.Add(time.Minute)
+
+	if err := updateMetricsFile(p, sync, runMetrics(true, sync, first, 2048, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMetricsFile(p, scrub, runMetrics(true, scrub, first, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMetricsFile(p, sync, runMetrics(false, sync, first.Add(time.Hour), 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, want := range []string{
+		"# TYPE s3_glacier_uploader_last_run_success gauge\n",
+		`s3_glacier_uploader_last_run_success{` + sync + "} 0\n",
+		`s3_glacier_uploader_last_run_success{` + scrub + "} 1\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("no %q in\n%s", want, text)
+		}
+	}
+
+	samples, err := readMetricsFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastSuccess, bytes float64
+	for _, s := range samples {
+		if s.labels != sync {
+			continue
+		}
+		switch s.name {
+		case METRICS_PREFIX + "last_success_timestamp_seconds":
+			lastSuccess = s.value
+		case METRICS_PREFIX + "last_run_uploaded_bytes":
+			bytes = s.value
+		}
+	}
+	if lastSuccess != float64(first.Unix()) {
+		t.Errorf("the failed run left last_success at %v, want %d", lastSuccess, first.Unix())
+	}
+	if bytes != 0 {
+		t.Errorf("the failed run uploaded %v bytes", bytes)
+	}
+	if len(samples) != 12 {
+		t.Errorf("got %d samples", len(samples))
+	}
+}
@@ -0,0 +1,119 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var WaitForNetwork time.Duration
+
+const NETWORK_POLL_INTERVAL = 15 * time.Second
+
+// isNetworkError tells whether a request failed because we couldn't talk to
+// S3 at all: no route, no DNS, a reset connection, or a certificate which
+// isn't Amazon's because a captive portal answered instead.  The SDK wraps
+// these in awserr errors, which don't support errors.As, so unwrap by hand.
+func isNetworkError(err error) bool {
+	for err != nil {
+		// Stalled parts are cancelled by us.
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+
+		var netErr net.Error
+		var certErr x509.UnknownAuthorityError
+		var hostErr x509.HostnameError
+		if errors.As(err, &netErr) || errors.As(err, &certErr) || errors.As(err, &hostErr) {
+			return true
+		}
+
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// s3Endpoint is where the session sends its requests, for probing.
+func s3Endpoint(s3session s3iface.S3API) string {
+	if client, ok := s3session.(*s3.S3); ok {
+		return client.Endpoint
+	}
+	return ""
+}
+
+// probeNetwork checks that S3 itself answers.  A captive portal may well
+// answer too, but it won't have an S3 request ID.  The probe goes through the
+// same transport as the requests, so --no-verify-ssl applies to it.
+func probeNetwork(endpoint string) error {
+	client := &http.Client{Transport: baseTransport(), Timeout: 10 * time.Second}
+	resp, err := client.Head(endpoint)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("x-amz-request-id") == "" {
+		return fmt.Errorf("%s answered, but it isn't S3", endpoint)
+	}
+	return nil
+}
+
+// waitForNetwork pauses the upload while S3 can't be reached, instead of
+// spending the remaining attempts on a laptop which has moved out of range
+// of its Wi-Fi.  It returns true if S3 was unreachable and now answers
+// again, in which case the failed request deserves another try for free.
+func waitForNetwork(endpoint string, interval time.Duration, limit time.Duration) bool {
+	if endpoint == "" || limit <= 0 {
+		return false
+	}
+
+	err := probeNetwork(endpoint)
+	if err == nil {
+		return false
+	}
+
+	ui.Warnf("Can't reach S3 (%v), pausing for up to %s until it's back\n", err, limit)
+	progress.Paused(err)
+
+	deadline := time.Now().Add(limit)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		if err = probeNetwork(endpoint); err == nil {
+			ui.Warnln("S3 is reachable again, resuming")
+			progress.Resumed()
+			return true
+		}
+	}
+
+	ui.Warnf("S3 has been unreachable for %s, giving up\n", limit)
+	return false
+}
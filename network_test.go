@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: network is unreachable")}
+	sent := awserr.New(request.ErrCodeRequestError, "send request failed", &url.Error{Op: "Put", URL: "https://s3", Err: dial})
+	cancelled := awserr.New(request.CanceledErrorCode, "request context canceled", &url.Error{Op: "Put", URL: "https://s3", Err: context.Canceled})
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{sent, true},
+		{&net.DNSError{Err: "no such host", Name: "s3.amazonaws.com"}, true},
+		{cancelled, false},
+		{awserr.New("SlowDown", "Please reduce your request rate.", nil), false},
+		{errors.New("boom"), false},
+	}
+
+	for _, test := range tests {
+		if got := isNetworkError(test.err); got != test.want {
+			t.Errorf("isNetworkError(%v) = %v", test.err, got)
+		}
+	}
+}
+
+func TestWaitForNetwork(t *testing.T) {
+	var online int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Until we're online, a captive portal answers.
+		if atomic.LoadInt32(&online) == 1 {
+			w.Header().Set("x-amz-request-id", "1")
+		}
+	}))
+	defer server.Close()
+
+	if waitForNetwork(server.URL, time.Millisecond, 20*time.Millisecond) {
+		t.Error("waited for a network which never came back")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&online, 1)
+	}()
+	if !waitForNetwork(server.URL, time.Millisecond, time.Minute) {
+		t.Error("didn't notice the network coming back")
+	}
+
+	// When S3 answers right away, the failure wasn't the network's fault.
+	if waitForNetwork(server.URL, time.Millisecond, time.Minute) {
+		t.Error("paused although S3 is reachable")
+	}
+}
+
+func TestProbeNetworkSelfSigned(t *testing.T) {
+	defer func() { NoVerifySSL, insecureTransport = false, nil }()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-request-id", "1")
+	}))
+	defer server.Close()
+
+	if err := probeNetwork(server.URL); err == nil {
+		t.Error("trusted a self-signed certificate")
+	}
+
+	NoVerifySSL = true
+	if err := checkEndpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := probeNetwork(server.URL); err != nil {
+		t.Errorf("--no-verify-ssl: %v", err)
+	}
+}
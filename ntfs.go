@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"strings"
+)
+
+// CLI flags
+var TarWindowsACLs bool
+var DownloadWindowsACLs bool
+
+// Security descriptors are archived as a PAX record of this name, base64
+// encoded.
+const PAX_WINDOWS_SD = "MSWINDOWS.rawsd"
+
+// archiveSecurityDescriptor adds the security descriptor of the file p, its
+// owner, group and ACL, to hdr with --windows-acls.
+func archiveSecurityDescriptor(hdr *tar.Header, p string) error {
+	if !TarWindowsACLs || hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	sd, err := readSecurityDescriptor(p)
+	if err != nil || len(sd) == 0 {
+		return err
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[PAX_WINDOWS_SD] = base64.StdEncoding.EncodeToString(sd)
+	return nil
+}
+
+// restoreSecurityDescriptor gives target the security descriptor hdr has
+// with download --windows-acls.  Setting another owner takes privileges,
+// so failing is only warned about.
+func restoreSecurityDescriptor(hdr *tar.Header, target string) {
+	encoded, ok := hdr.PAXRecords[PAX_WINDOWS_SD]
+	if !DownloadWindowsACLs || !ok {
+		return
+	}
+	sd, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		err = writeSecurityDescriptor(target, sd)
+	}
+	if err != nil {
+		warn(WARNING_METADATA, hdr.Name, "Failed to restore the security descriptor of %s: %v", hdr.Name, err)
+	}
+}
+
+// noteStreams warns about the alternate data streams of the file p, which
+// aren't uploaded: only the file's data is.
+func noteStreams(p string) {
+	streams, err := alternateStreams(p)
+	if err != nil {
+		warn(WARNING_METADATA, p, "Failed to list the alternate data streams of %s: %v", p, err)
+		return
+	}
+	if len(streams) > 0 {
+		warn(WARNING_METADATA, p, "Skipping the alternate data streams of %s: %s", p, strings.Join(streams, ", "))
+	}
+}
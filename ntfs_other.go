@@ -0,0 +1,39 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package main
+
+import "errors"
+
+// windowsACLsSupported tells whether --windows-acls works here.
+const windowsACLsSupported = false
+
+var errWindowsACLs = errors.New("Security descriptors only exist on Windows")
+
+func readSecurityDescriptor(p string) ([]byte, error) {
+	return nil, errWindowsACLs
+}
+
+func writeSecurityDescriptor(p string, sd []byte) error {
+	return errWindowsACLs
+}
+
+// alternateStreams has nothing to list, only NTFS has alternate data streams.
+func alternateStreams(p string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarWindowsACLs(t *testing.T) {
+	defer func() { Tar, TarWindowsACLs, DownloadWindowsACLs = false, false, false }()
+
+	Tar, TarWindowsACLs = true, true
+	if err := checkTarFlags(); (err == nil) != windowsACLsSupported {
+		t.Fatalf("--windows-acls here: %v", err)
+	}
+	if !windowsACLsSupported {
+		return
+	}
+
+	dir := writeTree(t, tarTree)
+	var archive bytes.Buffer
+	if err := writeTar(&archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&archive)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.PAXRecords[PAX_WINDOWS_SD] == "" {
+		t.Errorf("%s has no security descriptor", hdr.Name)
+	}
+
+	// Our own descriptors can be given back to files of ours.
+	DownloadWindowsACLs = true
+	out := t.TempDir()
+	if _, err := extractTar(bytes.NewReader(archive.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if sd, err := readSecurityDescriptor(filepath.Join(out, filepath.Base(dir), "a.txt")); err != nil || len(sd) == 0 {
+		t.Errorf("the extracted file has the security descriptor %x: %v", sd, err)
+	}
+}
@@ -0,0 +1,121 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// windowsACLsSupported tells whether --windows-acls works here.
+const windowsACLsSupported = true
+
+// The parts of a security descriptor archived: the owner, the group and the
+// access control list.  The audit list (SACL) takes a privilege to read.
+const (
+	OWNER_SECURITY_INFORMATION = 0x1
+	GROUP_SECURITY_INFORMATION = 0x2
+	DACL_SECURITY_INFORMATION  = 0x4
+
+	SECURITY_INFORMATION = OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION
+)
+
+const ERROR_HANDLE_EOF syscall.Errno = 38
+
+var (
+	advapi32             = syscall.NewLazyDLL("advapi32.dll")
+	procGetFileSecurityW = advapi32.NewProc("GetFileSecurityW")
+	procSetFileSecurityW = advapi32.NewProc("SetFileSecurityW")
+	procFindFirstStreamW = syscall.NewLazyDLL("kernel32.dll").NewProc("FindFirstStreamW")
+	procFindNextStreamW  = syscall.NewLazyDLL("kernel32.dll").NewProc("FindNextStreamW")
+)
+
+// readSecurityDescriptor returns the security descriptor of the file p, in
+// the self-relative form GetFileSecurityW gives.
+func readSecurityDescriptor(p string) ([]byte, error) {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first call asks for the size.
+	var needed uint32
+	procGetFileSecurityW.Call(uintptr(unsafe.Pointer(name)), SECURITY_INFORMATION, 0, 0, uintptr(unsafe.Pointer(&needed)))
+	if needed == 0 {
+		return nil, nil
+	}
+	sd := make([]byte, needed)
+	if ok, _, err := procGetFileSecurityW.Call(uintptr(unsafe.Pointer(name)), SECURITY_INFORMATION, uintptr(unsafe.Pointer(&sd[0])), uintptr(needed), uintptr(unsafe.Pointer(&needed))); ok == 0 {
+		return nil, err
+	}
+	return sd, nil
+}
+
+// writeSecurityDescriptor gives the file p the security descriptor sd.
+func writeSecurityDescriptor(p string, sd []byte) error {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return err
+	}
+	if len(sd) == 0 {
+		return nil
+	}
+	if ok, _, err := procSetFileSecurityW.Call(uintptr(unsafe.Pointer(name)), SECURITY_INFORMATION, uintptr(unsafe.Pointer(&sd[0]))); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// win32FindStreamData is WIN32_FIND_STREAM_DATA.
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [syscall.MAX_PATH + 36]uint16
+}
+
+// alternateStreams lists the alternate data streams of the file p by name,
+// leaving out the file's data itself, "::$DATA".
+func alternateStreams(p string) ([]string, error) {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var data win32FindStreamData
+	h, _, err := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(name)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		if err == ERROR_HANDLE_EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer syscall.FindClose(syscall.Handle(h))
+
+	var streams []string
+	for {
+		stream := strings.TrimSuffix(syscall.UTF16ToString(data.StreamName[:]), ":$DATA")
+		if stream != ":" {
+			streams = append(streams, strings.TrimPrefix(stream, ":"))
+		}
+		if ok, _, err := procFindNextStreamW.Call(h, uintptr(unsafe.Pointer(&data))); ok == 0 {
+			if err == ERROR_HANDLE_EOF {
+				return streams, nil
+			}
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Separate credentials keep a compromised backup host from destroying the
+// archive; the operator check keeps a tired human, or a script run with the
+// wrong flags, from doing it.  When it's set up, aborting uploads, emptying
+// the trash and sync --delete ask for a passphrase or a TOTP code first.
+
+// CLI flags
+var OperatorPassphraseHash string
+var OperatorTOTPFile string
+
+const OPERATOR_CODE_ENV = "S3_GLACIER_OPERATOR_CODE"
+
+const (
+	OPERATOR_HASH_PREFIX = "scrypt:"
+	TOTP_STEP            = 30 * time.Second
+	TOTP_DIGITS          = 6
+)
+
+// The secrets given with --operator-passphrase-hash and --operator-totp-file,
+// loaded before anything else happens.
+var operatorSalt []byte
+var operatorHash []byte
+var operatorTOTPSecret []byte
+
+// operatorConfirmed is set once the operator gave the passphrase or code, so
+// that it's asked for once per run.
+var operatorConfirmed bool
+
+var operatorCmd = &cobra.Command{
+	Use:   "operator",
+	Short: "Set up the passphrase or TOTP code asked for before deleting anything",
+}
+
+var operatorPassphraseCmd = &cobra.Command{
+	Use:   "passphrase",
+	Short: "Read a passphrase and print the hash of it to give --operator-passphrase-hash",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		passphrase, err := readOperatorCode("New operator passphrase: ")
+		if err == nil {
+			var hash string
+			hash, err = HashOperatorPassphrase(passphrase)
+			if err == nil {
+				ui.Println(hash)
+			}
+		}
+		return err
+	},
+}
+
+var operatorTOTPCmd = &cobra.Command{
+	Use:   "totp file",
+	Short: "Create a TOTP secret for --operator-totp-file, and print it for an authenticator app",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return OperatorTOTP(args[0], BucketName)
+	},
+}
+
+// HashOperatorPassphrase salts the passphrase and puts it through scrypt, so
+// that the hash can sit in a config file without giving the passphrase away.
+func HashOperatorPassphrase(passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("The operator passphrase can't be empty")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := operatorKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	return OPERATOR_HASH_PREFIX + base64.RawStdEncoding.EncodeToString(salt) + ":" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+func operatorKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// OperatorTOTP writes a new random secret to filename, readable only by its
+// owner, and prints the otpauth:// URI to add it to an authenticator app
+// with.
+func OperatorTOTP(filename string, bucket string) error {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, encoded); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	label := "s3-glacier-uploader"
+	if bucket != "" {
+		label += ":" + bucket
+	}
+	query := url.Values{"secret": {encoded}, "issuer": {"s3-glacier-uploader"}}
+	ui.Println("Wrote", filename)
+	ui.Println("Add this to your authenticator app:", "otpauth://totp/"+url.PathEscape(label)+"?"+query.Encode())
+	return nil
+}
+
+func checkOperatorFlags() error {
+	operatorSalt, operatorHash, operatorTOTPSecret = nil, nil, nil
+	if OperatorPassphraseHash != "" {
+		fields := strings.Split(strings.TrimPrefix(OperatorPassphraseHash, OPERATOR_HASH_PREFIX), ":")
+		if !strings.HasPrefix(OperatorPassphraseHash, OPERATOR_HASH_PREFIX) || len(fields) != 2 {
+			return fmt.Errorf("--operator-passphrase-hash should look like scrypt:<salt>:<hash>, as printed by the operator passphrase command")
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("Bad salt in --operator-passphrase-hash: %w", err)
+		}
+		hash, err := base64.RawStdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("Bad hash in --operator-passphrase-hash: %w", err)
+		}
+		operatorSalt, operatorHash = salt, hash
+	}
+	if OperatorTOTPFile != "" {
+		data, err := os.ReadFile(OperatorTOTPFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read --operator-totp-file: %w", err)
+		}
+		secret, err := decodeTOTPSecret(string(data))
+		if err != nil {
+			return fmt.Errorf("--operator-totp-file doesn't hold a base32 TOTP secret: %w", err)
+		}
+		operatorTOTPSecret = secret
+	}
+	if (operatorHash != nil || operatorTOTPSecret != nil) && WriteOnce {
+		return fmt.Errorf("--write-once never deletes anything, there's nothing for the operator to confirm")
+	}
+	return nil
+}
+
+// decodeTOTPSecret reads secrets the way authenticator apps show them: in
+// base32, in any case, maybe with spaces and padding.
+func decodeTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	s = strings.TrimRight(s, "=")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("it's empty")
+	}
+	return secret, nil
+}
+
+// totpCode is the RFC 6238 code for the time step t is in.
+func totpCode(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(TOTP_STEP/time.Second)))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus)
+}
+
+// checkOperatorCode accepts the passphrase, or a TOTP code of the time step
+// now is in or of the ones either side of it, for clocks that are a little
+// off.
+func checkOperatorCode(code string, now time.Time) bool {
+	if operatorTOTPSecret != nil {
+		for _, step := range []time.Duration{0, -TOTP_STEP, TOTP_STEP} {
+			if subtle.ConstantTimeCompare([]byte(totpCode(operatorTOTPSecret, now.Add(step))), []byte(code)) == 1 {
+				return true
+			}
+		}
+	}
+	if operatorHash != nil {
+		key, err := operatorKey(code, operatorSalt)
+		if err == nil && subtle.ConstantTimeCompare(key, operatorHash) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireOperator asks for the passphrase or code before action, unless no
+// operator check was set up.  Without a terminal, e.g. in cron jobs, it has
+// to be in $S3_GLACIER_OPERATOR_CODE.
+func requireOperator(action string) error {
+	if operatorConfirmed || (operatorHash == nil && operatorTOTPSecret == nil) {
+		return nil
+	}
+	code := os.Getenv(OPERATOR_CODE_ENV)
+	if code == "" {
+		if !isTerminal(os.Stdin) {
+			return fmt.Errorf("Refusing to %s without the operator passphrase or code, give it in %s", action, OPERATOR_CODE_ENV)
+		}
+		var err error
+		code, err = readOperatorCode(fmt.Sprintf("Operator passphrase or code to %s: ", action))
+		if err != nil {
+			return err
+		}
+	}
+	if !checkOperatorCode(strings.TrimSpace(code), time.Now()) {
+		return fmt.Errorf("Wrong operator passphrase or code, not going to %s", action)
+	}
+	operatorConfirmed = true
+	return nil
+}
+
+// readOperatorCode reads a line from a terminal without echoing it, or from
+// whatever stdin is.
+func readOperatorCode(prompt string) (string, error) {
+	if !isTerminal(os.Stdin) {
+		return readLine(os.Stdin)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&OperatorPassphraseHash, "operator-passphrase-hash", "", "ask for the passphrase of this hash before aborting uploads or deleting objects, see the operator passphrase command")
+	rootCmd.PersistentFlags().StringVar(&OperatorTOTPFile, "operator-totp-file", "", "ask for a TOTP code of the secret in this file before aborting uploads or deleting objects")
+	operatorCmd.AddCommand(operatorPassphraseCmd)
+	operatorCmd.AddCommand(operatorTOTPCmd)
+	rootCmd.AddCommand(operatorCmd)
+}
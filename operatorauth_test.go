@@ -0,0 +1,161 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetOperator() {
+	OperatorPassphraseHash, OperatorTOTPFile = "", ""
+	operatorSalt, operatorHash, operatorTOTPSecret = nil, nil, nil
+	operatorConfirmed = false
+	WriteOnce = false
+}
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, cut down to 6 digits.
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		if got := totpCode(secret, time.Unix(unix, 0)); got != code {
+			t.Errorf("%d: got %s, expected %s", unix, got, code)
+		}
+	}
+}
+
+func TestCheckOperatorCode(t *testing.T) {
+	defer resetOperator()
+
+	hash, err := HashOperatorPassphrase("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	totpFile := filepath.Join(t.TempDir(), "totp")
+	// "12345678901234567890" in base32, the way apps show it.
+	if err := os.WriteFile(totpFile, []byte("gezd gnbv gy3t qojq gezd gnbv gy3t qojq\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	OperatorPassphraseHash, OperatorTOTPFile = hash, totpFile
+	if err := checkOperatorFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(59, 0)
+	for code, ok := range map[string]bool{
+		"correct horse": true,
+		"correct":       false,
+		"":              false,
+		"287082":        true,
+		// The codes of the steps before and after.
+		totpCode(operatorTOTPSecret, now.Add(-TOTP_STEP)):  true,
+		totpCode(operatorTOTPSecret, now.Add(TOTP_STEP)):   true,
+		totpCode(operatorTOTPSecret, now.Add(2*TOTP_STEP)): false,
+	} {
+		if checkOperatorCode(code, now) != ok {
+			t.Errorf("%q: expected %v", code, ok)
+		}
+	}
+}
+
+func TestCheckOperatorFlags(t *testing.T) {
+	defer resetOperator()
+
+	for _, hash := range []string{"secret", "scrypt:abc", "scrypt:!!:abc", "sha256:abc:def"} {
+		resetOperator()
+		OperatorPassphraseHash = hash
+		if err := checkOperatorFlags(); err == nil {
+			t.Errorf("%q was accepted", hash)
+		}
+	}
+
+	resetOperator()
+	OperatorTOTPFile = filepath.Join(t.TempDir(), "totp")
+	if err := checkOperatorFlags(); err == nil {
+		t.Error("a missing --operator-totp-file was accepted")
+	}
+	os.WriteFile(OperatorTOTPFile, []byte("not base32!\n"), 0600)
+	if err := checkOperatorFlags(); err == nil {
+		t.Error("a bad TOTP secret was accepted")
+	}
+	os.WriteFile(OperatorTOTPFile, []byte("GEZDGNBVGY3TQOJQ\n"), 0600)
+	if err := checkOperatorFlags(); err != nil {
+		t.Error(err)
+	}
+	WriteOnce = true
+	if err := checkOperatorFlags(); err == nil {
+		t.Error("--write-once was accepted")
+	}
+}
+
+func TestRequireOperator(t *testing.T) {
+	defer resetOperator()
+
+	if err := requireOperator("delete everything"); err != nil {
+		t.Errorf("refused without an operator check: %v", err)
+	}
+
+	hash, err := HashOperatorPassphrase("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	OperatorPassphraseHash = hash
+	if err := checkOperatorFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tests don't run on a terminal, so there's nobody to ask.
+	t.Setenv(OPERATOR_CODE_ENV, "")
+	if err := requireOperator("delete everything"); err == nil || !strings.Contains(err.Error(), OPERATOR_CODE_ENV) {
+		t.Errorf("expected to be asked for %s, got %v", OPERATOR_CODE_ENV, err)
+	}
+	t.Setenv(OPERATOR_CODE_ENV, "wrong")
+	if err := requireOperator("delete everything"); err == nil {
+		t.Error("a wrong passphrase was accepted")
+	}
+	t.Setenv(OPERATOR_CODE_ENV, "correct horse")
+	if err := requireOperator("delete everything"); err != nil {
+		t.Error(err)
+	}
+	// Once is enough.
+	t.Setenv(OPERATOR_CODE_ENV, "")
+	if err := requireOperator("delete the rest"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashOperatorPassphrase(t *testing.T) {
+	first, err := HashOperatorPassphrase("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := HashOperatorPassphrase("correct horse")
+	if !strings.HasPrefix(first, OPERATOR_HASH_PREFIX) || first == second {
+		t.Errorf("expected salted hashes, got %s and %s", first, second)
+	}
+	if _, err := HashOperatorPassphrase(""); err == nil {
+		t.Error("an empty passphrase was accepted")
+	}
+}
@@ -0,0 +1,343 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// CLI flags
+var Format string
+
+const (
+	FORMAT_HUMAN = "human"
+	FORMAT_PLAIN = "plain"
+	FORMAT_JSON  = "json"
+)
+
+// How often a progress bar without a terminal reports, at most.
+const PROGRESS_REPORT_INTERVAL = 10 * time.Second
+
+// renderer is where everything we tell the user goes, so that every command
+// behaves the same with --format.  Commands print through ui instead of fmt.
+// Data, like a downloaded file or a restore script written to stdout, isn't
+// output in this sense and is written directly.
+type renderer interface {
+	// Printf and Println are messages, Warnf and Warnln messages for stderr.
+	Printf(format string, args ...interface{})
+	Println(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Warnln(args ...interface{})
+	// Warning is a warning also collected for the summary, see warn.
+	Warning(w runWarning)
+	// Error reports what a command failed with.
+	Error(err error)
+	// Bar follows progress towards max steps, ByteBar towards max bytes.
+	// -1 is an unknown max.
+	Bar(max int64, description string) progressBar
+	ByteBar(max int64, description string) progressBar
+	// Writer is for tables and reports, printed line by line.
+	Writer() io.Writer
+	// Event tells programs driving us what happened, e.g. that an upload
+	// started and with which ID.  Only json prints events.
+	Event(event interface{})
+}
+
+// Events of an upload, for --format json.
+type uploadStartedEvent struct {
+	Event    string `json:"event"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	Parts    int    `json:"parts"`
+	Size     int64  `json:"size"`
+}
+
+type partDoneEvent struct {
+	Event  string `json:"event"`
+	Part   int    `json:"part"`
+	ETag   string `json:"etag"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	// Source is sent, resumed or copied.
+	Source string `json:"source"`
+}
+
+// partRetryEvent is a failed attempt at a part, which is sent again.
+type partRetryEvent struct {
+	Event   string `json:"event"`
+	Part    int    `json:"part"`
+	Error   string `json:"error"`
+	Stalled bool   `json:"stalled"`
+}
+
+// uploadDoneEvent is only sent for an upload whose object S3 assembled as
+// we expected: Verified is whether its ETag, and its checksum with
+// --checksum-algorithm, matched what was computed while sending.
+type uploadDoneEvent struct {
+	Event             string `json:"event"`
+	Bucket            string `json:"bucket"`
+	Key               string `json:"key"`
+	UploadID          string `json:"upload_id"`
+	Location          string `json:"location"`
+	ETag              string `json:"etag"`
+	Size              int64  `json:"size"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
+	Verified          bool   `json:"verified"`
+}
+
+// progressBar is the part of progressbar.ProgressBar we use.
+type progressBar interface {
+	io.Writer
+	Add(n int) error
+	Set64(n int64) error
+	Describe(description string)
+}
+
+var ui renderer = humanRenderer{}
+
+func checkFormat() error {
+	switch Format {
+	case FORMAT_HUMAN:
+		ui = humanRenderer{}
+	case FORMAT_PLAIN:
+		ui = plainRenderer{}
+	case FORMAT_JSON:
+		ui = newJSONRenderer(os.Stdout)
+	default:
+		return fmt.Errorf("--format is %s, %s or %s", FORMAT_HUMAN, FORMAT_PLAIN, FORMAT_JSON)
+	}
+	return nil
+}
+
+// humanRenderer is for terminals, with progress bars.
+type humanRenderer struct{}
+
+func (humanRenderer) Printf(format string, args ...interface{}) { fmt.Printf(format, args...) }
+func (humanRenderer) Println(args ...interface{})               { fmt.Println(args...) }
+func (humanRenderer) Warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+func (humanRenderer) Warnln(args ...interface{}) { fmt.Fprintln(os.Stderr, args...) }
+func (humanRenderer) Warning(w runWarning)       { fmt.Fprintln(os.Stderr, w.Message) }
+func (humanRenderer) Error(err error)            { fmt.Println(err) }
+func (humanRenderer) Writer() io.Writer          { return os.Stdout }
+func (humanRenderer) Event(event interface{})    {}
+
+func (humanRenderer) Bar(max int64, description string) progressBar {
+	return progressbar.Default(max, description)
+}
+
+func (humanRenderer) ByteBar(max int64, description string) progressBar {
+	return progressbar.DefaultBytes(max, description)
+}
+
+// plainRenderer is for logs: the same messages, but progress as a line now
+// and then instead of a bar redrawn in place.
+type plainRenderer struct {
+	humanRenderer
+}
+
+func (plainRenderer) Bar(max int64, description string) progressBar {
+	return newReportingBar(max, description, false, func(line string) { fmt.Println(line) })
+}
+
+func (plainRenderer) ByteBar(max int64, description string) progressBar {
+	return newReportingBar(max, description, true, func(line string) { fmt.Println(line) })
+}
+
+// reportingBar counts progress like a bar, but reports it every
+// PROGRESS_REPORT_INTERVAL and when it's complete.
+type reportingBar struct {
+	mu          sync.Mutex
+	max         int64
+	done        int64
+	bytes       bool
+	description string
+	reported    time.Time
+	report      func(bar *reportingBar)
+}
+
+func newReportingBar(max int64, description string, bytes bool, print func(line string)) *reportingBar {
+	return &reportingBar{max: max, description: description, bytes: bytes, report: func(bar *reportingBar) {
+		print(bar.String())
+	}}
+}
+
+func (b *reportingBar) amount(n int64) string {
+	if b.bytes {
+		return formatBytes(n)
+	}
+	return fmt.Sprint(n)
+}
+
+// String is e.g. "uploading: 1.5 GiB of 4.0 GiB (37%)".
+func (b *reportingBar) String() string {
+	line := b.amount(b.done)
+	if b.max > 0 {
+		line = fmt.Sprintf("%s of %s (%d%%)", line, b.amount(b.max), b.done*100/b.max)
+	}
+	if b.description != "" {
+		line = b.description + ": " + line
+	}
+	return line
+}
+
+func (b *reportingBar) Set64(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.set(n)
+	return nil
+}
+
+// Add counts n more in one go, so that workers adding at the same time
+// don't lose each other's.
+func (b *reportingBar) Add(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.set(b.done + int64(n))
+	return nil
+}
+
+// set moves the bar to n.  b.mu has to be held.
+func (b *reportingBar) set(n int64) {
+	b.done = n
+	now := time.Now()
+	if now.Sub(b.reported) >= PROGRESS_REPORT_INTERVAL || (b.max > 0 && n >= b.max) {
+		b.reported = now
+		b.report(b)
+	}
+}
+
+func (b *reportingBar) Write(p []byte) (int, error) {
+	return len(p), b.Add(len(p))
+}
+
+func (b *reportingBar) Describe(description string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.description = description
+}
+
+// jsonRenderer prints one JSON object per line, for programs: {"message"},
+// {"warning"}, with the "kind" and "subject" of the ones warn collects,
+// {"error"}, {"progress"} with "done" and "total", or {"event"}.
+type jsonRenderer struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+type jsonLine struct {
+	Message  string `json:"message,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	Done     *int64 `json:"done,omitempty"`
+	Total    *int64 `json:"total,omitempty"`
+}
+
+func newJSONRenderer(w io.Writer) jsonRenderer {
+	return jsonRenderer{mu: &sync.Mutex{}, w: w}
+}
+
+func (r jsonRenderer) print(line interface{}) {
+	data, _ := json.Marshal(line)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(append(data, '\n'))
+}
+
+func (r jsonRenderer) message(text string) {
+	if text = strings.TrimRight(text, "\n"); text != "" {
+		r.print(jsonLine{Message: text})
+	}
+}
+
+func (r jsonRenderer) warning(text string) {
+	if text = strings.TrimRight(text, "\n"); text != "" {
+		r.print(jsonLine{Warning: text})
+	}
+}
+
+func (r jsonRenderer) Printf(format string, args ...interface{}) {
+	r.message(fmt.Sprintf(format, args...))
+}
+func (r jsonRenderer) Println(args ...interface{}) { r.message(fmt.Sprintln(args...)) }
+func (r jsonRenderer) Warnf(format string, args ...interface{}) {
+	r.warning(fmt.Sprintf(format, args...))
+}
+func (r jsonRenderer) Warnln(args ...interface{}) { r.warning(fmt.Sprintln(args...)) }
+func (r jsonRenderer) Error(err error)            { r.print(jsonLine{Error: err.Error()}) }
+func (r jsonRenderer) Writer() io.Writer          { return &lineWriter{emit: r.message} }
+func (r jsonRenderer) Event(event interface{})    { r.print(event) }
+
+func (r jsonRenderer) Warning(w runWarning) {
+	r.print(jsonLine{Warning: w.Message, Kind: w.Kind, Subject: w.Subject})
+}
+
+func (r jsonRenderer) Bar(max int64, description string) progressBar {
+	return r.bar(max, description)
+}
+
+func (r jsonRenderer) ByteBar(max int64, description string) progressBar {
+	return r.bar(max, description)
+}
+
+func (r jsonRenderer) bar(max int64, description string) *reportingBar {
+	bar := newReportingBar(max, description, false, nil)
+	bar.report = func(bar *reportingBar) {
+		line := jsonLine{Progress: bar.description, Done: new(int64)}
+		if line.Progress == "" {
+			line.Progress = "progress"
+		}
+		*line.Done = bar.done
+		if bar.max > 0 {
+			line.Total = new(int64)
+			*line.Total = bar.max
+		}
+		r.print(line)
+	}
+	return bar
+}
+
+// lineWriter hands what's written to it to emit a line at a time.
+type lineWriter struct {
+	buf  bytes.Buffer
+	emit func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.emit(string(w.buf.Next(i + 1)))
+	}
+}
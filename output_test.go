@@ -0,0 +1,213 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckFormat(t *testing.T) {
+	defer func() { Format, ui = FORMAT_HUMAN, humanRenderer{} }()
+
+	for format, want := range map[string]string{
+		FORMAT_HUMAN: "main.humanRenderer",
+		FORMAT_PLAIN: "main.plainRenderer",
+		FORMAT_JSON:  "main.jsonRenderer",
+	} {
+		Format = format
+		if err := checkFormat(); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%T", ui); got != want {
+			t.Errorf("--format %s renders with %s", format, got)
+		}
+	}
+
+	Format = "yaml"
+	if err := checkFormat(); err == nil {
+		t.Error("--format yaml was accepted")
+	}
+}
+
+func jsonLines(t *testing.T, out *bytes.Buffer) []jsonLine {
+	var lines []jsonLine
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var line jsonLine
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("%q isn't JSON: %v", l, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestJSONRenderer(t *testing.T) {
+	var out bytes.Buffer
+	r := newJSONRenderer(&out)
+
+	r.Printf("Upload ID: %s\n", "upload-1")
+	r.Println()
+	r.Println("Etags match!")
+	r.Error(errors.New("boom"))
+	fmt.Fprint(r.Writer(), "a table\nof two lines\n")
+
+	lines := jsonLines(t, &out)
+	want := []jsonLine{
+		{Message: "Upload ID: upload-1"},
+		{Message: "Etags match!"},
+		{Error: "boom"},
+		{Message: "a table"},
+		{Message: "of two lines"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %+v", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	var out bytes.Buffer
+	bar := newJSONRenderer(&out).ByteBar(100, "uploading")
+
+	// The first update is reported, the next ones only once a while has
+	// passed or it's complete.
+	bar.Add(10)
+	bar.Add(10)
+	bar.Set64(100)
+
+	lines := jsonLines(t, &out)
+	if len(lines) != 2 {
+		t.Fatalf("got %+v", lines)
+	}
+	if l := lines[1]; l.Progress != "uploading" || l.Done == nil || *l.Done != 100 || l.Total == nil || *l.Total != 100 {
+		t.Errorf("the last update is %+v", l)
+	}
+}
+
+func TestReportingBar(t *testing.T) {
+	var lines []string
+	bar := newReportingBar(4*MiB, "uploading", true, func(line string) { lines = append(lines, line) })
+
+	bar.Write(make([]byte, MiB))
+	bar.Describe("uploading, compressed to 40%")
+	bar.Add(3 * MiB)
+
+	want := []string{
+		"uploading: 1.0 MiB of 4.0 MiB (25%)",
+		"uploading, compressed to 40%: 4.0 MiB of 4.0 MiB (100%)",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reported %q", lines)
+	}
+
+	steps := newReportingBar(-1, "", false, nil)
+	steps.done = 7
+	if s := steps.String(); s != "7" {
+		t.Errorf("unknown total reads %q", s)
+	}
+}
+
+func TestReportingBarConcurrentAdds(t *testing.T) {
+	bar := newReportingBar(-1, "", false, func(string) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				bar.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if bar.done != 8000 {
+		t.Errorf("counted %d of 8000", bar.done)
+	}
+}
+
+func TestJSONUploadEvents(t *testing.T) {
+	var out bytes.Buffer
+	ui = newJSONRenderer(&out)
+	defer func() { ui = humanRenderer{} }()
+
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1024)
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var started uploadStartedEvent
+	var parts []partDoneEvent
+	var done uploadDoneEvent
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event struct {
+			Event string `json:"event"`
+		}
+		json.Unmarshal([]byte(l), &event)
+		switch event.Event {
+		case "upload_started":
+			json.Unmarshal([]byte(l), &started)
+		case "part_done":
+			var part partDoneEvent
+			json.Unmarshal([]byte(l), &part)
+			parts = append(parts, part)
+		case "upload_done":
+			json.Unmarshal([]byte(l), &done)
+		}
+	}
+
+	if started.UploadID == "" || started.Key != "archive.bin" || started.Parts != 2 || started.Size != int64(len(data)) {
+		t.Errorf("started: %+v", started)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("parts: %+v", parts)
+	}
+	for _, part := range parts {
+		if part.ETag == "" || part.Source != "sent" || (part.Part == 2 && part.Offset != PART_SIZE) {
+			t.Errorf("part: %+v", part)
+		}
+	}
+	if done.UploadID != started.UploadID || done.Location == "" || !done.Verified || done.Size != int64(len(data)) {
+		t.Errorf("done: %+v", done)
+	}
+
+	// Nothing is checked with --verify none, and the event says so.
+	defer func() { VerifyUpload, Force = VERIFY_MD5, false }()
+	VerifyUpload, Force = VERIFY_NONE, true
+	out.Reset()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	done = uploadDoneEvent{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &done)
+	if done.Event != "upload_done" || done.Verified {
+		t.Errorf("done with --verify none: %+v", done)
+	}
+}
@@ -0,0 +1,93 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ownDirs are our own directories, which are never uploaded from inside a
+// source tree: the state dir, with the journals, the caches and the
+// catalog, and the temp dir, where archives and dumps are spooled.  A tree
+// with one of them inside would otherwise archive its own archiving, a bit
+// more on every run.
+var ownDirs struct {
+	once sync.Once
+	mu   sync.Mutex
+	// paths are the directories, cleaned and absolute, with what they are.
+	paths  map[string]string
+	warned map[string]bool
+}
+
+func loadOwnDirs() {
+	ownDirs.paths = map[string]string{}
+	ownDirs.warned = map[string]bool{}
+	if dir, err := stateDir(); err == nil {
+		addOwnDir(dir, "state and catalog")
+	}
+	addOwnDir(os.TempDir(), "temporary files")
+}
+
+func addOwnDir(dir string, what string) {
+	if abs, err := filepath.Abs(shortPath(dir)); err == nil {
+		ownDirs.paths[abs] = what
+	}
+}
+
+// isOwnDir tells whether the directory p is one of ours, and warns the first
+// time it comes across it.
+func isOwnDir(p string) bool {
+	ownDirs.once.Do(loadOwnDirs)
+	abs, err := filepath.Abs(shortPath(p))
+	if err != nil {
+		return false
+	}
+
+	ownDirs.mu.Lock()
+	defer ownDirs.mu.Unlock()
+	what, ok := ownDirs.paths[abs]
+	if ok && !ownDirs.warned[abs] {
+		ownDirs.warned[abs] = true
+		warn(WARNING_SKIPPED, p, "Leaving out %s, it's where s3-glacier-uploader keeps its %s", shortPath(p), what)
+	}
+	return ok
+}
+
+// guardSnapshot makes the copies of our directories in a snapshot of src
+// ours too.
+func guardSnapshot(src string, snapshot string) {
+	ownDirs.once.Do(loadOwnDirs)
+	root, err := filepath.Abs(shortPath(src))
+	if err != nil {
+		return
+	}
+
+	ownDirs.mu.Lock()
+	defer ownDirs.mu.Unlock()
+	for dir, what := range ownDirs.paths {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if abs, err := filepath.Abs(shortPath(filepath.Join(snapshot, rel))); err == nil {
+			ownDirs.paths[abs] = what
+		}
+	}
+}
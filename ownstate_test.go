@@ -0,0 +1,56 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnDirsLeftOut(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.jpg":                "a",
+		"state/catalog.jsonl":  "{}",
+		"states/b.jpg":         "bb",
+		"snapshot/state/x.bin": "x",
+	})
+	ownDirs.once.Do(loadOwnDirs)
+	ownDirs.mu.Lock()
+	addOwnDir(filepath.Join(dir, "state"), "state and catalog")
+	ownDirs.mu.Unlock()
+
+	files, err := scanDirectory(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	if len(keys) != 3 || keys[0] != "a.jpg" || keys[1] != "snapshot/state/x.bin" || keys[2] != "states/b.jpg" {
+		t.Errorf("scanned %q", keys)
+	}
+
+	// In a snapshot of the tree, its copy is left out too.
+	guardSnapshot(dir, filepath.Join(dir, "snapshot"))
+	if !isOwnDir(filepath.Join(dir, "snapshot", "state")) {
+		t.Error("the copy of the state dir in the snapshot isn't left out")
+	}
+	if isOwnDir(filepath.Join(dir, "states")) || isOwnDir(dir) {
+		t.Error("left out a directory which isn't ours")
+	}
+}
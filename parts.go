@@ -0,0 +1,277 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// parts flags
+var (
+	PartsKey      string
+	PartsUploadID string
+)
+
+var partsCmd = &cobra.Command{
+	Use:   "parts",
+	Short: "Look into and repair the parts of unfinished uploads",
+}
+
+var partsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the parts S3 has of an upload",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return PartsList(ui.Writer(), newS3Session(Region), BucketName, PartsKey, PartsUploadID)
+	},
+}
+
+var partsDiffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Compare the parts S3 has of an upload with its journal here",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return PartsDiff(ui.Writer(), newS3Session(Region), BucketName, PartsKey, PartsUploadID)
+	},
+}
+
+var partsRepairCmd = &cobra.Command{
+	Use:   "repair [file]",
+	Short: "Drop journal entries of parts S3 doesn't have, then upload the missing parts and complete the upload",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var filename string
+		if len(args) > 0 {
+			filename = args[0]
+		}
+		return PartsRepair(newS3Session(Region), lazyCleanup(Region), BucketName, filename, PartsKey, PartsUploadID)
+	},
+}
+
+// resolveUpload fills in what wasn't given of an upload's key and ID: the ID
+// from the journal of the key, the key by listing the uploads.
+func resolveUpload(s3session s3iface.S3API, bucket string, key string, uploadID string) (string, string, error) {
+	if uploadID == "" {
+		if key == "" {
+			return "", "", fmt.Errorf("Tell us which upload with --upload-id or --key")
+		}
+		journal, err := loadJournal(bucket, key)
+		if err != nil {
+			return "", "", err
+		}
+		if journal == nil {
+			return "", "", fmt.Errorf("There's no journal of an upload to %s here, give its --upload-id", key)
+		}
+		return key, journal.UploadID, nil
+	}
+
+	if key == "" {
+		var err error
+		if key, err = findUploadKey(s3session, bucket, uploadID); err != nil {
+			return "", "", err
+		}
+	}
+	return key, uploadID, nil
+}
+
+func sortedPartNumbers(parts map[int64]*s3.Part) []int64 {
+	var numbers []int64
+	for n := range parts {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+// PartsList prints the parts S3 has of an upload, in order, with gaps
+// pointed out.
+func PartsList(w io.Writer, s3session s3iface.S3API, bucket string, key string, uploadID string) error {
+	key, uploadID, err := resolveUpload(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	parts, err := listUploadedParts(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	var last int64
+	for _, n := range sortedPartNumbers(parts) {
+		part := parts[n]
+		if n > last+1 {
+			fmt.Fprintf(w, "%5s (parts %d to %d missing)\n", "", last+1, n-1)
+		}
+		line := fmt.Sprintf("%5d %10s %s", n, formatBytes(aws.Int64Value(part.Size)), strings.Trim(aws.StringValue(part.ETag), "\""))
+		if part.ChecksumSHA256 != nil {
+			line += " sha256 " + *part.ChecksumSHA256
+		}
+		if part.LastModified != nil {
+			line += " " + part.LastModified.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintln(w, line)
+		size += aws.Int64Value(part.Size)
+		last = n
+	}
+	fmt.Fprintf(w, "\n%s of %s, upload ID %s: %d parts, %s\n", bucket, key, uploadID, len(parts), formatBytes(size))
+	return nil
+}
+
+// partDiff is a part which S3 and the journal disagree about.
+type partDiff struct {
+	Number  int64
+	Problem string
+	// Orphaned parts are journaled, but S3 doesn't have them as journaled.
+	Orphaned bool
+}
+
+// diffParts compares the journal of an upload with what S3 has of it.
+func diffParts(journal *uploadJournal, parts map[int64]*s3.Part) []partDiff {
+	var diffs []partDiff
+	journaled := map[int64]bool{}
+	for _, p := range journal.Parts {
+		journaled[p.Number] = true
+		part, ok := parts[p.Number]
+		switch {
+		case !ok:
+			diffs = append(diffs, partDiff{p.Number, "journaled, but S3 doesn't have it", true})
+		case strings.Trim(aws.StringValue(part.ETag), "\"") != strings.Trim(p.ETag, "\""):
+			diffs = append(diffs, partDiff{p.Number, fmt.Sprintf("journaled with ETag %s, S3 has %s", strings.Trim(p.ETag, "\""), strings.Trim(aws.StringValue(part.ETag), "\"")), true})
+		case aws.Int64Value(part.Size) != p.Size:
+			diffs = append(diffs, partDiff{p.Number, fmt.Sprintf("journaled with %d bytes, S3 has %d", p.Size, aws.Int64Value(part.Size)), true})
+		}
+	}
+	for _, n := range sortedPartNumbers(parts) {
+		if !journaled[n] {
+			diffs = append(diffs, partDiff{n, "S3 has it, but it isn't journaled", false})
+		}
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool { return diffs[i].Number < diffs[j].Number })
+	return diffs
+}
+
+// uploadJournalFor loads the journal of key, if it's of this upload.
+func uploadJournalFor(bucket string, key string, uploadID string) (*uploadJournal, error) {
+	journal, err := loadJournal(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if journal == nil {
+		return nil, fmt.Errorf("There's no journal of an upload to %s here", key)
+	}
+	if journal.UploadID != uploadID {
+		return nil, fmt.Errorf("The journal here is of the upload %s to %s, not %s", journal.UploadID, key, uploadID)
+	}
+	return journal, nil
+}
+
+// PartsDiff prints where the journal of an upload and S3 disagree, and fails
+// if they do.
+func PartsDiff(w io.Writer, s3session s3iface.S3API, bucket string, key string, uploadID string) error {
+	key, uploadID, err := resolveUpload(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	journal, err := uploadJournalFor(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	parts, err := listUploadedParts(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	diffs := diffParts(journal, parts)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%5d %s\n", d.Number, d.Problem)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("The journal and S3 disagree about %d parts, parts repair fixes that", len(diffs))
+	}
+	fmt.Fprintf(w, "The journal and S3 agree about all %d parts\n", len(parts))
+	return nil
+}
+
+// PartsRepair drops what the journal says about parts S3 doesn't have, then
+// resumes the upload, which checks the parts S3 has against the file, sends
+// the missing ones and completes it.
+func PartsRepair(s3session s3iface.S3API, cleanup cleanupSession, bucket string, filename string, key string, uploadID string) error {
+	if key == "" && uploadID == "" && filename != "" {
+		var err error
+		if key, err = uploadKey(filename); err != nil {
+			return err
+		}
+	}
+	key, uploadID, err := resolveUpload(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	parts, err := listUploadedParts(s3session, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	journal, err := uploadJournalFor(bucket, key, uploadID)
+	if err != nil && filename == "" {
+		return fmt.Errorf("%w, tell us which file it's an upload of", err)
+	}
+	if journal != nil {
+		if filename == "" {
+			filename = journal.Filename
+		}
+
+		orphaned := map[int64]bool{}
+		for _, d := range diffParts(journal, parts) {
+			if d.Orphaned {
+				orphaned[d.Number] = true
+			}
+		}
+		if len(orphaned) > 0 {
+			var kept []journaledPart
+			for _, p := range journal.Parts {
+				if !orphaned[p.Number] {
+					kept = append(kept, p)
+				}
+			}
+			journal.Parts = kept
+			if err := journal.Save(); err != nil {
+				return err
+			}
+			ui.Printf("Dropped %d journal entries of parts S3 doesn't have\n", len(orphaned))
+		}
+	}
+
+	return uploadObject(s3session, cleanup, bucket, filename, key, uploadID)
+}
+
+func init() {
+	partsCmd.PersistentFlags().StringVar(&PartsKey, "key", "", "the key of the upload, looked up if not given")
+	partsCmd.PersistentFlags().StringVar(&PartsUploadID, "upload-id", "", "the upload, taken from the journal of --key if not given")
+	partsCmd.AddCommand(partsListCmd)
+	partsCmd.AddCommand(partsDiffCmd)
+	partsCmd.AddCommand(partsRepairCmd)
+	rootCmd.AddCommand(partsCmd)
+}
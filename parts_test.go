@@ -0,0 +1,126 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDiffParts(t *testing.T) {
+	journal := &uploadJournal{Parts: []journaledPart{
+		{Number: 1, ETag: `"aaa"`, Size: 10},
+		{Number: 2, ETag: `"bbb"`, Size: 10},
+		{Number: 3, ETag: `"ccc"`, Size: 10},
+		{Number: 5, ETag: `"eee"`, Size: 10},
+	}}
+	parts := map[int64]*s3.Part{
+		1: {PartNumber: aws.Int64(1), ETag: aws.String(`"aaa"`), Size: aws.Int64(10)},
+		2: {PartNumber: aws.Int64(2), ETag: aws.String(`"xxx"`), Size: aws.Int64(10)},
+		4: {PartNumber: aws.Int64(4), ETag: aws.String(`"ddd"`), Size: aws.Int64(10)},
+		5: {PartNumber: aws.Int64(5), ETag: aws.String(`"eee"`), Size: aws.Int64(7)},
+	}
+
+	want := []partDiff{
+		{2, "journaled with ETag bbb, S3 has xxx", true},
+		{3, "journaled, but S3 doesn't have it", true},
+		{4, "S3 has it, but it isn't journaled", false},
+		{5, "journaled with 10 bytes, S3 has 7", true},
+	}
+	if got := diffParts(journal, parts); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPartsListAndDiff(t *testing.T) {
+	filename := writeTestFile(t, randomData(3*PART_SIZE))
+	fake := interruptedUpload(t, filename)
+
+	var out bytes.Buffer
+	if err := PartsList(&out, fake, "bucket", "archive.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "upload ID upload-1: 2 parts, 100.0 MiB") {
+		t.Errorf("got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := PartsDiff(&out, fake, "bucket", "", "upload-1"); err != nil {
+		t.Errorf("%v:\n%s", err, out.String())
+	}
+
+	delete(fake.uploads["upload-1"].parts, 1)
+	out.Reset()
+	if err := PartsList(&out, fake, "bucket", "archive.bin", "upload-1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "(parts 1 to 1 missing)") {
+		t.Errorf("the gap isn't shown:\n%s", out.String())
+	}
+
+	out.Reset()
+	err := PartsDiff(&out, fake, "bucket", "archive.bin", "")
+	if err == nil || !strings.Contains(out.String(), "1 journaled, but S3 doesn't have it") {
+		t.Errorf("%v:\n%s", err, out.String())
+	}
+}
+
+func TestPartsRepair(t *testing.T) {
+	data := randomData(3*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := interruptedUpload(t, filename)
+
+	// S3 lost a part the journal has.
+	delete(fake.uploads["upload-1"].parts, 2)
+	missing := 4 - len(fake.uploads["upload-1"].parts)
+
+	if err := PartsRepair(fake.fakeS3, fake.cleanup, "bucket", "", "archive.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the repaired upload doesn't contain the file")
+	}
+	if fake.partUploads != missing {
+		t.Errorf("uploaded %d parts, want the %d S3 didn't have", fake.partUploads, missing)
+	}
+	if journal, _ := loadJournal("bucket", "archive.bin"); journal != nil {
+		t.Error("the journal is still there after the upload finished")
+	}
+}
+
+func TestResolveUpload(t *testing.T) {
+	fake := newFakeS3()
+	fake.uploads["upload-7"] = &fakeUpload{key: "a.tar", parts: map[int64][]byte{}}
+
+	if key, id, err := resolveUpload(fake, "bucket", "", "upload-7"); err != nil || key != "a.tar" || id != "upload-7" {
+		t.Errorf("got %s, %s, %v", key, id, err)
+	}
+	if _, _, err := resolveUpload(fake, "bucket", "", "upload-8"); err == nil {
+		t.Error("an unknown upload was found")
+	}
+	if _, _, err := resolveUpload(fake, "bucket", "a.tar", ""); err == nil || !strings.Contains(err.Error(), "no journal") {
+		t.Errorf("without a journal: %v", err)
+	}
+	if _, _, err := resolveUpload(fake, "bucket", "", ""); err == nil {
+		t.Error("nothing was accepted")
+	}
+}
@@ -0,0 +1,134 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/honza/s3-glacier-uploader/pkg/uploader"
+)
+
+// CLI flags
+var PartSize string
+
+const (
+	PART_SIZE_AUTO = "auto"
+	MAX_PART_SIZE  = uploader.MaxPartSize
+)
+
+func checkPartSize() error {
+	_, err := configuredPartSize()
+	return err
+}
+
+// configuredPartSize is the part size given with --part-size, or 0 for auto.
+func configuredPartSize() (int64, error) {
+	if PartSize == PART_SIZE_AUTO {
+		return 0, nil
+	}
+	size, err := parseSize(PartSize)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid --part-size: %w", err)
+	}
+	if size < MIN_PART_SIZE || size > MAX_PART_SIZE {
+		return 0, fmt.Errorf("--part-size must be between %s and %s, or auto", formatBytes(MIN_PART_SIZE), formatBytes(MAX_PART_SIZE))
+	}
+	if err := checkPartBuffer(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// PART_SIZE_METADATA is where an object's part size is kept, so that
+// verify can recompute its ETag without guessing how it was split.
+const PART_SIZE_METADATA = "part-size"
+
+// partSizeMetadata adds the part size to the object's metadata.
+func partSizeMetadata(metadata map[string]*string, partSize int64) map[string]*string {
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	metadata[PART_SIZE_METADATA] = aws.String(strconv.FormatInt(partSize, 10))
+	return metadata
+}
+
+// recordedPartSize is the part size partSizeMetadata recorded, or 0 for
+// objects uploaded before we did, or by other tools.
+func recordedPartSize(metadata map[string]*string) int64 {
+	value, _ := metadataValue(metadata, PART_SIZE_METADATA)
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0
+	}
+	return size
+}
+
+// autoPartSize is the part size for size bytes, see uploader.AutoPartSize.
+func autoPartSize(size int64) int64 {
+	return uploader.AutoPartSize(size)
+}
+
+// filePartSize picks the part size for uploading size bytes, the one from
+// --part-size or an automatic one, and makes sure S3 takes that many parts.
+func filePartSize(size int64) (int, error) {
+	partSize, err := configuredPartSize()
+	if err != nil {
+		return 0, err
+	}
+	if partSize == 0 {
+		partSize = autoPartSize(size)
+	}
+	if err := checkPartCount(size, partSize); err != nil {
+		return 0, err
+	}
+	if err := checkPartBuffer(partSize); err != nil {
+		return 0, err
+	}
+	return int(partSize), nil
+}
+
+// checkPartBuffer makes sure a part fits in a buffer, which on 32 bit
+// platforms holds less than the largest part S3 takes.
+func checkPartBuffer(partSize int64) error {
+	if int64(int(partSize)) != partSize {
+		return fmt.Errorf("Parts of %s don't fit in memory on this platform", formatBytes(partSize))
+	}
+	return nil
+}
+
+func checkPartCount(size int64, partSize int64) error {
+	if partSize > MAX_PART_SIZE {
+		return fmt.Errorf("%s is too large for S3, which takes at most %d parts of %s", formatBytes(size), MAX_PARTS, formatBytes(MAX_PART_SIZE))
+	}
+	if parts := (size + partSize - 1) / partSize; parts > MAX_PARTS {
+		return fmt.Errorf("%s in %s parts makes %d parts, more than the %d S3 takes; use a larger --part-size, or auto", formatBytes(size), formatBytes(partSize), parts, MAX_PARTS)
+	}
+	return nil
+}
+
+// streamPartSize picks the part size for a stream of about expected bytes,
+// or of unknown size if expected is 0.  As the parts are cut before the size
+// is known, automatic ones leave room for the stream to grow.
+func streamPartSize(expected int64) int {
+	// Checked in checkPartSize already.
+	if partSize, _ := configuredPartSize(); partSize > 0 {
+		return int(partSize)
+	}
+	return dumpPartSize(expected)
+}
@@ -0,0 +1,156 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfiguredPartSize(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+
+	for spec, want := range map[string]int64{
+		PART_SIZE_AUTO: 0,
+		"128M":         128 * MiB,
+		"5MiB":         5 * MiB,
+		"5G":           5 * 1024 * MiB,
+	} {
+		PartSize = spec
+		if got, err := configuredPartSize(); err != nil || got != want {
+			t.Errorf("--part-size %s: got %d, %v, want %d", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"4M", "6G", "lots", ""} {
+		PartSize = spec
+		if err := checkPartSize(); err == nil {
+			t.Errorf("--part-size %q was accepted", spec)
+		}
+	}
+}
+
+func TestAutoPartSize(t *testing.T) {
+	for size, want := range map[int64]int64{
+		0:                         PART_SIZE,
+		1024:                      PART_SIZE,
+		MAX_PARTS * PART_SIZE:     PART_SIZE,
+		MAX_PARTS*PART_SIZE + 1:   PART_SIZE + MiB,
+		2 * 1024 * 1024 * MiB:     210 * MiB,
+		MAX_PARTS * MAX_PART_SIZE: MAX_PART_SIZE,
+	} {
+		got := autoPartSize(size)
+		if got != want {
+			t.Errorf("autoPartSize(%d) = %d, want %d", size, got, want)
+		}
+		if (size+got-1)/got > MAX_PARTS {
+			t.Errorf("autoPartSize(%d) = %d makes too many parts", size, got)
+		}
+	}
+}
+
+func TestFilePartSize(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+
+	if _, err := filePartSize(MAX_PARTS*MAX_PART_SIZE + 1); err == nil {
+		t.Error("a file too large for S3 was accepted")
+	}
+
+	PartSize = "8M"
+	if got, err := filePartSize(100 * MiB); err != nil || got != 8*MiB {
+		t.Errorf("got %d, %v, want --part-size", got, err)
+	}
+	if _, err := filePartSize(MAX_PARTS*8*MiB + 1); err == nil || !strings.Contains(err.Error(), "larger --part-size") {
+		t.Errorf("too many parts: %v", err)
+	}
+
+	if got := streamPartSize(1024 * 1024 * MiB); got != 8*MiB {
+		t.Errorf("streams got %d byte parts, want --part-size", got)
+	}
+	PartSize = PART_SIZE_AUTO
+	if got := streamPartSize(0); got != PART_SIZE {
+		t.Errorf("streams of unknown size got %d byte parts, want %d", got, PART_SIZE)
+	}
+}
+
+func TestUploadWithPartSize(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+	PartSize = "5M"
+
+	fake := newFakeS3()
+	data := randomData(12 * MiB)
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["archive.bin"]
+	if obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("the object doesn't contain the file")
+	}
+	want := []int64{5 * MiB, 5 * MiB, 2 * MiB}
+	if len(obj.partSizes) != len(want) || obj.partSizes[0] != want[0] || obj.partSizes[2] != want[2] {
+		t.Errorf("uploaded in parts of %v, want %v", obj.partSizes, want)
+	}
+}
+
+func TestUploadWithBaseFollowsItsPartSize(t *testing.T) {
+	defer func() { PartSize, PartManifest, BaseKey = PART_SIZE_AUTO, false, "" }()
+
+	fake := newFakeS3()
+	data := randomData(12 * MiB)
+	filename := writeTestFile(t, data)
+
+	PartSize, PartManifest = "5M", true
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["archive.bin"].restored = true
+
+	changed := append([]byte{}, data...)
+	changed[6*MiB] ^= 0xff
+	if err := os.WriteFile(filename, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	BaseKey = "archive.bin"
+	PartSize = "8M"
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err == nil {
+		t.Error("a --part-size other than the base's was accepted")
+	}
+
+	PartSize = PART_SIZE_AUTO
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.copies != 2 {
+		t.Errorf("copied %d parts, want the 2 unchanged ones", fake.copies)
+	}
+}
+
+func TestResumeWithOtherPartSize(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+
+	filename := writeTestFile(t, randomData(3*PART_SIZE))
+	fake := interruptedUpload(t, filename)
+
+	PartSize = "10M"
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "upload-1")
+	if err == nil || !strings.Contains(err.Error(), "--part-size 52428800") {
+		t.Errorf("got %v, want a hint about --part-size", err)
+	}
+}
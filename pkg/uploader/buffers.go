@@ -0,0 +1,28 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import "github.com/honza/s3-glacier-uploader/internal/transfer"
+
+// BufferPool hands out up to n buffers of a part size, allocating them only
+// when they're first needed.  Taking one blocks while all n are in use, which
+// is what bounds the memory an upload takes.
+type BufferPool = transfer.BufferPool
+
+func NewBufferPool(n int, size int) *BufferPool {
+	return transfer.NewBufferPool(n, size)
+}
@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Errors which won't go away no matter how often we retry: the credentials
+// or permissions are wrong, or the upload itself is gone.
+var systemicErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"NoSuchBucket":          true,
+	"NoSuchUpload":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// CircuitBreaker stops an upload once an error we know retrying won't fix
+// comes back, instead of burning through the remaining attempts.  A nil one
+// never trips.
+type CircuitBreaker struct {
+	mu      sync.Mutex
+	tripped error
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{}
+}
+
+// Allow returns an error once the breaker has tripped.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tripped
+}
+
+// Failure trips the breaker if err is one of those retrying won't fix.
+func (b *CircuitBreaker) Failure(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tripped != nil {
+		return
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && systemicErrorCodes[aerr.Code()] {
+		b.tripped = fmt.Errorf("Giving up, this won't fix itself by retrying: %w", err)
+	}
+}
@@ -0,0 +1,64 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.Failure(awserr.New("InternalError", "We encountered an internal error", nil))
+	b.Failure(errors.New("connection reset by peer"))
+	if err := b.Allow(); err != nil {
+		t.Fatalf("tripped by errors a retry may fix: %v", err)
+	}
+
+	denied := awserr.New("AccessDenied", "Access Denied", nil)
+	b.Failure(denied)
+	b.Failure(awserr.New("NoSuchBucket", "The specified bucket does not exist", nil))
+	if err := b.Allow(); !errors.Is(err, denied) {
+		t.Errorf("got %v, want the first systemic error", err)
+	}
+
+	// A nil breaker lets everything through.
+	var none *CircuitBreaker
+	none.Failure(denied)
+	if err := none.Allow(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCircuitBreakerStopsRetries(t *testing.T) {
+	var attempts int
+	u := New(newFakeS3(), WithRetries(5, func(int, error) time.Duration {
+		t.Error("waited to retry")
+		return 0
+	}))
+	err := u.attempt(context.Background(), NewCircuitBreaker(), 1, func(ctx context.Context) (bool, error) {
+		attempts++
+		return false, awserr.New("ExpiredToken", "The provided token has expired", nil)
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("%d attempts despite an expired token: %v", attempts, err)
+	}
+}
@@ -0,0 +1,100 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+// EventHandler is told what an upload does, part by part, e.g. to drive a
+// progress bar or metrics of its own.  Apart from OnStart and OnComplete,
+// its methods are called from the goroutines uploading the parts, so they
+// have to be safe for that, and quick, as the part waits for them.
+type EventHandler interface {
+	// OnStart is called once the upload exists, with how many parts it
+	// takes.
+	OnStart(uploadID string, parts int, size int64)
+	// OnPartStart is called before a part is sent, or copied from the
+	// Base.  Parts S3 has already aren't started.
+	OnPartStart(part Part)
+	// OnPartDone is called for every part S3 has, resumed ones included.
+	OnPartDone(part Part)
+	// OnRetry is called for every failed attempt at part number which is
+	// tried again.  stalled is whether it was cancelled for stalling.
+	OnRetry(number int, err error, stalled bool)
+	// OnComplete is called once an upload which was started ends, with
+	// its result or why it failed.
+	OnComplete(result *Result, err error)
+}
+
+// WithEvents tells h about the uploads.  Given more than once, or with
+// WithProgress, every handler is told, in the order they were given.
+func WithEvents(h EventHandler) Option {
+	return func(u *Uploader) { u.events = append(u.events, h) }
+}
+
+// events is the EventHandlers of an Uploader, told one after the other.
+type events []EventHandler
+
+func (e events) OnStart(uploadID string, parts int, size int64) {
+	for _, h := range e {
+		h.OnStart(uploadID, parts, size)
+	}
+}
+
+func (e events) OnPartStart(part Part) {
+	for _, h := range e {
+		h.OnPartStart(part)
+	}
+}
+
+func (e events) OnPartDone(part Part) {
+	for _, h := range e {
+		h.OnPartDone(part)
+	}
+}
+
+func (e events) OnRetry(number int, err error, stalled bool) {
+	for _, h := range e {
+		h.OnRetry(number, err, stalled)
+	}
+}
+
+func (e events) OnComplete(result *Result, err error) {
+	for _, h := range e {
+		h.OnComplete(result, err)
+	}
+}
+
+// progressEvents tells a Progress the events it takes.
+type progressEvents struct {
+	p Progress
+}
+
+func (e progressEvents) OnStart(uploadID string, parts int, size int64) {
+	e.p.Started(uploadID, parts, size)
+}
+
+func (e progressEvents) OnPartStart(part Part) {}
+
+func (e progressEvents) OnPartDone(part Part) {
+	if recorder, ok := e.p.(PartRecorder); ok {
+		recorder.PartRecorded(part)
+	} else {
+		e.p.PartDone(part.Number, part.Size, part.Source == PartResumed)
+	}
+}
+
+func (e progressEvents) OnRetry(number int, err error, stalled bool) {}
+
+func (e progressEvents) OnComplete(result *Result, err error) {}
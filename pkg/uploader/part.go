@@ -0,0 +1,166 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// UploadPart sends part number of the upload uploadID, retrying it as the
+// Uploader was told to, and returns what CompleteMultipartUpload needs of it.
+// It's for callers cutting the parts themselves, e.g. of a stream.
+func (u *Uploader) UploadPart(ctx context.Context, bucket string, key string, uploadID string, number int, data []byte) (*s3.CompletedPart, error) {
+	return u.sendPart(ctx, u.breaker, bucket, key, uploadID, number, data)
+}
+
+// CopyPart fills in part number of the upload uploadID with length bytes at
+// offset of sourceKey, without sending them again.  Given sourceETag, S3
+// refuses the copy when the source has been replaced in the meantime.
+func (u *Uploader) CopyPart(ctx context.Context, bucket string, key string, uploadID string, number int, sourceKey string, sourceETag string, offset int64, length int64) (*s3.CompletedPart, error) {
+	return u.copyPart(ctx, u.breaker, bucket, key, uploadID, number, bucket, sourceKey, sourceETag, offset, length)
+}
+
+// CopyPartFrom is CopyPart with the source in sourceBucket, which can be
+// another bucket than the upload's.
+func (u *Uploader) CopyPartFrom(ctx context.Context, bucket string, key string, uploadID string, number int, sourceBucket string, sourceKey string, sourceETag string, offset int64, length int64) (*s3.CompletedPart, error) {
+	return u.copyPart(ctx, u.breaker, bucket, key, uploadID, number, sourceBucket, sourceKey, sourceETag, offset, length)
+}
+
+func (u *Uploader) sendPart(ctx context.Context, breaker *CircuitBreaker, bucket string, key string, uploadID string, number int, data []byte) (*s3.CompletedPart, error) {
+	var checksum *string
+	if u.checksumAlgorithm != "" {
+		sum := sha256.Sum256(data)
+		checksum = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	var part *s3.CompletedPart
+	err := u.attempt(ctx, breaker, number, func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		body := newStallReader(bytes.NewReader(data))
+		stop := watchStall(body, u.stallTimeout, u.speedFloor, cancel)
+
+		resp, err := u.s3.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:         aws.String(bucket),
+			Key:            aws.String(key),
+			UploadId:       aws.String(uploadID),
+			PartNumber:     aws.Int64(int64(number)),
+			Body:           body,
+			ContentLength:  aws.Int64(int64(len(data))),
+			ChecksumSHA256: checksum,
+		})
+		if stalled := stop(); stalled != nil {
+			// Cancelling the request closed its connection, the next
+			// attempt gets a new one.
+			return true, fmt.Errorf("Part %d: %v", number, stalled)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// With a Verify of its own, the ETags may not be MD5 digests,
+		// e.g. with SSE-KMS.
+		if u.verify == nil {
+			if got, sent := strings.Trim(aws.StringValue(resp.ETag), "\""), fmt.Sprintf("%x", md5.Sum(data)); got != sent {
+				return false, fmt.Errorf("S3 got part %d with ETag %s, we sent %s", number, got, sent)
+			}
+		}
+		part = &s3.CompletedPart{
+			ETag:           resp.ETag,
+			PartNumber:     aws.Int64(int64(number)),
+			ChecksumSHA256: resp.ChecksumSHA256,
+		}
+		return false, nil
+	})
+	return part, err
+}
+
+func (u *Uploader) copyPart(ctx context.Context, breaker *CircuitBreaker, bucket string, key string, uploadID string, number int, sourceBucket string, sourceKey string, sourceETag string, offset int64, length int64) (*s3.CompletedPart, error) {
+	input := &s3.UploadPartCopyInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		PartNumber:      aws.Int64(int64(number)),
+		CopySource:      aws.String((&url.URL{Path: sourceBucket + "/" + sourceKey}).EscapedPath()),
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	if sourceETag != "" {
+		input.CopySourceIfMatch = aws.String(`"` + sourceETag + `"`)
+	}
+
+	var part *s3.CompletedPart
+	err := u.attempt(ctx, breaker, number, func(ctx context.Context) (bool, error) {
+		resp, err := u.s3.UploadPartCopyWithContext(ctx, input)
+		if err != nil {
+			return false, err
+		}
+		part = &s3.CompletedPart{
+			ETag:           resp.CopyPartResult.ETag,
+			PartNumber:     aws.Int64(int64(number)),
+			ChecksumSHA256: resp.CopyPartResult.ChecksumSHA256,
+		}
+		return false, nil
+	})
+	return part, err
+}
+
+// attempt calls try until it succeeds, or the part has been retried as often
+// as the Uploader allows.  try reports whether the attempt was cancelled
+// because it stalled.
+func (u *Uploader) attempt(ctx context.Context, breaker *CircuitBreaker, number int, try func(ctx context.Context) (bool, error)) error {
+	retrier := &transfer.Retrier{
+		Retries:      u.retries,
+		Delay:        u.retryDelay,
+		StallRetries: u.stallRetries,
+		Breaker:      breaker,
+		OnRetry: func(err error, stalled bool) {
+			u.events.OnRetry(number, err, stalled)
+		},
+	}
+	if u.onFailure != nil {
+		retrier.OnFailure = func(err error, stalled bool) bool {
+			return u.onFailure(number, err, stalled)
+		}
+	}
+
+	return retrier.Do(ctx, func(ctx context.Context, retries int, stalls int) (bool, error) {
+		attemptCtx, end := u.trace(ctx, "attempt", "try", retries, "stalls", stalls)
+		stalled, err := try(attemptCtx)
+		end(err, "stalled", stalled)
+		return stalled, err
+	})
+}
+
+// trace starts a span with the Uploader's Tracer, if it has one.
+func (u *Uploader) trace(ctx context.Context, name string, attributes ...interface{}) (context.Context, func(err error, attributes ...interface{})) {
+	if u.tracer == nil {
+		return ctx, func(error, ...interface{}) {}
+	}
+	return u.tracer(ctx, name, attributes...)
+}
@@ -0,0 +1,129 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallReader remembers when the HTTP client last took some bytes of the
+// request body, and how far into it it got.  Once the kernel's socket buffer
+// is full, reads only happen as fast as the other side acknowledges data, so a
+// reader which hasn't been read from in a long time means a dead connection,
+// and one read from slowly a bad one.
+type stallReader struct {
+	io.ReadSeeker
+	last   int64
+	offset int64
+}
+
+func newStallReader(r io.ReadSeeker) *stallReader {
+	return &stallReader{ReadSeeker: r, last: time.Now().UnixNano()}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&r.last, time.Now().UnixNano())
+		atomic.AddInt64(&r.offset, int64(n))
+	}
+	return n, err
+}
+
+// Seek keeps track of the offset, as the SDK reads the body once to sign it
+// and then goes back to the start to send it.
+func (r *stallReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		atomic.StoreInt64(&r.offset, n)
+	}
+	return n, err
+}
+
+func (r *stallReader) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.last)))
+}
+
+func (r *stallReader) sent() int64 {
+	return atomic.LoadInt64(&r.offset)
+}
+
+// stallCheckInterval is how often watchStall looks at the body.
+var stallCheckInterval = time.Second
+
+// speedFloor is the slowest a part may be sent at: Bytes every Window.  The
+// zero value has no floor.
+type speedFloor struct {
+	Bytes  int64
+	Window time.Duration
+}
+
+func (f speedFloor) perSecond() float64 {
+	return float64(f.Bytes) / f.Window.Seconds()
+}
+
+// watchStall cancels the request once its body has been idle for longer than
+// timeout, if that isn't 0, or less than floor of it was sent in one of its
+// windows.  Call stop when the request is done; it returns why the request was
+// cancelled, or nil if it wasn't.
+func watchStall(body *stallReader, timeout time.Duration, floor speedFloor, cancel context.CancelFunc) (stop func() error) {
+	done := make(chan struct{})
+	var reason atomic.Value
+
+	if timeout > 0 || floor.Bytes > 0 {
+		go func() {
+			ticker := time.NewTicker(stallCheckInterval)
+			defer ticker.Stop()
+
+			windowStart, windowSent := time.Now(), body.sent()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					if timeout > 0 && body.idle() > timeout {
+						reason.Store(fmt.Errorf("Nothing was sent for %s", timeout.Round(time.Second)))
+						cancel()
+						return
+					}
+
+					if floor.Bytes <= 0 || now.Sub(windowStart) < floor.Window {
+						continue
+					}
+					sent := body.sent() - windowSent
+					if sent < floor.Bytes {
+						elapsed := now.Sub(windowStart)
+						reason.Store(fmt.Errorf("Sent at %.0f bytes/s over %s, less than the minimum of %.0f", float64(sent)/elapsed.Seconds(), elapsed.Round(time.Second), floor.perSecond()))
+						cancel()
+						return
+					}
+					windowStart, windowSent = now, body.sent()
+				}
+			}
+		}()
+	}
+
+	return func() error {
+		close(done)
+		err, _ := reason.Load().(error)
+		return err
+	}
+}
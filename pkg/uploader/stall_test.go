@@ -0,0 +1,164 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stallingS3 takes the first stalls parts without reading any of them,
+// until the request is cancelled.
+type stallingS3 struct {
+	*fakeS3
+	stalls int
+}
+
+func (f *stallingS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	stall := f.stalls > 0
+	if stall {
+		f.stalls--
+	}
+	f.mu.Unlock()
+
+	if stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+func shortStallChecks(t *testing.T) {
+	interval := stallCheckInterval
+	stallCheckInterval = 5 * time.Millisecond
+	t.Cleanup(func() { stallCheckInterval = interval })
+}
+
+func TestStallReader(t *testing.T) {
+	body := newStallReader(bytes.NewReader([]byte("data")))
+	time.Sleep(20 * time.Millisecond)
+	if body.idle() < 20*time.Millisecond {
+		t.Errorf("idle for %s after 20ms", body.idle())
+	}
+
+	buf := make([]byte, 2)
+	if _, err := body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if body.idle() >= 20*time.Millisecond {
+		t.Errorf("still idle for %s after a read", body.idle())
+	}
+}
+
+func TestWatchStall(t *testing.T) {
+	shortStallChecks(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := watchStall(newStallReader(bytes.NewReader(nil)), 20*time.Millisecond, speedFloor{}, cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a body nothing was read of wasn't cancelled")
+	}
+	if stop() == nil {
+		t.Error("the cancelled body isn't reported as stalled")
+	}
+
+	// Stopped before the timeout, nothing is cancelled.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop = watchStall(newStallReader(bytes.NewReader(nil)), time.Hour, speedFloor{}, cancel)
+	time.Sleep(20 * time.Millisecond)
+	if stop() != nil || ctx.Err() != nil {
+		t.Error("a body within its timeout was cancelled")
+	}
+}
+
+func TestWatchSpeedFloor(t *testing.T) {
+	shortStallChecks(t)
+
+	// Reading the body to sign it and seeking back doesn't count.
+	body := newStallReader(bytes.NewReader(make([]byte, 1000)))
+	io.Copy(io.Discard, body)
+	body.Seek(0, io.SeekStart)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := watchStall(body, time.Hour, speedFloor{Bytes: 100, Window: 20 * time.Millisecond}, cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a body sent slower than the floor wasn't cancelled")
+	}
+	if err := stop(); err == nil || !strings.Contains(err.Error(), "less than the minimum") {
+		t.Errorf("the slow body was cancelled with %v", err)
+	}
+
+	// A body read fast enough in every window is left alone.
+	body = newStallReader(bytes.NewReader(make([]byte, 1<<20)))
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop = watchStall(body, time.Hour, speedFloor{Bytes: 100, Window: 20 * time.Millisecond}, cancel)
+	buf := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		body.Read(buf)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := stop(); err != nil || ctx.Err() != nil {
+		t.Errorf("a body sent fast enough was cancelled: %v", err)
+	}
+}
+
+func TestUploadPartStalled(t *testing.T) {
+	shortStallChecks(t)
+
+	fake := &stallingS3{fakeS3: newFakeS3(), stalls: 1}
+	created, _ := fake.CreateMultipartUploadWithContext(context.Background(), &s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+
+	var stalls int
+	u := New(fake,
+		WithStallTimeout(20*time.Millisecond, 1),
+		WithFailureHook(func(part int, err error, stalled bool) bool {
+			if stalled {
+				stalls++
+			}
+			return false
+		}))
+
+	// The stalled attempt doesn't count as one of the retries, there
+	// aren't any.
+	if _, err := u.UploadPart(context.Background(), "bucket", "key", *created.UploadId, 1, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if stalls != 1 {
+		t.Errorf("%d stalls reported, want 1", stalls)
+	}
+
+	// With its stall retry used up, the part fails.
+	fake.stalls = 2
+	if _, err := u.UploadPart(context.Background(), "bucket", "key", *created.UploadId, 2, []byte("data")); err == nil {
+		t.Error("a part which stalled twice was uploaded")
+	}
+}
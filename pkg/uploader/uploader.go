@@ -0,0 +1,737 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package uploader uploads files to S3 in parts, the way s3-glacier-uploader
+// does, for programs which would rather embed it than run it.  The command
+// itself uploads with it.
+//
+// It's the core of the command: parts uploaded in parallel, retried when they
+// fail or stall, resuming interrupted uploads, copying unchanged parts from an
+// earlier upload and checking what S3 made of the result.  The command's
+// journal, encryption, hooks and so on aren't part of it.  By default, failed
+// requests are only retried as the S3 client is configured to, see
+// WithRetries.
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+const (
+	DefaultPartSize    = 50 * 1024 * 1024
+	DefaultConcurrency = 4
+	DefaultReadAhead   = 1
+	MinPartSize        = 5 * 1024 * 1024
+	MaxPartSize        = 5 * 1024 * 1024 * 1024
+	MaxParts           = 10000
+)
+
+const mib = 1024 * 1024
+
+// AutoPartSize is the part size for size bytes: DefaultPartSize, or for
+// files too large for MaxParts of those, the smallest number of whole MiB
+// which does it.
+func AutoPartSize(size int64) int64 {
+	partSize := int64(DefaultPartSize)
+	if needed := (size + MaxParts - 1) / MaxParts; needed > partSize {
+		partSize = (needed + mib - 1) / mib * mib
+	}
+	return partSize
+}
+
+// MultipartETag is the ETag S3 gives an object uploaded in parts: the MD5
+// digest of the parts' MD5 digests, one after the other, and the number of
+// parts.
+func MultipartETag(digests []byte, parts int) string {
+	return transfer.MultipartETag(digests, parts)
+}
+
+// Progress is told how an upload goes, more briefly than an EventHandler.
+// PartDone is called from the goroutines uploading the parts, so it has to be
+// safe for that.
+type Progress interface {
+	// Started is called once the upload exists, with how many parts it
+	// takes.
+	Started(uploadID string, parts int, size int64)
+	// PartDone is called for every part S3 has, resumed ones included.
+	PartDone(part int, size int64, resumed bool)
+}
+
+// How a part got to S3.
+type PartSource int
+
+const (
+	PartSent PartSource = iota
+	PartResumed
+	PartCopied
+)
+
+// Part is a part of an upload which S3 has.
+type Part struct {
+	Number int
+	Offset int64
+	Size   int64
+	// MD5 is the digest of the part, in hex.
+	MD5       string
+	Source    PartSource
+	Completed *s3.CompletedPart
+}
+
+// PartRecorder is a Progress which wants to know all about the parts, e.g.
+// to journal them.  PartRecorded is called for it instead of PartDone.
+type PartRecorder interface {
+	Progress
+	PartRecorded(part Part)
+}
+
+// Base is an earlier upload of mostly the same data.  Parts which haven't
+// changed are copied from it on the server side instead of being sent again,
+// which takes parts of the same size.
+type Base struct {
+	Key string
+	// ETag is the object's.  The copies are conditional on it, so that
+	// nothing is copied from an object which has been replaced since.
+	ETag     string
+	Size     int64
+	PartSize int64
+	// Parts are the MD5 digests of its parts, in hex.
+	Parts []string
+}
+
+func (b *Base) matches(part Part) bool {
+	if b == nil || part.Number > len(b.Parts) {
+		return false
+	}
+
+	offset := int64(part.Number-1) * b.PartSize
+	expected := b.PartSize
+	if offset+expected > b.Size {
+		expected = b.Size - offset
+	}
+	return part.Size == expected && b.Parts[part.Number-1] == part.MD5
+}
+
+// Tracer starts a span of an upload's work: "part" for every part and
+// "attempt" for every try at sending one, with attributes as key and value
+// pairs.  The function it returns ends the span, with more attributes.
+type Tracer func(ctx context.Context, name string, attributes ...interface{}) (context.Context, func(err error, attributes ...interface{}))
+
+// Verify checks what S3 made of a completed upload, given the ETag and the
+// parts it should have.
+type Verify func(resp *s3.CompleteMultipartUploadOutput, etag string, parts []*s3.CompletedPart) error
+
+// Uploader uploads files with the options it was made with.  It's safe to
+// use for several uploads at the same time.
+type Uploader struct {
+	s3                s3iface.S3API
+	partSize          int64
+	concurrency       int
+	storageClass      string
+	metadata          map[string]*string
+	tagging           string
+	checksumAlgorithm string
+	sse               string
+	sseKMSKeyID       string
+	events            events
+	base              *Base
+	retries           int
+	retryDelay        func(try int, err error) time.Duration
+	stallTimeout      time.Duration
+	readAhead         int
+	stallRetries      int
+	speedFloor        speedFloor
+	onFailure         func(part int, err error, stalled bool) bool
+	breaker           *CircuitBreaker
+	tracer            Tracer
+	verify            Verify
+}
+
+// Option changes how an Uploader uploads.
+type Option func(u *Uploader)
+
+// WithPartSize sets the size of the parts, instead of AutoPartSize.
+func WithPartSize(size int64) Option {
+	return func(u *Uploader) { u.partSize = size }
+}
+
+// WithConcurrency sets how many parts are uploaded at the same time.  Each
+// one takes a part size of memory, allocated when it's first needed.
+func WithConcurrency(n int) Option {
+	return func(u *Uploader) { u.concurrency = n }
+}
+
+// WithReadAhead reads and hashes up to n parts ahead of those being sent,
+// DefaultReadAhead by default.  Each one takes a part size of memory too, but
+// keeps a slow disk or network filesystem busy while the network is.
+func WithReadAhead(n int) Option {
+	return func(u *Uploader) { u.readAhead = n }
+}
+
+// WithStorageClass sets the storage class, DEEP_ARCHIVE by default.  An
+// empty one leaves it to the server.
+func WithStorageClass(class string) Option {
+	return func(u *Uploader) { u.storageClass = class }
+}
+
+// WithMetadata stores user metadata with the objects.
+func WithMetadata(metadata map[string]string) Option {
+	return func(u *Uploader) { u.metadata = aws.StringMap(metadata) }
+}
+
+// WithTagging tags the objects, given the tags URL encoded like S3 takes
+// them, e.g. "project=x&owner=y".
+func WithTagging(tagging string) Option {
+	return func(u *Uploader) { u.tagging = tagging }
+}
+
+// WithChecksum has S3 store a checksum of every part as well, which is also
+// sent with it.  SHA256 is the only one supported; none is the default.
+func WithChecksum(algorithm string) Option {
+	return func(u *Uploader) { u.checksumAlgorithm = algorithm }
+}
+
+// WithServerSideEncryption has S3 encrypt the objects with sse, AES256 or
+// aws:kms, and with aws:kms the KMS key keyID, unless it's empty.  Without
+// it the bucket's default encryption applies.
+func WithServerSideEncryption(sse string, keyID string) Option {
+	return func(u *Uploader) {
+		u.sse = sse
+		u.sseKMSKeyID = keyID
+	}
+}
+
+// WithProgress reports the progress of uploads to p, like WithEvents does.
+func WithProgress(p Progress) Option {
+	return func(u *Uploader) { u.events = append(u.events, progressEvents{p}) }
+}
+
+// WithBase copies the parts which haven't changed since base from it.
+func WithBase(base *Base) Option {
+	return func(u *Uploader) { u.base = base }
+}
+
+// WithRetries sends a part which failed again, up to retries times, waiting
+// delay(try, err) before the try'th retry.  Best used with the S3 client's
+// own retries off, as they multiply.
+func WithRetries(retries int, delay func(try int, err error) time.Duration) Option {
+	return func(u *Uploader) { u.retries, u.retryDelay = retries, delay }
+}
+
+// WithStallTimeout cancels a part once none of it has been sent for timeout,
+// and sends it again, up to retries times.  The S3 client doesn't retry
+// requests cancelled like that.
+func WithStallTimeout(timeout time.Duration, retries int) Option {
+	return func(u *Uploader) { u.stallTimeout, u.stallRetries = timeout, retries }
+}
+
+// WithSpeedFloor cancels a part once less than bytes of it have been sent in
+// window, and sends it again on a new connection, like a stalled one.  A NAT
+// mapping gone stale can leave a connection barely moving for hours rather than
+// dead.
+func WithSpeedFloor(bytes int64, window time.Duration) Option {
+	return func(u *Uploader) { u.speedFloor = speedFloor{Bytes: bytes, Window: window} }
+}
+
+// WithFailureHook calls hook whenever an attempt at a part fails.  If it
+// returns true, the part is tried again right away, without counting it as a
+// retry; the command waits for a dropped connection to come back in it.
+func WithFailureHook(hook func(part int, err error, stalled bool) bool) Option {
+	return func(u *Uploader) { u.onFailure = hook }
+}
+
+// WithCircuitBreaker shares b between uploads, and with UploadPart and
+// CopyPart, which have none otherwise.  Each upload has its own by default.
+func WithCircuitBreaker(b *CircuitBreaker) Option {
+	return func(u *Uploader) { u.breaker = b }
+}
+
+// WithTracer traces the parts of uploads and the attempts at them.
+func WithTracer(t Tracer) Option {
+	return func(u *Uploader) { u.tracer = t }
+}
+
+// WithVerify checks completed uploads with v instead of comparing the ETag,
+// e.g. by their checksums when the ETags aren't MD5 digests with SSE-KMS.
+// The ETags of the parts aren't checked either then.
+func WithVerify(v Verify) Option {
+	return func(u *Uploader) { u.verify = v }
+}
+
+// New makes an Uploader using the S3 client.
+func New(client s3iface.S3API, opts ...Option) *Uploader {
+	u := &Uploader{
+		s3:           client,
+		concurrency:  DefaultConcurrency,
+		readAhead:    DefaultReadAhead,
+		storageClass: s3.StorageClassDeepArchive,
+		retryDelay: func(try int, err error) time.Duration {
+			return time.Second << uint(try)
+		},
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+// Result is what an upload made.
+type Result struct {
+	Key      string
+	UploadID string
+	// ETag is the object's, as S3 gave it.
+	ETag     string
+	Location string
+	Size     int64
+	Parts    int
+	// PartDigests are the MD5 digests of the parts, in hex.
+	PartDigests []string
+	// Resumed is how many parts were already uploaded before, and Copied
+	// how many were copied from the Base.
+	Resumed int
+	Copied  int
+	// ServerSideEncryption is how S3 encrypted the object, e.g. AES256 or
+	// aws:kms, with SSEKMSKeyID the KMS key.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+}
+
+// Error is an upload which failed after it was started.  Its parts are kept,
+// so it can be resumed with Resume, or deleted with Abort.
+type Error struct {
+	Key      string
+	UploadID string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Upload %s of %s failed, resume or abort it: %v", e.UploadID, e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// PartSizeError is a Resume of an upload which was started with parts of
+// another size, all of which would be sent again.
+type PartSizeError struct {
+	UploadID string
+	PartSize int64
+}
+
+func (e *PartSizeError) Error() string {
+	return fmt.Sprintf("The upload %s was started with %d byte parts", e.UploadID, e.PartSize)
+}
+
+// UploadFile uploads a file to key.
+func (u *Uploader) UploadFile(ctx context.Context, bucket string, key string, filename string) (*Result, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return u.Upload(ctx, bucket, key, f, info.Size())
+}
+
+// Upload uploads the size bytes r reads to key.  r is read once, from the
+// start to the end, so it can be a stream.
+func (u *Uploader) Upload(ctx context.Context, bucket string, key string, r io.Reader, size int64) (*Result, error) {
+	partSize, err := u.partSizeFor(size)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Metadata: u.metadata,
+	}
+	if u.storageClass != "" {
+		input.StorageClass = aws.String(u.storageClass)
+	}
+	if u.tagging != "" {
+		input.Tagging = aws.String(u.tagging)
+	}
+	if u.checksumAlgorithm != "" {
+		input.ChecksumAlgorithm = aws.String(u.checksumAlgorithm)
+	}
+	if u.sse != "" {
+		input.ServerSideEncryption = aws.String(u.sse)
+	}
+	if u.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.sseKMSKeyID)
+	}
+
+	created, err := u.s3.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return u.upload(ctx, bucket, key, aws.StringValue(created.UploadId), r, size, partSize, nil)
+}
+
+// Resume carries on with an upload of r which failed, uploading the parts S3
+// doesn't have and then completing it.  The parts S3 has are checked against
+// r, and uploaded again if they don't match, so the part size has to be the
+// same as the first time.  Unless it returns an Error, it hasn't read from r.
+func (u *Uploader) Resume(ctx context.Context, bucket string, key string, uploadID string, r io.Reader, size int64) (*Result, error) {
+	partSize, err := u.partSizeFor(size)
+	if err != nil {
+		return nil, err
+	}
+
+	uploaded := map[int64]*s3.Part{}
+	err = u.s3.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			uploaded[aws.Int64Value(part.PartNumber)] = part
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up upload %s of %s: %w", uploadID, key, err)
+	}
+
+	if first, ok := uploaded[1]; ok && len(uploaded) > 1 && aws.Int64Value(first.Size) != partSize {
+		return nil, &PartSizeError{UploadID: uploadID, PartSize: aws.Int64Value(first.Size)}
+	}
+	return u.upload(ctx, bucket, key, uploadID, r, size, partSize, uploaded)
+}
+
+// Abort deletes an upload and the parts it has.
+func (u *Uploader) Abort(ctx context.Context, bucket string, key string, uploadID string) error {
+	_, err := u.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
+
+// partSizeFor checks the options for an upload of size bytes, and returns
+// the part size for it.
+func (u *Uploader) partSizeFor(size int64) (int64, error) {
+	partSize := u.partSize
+	if partSize == 0 {
+		partSize = AutoPartSize(size)
+	}
+	if partSize < MinPartSize || partSize > MaxPartSize {
+		return 0, fmt.Errorf("The part size has to be between %d and %d bytes", int64(MinPartSize), int64(MaxPartSize))
+	}
+	if parts := (size + partSize - 1) / partSize; parts > MaxParts {
+		return 0, fmt.Errorf("%d bytes in parts of %d bytes makes %d parts, more than the %d S3 takes", size, partSize, parts, MaxParts)
+	}
+	if int64(int(partSize)) != partSize {
+		return 0, fmt.Errorf("Parts of %d bytes don't fit in memory on this platform", partSize)
+	}
+	if u.concurrency < 1 {
+		return 0, fmt.Errorf("The concurrency has to be at least 1")
+	}
+	if u.readAhead < 0 {
+		return 0, fmt.Errorf("The read ahead can't be negative")
+	}
+	if u.checksumAlgorithm != "" && u.checksumAlgorithm != s3.ChecksumAlgorithmSha256 {
+		return 0, fmt.Errorf("Unsupported checksum algorithm %s, only %s is", u.checksumAlgorithm, s3.ChecksumAlgorithmSha256)
+	}
+	return partSize, nil
+}
+
+// resumedPart returns the part S3 already has, if it's the one we'd upload:
+// the same size, and an ETag matching the MD5 digest of what we read.
+// Anything else, like a part of a file that has changed since, is uploaded
+// again.
+func resumedPart(uploaded map[int64]*s3.Part, part Part) *s3.CompletedPart {
+	p, ok := uploaded[int64(part.Number)]
+	if !ok || aws.Int64Value(p.Size) != part.Size || strings.Trim(aws.StringValue(p.ETag), "\"") != part.MD5 {
+		return nil
+	}
+	return &s3.CompletedPart{
+		ETag:           p.ETag,
+		PartNumber:     p.PartNumber,
+		ChecksumSHA256: p.ChecksumSHA256,
+	}
+}
+
+// upload reads r in parts, sends those which aren't among the uploaded ones,
+// with u.concurrency of them at a time, and completes the upload.
+func (u *Uploader) upload(ctx context.Context, bucket string, key string, uploadID string, r io.Reader, size int64, partSize int64, uploaded map[int64]*s3.Part) (result *Result, err error) {
+	parts := int((size + partSize - 1) / partSize)
+	// An empty file is one empty part.
+	if parts == 0 {
+		parts = 1
+	}
+	u.events.OnStart(uploadID, parts, size)
+	defer func() { u.events.OnComplete(result, err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	breaker := u.breaker
+	if breaker == nil {
+		breaker = NewCircuitBreaker()
+	}
+
+	// mu protects what the workers report back.
+	var mu sync.Mutex
+	var completed []*s3.CompletedPart
+	var firstErr error
+	var resumed, copied int
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	done := func(part Part) {
+		mu.Lock()
+		completed[part.Number-1] = part.Completed
+		switch part.Source {
+		case PartResumed:
+			resumed++
+		case PartCopied:
+			copied++
+		}
+		mu.Unlock()
+
+		u.events.OnPartDone(part)
+	}
+
+	// When an object is uploaded as a multipart upload, its ETag is the
+	// MD5 digest of the MD5 digests of the parts, so those are kept in
+	// order as the parts are read.  See transfer.MultipartETag.
+	var digests []byte
+	var partDigests []string
+	var offset int64
+	var number int
+
+	// Every part in flight has its own buffer, and so has every one read
+	// ahead of them, so taking one from the pool is what bounds memory use.
+	// sending bounds the parts in flight.
+	buffers := NewBufferPool(u.concurrency+u.readAhead, int(partSize))
+	sending := make(chan struct{}, u.concurrency)
+
+	var wg sync.WaitGroup
+	for read := range u.readParts(ctx, r, buffers) {
+		if read.err != nil {
+			fail(read.err)
+			break
+		}
+		if ctx.Err() != nil {
+			buffers.Put(read.data)
+			break
+		}
+
+		part := read.part
+		number = part.Number
+		digests = append(digests, read.md5[:]...)
+		partDigests = append(partDigests, part.MD5)
+		offset += part.Size
+
+		mu.Lock()
+		completed = append(completed, nil)
+		mu.Unlock()
+
+		if c := resumedPart(uploaded, part); c != nil {
+			part.Source, part.Completed = PartResumed, c
+			done(part)
+			buffers.Put(read.data)
+			continue
+		}
+
+		sending <- struct{}{}
+		wg.Add(1)
+		go func(part Part, data []byte) {
+			defer wg.Done()
+			defer func() { <-sending }()
+			defer buffers.Put(data)
+
+			if u.base.matches(part) {
+				part.Source = PartCopied
+			}
+			u.events.OnPartStart(part)
+
+			partCtx, end := u.trace(ctx, "part", "part", part.Number, "size", part.Size)
+			var err error
+			if part.Source == PartCopied {
+				part.Completed, err = u.copyPart(partCtx, breaker, bucket, key, uploadID, part.Number, bucket, u.base.Key, u.base.ETag, part.Offset, part.Size)
+			} else {
+				part.Completed, err = u.sendPart(partCtx, breaker, bucket, key, uploadID, part.Number, data)
+			}
+			end(err, "copied", part.Source == PartCopied)
+
+			if err != nil {
+				fail(fmt.Errorf("Failed to upload part %d: %w", part.Number, err))
+				return
+			}
+			done(part)
+		}(part, read.data)
+	}
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, &Error{Key: key, UploadID: uploadID, Err: firstErr}
+	}
+
+	resp, err := u.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return nil, &Error{Key: key, UploadID: uploadID, Err: err}
+	}
+
+	etag := transfer.MultipartETag(digests, number)
+	verify := u.verify
+	if verify == nil {
+		verify = checkETag
+	}
+	if err := verify(resp, etag, completed); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Key:         key,
+		UploadID:    uploadID,
+		ETag:        strings.Trim(aws.StringValue(resp.ETag), "\""),
+		Location:    aws.StringValue(resp.Location),
+		Size:        offset,
+		Parts:       number,
+		PartDigests: partDigests,
+		Resumed:     resumed,
+		Copied:      copied,
+
+		ServerSideEncryption: aws.StringValue(resp.ServerSideEncryption),
+		SSEKMSKeyID:          aws.StringValue(resp.SSEKMSKeyId),
+	}, nil
+}
+
+// readPart is a part read by readParts, or why reading failed.
+type readPart struct {
+	part Part
+	data []byte
+	md5  [md5.Size]byte
+	err  error
+}
+
+// readParts reads r in parts into buffers, and hashes them, in goroutines of
+// their own, so that the disk is busy while the parts before are sent.  Parts
+// have to line up with the ones uploaded before, so it always reads full
+// parts; a short one is the last.  The channel is closed after the last part,
+// or an error, or once ctx is done.
+func (u *Uploader) readParts(ctx context.Context, r io.Reader, buffers *BufferPool) <-chan readPart {
+	reads := make(chan readPart)
+	go func() {
+		defer close(reads)
+
+		var offset int64
+		for number := 1; ; number++ {
+			buffer := buffers.Get()
+			if ctx.Err() != nil {
+				buffers.Put(buffer)
+				return
+			}
+
+			n, err := io.ReadFull(r, buffer)
+			if err == io.EOF && number > 1 {
+				buffers.Put(buffer)
+				return
+			}
+			read := readPart{part: Part{Number: number, Offset: offset, Size: int64(n)}, data: buffer[:n]}
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				buffers.Put(buffer)
+				read = readPart{err: fmt.Errorf("Failed to read part %d: %w", number, err)}
+			}
+			offset += int64(n)
+
+			select {
+			case reads <- read:
+			case <-ctx.Done():
+				// A failed read gave its buffer back already.
+				if read.err == nil {
+					buffers.Put(buffer)
+				}
+				return
+			}
+			if read.err != nil || n < len(buffer) {
+				return
+			}
+		}
+	}()
+
+	// Hashing a part overlaps with reading the next one.
+	hashed := make(chan readPart)
+	go func() {
+		defer close(hashed)
+		for read := range reads {
+			if read.err == nil {
+				read.md5 = md5.Sum(read.data)
+				read.part.MD5 = hex.EncodeToString(read.md5[:])
+			}
+			select {
+			case hashed <- read:
+			case <-ctx.Done():
+				if read.err == nil {
+					buffers.Put(read.data)
+				}
+				// Let the reader see ctx is done.
+				for read := range reads {
+					if read.err == nil {
+						buffers.Put(read.data)
+					}
+				}
+				return
+			}
+		}
+	}()
+	return hashed
+}
+
+// checkETag is the default Verify.
+func checkETag(resp *s3.CompleteMultipartUploadOutput, etag string, parts []*s3.CompletedPart) error {
+	if got := strings.Trim(aws.StringValue(resp.ETag), "\""); got != etag {
+		return fmt.Errorf("The uploaded object's ETag is %s, but its parts make %s", got, etag)
+	}
+	return nil
+}
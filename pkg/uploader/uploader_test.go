@@ -0,0 +1,546 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 keeps multipart uploads in memory.  failPart makes the first
+// attempt at that part fail.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu           sync.Mutex
+	uploads      map[string]map[int64][]byte
+	storageClass map[string]string
+	objects      map[string][]byte
+	failPart     int64
+	copies       int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		uploads:      map[string]map[int64][]byte{},
+		storageClass: map[string]string{},
+		objects:      map[string][]byte{},
+	}
+}
+
+func md5Hex(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[id] = map[int64][]byte{}
+	f.storageClass[*in.Key] = aws.StringValue(in.StorageClass)
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if *in.PartNumber == f.failPart {
+		f.failPart = 0
+		return nil, awserr.New("InternalError", "We encountered an internal error", nil)
+	}
+	parts, ok := f.uploads[*in.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	parts[*in.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + md5Hex(data) + `"`)}, nil
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(ctx aws.Context, in *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	source := f.objects[strings.TrimPrefix(*in.CopySource, *in.Bucket+"/")]
+	var first, last int
+	fmt.Sscanf(*in.CopySourceRange, "bytes=%d-%d", &first, &last)
+	data := append([]byte{}, source[first:last+1]...)
+	f.uploads[*in.UploadId][*in.PartNumber] = data
+	f.copies++
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(`"` + md5Hex(data) + `"`)}}, nil
+}
+
+func (f *fakeS3) ListPartsPagesWithContext(ctx aws.Context, in *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	page := &s3.ListPartsOutput{}
+	for n, data := range f.uploads[*in.UploadId] {
+		page.Parts = append(page.Parts, &s3.Part{
+			PartNumber: aws.Int64(n),
+			Size:       aws.Int64(int64(len(data))),
+			ETag:       aws.String(`"` + md5Hex(data) + `"`),
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := f.uploads[*in.UploadId]
+	var data, digests []byte
+	for i, part := range in.MultipartUpload.Parts {
+		if *part.PartNumber != int64(i+1) || `"`+md5Hex(parts[*part.PartNumber])+`"` != *part.ETag {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("Part %d is missing or its ETag doesn't match", i+1), nil)
+		}
+		sum := md5.Sum(parts[*part.PartNumber])
+		digests = append(digests, sum[:]...)
+		data = append(data, parts[*part.PartNumber]...)
+	}
+	f.objects[*in.Key] = data
+	delete(f.uploads, *in.UploadId)
+	return &s3.CompleteMultipartUploadOutput{
+		ETag:     aws.String(fmt.Sprintf(`"%s-%d"`, md5Hex(digests), len(in.MultipartUpload.Parts))),
+		Location: aws.String("https://" + *in.Bucket + ".s3.amazonaws.com/" + *in.Key),
+	}, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+type recordedProgress struct {
+	mu       sync.Mutex
+	uploadID string
+	parts    int
+	done     []int
+	resumed  int
+	bytes    int64
+}
+
+func (p *recordedProgress) Started(uploadID string, parts int, size int64) {
+	p.uploadID, p.parts = uploadID, parts
+}
+
+func (p *recordedProgress) PartDone(part int, size int64, resumed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = append(p.done, part)
+	p.bytes += size
+	if resumed {
+		p.resumed++
+	}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestAutoPartSize(t *testing.T) {
+	if s := AutoPartSize(10 * 1024 * mib); s != DefaultPartSize {
+		t.Errorf("10 GiB in parts of %d", s)
+	}
+	// 1 TiB needs parts of at least 104,857.6 bytes, so 105 MiB.
+	if s := AutoPartSize(1024 * 1024 * mib); s != 105*mib {
+		t.Errorf("1 TiB in parts of %d", s)
+	}
+}
+
+func TestMultipartETag(t *testing.T) {
+	// The ETag S3 gives an object uploaded as two parts, "a" and "b".
+	a, b := md5.Sum([]byte("a")), md5.Sum([]byte("b"))
+	if etag := MultipartETag(append(a[:], b[:]...), 2); etag != md5Hex(append(a[:], b[:]...))+"-2" {
+		t.Errorf("got %s", etag)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	fake := newFakeS3()
+	progress := &recordedProgress{}
+	u := New(fake, WithPartSize(MinPartSize), WithConcurrency(2), WithStorageClass(s3.StorageClassGlacier), WithProgress(progress))
+
+	data := randomData(2*MinPartSize + 1024)
+	result, err := u.Upload(context.Background(), "bucket", "archive.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fake.objects["archive.bin"], data) {
+		t.Error("the object doesn't contain the data")
+	}
+	if fake.storageClass["archive.bin"] != s3.StorageClassGlacier {
+		t.Errorf("uploaded to %s", fake.storageClass["archive.bin"])
+	}
+	if result.Parts != 3 || result.Resumed != 0 || result.UploadID != "upload-1" || result.Location == "" {
+		t.Errorf("result %+v", result)
+	}
+
+	sort.Ints(progress.done)
+	if progress.uploadID != "upload-1" || progress.parts != 3 || fmt.Sprint(progress.done) != "[1 2 3]" || progress.bytes != int64(len(data)) {
+		t.Errorf("progress %+v", progress)
+	}
+}
+
+func TestUploadEmpty(t *testing.T) {
+	fake := newFakeS3()
+	result, err := New(fake).Upload(context.Background(), "bucket", "empty", bytes.NewReader(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Parts != 1 || len(fake.objects["empty"]) != 0 {
+		t.Errorf("result %+v", result)
+	}
+}
+
+func TestResume(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 2
+	u := New(fake, WithPartSize(MinPartSize), WithConcurrency(1))
+
+	data := randomData(3 * MinPartSize)
+	_, err := u.Upload(context.Background(), "bucket", "archive.bin", bytes.NewReader(data), int64(len(data)))
+	var failed *Error
+	if !errors.As(err, &failed) || failed.UploadID != "upload-1" {
+		t.Fatalf("got %v", err)
+	}
+
+	result, err := u.Resume(context.Background(), "bucket", "archive.bin", failed.UploadID, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed != 1 || result.Parts != 3 {
+		t.Errorf("result %+v", result)
+	}
+	if !bytes.Equal(fake.objects["archive.bin"], data) {
+		t.Error("the object doesn't contain the data")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 1
+	u := New(fake, WithPartSize(MinPartSize))
+
+	data := randomData(MinPartSize)
+	_, err := u.Upload(context.Background(), "bucket", "archive.bin", bytes.NewReader(data), int64(len(data)))
+	var failed *Error
+	if !errors.As(err, &failed) {
+		t.Fatalf("got %v", err)
+	}
+	if err := u.Abort(context.Background(), "bucket", failed.Key, failed.UploadID); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the upload is still there")
+	}
+}
+
+func TestUploadCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := randomData(MinPartSize)
+	_, err := New(newFakeS3()).Upload(ctx, "bucket", "archive.bin", bytes.NewReader(data), int64(len(data)))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestOptionsChecked(t *testing.T) {
+	for _, u := range []*Uploader{
+		New(newFakeS3(), WithPartSize(MinPartSize-1)),
+		New(newFakeS3(), WithPartSize(MaxPartSize+1)),
+		New(newFakeS3(), WithConcurrency(0)),
+		New(newFakeS3(), WithReadAhead(-1)),
+	} {
+		if _, err := u.Upload(context.Background(), "bucket", "key", bytes.NewReader(nil), 0); err == nil {
+			t.Errorf("uploaded with part size %d and concurrency %d", u.partSize, u.concurrency)
+		}
+	}
+
+	// 10,001 parts of 5 MiB are too many.
+	_, err := New(newFakeS3(), WithPartSize(MinPartSize)).Upload(context.Background(), "bucket", "key", bytes.NewReader(nil), (MaxParts+1)*MinPartSize)
+	if err == nil {
+		t.Error("uploaded more than 10,000 parts")
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 2
+	var failures int
+	u := New(fake, WithPartSize(MinPartSize),
+		WithRetries(1, func(int, error) time.Duration { return 0 }),
+		WithFailureHook(func(part int, err error, stalled bool) bool {
+			failures++
+			return false
+		}))
+
+	data := randomData(3 * MinPartSize)
+	if _, err := u.Upload(context.Background(), "bucket", "archive.bin", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || !bytes.Equal(fake.objects["archive.bin"], data) {
+		t.Errorf("%d failures", failures)
+	}
+}
+
+func TestUploadShortReads(t *testing.T) {
+	fake := newFakeS3()
+	u := New(fake, WithPartSize(MinPartSize))
+
+	// Every read only fills half of what it's given, which mustn't make
+	// short parts.
+	data := randomData(2*MinPartSize + 1024)
+	result, err := u.Upload(context.Background(), "bucket", "archive.bin", iotest.HalfReader(bytes.NewReader(data)), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Parts != 3 || result.Size != int64(len(data)) || !bytes.Equal(fake.objects["archive.bin"], data) {
+		t.Errorf("result %+v", result)
+	}
+}
+
+// blockingS3 holds the first part until the test lets it go.
+type blockingS3 struct {
+	*fakeS3
+	release chan struct{}
+}
+
+func (f *blockingS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if aws.Int64Value(in.PartNumber) == 1 {
+		<-f.release
+	}
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+// signalingReader says when it's been read up to at.
+type signalingReader struct {
+	io.Reader
+	read int64
+	at   int64
+	done chan struct{}
+}
+
+func (r *signalingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.read >= r.at && r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	return n, err
+}
+
+func TestUploadReadsAhead(t *testing.T) {
+	fake := &blockingS3{fakeS3: newFakeS3(), release: make(chan struct{})}
+	u := New(fake, WithPartSize(MinPartSize), WithConcurrency(1), WithReadAhead(1))
+
+	// The second part is read while the first one is still being sent.
+	data := randomData(3 * MinPartSize)
+	r := &signalingReader{Reader: bytes.NewReader(data), at: 2 * MinPartSize, done: make(chan struct{})}
+	read := r.done
+	go func() {
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Error("the second part wasn't read while the first was sent")
+		}
+		close(fake.release)
+	}()
+
+	result, err := u.Upload(context.Background(), "bucket", "archive.bin", r, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Parts != 3 || !bytes.Equal(fake.objects["archive.bin"], data) {
+		t.Errorf("result %+v", result)
+	}
+}
+
+func TestUploadReadError(t *testing.T) {
+	data := randomData(MinPartSize)
+	r := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errors.New("disk on fire")))
+	_, err := New(newFakeS3(), WithPartSize(MinPartSize)).Upload(context.Background(), "bucket", "archive.bin", r, 2*MinPartSize)
+	if err == nil || !strings.Contains(err.Error(), "Failed to read part 2: disk on fire") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// cancelingReader cancels the upload as it fails.
+type cancelingReader struct {
+	cancel context.CancelFunc
+}
+
+func (r cancelingReader) Read([]byte) (int, error) {
+	r.cancel()
+	return 0, errors.New("disk on fire")
+}
+
+func TestReadErrorCanceled(t *testing.T) {
+	// Which of the failed read and ctx being done the reader sees first is
+	// up to select, so try it a few times.  With one buffer, giving it back
+	// twice blocks.
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		reads := New(newFakeS3()).readParts(ctx, cancelingReader{cancel}, NewBufferPool(1, MinPartSize))
+
+		done := make(chan struct{})
+		go func() {
+			for range reads {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("reading hung")
+		}
+	}
+}
+
+func TestUploadBase(t *testing.T) {
+	fake := newFakeS3()
+	u := New(fake, WithPartSize(MinPartSize))
+
+	data := randomData(3 * MinPartSize)
+	first, err := u.Upload(context.Background(), "bucket", "v1", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the middle part changes.
+	changed := append([]byte{}, data...)
+	changed[MinPartSize+1] ^= 0xff
+	base := &Base{Key: "v1", Size: first.Size, PartSize: MinPartSize, Parts: first.PartDigests}
+	result, err := New(fake, WithPartSize(MinPartSize), WithBase(base)).Upload(context.Background(), "bucket", "v2", bytes.NewReader(changed), int64(len(changed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 2 || fake.copies != 2 {
+		t.Errorf("copied %d parts, want the 2 unchanged ones", fake.copies)
+	}
+	if !bytes.Equal(fake.objects["v2"], changed) {
+		t.Error("the object doesn't contain the data")
+	}
+}
+
+// recordedEvents is an EventHandler writing down what it's told.
+type recordedEvents struct {
+	mu       sync.Mutex
+	uploadID string
+	started  []int
+	done     []int
+	retries  []int
+	result   *Result
+	err      error
+}
+
+func (e *recordedEvents) OnStart(uploadID string, parts int, size int64) {
+	e.uploadID = uploadID
+}
+
+func (e *recordedEvents) OnPartStart(part Part) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.started = append(e.started, part.Number)
+}
+
+func (e *recordedEvents) OnPartDone(part Part) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done = append(e.done, part.Number)
+}
+
+func (e *recordedEvents) OnRetry(number int, err error, stalled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.retries = append(e.retries, number)
+}
+
+func (e *recordedEvents) OnComplete(result *Result, err error) {
+	e.result, e.err = result, err
+}
+
+func TestUploadEvents(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 2
+	events, progress := &recordedEvents{}, &recordedProgress{}
+	u := New(fake, WithPartSize(MinPartSize),
+		WithRetries(1, func(int, error) time.Duration { return 0 }),
+		WithEvents(events), WithProgress(progress))
+
+	data := randomData(3 * MinPartSize)
+	result, err := u.Upload(context.Background(), "bucket", "archive.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Ints(events.started)
+	sort.Ints(events.done)
+	if events.uploadID != "upload-1" || fmt.Sprint(events.started) != "[1 2 3]" || fmt.Sprint(events.done) != "[1 2 3]" {
+		t.Errorf("events %+v", events)
+	}
+	if fmt.Sprint(events.retries) != "[2]" {
+		t.Errorf("retried parts %v", events.retries)
+	}
+	if events.result != result || events.err != nil {
+		t.Errorf("completed with %+v, %v", events.result, events.err)
+	}
+	// Both handlers are told.
+	if len(progress.done) != 3 {
+		t.Errorf("progress %+v", progress)
+	}
+
+	// A failed upload completes too.
+	fake.failPart = 1
+	events = &recordedEvents{}
+	_, err = New(fake, WithPartSize(MinPartSize), WithEvents(events)).Upload(context.Background(), "bucket", "other.bin", bytes.NewReader(data), int64(len(data)))
+	var failed *Error
+	if !errors.As(events.err, &failed) || events.err != err || events.result != nil {
+		t.Errorf("completed with %+v, %v", events.result, events.err)
+	}
+}
@@ -0,0 +1,255 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// plan-restore flags
+var PlanPrefix string
+var PlanTier string
+var PlanDays int64
+var PlanScript string
+var PlanSet string
+var PlanAllObjects bool
+
+var planRestoreCmd = &cobra.Command{
+	Use:   "plan-restore [key...]",
+	Short: "Estimate the cost and time of restoring archived objects",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return PlanRestore(newS3Session(Region), BucketName, PlanPrefix, args, PlanTier, PlanDays, PlanScript)
+	},
+}
+
+type archivedObject struct {
+	Key          string
+	Size         int64
+	StorageClass string
+	LastModified time.Time
+}
+
+// collectObjects resolves the explicitly given keys with HeadObject and adds
+// everything found under prefix.  With neither, that's the whole bucket.
+func collectObjects(s3session s3iface.S3API, bucket string, prefix string, keys []string) ([]archivedObject, error) {
+	var objects []archivedObject
+
+	for _, key := range keys {
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to look up %s: %w", key, err)
+		}
+
+		// HeadObject leaves out the storage class for STANDARD objects.
+		storageClass := s3.StorageClassStandard
+		if head.StorageClass != nil {
+			storageClass = *head.StorageClass
+		}
+
+		objects = append(objects, archivedObject{key, *head.ContentLength, storageClass, *head.LastModified})
+	}
+
+	if prefix == "" && len(keys) > 0 {
+		return objects, nil
+	}
+
+	listed, err := listAll(s3session, bucket, prefix)
+	for _, obj := range listed {
+		if !isSidecar(obj.Key) {
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, err
+}
+
+// planObjects are the objects of the --set, or those of the set published
+// for prefix, unless --all-objects says otherwise.  Without a published set
+// it's the keys and everything under prefix.
+func planObjects(w io.Writer, s3session s3iface.S3API, bucket string, prefix string, keys []string) ([]archivedObject, error) {
+	var set *publishedSet
+	var err error
+	switch {
+	case PlanSet != "":
+		set, err = loadPublishedSet(s3session, bucket, PlanSet)
+	case prefix != "" && len(keys) == 0 && !PlanAllObjects:
+		set, err = findPublishedSet(s3session, bucket, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return collectObjects(s3session, bucket, prefix, keys)
+	}
+
+	fmt.Fprintf(w, "Planning a restore of the set of %s published %s, %d objects\n", set.Job, set.Published.Local().Format("2006-01-02 15:04:05"), len(set.Objects))
+	if PlanSet == "" {
+		fmt.Fprintln(w, "Add --all-objects to plan for everything under the prefix instead")
+	}
+	return setObjects(s3session, bucket, set)
+}
+
+func PlanRestore(s3session s3iface.S3API, bucket string, prefix string, keys []string, tier string, days int64, script string) error {
+	if prefix == "" && len(keys) == 0 && PlanSet == "" {
+		return fmt.Errorf("Give us some keys, a --prefix or a --set to plan a restore for")
+	}
+
+	// The script goes to stdout with --script -, so that it can be piped
+	// into a shell; the summary must not end up in it.
+	summary := ui.Writer()
+	if script == "-" {
+		summary = os.Stderr
+	}
+
+	objects, err := planObjects(summary, s3session, bucket, prefix, keys)
+	if err != nil {
+		return err
+	}
+
+	groups := map[string][]archivedObject{}
+	var skipped int
+
+	for _, obj := range objects {
+		if !isArchived(obj.StorageClass) {
+			skipped++
+			continue
+		}
+		groups[obj.StorageClass] = append(groups[obj.StorageClass], obj)
+	}
+
+	if len(groups) == 0 {
+		return fmt.Errorf("None of the %d objects need to be restored", len(objects))
+	}
+
+	var classes []string
+	for class := range groups {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	var totalCost float64
+	var waitHours float64
+
+	for _, class := range classes {
+		var size int64
+		for _, obj := range groups[class] {
+			size += obj.Size
+		}
+		count := int64(len(groups[class]))
+
+		fmt.Fprintf(summary, "%s: %d objects, %s\n", class, count, formatBytes(size))
+		for _, t := range retrievalTiers[class] {
+			fmt.Fprintf(summary, "  %-10s $%10.2f  %s\n", t.Name, t.Cost(count, size), t.TypicalString)
+		}
+
+		chosen, err := findTier(class, tier)
+		if err != nil {
+			return err
+		}
+		totalCost += chosen.Cost(count, size)
+		if chosen.TypicalHours > waitHours {
+			waitHours = chosen.TypicalHours
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(summary, "Skipping %d objects which are not archived\n", skipped)
+	}
+
+	fmt.Fprintf(summary, "Estimated cost of a %s restore: $%.2f\n", tier, totalCost)
+	fmt.Fprintf(summary, "Expect everything to be restored within %s\n",
+		time.Duration(waitHours*float64(time.Hour)).Round(time.Minute))
+
+	waves, err := restoreWaves(classes, groups, tier, time.Now())
+	if err != nil {
+		return err
+	}
+	printWaves(summary, waves)
+	if err := writeWavePlans(bucket, waves); err != nil {
+		return err
+	}
+
+	// The script is what spends the money.
+	if MaxRestoreCost > 0 && totalCost > MaxRestoreCost {
+		return fmt.Errorf("Not writing a script for a $%.2f restore, --max-restore-cost is $%.2f (raise it, or 0 for no limit)", totalCost, MaxRestoreCost)
+	}
+
+	if script == "" {
+		return nil
+	}
+
+	var out io.Writer = os.Stdout
+	if script != "-" {
+		f, err := os.OpenFile(script, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return writeRestoreScript(out, bucket, classes, groups, tier, days)
+}
+
+// writeRestoreScript writes a shell script which kicks off the planned
+// restore, so that it can be reviewed and approved before anything is spent.
+func writeRestoreScript(out io.Writer, bucket string, classes []string, groups map[string][]archivedObject, tier string, days int64) error {
+	fmt.Fprintln(out, "#!/bin/sh")
+	fmt.Fprintln(out, "set -e")
+
+	request := fmt.Sprintf(`{"Days":%d,"GlacierJobParameters":{"Tier":"%s"}}`, days, tier)
+
+	for _, class := range classes {
+		fmt.Fprintf(out, "\n# %s\n", class)
+		for _, obj := range groups[class] {
+			_, err := fmt.Fprintf(out, "aws s3api restore-object --bucket %s --key %s --restore-request %s\n",
+				shellQuote(bucket), shellQuote(obj.Key), shellQuote(request))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func init() {
+	planRestoreCmd.Flags().StringVar(&PlanPrefix, "prefix", "", "plan a restore of every object under this prefix")
+	planRestoreCmd.Flags().StringVar(&PlanTier, "tier", s3.TierBulk, "retrieval tier to use for the plan")
+	planRestoreCmd.Flags().Int64Var(&PlanDays, "days", 7, "number of days to keep the restored copies")
+	planRestoreCmd.Flags().StringVar(&PlanSet, "set", "", "plan a restore of the latest set sync --publish published for this job")
+	planRestoreCmd.Flags().BoolVar(&PlanAllObjects, "all-objects", false, "with --prefix, plan for every object under it, not only those of the set published for it")
+	planRestoreCmd.Flags().StringVar(&PlanScript, "script", "", "write a restore script to this file (- for stdout)")
+	rootCmd.AddCommand(planRestoreCmd)
+}
@@ -0,0 +1,92 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestPlanRestore(t *testing.T) {
+	fake := newFakeS3()
+	for key, class := range map[string]string{
+		"photos/2021.tar": s3.StorageClassDeepArchive,
+		"photos/2022.tar": s3.StorageClassGlacier,
+		"photos/it's.tar": s3.StorageClassDeepArchive,
+		"photos/new.tar":  s3.StorageClassStandard,
+	} {
+		fake.objects[key] = &fakeObject{data: []byte(key), etag: md5Hex([]byte(key)), storageClass: class, modified: time.Now()}
+	}
+
+	script := filepath.Join(t.TempDir(), "restore.sh")
+	if err := PlanRestore(fake, "bucket", "photos/", nil, s3.TierBulk, 3, script); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		"--key 'photos/2021.tar'",
+		"--key 'photos/2022.tar'",
+		`--key 'photos/it'"'"'s.tar'`,
+		`{"Days":3,"GlacierJobParameters":{"Tier":"Bulk"}}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the script has no %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "new.tar") {
+		t.Errorf("the script restores a STANDARD object:\n%s", out)
+	}
+	if !strings.HasPrefix(out, "#!/bin/sh\n") {
+		t.Errorf("the script doesn't start with #!:\n%s", out)
+	}
+
+	// Deep Archive has no Expedited tier.
+	if err := PlanRestore(fake, "bucket", "photos/", nil, s3.TierExpedited, 3, ""); err == nil {
+		t.Error("planned an Expedited restore from Deep Archive")
+	}
+
+	// Nothing to restore.
+	if err := PlanRestore(fake, "bucket", "", []string{"photos/new.tar"}, s3.TierBulk, 3, ""); err == nil {
+		t.Error("planned restoring a STANDARD object")
+	}
+}
+
+func TestPlanRestoreBudget(t *testing.T) {
+	defer func(limit float64) { MaxRestoreCost = limit }(MaxRestoreCost)
+	MaxRestoreCost = 0.005
+
+	fake := newFakeS3()
+	fake.objects["huge.img"] = &fakeObject{data: []byte("x"), etag: md5Hex([]byte("x")), storageClass: s3.StorageClassGlacier, modified: time.Now()}
+
+	script := filepath.Join(t.TempDir(), "restore.sh")
+	if err := PlanRestore(fake, "bucket", "", []string{"huge.img"}, s3.TierExpedited, 1, script); err == nil {
+		t.Error("planned a restore over --max-restore-cost")
+	}
+	if _, err := os.Stat(script); err == nil {
+		t.Error("wrote a script over --max-restore-cost")
+	}
+}
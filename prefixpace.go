@@ -0,0 +1,167 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// S3 handles 3,500 requests a second which write and 5,500 which read per
+// prefix of a bucket, and answers SlowDown beyond that.  Many small files in
+// one directory at a high --concurrency can get there, and the SDK's retries
+// alone only make it worse.  Once S3 slows a prefix down, its requests are
+// spaced out by a limiter of their own, which slows down whenever S3
+// throttles and speeds up again while it doesn't, up to S3's rate.
+const (
+	PREFIX_WRITE_INTERVAL = time.Second / 3500
+	PREFIX_READ_INTERVAL  = time.Second / 5500
+	PREFIX_START_INTERVAL = 10 * time.Millisecond
+	PREFIX_MAX_INTERVAL   = 5 * time.Second
+)
+
+// prefixLimiter is a requestLimiter whose interval changes as S3 throttles
+// one prefix.
+type prefixLimiter struct {
+	requestLimiter
+	floor time.Duration
+}
+
+// prefixPacing holds a limiter for every prefix S3 has throttled, so
+// prefixes which never were cost nothing.
+type prefixPacing struct {
+	mu       sync.Mutex
+	limiters map[string]*prefixLimiter
+}
+
+var prefixes = &prefixPacing{limiters: map[string]*prefixLimiter{}}
+
+// requestPrefix is the bucket and key prefix a request goes to, and the
+// fastest S3 allows for that kind of request.  Requests without a key, like
+// listings, aren't paced.
+func requestPrefix(r *request.Request) (string, time.Duration, bool) {
+	params, _ := json.Marshal(r.Params)
+	var ids struct{ Bucket, Key string }
+	json.Unmarshal(params, &ids)
+	if ids.Bucket == "" || ids.Key == "" {
+		return "", 0, false
+	}
+
+	prefix := ids.Bucket + "/" + path.Dir(ids.Key)
+	if r.HTTPRequest != nil && (r.HTTPRequest.Method == http.MethodGet || r.HTTPRequest.Method == http.MethodHead) {
+		return prefix + " (reads)", PREFIX_READ_INTERVAL, true
+	}
+	return prefix + " (writes)", PREFIX_WRITE_INTERVAL, true
+}
+
+// isSlowDown reports whether err is S3 throttling us for going too fast,
+// rather than passing on KMS's throttling.
+func isSlowDown(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == "SlowDown" && !isKMSThrottle(err)
+}
+
+// get is the limiter of prefix, or nil if S3 hasn't throttled it.
+func (p *prefixPacing) get(prefix string) *prefixLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limiters[prefix]
+}
+
+// Throttled halves the rate of requests to prefix, starting to pace them if
+// they weren't yet.
+func (p *prefixPacing) Throttled(prefix string, floor time.Duration) {
+	p.mu.Lock()
+	l, ok := p.limiters[prefix]
+	if !ok {
+		l = &prefixLimiter{floor: floor}
+		p.limiters[prefix] = l
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		ui.Warnf("S3 is throttling requests to %s, slowing down.  Spreading keys over more prefixes lets S3 take more requests at once.\n", prefix)
+	}
+	l.Throttled()
+}
+
+// Throttled halves the rate of requests to the prefix.
+func (l *prefixLimiter) Throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.interval *= 2
+	if l.interval < PREFIX_START_INTERVAL {
+		l.interval = PREFIX_START_INTERVAL
+	}
+	if l.interval > PREFIX_MAX_INTERVAL {
+		l.interval = PREFIX_MAX_INTERVAL
+	}
+}
+
+// Succeeded speeds up a little again, up to S3's rate for the prefix.
+func (l *prefixLimiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.interval <= l.floor {
+		return
+	}
+	l.interval -= l.interval / 20
+	if l.interval < l.floor {
+		l.interval = l.floor
+	}
+}
+
+// pacePrefixes spaces out the requests of the session to every prefix S3
+// has throttled, and has every attempt tell its prefix's limiter how it
+// went.
+func pacePrefixes(handlers *request.Handlers) {
+	handlers.Sign.PushFront(func(r *request.Request) {
+		prefix, _, ok := requestPrefix(r)
+		if !ok {
+			return
+		}
+		if l := prefixes.get(prefix); l != nil {
+			l.Wait(r)
+		}
+	})
+	handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+		prefix, floor, ok := requestPrefix(r)
+		if !ok {
+			return
+		}
+		switch {
+		case isSlowDown(r.Error):
+			prefixes.Throttled(prefix, floor)
+		case r.Error == nil:
+			if l := prefixes.get(prefix); l != nil {
+				l.Succeeded()
+			}
+		}
+	})
+}
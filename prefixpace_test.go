@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRequestPrefix(t *testing.T) {
+	put := &request.Request{
+		Params:      &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("photos/2022/a.jpg")},
+		HTTPRequest: &http.Request{Method: http.MethodPut},
+	}
+	prefix, floor, ok := requestPrefix(put)
+	if !ok || prefix != "bucket/photos/2022 (writes)" || floor != PREFIX_WRITE_INTERVAL {
+		t.Errorf("PutObject went to %q, %s", prefix, floor)
+	}
+
+	get := &request.Request{
+		Params:      &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.jpg")},
+		HTTPRequest: &http.Request{Method: http.MethodGet},
+	}
+	prefix, floor, ok = requestPrefix(get)
+	if !ok || prefix != "bucket/. (reads)" || floor != PREFIX_READ_INTERVAL {
+		t.Errorf("GetObject went to %q, %s", prefix, floor)
+	}
+
+	list := &request.Request{Params: &s3.ListObjectsV2Input{Bucket: aws.String("bucket")}}
+	if _, _, ok := requestPrefix(list); ok {
+		t.Error("a listing was paced")
+	}
+}
+
+func TestIsSlowDown(t *testing.T) {
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+	kmsSlowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "You have exceeded the rate at which you may call KMS. Reduce the frequency of your calls.", nil), 503, "")
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+
+	if !isSlowDown(slowDown) {
+		t.Error("SlowDown wasn't recognized")
+	}
+	if isSlowDown(kmsSlowDown) || isSlowDown(denied) || isSlowDown(nil) {
+		t.Error("other errors were taken for S3 throttling")
+	}
+}
+
+func TestPrefixPacing(t *testing.T) {
+	defer func() { prefixes = &prefixPacing{limiters: map[string]*prefixLimiter{}} }()
+	prefixes = &prefixPacing{limiters: map[string]*prefixLimiter{}}
+
+	if prefixes.get("bucket/a (writes)") != nil {
+		t.Fatal("a prefix was paced before S3 throttled it")
+	}
+
+	prefixes.Throttled("bucket/a (writes)", PREFIX_WRITE_INTERVAL)
+	l := prefixes.get("bucket/a (writes)")
+	if l == nil || l.interval != PREFIX_START_INTERVAL {
+		t.Fatalf("throttled once, the prefix is paced by %+v", l)
+	}
+	if prefixes.get("bucket/b (writes)") != nil {
+		t.Error("throttling one prefix paced another")
+	}
+
+	prefixes.Throttled("bucket/a (writes)", PREFIX_WRITE_INTERVAL)
+	if l.interval != 2*PREFIX_START_INTERVAL {
+		t.Errorf("throttled twice, the interval is %s", l.interval)
+	}
+	for i := 0; i < 30; i++ {
+		l.Throttled()
+	}
+	if l.interval != PREFIX_MAX_INTERVAL {
+		t.Errorf("the interval grew to %s", l.interval)
+	}
+
+	for i := 0; i < 1000; i++ {
+		l.Succeeded()
+	}
+	if l.interval != PREFIX_WRITE_INTERVAL {
+		t.Errorf("sped up to an interval of %s, not S3's rate", l.interval)
+	}
+}
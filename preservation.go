@@ -0,0 +1,190 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var PreservationMetadata string
+
+// Preservation metadata is a sidecar in STANDARD next to every archive,
+// describing it for archival institutions' systems: a minimal METS document,
+// or whatever a template of their own makes of the same facts.
+const (
+	PRESERVATION_SUFFIX = ".mets.xml"
+	PRESERVATION_METS   = "mets"
+)
+
+var preservationTemplate *template.Template
+
+// preservationRecord is what a preservation template is filled with.
+type preservationRecord struct {
+	Bucket       string
+	Key          string
+	Filename     string
+	Size         int64
+	Modified     time.Time
+	Uploaded     time.Time
+	SHA256       string
+	ETag         string
+	StorageClass string
+	UploadID     string
+	Host         string
+}
+
+var preservationFuncs = template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var b strings.Builder
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+	"iso": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}
+
+// metsTemplate describes the archive as the one file of a METS document,
+// with its SHA-256 checksum and where it's stored.
+const metsTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<mets xmlns="http://www.loc.gov/METS/" xmlns:xlink="http://www.w3.org/1999/xlink" OBJID="{{xml .Key}}" LABEL="{{xml .Filename}}">
+  <metsHdr CREATEDATE="{{iso .Uploaded}}">
+    <agent ROLE="CREATOR" TYPE="OTHER" OTHERTYPE="SOFTWARE"><name>s3-glacier-uploader on {{xml .Host}}</name></agent>
+  </metsHdr>
+  <fileSec>
+    <fileGrp USE="archive">
+      <file ID="file-1" SIZE="{{.Size}}" CREATED="{{iso .Modified}}" CHECKSUM="{{.SHA256}}" CHECKSUMTYPE="SHA-256">
+        <FLocat LOCTYPE="URL" xlink:href="s3://{{xml .Bucket}}/{{xml .Key}}" xlink:title="{{xml .StorageClass}}, ETag {{xml .ETag}}"/>
+      </file>
+    </fileGrp>
+  </fileSec>
+  <structMap>
+    <div LABEL="{{xml .Filename}}"><fptr FILEID="file-1"/></div>
+  </structMap>
+</mets>
+`
+
+func checkPreservationFlags() error {
+	preservationTemplate = nil
+	if PreservationMetadata == "" {
+		return nil
+	}
+	text := metsTemplate
+	if PreservationMetadata != PRESERVATION_METS {
+		data, err := os.ReadFile(PreservationMetadata)
+		if err != nil {
+			return fmt.Errorf("Failed to read the --preservation-metadata template: %w", err)
+		}
+		text = string(data)
+	}
+	t, err := template.New("preservation").Funcs(preservationFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("Invalid --preservation-metadata template: %w", err)
+	}
+	preservationTemplate = t
+	return nil
+}
+
+// fileDigest takes the SHA-256 digest of a file as the upload reads it.
+type fileDigest struct {
+	hash hash.Hash
+	size int64
+}
+
+func newFileDigest() *fileDigest {
+	return &fileDigest{hash: sha256.New()}
+}
+
+func (d *fileDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// sum is the digest of the file.  An upload which didn't read all of it,
+// e.g. because it was resumed, leaves the digest to be taken again.
+func (d *fileDigest) sum(filename string, size int64) (string, error) {
+	if d.size != size {
+		file, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		d.hash.Reset()
+		if _, err := io.Copy(d.hash, file); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(d.hash.Sum(nil)), nil
+}
+
+// uploadPreservation writes the preservation metadata of a finished upload
+// next to it.
+func uploadPreservation(s3session s3iface.S3API, bucket string, key string, filename string, stat os.FileInfo, digest *fileDigest, etag string, uploadID string) error {
+	if preservationTemplate == nil {
+		return nil
+	}
+	sum, err := digest.sum(filename, stat.Size())
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	record := preservationRecord{
+		Bucket:       bucket,
+		Key:          key,
+		Filename:     filepath.Base(filename),
+		Size:         stat.Size(),
+		Modified:     stat.ModTime(),
+		Uploaded:     time.Now(),
+		SHA256:       sum,
+		ETag:         strings.Trim(etag, "\""),
+		StorageClass: aws.StringValue(uploadStorageClass()),
+		UploadID:     uploadID,
+		Host:         host,
+	}
+	var data bytes.Buffer
+	if err := preservationTemplate.Execute(&data, record); err != nil {
+		return fmt.Errorf("Failed to fill in the --preservation-metadata template: %w", err)
+	}
+
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key + PRESERVATION_SUFFIX),
+		Body:         bytes.NewReader(data.Bytes()),
+		ContentType:  aws.String("application/xml"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+		Tagging:      objectTagging(key),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to upload the preservation metadata of %s: %w", key, err)
+	}
+	ui.Printf("Uploaded preservation metadata to %s\n", key+PRESERVATION_SUFFIX)
+	return nil
+}
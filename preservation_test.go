@@ -0,0 +1,87 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreservationMetadata(t *testing.T) {
+	defer func() {
+		PreservationMetadata = ""
+		checkPreservationFlags()
+	}()
+	data := randomData(PART_SIZE + 1024)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	PreservationMetadata = PRESERVATION_METS
+	if err := checkPreservationFlags(); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := fake.objects["archive.bin"+PRESERVATION_SUFFIX]
+	if sidecar == nil || sidecar.storageClass != "STANDARD" {
+		t.Fatal("no preservation metadata in STANDARD next to the archive")
+	}
+	var mets struct {
+		OBJID string `xml:"OBJID,attr"`
+		File  struct {
+			Size     int64  `xml:"SIZE,attr"`
+			Checksum string `xml:"CHECKSUM,attr"`
+		} `xml:"fileSec>fileGrp>file"`
+	}
+	if err := xml.Unmarshal(sidecar.data, &mets); err != nil {
+		t.Fatalf("%s: %v", sidecar.data, err)
+	}
+	if mets.OBJID != "archive.bin" || mets.File.Size != int64(len(data)) || mets.File.Checksum != digest {
+		t.Errorf("got %+v", mets)
+	}
+
+	// A template of one's own gets the same facts.
+	template := filepath.Join(t.TempDir(), "premis.tmpl")
+	if err := os.WriteFile(template, []byte(`{{.Key}} {{.Size}} {{.SHA256}} {{xml "<&>"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	PreservationMetadata = template
+	if err := checkPreservationFlags(); err != nil {
+		t.Fatal(err)
+	}
+	fake = newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("archive.bin %d %s &lt;&amp;&gt;", len(data), digest)
+	if got := string(fake.objects["archive.bin"+PRESERVATION_SUFFIX].data); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	os.WriteFile(template, []byte("{{.Nope"), 0644)
+	if err := checkPreservationFlags(); err == nil || !strings.Contains(err.Error(), "template") {
+		t.Errorf("a broken template gave %v", err)
+	}
+}
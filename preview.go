@@ -0,0 +1,121 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var PreviewSize string
+var PreviewCommand string
+
+// A preview is a small object in STANDARD next to the archive, which can be
+// read right away: the start of the file, or whatever --preview-command makes
+// of it, like a thumbnail or a listing of a tar file.  The two point at each
+// other in their metadata.
+const (
+	PREVIEW_SUFFIX           = ".preview"
+	PREVIEW_METADATA_PREVIEW = "preview-key"
+	PREVIEW_METADATA_ARCHIVE = "archive-key"
+)
+
+func checkPreviewFlags() error {
+	if PreviewSize != "" && PreviewCommand != "" {
+		return fmt.Errorf("Use either --preview-size or --preview-command, not both")
+	}
+	if PreviewSize != "" {
+		if _, err := parseSize(PreviewSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func wantPreview() bool {
+	return PreviewSize != "" || PreviewCommand != ""
+}
+
+// linkPreview adds the key of the preview to the archive's metadata.
+func linkPreview(key string, metadata map[string]*string) map[string]*string {
+	if !wantPreview() {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	metadata[PREVIEW_METADATA_PREVIEW] = aws.String(key + PREVIEW_SUFFIX)
+	return metadata
+}
+
+func previewData(filename string) ([]byte, error) {
+	if PreviewCommand != "" {
+		out, err := runHook(PreviewCommand, filename)
+		if err != nil {
+			return nil, fmt.Errorf("--preview-command failed for %s: %w", filename, err)
+		}
+		return out, nil
+	}
+
+	size, err := parseSize(PreviewSize)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(io.LimitReader(file, size))
+}
+
+// uploadPreview is done once the archive is complete, so that a preview
+// always has an archive behind it.
+func uploadPreview(s3session s3iface.S3API, bucket string, key string, filename string) error {
+	if !wantPreview() {
+		return nil
+	}
+
+	data, err := previewData(filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key + PREVIEW_SUFFIX),
+		Body:         bytes.NewReader(data),
+		StorageClass: aws.String(s3.StorageClassStandard),
+		Metadata:     map[string]*string{PREVIEW_METADATA_ARCHIVE: aws.String(key)},
+		Tagging:      objectTagging(key),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to upload the preview of %s: %w", key, err)
+	}
+
+	ui.Printf("Uploaded a %s preview to %s\n", formatBytes(int64(len(data))), key+PREVIEW_SUFFIX)
+	return nil
+}
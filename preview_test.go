@@ -0,0 +1,85 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestUploadPreview(t *testing.T) {
+	PreviewSize = "1K"
+	defer func() { PreviewSize = "" }()
+
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1024)
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := fake.objects["archive.bin"]
+	preview := fake.objects["archive.bin"+PREVIEW_SUFFIX]
+	if archive == nil || preview == nil {
+		t.Fatal("the archive or the preview is missing")
+	}
+	if !bytes.Equal(preview.data, data[:1024]) {
+		t.Errorf("the preview has %d bytes, want the first 1024", len(preview.data))
+	}
+	if preview.storageClass != s3.StorageClassStandard {
+		t.Errorf("the preview is in %s", preview.storageClass)
+	}
+	if key := archive.metadata[PREVIEW_METADATA_PREVIEW]; key == nil || *key != "archive.bin"+PREVIEW_SUFFIX {
+		t.Errorf("the archive links to %v", key)
+	}
+	if key := preview.metadata[PREVIEW_METADATA_ARCHIVE]; key == nil || *key != "archive.bin" {
+		t.Errorf("the preview links to %v", key)
+	}
+}
+
+func TestUploadPreviewCommand(t *testing.T) {
+	PreviewCommand = writeHook(t, "echo preview of $1")
+	defer func() { PreviewCommand = "" }()
+
+	fake := newFakeS3()
+	filename := writeTestFile(t, randomData(1024))
+	if err := uploadPreview(fake, "bucket", "archive.bin", filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.objects["archive.bin"+PREVIEW_SUFFIX].data); got != "preview of "+filename+"\n" {
+		t.Errorf("the preview is %q", got)
+	}
+}
+
+func TestCheckPreviewFlags(t *testing.T) {
+	defer func() { PreviewSize, PreviewCommand = "", "" }()
+
+	PreviewSize, PreviewCommand = "10M", ""
+	if err := checkPreviewFlags(); err != nil {
+		t.Error(err)
+	}
+	PreviewSize = "ten megs"
+	if err := checkPreviewFlags(); err == nil {
+		t.Error("an invalid size was accepted")
+	}
+	PreviewSize, PreviewCommand = "10M", "head -c 100"
+	if err := checkPreviewFlags(); err == nil {
+		t.Error("both flags were accepted")
+	}
+}
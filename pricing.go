@@ -0,0 +1,142 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const GB = 1024 * 1024 * 1024
+
+// retrievalTier describes what it costs to get an object back out of an
+// archive storage class.  Prices are the us-east-1 list prices, which is good
+// enough for a ballpark figure; other regions are within a few cents.
+type retrievalTier struct {
+	Name          string
+	PricePerGB    float64
+	PricePer1000  float64
+	TypicalHours  float64
+	TypicalString string
+}
+
+var retrievalTiers = map[string][]retrievalTier{
+	s3.StorageClassDeepArchive: {
+		{s3.TierStandard, 0.02, 0.10, 12, "within 12 hours"},
+		{s3.TierBulk, 0.0025, 0.025, 48, "within 48 hours"},
+	},
+	s3.StorageClassGlacier: {
+		{s3.TierExpedited, 0.03, 10.00, 0.08, "1-5 minutes"},
+		{s3.TierStandard, 0.01, 0.05, 5, "3-5 hours"},
+		{s3.TierBulk, 0.0, 0.0, 12, "5-12 hours"},
+	},
+}
+
+// storagePrices is what a GB costs per month in each storage class, at the
+// first volume tier.  INTELLIGENT_TIERING is priced as its frequent access
+// tier, which is the most it can cost.
+var storagePrices = map[string]float64{
+	s3.StorageClassStandard:           0.023,
+	s3.StorageClassReducedRedundancy:  0.023,
+	s3.StorageClassIntelligentTiering: 0.023,
+	s3.StorageClassStandardIa:         0.0125,
+	s3.StorageClassOnezoneIa:          0.01,
+	s3.StorageClassGlacierIr:          0.004,
+	s3.StorageClassGlacier:            0.0036,
+	s3.StorageClassDeepArchive:        0.00099,
+}
+
+// requestPrices is what 1,000 PUT, COPY, POST or LIST requests cost in each
+// storage class.  The parts of a multipart upload are billed as STANDARD
+// requests, only completing it at the storage class's rate.
+var requestPrices = map[string]float64{
+	s3.StorageClassStandard:           0.005,
+	s3.StorageClassReducedRedundancy:  0.005,
+	s3.StorageClassIntelligentTiering: 0.005,
+	s3.StorageClassStandardIa:         0.01,
+	s3.StorageClassOnezoneIa:          0.01,
+	s3.StorageClassGlacierIr:          0.02,
+	s3.StorageClassGlacier:            0.03,
+	s3.StorageClassDeepArchive:        0.05,
+}
+
+// requestCost estimates count PUT requests in a storage class.
+func requestCost(storageClass string, count int64) float64 {
+	price, ok := requestPrices[storageClass]
+	if !ok {
+		price = requestPrices[s3.StorageClassStandard]
+	}
+	return float64(count) / 1000 * price
+}
+
+// Every archived object also costs 8 KiB at the STANDARD rate for its name
+// and metadata, and 32 KiB at the archive rate for the index.
+const (
+	ARCHIVE_STANDARD_OVERHEAD = 8 * 1024
+	ARCHIVE_INDEX_OVERHEAD    = 32 * 1024
+)
+
+// storageCost estimates a month of storing count objects totalling size
+// bytes in a storage class.
+func storageCost(storageClass string, count int64, size int64) float64 {
+	price, ok := storagePrices[storageClass]
+	if !ok {
+		price = storagePrices[s3.StorageClassStandard]
+	}
+	if !isArchived(storageClass) {
+		return float64(size) / GB * price
+	}
+	return (float64(size)+float64(count*ARCHIVE_INDEX_OVERHEAD))/GB*price +
+		float64(count*ARCHIVE_STANDARD_OVERHEAD)/GB*storagePrices[s3.StorageClassStandard]
+}
+
+// isArchived reports whether objects in the given storage class have to be
+// restored before they can be read.
+func isArchived(storageClass string) bool {
+	_, ok := retrievalTiers[storageClass]
+	return ok
+}
+
+// findTier looks up the pricing of a retrieval tier for a storage class.
+func findTier(storageClass string, tier string) (retrievalTier, error) {
+	for _, t := range retrievalTiers[storageClass] {
+		if t.Name == tier {
+			return t, nil
+		}
+	}
+	return retrievalTier{}, fmt.Errorf("Tier %s is not available for %s", tier, storageClass)
+}
+
+// Cost returns the estimated cost of retrieving count objects totalling size
+// bytes.
+func (t retrievalTier) Cost(count int64, size int64) float64 {
+	return float64(size)/GB*t.PricePerGB + float64(count)/1000*t.PricePer1000
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,249 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CLI flags
+var ProgressSocket string
+
+const (
+	PROGRESS_STARTING    = "starting"
+	PROGRESS_UPLOADING   = "uploading"
+	PROGRESS_DOWNLOADING = "downloading"
+	PROGRESS_PAUSED      = "paused"
+	PROGRESS_DONE        = "done"
+	PROGRESS_FAILED      = "failed"
+)
+
+// progressState is what's sent to clients of the progress socket, one JSON
+// object per line, every time it changes.
+type progressState struct {
+	File       string `json:"file"`
+	Key        string `json:"key"`
+	UploadID   string `json:"upload_id,omitempty"`
+	State      string `json:"state"`
+	PartsDone  int64  `json:"parts_done"`
+	PartsTotal int64  `json:"parts_total"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total"`
+	// For compressed streams, bytes_done and bytes_total count the input,
+	// and these what's been sent of the output.
+	BytesSent        int64   `json:"bytes_sent,omitempty"`
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+	ETA              string  `json:"eta,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// progressServer lets a tray applet or a notification script follow an
+// upload without parsing our terminal output.  Anyone connecting to the Unix
+// socket gets the current state right away and every change after that.
+type progressServer struct {
+	path     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	state   progressState
+	clients map[net.Conn]bool
+	// What Resumed goes back to, uploading or downloading.
+	running string
+}
+
+var progress *progressServer
+
+func startProgressSocket(path string) error {
+	// A socket left behind by an earlier run which didn't get to clean up
+	// would make the listen fail.  Anything else at that path isn't ours.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use by another upload", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on --progress-socket %s: %w", path, err)
+	}
+
+	progress = &progressServer{
+		path:     path,
+		listener: listener,
+		state:    progressState{State: PROGRESS_STARTING},
+		clients:  map[net.Conn]bool{},
+	}
+	go progress.accept()
+
+	return nil
+}
+
+func stopProgressSocket() {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.listener.Close()
+	for conn := range progress.clients {
+		conn.Close()
+	}
+	os.Remove(progress.path)
+}
+
+func (p *progressServer) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		if p.send(conn, p.line()) {
+			p.clients[conn] = true
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *progressServer) line() []byte {
+	line, _ := json.Marshal(&p.state)
+	return append(line, '\n')
+}
+
+// send gives up on clients which don't keep up, rather than holding up the
+// upload.
+func (p *progressServer) send(conn net.Conn, line []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(line); err != nil {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// Update changes the state and tells every client about it.  Like the
+// tracer, it's safe to call when there's no progress socket.
+func (p *progressServer) Update(change func(state *progressState)) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	change(&p.state)
+	line := p.line()
+	for conn := range p.clients {
+		if !p.send(conn, line) {
+			delete(p.clients, conn)
+		}
+	}
+}
+
+// Start announces a file, Part counts one part of it as done and Finish
+// records how it ended.
+func (p *progressServer) Start(file string, key string, size int64, parts int64) {
+	p.Update(func(state *progressState) {
+		*state = progressState{
+			File:       file,
+			Key:        key,
+			State:      PROGRESS_STARTING,
+			PartsTotal: parts,
+			BytesTotal: size,
+		}
+	})
+}
+
+func (p *progressServer) Uploading(uploadID string) {
+	p.Update(func(state *progressState) {
+		state.UploadID = uploadID
+		state.State = PROGRESS_UPLOADING
+		p.running = state.State
+	})
+}
+
+// Downloading starts a download, of which done bytes were saved before.
+func (p *progressServer) Downloading(done int64) {
+	p.Update(func(state *progressState) {
+		state.State = PROGRESS_DOWNLOADING
+		state.BytesDone = done
+		p.running = state.State
+	})
+}
+
+// Paused and Resumed bracket the time we're waiting for the network.
+func (p *progressServer) Paused(err error) {
+	p.Update(func(state *progressState) {
+		state.State = PROGRESS_PAUSED
+		state.Error = err.Error()
+	})
+}
+
+func (p *progressServer) Resumed() {
+	p.Update(func(state *progressState) {
+		state.State = p.running
+		state.Error = ""
+	})
+}
+
+func (p *progressServer) Part(size int, eta time.Time) {
+	p.Update(func(state *progressState) {
+		state.PartsDone++
+		state.BytesDone += int64(size)
+		if !eta.IsZero() {
+			state.ETA = eta.Format(time.RFC3339)
+		}
+	})
+}
+
+// Streamed counts a part of a stream as done, for which read bytes of the
+// input have been read and sent bytes of output uploaded so far.
+func (p *progressServer) Streamed(read int64, sent int64, eta time.Time) {
+	p.Update(func(state *progressState) {
+		state.PartsDone++
+		state.BytesDone = read
+		state.BytesSent = sent
+		state.CompressionRatio = compressionRatio(read, sent)
+		if !eta.IsZero() {
+			state.ETA = eta.Format(time.RFC3339)
+		}
+	})
+}
+
+func (p *progressServer) Finish(err error) {
+	p.Update(func(state *progressState) {
+		if err != nil {
+			state.State = PROGRESS_FAILED
+			state.Error = err.Error()
+		} else {
+			state.State = PROGRESS_DONE
+		}
+	})
+}
@@ -0,0 +1,102 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressSocket(t *testing.T) {
+	// Unix socket paths are short, t.TempDir() can be too long.
+	dir, err := os.MkdirTemp("", "sgu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress")
+
+	if err := startProgressSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { stopProgressSocket(); progress = nil }()
+
+	if err := startProgressSocket(path); err == nil {
+		t.Error("a second upload took over the socket")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+
+	next := func() progressState {
+		if !lines.Scan() {
+			t.Fatalf("no update: %v", lines.Err())
+		}
+		var state progressState
+		if err := json.Unmarshal(lines.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	if state := next(); state.State != PROGRESS_STARTING {
+		t.Errorf("a new client got %+v", state)
+	}
+
+	progress.Start("archive.tar", "archive.tar", 150, 2)
+	progress.Uploading("upload-1")
+	progress.Part(100, time.Time{})
+	progress.Part(50, time.Time{})
+	progress.Finish(errors.New("boom"))
+
+	next()
+	next()
+	if state := next(); state.PartsDone != 1 || state.BytesDone != 100 || state.UploadID != "upload-1" {
+		t.Errorf("after the first part: %+v", state)
+	}
+	next()
+	if state := next(); state.State != PROGRESS_FAILED || state.Error != "boom" || state.BytesDone != 150 || state.BytesTotal != 150 {
+		t.Errorf("at the end: %+v", state)
+	}
+
+	stopProgressSocket()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket was left behind: %v", err)
+	}
+}
+
+func TestProgressSocketRefusesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := startProgressSocket(path); err == nil {
+		stopProgressSocket()
+		progress = nil
+		t.Error("a regular file was replaced by the socket")
+	}
+}
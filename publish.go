@@ -0,0 +1,160 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// A set is what one sync of a job leaves in the bucket.  sync --publish
+// only points sets/<job>/latest.json at it once every file is uploaded, so
+// a restore going by the pointer never sees a set which is half there.  The
+// objects are overwritten in place, so the pointer also has when each one
+// was last modified: one which changed after the set was published belongs
+// to a later sync, which may not have finished.
+
+const SETS_PREFIX = "sets/"
+
+type publishedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	StorageClass string    `json:"storage_class"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type publishedSet struct {
+	Version   int       `json:"version"`
+	Job       string    `json:"job"`
+	Host      string    `json:"host"`
+	Source    string    `json:"source"`
+	Prefix    string    `json:"prefix"`
+	Published time.Time `json:"published"`
+	// Run is the key of the run descriptor, with --track-run.
+	Run     string            `json:"run,omitempty"`
+	Objects []publishedObject `json:"objects"`
+}
+
+func setPointerKey(job string) string {
+	return SETS_PREFIX + job + "/latest.json"
+}
+
+func isSetPointer(key string) bool {
+	return strings.HasPrefix(key, SETS_PREFIX)
+}
+
+// publishSet lists the objects of the files once more, now that they're all
+// uploaded, and points the job's pointer at them.  The catalog gets an
+// entry for the pointer, which catalog search sets/ finds.
+func publishSet(s3session s3iface.S3API, bucket string, job string, dir string, prefix string, listPrefix string, files []localFile, run *runDescriptor, now time.Time) error {
+	remote, err := listRemote(s3session, bucket, listPrefix)
+	if err != nil {
+		return err
+	}
+
+	set := publishedSet{
+		Version:   1,
+		Job:       job,
+		Host:      auditHost(),
+		Source:    shortPath(dir),
+		Prefix:    prefix,
+		Published: now.UTC(),
+	}
+	if run != nil {
+		set.Run = run.key()
+	}
+	var size int64
+	for _, file := range files {
+		obj, ok := remote[file.Key]
+		if !ok {
+			return fmt.Errorf("%s isn't in the bucket, not publishing the set", file.Key)
+		}
+		set.Objects = append(set.Objects, publishedObject{obj.Key, obj.Size, obj.StorageClass, obj.LastModified})
+		size += obj.Size
+	}
+
+	key := setPointerKey(job)
+	if err := putJSON(s3session, bucket, key, set); err != nil {
+		return fmt.Errorf("Failed to publish the set: %w", err)
+	}
+	recordUpload(catalogEntry{Bucket: bucket, Key: key, Path: set.Source, Size: size, StorageClass: s3.StorageClassStandard, Uploaded: set.Published})
+	ui.Printf("Published %d objects (%s) as the latest set of %s\n", len(set.Objects), formatBytes(size), job)
+	return nil
+}
+
+// loadPublishedSet reads the pointer of job.
+func loadPublishedSet(s3session s3iface.S3API, bucket string, job string) (*publishedSet, error) {
+	var set publishedSet
+	found, err := getJSON(s3session, bucket, setPointerKey(job), &set)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the published set of %s: %w", job, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no published set, sync publishes one with --publish", job)
+	}
+	return &set, nil
+}
+
+// findPublishedSet finds the set synced to prefix, if one was published.
+func findPublishedSet(s3session s3iface.S3API, bucket string, prefix string) (*publishedSet, error) {
+	pointers, err := listAll(s3session, bucket, SETS_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, pointer := range pointers {
+		if !strings.HasSuffix(pointer.Key, "/latest.json") {
+			continue
+		}
+		var set publishedSet
+		if _, err := getJSON(s3session, bucket, pointer.Key, &set); err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %w", pointer.Key, err)
+		}
+		if strings.TrimSuffix(set.Prefix, "/") == prefix {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+// setObjects are the objects of a published set as they're in the bucket
+// now.  Those which changed since the set was published are left out with
+// a warning, they belong to a later sync.
+func setObjects(s3session s3iface.S3API, bucket string, set *publishedSet) ([]archivedObject, error) {
+	keys := make([]string, len(set.Objects))
+	for i, obj := range set.Objects {
+		keys[i] = obj.Key
+	}
+	current, err := collectObjects(s3session, bucket, "", keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []archivedObject
+	for i, obj := range current {
+		if obj.LastModified.After(set.Published) || obj.Size != set.Objects[i].Size {
+			warn(WARNING_SKIPPED, obj.Key, "%s changed after the set was published, leaving it out", obj.Key)
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
@@ -0,0 +1,91 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncPublish(t *testing.T) {
+	SyncPublish = true
+	defer func() { SyncPublish = false }()
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb"})
+	fake := newFakeS3()
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Error("a dry run published a set")
+	}
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	job := filepath.Base(dir)
+	set, err := loadPublishedSet(fake, "bucket", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Objects) != 2 || set.Objects[0].Key != "photos/a.jpg" || set.Prefix != "photos" {
+		t.Errorf("unexpected set %+v", set)
+	}
+
+	entries, err := loadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Key != setPointerKey(job) || last.Size != 3 {
+		t.Errorf("the catalog has %+v", last)
+	}
+
+	// A later sync uploaded a.jpg again, but never got to publish.
+	fake.objects["photos/a.jpg"].modified = time.Now().Add(time.Hour)
+	fake.objects["photos/c.jpg"] = &fakeObject{data: []byte("c"), modified: time.Now().Add(time.Hour)}
+
+	var out bytes.Buffer
+	objects, err := planObjects(&out, fake, "bucket", "photos/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "photos/b.jpg" {
+		t.Errorf("planned %v", objects)
+	}
+	if !strings.Contains(out.String(), "--all-objects") {
+		t.Errorf("didn't mention --all-objects:\n%s", out.String())
+	}
+
+	PlanAllObjects = true
+	defer func() { PlanAllObjects = false }()
+	if objects, _ := planObjects(&out, fake, "bucket", "photos", nil); len(objects) != 3 {
+		t.Errorf("planned %v with --all-objects", objects)
+	}
+}
+
+func TestLoadPublishedSet(t *testing.T) {
+	fake := newFakeS3()
+	if _, err := loadPublishedSet(fake, "bucket", "photos"); err == nil || !strings.Contains(err.Error(), "--publish") {
+		t.Errorf("expected a hint at --publish, got %v", err)
+	}
+	if set, err := findPublishedSet(fake, "bucket", "photos"); set != nil || err != nil {
+		t.Errorf("found %v, %v", set, err)
+	}
+}
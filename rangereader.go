@@ -0,0 +1,185 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// rangeReader reads a byte range of an object by fetching PART_SIZE chunks
+// with several concurrent ranged GETs, and hands them out in order.  At most
+// `workers` chunks, including the one being read, are held in memory at any
+// time, in buffers of a pool like the uploader's parts, so it can stream
+// objects of any size.  Every GET is conditional on the ETag the object had
+// to begin with, so that an object overwritten in the middle of a download
+// isn't stitched together from two versions.
+type rangeReader struct {
+	chunks  chan chan chunkResult
+	done    chan struct{}
+	current *bytes.Reader
+	buffer  []byte
+	buffers *transfer.BufferPool
+
+	// OnChunk, if set, is called with the size of every chunk as it's
+	// handed out, e.g. to report progress.
+	OnChunk func(size int)
+}
+
+func newRangeReader(s3session s3iface.S3API, bucket string, key string, etag string, start int64, end int64, workers int) *rangeReader {
+	if workers < 1 {
+		workers = 1
+	}
+
+	r := &rangeReader{
+		// The chunk being read is no longer in the channel, so it only
+		// needs room for the rest.
+		chunks:  make(chan chan chunkResult, workers-1),
+		done:    make(chan struct{}),
+		current: bytes.NewReader(nil),
+	}
+
+	// A small object doesn't need buffers for a whole chunk.
+	size := end - start + 1
+	if size > PART_SIZE {
+		size = PART_SIZE
+	}
+	r.buffers = transfer.NewBufferPool(workers, int(size))
+
+	retrier := chunkRetrier(s3session)
+	go func() {
+		defer close(r.chunks)
+
+		for _, chunk := range transfer.Chunks(start, end, PART_SIZE) {
+			ch := make(chan chunkResult, 1)
+
+			select {
+			case r.chunks <- ch:
+			case <-r.done:
+				return
+			}
+
+			go func(chunk transfer.Chunk) {
+				ch <- fetchRange(s3session, retrier, bucket, key, etag, chunk, r.buffers.Get())
+			}(chunk)
+		}
+	}()
+
+	return r
+}
+
+// fetchRange reads chunk into buffer, retried the way parts of uploads are.
+func fetchRange(s3session s3iface.S3API, retrier *transfer.Retrier, bucket string, key string, etag string, chunk transfer.Chunk, buffer []byte) chunkResult {
+	data := buffer[:chunk.Size]
+
+	var changed bool
+	err := retrier.Do(context.Background(), func(ctx context.Context, retries int, stalls int) (bool, error) {
+		resp, err := s3session.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", chunk.Offset, chunk.Last())),
+			IfMatch: aws.String(etag),
+		})
+		if isPreconditionFailed(err) {
+			changed = true
+			return false, transfer.Permanent(err)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		n, err := io.ReadFull(resp.Body, data)
+		if err == nil {
+			// Anything after the range is as wrong as too little.
+			var extra int64
+			extra, err = io.Copy(io.Discard, resp.Body)
+			n += int(extra)
+		}
+		resp.Body.Close()
+		if (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF) && n != len(data) {
+			err = fmt.Errorf("got %d bytes, expected %d", n, len(data))
+		}
+		return false, err
+	})
+	if changed {
+		return chunkResult{nil, fmt.Errorf("%s has changed since the download started", key)}
+	}
+	if err != nil {
+		return chunkResult{nil, fmt.Errorf("Failed to download bytes %d-%d: %w", chunk.Offset, chunk.Last(), err)}
+	}
+	return chunkResult{data, nil}
+}
+
+// isPreconditionFailed reports whether a conditional request found the
+// object changed.
+func isPreconditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "PreconditionFailed"
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for r.current.Len() == 0 {
+		// The chunk which has been read makes room for the next one.
+		if r.buffer != nil {
+			r.buffers.Put(r.buffer)
+			r.buffer = nil
+		}
+
+		ch, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+
+		result := <-ch
+		if result.err != nil {
+			return 0, result.err
+		}
+		r.buffer = result.data
+		r.current = bytes.NewReader(result.data)
+		if r.OnChunk != nil {
+			r.OnChunk(len(result.data))
+		}
+	}
+
+	return r.current.Read(p)
+}
+
+// Close stops fetching any further chunks.  Requests already in flight are
+// left to finish in the background.
+func (r *rangeReader) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	return nil
+}
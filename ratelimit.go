@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var RequestRate string
+
+var requestRatePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)/(s|m)$`)
+
+// requestLimiter spaces out requests evenly, so that no more than one is
+// sent per interval.  It's shared by every session, and therefore by every
+// worker, for the whole run.  mu protects the interval, which the KMS
+// limiter changes as it goes.
+type requestLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	pacer    transfer.Pacer
+}
+
+var limiter *requestLimiter
+
+// parseRequestRate turns "10/s" or "300/m" into the time between requests.
+func parseRequestRate(spec string) (time.Duration, error) {
+	m := requestRatePattern.FindStringSubmatch(spec)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid --request-rate %q, use e.g. 10/s or 300/m", spec)
+	}
+
+	count, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("Invalid --request-rate %q, use e.g. 10/s or 300/m", spec)
+	}
+
+	per := time.Second
+	if m[2] == "m" {
+		per = time.Minute
+	}
+
+	return time.Duration(float64(per) / count), nil
+}
+
+func checkRequestRate() error {
+	if RequestRate == "" {
+		return nil
+	}
+
+	interval, err := parseRequestRate(RequestRate)
+	if err != nil {
+		return err
+	}
+
+	limiter = &requestLimiter{interval: interval}
+	return nil
+}
+
+// Wait blocks until it's our turn to send a request.
+func (l *requestLimiter) Wait(r *request.Request) {
+	l.mu.Lock()
+	interval := l.interval
+	l.mu.Unlock()
+
+	if err := l.pacer.Wait(r.Context(), interval); err != nil {
+		r.Error = err
+	}
+}
+
+// limitRequests makes every request of the session, retries included, wait
+// for the global limiter.  The SDK signs each attempt right before sending
+// it, and an error there stops the attempt, so that's where we hook in.
+func limitRequests(handlers *request.Handlers) {
+	if limiter == nil {
+		return
+	}
+	handlers.Sign.PushFront(limiter.Wait)
+}
@@ -0,0 +1,51 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRequestRate(t *testing.T) {
+	tests := []struct {
+		spec     string
+		interval time.Duration
+		ok       bool
+	}{
+		{"10/s", 100 * time.Millisecond, true},
+		{"1/s", time.Second, true},
+		{"300/m", 200 * time.Millisecond, true},
+		{"0.5/s", 2 * time.Second, true},
+		{"0/s", 0, false},
+		{"10", 0, false},
+		{"10/h", 0, false},
+		{"-1/s", 0, false},
+		{"ten/s", 0, false},
+	}
+
+	for _, tt := range tests {
+		interval, err := parseRequestRate(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRequestRate(%q): got error %v, want ok %v", tt.spec, err, tt.ok)
+			continue
+		}
+		if interval != tt.interval {
+			t.Errorf("parseRequestRate(%q) = %s, want %s", tt.spec, interval, tt.interval)
+		}
+	}
+}
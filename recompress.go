@@ -0,0 +1,179 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var Recompress string
+
+// Metadata of recompressed uploads, telling what the file was before.
+const (
+	RECOMPRESS_METADATA_FROM = "recompressed-from"
+	RECOMPRESS_METADATA_NAME = "original-name"
+	RECOMPRESS_METADATA_SIZE = "original-size"
+)
+
+func checkRecompressFlags() error {
+	if Recompress == "" {
+		return nil
+	}
+	if Recompress != COMPRESS_ZSTD {
+		return fmt.Errorf("--recompress only converts to %s", COMPRESS_ZSTD)
+	}
+	if Tar {
+		return fmt.Errorf("--recompress doesn't go with --tar, use --compress %s", COMPRESS_ZSTD)
+	}
+	if Nodes > 1 {
+		return fmt.Errorf("--recompress can't be shared between --nodes, a stream can only be read once")
+	}
+	if UploadID != "" {
+		return fmt.Errorf("--recompress uploads a stream, which can't be resumed with --upload-id")
+	}
+	return nil
+}
+
+// isGzipFile tells by its first bytes whether filename is gzip compressed.
+func isGzipFile(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, len(GZIP_MAGIC))
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(head[:n], GZIP_MAGIC), nil
+}
+
+// recompressKey swaps the extension of a gzip file for zstd's, so that
+// photos.tar.gz and photos.tgz become photos.tar.zst.
+func recompressKey(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".tgz"):
+		return strings.TrimSuffix(key, ".tgz") + ".tar.zst"
+	case strings.HasSuffix(key, ".gz"):
+		return strings.TrimSuffix(key, ".gz") + ".zst"
+	}
+	return key + ".zst"
+}
+
+func UploadRecompressed(bucket string, region string, filename string) error {
+	gzipped, err := isGzipFile(filename)
+	if err != nil {
+		return err
+	}
+	if !gzipped {
+		ui.Printf("%s isn't gzip compressed, uploading it as it is\n", filename)
+		return Upload(bucket, region, filename, "")
+	}
+
+	return uploadRecompressed(newS3Session(region), lazyCleanup(region), bucket, filename, Recompress)
+}
+
+// uploadRecompressed decompresses a gzip file and uploads it compressed with
+// format instead.  The gzip checksum is checked on the way, and a file which
+// turns out damaged aborts the upload.
+func uploadRecompressed(s3session s3iface.S3API, cleanup cleanupSession, bucket string, filename string, format string) error {
+	include, err := includeFile(filename)
+	if err != nil {
+		return err
+	}
+	if !include {
+		ui.Println("Skipping", filename)
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// --key-command is trusted to know what it wants, the extension
+	// included.
+	key, err := uploadKey(filename)
+	if err != nil {
+		return err
+	}
+	if KeyCommand == "" {
+		key = recompressKey(key)
+	}
+
+	metadata, err := uploadMetadata(filename)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	metadata[RECOMPRESS_METADATA_FROM] = aws.String(COMPRESS_GZIP)
+	metadata[RECOMPRESS_METADATA_NAME] = aws.String(path.Base(filename))
+	metadata[RECOMPRESS_METADATA_SIZE] = aws.String(strconv.FormatInt(stat.Size(), 10))
+	metadata = compressionMetadata(metadata, format)
+
+	// Progress goes by how much of the gzip file has been read, so the ratio
+	// is that of the new archive to the old one.
+	input := newStreamInput(filename, stat.Size(), true)
+	gz, err := gzip.NewReader(input.Reader(file))
+	if err != nil {
+		return fmt.Errorf("%s is a damaged gzip file: %w", filename, err)
+	}
+
+	ui.Printf("File to upload: %s, recompressed with %s\n", filename, format)
+	stream := pipeStream(format, func(w io.Writer) error {
+		if _, err := io.Copy(w, gz); err != nil {
+			return fmt.Errorf("%s is a damaged gzip file: %w", filename, err)
+		}
+		return nil
+	})
+	defer stream.Close()
+
+	var source io.Reader = stream
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		metadata = encryptionMetadata(metadata, c)
+		source = encryptReader(stream, c)
+	}
+
+	// The result is usually smaller than the gzip file, which makes its
+	// size good enough a guess for the part size.
+	return uploadStream(s3session, cleanup, bucket, key, source, input, metadata, streamPartSize(stat.Size()))
+}
@@ -0,0 +1,140 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestRecompressKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"photos.tar.gz":   "photos.tar.zst",
+		"photos.tgz":      "photos.tar.zst",
+		"db/dump.sql.gz":  "db/dump.sql.zst",
+		"photos.gzip-ish": "photos.gzip-ish.zst",
+	} {
+		if got := recompressKey(key); got != want {
+			t.Errorf("recompressKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestIsGzipFile(t *testing.T) {
+	for name, c := range map[string]struct {
+		content []byte
+		want    bool
+	}{
+		"gzip":  {archiveBytes(t, true), true},
+		"tar":   {archiveBytes(t, false), false},
+		"empty": {nil, false},
+		"short": {[]byte{0x1f}, false},
+	} {
+		got, err := isGzipFile(writeArchive(t, "file", c.content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: got %v, want %v", name, got, c.want)
+		}
+	}
+}
+
+func TestUploadRecompressed(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd isn't installed")
+	}
+
+	gzipped := archiveBytes(t, true)
+	filename := writeArchive(t, "photos.tgz", gzipped)
+
+	fake := newFakeS3()
+	if err := uploadRecompressed(fake, fake.cleanup, "bucket", filename, COMPRESS_ZSTD); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["photos.tar.zst"]
+	if obj == nil {
+		t.Fatalf("no photos.tar.zst in %v", fake.objects)
+	}
+
+	cmd := exec.Command("zstd", "-d", "-c")
+	cmd.Stdin = bytes.NewReader(obj.data)
+	data, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, archiveBytes(t, false)) {
+		t.Error("the uploaded object doesn't decompress to the original archive")
+	}
+
+	for name, want := range map[string]string{
+		RECOMPRESS_METADATA_FROM: COMPRESS_GZIP,
+		RECOMPRESS_METADATA_NAME: filepath.Base(filename),
+	} {
+		if got := aws.StringValue(obj.metadata[name]); got != want {
+			t.Errorf("metadata %s is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUploadRecompressedDamaged(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(randomData(PART_SIZE + 1024))
+	gz.Close()
+	damaged := buf.Bytes()
+	damaged[len(damaged)-8] ^= 0xff
+
+	fake := newFakeS3()
+	// gzip keeps the comparison simple, the gzip checksum is checked the
+	// same whatever the stream is compressed with.
+	err := uploadRecompressed(fake, fake.cleanup, "bucket", writeArchive(t, "data.gz", damaged), COMPRESS_GZIP)
+	if err == nil || !strings.Contains(err.Error(), "damaged gzip file") {
+		t.Fatalf("got %v, want a damaged gzip file", err)
+	}
+	if len(fake.objects) != 0 || len(fake.uploads) != 0 {
+		t.Errorf("the upload wasn't aborted: %d objects, %d uploads", len(fake.objects), len(fake.uploads))
+	}
+}
+
+func TestCheckRecompressFlags(t *testing.T) {
+	defer func() { Recompress = ""; Tar = false; UploadID = "" }()
+
+	Recompress = COMPRESS_ZSTD
+	if err := checkRecompressFlags(); err != nil {
+		t.Errorf("--recompress zstd: %v", err)
+	}
+	Recompress = COMPRESS_GZIP
+	if err := checkRecompressFlags(); err == nil {
+		t.Error("--recompress gzip was accepted")
+	}
+	Recompress, Tar = COMPRESS_ZSTD, true
+	if err := checkRecompressFlags(); err == nil {
+		t.Error("--recompress was accepted with --tar")
+	}
+	Tar, UploadID = false, "upload-1"
+	if err := checkRecompressFlags(); err == nil {
+		t.Error("--recompress was accepted with --upload-id")
+	}
+}
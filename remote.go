@@ -0,0 +1,142 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	REMOTE_SFTP = "sftp"
+	REMOTE_SMB  = "smb"
+)
+
+// remoteSource is a file on a NAS or another machine, read with the sftp or
+// smbclient program and streamed into the upload, so nothing is copied to
+// local disk first.
+type remoteSource struct {
+	URL    string
+	Scheme string
+	User   string
+	Host   string
+	Port   string
+	// Share is the SMB share, Path the file's path on the server or in
+	// the share.
+	Share string
+	Path  string
+}
+
+func isRemoteSource(filename string) bool {
+	return strings.HasPrefix(filename, REMOTE_SFTP+"://") || strings.HasPrefix(filename, REMOTE_SMB+"://")
+}
+
+// parseRemoteSource takes sftp://[user@]host[:port]/path, where the path
+// is absolute, and smb://[user@]host[:port]/share/path.  Passwords aren't
+// taken from the URL, where they'd end up in the shell's history.
+func parseRemoteSource(s string) (remoteSource, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != REMOTE_SFTP && u.Scheme != REMOTE_SMB) || u.Hostname() == "" {
+		return remoteSource{}, fmt.Errorf("Expected sftp://[user@]host/path or smb://[user@]host/share/path, got %q", s)
+	}
+	if _, ok := u.User.Password(); ok {
+		return remoteSource{}, fmt.Errorf("Leave the password out of %s, sftp and smbclient ask for it", u.Redacted())
+	}
+
+	src := remoteSource{URL: s, Scheme: u.Scheme, User: u.User.Username(), Host: u.Hostname(), Port: u.Port(), Path: u.Path}
+	if src.Scheme == REMOTE_SMB {
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return remoteSource{}, fmt.Errorf("Expected smb://[user@]host/share/path, got %q", s)
+		}
+		src.Share, src.Path = parts[0], parts[1]
+		if strings.Contains(src.Path, `"`) {
+			return remoteSource{}, fmt.Errorf("smbclient can't be given a path with \" in it, got %q", src.Path)
+		}
+	}
+	if src.Path == "" || strings.HasSuffix(src.Path, "/") {
+		return remoteSource{}, fmt.Errorf("%s names a directory, only files can be read remotely", s)
+	}
+	return src, nil
+}
+
+// command writes the file to standard output.
+func (src remoteSource) command() []string {
+	if src.Scheme == REMOTE_SMB {
+		args := []string{"smbclient", "//" + src.Host + "/" + src.Share}
+		if src.Port != "" {
+			args = append(args, "--port", src.Port)
+		}
+		if src.User != "" {
+			args = append(args, "--user", src.User)
+		}
+		return append(args, "--command", `get "`+strings.ReplaceAll(src.Path, "/", `\`)+`" -`)
+	}
+
+	args := []string{"sftp", "-q"}
+	if src.Port != "" {
+		args = append(args, "-P", src.Port)
+	}
+	host := src.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if src.User != "" {
+		host = src.User + "@" + host
+	}
+	return append(args, host+":"+src.Path, "/dev/stdout")
+}
+
+func UploadRemote(bucket string, region string, source string) error {
+	src, err := parseRemoteSource(source)
+	if err != nil {
+		return err
+	}
+	if err := checkRemoteFlags(); err != nil {
+		return err
+	}
+	ui.Println("Reading", source, "with", src.command()[0])
+	out, err := startCommand(src.command())
+	if err != nil {
+		return err
+	}
+	return uploadRemote(newS3Session(region), lazyCleanup(region), bucket, src, out)
+}
+
+// checkRemoteFlags rules out what needs the file at hand: it's read once,
+// as a stream.
+func checkRemoteFlags() error {
+	switch {
+	case Tar || Recompress != "":
+		return fmt.Errorf("Remote files are uploaded as they are, --tar and --recompress need them locally")
+	case UploadID != "" || ResumeToken != "":
+		return fmt.Errorf("Remote files are read as a stream, so their uploads can't be resumed")
+	case Nodes > 1:
+		return fmt.Errorf("Remote files can't be shared between --nodes, a stream can only be read once")
+	case Snapshot != "" || VSS:
+		return fmt.Errorf("Snapshots are taken of local files, take one on the server instead")
+	}
+	return nil
+}
+
+func uploadRemote(s3session s3iface.S3API, cleanup cleanupSession, bucket string, src remoteSource, in io.Reader) error {
+	return uploadNamedStream(s3session, cleanup, bucket, src.URL, src.URL, in)
+}
@@ -0,0 +1,182 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var ConfigVerifyKey string
+var ConfigPublishJobs bool
+
+var configPublishCmd = &cobra.Command{
+	Use:   "publish file s3://bucket/key",
+	Short: "Upload a config file and its signature, for machines reading their config from S3",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ConfigPublish(newS3Session(Region), cmd.Root(), args[0], args[1], ConfigPublishJobs)
+	},
+}
+
+// configVerifyKeyFile is the key configs from S3 have to be signed with.
+// Like the config file's name, it can't come from the config itself.
+func configVerifyKeyFile() string {
+	if ConfigVerifyKey != "" {
+		return ConfigVerifyKey
+	}
+	return os.Getenv(configEnv("config-verify-key"))
+}
+
+// configCacheFile is where the last config fetched from url is kept.
+func configCacheFile(url string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, fmt.Sprintf("config-%x", sum[:8])), nil
+}
+
+// fetchRemoteConfig reads a config file from S3.  It can run commands on
+// every machine reading it, with key-command and the like, so it has to be
+// signed.  When S3 can't be reached the last copy is used, so that a machine
+// which is offline for a while keeps backing up the way it was told.
+func fetchRemoteConfig(s3session s3iface.S3API, url string) ([]byte, error) {
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := configVerifyKeyFile()
+	if keyFile == "" {
+		return nil, fmt.Errorf("A config from S3 has to be signed, give the public key with --config-verify-key")
+	}
+	public, err := loadVerifyKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load --config-verify-key: %w", err)
+	}
+	cache, err := configCacheFile(url)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := getObject(s3session, bucket, key)
+	if err != nil {
+		cached, cacheErr := os.ReadFile(cache)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("Failed to fetch the config %s: %w", url, err)
+		}
+		ui.Warnf("Failed to fetch the config %s, using the copy from the last run: %v\n", url, err)
+		return cached, nil
+	}
+
+	// A bad signature isn't a reason to fall back to the last copy, it's
+	// a reason to stop and look.
+	if err := verifySignature(s3session, bucket, key, data, public); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(cache+".tmp", data, 0600); err != nil {
+		return nil, err
+	}
+	return data, os.Rename(cache+".tmp", cache)
+}
+
+func getObject(s3session s3iface.S3API, bucket string, key string) ([]byte, error) {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// ConfigPublish checks a config file and uploads it with a signature made
+// with --signing-key, for machines started with --config s3://bucket/key.
+// With jobs, it's a jobs file, for daemons started with --jobs
+// s3://bucket/key.
+func ConfigPublish(s3session s3iface.S3API, root *cobra.Command, filename string, url string, jobs bool) error {
+	if signingPrivateKey == nil {
+		return fmt.Errorf("A config in S3 has to be signed, give the private key with --signing-key")
+	}
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var what string
+	if jobs {
+		config, err := parseJobs(bytes.NewReader(data), filename)
+		if err != nil {
+			return err
+		}
+		what = fmt.Sprintf("%d jobs", len(config.Jobs))
+	} else {
+		settings, err := parseConfig(bytes.NewReader(data), filename)
+		if err != nil {
+			return err
+		}
+		for _, s := range settings {
+			if _, known := configurableFlag(root, s.Name, true); !known {
+				return fmt.Errorf("%s: there's no setting %s", s.Source, s.Name)
+			}
+		}
+		what = fmt.Sprintf("%d settings", len(settings))
+	}
+
+	// The config has to be readable straight away, so it's never archived.
+	// What every machine reading it does is audited.
+	_, err = s3session.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("text/plain"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	}, audited)
+	if err != nil {
+		return fmt.Errorf("Failed to upload the config: %w", err)
+	}
+	if err := putSignature(s3session, bucket, key, data); err != nil {
+		return fmt.Errorf("Failed to upload the config's signature: %w", err)
+	}
+
+	ui.Printf("Published %s to %s, with %s\n", filename, url, what)
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&ConfigVerifyKey, "config-verify-key", "", "require a config read from S3 to be signed by this ed25519 public key")
+	configPublishCmd.Flags().BoolVar(&ConfigPublishJobs, "jobs", false, "the file is a jobs file for serve --jobs, not a config file")
+	configCmd.AddCommand(configPublishCmd)
+}
@@ -0,0 +1,82 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoteConfig(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "fleet.pem")
+	if err := Keygen(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { ConfigVerifyKey, signingPrivateKey = "", nil }()
+	fake := newFakeS3()
+	config := writeConfig(t, "bucket = backups\nprefix = {hostname}/\n")
+	url := "s3://fleet/backup.conf"
+
+	if err := ConfigPublish(fake, rootCmd, config, url, false); err == nil || !strings.Contains(err.Error(), "--signing-key") {
+		t.Errorf("published without a signature: %v", err)
+	}
+	var err error
+	if signingPrivateKey, err = loadSigningKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigPublish(fake, rootCmd, writeConfig(t, "bucket = backups\ncolour = blue\n"), url, false); err == nil {
+		t.Error("published an unknown setting")
+	}
+	if err := ConfigPublish(fake, rootCmd, config, url, false); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["backup.conf.sig"]; obj == nil || obj.storageClass != "STANDARD" {
+		t.Fatal("the signature wasn't uploaded")
+	}
+
+	if _, err := fetchRemoteConfig(fake, url); err == nil || !strings.Contains(err.Error(), "--config-verify-key") {
+		t.Errorf("fetched without a key: %v", err)
+	}
+	ConfigVerifyKey = keyFile + ".pub"
+	data, err := fetchRemoteConfig(fake, url)
+	if err != nil || string(data) != "bucket = backups\nprefix = {hostname}/\n" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	// A changed config is refused, not replaced by the last one.
+	fake.objects["backup.conf"].data = []byte("bucket = backups\nkey-command = /tmp/evil\n")
+	if _, err := fetchRemoteConfig(fake, url); err == nil || !strings.Contains(err.Error(), "not valid") {
+		t.Errorf("got %v", err)
+	}
+
+	// Without S3, the last good copy is used.
+	delete(fake.objects, "backup.conf")
+	data, err = fetchRemoteConfig(fake, url)
+	if err != nil || string(data) != "bucket = backups\nprefix = {hostname}/\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	cache, _ := configCacheFile(url)
+	os.Remove(cache)
+	if _, err := fetchRemoteConfig(fake, url); err == nil {
+		t.Error("fetched a config that isn't there")
+	}
+}
@@ -0,0 +1,163 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// repair-set flags
+var RepairDryRun bool
+
+var repairSetCmd = &cobra.Command{
+	Use:   "repair-set job",
+	Short: "Upload what the last run of sync --track-run for job didn't, and mark it complete",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := RepairSet(newS3Session(Region), lazyCleanup(Region), BucketName, args[0], RepairDryRun, time.Now())
+		reportRetries()
+		return err
+	},
+}
+
+// latestRun is the run of job which started last.
+func latestRun(s3session s3iface.S3API, bucket string, job string) (*runDescriptor, error) {
+	objects, err := listAll(s3session, bucket, RUNS_PREFIX+job+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("No runs of %s are recorded, sync records them with --track-run", job)
+	}
+	// The keys start with the time the run started.
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	var run runDescriptor
+	last := objects[len(objects)-1].Key
+	if _, err := getJSON(s3session, bucket, last, &run); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %w", last, err)
+	}
+	return &run, nil
+}
+
+// missingFiles are the planned files of run whose objects aren't there, or
+// weren't uploaded by it.
+func missingFiles(s3session s3iface.S3API, bucket string, run *runDescriptor) ([]runFile, error) {
+	// LastModified only has seconds.
+	started := run.Started.Truncate(time.Second)
+
+	var missing []runFile
+	for _, file := range run.Planned {
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+		})
+		if isNoSuchKey(err) {
+			missing = append(missing, file)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to look up %s: %w", file.Key, err)
+		}
+		if aws.TimeValue(head.LastModified).Before(started) {
+			missing = append(missing, file)
+		}
+	}
+	return missing, nil
+}
+
+// RepairSet completes the last run of job, if it didn't finish: the files
+// it planned to upload and didn't are uploaded, resuming where their
+// uploads left off, and the run is marked complete, and its set published
+// if it was going to be.  It doesn't scan the directory again or compare
+// anything else; deletions the run didn't get to are left to the next sync.
+func RepairSet(s3session s3iface.S3API, aborts cleanupSession, bucket string, job string, dryRun bool, now time.Time) error {
+	run, err := latestRun(s3session, bucket, job)
+	if err != nil {
+		return err
+	}
+	started := run.Started.Local().Format("2006-01-02 15:04:05")
+	if run.Status == RUN_COMPLETE {
+		ui.Printf("The last run of %s, started %s, is complete\n", job, started)
+		return nil
+	}
+	if run.Host != auditHost() {
+		return fmt.Errorf("The last run of %s was on %s, its files are there, repair it there", job, run.Host)
+	}
+	if run.Planned == nil && run.Files > 0 {
+		return fmt.Errorf("The last run of %s didn't record its files, run sync again instead", job)
+	}
+
+	missing, err := missingFiles(s3session, bucket, run)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, file := range missing {
+		size += file.Size
+	}
+	ui.Printf("The last run of %s, started %s, is %s: %d of %d files to upload (%s)\n", job, started, run.Status, len(missing), len(run.Planned), formatBytes(size))
+
+	for _, file := range missing {
+		if dryRun {
+			ui.Printf("Would upload %s to %s\n", file.Path, file.Key)
+			continue
+		}
+		if err := uploadObject(s3session, aborts, bucket, longPath(file.Path), file.Key, ""); err != nil {
+			return fmt.Errorf("Failed to upload %s: %w", file.Path, err)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	if run.Publish {
+		files, err := scanDirectory(longPath(run.Source), run.Prefix)
+		if err != nil {
+			return err
+		}
+		// Those sync skipped aren't part of the set.
+		if files, err = syncCaseCollisions(files, map[string]archivedObject{}, false); err != nil {
+			return err
+		}
+		if err := publishSet(s3session, bucket, run.Job, run.Source, run.Prefix, run.Prefix, files, run, now); err != nil {
+			return err
+		}
+	}
+
+	repaired := now.UTC()
+	run.Repaired = &repaired
+	if err := run.finish(s3session, bucket, nil, now); err != nil {
+		return fmt.Errorf("Failed to mark the run complete: %w", err)
+	}
+	ui.Printf("Repaired the run of %s, it's complete\n", job)
+	return nil
+}
+
+func init() {
+	repairSetCmd.Flags().BoolVar(&RepairDryRun, "dry-run", false, "only show what would be uploaded")
+	rootCmd.AddCommand(repairSetCmd)
+}
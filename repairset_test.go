@@ -0,0 +1,98 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepairSet(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb", "c.jpg": "ccc"})
+	fake := newFakeS3()
+	started := time.Now().Add(-time.Hour)
+
+	// The run uploaded a.jpg, and was killed before it got to b.jpg, which
+	// a run before it uploaded, and c.jpg.
+	run := &runDescriptor{Job: "photos", Host: auditHost(), Source: dir, Prefix: "photos", Started: started, Publish: true, Status: RUN_STARTED}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		run.Planned = append(run.Planned, runFile{"photos/" + name, filepath.Join(dir, name), 1})
+	}
+	if err := run.start(fake, "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["photos/a.jpg"] = &fakeObject{data: []byte("a"), modified: started.Add(time.Minute)}
+	fake.objects["photos/b.jpg"] = &fakeObject{data: []byte("old"), modified: started.Add(-24 * time.Hour)}
+
+	missing, err := missingFiles(fake, "bucket", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 || missing[0].Key != "photos/b.jpg" || missing[1].Key != "photos/c.jpg" {
+		t.Errorf("missing %v", missing)
+	}
+
+	if err := RepairSet(fake, fake.cleanup, "bucket", "photos", true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["photos/c.jpg"] != nil {
+		t.Error("a dry run uploaded files")
+	}
+
+	if err := RepairSet(fake, fake.cleanup, "bucket", "photos", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["photos/b.jpg"].data) != "bb" || fake.objects["photos/c.jpg"] == nil {
+		t.Error("the missing files weren't uploaded")
+	}
+	if string(fake.objects["photos/a.jpg"].data) != "a" || fake.objects["photos/a.jpg"].etag != "" {
+		t.Error("a.jpg was uploaded again")
+	}
+
+	repaired, err := latestRun(fake, "bucket", "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired.Status != RUN_COMPLETE || repaired.Repaired == nil {
+		t.Errorf("the run is %+v", repaired)
+	}
+	if set, err := loadPublishedSet(fake, "bucket", "photos"); err != nil || len(set.Objects) != 3 {
+		t.Errorf("published %+v, %v", set, err)
+	}
+
+	// Nothing left to do.
+	uploads := fake.nextID
+	if err := RepairSet(fake, fake.cleanup, "bucket", "photos", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploads {
+		t.Error("a complete run was repaired again")
+	}
+}
+
+func TestRepairSetElsewhere(t *testing.T) {
+	fake := newFakeS3()
+	if err := RepairSet(fake, fake.cleanup, "bucket", "photos", false, time.Now()); err == nil {
+		t.Error("repaired a job without runs")
+	}
+	run := &runDescriptor{Job: "photos", Host: "not-" + auditHost(), Started: time.Now(), Status: RUN_STARTED}
+	run.start(fake, "bucket")
+	if err := RepairSet(fake, fake.cleanup, "bucket", "photos", false, time.Now()); err == nil {
+		t.Error("repaired the run of another host")
+	}
+}
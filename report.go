@@ -0,0 +1,303 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// report flags
+var ReportPrefix string
+var ReportOutput string
+
+// SCRUB_NEVER is how the report shows objects scrub hasn't looked at yet.
+const SCRUB_NEVER = "never checked"
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Summarize what's in the bucket",
+}
+
+var reportHTMLCmd = &cobra.Command{
+	Use:   "html",
+	Short: "Write a static HTML report of the archive",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ReportHTML(BucketName, Region, ReportPrefix, ReportOutput)
+	},
+}
+
+type reportRow struct {
+	Name    string
+	Objects int
+	Bytes   int64
+	// Share is the row's percentage of all bytes, or for the months of the
+	// running total.
+	Share float64
+}
+
+type reportFailure struct {
+	Key     string
+	Checked time.Time
+	Detail  string
+}
+
+// reportDrift is how far the latest run of a job was from its usual.
+type reportDrift struct {
+	Job     string
+	Started time.Time
+	Detail  string
+}
+
+type reportSection struct {
+	Title string
+	Share string
+	Rows  []reportRow
+}
+
+type catalogReport struct {
+	Bucket    string
+	Prefix    string
+	Generated time.Time
+	Objects   int
+	Bytes     int64
+	Months    []reportRow
+	Sets      []reportRow
+	Classes   []reportRow
+	Scrubbed  []reportRow
+	Failures  []reportFailure
+	Drift     []reportDrift
+}
+
+// reportSet groups objects by the first part of their key, which is how
+// people tend to lay out their backups: photos/..., mail/...
+func reportSet(key string, prefix string) string {
+	rest := strings.TrimPrefix(key, prefix)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return prefix + rest[:i+1]
+	}
+	return "(no set)"
+}
+
+// reportRows turns the totals into rows, largest first.
+func reportRows(objects map[string]int, bytes map[string]int64, total int64) []reportRow {
+	var rows []reportRow
+	for name, n := range objects {
+		rows = append(rows, reportRow{Name: name, Objects: n, Bytes: bytes[name], Share: percentOf(bytes[name], total)})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Bytes != rows[j].Bytes {
+			return rows[i].Bytes > rows[j].Bytes
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	return rows
+}
+
+func percentOf(n int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func summarizeCatalog(bucket string, prefix string, objects []archivedObject, history map[string]scrubRecord, now time.Time) catalogReport {
+	report := catalogReport{Bucket: bucket, Prefix: prefix, Generated: now, Objects: len(objects)}
+
+	setObjects, setBytes := map[string]int{}, map[string]int64{}
+	classObjects, classBytes := map[string]int{}, map[string]int64{}
+	monthObjects, monthBytes := map[string]int{}, map[string]int64{}
+	scrubObjects, scrubBytes := map[string]int{}, map[string]int64{}
+
+	for _, obj := range objects {
+		report.Bytes += obj.Size
+
+		set := reportSet(obj.Key, prefix)
+		setObjects[set]++
+		setBytes[set] += obj.Size
+
+		classObjects[obj.StorageClass]++
+		classBytes[obj.StorageClass] += obj.Size
+
+		month := obj.LastModified.UTC().Format("2006-01")
+		monthObjects[month]++
+		monthBytes[month] += obj.Size
+
+		record, ok := history[bucket+"/"+obj.Key]
+		status := record.Result
+		if !ok {
+			status = SCRUB_NEVER
+		}
+		scrubObjects[status]++
+		scrubBytes[status] += obj.Size
+
+		if status == SCRUB_FAILED {
+			report.Failures = append(report.Failures, reportFailure{obj.Key, record.Checked, record.Detail})
+		}
+	}
+
+	report.Sets = reportRows(setObjects, setBytes, report.Bytes)
+	report.Classes = reportRows(classObjects, classBytes, report.Bytes)
+	report.Scrubbed = reportRows(scrubObjects, scrubBytes, report.Bytes)
+
+	// Months are in order, with the share showing how the archive grew.
+	var months []string
+	for month := range monthObjects {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	var sum int64
+	for _, month := range months {
+		sum += monthBytes[month]
+		report.Months = append(report.Months, reportRow{Name: month, Objects: monthObjects[month], Bytes: monthBytes[month], Share: percentOf(sum, report.Bytes)})
+	}
+
+	sort.Slice(report.Failures, func(i, j int) bool {
+		return report.Failures[i].Key < report.Failures[j].Key
+	})
+
+	return report
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes":   formatBytes,
+	"percent": func(share float64) string { return fmt.Sprintf("%.1f%%", share) },
+	"section": func(title string, share string, rows []reportRow) reportSection {
+		return reportSection{title, share, rows}
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Bucket}} archive report</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; white-space: nowrap; }
+td.bar { width: 40%; }
+td.bar div { background: #4a7ab5; height: 1em; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Bucket}}{{if .Prefix}}/{{.Prefix}}{{end}}</h1>
+<p>{{.Objects}} objects, {{bytes .Bytes}}.  Generated {{.Generated.Format "2006-01-02 15:04 MST"}}.</p>
+{{define "rows"}}
+<tr><th>{{.Title}}</th><th>Objects</th><th>Size</th><th colspan="2">{{.Share}}</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td class="number">{{.Objects}}</td><td class="number">{{bytes .Bytes}}</td><td class="number">{{percent .Share}}</td><td class="bar"><div style="width: {{printf "%.1f" .Share}}%"></div></td></tr>
+{{end}}{{end}}
+<h2>Size over time</h2>
+<table>{{template "rows" (section "Month uploaded" "Archive size so far" .Months)}}</table>
+<h2>Sets</h2>
+<table>{{template "rows" (section "Set" "Share" .Sets)}}</table>
+<h2>Storage classes</h2>
+<table>{{template "rows" (section "Storage class" "Share" .Classes)}}</table>
+<h2>Verification</h2>
+<p>As last seen by <code>scrub</code> on the machine that generated this report.</p>
+<table>{{template "rows" (section "Status" "Share" .Scrubbed)}}</table>
+{{if .Failures}}
+<h2 class="failed">Failed verification</h2>
+<table>
+<tr><th>Key</th><th>Checked</th><th>Detail</th></tr>
+{{range .Failures}}<tr class="failed"><td>{{.Key}}</td><td>{{.Checked.Format "2006-01-02"}}</td><td>{{.Detail}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Drift}}
+<h2 class="failed">Unusual runs</h2>
+<p>The latest sync runs which planned far more or less data than usual for their job, or took far longer or shorter.</p>
+<table>
+<tr><th>Job</th><th>Started</th><th>Detail</th></tr>
+{{range .Drift}}<tr class="failed"><td>{{.Job}}</td><td>{{.Started.Format "2006-01-02 15:04"}}</td><td>{{.Detail}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+func writeReport(w io.Writer, report catalogReport) error {
+	return reportTemplate.Execute(w, report)
+}
+
+func ReportHTML(bucket string, region string, prefix string, output string) error {
+	s3session := newS3Session(region)
+
+	objects, err := listAll(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	var archives []archivedObject
+	for _, obj := range objects {
+		if !isSidecar(obj.Key) {
+			archives = append(archives, obj)
+		}
+	}
+
+	history, err := loadScrubHistory()
+	if err != nil {
+		return err
+	}
+
+	report := summarizeCatalog(bucket, prefix, archives, history, time.Now())
+	if report.Drift, err = jobDrift(s3session, bucket); err != nil {
+		return err
+	}
+
+	if output == "-" {
+		return writeReport(os.Stdout, report)
+	}
+
+	// Write next to the target and rename, so a web server never serves
+	// half a report.
+	tmp := output + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(file, report); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		return err
+	}
+
+	ui.Printf("Wrote a report of %d objects (%s) to %s\n", report.Objects, formatBytes(report.Bytes), output)
+	return nil
+}
+
+func init() {
+	reportHTMLCmd.Flags().StringVar(&ReportPrefix, "prefix", "", "only report on objects under this prefix")
+	reportHTMLCmd.Flags().StringVarP(&ReportOutput, "output", "o", "report.html", "file to write the report to, - for stdout")
+	reportCmd.AddCommand(reportHTMLCmd)
+	rootCmd.AddCommand(reportCmd)
+}
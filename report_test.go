@@ -0,0 +1,94 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeCatalog(t *testing.T) {
+	jan := time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2022, 2, 10, 0, 0, 0, 0, time.UTC)
+	objects := []archivedObject{
+		{"photos/2021.tar", 600, "DEEP_ARCHIVE", jan},
+		{"photos/2022.tar", 200, "DEEP_ARCHIVE", feb},
+		{"mail/inbox.mbox", 150, "GLACIER", feb},
+		{"notes.txt", 50, "STANDARD", jan},
+	}
+	history := map[string]scrubRecord{
+		"bucket/photos/2021.tar": {Checked: feb, Result: SCRUB_OK},
+		"bucket/mail/inbox.mbox": {Checked: feb, Result: SCRUB_FAILED, Detail: "ETag mismatch"},
+		"other/notes.txt":        {Checked: feb, Result: SCRUB_OK},
+	}
+
+	report := summarizeCatalog("bucket", "", objects, history, feb)
+
+	if report.Objects != 4 || report.Bytes != 1000 {
+		t.Errorf("%d objects, %d bytes", report.Objects, report.Bytes)
+	}
+
+	if len(report.Sets) != 3 || report.Sets[0].Name != "photos/" || report.Sets[0].Bytes != 800 || report.Sets[0].Share != 80 || report.Sets[2].Name != "(no set)" {
+		t.Errorf("sets: %+v", report.Sets)
+	}
+
+	if len(report.Classes) != 3 || report.Classes[0].Name != "DEEP_ARCHIVE" || report.Classes[0].Objects != 2 {
+		t.Errorf("storage classes: %+v", report.Classes)
+	}
+
+	// The share of months is the running total.
+	if len(report.Months) != 2 || report.Months[0].Name != "2022-01" || report.Months[0].Share != 65 || report.Months[1].Share != 100 {
+		t.Errorf("months: %+v", report.Months)
+	}
+
+	scrubbed := map[string]int{}
+	for _, row := range report.Scrubbed {
+		scrubbed[row.Name] = row.Objects
+	}
+	if scrubbed[SCRUB_OK] != 1 || scrubbed[SCRUB_FAILED] != 1 || scrubbed[SCRUB_NEVER] != 2 {
+		t.Errorf("verification: %+v", report.Scrubbed)
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Key != "mail/inbox.mbox" {
+		t.Errorf("failures: %+v", report.Failures)
+	}
+
+	var out bytes.Buffer
+	if err := writeReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<h1>bucket</h1>", "photos/", "DEEP_ARCHIVE", "ETag mismatch", "width: 80.0%"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the report doesn't contain %q", want)
+		}
+	}
+}
+
+func TestReportSet(t *testing.T) {
+	tests := []struct{ key, prefix, set string }{
+		{"photos/2021.tar", "", "photos/"},
+		{"photos/2021/jan.tar", "", "photos/"},
+		{"photos/2021/jan.tar", "photos/", "photos/2021/"},
+		{"notes.txt", "", "(no set)"},
+	}
+	for _, test := range tests {
+		if set := reportSet(test.key, test.prefix); set != test.set {
+			t.Errorf("%s under %q is in %s, want %s", test.key, test.prefix, set, test.set)
+		}
+	}
+}
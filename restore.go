@@ -0,0 +1,254 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var ExpeditedUnavailable string
+var ExpeditedWait time.Duration
+
+// What to do when S3 has no Expedited capacity left, which it reports with
+// GlacierExpeditedRetrievalNotAvailable.
+const (
+	EXPEDITED_STANDARD = "standard"
+	EXPEDITED_WAIT     = "wait"
+	EXPEDITED_FAIL     = "fail"
+)
+
+// The first pause before asking for Expedited capacity again.  It doubles up
+// to EXPEDITED_MAX_DELAY.  A variable, so that the tests don't have to wait.
+var expeditedRetryDelay = 30 * time.Second
+
+const EXPEDITED_MAX_DELAY = 10 * time.Minute
+
+func checkExpeditedFlags() error {
+	switch ExpeditedUnavailable {
+	case EXPEDITED_STANDARD, EXPEDITED_WAIT, EXPEDITED_FAIL:
+		return nil
+	}
+	return fmt.Errorf("Unknown --expedited-unavailable %q, use %s, %s or %s", ExpeditedUnavailable, EXPEDITED_STANDARD, EXPEDITED_WAIT, EXPEDITED_FAIL)
+}
+
+// requestRestore asks S3 to make a temporary copy of an archived object
+// available for the given number of days.  Asking again while a restore is
+// already under way is not an error.  When the Expedited tier is out of
+// capacity, --expedited-unavailable decides what happens.  It returns the
+// tier the restore was requested with.
+func requestRestore(s3session s3iface.S3API, bucket string, key string, tier string, days int64) (string, error) {
+	delay := expeditedRetryDelay
+	deadline := time.Now().Add(ExpeditedWait)
+
+	for {
+		err := restoreObject(s3session, bucket, key, tier, days)
+
+		var aerr awserr.Error
+		if tier != s3.TierExpedited || !errors.As(err, &aerr) || aerr.Code() != "GlacierExpeditedRetrievalNotAvailable" {
+			return tier, err
+		}
+
+		switch ExpeditedUnavailable {
+		case EXPEDITED_STANDARD:
+			ui.Warnf("No Expedited capacity for %s, restoring it with the Standard tier\n", key)
+			tier = s3.TierStandard
+			continue
+		case EXPEDITED_WAIT:
+			if time.Now().Add(delay).After(deadline) {
+				return tier, fmt.Errorf("No Expedited capacity for %s within %s: %w", key, ExpeditedWait, err)
+			}
+			ui.Warnf("No Expedited capacity for %s, trying again in %s\n", key, delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > EXPEDITED_MAX_DELAY {
+				delay = EXPEDITED_MAX_DELAY
+			}
+		default:
+			return tier, err
+		}
+	}
+}
+
+func restoreObject(s3session s3iface.S3API, bucket string, key string, tier string, days int64) error {
+	_, err := s3session.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(tier),
+			},
+		},
+	})
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+
+	return err
+}
+
+// restore flags
+var RestoreKey string
+var RestoreTier string
+var RestoreDays int64
+var RestoreWait bool
+var RestorePollInterval time.Duration
+var RestoreOutput string
+var RestoreCopyTo string
+var RestoreCopyBucket string
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore an archived object, wait for it and download it",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s3session := newRestoreS3Session(Region)
+		err := Restore(s3session, BucketName, RestoreKey, RestoreTier, RestoreDays, RestoreWait || RestoreCopyTo != "", RestorePollInterval, RestoreOutput)
+		if err == nil && RestoreCopyTo != "" {
+			err = CopyRestored(s3session, lazyCleanup(Region), BucketName, RestoreKey, RestoreCopyBucket, RestoreCopyTo)
+		}
+		return err
+	},
+}
+
+// Restore requests a restore of an archived object, unless there already is
+// one.  With wait, it then polls until the restored copy can be read, and
+// with an output, downloads it there and verifies it.
+func Restore(s3session s3iface.S3API, bucket string, key string, tier string, days int64, wait bool, interval time.Duration, output string) error {
+	if key == "" {
+		return fmt.Errorf("Tell us which object to restore with --key")
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	storageClass := aws.StringValue(head.StorageClass)
+	restore := aws.StringValue(head.Restore)
+	switch {
+	case storageClass == "" || !isArchived(storageClass):
+		ui.Printf("%s isn't archived, it can be read right away\n", key)
+	case strings.Contains(restore, `ongoing-request="true"`):
+		ui.Printf("A restore of %s is already under way\n", key)
+	case restore != "":
+		ui.Printf("%s is restored already (%s)\n", key, restore)
+	default:
+		t, err := findTier(storageClass, tier)
+		if err != nil {
+			return err
+		}
+		if err := checkBudget("the restore", t.Cost(1, aws.Int64Value(head.ContentLength))); err != nil {
+			return err
+		}
+
+		used, err := requestRestore(s3session, bucket, key, tier, days)
+		if err != nil {
+			return fmt.Errorf("Failed to restore %s: %w", key, err)
+		}
+		if used != tier {
+			if t, err = findTier(storageClass, used); err != nil {
+				return err
+			}
+		}
+		ui.Printf("Requested a %s restore of %s for %d days, typical wait: %s\n", used, key, days, t.TypicalString)
+	}
+
+	if !wait && output == "" {
+		return nil
+	}
+
+	ui.Printf("Waiting for the restore, checking every %s\n", interval)
+	start := time.Now()
+	if err := waitForRestore(s3session, bucket, key, interval, waitUntil(start, 0, "")); err != nil {
+		return err
+	}
+	ui.Printf("%s can be read, after %s\n", key, time.Since(start).Round(time.Second))
+
+	if output == "" {
+		return nil
+	}
+	// The object is verified as it's stored, so it stays compressed.
+	if err := downloadObject(s3session, bucket, key, "", output, DownloadConcurrency, DECOMPRESS_NONE, "", false); err != nil {
+		return err
+	}
+	if output == "-" {
+		return nil
+	}
+	return Verify(s3session, bucket, output, key)
+}
+
+// CopyRestored copies the restored copy of key to destKey in destBucket,
+// the same bucket if it's empty, in STANDARD, for other programs to read
+// from S3 directly.  The restored copy itself goes away after its days, the
+// copy stays, and is billed as STANDARD, until it's deleted.
+func CopyRestored(s3session s3iface.S3API, cleanup cleanupSession, bucket string, key string, destBucket string, destKey string) error {
+	if destBucket == "" {
+		destBucket = bucket
+	}
+	if destBucket == bucket && destKey == key {
+		return fmt.Errorf("Copying %s onto itself would take it out of the archive, give --copy-to another key", key)
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	storageClass := aws.StringValue(head.StorageClass)
+	if isArchived(storageClass) && !strings.Contains(aws.StringValue(head.Restore), `ongoing-request="false"`) {
+		return fmt.Errorf("%s isn't restored, it can't be copied yet", key)
+	}
+
+	obj := archivedObject{Key: key, Size: aws.Int64Value(head.ContentLength), StorageClass: storageClass}
+	ui.Printf("Copying %s to s3://%s/%s in %s\n", key, destBucket, destKey, s3.StorageClassStandard)
+	if err := copyObjectTo(s3session, cleanup, bucket, obj, destBucket, destKey, s3.StorageClassStandard); err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", key, err)
+	}
+	ui.Printf("Copied %s to s3://%s/%s, which stays until it's deleted\n", key, destBucket, destKey)
+	return nil
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&RestoreKey, "key", "", "key of the object to restore")
+	restoreCmd.Flags().StringVar(&RestoreTier, "tier", s3.TierBulk, "retrieval tier: Bulk, Standard or Expedited")
+	restoreCmd.Flags().Int64Var(&RestoreDays, "days", 7, "number of days to keep the restored copy")
+	restoreCmd.Flags().BoolVar(&RestoreWait, "wait", false, "wait until the restored copy can be read")
+	restoreCmd.Flags().DurationVar(&RestorePollInterval, "poll-interval", 15*time.Minute, "how often to check whether the restore has finished")
+	restoreCmd.Flags().StringVarP(&RestoreOutput, "output", "o", "", "when the restore is done, download the object to this file (- for stdout) and verify it")
+	restoreCmd.Flags().StringVar(&RestoreCopyTo, "copy-to", "", "when the restore is done, copy the object to this key in STANDARD, for other programs to read from S3")
+	restoreCmd.Flags().StringVar(&RestoreCopyBucket, "copy-bucket", "", "bucket to --copy-to, instead of the object's")
+	restoreCmd.Flags().IntVar(&DownloadConcurrency, "concurrency", 4, "number of chunks to download in parallel")
+	rootCmd.AddCommand(restoreCmd)
+}
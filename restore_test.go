@@ -0,0 +1,156 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// busyGlacier has no Expedited capacity for the first few requests.
+type busyGlacier struct {
+	s3iface.S3API
+	busy  int
+	tiers []string
+}
+
+func (g *busyGlacier) RestoreObject(in *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	tier := aws.StringValue(in.RestoreRequest.GlacierJobParameters.Tier)
+	g.tiers = append(g.tiers, tier)
+
+	if tier == s3.TierExpedited && g.busy > 0 {
+		g.busy--
+		return nil, awserr.New("GlacierExpeditedRetrievalNotAvailable", "Glacier expedited retrievals are currently not available, please try again later", nil)
+	}
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestRequestRestoreExpedited(t *testing.T) {
+	defer func(policy string, wait, delay time.Duration) {
+		ExpeditedUnavailable, ExpeditedWait, expeditedRetryDelay = policy, wait, delay
+	}(ExpeditedUnavailable, ExpeditedWait, expeditedRetryDelay)
+	expeditedRetryDelay = time.Millisecond
+
+	tests := []struct {
+		policy string
+		wait   time.Duration
+		tiers  int
+		used   string
+		fails  bool
+	}{
+		{EXPEDITED_STANDARD, time.Hour, 2, s3.TierStandard, false},
+		{EXPEDITED_WAIT, time.Hour, 3, s3.TierExpedited, false},
+		{EXPEDITED_WAIT, 2 * time.Millisecond, 2, s3.TierExpedited, true},
+		{EXPEDITED_FAIL, time.Hour, 1, s3.TierExpedited, true},
+	}
+
+	for _, test := range tests {
+		ExpeditedUnavailable, ExpeditedWait = test.policy, test.wait
+		glacier := &busyGlacier{busy: 2}
+
+		used, err := requestRestore(glacier, "bucket", "key", s3.TierExpedited, 1)
+		if (err != nil) != test.fails || used != test.used || len(glacier.tiers) != test.tiers {
+			t.Errorf("%s for %s: used %s after %v, error %v", test.policy, test.wait, used, glacier.tiers, err)
+		}
+	}
+
+	// Other tiers don't fall back to anything.
+	ExpeditedUnavailable = EXPEDITED_STANDARD
+	glacier := &busyGlacier{busy: 2}
+	if used, err := requestRestore(glacier, "bucket", "key", s3.TierBulk, 1); err != nil || used != s3.TierBulk {
+		t.Errorf("bulk restore: %s, %v", used, err)
+	}
+}
+
+func TestRestoreAndDownload(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1024)
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["archive.bin"].storageClass = s3.StorageClassDeepArchive
+	fake.restoreHeads = 3
+
+	// Without waiting, only the restore is requested.
+	if err := Restore(fake, "bucket", "archive.bin", s3.TierBulk, 1, false, time.Millisecond, ""); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj.restoring != 3 {
+		t.Fatalf("restore not requested, %d HEADs to go", obj.restoring)
+	}
+
+	// Asking again finds the restore under way, then waits for it and
+	// downloads the object.
+	output := filepath.Join(t.TempDir(), "restored.bin")
+	if err := Restore(fake, "bucket", "archive.bin", s3.TierBulk, 1, false, time.Millisecond, output); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the download doesn't contain the object: %v", err)
+	}
+}
+
+func TestRestoreNotArchived(t *testing.T) {
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["archive.bin"].storageClass = s3.StorageClassStandard
+
+	if err := Restore(fake, "bucket", "archive.bin", s3.TierBulk, 1, true, time.Millisecond, ""); err != nil {
+		t.Error(err)
+	}
+	if err := Restore(fake, "bucket", "missing.bin", s3.TierBulk, 1, false, time.Millisecond, ""); err == nil {
+		t.Error("restored an object which doesn't exist")
+	}
+}
+
+func TestCopyRestored(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(1024)
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["archive.bin"].storageClass = s3.StorageClassDeepArchive
+
+	if err := CopyRestored(fake, fake.cleanup, "bucket", "archive.bin", "", "readable/archive.bin"); err == nil {
+		t.Fatal("copied an object which isn't restored")
+	}
+	if err := CopyRestored(fake, fake.cleanup, "bucket", "archive.bin", "bucket", "archive.bin"); err == nil {
+		t.Fatal("copied an object onto itself")
+	}
+
+	fake.objects["archive.bin"].restored = true
+	if err := CopyRestored(fake, fake.cleanup, "bucket", "archive.bin", "", "readable/archive.bin"); err != nil {
+		t.Fatal(err)
+	}
+	copied := fake.objects["readable/archive.bin"]
+	if copied == nil || copied.storageClass != s3.StorageClassStandard || !bytes.Equal(copied.data, data) {
+		t.Errorf("copied %+v", copied)
+	}
+	if fake.objects["archive.bin"].storageClass != s3.StorageClassDeepArchive {
+		t.Error("the archived object changed")
+	}
+}
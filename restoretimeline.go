@@ -0,0 +1,166 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// plan-restore flags
+var PlanTimeline string
+var PlanDownloadScript string
+var PlanDownloadDir string
+
+// restoreWave is the objects expected to be restored at the same time: all
+// of one storage class, restored with the same tier.
+type restoreWave struct {
+	Number    int
+	Available time.Time
+	Objects   []archivedObject
+	Bytes     int64
+}
+
+// restoreWaves works out when the objects are expected to be readable if
+// their restores are requested at start, going by the tier's typical time,
+// e.g. 48 hours for Bulk from Deep Archive.  The waves come in the order
+// they're available.
+func restoreWaves(classes []string, groups map[string][]archivedObject, tier string, start time.Time) ([]restoreWave, error) {
+	var waves []restoreWave
+	for _, class := range classes {
+		t, err := findTier(class, tier)
+		if err != nil {
+			return nil, err
+		}
+		wave := restoreWave{Available: start.Add(time.Duration(t.TypicalHours * float64(time.Hour))), Objects: groups[class]}
+		for _, obj := range wave.Objects {
+			wave.Bytes += obj.Size
+		}
+		waves = append(waves, wave)
+	}
+
+	sort.SliceStable(waves, func(i, j int) bool { return waves[i].Available.Before(waves[j].Available) })
+	// Classes which are restored in the same time are one wave.
+	var merged []restoreWave
+	for _, wave := range waves {
+		if n := len(merged); n > 0 && merged[n-1].Available.Equal(wave.Available) {
+			merged[n-1].Objects = append(merged[n-1].Objects, wave.Objects...)
+			merged[n-1].Bytes += wave.Bytes
+			continue
+		}
+		wave.Number = len(merged) + 1
+		merged = append(merged, wave)
+	}
+	return merged, nil
+}
+
+// printWaves is the timeline in the plan's summary.
+func printWaves(w io.Writer, waves []restoreWave) {
+	for _, wave := range waves {
+		fmt.Fprintf(w, "Wave %d: %d objects, %s, expected to be readable around %s\n",
+			wave.Number, len(wave.Objects), formatBytes(wave.Bytes), wave.Available.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+// writeTimeline writes when each object is expected to be readable, as CSV.
+func writeTimeline(out io.Writer, waves []restoreWave) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"key", "storage_class", "size", "wave", "available_at"})
+	for _, wave := range waves {
+		for _, obj := range wave.Objects {
+			w.Write([]string{obj.Key, obj.StorageClass, strconv.FormatInt(obj.Size, 10), strconv.Itoa(wave.Number), wave.Available.UTC().Format(time.RFC3339)})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeDownloadScript writes a shell script to run from cron, which
+// downloads the objects of every wave to dir once the wave is due.  A wave
+// is marked done when all of it is downloaded; one which isn't restored yet
+// fails and is tried again on the next run.
+func writeDownloadScript(out io.Writer, program string, bucket string, waves []restoreWave, dir string) error {
+	fmt.Fprintln(out, "#!/bin/sh")
+	fmt.Fprintln(out, "# Downloads the restored objects a wave at a time, run it e.g. hourly from cron.")
+	fmt.Fprintln(out, "set -e")
+	fmt.Fprintf(out, "cd %s\n", shellQuote(dir))
+	io.WriteString(out, "now=$(date +%s)\n")
+
+	for _, wave := range waves {
+		done := fmt.Sprintf(".restore-wave-%d.done", wave.Number)
+		fmt.Fprintf(out, "\n# Wave %d, %d objects, %s, due %s\n", wave.Number, len(wave.Objects), formatBytes(wave.Bytes), wave.Available.UTC().Format(time.RFC3339))
+		fmt.Fprintf(out, "if [ \"$now\" -ge %d ] && [ ! -e %s ]; then\n", wave.Available.Unix(), done)
+		for _, obj := range wave.Objects {
+			if parent := path.Dir(obj.Key); parent != "." {
+				fmt.Fprintf(out, "  mkdir -p %s\n", shellQuote(parent))
+			}
+			fmt.Fprintf(out, "  %s download --bucket %s --key %s -o %s\n", shellQuote(program), shellQuote(bucket), shellQuote(obj.Key), shellQuote(obj.Key))
+		}
+		_, err := fmt.Fprintf(out, "  touch %s\nfi\n", done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWavePlans writes the --timeline and --download-script of a plan.
+func writeWavePlans(bucket string, waves []restoreWave) error {
+	if PlanTimeline != "" {
+		f, err := os.Create(PlanTimeline)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := writeTimeline(f, waves); err != nil {
+			return err
+		}
+	}
+
+	if PlanDownloadScript != "" {
+		program, err := os.Executable()
+		if err != nil {
+			program = "s3-glacier-uploader"
+		}
+		dir, err := filepath.Abs(PlanDownloadDir)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(PlanDownloadScript, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := writeDownloadScript(f, program, bucket, waves, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	planRestoreCmd.Flags().StringVar(&PlanTimeline, "timeline", "", "write when each object is expected to be readable to this CSV file")
+	planRestoreCmd.Flags().StringVar(&PlanDownloadScript, "download-script", "", "write a script for cron which downloads each wave of restored objects once it's due")
+	planRestoreCmd.Flags().StringVar(&PlanDownloadDir, "download-to", ".", "directory the --download-script downloads to")
+}
@@ -0,0 +1,128 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRestoreWaves(t *testing.T) {
+	start := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	groups := map[string][]archivedObject{
+		s3.StorageClassDeepArchive: {{Key: "a", Size: 10, StorageClass: s3.StorageClassDeepArchive}, {Key: "b", Size: 20, StorageClass: s3.StorageClassDeepArchive}},
+		s3.StorageClassGlacier:     {{Key: "c", Size: 5, StorageClass: s3.StorageClassGlacier}},
+	}
+	classes := []string{s3.StorageClassDeepArchive, s3.StorageClassGlacier}
+
+	waves, err := restoreWaves(classes, groups, s3.TierBulk, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waves) != 2 {
+		t.Fatalf("got %d waves", len(waves))
+	}
+	if w := waves[0]; w.Number != 1 || !w.Available.Equal(start.Add(12*time.Hour)) || len(w.Objects) != 1 || w.Bytes != 5 {
+		t.Errorf("first wave %+v", w)
+	}
+	if w := waves[1]; w.Number != 2 || !w.Available.Equal(start.Add(48*time.Hour)) || len(w.Objects) != 2 || w.Bytes != 30 {
+		t.Errorf("second wave %+v", w)
+	}
+
+	// Standard takes 12 hours from Deep Archive, as long as Bulk from
+	// Glacier, but Standard from Glacier is quicker.
+	waves, err = restoreWaves(classes, groups, s3.TierStandard, start)
+	if err != nil || len(waves) != 2 || !waves[1].Available.Equal(start.Add(12*time.Hour)) {
+		t.Errorf("Standard: %+v, %v", waves, err)
+	}
+
+	if _, err := restoreWaves(classes, groups, s3.TierExpedited, start); err == nil {
+		t.Error("Expedited restores of Deep Archive were planned")
+	}
+
+	var out bytes.Buffer
+	waves, _ = restoreWaves(classes, groups, s3.TierBulk, start)
+	if err := writeTimeline(&out, waves); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil || len(rows) != 4 {
+		t.Fatalf("timeline %q, %v", rows, err)
+	}
+	if row := rows[3]; row[0] != "b" || row[3] != "2" || row[4] != "2026-01-04T00:00:00Z" {
+		t.Errorf("timeline row %q", row)
+	}
+}
+
+func TestDownloadScript(t *testing.T) {
+	start := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	waves := []restoreWave{
+		{Number: 1, Available: start, Objects: []archivedObject{{Key: "photos/it's.tar", Size: 10}}, Bytes: 10},
+		{Number: 2, Available: start.Add(time.Hour), Objects: []archivedObject{{Key: "vm.img", Size: 20}}, Bytes: 20},
+	}
+
+	var out bytes.Buffer
+	if err := writeDownloadScript(&out, "/usr/bin/s3-glacier-uploader", "bucket", waves, "/restore"); err != nil {
+		t.Fatal(err)
+	}
+	script := out.String()
+	for _, want := range []string{
+		"cd '/restore'\n",
+		`if [ "$now" -ge 1767312000 ] && [ ! -e .restore-wave-1.done ]; then`,
+		"  mkdir -p 'photos'\n",
+		`  '/usr/bin/s3-glacier-uploader' download --bucket 'bucket' --key 'photos/it'"'"'s.tar' -o 'photos/it'"'"'s.tar'`,
+		`if [ "$now" -ge 1767315600 ] && [ ! -e .restore-wave-2.done ]; then`,
+		"  touch .restore-wave-2.done\nfi\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("no %q in\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "mkdir -p '.'") {
+		t.Errorf("made the current directory:\n%s", script)
+	}
+}
+
+func TestPlanRestoreTimeline(t *testing.T) {
+	defer func() { PlanTimeline, PlanDownloadScript, PlanDownloadDir = "", "", "." }()
+
+	fake := newFakeS3()
+	fake.objects["photos/2021.tar"] = &fakeObject{data: []byte("x"), etag: md5Hex([]byte("x")), storageClass: s3.StorageClassDeepArchive, modified: time.Now()}
+
+	dir := t.TempDir()
+	PlanTimeline = filepath.Join(dir, "timeline.csv")
+	PlanDownloadScript = filepath.Join(dir, "download.sh")
+	PlanDownloadDir = dir
+	if err := PlanRestore(fake, "bucket", "photos/", nil, s3.TierBulk, 3, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(PlanTimeline); err != nil || !strings.Contains(string(data), "photos/2021.tar,DEEP_ARCHIVE,1,1,") {
+		t.Errorf("timeline %s, %v", data, err)
+	}
+	info, err := os.Stat(PlanDownloadScript)
+	if err != nil || info.Mode()&0100 == 0 {
+		t.Errorf("download script %v, %v", info, err)
+	}
+}
@@ -0,0 +1,63 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// listUploadedParts asks S3 which parts of an unfinished upload it already
+// has.
+func listUploadedParts(s3session s3iface.S3API, bucket string, key string, uploadID string) (map[int64]*s3.Part, error) {
+	parts := map[int64]*s3.Part{}
+	err := s3session.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			parts[*part.PartNumber] = part
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up upload %s of %s: %w", uploadID, key, err)
+	}
+	return parts, nil
+}
+
+// resumedPart returns the part S3 already has, if it's the one we'd upload:
+// the same size, and an ETag matching the MD5 digest of what we read from the
+// file.  Anything else, like a part of a file that has changed since, is
+// uploaded again.
+func resumedPart(parts map[int64]*s3.Part, partNum int, size int, digest string) *s3.CompletedPart {
+	part, ok := parts[int64(partNum)]
+	if !ok || aws.Int64Value(part.Size) != int64(size) || strings.Trim(aws.StringValue(part.ETag), "\"") != digest {
+		return nil
+	}
+
+	return &s3.CompletedPart{
+		ETag:           part.ETag,
+		PartNumber:     part.PartNumber,
+		ChecksumSHA256: part.ChecksumSHA256,
+	}
+}
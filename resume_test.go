@@ -0,0 +1,80 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestResumeUpload(t *testing.T) {
+	for _, algorithm := range []string{"", s3.ChecksumAlgorithmSha256} {
+		ChecksumAlgorithm = algorithm
+
+		fake := newFakeS3()
+		data := randomData(2*PART_SIZE + 1024)
+		filename := writeTestFile(t, data)
+
+		// An interrupted upload: S3 got the first part, and a second part
+		// which doesn't match the file any more.
+		created, err := fake.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:            aws.String("bucket"),
+			Key:               aws.String("archive.bin"),
+			StorageClass:      aws.String(s3.StorageClassDeepArchive),
+			ChecksumAlgorithm: checksumAlgorithm(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, part := range [][]byte{data[:PART_SIZE], randomData(PART_SIZE)} {
+			_, err := fake.UploadPart(&s3.UploadPartInput{
+				Bucket:         aws.String("bucket"),
+				Key:            aws.String("archive.bin"),
+				UploadId:       created.UploadId,
+				PartNumber:     aws.Int64(int64(i + 1)),
+				Body:           bytes.NewReader(part),
+				ChecksumSHA256: partChecksum(part),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fake.partUploads = 0
+
+		if err := uploadFile(fake, fake.cleanup, "bucket", filename, *created.UploadId); err != nil {
+			t.Fatal(err)
+		}
+
+		if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+			t.Error("the resumed upload doesn't contain the file")
+		}
+		if fake.partUploads != 2 {
+			t.Errorf("uploaded %d parts, want the changed second and the missing third", fake.partUploads)
+		}
+	}
+	ChecksumAlgorithm = ""
+}
+
+func TestResumeUnknownUpload(t *testing.T) {
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), "upload-42"); err == nil {
+		t.Error("resumed an upload which doesn't exist")
+	}
+}
@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var ResumeToken string
+
+const RESUME_TOKEN_PREFIX = "s3gu1."
+
+// resumeToken is everything it takes to resume an upload, printed so that
+// it can be copied into --resume-token on any machine.  Done is only there
+// to tell how far the upload got, S3 is asked which parts it has.
+type resumeToken struct {
+	Bucket   string `json:"b"`
+	Key      string `json:"k"`
+	UploadID string `json:"u"`
+	PartSize int64  `json:"p"`
+	Done     int64  `json:"d"`
+}
+
+func (t resumeToken) String() string {
+	data, _ := json.Marshal(t)
+	return RESUME_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseResumeToken(s string) (resumeToken, error) {
+	var t resumeToken
+	invalid := fmt.Errorf("Invalid resume token %q, copy all of what the upload printed", s)
+
+	if !strings.HasPrefix(s, RESUME_TOKEN_PREFIX) {
+		return t, invalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, RESUME_TOKEN_PREFIX))
+	if err != nil {
+		return t, invalid
+	}
+	if err := json.Unmarshal(data, &t); err != nil || t.Bucket == "" || t.Key == "" || t.UploadID == "" || t.PartSize <= 0 {
+		return t, invalid
+	}
+	return t, nil
+}
+
+func checkResumeToken() error {
+	if ResumeToken == "" {
+		return nil
+	}
+	t, err := parseResumeToken(ResumeToken)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case UploadID != "":
+		return fmt.Errorf("--resume-token already says which upload to resume, leave out --upload-id")
+	case Tar || Recompress != "" || Nodes > 1:
+		return fmt.Errorf("--resume-token only resumes uploads of single files")
+	case BucketName != "" && BucketName != t.Bucket:
+		return fmt.Errorf("The resume token is for an upload to %s, not %s", t.Bucket, BucketName)
+	}
+
+	// Checked in checkPartSize already.
+	if partSize, _ := configuredPartSize(); partSize != 0 && partSize != t.PartSize {
+		return fmt.Errorf("The resume token is for an upload in %d byte parts, not %d", t.PartSize, partSize)
+	}
+	return nil
+}
+
+func ResumeFromToken(region string, filename string) error {
+	// Checked in checkResumeToken already.
+	t, _ := parseResumeToken(ResumeToken)
+	return resumeFromToken(newS3Session(region), lazyCleanup(region), filename, t)
+}
+
+// resumeFromToken resumes the upload of filename the token tells about, in
+// parts of the same size.
+func resumeFromToken(s3session s3iface.S3API, cleanup cleanupSession, filename string, t resumeToken) error {
+	ui.Printf("Resuming the upload to %s/%s, %s of it were done when the token was printed\n", t.Bucket, t.Key, formatBytes(t.Done))
+	PartSize = strconv.FormatInt(t.PartSize, 10)
+	return uploadObject(s3session, cleanup, t.Bucket, filename, t.Key, t.UploadID)
+}
@@ -0,0 +1,98 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	want := resumeToken{Bucket: "backups", Key: "photos/2022.tar", UploadID: "2~kOLuR3Gq", PartSize: PART_SIZE, Done: 3 * PART_SIZE}
+	s := want.String()
+	if !strings.HasPrefix(s, RESUME_TOKEN_PREFIX) || strings.ContainsAny(s, " +/=") {
+		t.Errorf("token %q can't be copied around easily", s)
+	}
+	got, err := parseResumeToken(s)
+	if err != nil || got != want {
+		t.Errorf("got %+v, %v, want %+v", got, err, want)
+	}
+
+	for _, s := range []string{"", "s3gu1.", "s3gu1.!!!", "2~kOLuR3Gq", RESUME_TOKEN_PREFIX + "e30", s[:len(s)-4]} {
+		if _, err := parseResumeToken(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
+
+func TestCheckResumeToken(t *testing.T) {
+	defer func() { ResumeToken, UploadID, BucketName, PartSize = "", "", "", PART_SIZE_AUTO }()
+
+	ResumeToken = resumeToken{Bucket: "backups", Key: "a.tar", UploadID: "upload-1", PartSize: PART_SIZE}.String()
+	if err := checkResumeToken(); err != nil {
+		t.Errorf("a valid token: %v", err)
+	}
+	for name, set := range map[string]func(){
+		"--upload-id":         func() { UploadID = "upload-2" },
+		"another --bucket":    func() { BucketName = "photos" },
+		"another --part-size": func() { PartSize = "8M" },
+	} {
+		set()
+		if err := checkResumeToken(); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+		UploadID, BucketName, PartSize = "", "", PART_SIZE_AUTO
+	}
+}
+
+func TestResumeFromToken(t *testing.T) {
+	defer func() { PartSize = PART_SIZE_AUTO }()
+
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+	fake := &slowS3{fakeS3: newFakeS3(), fail: 3}
+
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "")
+	var unfinished *unfinishedUploadError
+	if !errors.As(err, &unfinished) {
+		t.Fatalf("got %v, want an unfinished upload", err)
+	}
+	token := unfinished.Token
+	if !strings.Contains(err.Error(), "--resume-token "+token.String()) {
+		t.Errorf("the error doesn't tell the token: %v", err)
+	}
+	if token.Bucket != "bucket" || token.Key != "archive.bin" || token.Done != 2*PART_SIZE {
+		t.Errorf("got %+v", token)
+	}
+
+	// The token is all it takes, even without the journal.
+	if journal, _ := loadJournal("bucket", "archive.bin"); journal != nil {
+		journal.Remove()
+	}
+	fake.partUploads = 0
+	if err := resumeFromToken(fake.fakeS3, fake.cleanup, filename, token); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the resumed upload doesn't contain the file")
+	}
+	if fake.partUploads != 1 {
+		t.Errorf("uploaded %d parts, want only the third", fake.partUploads)
+	}
+}
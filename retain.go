@@ -0,0 +1,156 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// CLI flags
+var Retain []string
+var RetainRules string
+
+// RETAIN_METADATA is how long an object is to be kept, like 90d, when it's
+// not --keep.  report retention goes by it.
+const RETAIN_METADATA = "retain-for"
+
+// retainRule keeps the files matching Pattern for Age.
+type retainRule struct {
+	Pattern string
+	Age     string
+}
+
+// retainRules are --retain, then the lines of --retain-rules, in order.
+var retainRules []retainRule
+
+func parseRetainRule(pattern string, age string) (retainRule, error) {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return retainRule{}, fmt.Errorf("Invalid pattern %q", pattern)
+	}
+	if _, err := parseAge(age); err != nil {
+		return retainRule{}, err
+	}
+	return retainRule{pattern, age}, nil
+}
+
+// checkRetainFlags reads --retain and --retain-rules, whose lines are a
+// pattern and an age, with # starting a comment:
+//
+//	*.log        90d
+//	photos/*     3650d
+func checkRetainFlags() error {
+	retainRules = nil
+	for _, spec := range Retain {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("--retain looks like pattern=age, e.g. '*.log=90d', got %q", spec)
+		}
+		rule, err := parseRetainRule(parts[0], parts[1])
+		if err != nil {
+			return fmt.Errorf("Invalid --retain: %w", err)
+		}
+		retainRules = append(retainRules, rule)
+	}
+	if RetainRules == "" {
+		return nil
+	}
+
+	file, err := os.Open(RetainRules)
+	if err != nil {
+		return fmt.Errorf("Invalid --retain-rules: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: a rule is a pattern and an age, e.g. *.log 90d", RetainRules, n)
+		}
+		rule, err := parseRetainRule(fields[0], fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", RetainRules, n, err)
+		}
+		retainRules = append(retainRules, rule)
+	}
+	return scanner.Err()
+}
+
+// matches tells whether the rule is for filename.  A pattern without a
+// slash is matched against the file's name, one with slashes against as
+// many of the last parts of its path.
+func (r retainRule) matches(filename string) bool {
+	parts := strings.Split(filepath.ToSlash(filename), "/")
+	n := strings.Count(r.Pattern, "/") + 1
+	if n > len(parts) {
+		return false
+	}
+	ok, _ := path.Match(r.Pattern, strings.Join(parts[len(parts)-n:], "/"))
+	return ok
+}
+
+// retainMetadata records how long the file is to be kept, as the first rule
+// matching it says.  Metadata given for the file already wins.
+func retainMetadata(filename string, metadata map[string]*string) map[string]*string {
+	if _, ok := metadataValue(metadata, RETAIN_METADATA); ok {
+		return metadata
+	}
+	for _, rule := range retainRules {
+		if rule.matches(filename) {
+			if metadata == nil {
+				metadata = map[string]*string{}
+			}
+			metadata[RETAIN_METADATA] = aws.String(rule.Age)
+			return metadata
+		}
+	}
+	return metadata
+}
+
+// objectRetention is how long the object with metadata is to be kept: as
+// long as it says, or keep.
+func objectRetention(key string, metadata map[string]*string, keep time.Duration) time.Duration {
+	spec, ok := metadataValue(metadata, RETAIN_METADATA)
+	if !ok {
+		return keep
+	}
+	age, err := parseAge(spec)
+	if err != nil {
+		ui.Warnf("%s has an invalid %s of %q, going by --keep\n", key, RETAIN_METADATA, spec)
+		return keep
+	}
+	return age
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringArrayVar(&Retain, "retain", nil, "keep uploaded files matching a pattern this long, pattern=age, e.g. '*.log=90d', recorded with the object for report retention (can be repeated)")
+	rootCmd.PersistentFlags().StringVar(&RetainRules, "retain-rules", "", "file of retention rules, a pattern and an age per line, like --retain")
+}
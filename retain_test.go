@@ -0,0 +1,104 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRetainRules(t *testing.T) {
+	defer func() { Retain, RetainRules, retainRules = nil, "", nil }()
+
+	RetainRules = filepath.Join(t.TempDir(), "retain")
+	rules := "# short-lived\n*.log  90d\n\nphotos/*  3650d  # forever, near enough\n"
+	if err := os.WriteFile(RetainRules, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	Retain = []string{"debug.log=7d"}
+	if err := checkRetainFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	for filename, expected := range map[string]string{
+		"/var/log/debug.log":      "7d",
+		"/var/log/syslog.log":     "90d",
+		"/srv/photos/a.jpg":       "3650d",
+		"/srv/photos/2021/a.jpg":  "",
+		"photos/a.jpg":            "3650d",
+		"a.jpg":                   "",
+		"/srv/photos/a.jpg/x.log": "90d",
+	} {
+		metadata := retainMetadata(filename, nil)
+		if age, _ := metadataValue(metadata, RETAIN_METADATA); age != expected {
+			t.Errorf("%s is kept for %q, expected %q", filename, age, expected)
+		}
+	}
+
+	// Metadata given for the file wins.
+	metadata := retainMetadata("debug.log", map[string]*string{"Retain-For": aws.String("1d")})
+	if age, _ := metadataValue(metadata, RETAIN_METADATA); age != "1d" {
+		t.Errorf("the file's own metadata was replaced with %q", age)
+	}
+
+	for _, bad := range []string{"*.log 90d 1\n", "*.log forever\n", "[ 90d\n"} {
+		if err := os.WriteFile(RetainRules, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkRetainFlags(); err == nil {
+			t.Errorf("accepted the rule %q", bad)
+		}
+	}
+	RetainRules = ""
+	Retain = []string{"*.log"}
+	if err := checkRetainFlags(); err == nil {
+		t.Error("accepted --retain without an age")
+	}
+}
+
+func TestRetentionReportRetainFor(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	s3session := newFakeS3()
+	for key, obj := range map[string]*fakeObject{
+		"app.log":  {data: []byte("log"), modified: now.AddDate(0, -2, 0), metadata: map[string]*string{"Retain-For": aws.String("30d")}},
+		"scan.tif": {data: []byte("scan"), modified: now.AddDate(-8, 0, 0), metadata: map[string]*string{"Retain-For": aws.String("3650d")}},
+		"old.tar":  {data: []byte("old"), modified: now.AddDate(-8, 0, 0)},
+	} {
+		obj.storageClass = s3.StorageClassDeepArchive
+		s3session.objects[key] = obj
+	}
+
+	var out bytes.Buffer
+	if err := RetentionReport(&out, s3session, "bucket", "", 7*365*24*time.Hour, "", now); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"  app.log\n", "  old.tar\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "  scan.tif\n") {
+		t.Errorf("scan.tif is kept for 10 years, but in:\n%s", out.String())
+	}
+}
@@ -0,0 +1,211 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// report retention flags
+var RetentionKeep string
+var RetentionPrefix string
+var RetentionCSV string
+
+// Where an object stands against the retention policy.  Object Lock and
+// legal holds win over the policy: those objects can't be deleted, however
+// old they are.
+const (
+	RETENTION_EXPIRED    = "past retention"
+	RETENTION_KEPT       = "retained"
+	RETENTION_LOCKED     = "locked"
+	RETENTION_LEGAL_HOLD = "legal hold"
+)
+
+var reportRetentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Show which objects are past their retention and could be pruned, and which are locked or under legal hold",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var keep time.Duration
+		err := fmt.Errorf("Give the retention policy with --keep, e.g. 2555d for 7 years")
+		if RetentionKeep != "" {
+			keep, err = parseAge(RetentionKeep)
+		}
+		if err == nil {
+			err = RetentionReport(ui.Writer(), newS3Session(Region), BucketName, RetentionPrefix, keep, RetentionCSV, time.Now())
+		}
+		return err
+	},
+}
+
+type retentionStatus struct {
+	archivedObject
+	// Keep is how long the object is kept, its own retain-for or --keep.
+	Keep        time.Duration
+	Status      string
+	RetainUntil time.Time
+	LockMode    string
+	LegalHold   bool
+}
+
+// retentionStatuses looks up the Object Lock settings of every object, which
+// listings don't have, a few at a time.
+func retentionStatuses(s3session s3iface.S3API, bucket string, objects []archivedObject, keep time.Duration, now time.Time) ([]retentionStatus, error) {
+	statuses := make([]retentionStatus, len(objects))
+	err := forEachObject(len(objects), func(i int) error {
+		var err error
+		statuses[i], err = retentionStatusOf(s3session, bucket, objects[i], keep, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func retentionStatusOf(s3session s3iface.S3API, bucket string, obj archivedObject, keep time.Duration, now time.Time) (retentionStatus, error) {
+	status := retentionStatus{archivedObject: obj}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return status, fmt.Errorf("Failed to look up the retention of %s: %w", obj.Key, err)
+	}
+	status.LockMode = aws.StringValue(head.ObjectLockMode)
+	status.RetainUntil = aws.TimeValue(head.ObjectLockRetainUntilDate)
+	status.LegalHold = aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn
+	status.Keep = objectRetention(obj.Key, head.Metadata, keep)
+
+	switch {
+	case status.LegalHold:
+		status.Status = RETENTION_LEGAL_HOLD
+	case status.RetainUntil.After(now):
+		status.Status = RETENTION_LOCKED
+	case now.Sub(obj.LastModified) >= status.Keep:
+		status.Status = RETENTION_EXPIRED
+	default:
+		status.Status = RETENTION_KEPT
+	}
+	return status, nil
+}
+
+// RetentionReport prints how many objects under prefix are in each state,
+// and which are past keep, and writes all of them to csvOutput if given.
+// Sidecars go with their objects and the audit log isn't ours to prune, so
+// neither is listed.
+func RetentionReport(w io.Writer, s3session s3iface.S3API, bucket string, prefix string, keep time.Duration, csvOutput string, now time.Time) error {
+	objects, err := listAll(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	var archives []archivedObject
+	for _, obj := range objects {
+		if !isSidecar(obj.Key) && !isAudit(obj.Key) {
+			archives = append(archives, obj)
+		}
+	}
+
+	statuses, err := retentionStatuses(s3session, bucket, archives, keep, now)
+	if err != nil {
+		return err
+	}
+
+	if csvOutput != "" {
+		if err := writeRetentionCSVFile(csvOutput, statuses, now); err != nil {
+			return err
+		}
+	}
+	if csvOutput == "-" {
+		return nil
+	}
+
+	counts := map[string]int{}
+	sizes := map[string]int64{}
+	for _, s := range statuses {
+		counts[s.Status]++
+		sizes[s.Status] += s.Size
+		if s.Status == RETENTION_EXPIRED {
+			fmt.Fprintf(w, "%-19s %10s %10s  %s\n", showTime(s.LastModified), formatAge(now.Sub(s.LastModified)), showBytes(s.Size), s.Key)
+		}
+	}
+	if counts[RETENTION_EXPIRED] > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, status := range []string{RETENTION_EXPIRED, RETENTION_KEPT, RETENTION_LOCKED, RETENTION_LEGAL_HOLD} {
+		fmt.Fprintf(w, "%-15s %6d objects, %s\n", status+":", counts[status], showBytes(sizes[status]))
+	}
+	return nil
+}
+
+func writeRetentionCSVFile(output string, statuses []retentionStatus, now time.Time) error {
+	if output == "-" {
+		return writeRetentionCSV(os.Stdout, statuses, now)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := writeRetentionCSV(file, statuses, now); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeRetentionCSV writes a row per object, for auditors and spreadsheets.
+func writeRetentionCSV(w io.Writer, statuses []retentionStatus, now time.Time) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"key", "size", "storage_class", "last_modified", "age_days", "status", "lock_mode", "retain_until", "legal_hold"})
+	for _, s := range statuses {
+		var retainUntil string
+		if !s.RetainUntil.IsZero() {
+			retainUntil = s.RetainUntil.UTC().Format(time.RFC3339)
+		}
+		out.Write([]string{
+			s.Key,
+			strconv.FormatInt(s.Size, 10),
+			s.StorageClass,
+			s.LastModified.UTC().Format(time.RFC3339),
+			strconv.Itoa(int(now.Sub(s.LastModified).Hours() / 24)),
+			s.Status,
+			s.LockMode,
+			retainUntil,
+			strconv.FormatBool(s.LegalHold),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func init() {
+	reportRetentionCmd.Flags().StringVar(&RetentionKeep, "keep", "", "how long objects have to be kept, e.g. 2555d for 7 years, unless they were uploaded with --retain")
+	reportRetentionCmd.Flags().StringVar(&RetentionPrefix, "prefix", "", "only report on objects under this prefix")
+	reportRetentionCmd.Flags().StringVar(&RetentionCSV, "csv", "", "also write every object and its status to this CSV file, - for stdout instead of the summary")
+	reportCmd.AddCommand(reportRetentionCmd)
+}
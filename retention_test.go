@@ -0,0 +1,95 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRetentionReport(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	s3session := newFakeS3()
+	for key, obj := range map[string]*fakeObject{
+		"old.tar":      {data: []byte("old"), modified: now.AddDate(-8, 0, 0)},
+		"old.tar.sig":  {data: []byte("sidecar"), modified: now.AddDate(-8, 0, 0)},
+		"new.tar":      {data: []byte("new"), modified: now.AddDate(-1, 0, 0)},
+		"locked.tar":   {data: []byte("locked"), modified: now.AddDate(-8, 0, 0), lockMode: s3.ObjectLockModeCompliance, retainUntil: now.AddDate(1, 0, 0)},
+		"unlocked.tar": {data: []byte("unlocked"), modified: now.AddDate(-8, 0, 0), lockMode: s3.ObjectLockModeGovernance, retainUntil: now.AddDate(-1, 0, 0)},
+		"held.tar":     {data: []byte("held"), modified: now.AddDate(-8, 0, 0), legalHold: true},
+		"audit/x.json": {data: []byte("{}"), modified: now.AddDate(-8, 0, 0)},
+	} {
+		obj.storageClass = s3.StorageClassDeepArchive
+		s3session.objects[key] = obj
+	}
+
+	var out bytes.Buffer
+	if err := RetentionReport(&out, s3session, "bucket", "", 7*365*24*time.Hour, "", now); err != nil {
+		t.Fatal(err)
+	}
+	summary := strings.Join(strings.Fields(out.String()), " ")
+	for _, expected := range []string{"past retention: 2 objects", "retained: 1 objects", "locked: 1 objects", "legal hold: 1 objects"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+	for _, expected := range []string{"  old.tar\n", "  unlocked.tar\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+	for _, unexpected := range []string{"old.tar.sig", "audit/", "  new.tar", "held.tar\n"} {
+		if strings.Contains(out.String(), unexpected) {
+			t.Errorf("didn't expect %q in:\n%s", unexpected, out.String())
+		}
+	}
+}
+
+func TestWriteRetentionCSV(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	statuses := []retentionStatus{
+		{archivedObject: archivedObject{"a,b.tar", 10, s3.StorageClassDeepArchive, now.AddDate(0, 0, -10)}, Status: RETENTION_EXPIRED},
+		{archivedObject: archivedObject{"c.tar", 20, s3.StorageClassGlacier, now.AddDate(0, 0, -1)}, Status: RETENTION_LOCKED, LockMode: s3.ObjectLockModeCompliance, RetainUntil: now.AddDate(1, 0, 0)},
+	}
+
+	var out bytes.Buffer
+	if err := writeRetentionCSV(&out, statuses, now); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"key", "size", "storage_class", "last_modified", "age_days", "status", "lock_mode", "retain_until", "legal_hold"},
+		{"a,b.tar", "10", "DEEP_ARCHIVE", "2022-05-22T00:00:00Z", "10", "past retention", "", "", "false"},
+		{"c.tar", "20", "GLACIER", "2022-05-31T00:00:00Z", "1", "locked", "COMPLIANCE", "2023-06-01T00:00:00Z", "false"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("got %v", rows)
+	}
+	for i := range rows {
+		if strings.Join(rows[i], "|") != strings.Join(expected[i], "|") {
+			t.Errorf("row %d: got %v, expected %v", i, rows[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// There are two places a failed request can be retried: inside the SDK, which
+// retries throttling, 5xx and connection errors with exponential backoff, and
+// in our own per-part loop, which waits a while and sends the whole part
+// again.  Doing both multiplies the attempts, so only one of them is allowed
+// to retry at a time.
+const (
+	RETRY_MODE_SDK  = "sdk"
+	RETRY_MODE_TOOL = "tool"
+)
+
+// Pauses between attempts, which start at --retry-backoff and back off
+// exponentially, starting longer when S3 asks us to slow down.
+const (
+	RETRY_MIN_DELAY          = 1 * time.Second
+	RETRY_MIN_THROTTLE_DELAY = 5 * time.Second
+	RETRY_MAX_DELAY          = 2 * time.Minute
+)
+
+// Kinds of failures which are retried, for the summary at the end.
+const (
+	RETRY_KMS       = "KMS throttling"
+	RETRY_THROTTLED = "throttling"
+	RETRY_SERVER    = "server errors"
+	RETRY_NETWORK   = "timeouts and connection errors"
+	RETRY_OTHER     = "other errors"
+)
+
+// CLI flags
+var RetryMode string
+var MaxAttempts int
+var MaxRetries int
+var RetryBackoff time.Duration
+var RequestTimeout time.Duration
+var StallTimeout time.Duration
+var MinPartSpeed string
+var MinPartSpeedWindow time.Duration
+
+// minPartSpeed is --min-part-speed in bytes a second, 0 for none.
+var minPartSpeed int64
+
+func checkRetryFlags() error {
+	if RetryMode != RETRY_MODE_SDK && RetryMode != RETRY_MODE_TOOL {
+		return fmt.Errorf("Unknown --retry-mode %q, use %s or %s", RetryMode, RETRY_MODE_SDK, RETRY_MODE_TOOL)
+	}
+
+	// --max-retries is another way to say --max-attempts.
+	if MaxRetries >= 0 {
+		MaxAttempts = MaxRetries + 1
+	}
+	if MaxAttempts < 1 {
+		return fmt.Errorf("--max-attempts has to be at least 1")
+	}
+	if RetryBackoff <= 0 || RetryBackoff > RETRY_MAX_DELAY {
+		return fmt.Errorf("--retry-backoff has to be more than 0 and at most %s", RETRY_MAX_DELAY)
+	}
+
+	if MinPartSpeed != "" && MinPartSpeed != "0" {
+		speed, err := parseSize(strings.TrimSuffix(MinPartSpeed, "/s"))
+		if err != nil {
+			return fmt.Errorf("Invalid --min-part-speed %q, use e.g. 100K or 100K/s", MinPartSpeed)
+		}
+		if MinPartSpeedWindow < time.Second {
+			return fmt.Errorf("--min-part-speed-window has to be at least 1s")
+		}
+		minPartSpeed = speed
+	}
+
+	return nil
+}
+
+// configureRetries sets up the SDK's retryer and timeouts.
+func configureRetries(config *aws.Config) {
+	if RetryMode == RETRY_MODE_SDK {
+		config.MaxRetries = aws.Int(MaxAttempts - 1)
+		config.Retryer = countingRetryer{retryer()}
+	} else {
+		config.MaxRetries = aws.Int(0)
+	}
+
+	if RequestTimeout > 0 {
+		client := &http.Client{}
+		if config.HTTPClient != nil {
+			*client = *config.HTTPClient
+		}
+		client.Timeout = RequestTimeout
+		config.HTTPClient = client
+	}
+}
+
+// partRetries is how many times our own loop should retry a failed part.
+func partRetries() int {
+	if RetryMode == RETRY_MODE_TOOL {
+		return MaxAttempts - 1
+	}
+	return 0
+}
+
+// chunkRetrier retries the chunks of downloads the way newUploader has the
+// parts of uploads retried, waiting for the network when it's gone.
+func chunkRetrier(s3session s3iface.S3API) *transfer.Retrier {
+	return &transfer.Retrier{
+		Retries: partRetries(),
+		Delay:   retryDelay,
+		OnFailure: func(err error, stalled bool) bool {
+			return isNetworkError(err) && waitForNetwork(s3Endpoint(s3session), NETWORK_POLL_INTERVAL, WaitForNetwork)
+		},
+	}
+}
+
+// retryer backs off exponentially with jitter from --retry-backoff.  Both the
+// SDK and our per-part loop use it.
+func retryer() client.DefaultRetryer {
+	throttle := RETRY_MIN_THROTTLE_DELAY
+	if RetryBackoff > throttle {
+		throttle = RetryBackoff
+	}
+	return client.DefaultRetryer{
+		NumMaxRetries:    MaxAttempts - 1,
+		MinRetryDelay:    RetryBackoff,
+		MinThrottleDelay: throttle,
+		MaxRetryDelay:    RETRY_MAX_DELAY,
+		MaxThrottleDelay: RETRY_MAX_DELAY,
+	}
+}
+
+// countingRetryer counts the retries of the SDK for the summary.  Errors
+// which retrying won't fix, like AccessDenied or NoSuchUpload, aren't
+// retried by it to begin with.
+type countingRetryer struct {
+	client.DefaultRetryer
+}
+
+// ShouldRetry retries KMS throttling, which S3 may pass on with a status
+// code the SDK doesn't take as throttling.
+func (r countingRetryer) ShouldRetry(req *request.Request) bool {
+	if isKMSThrottle(req.Error) {
+		return true
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+func (r countingRetryer) RetryRules(req *request.Request) time.Duration {
+	countRetry(req.Error)
+	return r.DefaultRetryer.RetryRules(req)
+}
+
+// retries counts the retries of this run by kind.
+var retries = struct {
+	sync.Mutex
+	kinds map[string]int
+}{kinds: map[string]int{}}
+
+// retryKind tells what a retried failure was.
+func retryKind(err error) string {
+	var failure awserr.RequestFailure
+	switch {
+	case isKMSThrottle(err):
+		return RETRY_KMS
+	case request.IsErrorThrottle(err) || isSlowDown(err):
+		return RETRY_THROTTLED
+	case errors.As(err, &failure) && failure.StatusCode() >= 500:
+		return RETRY_SERVER
+	case isNetworkError(err) || request.IsErrorRetryable(err):
+		return RETRY_NETWORK
+	}
+	return RETRY_OTHER
+}
+
+func countRetry(err error) {
+	retries.Lock()
+	defer retries.Unlock()
+	retries.kinds[retryKind(err)]++
+}
+
+// reportRetries says how many requests were retried, and why, if any were.
+func reportRetries() {
+	retries.Lock()
+	defer retries.Unlock()
+	var total int
+	var kinds []string
+	for _, kind := range []string{RETRY_KMS, RETRY_THROTTLED, RETRY_SERVER, RETRY_NETWORK, RETRY_OTHER} {
+		if n := retries.kinds[kind]; n > 0 {
+			total += n
+			kinds = append(kinds, fmt.Sprintf("%d for %s", n, kind))
+		}
+	}
+	if total > 0 {
+		ui.Printf("Retried %d times, %s\n", total, strings.Join(kinds, ", "))
+	}
+}
+
+// retryDelay is how long the per-part loop waits before attempt try+1 after
+// err, worked out by the SDK's own retryer: exponential backoff with jitter.
+func retryDelay(try int, err error) time.Duration {
+	countRetry(err)
+	r := retryer()
+
+	// The retryer tells throttling by the status code as well as the
+	// error.
+	resp := &http.Response{Header: http.Header{}}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		resp.StatusCode = failure.StatusCode()
+	}
+	return r.RetryRules(&request.Request{RetryCount: try, Error: err, HTTPResponse: resp})
+}
@@ -0,0 +1,115 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryDelay(t *testing.T) {
+	defer func(attempts int) { MaxAttempts = attempts }(MaxAttempts)
+	MaxAttempts = 5
+
+	serverError := awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "")
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+
+	for _, c := range []struct {
+		try      int
+		err      error
+		min, max time.Duration
+	}{
+		{0, serverError, RETRY_MIN_DELAY, 2 * RETRY_MIN_DELAY},
+		{3, serverError, 8 * RETRY_MIN_DELAY, 16 * RETRY_MIN_DELAY},
+		{0, io.ErrUnexpectedEOF, RETRY_MIN_DELAY, 2 * RETRY_MIN_DELAY},
+		{0, slowDown, RETRY_MIN_THROTTLE_DELAY, 2 * RETRY_MIN_THROTTLE_DELAY},
+		{20, serverError, RETRY_MAX_DELAY / 2, RETRY_MAX_DELAY},
+	} {
+		if delay := retryDelay(c.try, c.err); delay < c.min || delay >= c.max {
+			t.Errorf("try %d after %v waits %s, not between %s and %s", c.try, c.err, delay, c.min, c.max)
+		}
+	}
+}
+
+func TestRetryFlags(t *testing.T) {
+	defer func(attempts, retries int, backoff time.Duration) {
+		MaxAttempts, MaxRetries, RetryBackoff = attempts, retries, backoff
+	}(MaxAttempts, MaxRetries, RetryBackoff)
+
+	MaxRetries, RetryBackoff = 2, 3*time.Second
+	if err := checkRetryFlags(); err != nil || MaxAttempts != 3 {
+		t.Errorf("--max-retries 2 makes %d attempts: %v", MaxAttempts, err)
+	}
+	serverError := awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "")
+	if delay := retryDelay(0, serverError); delay < RetryBackoff || delay >= 2*RetryBackoff {
+		t.Errorf("the first retry waits %s", delay)
+	}
+
+	RetryBackoff = 0
+	if err := checkRetryFlags(); err == nil {
+		t.Error("--retry-backoff 0 was taken")
+	}
+}
+
+func TestMinPartSpeedFlag(t *testing.T) {
+	defer func(speed string, window time.Duration, parsed int64) {
+		MinPartSpeed, MinPartSpeedWindow, minPartSpeed = speed, window, parsed
+	}(MinPartSpeed, MinPartSpeedWindow, minPartSpeed)
+
+	MinPartSpeed, MinPartSpeedWindow = "100K/s", time.Minute
+	if err := checkRetryFlags(); err != nil || minPartSpeed != 100<<10 {
+		t.Errorf("--min-part-speed 100K/s is %d bytes a second: %v", minPartSpeed, err)
+	}
+
+	MinPartSpeed = "fast"
+	if err := checkRetryFlags(); err == nil {
+		t.Error("--min-part-speed fast was taken")
+	}
+
+	MinPartSpeed, MinPartSpeedWindow = "100K", 0
+	if err := checkRetryFlags(); err == nil {
+		t.Error("--min-part-speed-window 0 was taken")
+	}
+}
+
+func TestReportRetries(t *testing.T) {
+	var out bytes.Buffer
+	ui = newJSONRenderer(&out)
+	defer func() { ui = humanRenderer{} }()
+	retries.kinds = map[string]int{}
+	defer func() { retries.kinds = map[string]int{} }()
+
+	reportRetries()
+	if out.Len() != 0 {
+		t.Errorf("reported %q without retries", out.String())
+	}
+
+	serverError := awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "")
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+	for _, err := range []error{slowDown, serverError, slowDown} {
+		countRetry(err)
+	}
+	reportRetries()
+	if want := "Retried 3 times, 2 for throttling, 1 for server errors"; !strings.Contains(out.String(), want) {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,115 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// sync flags
+var SyncFileRetries int
+var SyncFileRetryWait time.Duration
+
+// syncRetrySession makes a session for every pass over the files which
+// failed, so that credentials which ran out are fetched again.  Without it,
+// the first pass's is used.
+var syncRetrySession func() s3iface.S3API
+
+// failedFile is a file whose upload failed with err.
+type failedFile struct {
+	localFile
+	err error
+}
+
+// uploadChanged uploads files, and then those which failed again, up to
+// --file-retries times, waiting --file-retry-wait before the first of those
+// passes and twice as long before each one after it.  What failed every
+// pass is returned.  Once budget is done, the files left, failed ones
+// included, are left for the next run.
+func uploadChanged(s3session s3iface.S3API, aborts cleanupSession, bucket string, files []localFile, budget context.Context) ([]failedFile, *timeBudgetError) {
+	wait := SyncFileRetryWait
+	for pass := 0; ; pass++ {
+		failed, spent := uploadPass(s3session, aborts, bucket, files, budget)
+		if spent != nil || len(failed) == 0 || pass == SyncFileRetries {
+			return failed, spent
+		}
+
+		ui.Printf("%d files failed to upload, trying them again in %s\n", len(failed), wait)
+		select {
+		case <-time.After(wait):
+		case <-budget.Done():
+		}
+		wait *= 2
+		if syncRetrySession != nil {
+			s3session = syncRetrySession()
+		}
+		files = failedFiles(failed)
+	}
+}
+
+// uploadPass uploads files one after the other, carrying on past those
+// which fail.
+func uploadPass(s3session s3iface.S3API, aborts cleanupSession, bucket string, files []localFile, budget context.Context) ([]failedFile, *timeBudgetError) {
+	var failed []failedFile
+	for i, file := range files {
+		if budget.Err() != nil {
+			return nil, leftOver(append(failedFiles(failed), files[i:]...))
+		}
+		if err := uploadObject(s3session, aborts, bucket, file.Path, file.Key, ""); err != nil {
+			// Its journal has what was uploaded.
+			if budget.Err() != nil {
+				ui.Printf("Stopped uploading %s, the next run resumes it\n", file.Path)
+				return nil, leftOver(append(failedFiles(failed), files[i:]...))
+			}
+			ui.Warnf("Failed to upload %s: %v\n", file.Path, err)
+			failed = append(failed, failedFile{file, err})
+		}
+	}
+	return failed, nil
+}
+
+func failedFiles(failed []failedFile) []localFile {
+	var files []localFile
+	for _, f := range failed {
+		files = append(files, f.localFile)
+	}
+	return files
+}
+
+// failedError is the error of a run whose files failed every pass.  Each
+// failure was warned about as it happened.
+func failedError(failed []failedFile) error {
+	var paths []string
+	for _, f := range failed {
+		paths = append(paths, f.Path)
+	}
+	tries := SyncFileRetries + 1
+	switch {
+	case len(failed) == 1:
+		return fmt.Errorf("Failed to upload %s, %d times: %w", failed[0].Path, tries, failed[0].err)
+	case len(failed) > 10:
+		return fmt.Errorf("Failed to upload %d files, %d times each: %s and %d more", len(failed), tries, strings.Join(paths[:10], ", "), len(failed)-10)
+	case len(failed) > 0:
+		return fmt.Errorf("Failed to upload %d files, %d times each: %s", len(failed), tries, strings.Join(paths, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// flakyS3 refuses to start the uploads of keys as often as failures says.
+type flakyS3 struct {
+	*fakeS3
+	failures map[string]int
+}
+
+func (f *flakyS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	fail := f.failures[*in.Key] > 0
+	if fail {
+		f.failures[*in.Key]--
+	}
+	f.mu.Unlock()
+	if fail {
+		return nil, awserr.New("ExpiredToken", "The provided token has expired.", nil)
+	}
+	return f.fakeS3.CreateMultipartUploadWithContext(ctx, in, opts...)
+}
+
+func TestSyncRetriesFailedFiles(t *testing.T) {
+	SyncFileRetryWait = 0
+	var sessions int
+	defer func() {
+		SyncFileRetryWait = time.Minute
+		syncRetrySession = nil
+	}()
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb", "c.jpg": "ccc"})
+	fake := &flakyS3{newFakeS3(), map[string]int{"photos/a.jpg": 2}}
+	syncRetrySession = func() s3iface.S3API {
+		sessions++
+		return fake
+	}
+
+	// a.jpg fails twice, the third time is the charm.
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"photos/a.jpg", "photos/b.jpg", "photos/c.jpg"} {
+		if fake.objects[key] == nil {
+			t.Errorf("%s wasn't uploaded", key)
+		}
+	}
+	if sessions != 2 {
+		t.Errorf("%d fresh sessions for 2 passes over the failed files", sessions)
+	}
+
+	// b.jpg fails every time, which fails the run, but not the others.
+	for name, data := range map[string]string{"a.jpg": "aa", "b.jpg": "bbb"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.failures["photos/b.jpg"] = 3
+	err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false)
+	if err == nil || !strings.Contains(err.Error(), "b.jpg, 3 times") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if string(fake.objects["photos/a.jpg"].data) != "aa" || string(fake.objects["photos/b.jpg"].data) != "bb" {
+		t.Error("the files which could be uploaded weren't")
+	}
+}
+
+func TestFailedError(t *testing.T) {
+	var failed []failedFile
+	for i := 0; i < 12; i++ {
+		failed = append(failed, failedFile{localFile{Path: string(rune('a'+i)) + ".jpg"}, os.ErrPermission})
+	}
+	if err := failedError(failed[:2]); err == nil || err.Error() != "Failed to upload 2 files, 3 times each: a.jpg, b.jpg" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := failedError(failed); err == nil || !strings.HasSuffix(err.Error(), "j.jpg and 2 more") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if failedError(nil) != nil {
+		t.Error("nothing failed, but the run did")
+	}
+}
@@ -0,0 +1,70 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var RestoreRole string
+var RestoreExternalID string
+
+// ROLE_SESSION_NAME shows up in the CloudTrail logs of the account whose
+// role is assumed.
+const ROLE_SESSION_NAME = "s3-glacier-uploader"
+
+var roleARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+
+func checkRestoreRole() error {
+	if RestoreRole == "" {
+		if RestoreExternalID != "" {
+			return fmt.Errorf("--restore-external-id only goes with --restore-role")
+		}
+		return nil
+	}
+	if !roleARNPattern.MatchString(RestoreRole) {
+		return fmt.Errorf("Invalid --restore-role %q, use the ARN of the role, e.g. arn:aws:iam::123456789012:role/archive-restore", RestoreRole)
+	}
+	return nil
+}
+
+// assumeRestoreRole is an S3 client which restores and downloads as
+// --restore-role, typically one of the account the bucket belongs to, which
+// trusts the account of sess.  The role is assumed again before its
+// credentials expire, so that long waits for restores don't outlive them.
+func assumeRestoreRole(sess *session.Session) s3iface.S3API {
+	credentials := stscreds.NewCredentials(sess, RestoreRole, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = ROLE_SESSION_NAME
+		if RestoreExternalID != "" {
+			p.ExternalID = aws.String(RestoreExternalID)
+		}
+	})
+	return s3.New(sess, &aws.Config{Credentials: credentials})
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&RestoreRole, "restore-role", "", "ARN of an IAM role to assume for restoring and downloading, e.g. of the account whose bucket it is")
+	rootCmd.PersistentFlags().StringVar(&RestoreExternalID, "restore-external-id", "", "external ID the --restore-role trust policy asks for")
+}
@@ -0,0 +1,55 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckRestoreRole(t *testing.T) {
+	defer func() { RestoreRole, RestoreExternalID = "", "" }()
+
+	for _, c := range []struct {
+		role, externalID string
+		ok               bool
+	}{
+		{"", "", true},
+		{"arn:aws:iam::123456789012:role/archive-restore", "", true},
+		{"arn:aws-us-gov:iam::123456789012:role/teams/archive", "team-a", true},
+		{"archive-restore", "", false},
+		{"arn:aws:iam::123456789012:user/alice", "", false},
+		{"", "team-a", false},
+	} {
+		RestoreRole, RestoreExternalID = c.role, c.externalID
+		if err := checkRestoreRole(); (err == nil) != c.ok {
+			t.Errorf("--restore-role %q --restore-external-id %q: %v", c.role, c.externalID, err)
+		}
+	}
+}
+
+func TestRestoreRoleCredentials(t *testing.T) {
+	defer func() { RestoreRole = "" }()
+	RestoreRole = "arn:aws:iam::123456789012:role/archive-restore"
+
+	sess := newAWSSession("eu-west-1", "")
+	client := assumeRestoreRole(sess).(*s3.S3)
+	if client.Config.Credentials == nil || client.Config.Credentials == sess.Config.Credentials {
+		t.Error("the role isn't assumed")
+	}
+}
@@ -0,0 +1,232 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// A run of sync uploads many files, and a run which was killed halfway
+// through looks much like one which finished with fewer files.  With
+// --track-run, it says so in the bucket: a run descriptor is uploaded before
+// the first file and marked complete after the last one, so a descriptor
+// which is still "started" is a run that never finished.
+
+const RUNS_PREFIX = "runs/"
+
+// Run statuses
+const (
+	RUN_STARTED  = "started"
+	RUN_COMPLETE = "complete"
+	RUN_FAILED   = "failed"
+	// A run which used up its --time-budget.
+	RUN_PARTIAL = "partial"
+)
+
+var runsCmd = &cobra.Command{
+	Use:   "runs [job]",
+	Short: "List the runs recorded with sync --track-run, and which never finished",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var job string
+		if len(args) > 0 {
+			job = args[0]
+		}
+		return ListRuns(ui.Writer(), newS3Session(Region), BucketName, job)
+	},
+}
+
+type runDescriptor struct {
+	Version int       `json:"version"`
+	Job     string    `json:"job"`
+	Host    string    `json:"host"`
+	User    string    `json:"user"`
+	Source  string    `json:"source"`
+	Prefix  string    `json:"prefix,omitempty"`
+	Started time.Time `json:"started"`
+	// Files and Bytes are what the run planned to upload, PlanHash the
+	// SHA-256 of their keys and sizes, and Planned the files themselves,
+	// for repair-set.
+	Files     int       `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	Deletions int       `json:"deletions,omitempty"`
+	PlanHash  string    `json:"plan_hash"`
+	Planned   []runFile `json:"planned,omitempty"`
+	// Publish is whether the set is published once it's complete.
+	Publish  bool       `json:"publish,omitempty"`
+	Status   string     `json:"status"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Repaired *time.Time `json:"repaired,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Expected is what the job's earlier runs were like, and Drift how
+	// far off this one was.
+	Expected *runExpectation `json:"expected,omitempty"`
+	Drift    []string        `json:"drift,omitempty"`
+}
+
+type runFile struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// runKey sorts the runs of a job by when they started.
+func runKey(job string, started time.Time, host string) string {
+	return RUNS_PREFIX + job + "/" + started.UTC().Format("20060102T150405Z") + "-" + host + ".json"
+}
+
+func isRun(key string) bool {
+	return strings.HasPrefix(key, RUNS_PREFIX)
+}
+
+// syncJob is the name runs and sets of sync are filed under: --job, or the
+// name of the directory.
+func syncJob(dir string) string {
+	if SyncJob != "" {
+		return SyncJob
+	}
+	return filepath.Base(shortPath(dir))
+}
+
+func newRunDescriptor(job string, source string, prefix string, planned []localFile, deletions int) *runDescriptor {
+	sorted := append([]localFile(nil), planned...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	hash := sha256.New()
+	var size int64
+	var files []runFile
+	for _, file := range sorted {
+		fmt.Fprintf(hash, "%s\t%d\n", file.Key, file.Size)
+		size += file.Size
+		files = append(files, runFile{file.Key, shortPath(file.Path), file.Size})
+	}
+
+	return &runDescriptor{
+		Version:   1,
+		Job:       job,
+		Host:      auditHost(),
+		User:      auditUser(),
+		Source:    shortPath(source),
+		Prefix:    prefix,
+		Started:   runStarted,
+		Files:     len(planned),
+		Bytes:     size,
+		Deletions: deletions,
+		PlanHash:  hex.EncodeToString(hash.Sum(nil)),
+		Planned:   files,
+		Publish:   SyncPublish,
+		Status:    RUN_STARTED,
+	}
+}
+
+func (r *runDescriptor) key() string {
+	return runKey(r.Job, r.Started, r.Host)
+}
+
+func (r *runDescriptor) start(s3session s3iface.S3API, bucket string) error {
+	return putJSON(s3session, bucket, r.key(), r)
+}
+
+// finish marks the run complete, or failed with runErr.
+func (r *runDescriptor) finish(s3session s3iface.S3API, bucket string, runErr error, now time.Time) error {
+	r.Status = RUN_COMPLETE
+	r.Error = ""
+	var spent *timeBudgetError
+	if errors.As(runErr, &spent) {
+		r.Status = RUN_PARTIAL
+		r.Error = runErr.Error()
+	} else if runErr != nil {
+		r.Status = RUN_FAILED
+		r.Error = runErr.Error()
+	}
+	finished := now.UTC()
+	r.Finished = &finished
+	if r.Status == RUN_COMPLETE && r.Repaired == nil {
+		r.expectDuration()
+	}
+	return putJSON(s3session, bucket, r.key(), r)
+}
+
+// ListRuns prints the runs of job, or of every job, oldest first.
+func ListRuns(w io.Writer, s3session s3iface.S3API, bucket string, job string) error {
+	prefix := RUNS_PREFIX
+	if job != "" {
+		prefix += job + "/"
+	}
+	objects, err := listAll(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	var runs []runDescriptor
+	for _, obj := range objects {
+		var run runDescriptor
+		if _, err := getJSON(s3session, bucket, obj.Key, &run); err != nil {
+			return fmt.Errorf("Failed to read %s: %w", obj.Key, err)
+		}
+		runs = append(runs, run)
+	}
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No runs recorded, sync records them with --track-run")
+		return nil
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Started.Before(runs[j].Started)
+	})
+
+	var unfinished int
+	for _, run := range runs {
+		status := run.Status
+		if run.Status == RUN_STARTED {
+			status = "unfinished"
+			unfinished++
+		}
+		if run.Repaired != nil {
+			status += ", repaired " + run.Repaired.Local().Format("2006-01-02 15:04:05")
+		} else if run.Finished != nil {
+			status += " after " + run.Finished.Sub(run.Started).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%-19s %-20s %-20s %6d files %10s  %s\n",
+			showTime(run.Started), run.Job, run.Host, run.Files, showBytes(run.Bytes), status)
+		if run.Error != "" {
+			fmt.Fprintf(w, "    %s\n", run.Error)
+		}
+		for _, d := range run.Drift {
+			fmt.Fprintf(w, "    drift: %s\n", d)
+		}
+	}
+	if unfinished > 0 {
+		fmt.Fprintf(w, "\n%d runs never finished: they were interrupted, or are still going\n", unfinished)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(runsCmd)
+}
@@ -0,0 +1,111 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncTrackRun(t *testing.T) {
+	SyncTrackRun = true
+	defer func() { SyncTrackRun = false }()
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb"})
+	fake := newFakeS3()
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Error("a dry run recorded a run")
+	}
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	key := runKey(filepath.Base(dir), runStarted, auditHost())
+	var run runDescriptor
+	if found, err := getJSON(fake, "bucket", key, &run); !found || err != nil {
+		t.Fatalf("no run descriptor at %s: %v", key, err)
+	}
+	if run.Status != RUN_COMPLETE || run.Files != 2 || run.Bytes != 3 || run.Finished == nil || run.PlanHash == "" {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	// The next run plans nothing, and with --delete doesn't take the run
+	// descriptor for an object whose file is gone.
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects[key] == nil {
+		t.Fatal("the run descriptor was deleted")
+	}
+	getJSON(fake, "bucket", key, &run)
+	if run.Files != 0 || run.Status != RUN_COMPLETE {
+		t.Errorf("unexpected run %+v", run)
+	}
+}
+
+func TestRunPlanHash(t *testing.T) {
+	a := newRunDescriptor("job", "/data", "", []localFile{{Key: "a", Size: 1}, {Key: "b", Size: 2}}, 0)
+	b := newRunDescriptor("job", "/data", "", []localFile{{Key: "b", Size: 2}, {Key: "a", Size: 1}}, 0)
+	c := newRunDescriptor("job", "/data", "", []localFile{{Key: "a", Size: 1}, {Key: "b", Size: 3}}, 0)
+	if a.PlanHash != b.PlanHash {
+		t.Error("the order of the files changed the hash")
+	}
+	if a.PlanHash == c.PlanHash {
+		t.Error("a different plan has the same hash")
+	}
+}
+
+func TestListRuns(t *testing.T) {
+	fake := newFakeS3()
+	started := time.Date(2022, 5, 1, 2, 0, 0, 0, time.UTC)
+
+	complete := &runDescriptor{Job: "photos", Host: "nas", Started: started, Files: 3, Status: RUN_STARTED}
+	complete.start(fake, "bucket")
+	if err := complete.finish(fake, "bucket", nil, started.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	failed := &runDescriptor{Job: "photos", Host: "nas", Started: started.AddDate(0, 0, 1), Status: RUN_STARTED}
+	failed.finish(fake, "bucket", errors.New("Failed to upload x.jpg"), started.AddDate(0, 0, 1).Add(time.Minute))
+	interrupted := &runDescriptor{Job: "photos", Host: "nas", Started: started.AddDate(0, 0, 2), Status: RUN_STARTED}
+	interrupted.start(fake, "bucket")
+	other := &runDescriptor{Job: "music", Host: "nas", Started: started, Status: RUN_STARTED}
+	other.start(fake, "bucket")
+
+	var out bytes.Buffer
+	if err := ListRuns(&out, fake, "bucket", "photos"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("unexpected listing:\n%s", out.String())
+	}
+	for i, expected := range []string{"complete after 1h0m0s", "failed after 1m0s", "    Failed to upload x.jpg", "unfinished", "", "1 runs never finished"} {
+		if !strings.Contains(lines[i], expected) {
+			t.Errorf("line %d: expected %q in %q", i, expected, lines[i])
+		}
+	}
+	if strings.Contains(out.String(), "music") {
+		t.Error("listed the runs of another job")
+	}
+}
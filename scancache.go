@@ -0,0 +1,130 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sync flags
+var SyncRehash bool
+
+// scanCache remembers, for sync --compare checksum, which files matched
+// their objects when they were last read: a file of the same size and
+// modification time as then, whose object still has the same ETag, matches
+// it without being read again.  It's kept in the state directory, one per
+// directory and bucket, and only has the files the last sync found.  A nil
+// one has nothing.
+type scanCache struct {
+	Version int                    `json:"version"`
+	Files   map[string]scannedFile `json:"files"`
+
+	path string
+	// mu protects found, what this sync found matching.
+	mu    sync.Mutex
+	found map[string]scannedFile
+}
+
+// scannedFile is a file which matched the object key had with ETag.
+type scannedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Key     string    `json:"key"`
+	ETag    string    `json:"etag"`
+}
+
+func scanCachePath(bucket string, dir string) (string, error) {
+	state, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	state = filepath.Join(state, "scans")
+	if err := os.MkdirAll(state, 0700); err != nil {
+		return "", err
+	}
+
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	sum := sha256.Sum256([]byte(bucket + "\x00" + dir))
+	return filepath.Join(state, fmt.Sprintf("%x.json", sum[:16])), nil
+}
+
+// loadScanCache returns the scan cache of dir synced to bucket, which is
+// empty the first time, or with --rehash.
+func loadScanCache(bucket string, dir string) (*scanCache, error) {
+	p, err := scanCachePath(bucket, dir)
+	if err != nil {
+		return nil, err
+	}
+	cache := &scanCache{Files: map[string]scannedFile{}, path: p, found: map[string]scannedFile{}}
+	if SyncRehash {
+		return cache, nil
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, fmt.Errorf("Failed to read the scan cache %s: %w", p, err)
+	}
+	return cache, nil
+}
+
+// Matched tells whether file matched the object with etag before, and hasn't
+// changed since.  Either way, a file which matches is recorded with Record.
+func (c *scanCache) Matched(file localFile, etag string) bool {
+	if c == nil {
+		return false
+	}
+	scanned, ok := c.Files[file.Path]
+	return ok && scanned.Key == file.Key && scanned.ETag == etag && scanned.Size == file.Size && scanned.ModTime.Equal(file.ModTime)
+}
+
+// Record notes that file matches the object with etag.
+func (c *scanCache) Record(file localFile, etag string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.found[file.Path] = scannedFile{Size: file.Size, ModTime: file.ModTime, Key: file.Key, ETag: etag}
+}
+
+// Save replaces what the cache had with what this sync found.  Files which
+// are uploaded again are left out, their objects get new ETags.
+func (c *scanCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Version = STATE_VERSION
+	c.Files = c.found
+	return writeStateFile(c.path, c)
+}
@@ -0,0 +1,85 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncScanCache(t *testing.T) {
+	defer func() { SyncRehash = false }()
+	fake := newFakeS3()
+	dir := writeTree(t, map[string]string{"a.jpg": "AA", "b.jpg": "BB"})
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_CHECKSUM, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first checksum sync reads the files and remembers they match.
+	uploaded := fake.nextID
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_CHECKSUM, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded {
+		t.Errorf("%d files were uploaded again", fake.nextID-uploaded)
+	}
+	cache, err := loadScanCache("bucket", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Files) != 2 || cache.Files[filepath.Join(dir, "a.jpg")].Key != "photos/a.jpg" {
+		t.Errorf("the cache has %+v", cache.Files)
+	}
+
+	// A file rewritten with the same size and time isn't read again...
+	filename := filepath.Join(dir, "b.jpg")
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("XX"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_CHECKSUM, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded {
+		t.Error("the cached file was read again")
+	}
+
+	// ...unless the cache isn't trusted.
+	SyncRehash = true
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_CHECKSUM, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded+1 || string(fake.objects["photos/b.jpg"].data) != "XX" {
+		t.Error("--rehash missed the change")
+	}
+
+	// The uploaded file is left out of the cache, its object is new.
+	SyncRehash = false
+	if cache, err = loadScanCache("bucket", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Files[filename]; ok || len(cache.Files) != 1 {
+		t.Errorf("the cache has %+v", cache.Files)
+	}
+}
@@ -0,0 +1,313 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+const (
+	SCRUB_OK         = "ok"
+	SCRUB_FAILED     = "failed"
+	SCRUB_RESTORING  = "restoring"
+	SCRUB_ATTRIBUTES = "attributes"
+)
+
+// scrub flags
+var ScrubPrefix string
+var ScrubSample int
+var ScrubRestoreTier string
+var ScrubDays int64
+
+var scrubCmd = &cobra.Command{
+	Use:   "scrub",
+	Short: "Verify a random sample of archived objects",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Scrub(newRestoreS3Session(Region), BucketName, ScrubPrefix, ScrubSample, ScrubRestoreTier, ScrubDays)
+	},
+}
+
+// scrubRecord remembers when we last looked at an object and what we found,
+// so that repeated runs work their way through the whole archive.
+type scrubRecord struct {
+	Checked time.Time `json:"checked"`
+	Result  string    `json:"result"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+func scrubHistoryPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "scrub.json"), nil
+}
+
+func loadScrubHistory() (map[string]scrubRecord, error) {
+	history := map[string]scrubRecord{}
+
+	p, err := scrubHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := checkStateVersion(p, data); err != nil {
+		return nil, err
+	}
+
+	// Version 1 was only the map.
+	if stateVersion(data) == 1 {
+		return history, json.Unmarshal(data, &history)
+	}
+	file := scrubHistoryFile{Objects: history}
+	err = json.Unmarshal(data, &file)
+	return file.Objects, err
+}
+
+// scrubHistoryFile is what's in the scrub history file.
+type scrubHistoryFile struct {
+	Version int                    `json:"version"`
+	Objects map[string]scrubRecord `json:"objects"`
+}
+
+func saveScrubHistory(history map[string]scrubRecord) error {
+	p, err := scrubHistoryPath()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(p, scrubHistoryFile{Version: STATE_VERSION, Objects: history})
+}
+
+// pickSample chooses n objects.  Objects we requested a restore for come
+// first, because their restored copies only stay around for a few days.  Then
+// the ones we've never looked at, then the ones we looked at the longest time
+// ago.
+func pickSample(objects []archivedObject, history map[string]scrubRecord, bucket string, n int) []archivedObject {
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(len(objects), func(i, j int) {
+		objects[i], objects[j] = objects[j], objects[i]
+	})
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		a := history[bucket+"/"+objects[i].Key]
+		b := history[bucket+"/"+objects[j].Key]
+		if (a.Result == SCRUB_RESTORING) != (b.Result == SCRUB_RESTORING) {
+			return a.Result == SCRUB_RESTORING
+		}
+		return a.Checked.Before(b.Checked)
+	})
+
+	if n < len(objects) {
+		objects = objects[:n]
+	}
+	return objects
+}
+
+// verifyObject checks a single object as thoroughly as we can without any
+// local copy: its size, and if its data is readable, that the data still
+// hashes to the ETag S3 recorded when it was uploaded.
+func verifyObject(s3session s3iface.S3API, bucket string, obj archivedObject, tier string, days int64) scrubRecord {
+	record := scrubRecord{Checked: time.Now()}
+
+	attrs, err := s3session.GetObjectAttributes(&s3.GetObjectAttributesInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+		ObjectAttributes: aws.StringSlice([]string{
+			s3.ObjectAttributesEtag,
+			s3.ObjectAttributesChecksum,
+			s3.ObjectAttributesObjectSize,
+		}),
+	})
+	if err != nil {
+		record.Result, record.Detail = SCRUB_FAILED, err.Error()
+		return record
+	}
+
+	if attrs.ObjectSize != nil && *attrs.ObjectSize != obj.Size {
+		record.Result = SCRUB_FAILED
+		record.Detail = fmt.Sprintf("size is %d, expected %d", *attrs.ObjectSize, obj.Size)
+		return record
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		record.Result, record.Detail = SCRUB_FAILED, err.Error()
+		return record
+	}
+
+	// Without a part manifest, all we can go on for SSE-KMS objects is
+	// what GetObjectAttributes told us, their ETag isn't an MD5 digest.
+	expected, partSizes, err := expectedETag(s3session, bucket, obj.Key, head)
+	if errors.Is(err, errUnverifiable) {
+		record.Result, record.Detail = SCRUB_ATTRIBUTES, err.Error()
+		return record
+	}
+	if err != nil {
+		record.Result, record.Detail = SCRUB_FAILED, err.Error()
+		return record
+	}
+
+	// The manifest's ETag was recorded at upload time, so a difference
+	// means the object has been replaced since.  This needs no restore.
+	etag := strings.Trim(*attrs.ETag, "\"")
+	if !isKMS(head) && etag != expected {
+		record.Result, record.Detail = SCRUB_FAILED, fmt.Sprintf("ETag is %s, the part manifest says %s", etag, expected)
+		return record
+	}
+
+	if checkRestored(obj.Key, head) != nil {
+		if tier == "" {
+			record.Result, record.Detail = SCRUB_ATTRIBUTES, "archived, not restored"
+			return record
+		}
+
+		used, err := requestRestore(s3session, bucket, obj.Key, tier, days)
+		if err != nil {
+			record.Result, record.Detail = SCRUB_FAILED, err.Error()
+			return record
+		}
+
+		record.Result, record.Detail = SCRUB_RESTORING, used+" restore requested"
+		return record
+	}
+
+	ours, err := downloadETag(s3session, bucket, obj.Key, *head.ETag, obj.Size, partSizes)
+	if err != nil {
+		record.Result, record.Detail = SCRUB_FAILED, err.Error()
+		return record
+	}
+
+	if ours != expected {
+		record.Result, record.Detail = SCRUB_FAILED, fmt.Sprintf("ETag is %s, data hashes to %s", expected, ours)
+		return record
+	}
+
+	record.Result = SCRUB_OK
+	return record
+}
+
+// downloadETag streams an object and computes its ETag the same way S3 did,
+// given the sizes of the parts it was uploaded in.  etag is the one the
+// object has now, which makes sure it stays the same object throughout.
+func downloadETag(s3session s3iface.S3API, bucket string, key string, etag string, size int64, partSizes []int64) (string, error) {
+	chunks := newRangeReader(s3session, bucket, key, etag, 0, size-1, 4)
+	defer chunks.Close()
+
+	return computeETag(chunks, partSizes)
+}
+
+func Scrub(s3session s3iface.S3API, bucket string, prefix string, sample int, tier string, days int64) error {
+	objects, err := collectObjects(s3session, bucket, prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(objects) == 0 {
+		return fmt.Errorf("There are no objects under %q", prefix)
+	}
+
+	history, err := loadScrubHistory()
+	if err != nil {
+		return err
+	}
+
+	// Assume the worst: every archived object in the sample needs a restore,
+	// and all of them get downloaded.
+	picked := pickSample(objects, history, bucket, sample)
+	var cost float64
+	var size int64
+	if tier != "" {
+		if cost, err = restoreCost(picked, tier); err != nil {
+			return err
+		}
+	}
+	for _, obj := range picked {
+		size += obj.Size
+	}
+	if err := checkBudget("scrubbing the sample", cost+transferCost(size)); err != nil {
+		return err
+	}
+
+	var failed int
+
+	for _, obj := range picked {
+		record := verifyObject(s3session, bucket, obj, tier, days)
+		history[bucket+"/"+obj.Key] = record
+
+		if record.Result == SCRUB_FAILED {
+			failed++
+		}
+
+		ui.Printf("%-10s %s %s\n", record.Result, obj.Key, record.Detail)
+	}
+
+	if err := saveScrubHistory(history); err != nil {
+		return err
+	}
+
+	var verified, checked int
+	for _, obj := range objects {
+		switch history[bucket+"/"+obj.Key].Result {
+		case SCRUB_OK:
+			verified++
+		case SCRUB_ATTRIBUTES, SCRUB_RESTORING:
+			checked++
+		}
+	}
+
+	ui.Printf("Coverage: %d of %d objects verified by hashing their data, %d more by their attributes only\n",
+		verified, len(objects), checked)
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects failed verification", failed)
+	}
+
+	return nil
+}
+
+func init() {
+	scrubCmd.Flags().StringVar(&ScrubPrefix, "prefix", "", "only scrub objects under this prefix")
+	scrubCmd.Flags().IntVar(&ScrubSample, "sample", 10, "number of objects to check")
+	scrubCmd.Flags().StringVar(&ScrubRestoreTier, "restore-tier", "", "restore archived objects with this tier so the next run can hash them")
+	scrubCmd.Flags().Int64Var(&ScrubDays, "days", 1, "number of days to keep restored copies")
+	rootCmd.AddCommand(scrubCmd)
+}
@@ -0,0 +1,78 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestPickSample(t *testing.T) {
+	now := time.Now()
+	objects := []archivedObject{{Key: "old"}, {Key: "new"}, {Key: "restoring"}, {Key: "never"}}
+	history := map[string]scrubRecord{
+		"b/old":       {Checked: now.Add(-48 * time.Hour), Result: SCRUB_OK},
+		"b/new":       {Checked: now.Add(-time.Hour), Result: SCRUB_OK},
+		"b/restoring": {Checked: now, Result: SCRUB_RESTORING},
+	}
+
+	sample := pickSample(objects, history, "b", 3)
+
+	var keys []string
+	for _, obj := range sample {
+		keys = append(keys, obj.Key)
+	}
+
+	want := []string{"restoring", "never", "old"}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("got %v, want %v", keys, want)
+		}
+	}
+}
+
+func TestScrubWholeBucket(t *testing.T) {
+	fake := newFakeS3()
+	keys := []string{"vm.img", "photos/2022/a.jpg"}
+	for _, key := range keys {
+		fake.PutObject(&s3.PutObjectInput{
+			Bucket:       aws.String("scrubbed"),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader(randomData(1024)),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+	}
+
+	// Without --prefix, everything in the bucket is a candidate.
+	if err := Scrub(fake, "scrubbed", "", 10, "", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := loadScrubHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if record := history["scrubbed/"+key]; record.Result != SCRUB_OK {
+			t.Errorf("%s: %+v", key, record)
+		}
+	}
+}
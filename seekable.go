@@ -0,0 +1,166 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var Seekable bool
+
+const FRAME_INDEX_SUFFIX = ".frames.json"
+
+// A --seekable archive is compressed in SEEKABLE_FRAMES_PER_PART frames per
+// part.  More of them waste less padding, fewer compress better.
+const SEEKABLE_FRAMES_PER_PART = 8
+
+// zstd skips skippable frames, whatever is in them.  One is a magic number
+// and the size of what follows it, so at least ZSTD_SKIPPABLE_HEADER bytes,
+// and at most ZSTD_SKIPPABLE_MAX, which is as big as we make them.
+const (
+	ZSTD_SKIPPABLE_MAGIC  = 0x184D2A50
+	ZSTD_SKIPPABLE_HEADER = 8
+	ZSTD_SKIPPABLE_MAX    = 1 << 30
+)
+
+// frameIndex is stored next to a --seekable archive.  Every part of the
+// archive starts with a frame, which decompresses on its own, and the index
+// says where each frame is in the object and which bytes of the tar archive
+// it holds, so that any of them can be downloaded with a ranged GET and
+// decompressed without the rest.
+type frameIndex struct {
+	Key      string          `json:"key"`
+	Format   string          `json:"format"`
+	PartSize int64           `json:"part_size"`
+	Frames   []seekableFrame `json:"frames"`
+}
+
+type seekableFrame struct {
+	Input      int64 `json:"input"`
+	InputSize  int64 `json:"input_size"`
+	Output     int64 `json:"output"`
+	OutputSize int64 `json:"output_size"`
+}
+
+// framePadding is how much padding goes before a frame of size at pos, so
+// that it doesn't straddle parts: none if it fits in what's left of the
+// part, otherwise the rest of it.  What's left may be too little for a
+// skippable frame, then the padding takes the next part too.
+func framePadding(pos int64, size int64, align int64) int64 {
+	left := align - pos%align
+	if left == align || size <= left {
+		return 0
+	}
+	if left < ZSTD_SKIPPABLE_HEADER {
+		left += align
+	}
+	return left
+}
+
+// writePadding writes size bytes of skippable frames.
+func writePadding(w io.Writer, size int64) error {
+	zeros := make([]byte, 64*1024)
+	for size > 0 {
+		n := size
+		if n > ZSTD_SKIPPABLE_MAX {
+			n = ZSTD_SKIPPABLE_MAX
+		}
+		if left := size - n; left > 0 && left < ZSTD_SKIPPABLE_HEADER {
+			n -= ZSTD_SKIPPABLE_HEADER
+		}
+		size -= n
+
+		var header [ZSTD_SKIPPABLE_HEADER]byte
+		binary.LittleEndian.PutUint32(header[:], ZSTD_SKIPPABLE_MAGIC)
+		binary.LittleEndian.PutUint32(header[4:], uint32(n-ZSTD_SKIPPABLE_HEADER))
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		for n -= ZSTD_SKIPPABLE_HEADER; n > 0; {
+			chunk := zeros
+			if int64(len(chunk)) > n {
+				chunk = chunk[:n]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			n -= int64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// writeSeekable writes out the frame in the buffer, padded so that it
+// starts a part if it would straddle one, and indexes it.
+func (f *frameWriter) writeSeekable() error {
+	size := int64(f.buffer.Len())
+	if err := writePadding(f.out, framePadding(f.out.n, size, f.align)); err != nil {
+		return err
+	}
+	f.index.Frames = append(f.index.Frames, seekableFrame{
+		Input:      f.input - f.framed,
+		InputSize:  f.framed,
+		Output:     f.out.n,
+		OutputSize: size,
+	})
+	_, err := f.buffer.WriteTo(f.out)
+	return err
+}
+
+// seekableTarStream is tarStream, compressed with zstd in frames aligned to
+// parts of partSize, which it adds to index as it goes.
+func seekableTarStream(dir string, input *streamInput, partSize int, index *frameIndex) io.ReadCloser {
+	return pipeFrames(dir, input, func(w io.Writer) *frameWriter {
+		frames := newFrameWriter(w, COMPRESS_ZSTD, frameBoundary{}, &frameLog{})
+		frames.size = int64(partSize) / SEEKABLE_FRAMES_PER_PART
+		frames.align = int64(partSize)
+		frames.index = index
+		return frames
+	})
+}
+
+// saveFrameIndex stores the index next to the archive, where it can be read
+// without restoring anything.
+func saveFrameIndex(s3session s3iface.S3API, bucket string, index *frameIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	key := index.Key + FRAME_INDEX_SUFFIX
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Println("Frame index:", key)
+	return putSignature(s3session, bucket, key, data)
+}
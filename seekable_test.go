@@ -0,0 +1,133 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFramePadding(t *testing.T) {
+	for _, c := range []struct {
+		pos, size, want int64
+	}{
+		{0, 500, 0},
+		{100, 900, 0},
+		{100, 901, 900},
+		{1000, 5000, 0},
+		{995, 100, 5 + 1000},
+	} {
+		if got := framePadding(c.pos, c.size, 1000); got != c.want {
+			t.Errorf("%d bytes at %d: got %d bytes of padding, want %d", c.size, c.pos, got, c.want)
+		}
+	}
+}
+
+func zstdDecompress(t *testing.T, data []byte) []byte {
+	cmd := exec.Command("zstd", "-d", "-q", "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("zstd -d: %v", err)
+	}
+	return out
+}
+
+func TestSeekableTarStream(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd isn't installed")
+	}
+
+	tree := map[string]string{"text.txt": string(bytes.Repeat([]byte("seekable "), 20000))}
+	for name, size := range map[string]int{"a.bin": 100000, "b.bin": 250000} {
+		tree[name] = string(randomData(size))
+	}
+	dir := writeTree(t, tree)
+	archive, err := io.ReadAll(tarStream(dir, "", newStreamInput(dir, 0, false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const partSize = 64 * 1024
+	index := &frameIndex{}
+	out, err := io.ReadAll(seekableTarStream(dir, newStreamInput(dir, 0, true), partSize, index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(zstdDecompress(t, out), archive) {
+		t.Fatal("the frames don't decompress to the archive")
+	}
+
+	// No frame straddles parts, so every part decompresses on its own.
+	var parts []byte
+	for offset := 0; offset < len(out); offset += partSize {
+		end := offset + partSize
+		if end > len(out) {
+			end = len(out)
+		}
+		parts = append(parts, zstdDecompress(t, out[offset:end])...)
+	}
+	if !bytes.Equal(parts, archive) {
+		t.Error("the parts don't decompress to the archive")
+	}
+
+	// And every frame is where the index says.
+	var input int64
+	for _, frame := range index.Frames {
+		if frame.Input != input || frame.Output/partSize != (frame.Output+frame.OutputSize-1)/partSize {
+			t.Fatalf("got frame %+v", frame)
+		}
+		got := zstdDecompress(t, out[frame.Output:frame.Output+frame.OutputSize])
+		if !bytes.Equal(got, archive[frame.Input:frame.Input+frame.InputSize]) {
+			t.Fatalf("frame %+v isn't that part of the archive", frame)
+		}
+		input += frame.InputSize
+	}
+	if input != int64(len(archive)) {
+		t.Errorf("the frames hold %d bytes of the %d byte archive", input, len(archive))
+	}
+}
+
+func TestUploadSeekableTar(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd isn't installed")
+	}
+	defer func() { Tar, Compress, Seekable = false, "", false }()
+	Tar, Compress, Seekable = true, COMPRESS_ZSTD, true
+
+	dir := writeTree(t, tarTree)
+	fake := newFakeS3()
+	if err := uploadTar(fake, fake.cleanup, "bucket", dir, COMPRESS_ZSTD); err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Base(dir) + ".tar.zst"
+	if fake.objects[key] == nil {
+		t.Fatal("the archive wasn't uploaded")
+	}
+	index := fake.objects[key+FRAME_INDEX_SUFFIX]
+	if index == nil || !isSidecar(key+FRAME_INDEX_SUFFIX) {
+		t.Fatal("the frame index wasn't uploaded")
+	}
+	var got frameIndex
+	if err := json.Unmarshal(index.data, &got); err != nil || got.Key != key || len(got.Frames) != 1 {
+		t.Errorf("got index %+v: %v", got, err)
+	}
+}
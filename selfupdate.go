@@ -0,0 +1,351 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=v1.2.3".
+var Version = "dev"
+
+// ReleasePublicKey is the ed25519 key the release checksums are signed with,
+// base64 encoded.  Release builds pin it the same way as the version, see
+// RELEASE_PUBLIC_KEY in the Makefile.
+var ReleasePublicKey = ""
+
+const (
+	RELEASES_URL  = "https://api.github.com/repos/honza/s3-glacier-uploader/releases/latest"
+	CHECKSUMS     = "SHA256SUMS"
+	CHECKSUMS_SIG = "SHA256SUMS.sig"
+)
+
+// self-update flags
+var UpdateCheck bool
+var UpdateReleaseKey string
+
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Replace this binary with the latest release",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return SelfUpdate(UpdateCheck, UpdateReleaseKey)
+	},
+}
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) (string, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("Release %s has no %s", r.TagName, name)
+}
+
+// releaseAssetName is the name of the binary of a release for this
+// platform.  It carries the version, so that the signed checksums do too.
+func releaseAssetName(tag string) string {
+	name := fmt.Sprintf("s3-glacier-uploader_%s_%s_%s", tag, runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch %s: %s", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// releaseKey is the key the release has to be signed with: the one given
+// with --release-key, or the one pinned in the binary.  There's no updating
+// without one, a checksum from the same place as the binary proves nothing.
+func releaseKey(filename string) (ed25519.PublicKey, error) {
+	if filename != "" {
+		return loadVerifyKey(filename)
+	}
+	if ReleasePublicKey == "" {
+		return nil, fmt.Errorf("This build has no release key, give the project's with --release-key")
+	}
+	key, err := base64.StdEncoding.DecodeString(ReleasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("The release key of this build is malformed")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// parseVersion splits a tag like v1.2.3 into its numbers.
+func parseVersion(tag string) ([]int, error) {
+	fields := strings.Split(strings.TrimPrefix(tag, "v"), ".")
+	version := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q isn't a version", tag)
+		}
+		version[i] = n
+	}
+	return version, nil
+}
+
+// parseBuildVersion takes the version of a build, which make sets to what
+// git describe --tags --always --dirty says: a tag like v1.2.3, followed by
+// how many commits after it the build is, like v1.2.3-4-gabcdef, and -dirty
+// for uncommitted changes.  A build after a tag is newer than its release.
+func parseBuildVersion(version string) ([]int, bool, error) {
+	tag := strings.TrimSuffix(version, "-dirty")
+	var after bool
+	if fields := strings.Split(tag, "-"); len(fields) >= 3 && strings.HasPrefix(fields[len(fields)-1], "g") {
+		if n, err := strconv.Atoi(fields[len(fields)-2]); err == nil && n > 0 {
+			tag = strings.Join(fields[:len(fields)-2], "-")
+			after = true
+		}
+	}
+	parsed, err := parseVersion(tag)
+	if err != nil {
+		return nil, false, fmt.Errorf("%q isn't a version", version)
+	}
+	return parsed, after, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b.  Missing numbers count as 0.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// replaceExecutable puts the new binary in place of the old one.  Windows
+// doesn't let a running executable be overwritten, but it does let it be
+// renamed, so there the old one is moved aside first, and removed by the
+// next update.
+func replaceExecutable(updated string, executable string, goos string) error {
+	if goos != "windows" {
+		return os.Rename(updated, executable)
+	}
+
+	old := executable + ".old"
+	os.Remove(old)
+	if err := os.Rename(executable, old); err != nil {
+		return err
+	}
+	if err := os.Rename(updated, executable); err != nil {
+		os.Rename(old, executable)
+		return err
+	}
+	return nil
+}
+
+// parseChecksums finds the checksum of name in a sha256sum style file.
+func parseChecksums(data []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+				return "", fmt.Errorf("Malformed checksum for %s", name)
+			}
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("There is no checksum for %s", name)
+}
+
+// SelfUpdate downloads the latest release for this platform, checks it
+// against the release's checksums and their signature, and puts it in place
+// of the running binary.  It never goes back to an older release.
+func SelfUpdate(check bool, keyFile string) error {
+	data, err := httpGet(RELEASES_URL)
+	if err != nil {
+		return err
+	}
+
+	var latest release
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return fmt.Errorf("Failed to parse the release feed: %w", err)
+	}
+
+	latestVersion, err := parseVersion(latest.TagName)
+	if err != nil {
+		return fmt.Errorf("Can't tell which version the latest release is: %w", err)
+	}
+	current, after, versionErr := parseBuildVersion(Version)
+	if versionErr == nil {
+		switch compareVersions(latestVersion, current) {
+		case 0:
+			if !after {
+				ui.Println("Already running the latest release,", Version)
+				return nil
+			}
+			fallthrough
+		case -1:
+			return fmt.Errorf("Running %s, which is newer than the latest release %s, not downgrading", Version, latest.TagName)
+		}
+	}
+
+	ui.Printf("Running %s, the latest release is %s\n", Version, latest.TagName)
+	if check {
+		return nil
+	}
+	// Without knowing what's running, any release could be a downgrade.
+	if versionErr != nil {
+		return fmt.Errorf("Can't tell which version this build is, %w; build it with make, or install a release by hand", versionErr)
+	}
+
+	public, err := releaseKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	name := releaseAssetName(latest.TagName)
+	binaryURL, err := latest.assetURL(name)
+	if err != nil {
+		return err
+	}
+
+	checksumsURL, err := latest.assetURL(CHECKSUMS)
+	if err != nil {
+		return err
+	}
+	checksums, err := httpGet(checksumsURL)
+	if err != nil {
+		return err
+	}
+
+	sigURL, err := latest.assetURL(CHECKSUMS_SIG)
+	if err != nil {
+		return err
+	}
+	signature, err := httpGet(sigURL)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, checksums, signature) {
+		return fmt.Errorf("The signature of the %s checksums is not valid", latest.TagName)
+	}
+
+	// The feed's tag isn't signed, but the checksums only list the binary
+	// under this name if they're of that version: those of an older release
+	// served as the latest one don't have it.
+	expected, err := parseChecksums(checksums, name)
+	if err != nil {
+		return fmt.Errorf("The signed checksums aren't of %s: %w", latest.TagName, err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return err
+	}
+
+	// The new binary is written next to the old one, so that it can be
+	// renamed over it in one step.
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".s3-glacier-uploader-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	resp, err := http.Get(binaryURL)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tmp.Close()
+		return fmt.Errorf("Failed to fetch %s: %s", binaryURL, resp.Status)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		return fmt.Errorf("%s has checksum %s, expected %s", name, sum, expected)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	if err := replaceExecutable(tmp.Name(), executable, runtime.GOOS); err != nil {
+		return err
+	}
+
+	ui.Println("Updated", executable, "to", latest.TagName)
+	return nil
+}
+
+func init() {
+	selfUpdateCmd.Flags().BoolVar(&UpdateCheck, "check", false, "only check whether there is a newer release")
+	selfUpdateCmd.Flags().StringVar(&UpdateReleaseKey, "release-key", "", "check the release against this ed25519 public key instead of the one built in")
+	rootCmd.AddCommand(selfUpdateCmd)
+	rootCmd.Version = Version
+}
@@ -0,0 +1,149 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChecksums(t *testing.T) {
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	data := []byte(sum + "  s3-glacier-uploader_v1.2.3_linux_amd64\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 *s3-glacier-uploader_v1.2.3_windows_amd64.exe\n" +
+		"abc  s3-glacier-uploader_v1.2.3_linux_arm64\n")
+
+	got, err := parseChecksums(data, "s3-glacier-uploader_v1.2.3_linux_amd64")
+	if err != nil || got != sum {
+		t.Errorf("got %s, %v", got, err)
+	}
+
+	if _, err := parseChecksums(data, "s3-glacier-uploader_v1.2.3_windows_amd64.exe"); err != nil {
+		t.Errorf("binary mode entry: %v", err)
+	}
+	if _, err := parseChecksums(data, "s3-glacier-uploader_v1.2.3_linux_arm64"); err == nil {
+		t.Error("accepted a malformed checksum")
+	}
+	if _, err := parseChecksums(data, "s3-glacier-uploader_v1.2.3_darwin_arm64"); err == nil {
+		t.Error("found a checksum which isn't there")
+	}
+	if _, err := parseChecksums(data, "s3-glacier-uploader_v1.3.0_linux_amd64"); err == nil {
+		t.Error("took the checksums of v1.2.3 for v1.3.0")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.10.0", -1},
+		{"v2.0", "v1.9.9", 1},
+		{"v1.2", "v1.2.0", 0},
+		{"1.3.0", "v1.2.9", 1},
+	} {
+		a, err := parseVersion(c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseVersion(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := compareVersions(a, b); got != c.want {
+			t.Errorf("%s against %s: got %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+
+	for _, tag := range []string{"dev", "v1.2.3-4-gabcdef", "v1..2", ""} {
+		if _, err := parseVersion(tag); err == nil {
+			t.Errorf("parsed %q", tag)
+		}
+	}
+}
+
+func TestParseBuildVersion(t *testing.T) {
+	for _, c := range []struct {
+		version string
+		want    []int
+		after   bool
+	}{
+		{"v1.2.3", []int{1, 2, 3}, false},
+		{"v1.2.3-dirty", []int{1, 2, 3}, false},
+		{"v1.2.3-4-gabcdef", []int{1, 2, 3}, true},
+		{"v1.2.3-4-gabcdef-dirty", []int{1, 2, 3}, true},
+	} {
+		got, after, err := parseBuildVersion(c.version)
+		if err != nil || compareVersions(got, c.want) != 0 || after != c.after {
+			t.Errorf("%s: got %v, %v, %v", c.version, got, after, err)
+		}
+	}
+
+	// git describe --always falls back to the commit without a tag.
+	for _, version := range []string{"dev", "abcdef1", "abcdef1-dirty", "v1.2.3-x-gabcdef"} {
+		if _, _, err := parseBuildVersion(version); err == nil {
+			t.Errorf("parsed %q", version)
+		}
+	}
+}
+
+func TestReleaseKey(t *testing.T) {
+	defer func(key string) { ReleasePublicKey = key }(ReleasePublicKey)
+
+	ReleasePublicKey = ""
+	if _, err := releaseKey(""); err == nil {
+		t.Error("updated without a release key")
+	}
+
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReleasePublicKey = base64.StdEncoding.EncodeToString(public)
+	got, err := releaseKey("")
+	if err != nil || !got.Equal(public) {
+		t.Errorf("got %x, %v", got, err)
+	}
+
+	ReleasePublicKey = base64.StdEncoding.EncodeToString(public[:16])
+	if _, err := releaseKey(""); err == nil {
+		t.Error("accepted a short release key")
+	}
+}
+
+func TestReplaceExecutableWindows(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "s3-glacier-uploader.exe")
+	updated := filepath.Join(dir, "update")
+	os.WriteFile(executable, []byte("old"), 0755)
+	os.WriteFile(executable+".old", []byte("older"), 0755)
+	os.WriteFile(updated, []byte("new"), 0755)
+
+	if err := replaceExecutable(updated, executable, "windows"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(executable); string(data) != "new" {
+		t.Errorf("executable is %q", data)
+	}
+	if data, _ := os.ReadFile(executable + ".old"); string(data) != "old" {
+		t.Errorf("the old executable is %q", data)
+	}
+}
@@ -0,0 +1,930 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/pkg/uploader"
+	"github.com/spf13/cobra"
+)
+
+// serve flags
+var ServeListen string
+var ServeGRPCListen string
+var ServeParallelJobs int
+var ServeJobsFile string
+var ServeRefresh time.Duration
+
+// The API token can't be given on the command line, where every user of the
+// machine could read it.
+const SERVE_TOKEN_ENV = "S3_GLACIER_SERVE_TOKEN"
+
+const JOB_QUEUED = "queued"
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run as a daemon which takes upload jobs over HTTP and reports their progress",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Serve(newS3SessionWithProfile, BucketName, ServeListen, os.Getenv(SERVE_TOKEN_ENV), ServeJobsFile)
+	},
+}
+
+// serveJob is an upload the daemon was given, of a file or of the files of a
+// directory.  State goes from queued through the progress socket's states to
+// done or failed.
+type serveJob struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	File       string `json:"file"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Priority   int    `json:"priority"`
+	State      string `json:"state"`
+	UploadID   string `json:"upload_id,omitempty"`
+	PartsDone  int64  `json:"parts_done"`
+	PartsTotal int64  `json:"parts_total"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total"`
+	FilesDone  int    `json:"files_done"`
+	FilesTotal int    `json:"files_total"`
+	// FilesShared are those another job was uploading already, which this
+	// one waited for instead of uploading them again.
+	FilesShared int `json:"files_shared,omitempty"`
+	// The job's limits: parts of a file in flight, files in flight and
+	// the bandwidth it may take of what --bandwidth allows.
+	Concurrency int        `json:"concurrency"`
+	Files       int        `json:"files"`
+	Bandwidth   string     `json:"bandwidth,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Submitted   time.Time  `json:"submitted"`
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+
+	// preempt asks the job to pause at its next part boundary, and resume
+	// is closed to carry on.
+	preempt bool
+	resume  chan struct{}
+	limiter *bandwidthLimiter
+	tenant  *serveTenant
+	// waiters counts the jobs waiting for one of this job's uploads.
+	waiters int
+}
+
+func (j *serveJob) finished() bool {
+	return j.State == PROGRESS_DONE || j.State == PROGRESS_FAILED
+}
+
+// jobRequest is what's posted to /jobs, or configured in the jobs file.
+// Without a key, a file is named like on the command line, with
+// --key-command and --prefix.  For a directory, the key is the prefix the
+// files go under, like sync's.  Jobs with a higher priority go first.  A
+// tenant's jobs go to its bucket, with its credentials.
+type jobRequest struct {
+	Name        string `json:"name"`
+	Tenant      string `json:"tenant"`
+	File        string `json:"file"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Priority    int    `json:"priority"`
+	Concurrency int    `json:"concurrency"`
+	Files       int    `json:"files"`
+	Bandwidth   string `json:"bandwidth"`
+}
+
+// serveTenant is a customer of the daemon, e.g. of a service provider
+// backing up several from one machine.  Its jobs upload files under its Root,
+// run with the credentials of its AWS profile, in its region, and share its
+// budget: Jobs of them at a time and its bandwidth.
+type serveTenant struct {
+	Name      string
+	Root      string
+	Profile   string
+	Region    string
+	Bucket    string
+	Jobs      int
+	Bandwidth string
+
+	limiter *bandwidthLimiter
+	running int
+}
+
+// full tells whether the tenant runs as many jobs as it may.  A job without
+// a tenant has only the daemon's limit.
+func (t *serveTenant) full() bool {
+	return t != nil && t.Jobs > 0 && t.running >= t.Jobs
+}
+
+// resolve follows the symlinks of a file a job of the tenant names, which
+// has to end up under its root: a tenant can't upload anyone else's files.
+func (t *serveTenant) resolve(file string) (string, error) {
+	root, err := filepath.EvalSymlinks(t.Root)
+	if err != nil {
+		return "", fmt.Errorf("The root of %s: %w", t.Name, err)
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't under %s, the root of %s", file, t.Root, t.Name)
+	}
+	return resolved, nil
+}
+
+// daemon runs the jobs it's given, ServeParallelJobs at a time, the most
+// urgent first.  A job which is more urgent than one running pauses that one
+// until there's room for it again.
+type daemon struct {
+	// session makes a session with the credentials of the profile, keeping
+	// within the limiters as well as --bandwidth.
+	session func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API
+	bucket  string
+	token   string
+	// loopback is set when the daemon only listens on the machine itself,
+	// where a request for any other host is DNS rebinding.
+	loopback bool
+
+	mu      sync.Mutex
+	jobs    []*serveJob
+	running int
+	tenants map[string]*serveTenant
+	// inflight are the uploads going on, by bucket, key and the digest of
+	// the file, so that a job given the same file again waits for them.
+	inflight map[string]*inflightUpload
+
+	// For the web UI's graph.
+	throughput   []throughputSample
+	sampledBytes int64
+	// configured are the jobs of the jobs file, and lastRun when each of
+	// them was last submitted.
+	configured []configuredJob
+	lastRun    map[string]time.Time
+	// incomplete is what the bucket's unfinished uploads held when last
+	// checked.
+	incomplete incompleteUploads
+	// changed is closed and replaced whenever a job changes, which wakes
+	// up everyone following the progress.
+	changed chan struct{}
+}
+
+func newDaemon(session func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API, bucket string, token string) *daemon {
+	return &daemon{
+		session:  session,
+		bucket:   bucket,
+		token:    token,
+		lastRun:  map[string]time.Time{},
+		inflight: map[string]*inflightUpload{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// inflightUpload is a file a job is uploading.  done is closed once it's
+// finished, with err saying how.
+type inflightUpload struct {
+	job  *serveJob
+	done chan struct{}
+	err  error
+}
+
+// Serve takes jobs on listen, and with gRPC on --grpc-listen, until it's
+// killed, and runs those of the jobs file, if there is one.  Jobs which haven't finished by then leave their
+// uploads behind, to be resumed like any other.
+func Serve(session func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API, bucket string, listen string, token string, jobsFile string) error {
+	if ServeParallelJobs < 1 {
+		return fmt.Errorf("--parallel-jobs must be at least 1")
+	}
+	// Even on localhost, a web page could have the browser send jobs.
+	if token == "" {
+		return fmt.Errorf("Anyone who can reach %s could upload any file of this machine, set $%s to require a token", listen, SERVE_TOKEN_ENV)
+	}
+
+	d := newDaemon(session, bucket, token)
+	d.loopback = isLoopback(listen)
+	if jobsFile != "" {
+		fetch := session(Region, AWSProfile)
+		if err := d.reload(fetch, jobsFile); err != nil {
+			return err
+		}
+		go d.runConfigured()
+		go d.refresh(fetch, jobsFile, ServeRefresh)
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on --listen %s: %w", listen, err)
+	}
+	go d.sampleThroughput()
+	if alert, _ := parseSize(IncompleteAlert); alert > 0 && bucket != "" {
+		go d.watchIncomplete(session(Region, AWSProfile))
+	}
+	ui.Println("Taking jobs on", listener.Addr())
+
+	failed := make(chan error, 2)
+	if ServeGRPCListen != "" {
+		grpcListener, err := net.Listen("tcp", ServeGRPCListen)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("Failed to listen on --grpc-listen %s: %w", ServeGRPCListen, err)
+		}
+		ui.Println("Taking gRPC calls on", grpcListener.Addr())
+		go func() { failed <- d.grpcServer().Serve(grpcListener) }()
+	}
+	go func() { failed <- http.Serve(listener, d.handler()) }()
+	return <-failed
+}
+
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// notify wakes up whoever waits for a change.  It's called with d.mu held.
+func (d *daemon) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *daemon) update(job *serveJob, change func(job *serveJob)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	change(job)
+	d.notify()
+}
+
+// newJob checks a request and makes a job of it.  Limits it doesn't set are
+// those of the daemon: --concurrency parts and one file at a time.
+func (d *daemon) newJob(req jobRequest) (*serveJob, error) {
+	if req.File == "" {
+		return nil, fmt.Errorf("A job needs a file")
+	}
+	var tenant *serveTenant
+	if req.Tenant != "" {
+		d.mu.Lock()
+		tenant = d.tenants[req.Tenant]
+		d.mu.Unlock()
+		if tenant == nil {
+			return nil, fmt.Errorf("There's no tenant %s", req.Tenant)
+		}
+		file, err := tenant.resolve(req.File)
+		if err != nil {
+			return nil, err
+		}
+		req.File = file
+	}
+	info, err := os.Stat(req.File)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil, fmt.Errorf("%s isn't a regular file or a directory", req.File)
+	}
+
+	job := &serveJob{
+		Name:        req.Name,
+		File:        req.File,
+		Bucket:      req.Bucket,
+		Key:         req.Key,
+		Priority:    req.Priority,
+		State:       JOB_QUEUED,
+		Concurrency: req.Concurrency,
+		Files:       req.Files,
+		Bandwidth:   req.Bandwidth,
+		Submitted:   time.Now(),
+	}
+	if tenant != nil {
+		job.tenant = tenant
+		job.Tenant = req.Tenant
+		if job.tenant.Bucket != "" {
+			if job.Bucket != "" && job.Bucket != job.tenant.Bucket {
+				return nil, fmt.Errorf("Jobs of %s go to its bucket %s", req.Tenant, job.tenant.Bucket)
+			}
+			job.Bucket = job.tenant.Bucket
+		}
+	}
+	if job.Bucket == "" {
+		job.Bucket = d.bucket
+	}
+	if job.Bucket == "" {
+		return nil, fmt.Errorf("A job needs a bucket, the daemon wasn't given one with --bucket")
+	}
+	if job.Key == "" && !info.IsDir() {
+		if job.Key, err = uploadKey(req.File); err != nil {
+			return nil, err
+		}
+	}
+
+	if job.Concurrency == 0 {
+		job.Concurrency = Concurrency
+	}
+	if job.Files == 0 {
+		job.Files = 1
+	}
+	if job.Concurrency < 1 || job.Files < 1 {
+		return nil, fmt.Errorf("A job needs at least one part and one file at a time")
+	}
+	if job.Bandwidth != "" {
+		if job.limiter, err = parseBandwidth(job.Bandwidth, "bandwidth"); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+func (d *daemon) submit(req jobRequest) (*serveJob, error) {
+	job, err := d.newJob(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.ID = strconv.Itoa(len(d.jobs) + 1)
+	d.jobs = append(d.jobs, job)
+	d.schedule()
+	return job, nil
+}
+
+// schedule starts or resumes jobs while there's room, and when there isn't,
+// asks a less urgent job to make some.  It's called with d.mu held, whenever
+// a job is added, pauses or finishes.
+func (d *daemon) schedule() {
+	for {
+		next := d.waiting()
+		if next == nil {
+			break
+		}
+		if d.running >= ServeParallelJobs {
+			d.preempt(next.Priority)
+			break
+		}
+
+		d.occupy(next, 1)
+		if next.State == PROGRESS_PAUSED {
+			d.resume(next)
+			continue
+		}
+		now := time.Now()
+		next.State = PROGRESS_STARTING
+		next.Started = &now
+		go d.run(next)
+	}
+	d.notify()
+}
+
+// resume carries on with a paused job, which has to be counted as running.
+func (d *daemon) resume(job *serveJob) {
+	job.State = PROGRESS_UPLOADING
+	close(job.resume)
+	job.resume = nil
+}
+
+// occupy counts a job as running, or with -1 as not any more, for the
+// daemon's limit and its tenant's.
+func (d *daemon) occupy(job *serveJob, n int) {
+	d.running += n
+	if job.tenant != nil {
+		job.tenant.running += n
+	}
+}
+
+// waiting is the most urgent job which is queued or paused, and whose tenant
+// has room for it.  Of equally urgent ones, the one submitted first goes
+// first, so a paused job is resumed before one of the same priority is
+// started.
+func (d *daemon) waiting() *serveJob {
+	var next *serveJob
+	for _, job := range d.jobs {
+		if job.State != JOB_QUEUED && job.resume == nil {
+			continue
+		}
+		if job.tenant.full() {
+			continue
+		}
+		if next == nil || job.Priority > next.Priority {
+			next = job
+		}
+	}
+	return next
+}
+
+// preempt asks the least urgent running job which is less urgent than
+// priority to pause, unless one has been asked already.
+func (d *daemon) preempt(priority int) {
+	var victim *serveJob
+	for _, job := range d.jobs {
+		if job.State != PROGRESS_STARTING && job.State != PROGRESS_UPLOADING {
+			continue
+		}
+		if job.preempt {
+			return
+		}
+		// Pausing a job others wait for would hold them up too.
+		if job.waiters > 0 {
+			continue
+		}
+		if job.Priority < priority && (victim == nil || job.Priority < victim.Priority) {
+			victim = job
+		}
+	}
+	if victim != nil {
+		victim.preempt = true
+	}
+}
+
+// checkpoint is where a job pauses if it's been asked to, between two
+// parts.  The parts it has in flight are finished, and the uploads are
+// carried on from the next ones once it's resumed.  Every file of a job
+// which is paused waits here.
+func (d *daemon) checkpoint(job *serveJob) {
+	d.mu.Lock()
+	if job.preempt {
+		job.preempt = false
+		job.State = PROGRESS_PAUSED
+		job.resume = make(chan struct{})
+		d.occupy(job, -1)
+		d.schedule()
+	}
+	resume := job.resume
+	d.mu.Unlock()
+
+	if resume != nil {
+		<-resume
+	}
+}
+
+// preemptibleReader reads a job's file, stopping at the start of every part
+// to let the job pause there.
+type preemptibleReader struct {
+	r        io.Reader
+	d        *daemon
+	job      *serveJob
+	partSize int64
+	offset   int64
+}
+
+func (p *preemptibleReader) Read(b []byte) (int, error) {
+	rest := p.partSize - p.offset%p.partSize
+	if rest == p.partSize {
+		p.d.checkpoint(p.job)
+	}
+	// Reads never cross a part boundary, so that there's always one
+	// starting on it.
+	if int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := p.r.Read(b)
+	p.offset += int64(n)
+	return n, err
+}
+
+func (d *daemon) run(job *serveJob) {
+	err := d.upload(job)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.occupy(job, -1)
+	job.Finished = &now
+	if err != nil {
+		job.State = PROGRESS_FAILED
+		job.Error = err.Error()
+		ui.Warnf("Job %s, %s to %s, failed: %v\n", job.ID, job.File, job.Key, err)
+	} else {
+		job.State = PROGRESS_DONE
+	}
+	d.schedule()
+}
+
+// jobFiles lists what a job uploads: its file, or the files of its directory
+// which aren't in the bucket yet or have changed since, like sync does.
+func jobFiles(s3session s3iface.S3API, job *serveJob) ([]localFile, error) {
+	info, err := os.Stat(job.File)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []localFile{{job.File, job.Key, info.Size(), info.ModTime()}}, nil
+	}
+
+	files, err := scanDirectory(longPath(job.File), job.Key)
+	if err != nil {
+		return nil, err
+	}
+	listPrefix := job.Key
+	if KeyCommand != "" {
+		listPrefix = ""
+	}
+	all, err := listRemote(s3session, job.Bucket, listPrefix)
+	if err != nil {
+		return nil, err
+	}
+	remote := map[string]archivedObject{}
+	for key, obj := range all {
+		if !isSidecar(key) {
+			remote[key] = obj
+		}
+	}
+	return syncPlan(files, remote, syncComparison(s3session, job.Bucket, SYNC_COMPARE_MTIME, nil))
+}
+
+// upload sends the job's files, job.Files at a time, through a session of
+// its own which keeps to the job's bandwidth and its tenant's.
+func (d *daemon) upload(job *serveJob) error {
+	region, profile := Region, AWSProfile
+	var limiters []*bandwidthLimiter
+	d.mu.Lock()
+	if tenant := job.tenant; tenant != nil {
+		if tenant.Profile != "" {
+			profile = tenant.Profile
+		}
+		if tenant.Region != "" {
+			region = tenant.Region
+		}
+		limiters = append(limiters, tenant.limiter)
+	}
+	d.mu.Unlock()
+	s3session := d.session(region, profile, append(limiters, job.limiter)...)
+	files, err := jobFiles(s3session, job)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	d.update(job, func(job *serveJob) {
+		job.FilesTotal = len(files)
+		job.BytesTotal = size
+	})
+
+	places := make(chan struct{}, job.Files)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for _, file := range files {
+		places <- struct{}{}
+		wg.Add(1)
+		go func(file localFile) {
+			defer wg.Done()
+			defer func() { <-places }()
+
+			if err := d.uploadFile(s3session, job, file); err != nil {
+				errs <- fmt.Errorf("%s: %w", file.Path, err)
+				return
+			}
+			d.update(job, func(job *serveJob) { job.FilesDone++ })
+		}(file)
+	}
+	wg.Wait()
+	close(errs)
+
+	first, failed := <-errs, len(errs)+1
+	if first == nil {
+		return nil
+	}
+	if failed == 1 {
+		return first
+	}
+	return fmt.Errorf("%d of %d files failed, the first: %w", failed, len(files), first)
+}
+
+// uploadFile uploads a file of the job, unless another job is uploading the
+// same content to the same key already, e.g. because the runs of two
+// overlapping cron jobs were submitted.  Then it waits for that upload, and
+// succeeds or fails with it.
+func (d *daemon) uploadFile(s3session s3iface.S3API, job *serveJob, file localFile) (err error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(f)
+	if err != nil {
+		return err
+	}
+
+	id := job.Bucket + "/" + file.Key + "@" + sum
+	d.mu.Lock()
+	if other := d.inflight[id]; other != nil {
+		return d.share(job, other, file.Key, info.Size())
+	}
+	upload := &inflightUpload{job: job, done: make(chan struct{})}
+	d.inflight[id] = upload
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.inflight, id)
+		d.mu.Unlock()
+		upload.err = err
+		close(upload.done)
+	}()
+
+	metadata := sourceMetadata(nil, info)
+	metadata[SOURCE_METADATA_SHA256] = aws.String(sum)
+
+	partSize := uploader.AutoPartSize(info.Size())
+	u := newUploader(s3session,
+		uploader.WithPartSize(partSize),
+		uploader.WithConcurrency(job.Concurrency),
+		uploader.WithReadAhead(ReadAhead),
+		uploader.WithStorageClass(aws.StringValue(uploadStorageClass())),
+		uploader.WithMetadata(aws.StringValueMap(metadata)),
+		uploader.WithTagging(aws.StringValue(objectTagging(file.Key))),
+		uploader.WithProgress(&jobProgress{d, job}))
+	source := &preemptibleReader{r: f, d: d, job: job, partSize: partSize}
+	_, err = u.Upload(context.Background(), job.Bucket, file.Key, source, info.Size())
+
+	var failed *uploader.Error
+	if errors.As(err, &failed) {
+		return fmt.Errorf("%w, resume it with --upload-id %s", err, failed.UploadID)
+	}
+	return err
+}
+
+// share waits for another job's upload of the same file, called with d.mu
+// held.  The other job may have been paused to make room for this one, or
+// one more urgent; it's resumed, even if that's one more job than
+// --parallel-jobs, as this one can't get on without it.
+func (d *daemon) share(job *serveJob, other *inflightUpload, key string, size int64) error {
+	other.job.waiters++
+	if other.job.State == PROGRESS_PAUSED {
+		d.occupy(other.job, 1)
+		d.resume(other.job)
+		d.notify()
+	}
+	d.mu.Unlock()
+	ui.Printf("Job %s: job %s is uploading the same file to %s already, waiting for it\n", job.ID, other.job.ID, key)
+	<-other.done
+
+	d.mu.Lock()
+	other.job.waiters--
+	d.mu.Unlock()
+	if other.err != nil {
+		return fmt.Errorf("Job %s uploading it failed: %w", other.job.ID, other.err)
+	}
+	d.update(job, func(job *serveJob) {
+		job.FilesShared++
+		job.BytesDone += size
+	})
+	return nil
+}
+
+// jobProgress keeps a job's counts up to date as its upload goes.
+type jobProgress struct {
+	d   *daemon
+	job *serveJob
+}
+
+// Started counts the parts of every file of the job.  The upload ID is only
+// shown for jobs of a single file.
+func (p *jobProgress) Started(uploadID string, parts int, size int64) {
+	p.d.update(p.job, func(job *serveJob) {
+		if job.State == PROGRESS_STARTING {
+			job.State = PROGRESS_UPLOADING
+		}
+		if job.FilesTotal == 1 {
+			job.UploadID = uploadID
+		}
+		job.PartsTotal += int64(parts)
+	})
+}
+
+func (p *jobProgress) PartDone(part int, size int64, resumed bool) {
+	p.d.update(p.job, func(job *serveJob) {
+		job.PartsDone++
+		job.BytesDone += size
+	})
+}
+
+// snapshot copies a job, so that it can be encoded without holding d.mu.
+func (d *daemon) snapshot(id string) (serveJob, <-chan struct{}, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, job := range d.jobs {
+		if job.ID == id {
+			return *job, d.changed, true
+		}
+	}
+	return serveJob{}, nil, false
+}
+
+func (d *daemon) list() []serveJob {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]serveJob, len(d.jobs))
+	for i, job := range d.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// handler is the daemon's REST API, and its web UI at /:
+//
+//	POST /jobs                 submit a job, a jobRequest
+//	GET  /jobs                 all jobs
+//	GET  /jobs/{id}            one job
+//	GET  /jobs/{id}/progress   the job, then again every time it changes, one
+//	                           JSON object per line, until it's finished
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", d.handleJobs)
+	mux.HandleFunc("/jobs/", d.handleJob)
+	mux.HandleFunc("/", d.handleUI)
+	return d.authorize(mux)
+}
+
+func (d *daemon) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := d.checkOrigin(r); err != nil {
+			writeAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		if d.token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			// Browsers ask for a password, which can be the token.
+			if _, password, ok := r.BasicAuth(); ok {
+				given = password
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(d.token)) != 1 {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+				w.Header().Add("WWW-Authenticate", `Basic realm="s3-glacier-uploader"`)
+				writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("A valid token is needed"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin turns away what a web page of another site has a browser send:
+// requests from another origin, and those for another host, which is what
+// DNS rebinding sends to a daemon on localhost.
+func (d *daemon) checkOrigin(r *http.Request) error {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if d.loopback && !isLoopbackHost(host) {
+		return fmt.Errorf("The daemon only takes requests for localhost, not %s", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("Requests from %s aren't taken", origin)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (d *daemon) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, d.list())
+	case http.MethodPost:
+		// Forms can't send JSON, so a page can't post a job without asking.
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeAPIError(w, http.StatusUnsupportedMediaType, fmt.Errorf("Jobs are sent as application/json"))
+			return
+		}
+		var req jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("Invalid job: %w", err))
+			return
+		}
+		job, err := d.submit(req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't supported", r.Method))
+	}
+}
+
+func (d *daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't supported", r.Method))
+		return
+	}
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	job, _, ok := d.snapshot(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("There's no job %s", id))
+		return
+	}
+
+	switch rest {
+	case "":
+		writeJSON(w, http.StatusOK, job)
+	case "progress":
+		d.streamProgress(w, r, id)
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("There's no %s", r.URL.Path))
+	}
+}
+
+// streamProgress sends the job every time it changes until it's finished,
+// or the client goes away.
+func (d *daemon) streamProgress(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		job, changed, _ := d.snapshot(id)
+		if err := encoder.Encode(&job); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if job.finished() {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&ServeListen, "listen", "127.0.0.1:8642", "address to take jobs on")
+	serveCmd.Flags().StringVar(&ServeGRPCListen, "grpc-listen", "", "address to take jobs on with gRPC as well, e.g. 127.0.0.1:8643")
+	serveCmd.Flags().IntVar(&ServeParallelJobs, "parallel-jobs", 1, "number of jobs to run at once")
+	serveCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts of a job to upload in parallel, unless the job says otherwise")
+	serveCmd.Flags().StringVar(&ServeJobsFile, "jobs", "", "run the jobs configured in this file, or in S3 with s3://bucket/key")
+	serveCmd.Flags().DurationVar(&ServeRefresh, "refresh", 5*time.Minute, "how often to read the jobs file again")
+	rootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,297 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// serveTest runs a daemon in front of s3session.
+func serveTest(t *testing.T, s3session s3iface.S3API, token string) *httptest.Server {
+	session := func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API { return s3session }
+	server := httptest.NewServer(newDaemon(session, "bucket", token).handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func submitJob(t *testing.T, server *httptest.Server, req jobRequest) (*http.Response, serveJob) {
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(server.URL+"/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var job serveJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	return resp, job
+}
+
+// followJob reads the progress of a job until the daemon says it's done.
+func followJob(t *testing.T, server *httptest.Server, id string) []serveJob {
+	resp, err := http.Get(server.URL + "/jobs/" + id + "/progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var updates []serveJob
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		var job serveJob
+		if err := json.Unmarshal(lines.Bytes(), &job); err != nil {
+			t.Fatalf("%q: %v", lines.Text(), err)
+		}
+		updates = append(updates, job)
+	}
+	return updates
+}
+
+func TestServeJob(t *testing.T) {
+	fake := newFakeS3()
+	server := serveTest(t, fake, "")
+
+	data := randomData(PART_SIZE + 1024)
+	resp, job := submitJob(t, server, jobRequest{File: writeTestFile(t, data)})
+	if resp.StatusCode != http.StatusCreated || job.ID == "" || job.Key != "archive.bin" {
+		t.Fatalf("%s, job %+v", resp.Status, job)
+	}
+
+	updates := followJob(t, server, job.ID)
+	last := updates[len(updates)-1]
+	if last.State != PROGRESS_DONE || last.BytesDone != int64(len(data)) || last.PartsDone != last.PartsTotal {
+		t.Errorf("the job ended as %+v", last)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the object doesn't contain the file")
+	}
+
+	var jobs []serveJob
+	resp, err := http.Get(server.URL + "/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil || len(jobs) != 1 || jobs[0].State != PROGRESS_DONE {
+		t.Errorf("listed %+v, %v", jobs, err)
+	}
+}
+
+func TestServeRefusesJobs(t *testing.T) {
+	server := serveTest(t, newFakeS3(), "")
+	filename := writeTestFile(t, randomData(1024))
+
+	for name, req := range map[string]jobRequest{
+		"no file":         {},
+		"missing file":    {File: "/nonexistent/archive.bin"},
+		"no files":        {File: filename, Files: -1},
+		"tiny bandwidth":  {File: filename, Bandwidth: "1K"},
+		"wrong bandwidth": {File: filename, Bandwidth: "fast"},
+	} {
+		if resp, _ := submitJob(t, server, req); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %s", name, resp.Status)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/jobs/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("an unknown job got %s", resp.Status)
+	}
+}
+
+func TestServeToken(t *testing.T) {
+	server := serveTest(t, newFakeS3(), "secret")
+
+	for token, want := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/jobs", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: got %s", token, resp.Status)
+		}
+	}
+
+	// There's no serving without a token, not even on localhost.
+	for _, listen := range []string{"0.0.0.0:0", "127.0.0.1:0"} {
+		if err := Serve(nil, "bucket", listen, "", ""); err == nil || !strings.Contains(err.Error(), SERVE_TOKEN_ENV) {
+			t.Errorf("served on %s without a token: %v", listen, err)
+		}
+	}
+}
+
+func TestServeRefusesOtherSites(t *testing.T) {
+	d := newDaemon(func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API { return newFakeS3() }, "bucket", "")
+	d.loopback = true
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+	body := `{"file": "` + writeTestFile(t, randomData(1024)) + `"}`
+
+	for name, c := range map[string]struct {
+		contentType, origin, host string
+		want                      int
+	}{
+		"a form":           {"text/plain", "", "", http.StatusUnsupportedMediaType},
+		"another site":     {"application/json", "https://example.com", "", http.StatusForbidden},
+		"DNS rebinding":    {"application/json", "", "example.com:8642", http.StatusForbidden},
+		"the daemon's own": {"application/json; charset=utf-8", server.URL, "", http.StatusCreated},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/jobs", strings.NewReader(body))
+		req.Header.Set("Content-Type", c.contentType)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.host != "" {
+			req.Host = c.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: got %s", name, resp.Status)
+		}
+	}
+}
+
+// orderedS3 records the order parts arrive in, and holds up the first part
+// of the key hold until release is closed.
+type orderedS3 struct {
+	*fakeS3
+	hold    string
+	held    chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	order []string
+}
+
+func (f *orderedS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if *in.Key == f.hold && *in.PartNumber == 1 {
+		close(f.held)
+		<-f.release
+	}
+	f.mu.Lock()
+	f.order = append(f.order, fmt.Sprintf("%s/%d", *in.Key, *in.PartNumber))
+	f.mu.Unlock()
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+func TestServePreempts(t *testing.T) {
+	defer func(concurrency, readAhead int) { Concurrency, ReadAhead = concurrency, readAhead }(Concurrency, ReadAhead)
+	// A part read ahead is sent before the job pauses.
+	Concurrency, ReadAhead = 1, 0
+
+	fake := &orderedS3{fakeS3: newFakeS3(), hold: "bulk", held: make(chan struct{}), release: make(chan struct{})}
+	server := serveTest(t, fake, "")
+
+	_, bulk := submitJob(t, server, jobRequest{File: writeTestFile(t, randomData(3*PART_SIZE)), Key: "bulk"})
+	<-fake.held
+	_, urgent := submitJob(t, server, jobRequest{File: writeTestFile(t, randomData(1024)), Key: "urgent", Priority: 10})
+	close(fake.release)
+
+	// The bulk job pauses once its first part is done, and carries on
+	// after the urgent one.
+	if last := followJob(t, server, urgent.ID); last[len(last)-1].State != PROGRESS_DONE {
+		t.Fatalf("the urgent job ended as %+v", last[len(last)-1])
+	}
+	updates := followJob(t, server, bulk.ID)
+	if last := updates[len(updates)-1]; last.State != PROGRESS_DONE || last.PartsDone != 3 {
+		t.Fatalf("the bulk job ended as %+v", last)
+	}
+
+	want := []string{"bulk/1", "urgent/1", "bulk/2", "bulk/3"}
+	if !reflect.DeepEqual(fake.order, want) {
+		t.Errorf("parts went in the order %v, want %v", fake.order, want)
+	}
+}
+
+func TestServeSharesUploads(t *testing.T) {
+	defer func(concurrency, readAhead int) { Concurrency, ReadAhead = concurrency, readAhead }(Concurrency, ReadAhead)
+	Concurrency, ReadAhead = 1, 0
+
+	fake := &orderedS3{fakeS3: newFakeS3(), hold: "shared", held: make(chan struct{}), release: make(chan struct{})}
+	server := serveTest(t, fake, "")
+
+	// The more urgent job pauses the first, which it then has to resume
+	// to get the file it waits for.
+	filename := writeTestFile(t, randomData(2*PART_SIZE))
+	_, first := submitJob(t, server, jobRequest{File: filename, Key: "shared"})
+	<-fake.held
+	_, second := submitJob(t, server, jobRequest{File: filename, Key: "shared", Priority: 10})
+	close(fake.release)
+
+	updates := followJob(t, server, second.ID)
+	if last := updates[len(updates)-1]; last.State != PROGRESS_DONE || last.FilesShared != 1 || last.PartsTotal != 0 {
+		t.Fatalf("the second job ended as %+v", last)
+	}
+	updates = followJob(t, server, first.ID)
+	if last := updates[len(updates)-1]; last.State != PROGRESS_DONE || last.PartsDone != 2 {
+		t.Fatalf("the first job ended as %+v", last)
+	}
+	if want := []string{"shared/1", "shared/2"}; !reflect.DeepEqual(fake.order, want) {
+		t.Errorf("parts went in the order %v, want %v", fake.order, want)
+	}
+}
+
+func TestServeWaiting(t *testing.T) {
+	d := newDaemon(nil, "bucket", "")
+	d.jobs = []*serveJob{
+		{ID: "1", State: PROGRESS_DONE, Priority: 9},
+		{ID: "2", State: JOB_QUEUED},
+		{ID: "3", State: JOB_QUEUED, Priority: 5},
+		{ID: "4", State: PROGRESS_PAUSED, Priority: 5, resume: make(chan struct{})},
+	}
+	// The paused one was submitted later, but of the two most urgent jobs
+	// the one submitted first goes first.
+	if next := d.waiting(); next.ID != "3" {
+		t.Errorf("job %s goes next", next.ID)
+	}
+
+	// A tenant running as many jobs as it may waits.
+	d.jobs[2].tenant = &serveTenant{Name: "acme", Jobs: 1, running: 1}
+	if next := d.waiting(); next.ID != "4" {
+		t.Errorf("job %s goes next, its tenant is full", next.ID)
+	}
+}
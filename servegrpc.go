@@ -0,0 +1,171 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/honza/s3-glacier-uploader/internal/servepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// jobsServer is the daemon's gRPC API, see internal/servepb/serve.proto: the
+// jobs of the REST API, for an orchestrator which would rather have a schema
+// and a stream of progress.
+type jobsServer struct {
+	servepb.UnimplementedJobsServer
+	d *daemon
+}
+
+func (d *daemon) grpcServer() *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(d.authorizeUnary), grpc.StreamInterceptor(d.authorizeStream))
+	servepb.RegisterJobsServer(server, &jobsServer{d: d})
+	return server
+}
+
+// authorizeCall checks the token of a call, which is sent like the REST
+// API's, as "authorization: Bearer <token>" metadata.  Browsers can't make
+// gRPC calls, so there's no origin to check.
+func (d *daemon) authorizeCall(ctx context.Context) error {
+	if d.token == "" {
+		return nil
+	}
+	var given string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			given = strings.TrimPrefix(values[0], "Bearer ")
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(d.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "A valid token is needed")
+	}
+	return nil
+}
+
+func (d *daemon) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := d.authorizeCall(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (d *daemon) authorizeStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := d.authorizeCall(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (s *jobsServer) Submit(ctx context.Context, in *servepb.JobRequest) (*servepb.Job, error) {
+	job, err := s.d.submit(jobRequest{
+		Name:        in.Name,
+		Tenant:      in.Tenant,
+		File:        in.File,
+		Bucket:      in.Bucket,
+		Key:         in.Key,
+		Priority:    int(in.Priority),
+		Concurrency: int(in.Concurrency),
+		Files:       int(in.Files),
+		Bandwidth:   in.Bandwidth,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.Get(ctx, &servepb.GetRequest{Id: job.ID})
+}
+
+func (s *jobsServer) List(ctx context.Context, in *servepb.ListRequest) (*servepb.ListResponse, error) {
+	var resp servepb.ListResponse
+	for _, job := range s.d.list() {
+		resp.Jobs = append(resp.Jobs, jobMessage(job))
+	}
+	return &resp, nil
+}
+
+func (s *jobsServer) Get(ctx context.Context, in *servepb.GetRequest) (*servepb.Job, error) {
+	job, _, ok := s.d.snapshot(in.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "There's no job %s", in.Id)
+	}
+	return jobMessage(job), nil
+}
+
+// Progress sends the job every time it changes until it's finished, or the
+// client goes away, like GET /jobs/{id}/progress.
+func (s *jobsServer) Progress(in *servepb.GetRequest, stream servepb.Jobs_ProgressServer) error {
+	for {
+		job, changed, ok := s.d.snapshot(in.Id)
+		if !ok {
+			return status.Errorf(codes.NotFound, "There's no job %s", in.Id)
+		}
+		if err := stream.Send(jobMessage(job)); err != nil {
+			return err
+		}
+		if job.finished() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func jobMessage(job serveJob) *servepb.Job {
+	return &servepb.Job{
+		Id:          job.ID,
+		Name:        job.Name,
+		Tenant:      job.Tenant,
+		File:        job.File,
+		Bucket:      job.Bucket,
+		Key:         job.Key,
+		Priority:    int32(job.Priority),
+		State:       job.State,
+		UploadId:    job.UploadID,
+		PartsDone:   job.PartsDone,
+		PartsTotal:  job.PartsTotal,
+		BytesDone:   job.BytesDone,
+		BytesTotal:  job.BytesTotal,
+		FilesDone:   int32(job.FilesDone),
+		FilesTotal:  int32(job.FilesTotal),
+		FilesShared: int32(job.FilesShared),
+		Concurrency: int32(job.Concurrency),
+		Files:       int32(job.Files),
+		Bandwidth:   job.Bandwidth,
+		Error:       job.Error,
+		Submitted:   timestamppb.New(job.Submitted),
+		Started:     timestamp(job.Started),
+		Finished:    timestamp(job.Finished),
+	}
+}
+
+// timestamp leaves out a time which hasn't come yet.
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
@@ -0,0 +1,128 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/internal/servepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTest runs a daemon's gRPC API in front of s3session.
+func grpcTest(t *testing.T, s3session s3iface.S3API, token string) servepb.JobsClient {
+	session := func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API { return s3session }
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newDaemon(session, "bucket", token).grpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return servepb.NewJobsClient(conn)
+}
+
+func TestServeGRPCJob(t *testing.T) {
+	fake := newFakeS3()
+	client := grpcTest(t, fake, "")
+	ctx := context.Background()
+
+	data := randomData(PART_SIZE + 1024)
+	job, err := client.Submit(ctx, &servepb.JobRequest{File: writeTestFile(t, data)})
+	if err != nil || job.Id == "" || job.Key != "archive.bin" {
+		t.Fatalf("job %v, %v", job, err)
+	}
+
+	progress, err := client.Progress(ctx, &servepb.GetRequest{Id: job.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last *servepb.Job
+	for {
+		update, err := progress.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = update
+	}
+	if last == nil || last.State != PROGRESS_DONE || last.BytesDone != int64(len(data)) || last.PartsDone != last.PartsTotal || last.Finished == nil {
+		t.Errorf("the job ended as %v", last)
+	}
+	if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the object doesn't contain the file")
+	}
+
+	jobs, err := client.List(ctx, &servepb.ListRequest{})
+	if err != nil || len(jobs.Jobs) != 1 || jobs.Jobs[0].State != PROGRESS_DONE {
+		t.Errorf("listed %v, %v", jobs, err)
+	}
+
+	if _, err := client.Get(ctx, &servepb.GetRequest{Id: "42"}); status.Code(err) != codes.NotFound {
+		t.Errorf("an unknown job got %v", err)
+	}
+	if _, err := client.Submit(ctx, &servepb.JobRequest{File: "/nonexistent/archive.bin"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a missing file got %v", err)
+	}
+}
+
+func TestServeGRPCToken(t *testing.T) {
+	client := grpcTest(t, newFakeS3(), "secret")
+
+	for token, want := range map[string]codes.Code{
+		"":       codes.Unauthenticated,
+		"wrong":  codes.Unauthenticated,
+		"secret": codes.OK,
+	} {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		if _, err := client.List(ctx, &servepb.ListRequest{}); status.Code(err) != want {
+			t.Errorf("token %q: got %v", token, err)
+		}
+
+		progress, err := client.Progress(ctx, &servepb.GetRequest{Id: "1"})
+		if err == nil {
+			_, err = progress.Recv()
+		}
+		// With the token, there's just no such job.
+		if want == codes.OK {
+			want = codes.NotFound
+		}
+		if status.Code(err) != want {
+			t.Errorf("token %q, following a job: got %v", token, err)
+		}
+	}
+}
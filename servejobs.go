@@ -0,0 +1,316 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// How often the daemon looks for configured jobs which are due.
+var jobsCheckInterval = time.Minute
+
+// configuredJob is a job of the jobs file.  It's run when the daemon starts,
+// and again every Every if that isn't 0.
+type configuredJob struct {
+	jobRequest
+	Every time.Duration
+}
+
+// jobsConfig is what a jobs file configures: the tenants by name, and the
+// jobs.
+type jobsConfig struct {
+	Tenants map[string]*serveTenant
+	Jobs    []configuredJob
+}
+
+// parseJobs reads a jobs file: a section for every job, starting with its
+// name in brackets, and its settings like in the config file.  Sections
+// named tenant and a name configure tenants, which jobs can belong to:
+//
+//	[tenant acme]
+//	root = /srv/acme
+//	profile = acme
+//	bucket = acme-backups
+//	jobs = 2
+//	bandwidth = 10M
+//
+//	[photos]
+//	tenant = acme
+//	path = /srv/acme/photos
+//	key = photos/
+//	every = 24h
+//	files = 2
+//	bandwidth = 2M
+func parseJobs(r io.Reader, filename string) (jobsConfig, error) {
+	config := jobsConfig{Tenants: map[string]*serveTenant{}}
+	var jobs []configuredJob
+	var tenant *serveTenant
+	names := map[string]bool{}
+	lines := bufio.NewScanner(r)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", filename, n)
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if fields := strings.Fields(name); len(fields) == 2 && fields[0] == "tenant" {
+				if config.Tenants[fields[1]] != nil {
+					return jobsConfig{}, fmt.Errorf("%s: tenants need names of their own, got %q", where, line)
+				}
+				tenant = &serveTenant{Name: fields[1]}
+				config.Tenants[tenant.Name] = tenant
+				continue
+			}
+			if name == "" || names[name] {
+				return jobsConfig{}, fmt.Errorf("%s: jobs need names of their own, got %q", where, line)
+			}
+			names[name] = true
+			tenant = nil
+			jobs = append(jobs, configuredJob{jobRequest: jobRequest{Name: name}})
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return jobsConfig{}, fmt.Errorf("%s: settings look like name = value, got %q", where, line)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch {
+		case tenant != nil:
+			err = tenant.set(name, value)
+		case len(jobs) == 0:
+			err = fmt.Errorf("%s isn't in a job, start one with [name]", line)
+		default:
+			err = jobs[len(jobs)-1].set(name, value)
+		}
+		if err != nil {
+			return jobsConfig{}, fmt.Errorf("%s: %w", where, err)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return jobsConfig{}, err
+	}
+
+	for _, tenant := range config.Tenants {
+		if tenant.Root == "" {
+			return jobsConfig{}, fmt.Errorf("%s: tenant %s has no root, the directory its files are in", filename, tenant.Name)
+		}
+	}
+	for _, job := range jobs {
+		if job.File == "" {
+			return jobsConfig{}, fmt.Errorf("%s: job %s has no path", filename, job.Name)
+		}
+		if job.Tenant != "" && config.Tenants[job.Tenant] == nil {
+			return jobsConfig{}, fmt.Errorf("%s: job %s is of tenant %s, which isn't in the file", filename, job.Name, job.Tenant)
+		}
+	}
+	config.Jobs = jobs
+	return config, nil
+}
+
+func (t *serveTenant) set(name string, value string) error {
+	var err error
+	switch name {
+	case "root":
+		t.Root = value
+	case "profile":
+		t.Profile = value
+	case "region":
+		t.Region = value
+	case "bucket":
+		t.Bucket = value
+	case "jobs":
+		t.Jobs, err = strconv.Atoi(value)
+		if err == nil && t.Jobs < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "bandwidth":
+		t.Bandwidth = value
+		t.limiter, err = parseBandwidth(value, "bandwidth")
+		return err
+	default:
+		return fmt.Errorf("Tenants have no setting %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q: %w", name, value, err)
+	}
+	return nil
+}
+
+func (j *configuredJob) set(name string, value string) error {
+	var err error
+	switch name {
+	case "path":
+		j.File = value
+	case "tenant":
+		j.Tenant = value
+	case "bucket":
+		j.Bucket = value
+	case "key":
+		j.Key = value
+	case "priority":
+		j.Priority, err = strconv.Atoi(value)
+	case "concurrency":
+		j.Concurrency, err = strconv.Atoi(value)
+		if err == nil && j.Concurrency < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "files":
+		j.Files, err = strconv.Atoi(value)
+		if err == nil && j.Files < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "bandwidth":
+		j.Bandwidth = value
+		_, err = parseBandwidth(value, "bandwidth")
+		return err
+	case "every":
+		j.Every, err = time.ParseDuration(value)
+		if err == nil && j.Every <= 0 {
+			err = fmt.Errorf("must be more than 0")
+		}
+	default:
+		return fmt.Errorf("Jobs have no setting %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q: %w", name, value, err)
+	}
+	return nil
+}
+
+// readJobsFile reads the jobs file, which can be in S3.  There it has to be
+// signed like a config, see fetchRemoteConfig.
+func readJobsFile(s3session s3iface.S3API, filename string) (jobsConfig, error) {
+	if strings.HasPrefix(filename, "s3://") {
+		data, err := fetchRemoteConfig(s3session, filename)
+		if err != nil {
+			return jobsConfig{}, err
+		}
+		return parseJobs(bytes.NewReader(data), filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return jobsConfig{}, err
+	}
+	defer f.Close()
+	return parseJobs(f, filename)
+}
+
+// configure replaces the tenants and the configured jobs, and submits those
+// which are due.  A tenant which was configured before keeps counting the
+// jobs it runs.
+func (d *daemon) configure(config jobsConfig) {
+	d.mu.Lock()
+	tenants := map[string]*serveTenant{}
+	for name, tenant := range config.Tenants {
+		if old := d.tenants[name]; old != nil {
+			tenant.running = old.running
+			for _, job := range d.jobs {
+				if job.tenant == old {
+					job.tenant = tenant
+				}
+			}
+		}
+		tenants[name] = tenant
+	}
+	d.tenants = tenants
+	d.configured = config.Jobs
+	d.mu.Unlock()
+	d.submitDue()
+}
+
+// refresh reads the jobs file again every so often, so that a fleet of
+// daemons can be told what to back up by changing one file in S3.  The
+// signature is checked every time; a jobs file which can't be read or
+// doesn't check out leaves the daemon with the jobs it has.
+func (d *daemon) refresh(s3session s3iface.S3API, filename string, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	for range time.Tick(every) {
+		if err := d.reload(s3session, filename); err != nil {
+			ui.Warnf("Failed to read the jobs again, keeping the ones from before: %v\n", err)
+		}
+	}
+}
+
+func (d *daemon) reload(s3session s3iface.S3API, filename string) error {
+	config, err := readJobsFile(s3session, filename)
+	if err != nil {
+		return err
+	}
+	d.configure(config)
+	return nil
+}
+
+func (d *daemon) runConfigured() {
+	for range time.Tick(jobsCheckInterval) {
+		d.submitDue()
+	}
+}
+
+// submitDue submits the configured jobs which haven't run yet, or are due to
+// run again.  A job which is still queued or running from the last time
+// isn't submitted again.
+func (d *daemon) submitDue() {
+	d.mu.Lock()
+	now := time.Now()
+	var due []jobRequest
+	for _, job := range d.configured {
+		last, ran := d.lastRun[job.Name]
+		if ran && (job.Every == 0 || now.Sub(last) < job.Every) {
+			continue
+		}
+		if d.unfinished(job.Name) {
+			continue
+		}
+		d.lastRun[job.Name] = now
+		due = append(due, job.jobRequest)
+	}
+	d.mu.Unlock()
+
+	for _, req := range due {
+		if _, err := d.submit(req); err != nil {
+			ui.Warnf("Failed to start job %s: %v\n", req.Name, err)
+		}
+	}
+}
+
+// unfinished tells whether a job of that name is queued, running or paused.
+// It's called with d.mu held.
+func (d *daemon) unfinished(name string) bool {
+	for _, job := range d.jobs {
+		if job.Name == name && !job.finished() {
+			return true
+		}
+	}
+	return false
+}
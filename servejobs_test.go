@@ -0,0 +1,262 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestParseJobs(t *testing.T) {
+	config, err := parseJobs(strings.NewReader(`
+[tenant acme]
+root = /srv/acme
+profile = acme
+region = eu-west-1
+bucket = acme-backups
+jobs = 2
+bandwidth = 10M
+
+# Nightly
+[photos]
+tenant = acme
+path = /srv/acme/photos
+key = photos/
+every = 24h
+concurrency = 2
+files = 3
+bandwidth = 5M
+
+[dump]
+path = /srv/db.dump
+priority = 10
+`), "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := config.Tenants["acme"]
+	if len(config.Tenants) != 1 || acme == nil || acme.Root != "/srv/acme" || acme.Profile != "acme" || acme.Region != "eu-west-1" ||
+		acme.Bucket != "acme-backups" || acme.Jobs != 2 || acme.limiter == nil || acme.limiter.rate != 10*1024*1024 {
+		t.Errorf("tenants: %+v", config.Tenants)
+	}
+	jobs := config.Jobs
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs", len(jobs))
+	}
+	photos := jobs[0]
+	if photos.Name != "photos" || photos.Tenant != "acme" || photos.File != "/srv/acme/photos" || photos.Key != "photos/" || photos.Every != 24*time.Hour ||
+		photos.Concurrency != 2 || photos.Files != 3 || photos.Bandwidth != "5M" {
+		t.Errorf("photos: %+v", photos)
+	}
+	if dump := jobs[1]; dump.Name != "dump" || dump.Tenant != "" || dump.Priority != 10 || dump.Every != 0 {
+		t.Errorf("dump: %+v", dump)
+	}
+
+	for _, bad := range []string{
+		"path = /srv",
+		"[a]\npath = /srv\n[a]\npath = /srv",
+		"[a]\nkey = photos/",
+		"[a]\npath = /srv\ncolor = blue",
+		"[a]\npath = /srv\nfiles = 0",
+		"[a]\npath = /srv\nbandwidth = 1K",
+		"[a]\npath = /srv\nevery = daily",
+		"[a]\npath",
+		"[a]\npath = /srv\ntenant = acme",
+		"[tenant acme]\nroot = /srv/acme\ncolor = blue",
+		"[tenant acme]\nroot = /srv/acme\njobs = 0",
+		"[tenant acme]\nroot = /srv/acme\n[tenant acme]",
+		"[tenant acme]\nprofile = acme",
+	} {
+		if _, err := parseJobs(strings.NewReader(bad), "jobs"); err == nil {
+			t.Errorf("%q was taken", bad)
+		}
+	}
+}
+
+func TestServeConfiguredJobs(t *testing.T) {
+	fake := newFakeS3()
+	var limited []*bandwidthLimiter
+	d := newDaemon(func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API {
+		limited = limiters
+		return fake
+	}, "bucket", "")
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b/c.jpg": "c"})
+	job := configuredJob{jobRequest: jobRequest{Name: "photos", File: dir, Key: "photos", Files: 2, Bandwidth: "5M"}}
+	d.configure(jobsConfig{Jobs: []configuredJob{job}})
+	first := waitForJob(t, d, "1")
+	if first.State != PROGRESS_DONE || first.FilesDone != 2 || first.FilesTotal != 2 {
+		t.Fatalf("the job ended as %+v", first)
+	}
+	if fake.objects["photos/a.jpg"] == nil || fake.objects["photos/b/c.jpg"] == nil {
+		t.Error("the files weren't uploaded under the prefix")
+	}
+	if len(limited) != 1 || limited[0] == nil || limited[0].rate != 5*1024*1024 {
+		t.Errorf("the job's session was limited by %v", limited)
+	}
+
+	// Without every, it runs once.
+	d.submitDue()
+	if jobs := d.list(); len(jobs) != 1 {
+		t.Errorf("%d jobs after running the configured one once", len(jobs))
+	}
+
+	// Running again, it only uploads what's changed.
+	job.Every = time.Nanosecond
+	d.configure(jobsConfig{Jobs: []configuredJob{job}})
+	second := waitForJob(t, d, "2")
+	if second.State != PROGRESS_DONE || second.FilesTotal != 0 {
+		t.Errorf("the second run ended as %+v", second)
+	}
+}
+
+func TestServeTenants(t *testing.T) {
+	fake := newFakeS3()
+	var region, profile string
+	var limited []*bandwidthLimiter
+	d := newDaemon(func(r string, p string, limiters ...*bandwidthLimiter) s3iface.S3API {
+		region, profile, limited = r, p, limiters
+		return fake
+	}, "bucket", "")
+	file := writeTestFile(t, []byte("abc"))
+	acme, err := parseJobs(strings.NewReader(`
+[tenant acme]
+root = `+filepath.Dir(file)+`
+profile = acme
+region = eu-west-1
+bucket = acme-backups
+bandwidth = 10M
+`), "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.configure(acme)
+
+	// Files outside its root aren't the tenant's, also through a symlink.
+	other := writeTestFile(t, []byte("someone else's"))
+	link := filepath.Join(filepath.Dir(file), "link")
+	if err := os.Symlink(other, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []jobRequest{
+		{File: file, Tenant: "initech"},
+		{File: file, Tenant: "acme", Bucket: "bucket"},
+		{File: other, Tenant: "acme"},
+		{File: link, Tenant: "acme"},
+		{File: filepath.Join(filepath.Dir(file), "..", filepath.Base(filepath.Dir(other)), filepath.Base(other)), Tenant: "acme"},
+	} {
+		if _, err := d.submit(bad); err == nil {
+			t.Errorf("%+v was taken", bad)
+		}
+	}
+
+	job, err := d.submit(jobRequest{File: file, Tenant: "acme", Key: "dump"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done := waitForJob(t, d, job.ID); done.State != PROGRESS_DONE || done.Bucket != "acme-backups" {
+		t.Fatalf("the job ended as %+v", done)
+	}
+	if region != "eu-west-1" || profile != "acme" {
+		t.Errorf("the job ran in %s as %s", region, profile)
+	}
+	if len(limited) != 2 || limited[0] == nil || limited[0].rate != 10*1024*1024 || limited[1] != nil {
+		t.Errorf("the job's session was limited by %v", limited)
+	}
+}
+
+// waitForJob waits until the job is finished, and returns how it ended.
+func waitForJob(t *testing.T, d *daemon, id string) serveJob {
+	timeout := time.After(10 * time.Second)
+	for {
+		job, changed, ok := d.snapshot(id)
+		if !ok {
+			t.Fatalf("there's no job %s", id)
+		}
+		if job.finished() {
+			return job
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("job %s is still %s", id, job.State)
+		}
+	}
+}
+
+func TestServeRemoteJobs(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "fleet.pem")
+	if err := Keygen(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if signingPrivateKey, err = loadSigningKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	ConfigVerifyKey = keyFile + ".pub"
+	defer func() { ConfigVerifyKey, signingPrivateKey = "", nil }()
+
+	fake := newFakeS3()
+	d := newDaemon(func(region string, profile string, limiters ...*bandwidthLimiter) s3iface.S3API {
+		return fake
+	}, "bucket", "")
+	url := "s3://fleet/jobs"
+	publish := func(jobs string) {
+		t.Helper()
+		if err := ConfigPublish(fake, rootCmd, writeConfig(t, jobs), url, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ConfigPublish(fake, rootCmd, writeConfig(t, "[a]\nkey = a\n"), url, true); err == nil {
+		t.Error("published a job without a path")
+	}
+	publish(fmt.Sprintf("[a]\npath = %s\nkey = a\n", writeTestFile(t, []byte("a"))))
+	if err := d.reload(fake, url); err != nil {
+		t.Fatal(err)
+	}
+	if a := waitForJob(t, d, "1"); a.Name != "a" || a.State != PROGRESS_DONE {
+		t.Fatalf("the job ended as %+v", a)
+	}
+
+	// Jobs added later are run once the file is read again.
+	publish(fmt.Sprintf("[b]\npath = %s\nkey = b\n", writeTestFile(t, []byte("b"))))
+	if err := d.reload(fake, url); err != nil {
+		t.Fatal(err)
+	}
+	if b := waitForJob(t, d, "2"); b.Name != "b" || b.State != PROGRESS_DONE {
+		t.Fatalf("the job ended as %+v", b)
+	}
+
+	// A jobs file whose signature doesn't match is refused every time.
+	fake.objects["jobs"].data = []byte("[evil]\npath = /etc\n")
+	if err := d.reload(fake, url); err == nil || !strings.Contains(err.Error(), "not valid") {
+		t.Errorf("got %v", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.configured) != 1 || d.configured[0].Name != "b" {
+		t.Errorf("configured %+v", d.configured)
+	}
+}
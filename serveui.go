@@ -0,0 +1,194 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How often the daemon notes its throughput for the web UI, and how many of
+// those notes it keeps.
+var throughputInterval = 10 * time.Second
+
+const THROUGHPUT_SAMPLES = 90
+
+// How many finished jobs the web UI shows.
+const UI_RECENT_JOBS = 10
+
+// throughputSample is how fast the daemon uploaded, all jobs together, in
+// the interval up to Time.
+type throughputSample struct {
+	Time time.Time
+	Rate int64
+}
+
+// sampleThroughput notes how many bytes the jobs uploaded every
+// throughputInterval, for the web UI's graph.
+func (d *daemon) sampleThroughput() {
+	for now := range time.Tick(throughputInterval) {
+		d.mu.Lock()
+		d.sample(now, throughputInterval)
+		d.mu.Unlock()
+	}
+}
+
+// sample notes the throughput since the last sample, interval ago.  It's
+// called with d.mu held.
+func (d *daemon) sample(now time.Time, interval time.Duration) {
+	var total int64
+	for _, job := range d.jobs {
+		total += job.BytesDone
+	}
+	rate := int64(float64(total-d.sampledBytes) / interval.Seconds())
+	d.sampledBytes = total
+	d.throughput = append(d.throughput, throughputSample{now, rate})
+	if len(d.throughput) > THROUGHPUT_SAMPLES {
+		d.throughput = d.throughput[len(d.throughput)-THROUGHPUT_SAMPLES:]
+	}
+}
+
+// uiPage is what the web UI shows: the jobs which are queued, running or
+// paused, the last ones to finish, and the last ones to fail.
+type uiPage struct {
+	Host       string
+	Generated  time.Time
+	Queue      []serveJob
+	Done       []serveJob
+	Failures   []serveJob
+	Throughput []throughputSample
+	Rate       int64
+	Peak       int64
+	Incomplete incompleteUploads
+}
+
+func (d *daemon) uiPage(now time.Time) uiPage {
+	host, _ := os.Hostname()
+	page := uiPage{Host: host, Generated: now}
+
+	d.mu.Lock()
+	page.Throughput = append(page.Throughput, d.throughput...)
+	page.Incomplete = d.incomplete
+	d.mu.Unlock()
+	for _, sample := range page.Throughput {
+		if sample.Rate > page.Peak {
+			page.Peak = sample.Rate
+		}
+		page.Rate = sample.Rate
+	}
+
+	jobs := d.list()
+	for _, job := range jobs {
+		if !job.finished() {
+			page.Queue = append(page.Queue, job)
+		}
+	}
+	// The latest first.
+	for i := len(jobs) - 1; i >= 0; i-- {
+		switch {
+		case jobs[i].State == PROGRESS_DONE && len(page.Done) < UI_RECENT_JOBS:
+			page.Done = append(page.Done, jobs[i])
+		case jobs[i].State == PROGRESS_FAILED && len(page.Failures) < UI_RECENT_JOBS:
+			page.Failures = append(page.Failures, jobs[i])
+		}
+	}
+	return page
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"percent": func(done int64, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(done) / float64(total) * 100
+	},
+	"height": func(rate int64, peak int64) float64 {
+		if peak == 0 {
+			return 0
+		}
+		return float64(rate) / float64(peak) * 100
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>s3-glacier-uploader on {{.Host}}</title>
+<style>
+body { font-family: sans-serif; max-width: 70em; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; white-space: nowrap; }
+td.bar { width: 25%; }
+td.bar div { background: #4a7ab5; height: 1em; }
+.graph { display: flex; align-items: flex-end; height: 8em; border-bottom: 1px solid #ddd; margin-bottom: 2em; }
+.graph div { flex: 1; background: #4a7ab5; margin-right: 1px; }
+.paused { color: #888; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>s3-glacier-uploader on {{.Host}}</h1>
+<p>{{len .Queue}} jobs queued or running.  Updated {{.Generated.Format "2006-01-02 15:04:05 MST"}}.</p>
+{{if .Incomplete.Warning}}<p class="failed">{{.Incomplete.Warning}} (as of {{.Incomplete.Checked.Format "15:04"}})</p>{{end}}
+<h2>Throughput</h2>
+{{if .Throughput}}<p>{{bytes .Rate}}/s now, at most {{bytes .Peak}}/s since {{(index .Throughput 0).Time.Format "15:04"}}.</p>
+<div class="graph">{{range .Throughput}}<div title="{{.Time.Format "15:04:05"}}: {{bytes .Rate}}/s" style="height: {{printf "%.1f" (height .Rate $.Peak)}}%"></div>{{end}}</div>
+{{else}}<p>Nothing measured yet.</p>{{end}}
+<h2>Queue</h2>
+{{if .Queue}}<table>
+<tr><th>Job</th><th>File</th><th>To</th><th>Priority</th><th>State</th><th>Files</th><th>Parts</th><th colspan="2">Uploaded</th></tr>
+{{range .Queue}}<tr class="{{.State}}"><td>{{.ID}}{{if .Name}} {{.Name}}{{end}}{{if .Tenant}} ({{.Tenant}}){{end}}</td><td>{{.File}}</td><td>{{.Bucket}}/{{.Key}}</td><td class="number">{{.Priority}}</td><td>{{.State}}</td><td class="number">{{.FilesDone}}/{{.FilesTotal}}</td><td class="number">{{.PartsDone}}/{{.PartsTotal}}</td><td class="number">{{bytes .BytesDone}} of {{bytes .BytesTotal}}</td><td class="bar"><div style="width: {{printf "%.1f" (percent .BytesDone .BytesTotal)}}%"></div></td></tr>
+{{end}}</table>
+{{else}}<p>No jobs.</p>{{end}}
+{{if .Failures}}
+<h2 class="failed">Recent failures</h2>
+<table>
+<tr><th>Job</th><th>File</th><th>Failed</th><th>Error</th></tr>
+{{range .Failures}}<tr class="failed"><td>{{.ID}}{{if .Name}} {{.Name}}{{end}}{{if .Tenant}} ({{.Tenant}}){{end}}</td><td>{{.File}}</td><td>{{if .Finished}}{{.Finished.Format "2006-01-02 15:04"}}{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Done}}
+<h2>Recently done</h2>
+<table>
+<tr><th>Job</th><th>File</th><th>To</th><th>Done</th><th>Files</th><th>Size</th></tr>
+{{range .Done}}<tr><td>{{.ID}}{{if .Name}} {{.Name}}{{end}}{{if .Tenant}} ({{.Tenant}}){{end}}</td><td>{{.File}}</td><td>{{.Bucket}}/{{.Key}}</td><td>{{if .Finished}}{{.Finished.Format "2006-01-02 15:04"}}{{end}}</td><td class="number">{{.FilesDone}}</td><td class="number">{{bytes .BytesDone}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// handleUI shows the daemon's jobs to people, on a page which reloads itself
+// every few seconds.
+func (d *daemon) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("There's no %s", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't supported", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	uiTemplate.Execute(w, d.uiPage(time.Now()))
+}
@@ -0,0 +1,77 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeUI(t *testing.T) {
+	d := newDaemon(nil, "bucket", "secret")
+	finished := time.Now()
+	d.jobs = []*serveJob{
+		{ID: "1", Name: "mail", File: "/srv/mail.tar", State: PROGRESS_FAILED, Error: "Access Denied", Finished: &finished},
+		{ID: "2", File: "/srv/db.dump", State: PROGRESS_DONE, BytesDone: 100, BytesTotal: 100, Finished: &finished},
+		{ID: "3", File: "/srv/photos", State: PROGRESS_UPLOADING, BytesDone: 250, BytesTotal: 1000},
+	}
+	d.sampledBytes = 50
+	d.sample(finished, 10*time.Second)
+	if len(d.throughput) != 1 || d.throughput[0].Rate != 30 {
+		t.Errorf("sampled %+v", d.throughput)
+	}
+
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Values("WWW-Authenticate")[1], "Basic") {
+		t.Errorf("got %s, %v", resp.Status, resp.Header.Values("WWW-Authenticate"))
+	}
+
+	// The browser sends the token as the password.
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.SetBasicAuth("", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %s", resp.Status, page)
+	}
+	for _, want := range []string{
+		"1 jobs queued or running",
+		"/srv/photos", "width: 25.0%",
+		"Recent failures", "1 mail", "Access Denied",
+		"Recently done", "/srv/db.dump",
+		"30 B/s now",
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("the page doesn't show %q", want)
+		}
+	}
+}
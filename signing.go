@@ -0,0 +1,211 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var SigningKey string
+var VerifyKey string
+
+const SIGNATURE_SUFFIX = ".sig"
+
+// The keys given with --signing-key and --verify-key, loaded before anything
+// else happens so that a bad key doesn't surface after a day of uploading.
+var signingPrivateKey ed25519.PrivateKey
+var verifyPublicKey ed25519.PublicKey
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen file",
+	Short: "Create an ed25519 key pair for signing manifests",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Keygen(args[0])
+	},
+}
+
+// Keygen writes a private key to filename and the matching public key to
+// filename.pub.  Keep the private key on the machine doing the uploads and
+// the public key wherever you restore or audit from.
+func Keygen(filename string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filename+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+	if err != nil {
+		return err
+	}
+
+	ui.Println("Wrote", filename, "and", filename+".pub")
+
+	return nil
+}
+
+func readPEM(filename string, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s doesn't contain a %s", filename, blockType)
+	}
+
+	return block.Bytes, nil
+}
+
+func loadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(filename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an ed25519 key", filename)
+	}
+
+	return private, nil
+}
+
+func loadVerifyKey(filename string) (ed25519.PublicKey, error) {
+	der, err := readPEM(filename, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an ed25519 key", filename)
+	}
+
+	return public, nil
+}
+
+func loadKeys() error {
+	var err error
+
+	if SigningKey != "" {
+		if signingPrivateKey, err = loadSigningKey(SigningKey); err != nil {
+			return fmt.Errorf("Failed to load --signing-key: %w", err)
+		}
+	}
+
+	if VerifyKey != "" {
+		if verifyPublicKey, err = loadVerifyKey(VerifyKey); err != nil {
+			return fmt.Errorf("Failed to load --verify-key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// putSignature signs data with the --signing-key, if there is one, and stores
+// the signature next to the object it belongs to.
+func putSignature(s3session s3iface.S3API, bucket string, key string, data []byte) error {
+	if signingPrivateKey == nil {
+		return nil
+	}
+
+	_, err := s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key + SIGNATURE_SUFFIX),
+		Body:         bytes.NewReader(ed25519.Sign(signingPrivateKey, data)),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+
+	return err
+}
+
+// checkSignature verifies data against the signature stored next to the
+// object, if a --verify-key was given.  A missing signature is an error then:
+// an attacker with write access to the bucket could simply delete it.
+func checkSignature(s3session s3iface.S3API, bucket string, key string, data []byte) error {
+	if verifyPublicKey == nil {
+		return nil
+	}
+	return verifySignature(s3session, bucket, key, data, verifyPublicKey)
+}
+
+// verifySignature checks the signature stored next to key against public.
+func verifySignature(s3session s3iface.S3API, bucket string, key string, data []byte, public ed25519.PublicKey) error {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key + SIGNATURE_SUFFIX),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read the signature of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	signature, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(public, data, signature) {
+		return fmt.Errorf("The signature of %s is not valid", key)
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+}
@@ -0,0 +1,82 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignatures(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "signing.pem")
+	if err := Keygen(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		SigningKey, VerifyKey = "", ""
+		signingPrivateKey, verifyPublicKey = nil, nil
+	}()
+	SigningKey, VerifyKey = keyFile, keyFile+".pub"
+	if err := loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeS3()
+	data := []byte("manifest")
+	if err := putSignature(fake, "bucket", "archive.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSignature(fake, "bucket", "archive.bin", data); err != nil {
+		t.Errorf("the signature of what was signed isn't valid: %v", err)
+	}
+	if err := checkSignature(fake, "bucket", "archive.bin", []byte("tampered")); err == nil {
+		t.Error("the signature is valid for other data")
+	}
+
+	// Deleting the signature doesn't get around it.
+	delete(fake.objects, "archive.bin"+SIGNATURE_SUFFIX)
+	if err := checkSignature(fake, "bucket", "archive.bin", data); err == nil {
+		t.Error("a missing signature was taken")
+	}
+}
+
+func TestLoadKeysRefusesWrongKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "signing.pem")
+	if err := Keygen(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The halves swapped, or something else entirely.
+	for _, filename := range []string{keyFile + ".pub", garbage} {
+		if _, err := loadSigningKey(filename); err == nil {
+			t.Errorf("loaded %s as a signing key", filename)
+		}
+	}
+	for _, filename := range []string{keyFile, garbage} {
+		if _, err := loadVerifyKey(filename); err == nil {
+			t.Errorf("loaded %s as a verify key", filename)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CLI flags
+var Snapshot string
+var SnapshotCommand string
+var SnapshotReleaseCommand string
+var SnapshotSize string
+
+const (
+	SNAPSHOT_ZFS     = "zfs"
+	SNAPSHOT_BTRFS   = "btrfs"
+	SNAPSHOT_LVM     = "lvm"
+	SNAPSHOT_COMMAND = "command"
+)
+
+func checkSnapshotFlags() error {
+	switch Snapshot {
+	case "", SNAPSHOT_ZFS, SNAPSHOT_BTRFS, SNAPSHOT_LVM:
+	case SNAPSHOT_COMMAND:
+		if SnapshotCommand == "" {
+			return fmt.Errorf("--snapshot command needs --snapshot-command")
+		}
+	default:
+		return fmt.Errorf("--snapshot is %s, %s, %s or %s", SNAPSHOT_ZFS, SNAPSHOT_BTRFS, SNAPSHOT_LVM, SNAPSHOT_COMMAND)
+	}
+	if Snapshot != "" && VSS {
+		return fmt.Errorf("--snapshot and --vss can't be used together")
+	}
+	if SnapshotCommand != "" && Snapshot != SNAPSHOT_COMMAND {
+		return fmt.Errorf("--snapshot-command only goes with --snapshot command")
+	}
+	return nil
+}
+
+// snapshotPlan is the commands taking a snapshot and removing it again, and
+// where the source is in the snapshot.
+type snapshotPlan struct {
+	Create  [][]string
+	Path    string
+	Release [][]string
+}
+
+func snapshotName(now time.Time) string {
+	return fmt.Sprintf("s3-glacier-uploader-%d", now.Unix())
+}
+
+// btrfsSnapshot snapshots src, which has to be a subvolume, next to itself.
+func btrfsSnapshot(src string, name string) snapshotPlan {
+	path := filepath.Join(filepath.Dir(src), "."+filepath.Base(src)+"-"+name)
+	return snapshotPlan{
+		Create:  [][]string{{"btrfs", "subvolume", "snapshot", "-r", src, path}},
+		Path:    path,
+		Release: [][]string{{"btrfs", "subvolume", "delete", path}},
+	}
+}
+
+// zfsSnapshot snapshots the dataset mounted at mountpoint, which src is in.
+// ZFS makes snapshots visible under .zfs/snapshot, so there's nothing to
+// mount.
+func zfsSnapshot(src string, dataset string, mountpoint string, name string) (snapshotPlan, error) {
+	rel, err := filepath.Rel(mountpoint, src)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return snapshotPlan{}, fmt.Errorf("%s isn't in the dataset %s mounted at %s", src, dataset, mountpoint)
+	}
+	snapshot := dataset + "@" + name
+	return snapshotPlan{
+		Create:  [][]string{{"zfs", "snapshot", snapshot}},
+		Path:    filepath.Join(mountpoint, ".zfs", "snapshot", name, rel),
+		Release: [][]string{{"zfs", "destroy", snapshot}},
+	}, nil
+}
+
+// lvmSnapshot snapshots the logical volume vg/lv mounted at mountpoint, which
+// src is in, and mounts the snapshot read only at mountDir.  The snapshot can
+// take size worth of changes to the volume before it's invalidated.
+func lvmSnapshot(src string, vg string, lv string, fstype string, mountpoint string, mountDir string, name string, size string) (snapshotPlan, error) {
+	rel, err := filepath.Rel(mountpoint, src)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return snapshotPlan{}, fmt.Errorf("%s isn't on %s/%s mounted at %s", src, vg, lv, mountpoint)
+	}
+
+	// XFS refuses to mount a second file system with the same UUID.
+	options := "ro"
+	if fstype == "xfs" {
+		options += ",nouuid"
+	}
+
+	snapshot := vg + "/" + name
+	return snapshotPlan{
+		Create: [][]string{
+			{"lvcreate", "--snapshot", "--size", size, "--name", name, vg + "/" + lv},
+			{"mount", "-o", options, "/dev/" + snapshot, mountDir},
+		},
+		Path: filepath.Join(mountDir, rel),
+		Release: [][]string{
+			{"umount", mountDir},
+			{"lvremove", "--yes", snapshot},
+		},
+	}, nil
+}
+
+func runSnapshotCommand(args []string) (string, error) {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// planSnapshot asks the system what src is on and works out the snapshot.
+func planSnapshot(src string, name string) (snapshotPlan, func(), error) {
+	noCleanup := func() {}
+
+	switch Snapshot {
+	case SNAPSHOT_BTRFS:
+		return btrfsSnapshot(src, name), noCleanup, nil
+
+	case SNAPSHOT_ZFS:
+		out, err := runSnapshotCommand([]string{"zfs", "list", "-H", "-o", "name,mountpoint", src})
+		if err != nil {
+			return snapshotPlan{}, nil, err
+		}
+		fields := strings.Split(strings.TrimSpace(out), "\t")
+		if len(fields) != 2 {
+			return snapshotPlan{}, nil, fmt.Errorf("Unexpected output from zfs list: %q", out)
+		}
+		plan, err := zfsSnapshot(src, fields[0], fields[1], name)
+		return plan, noCleanup, err
+
+	case SNAPSHOT_LVM:
+		out, err := runSnapshotCommand([]string{"findmnt", "-n", "-o", "SOURCE,TARGET,FSTYPE", "--target", src})
+		if err != nil {
+			return snapshotPlan{}, nil, err
+		}
+		mount := strings.Fields(out)
+		if len(mount) != 3 {
+			return snapshotPlan{}, nil, fmt.Errorf("Unexpected output from findmnt: %q", out)
+		}
+		out, err = runSnapshotCommand([]string{"lvs", "--noheadings", "-o", "vg_name,lv_name", mount[0]})
+		if err != nil {
+			return snapshotPlan{}, nil, err
+		}
+		volume := strings.Fields(out)
+		if len(volume) != 2 {
+			return snapshotPlan{}, nil, fmt.Errorf("%s isn't an LVM logical volume", mount[0])
+		}
+
+		mountDir, err := os.MkdirTemp(snapshotMountRoot, name)
+		if err != nil {
+			return snapshotPlan{}, nil, err
+		}
+		plan, err := lvmSnapshot(src, volume[0], volume[1], mount[2], mount[1], mountDir, name, SnapshotSize)
+		return plan, func() { os.Remove(mountDir) }, err
+	}
+
+	return snapshotPlan{}, nil, fmt.Errorf("Unknown snapshot kind %s", Snapshot)
+}
+
+// takeSnapshot makes a point-in-time copy of the file system src is on, so
+// that a live dataset is uploaded as it was at one moment.  The returned
+// function removes the snapshot again.
+func takeSnapshot(src string, now time.Time) (string, func(), error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if Snapshot == SNAPSHOT_COMMAND {
+		out, err := runHook(SnapshotCommand, src)
+		if err != nil {
+			return "", nil, fmt.Errorf("--snapshot-command failed for %s: %w", src, err)
+		}
+		path := strings.TrimSpace(string(out))
+		if path == "" {
+			return "", nil, fmt.Errorf("--snapshot-command printed no path for %s", src)
+		}
+		ui.Warnln("Uploading from snapshot", path)
+
+		release := func() {
+			if SnapshotReleaseCommand == "" {
+				return
+			}
+			if _, err := runHook(SnapshotReleaseCommand, path); err != nil {
+				ui.Warnf("--snapshot-release-command failed for %s: %v\n", path, err)
+			}
+		}
+		return path, release, nil
+	}
+
+	plan, cleanup, err := planSnapshot(src, snapshotName(now))
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to snapshot %s (drop --snapshot to upload anyway): %w", src, err)
+	}
+
+	release := func() {
+		for _, args := range plan.Release {
+			if _, err := runSnapshotCommand(args); err != nil {
+				ui.Warnln("Failed to remove the snapshot:", err)
+				return
+			}
+		}
+		cleanup()
+	}
+
+	// A snapshot that's half set up, like an LVM snapshot which didn't
+	// mount, is taken down again.
+	for i, args := range plan.Create {
+		if _, err := runSnapshotCommand(args); err != nil {
+			if i > 0 {
+				release()
+			} else {
+				cleanup()
+			}
+			return "", nil, fmt.Errorf("Failed to snapshot %s (drop --snapshot to upload anyway): %w", src, err)
+		}
+	}
+
+	ui.Warnln("Uploading from snapshot", plan.Path)
+	return plan.Path, release, nil
+}
+
+// sourceSnapshot returns where to read path from: a snapshot if one was asked
+// for, or path itself.  The returned function removes the snapshot again.
+func sourceSnapshot(path string) (string, func(), error) {
+	if !VSS && Snapshot == "" {
+		return path, func() {}, nil
+	}
+
+	take := snapshotSource
+	if Snapshot != "" {
+		take = func(path string) (string, func(), error) { return takeSnapshot(path, time.Now()) }
+	}
+
+	snapshot, release, err := take(path)
+	if err != nil {
+		return "", func() {}, err
+	}
+	guardSnapshot(path, snapshot)
+	return snapshot, release, nil
+}
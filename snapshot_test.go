@@ -0,0 +1,124 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotPlans(t *testing.T) {
+	name := snapshotName(time.Unix(1700000000, 0))
+	if name != "s3-glacier-uploader-1700000000" {
+		t.Errorf("snapshot name %s", name)
+	}
+
+	btrfs := btrfsSnapshot("/data/photos", name)
+	if btrfs.Path != "/data/.photos-"+name {
+		t.Errorf("btrfs snapshot at %s", btrfs.Path)
+	}
+	if want := []string{"btrfs", "subvolume", "snapshot", "-r", "/data/photos", btrfs.Path}; !reflect.DeepEqual(btrfs.Create[0], want) {
+		t.Errorf("btrfs snapshot taken with %v", btrfs.Create)
+	}
+
+	zfs, err := zfsSnapshot("/tank/home/honza/photos", "tank/home", "/tank/home", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zfs.Path != "/tank/home/.zfs/snapshot/"+name+"/honza/photos" {
+		t.Errorf("zfs snapshot at %s", zfs.Path)
+	}
+	if want := [][]string{{"zfs", "destroy", "tank/home@" + name}}; !reflect.DeepEqual(zfs.Release, want) {
+		t.Errorf("zfs snapshot removed with %v", zfs.Release)
+	}
+	if _, err := zfsSnapshot("/srv/photos", "tank/home", "/tank/home", name); err == nil {
+		t.Error("snapshotted a dataset the source isn't in")
+	}
+
+	lvm, err := lvmSnapshot("/srv/db", "vg0", "srv", "xfs", "/srv", "/tmp/mnt", name, "10G")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lvm.Path != "/tmp/mnt/db" {
+		t.Errorf("lvm snapshot at %s", lvm.Path)
+	}
+	want := [][]string{
+		{"lvcreate", "--snapshot", "--size", "10G", "--name", name, "vg0/srv"},
+		{"mount", "-o", "ro,nouuid", "/dev/vg0/" + name, "/tmp/mnt"},
+	}
+	if !reflect.DeepEqual(lvm.Create, want) {
+		t.Errorf("lvm snapshot taken with %v", lvm.Create)
+	}
+	if want := [][]string{{"umount", "/tmp/mnt"}, {"lvremove", "--yes", "vg0/" + name}}; !reflect.DeepEqual(lvm.Release, want) {
+		t.Errorf("lvm snapshot removed with %v", lvm.Release)
+	}
+}
+
+func TestSnapshotCommand(t *testing.T) {
+	defer func() { Snapshot, SnapshotCommand, SnapshotReleaseCommand = "", "", "" }()
+
+	snapshot := t.TempDir()
+	released := filepath.Join(t.TempDir(), "released")
+	Snapshot = SNAPSHOT_COMMAND
+	SnapshotCommand = writeHook(t, "echo "+snapshot)
+	SnapshotReleaseCommand = writeHook(t, `echo "$1" > `+released)
+
+	path, release, err := sourceSnapshot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != snapshot {
+		t.Errorf("reading from %s, want %s", path, snapshot)
+	}
+
+	release()
+	if data, err := os.ReadFile(released); err != nil || string(data) != snapshot+"\n" {
+		t.Errorf("release command got %q: %v", data, err)
+	}
+
+	SnapshotCommand = writeHook(t, "exit 1")
+	if _, release, err := sourceSnapshot(t.TempDir()); err == nil || release == nil {
+		t.Errorf("a failed snapshot command gave %v", err)
+	}
+}
+
+func TestCheckSnapshotFlags(t *testing.T) {
+	defer func() { Snapshot, SnapshotCommand, VSS = "", "", false }()
+
+	for _, flags := range []struct {
+		snapshot string
+		command  string
+		vss      bool
+		ok       bool
+	}{
+		{"", "", false, true},
+		{SNAPSHOT_ZFS, "", false, true},
+		{SNAPSHOT_COMMAND, "snap.sh", false, true},
+		{SNAPSHOT_COMMAND, "", false, false},
+		{"xfs", "", false, false},
+		{SNAPSHOT_LVM, "", true, false},
+		{SNAPSHOT_BTRFS, "snap.sh", false, false},
+	} {
+		Snapshot, SnapshotCommand, VSS = flags.snapshot, flags.command, flags.vss
+		if err := checkSnapshotFlags(); (err == nil) != flags.ok {
+			t.Errorf("%+v: %v", flags, err)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var SplitSize string
+
+// S3 objects can't be larger than 5 TiB.  Anything larger is uploaded as
+// shards of --split-size, key.part-0001, key.part-0002 and so on, each an
+// object of its own, and a manifest listing them in order is stored next to
+// them.  download puts them back together.
+const (
+	MAX_OBJECT_SIZE       = 5 * 1024 * 1024 * 1024 * 1024
+	SPLIT_MANIFEST_SUFFIX = ".split.json"
+)
+
+// splitBytes is --split-size in bytes, 0 for not splitting.
+var splitBytes int64
+
+type splitManifest struct {
+	Key    string       `json:"key"`
+	Size   int64        `json:"size"`
+	Shards []splitShard `json:"shards"`
+}
+
+// splitShard is one object of a split upload.  Its size and SHA-256 digest
+// are of what was read, before any encryption.
+type splitShard struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func checkSplitFlags() error {
+	splitBytes = 0
+	if SplitSize == "" {
+		return nil
+	}
+
+	size, err := parseSize(SplitSize)
+	if err != nil {
+		return fmt.Errorf("Invalid --split-size: %w", err)
+	}
+	if size < MIN_PART_SIZE || size > MAX_OBJECT_SIZE {
+		return fmt.Errorf("--split-size must be between %s and %s", formatBytes(MIN_PART_SIZE), formatBytes(MAX_OBJECT_SIZE))
+	}
+	switch {
+	case Nodes > 1:
+		return fmt.Errorf("--split-size can't be combined with --nodes")
+	case BaseKey != "":
+		return fmt.Errorf("--split-size can't be combined with --base")
+	case Recompress != "":
+		return fmt.Errorf("--split-size can't be combined with --recompress")
+	case UploadID != "" || ResumeToken != "":
+		return fmt.Errorf("Split uploads are streamed, they can't be resumed")
+	}
+	splitBytes = size
+	return nil
+}
+
+// shardKey is where the shard with the given index, from 0, goes.
+func shardKey(key string, index int) string {
+	return fmt.Sprintf("%s.part-%04d", key, index+1)
+}
+
+// shardDigest hashes and counts what a shard reads.
+type shardDigest struct {
+	hash.Hash
+	size int64
+}
+
+func (d *shardDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.Hash.Write(p)
+}
+
+// uploadSplit uploads what r returns as shards of splitBytes, and then their
+// manifest.  Every shard is a stream upload of its own, encrypted on its own
+// with --encrypt.  If a shard fails, the ones before it are left in the
+// bucket, without a manifest.
+func uploadSplit(s3session s3iface.S3API, cleanup cleanupSession, bucket string, key string, r io.Reader, input *streamInput, metadata map[string]*string) error {
+	in := bufio.NewReader(r)
+	m := &splitManifest{Key: key}
+
+	for i := 0; ; i++ {
+		// A stream that ends right at the end of a shard doesn't get an
+		// empty one after it.
+		if i > 0 {
+			if _, err := in.Peek(1); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("Failed to read %s: %w", key, err)
+			}
+		}
+
+		shard := shardKey(key, i)
+		digest := &shardDigest{Hash: sha256.New()}
+		var source io.Reader = io.TeeReader(io.LimitReader(in, splitBytes), digest)
+
+		shardMetadata := map[string]*string{}
+		for k, v := range metadata {
+			shardMetadata[k] = v
+		}
+		partSize := streamPartSize(splitBytes)
+		if Encrypt {
+			c, err := newObjectCipher(bucket, shard)
+			if err != nil {
+				return err
+			}
+			shardMetadata = encryptionMetadata(shardMetadata, c)
+			source = encryptReader(source, c)
+			partSize = streamPartSize(encryptedSize(splitBytes))
+		}
+
+		ui.Printf("Shard %d: %s\n", i+1, shard)
+		if err := uploadStream(s3session, cleanup, bucket, shard, source, input, shardMetadata, partSize); err != nil {
+			return fmt.Errorf("Failed to upload %s, the shards before it have no manifest: %w", shard, err)
+		}
+
+		m.Shards = append(m.Shards, splitShard{Key: shard, Size: digest.size, SHA256: hex.EncodeToString(digest.Sum(nil))})
+		m.Size += digest.size
+		if digest.size < splitBytes {
+			break
+		}
+	}
+
+	if err := saveSplitManifest(s3session, bucket, m); err != nil {
+		return fmt.Errorf("Failed to save the manifest of the %d shards of %s: %w", len(m.Shards), key, err)
+	}
+	ui.Printf("Uploaded %s as %d shards, listed in %s\n", formatBytes(m.Size), len(m.Shards), key+SPLIT_MANIFEST_SUFFIX)
+	return nil
+}
+
+// uploadSplitFile uploads a file larger than --split-size in shards.
+func uploadSplitFile(s3session s3iface.S3API, cleanup cleanupSession, bucket string, filename string, key string, size int64) error {
+	metadata, err := uploadMetadata(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ui.Println("File to upload:", filename)
+	input := newStreamInput(filename, size, false)
+	return uploadSplit(s3session, cleanup, bucket, key, input.Reader(file), input, metadata)
+}
+
+func saveSplitManifest(s3session s3iface.S3API, bucket string, m *splitManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(m.Key + SPLIT_MANIFEST_SUFFIX),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String("application/json"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+		Tagging:      objectTagging(m.Key),
+	})
+	if err != nil {
+		return err
+	}
+
+	return putSignature(s3session, bucket, m.Key+SPLIT_MANIFEST_SUFFIX, data)
+}
+
+// loadSplitManifest reads the manifest of key, if it was uploaded in shards.
+// Without one, it returns nil.
+func loadSplitManifest(s3session s3iface.S3API, bucket string, key string) (*splitManifest, error) {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key + SPLIT_MANIFEST_SUFFIX),
+	})
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the split manifest of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(s3session, bucket, key+SPLIT_MANIFEST_SUFFIX, data); err != nil {
+		return nil, err
+	}
+
+	var m splitManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse the split manifest of %s: %w", key, err)
+	}
+	if m.Key != key {
+		return nil, fmt.Errorf("The split manifest of %s describes %s", key, m.Key)
+	}
+	return &m, nil
+}
+
+// joinReader reads the shards of a split upload one after another, checking
+// every one against its digest in the manifest when it ends.
+type joinReader struct {
+	s3session   s3iface.S3API
+	bucket      string
+	concurrency int
+	shards      []splitShard
+
+	shard   io.Reader
+	chunks  *rangeReader
+	digest  *shardDigest
+	current splitShard
+}
+
+// next opens the next shard, which has to be restored already.
+func (j *joinReader) next() error {
+	j.current, j.shards = j.shards[0], j.shards[1:]
+	head, err := j.s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(j.bucket),
+		Key:    aws.String(j.current.Key),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to find %s: %w", j.current.Key, err)
+	}
+	if err := checkRestored(j.current.Key, head); err != nil {
+		return err
+	}
+
+	j.chunks = newRangeReader(j.s3session, j.bucket, j.current.Key, *head.ETag, 0, *head.ContentLength-1, j.concurrency)
+	j.shard = j.chunks
+	if isEncrypted(head.Metadata) {
+		keyID, _ := metadataValue(head.Metadata, ENCRYPTION_KEY_ID_METADATA)
+		j.shard = decryptReader(j.chunks, keyID)
+	}
+	j.digest = &shardDigest{Hash: sha256.New()}
+	j.shard = io.TeeReader(j.shard, j.digest)
+	return nil
+}
+
+func (j *joinReader) Read(p []byte) (int, error) {
+	for {
+		if j.shard == nil {
+			if len(j.shards) == 0 {
+				return 0, io.EOF
+			}
+			if err := j.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := j.shard.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		j.chunks.Close()
+		j.shard = nil
+		if sum := hex.EncodeToString(j.digest.Sum(nil)); j.digest.size != j.current.Size || sum != j.current.SHA256 {
+			return n, fmt.Errorf("%s doesn't match the split manifest: %d bytes with SHA-256 %s, it lists %d bytes with %s", j.current.Key, j.digest.size, sum, j.current.Size, j.current.SHA256)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (j *joinReader) Close() error {
+	if j.chunks != nil {
+		return j.chunks.Close()
+	}
+	return nil
+}
+
+// downloadSplit puts the shards of a split upload back together, through
+// --decompress and --extract like any other download.  The shards don't
+// tell how they were compressed, only how they start does.
+func downloadSplit(s3session s3iface.S3API, bucket string, m *splitManifest, byteRange string, output string, concurrency int, decompress string, extract string, raw bool) error {
+	if byteRange != "" {
+		return fmt.Errorf("%s was uploaded in %d shards, it can only be downloaded whole", m.Key, len(m.Shards))
+	}
+	if err := checkBudget("the download", transferCost(m.Size)); err != nil {
+		return err
+	}
+	ui.Warnf("Joining the %d shards of %s\n", len(m.Shards), m.Key)
+
+	joined := &joinReader{s3session: s3session, bucket: bucket, concurrency: concurrency, shards: m.Shards}
+	defer joined.Close()
+
+	bar := ui.ByteBar(m.Size, "downloading")
+	var r io.Reader = io.TeeReader(joined, bar)
+
+	format := decompress
+	if format == "" && !raw {
+		peek := bufio.NewReader(r)
+		start, _ := peek.Peek(len(zstdMagic))
+		format = detectCompression(nil, start)
+		if format != "" {
+			ui.Warnf("%s is compressed with %s, decompressing it\n", m.Key, format)
+		}
+		r = peek
+	}
+
+	stream, err := decompressReader(r, format)
+	if err != nil {
+		return err
+	}
+
+	if extract != "" {
+		count, err := extractTar(stream, extract)
+		if err != nil {
+			return err
+		}
+		ui.Warnln("Extracted", count, "entries to", extract)
+		_, err = io.Copy(io.Discard, stream)
+		return err
+	}
+
+	if output == "" {
+		output = decompressedName(path.Base(m.Key), format)
+	}
+	var out io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	n, err := io.Copy(out, stream)
+	if err != nil {
+		return fmt.Errorf("Download failed after %d bytes: %w", n, err)
+	}
+	ui.Warnln("Saved", formatBytes(n), "to", output)
+	return nil
+}
@@ -0,0 +1,119 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadSplit(t *testing.T) {
+	defer func() { ObjectKey, SplitSize = "", ""; checkSplitFlags() }()
+	ObjectKey, SplitSize = "disk.img", "5M"
+	if err := checkSplitFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeS3()
+	data := randomData(2*MIN_PART_SIZE + 1024)
+	if err := uploadStdin(fake, fake.cleanup, "bucket", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var joined []byte
+	for _, key := range []string{"disk.img.part-0001", "disk.img.part-0002", "disk.img.part-0003"} {
+		obj := fake.objects[key]
+		if obj == nil {
+			t.Fatalf("%s wasn't uploaded", key)
+		}
+		joined = append(joined, obj.data...)
+		obj.restored = true
+	}
+	if !bytes.Equal(joined, data) || len(fake.objects["disk.img.part-0003"].data) != 1024 {
+		t.Error("the shards don't add up to the input")
+	}
+
+	m, err := loadSplitManifest(fake, "bucket", "disk.img")
+	if err != nil || m == nil {
+		t.Fatalf("no manifest: %v", err)
+	}
+	if m.Size != int64(len(data)) || len(m.Shards) != 3 || m.Shards[2].Size != 1024 {
+		t.Errorf("the manifest lists %d bytes in %v", m.Size, m.Shards)
+	}
+
+	output := filepath.Join(t.TempDir(), "disk.img")
+	if err := downloadObject(fake, "bucket", "disk.img", "", output, 2, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Error("the joined download doesn't match the input")
+	}
+
+	fake.objects["disk.img.part-0002"].data[0] ^= 0xff
+	err = downloadObject(fake, "bucket", "disk.img", "", output, 2, "", "", false)
+	if err == nil || !strings.Contains(err.Error(), "disk.img.part-0002 doesn't match") {
+		t.Errorf("a damaged shard got through: %v", err)
+	}
+}
+
+func TestUploadSplitExactly(t *testing.T) {
+	defer func() { SplitSize = ""; checkSplitFlags() }()
+	SplitSize = "5M"
+	if err := checkSplitFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file ending right at the end of a shard gets no empty one after it,
+	// and a file no larger than --split-size isn't split.
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(2*MIN_PART_SIZE)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["archive.bin.part-0002"]; !ok {
+		t.Error("the second shard is missing")
+	}
+	if _, ok := fake.objects["archive.bin.part-0003"]; ok {
+		t.Error("an empty shard was uploaded")
+	}
+
+	fake = newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["archive.bin"]; !ok {
+		t.Error("a small file was split")
+	}
+}
+
+func TestCheckSplitFlags(t *testing.T) {
+	defer func() { SplitSize, Nodes = "", 1; checkSplitFlags() }()
+
+	for _, size := range []string{"1M", "6T", "big"} {
+		SplitSize = size
+		if err := checkSplitFlags(); err == nil {
+			t.Errorf("--split-size %s was accepted", size)
+		}
+	}
+
+	SplitSize, Nodes = "4T", 2
+	if err := checkSplitFlags(); err == nil {
+		t.Error("--split-size was accepted with --nodes")
+	}
+}
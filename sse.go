@@ -0,0 +1,179 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var SSE string
+var SSEKMSKeyID string
+var CheckBucket bool
+
+func checkSSEFlags() error {
+	switch strings.ToLower(SSE) {
+	case "":
+		if SSEKMSKeyID != "" {
+			return fmt.Errorf("--sse-kms-key-id needs --sse %s", s3.ServerSideEncryptionAwsKms)
+		}
+		return nil
+	case strings.ToLower(s3.ServerSideEncryptionAes256):
+		if SSEKMSKeyID != "" {
+			return fmt.Errorf("--sse-kms-key-id needs --sse %s", s3.ServerSideEncryptionAwsKms)
+		}
+		SSE = s3.ServerSideEncryptionAes256
+	case s3.ServerSideEncryptionAwsKms:
+		SSE = s3.ServerSideEncryptionAwsKms
+		// The ETag of an SSE-KMS object isn't the MD5 of its parts.
+		if VerifyUpload == VERIFY_MD5 {
+			return fmt.Errorf("SSE-KMS objects can't be verified by their ETag, use --verify %s", VERIFY_SHA256)
+		}
+	default:
+		return fmt.Errorf("Unsupported --sse %q, use %s or %s", SSE, s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAes256)
+	}
+	return nil
+}
+
+// serverSideEncryption is the encryption to ask S3 for, if any.
+func serverSideEncryption() *string {
+	if SSE == "" {
+		return nil
+	}
+	return aws.String(SSE)
+}
+
+func sseKMSKeyID() *string {
+	if SSEKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(SSEKMSKeyID)
+}
+
+// bucketRegion is the region GetBucketLocation's answer stands for.  Buckets
+// in us-east-1 have none, the oldest ones in eu-west-1 are in "EU".
+func bucketRegion(constraint string) string {
+	switch constraint {
+	case "":
+		return "us-east-1"
+	case s3.BucketLocationConstraintEu:
+		return "eu-west-1"
+	}
+	return constraint
+}
+
+// explainBucketError turns what S3 says when a bucket can't be used into
+// something to act on.  HeadBucket has no body, so there's only the status.
+func explainBucketError(bucket string, region string, err error) error {
+	var rerr awserr.RequestFailure
+	if !errors.As(err, &rerr) {
+		return fmt.Errorf("Can't access bucket %s: %w", bucket, err)
+	}
+	switch rerr.StatusCode() {
+	case http.StatusNotFound:
+		return fmt.Errorf("Bucket %s doesn't exist", bucket)
+	case http.StatusForbidden:
+		return fmt.Errorf("Not allowed to use bucket %s, the credentials need s3:ListBucket on it", bucket)
+	case http.StatusMovedPermanently, http.StatusBadRequest:
+		return fmt.Errorf("Bucket %s isn't in %s, set --region to the one it's in", bucket, region)
+	}
+	return fmt.Errorf("Can't access bucket %s: %w", bucket, err)
+}
+
+// checkBucket is the --check-bucket pre-flight: it makes sure the bucket
+// exists in region, reports its versioning and lifecycle rules, and tries
+// everything an upload needs, so that a missing permission fails here and
+// not with an AccessDenied on the first part.
+func checkBucket(w io.Writer, s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, region string) error {
+	if _, err := s3session.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return explainBucketError(bucket, region, err)
+	}
+
+	// S3 compatible servers answer whatever they like.
+	if S3Endpoint == "" {
+		location, err := s3session.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			fmt.Fprintf(w, "Can't tell which region %s is in, the credentials need s3:GetBucketLocation: %v\n", bucket, err)
+		} else if actual := bucketRegion(aws.StringValue(location.LocationConstraint)); actual != region {
+			return fmt.Errorf("Bucket %s is in %s, not %s; use --region %s", bucket, actual, region, actual)
+		}
+	}
+
+	versioning, err := s3session.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bucket)})
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Can't tell whether %s is versioned: %v\n", bucket, err)
+	case aws.StringValue(versioning.Status) == s3.BucketVersioningStatusEnabled:
+		fmt.Fprintln(w, "Versioning is enabled: an object uploaded again keeps its old version, which is billed too")
+	case aws.StringValue(versioning.Status) == s3.BucketVersioningStatusSuspended:
+		fmt.Fprintln(w, "Versioning is suspended")
+	default:
+		fmt.Fprintln(w, "Versioning is off")
+	}
+
+	checkLifecycle(w, s3session, bucket)
+
+	if _, err := s3session.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: aws.String(bucket), MaxUploads: aws.Int64(1)}); err != nil {
+		return fmt.Errorf("Can't list the unfinished uploads of %s to resume them, the credentials need s3:ListBucketMultipartUploads: %w", bucket, err)
+	}
+	return checkAccess(w, s3session, cleanup, bucket, aws.StringValue(uploadStorageClass()))
+}
+
+// checkLifecycle reports the bucket's lifecycle rules, and warns if none of
+// them cleans up the parts of uploads which were never finished.
+func checkLifecycle(w io.Writer, s3session s3iface.S3API, bucket string) {
+	lifecycle, err := s3session.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "NoSuchLifecycleConfiguration" {
+		lifecycle, err = &s3.GetBucketLifecycleConfigurationOutput{}, nil
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Can't read the lifecycle rules of %s: %v\n", bucket, err)
+		return
+	}
+
+	var enabled int
+	var abortsUploads bool
+	for _, rule := range lifecycle.Rules {
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled {
+			continue
+		}
+		enabled++
+		if rule.AbortIncompleteMultipartUpload != nil {
+			abortsUploads = true
+		}
+	}
+	fmt.Fprintf(w, "%d lifecycle rules are enabled\n", enabled)
+	if !abortsUploads {
+		fmt.Fprintln(w, "No lifecycle rule aborts incomplete multipart uploads: the parts of those never resumed are billed until they're aborted")
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&SSE, "sse", "", "have S3 encrypt the objects: aws:kms or AES256, instead of the bucket's default encryption")
+	rootCmd.PersistentFlags().StringVar(&SSEKMSKeyID, "sse-kms-key-id", "", "with --sse aws:kms, the KMS key to encrypt with instead of the AWS managed one")
+	rootCmd.PersistentFlags().BoolVar(&CheckBucket, "check-bucket", false, "before anything else, check the bucket exists in --region and the credentials can upload to it")
+}
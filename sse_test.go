@@ -0,0 +1,120 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckSSEFlags(t *testing.T) {
+	defer func() { SSE, SSEKMSKeyID, VerifyUpload = "", "", VERIFY_MD5 }()
+
+	for _, c := range []struct {
+		sse, keyID, verify string
+		expected           string
+		ok                 bool
+	}{
+		{"", "", VERIFY_MD5, "", true},
+		{"aes256", "", VERIFY_MD5, s3.ServerSideEncryptionAes256, true},
+		{"aws:kms", "alias/archive", VERIFY_SHA256, s3.ServerSideEncryptionAwsKms, true},
+		{"AWS:KMS", "", VERIFY_NONE, s3.ServerSideEncryptionAwsKms, true},
+		// The ETag of an SSE-KMS object is no MD5.
+		{"aws:kms", "", VERIFY_MD5, "", false},
+		{"AES256", "alias/archive", VERIFY_MD5, "", false},
+		{"", "alias/archive", VERIFY_MD5, "", false},
+		{"aws:kms:dsse", "", VERIFY_SHA256, "", false},
+	} {
+		SSE, SSEKMSKeyID, VerifyUpload = c.sse, c.keyID, c.verify
+		err := checkSSEFlags()
+		if (err == nil) != c.ok || (c.ok && SSE != c.expected) {
+			t.Errorf("--sse %q --sse-kms-key-id %q --verify %s became %q, %v", c.sse, c.keyID, c.verify, SSE, err)
+		}
+	}
+}
+
+func TestUploadSSE(t *testing.T) {
+	defer func() { SSE, SSEKMSKeyID, ChecksumAlgorithm, VerifyUpload = "", "", "", VERIFY_MD5 }()
+	SSE, SSEKMSKeyID = s3.ServerSideEncryptionAwsKms, "alias/archive"
+	ChecksumAlgorithm, VerifyUpload = s3.ChecksumAlgorithmSha256, VERIFY_SHA256
+
+	fake := newFakeS3()
+	filename := writeTestFile(t, randomData(1000))
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	obj := fake.objects["archive.bin"]
+	if obj.sse != s3.ServerSideEncryptionAwsKms || obj.kmsKeyID != "alias/archive" {
+		t.Errorf("uploaded with %q, key %q", obj.sse, obj.kmsKeyID)
+	}
+}
+
+func TestCheckBucket(t *testing.T) {
+	fake := newFakeS3()
+	fake.location = "eu-central-1"
+	fake.versioning = s3.BucketVersioningStatusEnabled
+
+	var out bytes.Buffer
+	if err := checkBucket(&out, fake, fake, "bucket", "eu-central-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Versioning is enabled", "0 lifecycle rules", "No lifecycle rule aborts", "Uploads work"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("%q not in\n%s", line, out.String())
+		}
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("left %d test uploads", len(fake.uploads))
+	}
+
+	fake.lifecycle = []*s3.LifecycleRule{{
+		Status:                         aws.String(s3.ExpirationStatusEnabled),
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(7)},
+	}}
+	out.Reset()
+	if err := checkBucket(&out, fake, fake, "bucket", "eu-central-1"); err != nil || strings.Contains(out.String(), "No lifecycle rule") {
+		t.Errorf("with a rule aborting uploads:\n%s%v", out.String(), err)
+	}
+
+	err := checkBucket(&out, fake, fake, "bucket", "us-east-1")
+	if err == nil || !strings.Contains(err.Error(), "--region eu-central-1") {
+		t.Errorf("in the wrong region: %v", err)
+	}
+}
+
+// forbiddenBucketS3 answers HeadBucket like S3 does without s3:ListBucket.
+type forbiddenBucketS3 struct {
+	*fakeS3
+}
+
+func (f forbiddenBucketS3) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "")
+}
+
+func TestCheckBucketForbidden(t *testing.T) {
+	fake := forbiddenBucketS3{newFakeS3()}
+	err := checkBucket(&bytes.Buffer{}, fake, fake, "bucket", "us-east-1")
+	if err == nil || !strings.Contains(err.Error(), "s3:ListBucket") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// CLI flags
+var StaleReadRetries int
+
+const STALE_RETRY_MAX_PAUSE = 30 * time.Second
+
+// staleRetryPause is the pause before the first reopen, doubling from there.
+var staleRetryPause = 2 * time.Second
+
+// staleSafeFile reads a file which may go away for a moment, like one on
+// NFS while the NAS fails over: a read failing with ESTALE or EIO reopens
+// the file and carries on at the same offset, which is all a part being cut
+// from it needs.  Each part gets --stale-read-retries of them, so a long
+// upload survives any number of failovers, but not a file that's gone.
+type staleSafeFile struct {
+	r        io.ReadSeekCloser
+	path     string
+	stat     os.FileInfo
+	open     func(path string) (io.ReadSeekCloser, os.FileInfo, error)
+	offset   int64
+	partSize int64
+	// retried is how often the part at offset has been reopened for.
+	retried     int
+	retriedPart int64
+}
+
+func openFile(path string) (io.ReadSeekCloser, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, stat, nil
+}
+
+// openSource opens the file an upload reads.
+func openSource(path string) (*staleSafeFile, error) {
+	return openStaleSafe(path, openFile)
+}
+
+func openStaleSafe(path string, open func(path string) (io.ReadSeekCloser, os.FileInfo, error)) (*staleSafeFile, error) {
+	r, stat, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &staleSafeFile{r: r, path: path, stat: stat, open: open}, nil
+}
+
+// SetPartSize has retries counted per part of this size rather than for
+// the whole file.
+func (f *staleSafeFile) SetPartSize(partSize int64) {
+	f.partSize = partSize
+}
+
+func (f *staleSafeFile) Stat() (os.FileInfo, error) {
+	return f.stat, nil
+}
+
+func (f *staleSafeFile) Close() error {
+	return f.r.Close()
+}
+
+func (f *staleSafeFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.r.Seek(offset, whence)
+	if err == nil {
+		f.offset = n
+	}
+	return n, err
+}
+
+func (f *staleSafeFile) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		f.offset += int64(n)
+		if !isStale(err) {
+			return n, err
+		}
+		// The next read fails again, and is retried then.
+		if n > 0 {
+			return n, nil
+		}
+		if err := f.reopen(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func isStale(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO)
+}
+
+// reopen opens the file again after cause, once it's back, and seeks to
+// where reading stopped.  A file which has changed meanwhile can't be
+// carried on with.
+func (f *staleSafeFile) reopen(cause error) error {
+	part := int64(0)
+	if f.partSize > 0 {
+		part = f.offset / f.partSize
+	}
+	if part != f.retriedPart {
+		f.retried, f.retriedPart = 0, part
+	}
+
+	for {
+		if f.retried >= StaleReadRetries {
+			return fmt.Errorf("Failed to read %s at %d: %w", f.path, f.offset, cause)
+		}
+		pause := staleRetryPause << f.retried
+		if pause > STALE_RETRY_MAX_PAUSE {
+			pause = STALE_RETRY_MAX_PAUSE
+		}
+		f.retried++
+		ui.Warnf("Reading %s failed at %d (%v), opening it again in %s\n", f.path, f.offset, cause, pause)
+		time.Sleep(pause)
+
+		f.r.Close()
+		r, stat, err := f.open(f.path)
+		if err != nil {
+			// Closing the old handle again does no harm.
+			cause = err
+			continue
+		}
+		f.r = r
+		if stat.Size() != f.stat.Size() || !stat.ModTime().Equal(f.stat.ModTime()) {
+			return fmt.Errorf("%s changed while it was being uploaded", f.path)
+		}
+		if _, err := r.Seek(f.offset, io.SeekStart); err != nil {
+			cause = err
+			continue
+		}
+		return nil
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().IntVar(&StaleReadRetries, "stale-read-retries", 5, "how often to reopen a file whose reads fail with ESTALE or EIO, e.g. on NFS during a failover, per part")
+}
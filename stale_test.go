@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyFile fails reads with ESTALE at failAt until it's been opened
+// failures times, as a file does while its NFS server fails over.
+type flakyFile struct {
+	*bytes.Reader
+	share *flakyShare
+}
+
+type flakyShare struct {
+	data     []byte
+	failAt   int64
+	failures int
+	opened   int
+	modTime  time.Time
+}
+
+type flakyInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (i flakyInfo) Size() int64        { return i.size }
+func (i flakyInfo) ModTime() time.Time { return i.modTime }
+
+func (s *flakyShare) open(path string) (io.ReadSeekCloser, os.FileInfo, error) {
+	s.opened++
+	return &flakyFile{bytes.NewReader(s.data), s}, flakyInfo{size: int64(len(s.data)), modTime: s.modTime}, nil
+}
+
+func (f *flakyFile) Read(p []byte) (int, error) {
+	offset := f.Size() - int64(f.Len())
+	if f.share.opened <= f.share.failures && offset+int64(len(p)) > f.share.failAt {
+		n, _ := f.Reader.Read(p[:f.share.failAt-offset])
+		return n, &os.PathError{Op: "read", Path: "nas", Err: syscall.ESTALE}
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *flakyFile) Close() error { return nil }
+
+func TestStaleSafeFile(t *testing.T) {
+	defer func(pause time.Duration) { staleRetryPause = pause }(staleRetryPause)
+	staleRetryPause = time.Millisecond
+
+	data := randomData(64 * 1024)
+	share := &flakyShare{data: data, failAt: 40000, failures: 3}
+	f, err := openStaleSafe("nas/vm.img", share.open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || share.opened != 4 {
+		t.Errorf("read %d bytes, opened %d times", len(got), share.opened)
+	}
+
+	// Too many failures within a part.
+	share = &flakyShare{data: data, failAt: 40000, failures: StaleReadRetries + 1}
+	f, _ = openStaleSafe("nas/vm.img", share.open)
+	if _, err := io.ReadAll(f); err == nil || !strings.Contains(err.Error(), "at 40000") {
+		t.Errorf("got %v", err)
+	}
+
+	// The file changed while the share was away.
+	share = &flakyShare{data: data, failAt: 40000, failures: 1}
+	f, _ = openStaleSafe("nas/vm.img", share.open)
+	share.modTime = time.Now()
+	if _, err := io.ReadAll(f); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// state clean flags
+var StateCleanDryRun bool
+
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the journals of unfinished uploads, and whether S3 still has the uploads",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ListState(ui.Writer(), newS3Session(Region))
+	},
+}
+
+var stateShowCmd = &cobra.Command{
+	Use:   "show key",
+	Short: "Show the journal of the unfinished upload to key in --bucket",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ShowState(ui.Writer(), newS3Session(Region), BucketName, args[0])
+	},
+}
+
+var stateCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove the journals of uploads S3 no longer has, and files left behind by crashes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return CleanState(newS3Session(Region), StateCleanDryRun)
+	},
+}
+
+// What S3 says about a journaled upload.
+const (
+	STATE_LIVE     = "live"
+	STATE_ORPHANED = "orphaned"
+	STATE_UNKNOWN  = "unknown"
+)
+
+// journalState is a journal and what became of its upload.
+type journalState struct {
+	path    string
+	journal *uploadJournal
+	status  string
+	err     error
+}
+
+// uploadStatus asks S3 whether the upload is still there.  Uploads which
+// were completed or aborted since are gone, which orphans their journals.
+func uploadStatus(s3session s3iface.S3API, journal *uploadJournal) (string, error) {
+	live := false
+	err := s3session.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(journal.Bucket),
+		Prefix: aws.String(journal.Key),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			if aws.StringValue(u.Key) == journal.Key && aws.StringValue(u.UploadId) == journal.UploadID {
+				live = true
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return STATE_UNKNOWN, err
+	}
+	if live {
+		return STATE_LIVE, nil
+	}
+	return STATE_ORPHANED, nil
+}
+
+// journalStates reads every journal and looks up its upload.  A journal
+// which can't be read is orphaned, nothing can resume it, unless it's from a
+// newer version.
+func journalStates(s3session s3iface.S3API) ([]journalState, error) {
+	paths, err := journalPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []journalState
+	for _, p := range paths {
+		state := journalState{path: p}
+		state.journal, state.err = loadJournalFile(p)
+		if errors.Is(state.err, errNewerState) {
+			state.status = STATE_UNKNOWN
+		} else if state.err != nil {
+			state.status = STATE_ORPHANED
+		} else {
+			state.status, state.err = uploadStatus(s3session, state.journal)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// done is how much of the file the journal has parts of.
+func (j *uploadJournal) done() int64 {
+	var done int64
+	for _, part := range j.Parts {
+		done += part.Size
+	}
+	return done
+}
+
+// ListState lists the journals of unfinished uploads.
+func ListState(w io.Writer, s3session s3iface.S3API) error {
+	states, err := journalStates(s3session)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var orphaned int
+	for _, s := range states {
+		if s.status == STATE_ORPHANED {
+			orphaned++
+		}
+		if s.journal == nil {
+			fmt.Fprintf(tw, "%s\t%s\t\t\t%v\n", s.status, filepath.Base(s.path), s.err)
+			continue
+		}
+		j := s.journal
+		fmt.Fprintf(tw, "%s\t%s/%s\t%s of %s\t%s\t%s\n", s.status, j.Bucket, j.Key, formatBytes(j.done()), formatBytes(j.Size), j.Filename, j.UploadID)
+		if s.err != nil {
+			fmt.Fprintf(tw, "\t  %v\n", s.err)
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d journals, %d orphaned\n", len(states), orphaned)
+	return nil
+}
+
+// ShowState shows everything about the journal of the upload to key.
+func ShowState(w io.Writer, s3session s3iface.S3API, bucket string, key string) error {
+	journal, err := loadJournal(bucket, key)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return fmt.Errorf("There's no journal of an upload to %s/%s", bucket, key)
+	}
+
+	status, err := uploadStatus(s3session, journal)
+	if err != nil {
+		status = fmt.Sprintf("%s (%v)", status, err)
+	}
+
+	fileStatus := "unchanged"
+	if stat, err := os.Stat(journal.Filename); err != nil {
+		fileStatus = err.Error()
+	} else if !journal.Matches(stat, int(journal.PartSize)) {
+		fileStatus = "changed since, the upload would start over"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Journal:\t%s\n", journal.path)
+	fmt.Fprintf(tw, "Format:\t%d\n", journal.Version)
+	fmt.Fprintf(tw, "Upload:\t%s/%s\n", journal.Bucket, journal.Key)
+	fmt.Fprintf(tw, "Upload ID:\t%s\n", journal.UploadID)
+	fmt.Fprintf(tw, "In S3:\t%s\n", status)
+	fmt.Fprintf(tw, "File:\t%s, %s\n", journal.Filename, fileStatus)
+	fmt.Fprintf(tw, "Size:\t%s, modified %s\n", formatBytes(journal.Size), journal.ModTime.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(tw, "Parts:\t%d of %s done, %s\n", len(journal.Parts), formatBytes(journal.PartSize), formatBytes(journal.done()))
+	return tw.Flush()
+}
+
+// CleanState removes the journals of uploads which are gone, and temporary
+// files a crash left in the middle of writing a state file.  Journals of
+// uploads S3 still has are kept, remove those with abort.
+func CleanState(s3session s3iface.S3API, dryRun bool) error {
+	states, err := journalStates(s3session)
+	if err != nil {
+		return err
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	more, err := filepath.Glob(filepath.Join(dir, "uploads", "*.tmp"))
+	if err != nil {
+		return err
+	}
+	leftovers = append(leftovers, more...)
+
+	var removed []string
+	for _, s := range states {
+		if s.status != STATE_ORPHANED {
+			if s.err != nil {
+				ui.Warnf("Keeping %s, we couldn't tell if S3 still has its upload: %v\n", s.path, s.err)
+			}
+			continue
+		}
+		removed = append(removed, s.path)
+	}
+	removed = append(removed, leftovers...)
+
+	for _, p := range removed {
+		if dryRun {
+			ui.Println("Would remove", p)
+			continue
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		ui.Println("Removed", p)
+	}
+	ui.Printf("%d files cleaned up, %d journals kept\n", len(removed), len(states)-len(removed)+len(leftovers))
+	return nil
+}
+
+func init() {
+	stateCleanCmd.Flags().BoolVar(&StateCleanDryRun, "dry-run", false, "only list what would be removed")
+	stateCmd.AddCommand(stateListCmd)
+	stateCmd.AddCommand(stateShowCmd)
+	stateCmd.AddCommand(stateCleanCmd)
+}
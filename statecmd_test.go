@@ -0,0 +1,77 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestStateCommands(t *testing.T) {
+	fake := newFakeS3()
+	created, _ := fake.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("live.bin")})
+
+	filename := writeTestFile(t, randomData(1000))
+	stat, _ := os.Stat(filename)
+	for key, id := range map[string]string{"live.bin": *created.UploadId, "gone.bin": "upload-gone"} {
+		journal, err := newJournal("bucket", key, filename, id, stat, PART_SIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := journal.Save(); err != nil {
+			t.Fatal(err)
+		}
+		defer journal.Remove()
+	}
+	dir, _ := stateDir()
+	leftover := dir + "/runs.json.tmp"
+	os.WriteFile(leftover, nil, 0600)
+
+	var out bytes.Buffer
+	if err := ListState(&out, fake); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "live      bucket/live.bin") || !strings.Contains(out.String(), "orphaned  bucket/gone.bin") {
+		t.Errorf("listed\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := ShowState(&out, fake, "bucket", "live.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "In S3:      live") || !strings.Contains(out.String(), "unchanged") {
+		t.Errorf("showed\n%s", out.String())
+	}
+
+	if err := CleanState(fake, false); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := loadJournal("bucket", "gone.bin"); j != nil {
+		t.Error("the orphaned journal was kept")
+	}
+	if j, _ := loadJournal("bucket", "live.bin"); j == nil {
+		t.Error("the journal of a live upload was removed")
+	}
+	if _, err := os.Stat(leftover); err == nil {
+		t.Error("the temporary file was kept")
+	}
+}
@@ -0,0 +1,194 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// STATE_VERSION is the format of the files we keep in the state directory.
+// Files written before the format had a version are version 1: the journals
+// had no version field, and the run and scrub histories were a bare list and
+// map.  A newer version of the tool reads the files of older ones, and
+// rewrites them in its own format as it saves them, so upgrading in the middle
+// of an upload still resumes it.  An older one refuses the files of newer
+// ones rather than misreading them.
+const STATE_VERSION = 2
+
+// state migrate flags
+var StateMigrateDryRun bool
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Look after the files kept between runs, like upload journals",
+}
+
+var stateMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Rewrite the files kept between runs in this version's format",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return MigrateState(StateMigrateDryRun)
+	},
+}
+
+// stateVersion is the version of a state file: the version field of a JSON
+// object, or 1 for anything without one.
+func stateVersion(data []byte) int {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return 1
+	}
+	var versioned struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil || versioned.Version == 0 {
+		return 1
+	}
+	return versioned.Version
+}
+
+// errNewerState is the error of state files from newer versions.
+var errNewerState = errors.New("upgrade to go on")
+
+// checkStateVersion refuses a state file written by a newer version.
+func checkStateVersion(p string, data []byte) (int, error) {
+	version := stateVersion(data)
+	if version > STATE_VERSION {
+		return 0, fmt.Errorf("%s was written by a newer version of s3-glacier-uploader (state format %d, this one reads up to %d), %w", p, version, STATE_VERSION, errNewerState)
+	}
+	return version, nil
+}
+
+// writeStateFile replaces a state file by a rename, so that a crash never
+// leaves half of it behind.
+func writeStateFile(p string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// stateMigration rewrites one kind of state file in the current format.
+type stateMigration struct {
+	what    string
+	paths   func() ([]string, error)
+	migrate func(p string) error
+}
+
+var stateMigrations = []stateMigration{
+	{"upload journal", journalPaths, func(p string) error {
+		journal, err := loadJournalFile(p)
+		if err != nil {
+			return err
+		}
+		return journal.Save()
+	}},
+	{"run history", func() ([]string, error) { return existingPath(runHistoryPath()) }, func(string) error {
+		history, err := loadRunHistory()
+		if err != nil {
+			return err
+		}
+		return saveRunHistory(history)
+	}},
+	{"scrub history", func() ([]string, error) { return existingPath(scrubHistoryPath()) }, func(string) error {
+		history, err := loadScrubHistory()
+		if err != nil {
+			return err
+		}
+		return saveScrubHistory(history)
+	}},
+}
+
+// existingPath is p, if there's a file there.
+func existingPath(p string, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return nil, nil
+	}
+	return []string{p}, nil
+}
+
+// MigrateState rewrites the state files of older versions in the current
+// format.  Uploads don't need it, they read the files as they are; it's for
+// converting everything at once, and checking that every file can be read.
+func MigrateState(dryRun bool) error {
+	var migrated, current int
+	for _, m := range stateMigrations {
+		paths, err := m.paths()
+		if err != nil {
+			return err
+		}
+
+		for _, p := range paths {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			version, err := checkStateVersion(p, data)
+			if err != nil {
+				return err
+			}
+			if version == STATE_VERSION {
+				current++
+				continue
+			}
+
+			if dryRun {
+				ui.Printf("Would migrate the %s %s from format %d to %d\n", m.what, p, version, STATE_VERSION)
+			} else {
+				if err := m.migrate(p); err != nil {
+					return fmt.Errorf("Failed to migrate the %s %s: %w", m.what, p, err)
+				}
+				ui.Printf("Migrated the %s %s from format %d to %d\n", m.what, p, version, STATE_VERSION)
+			}
+			migrated++
+		}
+	}
+
+	ui.Printf("%d state files migrated, %d were in format %d already\n", migrated, current, STATE_VERSION)
+	return nil
+}
+
+// journalPaths lists the journals of every unfinished upload.
+func journalPaths() ([]string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	return filepath.Glob(filepath.Join(dir, "uploads", "*.json"))
+}
+
+func init() {
+	stateMigrateCmd.Flags().BoolVar(&StateMigrateDryRun, "dry-run", false, "only list the files which would be migrated")
+	stateCmd.AddCommand(stateMigrateCmd)
+	rootCmd.AddCommand(stateCmd)
+}
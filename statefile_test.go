@@ -0,0 +1,91 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrateState(t *testing.T) {
+	journal, _ := journalPath("bucket", "old.bin")
+	runs, _ := runHistoryPath()
+	defer os.Remove(journal)
+	defer os.Remove(runs)
+
+	// Files as versions before the state format had one wrote them.
+	if err := os.WriteFile(journal, []byte(`{"bucket": "bucket", "key": "old.bin", "upload_id": "upload-1", "part_size": 52428800, "parts": [{"number": 1, "etag": "\"abc\"", "offset": 0, "size": 52428800}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(runs, []byte(`[{"bucket": "bucket", "key": "old.bin", "bytes": 1000, "seconds": 2}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// They're read as they are.
+	if j, err := loadJournal("bucket", "old.bin"); err != nil || j.UploadID != "upload-1" || len(j.Parts) != 1 {
+		t.Fatalf("got %+v, %v", j, err)
+	}
+	if history, err := loadRunHistory(); err != nil || len(history) != 1 || history[0].Bytes != 1000 {
+		t.Fatalf("got %+v, %v", history, err)
+	}
+
+	if err := MigrateState(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{journal, runs} {
+		data, _ := os.ReadFile(p)
+		if stateVersion(data) != STATE_VERSION {
+			t.Errorf("%s wasn't migrated: %s", p, data)
+		}
+	}
+	if j, err := loadJournal("bucket", "old.bin"); err != nil || j.UploadID != "upload-1" || len(j.Parts) != 1 {
+		t.Errorf("after migrating, got %+v, %v", j, err)
+	}
+	if history, err := loadRunHistory(); err != nil || len(history) != 1 || history[0].Bytes != 1000 {
+		t.Errorf("after migrating, got %+v, %v", history, err)
+	}
+
+	// A newer version's files aren't guessed at.
+	if err := os.WriteFile(journal, []byte(`{"version": 99, "upload_id": "upload-1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJournal("bucket", "old.bin"); err == nil || !strings.Contains(err.Error(), "newer version") {
+		t.Errorf("a journal of format 99 got %v", err)
+	}
+}
+
+func TestScrubHistoryVersion1(t *testing.T) {
+	p, _ := scrubHistoryPath()
+	defer os.Remove(p)
+
+	if err := os.WriteFile(p, []byte(`{"bucket/a.bin": {"checked": "2024-01-02T03:04:05Z", "result": "ok"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	history, err := loadScrubHistory()
+	if err != nil || history["bucket/a.bin"].Result != "ok" {
+		t.Fatalf("got %+v, %v", history, err)
+	}
+
+	if err := saveScrubHistory(history); err != nil {
+		t.Fatal(err)
+	}
+	history, err = loadScrubHistory()
+	if err != nil || history["bucket/a.bin"].Result != "ok" {
+		t.Errorf("after saving, got %+v, %v", history, err)
+	}
+}
@@ -0,0 +1,113 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+var StatsFile string
+
+// STATS_SCHEMA_VERSION is the version of runStats.  Fields are only ever
+// added; renaming, removing or changing the meaning of one bumps it.
+const STATS_SCHEMA_VERSION = 1
+
+// transferCommands are the commands which move data to or from S3, and
+// write --stats-file.
+var transferCommands = map[string]bool{
+	"upload":     true,
+	"sync":       true,
+	"watch":      true,
+	"dump":       true,
+	"complete":   true,
+	"compose":    true,
+	"repair-set": true,
+	"download":   true,
+	"restore":    true,
+	"verify":     true,
+	"dr-test":    true,
+}
+
+// runStats is what --stats-file gets after a transfer command, one JSON
+// object for dashboards to be built against:
+//
+//	schema_version      STATS_SCHEMA_VERSION
+//	command             the command, upload for uploading a file
+//	bucket, host        where from and to
+//	started, finished   RFC 3339 times in UTC
+//	duration_seconds    finished - started
+//	success             whether the command succeeded
+//	uploaded_bytes      bytes of PutObject and UploadPart requests
+//	uploaded_objects    PutObject and CompleteMultipartUpload requests
+//	downloaded_bytes    bytes of GetObject responses
+//	downloaded_objects  GetObject requests
+//	requests            S3 requests, each counted once however often retried
+//	retries             retries of those requests
+//	failed_requests     requests which failed after their retries
+//
+// Counts only include successful requests, apart from failed_requests.
+type runStats struct {
+	SchemaVersion     int       `json:"schema_version"`
+	Command           string    `json:"command"`
+	Bucket            string    `json:"bucket"`
+	Host              string    `json:"host"`
+	Started           time.Time `json:"started"`
+	Finished          time.Time `json:"finished"`
+	DurationSeconds   float64   `json:"duration_seconds"`
+	Success           bool      `json:"success"`
+	UploadedBytes     int64     `json:"uploaded_bytes"`
+	UploadedObjects   int64     `json:"uploaded_objects"`
+	DownloadedBytes   int64     `json:"downloaded_bytes"`
+	DownloadedObjects int64     `json:"downloaded_objects"`
+	Requests          int64     `json:"requests"`
+	Retries           int64     `json:"retries"`
+	FailedRequests    int64     `json:"failed_requests"`
+}
+
+func newRunStats(command string, bucket string, ok bool, now time.Time, counts transferCounts) runStats {
+	return runStats{
+		SchemaVersion:     STATS_SCHEMA_VERSION,
+		Command:           command,
+		Bucket:            bucket,
+		Host:              auditHost(),
+		Started:           runStarted,
+		Finished:          now.UTC(),
+		DurationSeconds:   now.Sub(runStarted).Seconds(),
+		Success:           ok,
+		UploadedBytes:     counts.UploadedBytes,
+		UploadedObjects:   counts.UploadedObjects,
+		DownloadedBytes:   counts.DownloadedBytes,
+		DownloadedObjects: counts.DownloadedObjects,
+		Requests:          counts.Requests,
+		Retries:           counts.Retries,
+		FailedRequests:    counts.FailedRequests,
+	}
+}
+
+// writeStatsFile replaces the file, it holds the last run's stats.
+func writeStatsFile(filename string, stats runStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(filename, append(data, '\n'))
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&StatsFile, "stats-file", "", "after each upload, download or other transfer, write its stats as JSON to this file")
+}
@@ -0,0 +1,58 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestRunStatsSchema guards the fields dashboards are built against.
+func TestRunStatsSchema(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "stats.json")
+	stats := newRunStats("sync", "backups", true, runStarted.Add(90*time.Second), transferCounts{UploadedBytes: 4096, UploadedObjects: 2, Requests: 7, Retries: 1})
+	if err := writeStatsFile(p, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"bucket", "command", "downloaded_bytes", "downloaded_objects", "duration_seconds", "failed_requests", "finished", "host",
+		"requests", "retries", "schema_version", "started", "success", "uploaded_bytes", "uploaded_objects"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("fields are %v", names)
+	}
+	if fields["schema_version"] != float64(STATS_SCHEMA_VERSION) || fields["duration_seconds"] != float64(90) || fields["uploaded_bytes"] != float64(4096) {
+		t.Errorf("got %s", data)
+	}
+}
@@ -0,0 +1,98 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var ExpectedSize string
+
+// STDIN as the file name uploads standard input.
+const STDIN = "-"
+
+func UploadStdin(bucket string, region string) error {
+	if isTerminal(os.Stdin) {
+		return fmt.Errorf("Standard input is a terminal, pipe what to upload into it")
+	}
+	return uploadStdin(newS3Session(region), lazyCleanup(region), bucket, os.Stdin)
+}
+
+// uploadStdin uploads a stream of unknown size, like the output of tar, in
+// parts of --part-size, or larger ones for an --expected-size that needs
+// them.
+func uploadStdin(s3session s3iface.S3API, cleanup cleanupSession, bucket string, in io.Reader) error {
+	switch {
+	case ObjectKey == "":
+		return fmt.Errorf("Standard input has no name, give the key with --key")
+	case Tar || Recompress != "":
+		return fmt.Errorf("Standard input is uploaded as it is, compress it in the pipeline instead of with --tar or --recompress")
+	case UploadID != "" || ResumeToken != "":
+		return fmt.Errorf("Standard input can't be read again, so its upload can't be resumed")
+	case Nodes > 1:
+		return fmt.Errorf("Standard input can't be shared between --nodes, a stream can only be read once")
+	case Snapshot != "" || VSS:
+		return fmt.Errorf("There's nothing to take a snapshot of on standard input")
+	}
+	return uploadNamedStream(s3session, cleanup, bucket, STDIN, "standard input", in)
+}
+
+// uploadNamedStream uploads in, which is source to --key-command and
+// --metadata-command and name in messages.
+func uploadNamedStream(s3session s3iface.S3API, cleanup cleanupSession, bucket string, source string, name string, in io.Reader) error {
+	var expected int64
+	if ExpectedSize != "" {
+		var err error
+		if expected, err = parseSize(ExpectedSize); err != nil {
+			return fmt.Errorf("Invalid --expected-size: %w", err)
+		}
+	}
+
+	key, err := uploadKey(source)
+	if err != nil {
+		return err
+	}
+	metadata, err := uploadMetadata(source)
+	if err != nil {
+		return err
+	}
+
+	input := newStreamInput(name, expected, false)
+	r := input.Reader(in)
+	if splitBytes > 0 {
+		return uploadSplit(s3session, cleanup, bucket, key, r, input, metadata)
+	}
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		metadata = encryptionMetadata(metadata, c)
+		r = encryptReader(r, c)
+	}
+
+	return uploadStream(s3session, cleanup, bucket, key, r, input, metadata, streamPartSize(expected))
+}
+
+func init() {
+	rootCmd.Flags().StringVar(&ExpectedSize, "expected-size", "", "with - or a remote file, about how much will be read, e.g. 2T, to pick parts large enough")
+}
@@ -0,0 +1,84 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUploadStdin(t *testing.T) {
+	defer func() { ObjectKey, KeyPrefix, PartSize = "", "", PART_SIZE_AUTO }()
+	ObjectKey, KeyPrefix, PartSize = "backup.tar.zst", "laptop/", "5M"
+
+	fake := newFakeS3()
+	data := randomData(2*MIN_PART_SIZE + 1024)
+	if err := uploadStdin(fake, fake.cleanup, "bucket", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["laptop/backup.tar.zst"]
+	if obj == nil {
+		t.Fatal("no object was created")
+	}
+	if !bytes.Equal(obj.data, data) {
+		t.Error("the object doesn't contain standard input")
+	}
+	if len(obj.partSizes) != 3 || obj.etag != multipartETag(data, obj.partSizes) {
+		t.Errorf("uploaded in parts of %v with ETag %s", obj.partSizes, obj.etag)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the upload is still open")
+	}
+}
+
+func TestUploadStdinEmpty(t *testing.T) {
+	defer func() { ObjectKey = "" }()
+	ObjectKey = "empty"
+
+	fake := newFakeS3()
+	if err := uploadStdin(fake, fake.cleanup, "bucket", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["empty"]; obj == nil || len(obj.data) != 0 {
+		t.Error("no empty object was created")
+	}
+}
+
+func TestUploadStdinRefused(t *testing.T) {
+	defer func() { ObjectKey, Tar, UploadID = "", false, "" }()
+
+	for _, c := range []struct {
+		set      func()
+		expected string
+	}{
+		{func() {}, "--key"},
+		{func() { ObjectKey, Tar = "backup.tar", true }, "--tar"},
+		{func() { Tar, UploadID = false, "upload-1" }, "resumed"},
+	} {
+		c.set()
+		fake := newFakeS3()
+		err := uploadStdin(fake, fake.cleanup, "bucket", strings.NewReader("data"))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("got %v, expected %s", err, c.expected)
+		}
+		if fake.nextID != 0 {
+			t.Error("started an upload")
+		}
+	}
+}
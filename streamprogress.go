@@ -0,0 +1,131 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sync/atomic"
+	"time"
+)
+
+// streamInput counts what goes into a stream.  Unlike with files, that isn't
+// what's sent when the stream is compressed: the two give the compression
+// ratio, and what's left of the input, when its size is known, is what the
+// ETA goes by.
+type streamInput struct {
+	name       string
+	total      int64
+	compressed bool
+	started    time.Time
+
+	read int64
+}
+
+func newStreamInput(name string, total int64, compressed bool) *streamInput {
+	return &streamInput{name: name, total: total, compressed: compressed, started: time.Now()}
+}
+
+type inputCounter struct {
+	r     io.Reader
+	w     io.Writer
+	input *streamInput
+}
+
+func (c *inputCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.input.read, int64(n))
+	return n, err
+}
+
+func (c *inputCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.input.read, int64(n))
+	return n, err
+}
+
+// Reader counts what's read from r, Writer what's written to w.
+func (in *streamInput) Reader(r io.Reader) io.Reader {
+	return &inputCounter{r: r, input: in}
+}
+
+func (in *streamInput) Writer(w io.Writer) io.Writer {
+	return &inputCounter{w: w, input: in}
+}
+
+func (in *streamInput) Read() int64 {
+	return atomic.LoadInt64(&in.read)
+}
+
+// Done is how much of the input has been read, up to its size: tar headers
+// make the archive a little bigger than the files in it.
+func (in *streamInput) Done() int64 {
+	read := in.Read()
+	if in.total > 0 && read > in.total {
+		return in.total
+	}
+	return read
+}
+
+// compressionRatio is the size of the output compared to the input, 0
+// while nothing has been read.
+func compressionRatio(read int64, sent int64) float64 {
+	if read <= 0 {
+		return 0
+	}
+	return float64(sent) / float64(read)
+}
+
+// streamETA predicts when the rest of the input is read, at the rate it has
+// been read so far, or returns the zero time when that can't be told.
+func streamETA(started time.Time, now time.Time, read int64, total int64) time.Time {
+	elapsed := now.Sub(started)
+	if total <= 0 || read <= 0 || elapsed <= 0 {
+		return time.Time{}
+	}
+	if read >= total {
+		return now
+	}
+	return now.Add(time.Duration(float64(elapsed) * float64(total-read) / float64(read)))
+}
+
+// describe is the progress bar's label, with the compression ratio so far.
+func (in *streamInput) describe(sent int64) string {
+	ratio := compressionRatio(in.Read(), sent)
+	if !in.compressed || ratio == 0 {
+		return "uploading"
+	}
+	return fmt.Sprintf("uploading, compressed to %.0f%%", ratio*100)
+}
+
+// treeSize adds up the files in dir, which is roughly how big a tar archive
+// of it is.  --filter-command isn't asked, so skipped files count too.
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := walkTree(dir, func(p string, entry fs.DirEntry) error {
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&size, info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
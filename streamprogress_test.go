@@ -0,0 +1,116 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompressionRatio(t *testing.T) {
+	if r := compressionRatio(0, 0); r != 0 {
+		t.Errorf("nothing read: %v", r)
+	}
+	if r := compressionRatio(400, 100); r != 0.25 {
+		t.Errorf("400 bytes compressed to 100: %v", r)
+	}
+}
+
+func TestStreamETA(t *testing.T) {
+	started := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := started.Add(10 * time.Minute)
+
+	// A quarter read in 10 minutes leaves 30.
+	if eta := streamETA(started, now, 250, 1000); !eta.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("ETA %v", eta)
+	}
+	if eta := streamETA(started, now, 250, 0); !eta.IsZero() {
+		t.Errorf("ETA %v without a size", eta)
+	}
+	if eta := streamETA(started, now, 0, 1000); !eta.IsZero() {
+		t.Errorf("ETA %v before anything was read", eta)
+	}
+	if eta := streamETA(started, now, 1100, 1000); !eta.Equal(now) {
+		t.Errorf("ETA %v past the estimated size", eta)
+	}
+}
+
+func TestStreamInput(t *testing.T) {
+	input := newStreamInput("stream", 10, true)
+
+	if _, err := io.Copy(io.Discard, input.Reader(bytes.NewReader(make([]byte, 6)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := input.Writer(io.Discard).Write(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if input.Read() != 12 || input.Done() != 10 {
+		t.Errorf("read %d, done %d", input.Read(), input.Done())
+	}
+
+	if d := input.describe(3); d != "uploading, compressed to 25%" {
+		t.Errorf("described as %q", d)
+	}
+	if d := newStreamInput("stream", 0, false).describe(3); d != "uploading" {
+		t.Errorf("uncompressed stream described as %q", d)
+	}
+}
+
+func TestTreeSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"one": 100, "a/two": 20, "a/b/three": 3} {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("one", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if size, err := treeSize(dir); err != nil || size != 123 {
+		t.Errorf("got %d, %v", size, err)
+	}
+}
+
+func TestUploadCompressedStream(t *testing.T) {
+	fake := newFakeS3()
+	data := bytes.Repeat([]byte("compresses well "), PART_SIZE/8)
+
+	input := newStreamInput("stream", int64(len(data)), true)
+	stream := pipeStream(COMPRESS_GZIP, func(w io.Writer) error {
+		_, err := io.Copy(w, input.Reader(bytes.NewReader(data)))
+		return err
+	})
+	defer stream.Close()
+
+	if err := uploadStream(fake, fake.cleanup, "bucket", "stream.gz", stream, input, nil, PART_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if input.Read() != int64(len(data)) {
+		t.Errorf("read %d of %d bytes", input.Read(), len(data))
+	}
+	if obj := fake.objects["stream.gz"]; obj == nil || len(obj.data) >= len(data)/10 {
+		t.Error("the stream wasn't uploaded compressed")
+	}
+}
@@ -0,0 +1,551 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// streamFrameSize is how much of the archive is compressed into each frame
+// of a resumable stream.  A variable, so that the tests can make it small.
+var streamFrameSize int64 = 64 << 20
+
+// errStreamChanged is what resuming a stream which doesn't come out the same
+// as before returns.
+var errStreamChanged = errors.New("The archive isn't the same as the one being uploaded")
+
+// errPartsGone is what resuming a stream whose parts S3 no longer has
+// returns.
+var errPartsGone = errors.New("S3 doesn't have all of its parts")
+
+// A --reproducible archive comes out the same every time, so an interrupted
+// upload of one can carry on from where it stopped by archiving the
+// directory again.  Compressing it all again would take as long as
+// uploading it, so it's compressed in frames, each one a complete gzip
+// member or zstd frame of its own, which decompress as one when they're
+// concatenated.  A frame can be compressed without the ones before it:
+// the checkpoint is the start of the last frame before the end of what
+// has been uploaded.
+//
+// Encrypted archives aren't resumed, the key of each upload is new, and
+// neither are split ones, or --seekable ones, whose index is made as they're
+// compressed.
+func streamResumable() bool {
+	return Tar && Reproducible && !Encrypt && !AbortOnFailure && !Seekable && splitBytes == 0
+}
+
+// frameBoundary is where a frame starts, in the archive and in what's
+// uploaded.  InputMD5 is of the archive before it, which is how a resumed
+// stream tells the archive hasn't changed without compressing it.
+type frameBoundary struct {
+	Input    int64  `json:"input"`
+	Output   int64  `json:"output"`
+	InputMD5 string `json:"input_md5,omitempty"`
+}
+
+// streamCheckpoint is where a stream resumes: the frame it was in when
+// Uploaded bytes of it had been, and the MD5 of what it was from the
+// start of the frame up to there.
+type streamCheckpoint struct {
+	Frame    frameBoundary `json:"frame"`
+	Uploaded int64         `json:"uploaded"`
+	TailMD5  string        `json:"tail_md5,omitempty"`
+}
+
+// frameLog is the boundaries a frameWriter has written, for the
+// checkpointReader reading its output.
+type frameLog struct {
+	mu         sync.Mutex
+	boundaries []frameBoundary
+}
+
+func (l *frameLog) Add(b frameBoundary) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.boundaries = append(l.boundaries, b)
+}
+
+func (l *frameLog) At(i int) (frameBoundary, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i >= len(l.boundaries) {
+		return frameBoundary{}, false
+	}
+	return l.boundaries[i], true
+}
+
+// outputCounter counts what's written to w.
+type outputCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *outputCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uncompressedFrame is a frame of an archive which isn't compressed.
+type uncompressedFrame struct {
+	io.Writer
+}
+
+func (uncompressedFrame) Close() error {
+	return nil
+}
+
+// frameWriter compresses what's written to it in frames of size, and logs
+// where each one ends.  The first skip bytes aren't written at all, they
+// were uploaded before: they're only checked against skipMD5.  With align,
+// the frames are seekable ones.
+type frameWriter struct {
+	format string
+	size   int64
+	out    *outputCounter
+	log    *frameLog
+
+	align  int64
+	index  *frameIndex
+	buffer bytes.Buffer
+
+	skip    int64
+	skipMD5 string
+
+	input    int64
+	inputMD5 hash.Hash
+	frame    io.WriteCloser
+	framed   int64
+}
+
+func newFrameWriter(w io.Writer, format string, from frameBoundary, log *frameLog) *frameWriter {
+	return &frameWriter{
+		format:   format,
+		size:     streamFrameSize,
+		out:      &outputCounter{w: w, n: from.Output},
+		log:      log,
+		skip:     from.Input,
+		skipMD5:  from.InputMD5,
+		inputMD5: md5.New(),
+	}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int64(len(p))
+
+		if f.skip > 0 {
+			if n > f.skip {
+				n = f.skip
+			}
+			f.inputMD5.Write(p[:n])
+			f.input += n
+			f.skip -= n
+			if f.skip == 0 && hex.EncodeToString(f.inputMD5.Sum(nil)) != f.skipMD5 {
+				return written, errStreamChanged
+			}
+			written += int(n)
+			p = p[n:]
+			continue
+		}
+
+		if f.frame == nil {
+			frame, err := f.startFrame()
+			if err != nil {
+				return written, err
+			}
+			f.frame = frame
+		}
+		if n > f.size-f.framed {
+			n = f.size - f.framed
+		}
+		if _, err := f.frame.Write(p[:n]); err != nil {
+			return written, err
+		}
+		f.inputMD5.Write(p[:n])
+		f.input += n
+		f.framed += n
+		written += int(n)
+		p = p[n:]
+
+		if f.framed == f.size {
+			if err := f.endFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *frameWriter) startFrame() (io.WriteCloser, error) {
+	if f.align > 0 {
+		return compressWriter(&f.buffer, f.format)
+	}
+	if f.format == "" {
+		return uncompressedFrame{f.out}, nil
+	}
+	return compressWriter(f.out, f.format)
+}
+
+// endFrame finishes the frame, so that all of it is written, before its end
+// is logged.
+func (f *frameWriter) endFrame() error {
+	if err := f.frame.Close(); err != nil {
+		return err
+	}
+	if f.align > 0 {
+		if err := f.writeSeekable(); err != nil {
+			return err
+		}
+	}
+	f.frame = nil
+	f.framed = 0
+	f.log.Add(frameBoundary{Input: f.input, Output: f.out.n, InputMD5: hex.EncodeToString(f.inputMD5.Sum(nil))})
+	return nil
+}
+
+// Close ends the last frame.  An archive which ends before what was skipped
+// can't be the same one.
+func (f *frameWriter) Close() error {
+	if f.skip > 0 {
+		return errStreamChanged
+	}
+	if f.frame == nil {
+		return nil
+	}
+	return f.endFrame()
+}
+
+// framedTarStream is tarStream, in frames starting at from.
+func framedTarStream(dir string, compress string, input *streamInput, from frameBoundary, log *frameLog) io.ReadCloser {
+	return pipeFrames(dir, input, func(w io.Writer) *frameWriter {
+		return newFrameWriter(w, compress, from, log)
+	})
+}
+
+// pipeFrames archives dir into the frameWriter frames returns in the
+// background.
+func pipeFrames(dir string, input *streamInput, frames func(io.Writer) *frameWriter) io.ReadCloser {
+	r, w := io.Pipe()
+
+	go func() {
+		frames := frames(w)
+		err := writeTar(input.Writer(frames), dir)
+		if closeErr := frames.Close(); err == nil {
+			err = closeErr
+		}
+		w.CloseWithError(err)
+	}()
+
+	return r
+}
+
+// checkpointReader follows the frames of what it reads, and the MD5 of what
+// it has read of the current one, so that a checkpoint can be taken
+// anywhere.
+type checkpointReader struct {
+	r      io.Reader
+	frames *frameLog
+	next   int
+
+	frame frameBoundary
+	pos   int64
+	tail  hash.Hash
+}
+
+func (c *checkpointReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.consume(p[:n])
+	return n, err
+}
+
+// consume hashes what was read, starting over at every frame it gets to.  A
+// frame is logged once all of it is written, so one ending before what was
+// read already has been.
+func (c *checkpointReader) consume(p []byte) {
+	for {
+		b, ok := c.frames.At(c.next)
+		if !ok || b.Output > c.pos+int64(len(p)) {
+			break
+		}
+		c.next++
+		if b.Output < c.pos {
+			continue
+		}
+		k := b.Output - c.pos
+		c.tail.Write(p[:k])
+		p = p[k:]
+		c.pos = b.Output
+		c.frame = b
+		c.tail.Reset()
+	}
+	c.tail.Write(p)
+	c.pos += int64(len(p))
+}
+
+func (c *checkpointReader) Checkpoint() streamCheckpoint {
+	c.consume(nil)
+	return streamCheckpoint{Frame: c.frame, Uploaded: c.pos, TailMD5: hex.EncodeToString(c.tail.Sum(nil))}
+}
+
+// streamResume keeps the journal of a resumable stream.  The journal has
+// the parts up to the last checkpoint which all have been uploaded.
+type streamResume struct {
+	journal *uploadJournal
+	stream  io.ReadCloser
+	reader  *checkpointReader
+	resumed []*s3.CompletedPart
+
+	checkpoints map[int64]streamCheckpoint
+	pending     map[int64]journaledPart
+	lost        bool
+}
+
+func newStreamJournal(bucket string, key string, dir string, partSize int) (*uploadJournal, error) {
+	p, err := journalPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	return &uploadJournal{
+		Bucket:   bucket,
+		Key:      key,
+		Filename: dir,
+		PartSize: int64(partSize),
+		Stream:   &streamCheckpoint{},
+		path:     p,
+	}, nil
+}
+
+// journaledStream is journaledUpload for directories: the journal of an
+// interrupted upload of dir to resume, or a new one.
+func journaledStream(cleanup cleanupSession, bucket string, key string, dir string, partSize int) (*uploadJournal, error) {
+	journal, err := loadJournal(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if journal == nil {
+		return newStreamJournal(bucket, key, dir, partSize)
+	}
+
+	startOver := func(format string, args ...interface{}) (*uploadJournal, error) {
+		if format != "" {
+			ui.Printf(format, args...)
+		}
+		if err := journal.startOver(cleanup); err != nil {
+			return nil, err
+		}
+		return newStreamJournal(bucket, key, dir, partSize)
+	}
+
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	switch {
+	case NoResume:
+		return startOver("")
+	case journal.Stream == nil || journal.Filename != dir:
+		return startOver("The interrupted upload %s to %s was of something else than %s, starting over\n", journal.UploadID, key, dir)
+	case journal.PartSize != int64(partSize):
+		return startOver("The interrupted upload %s to %s was in %s parts, not %s, starting over\n", journal.UploadID, key, formatBytes(journal.PartSize), formatBytes(int64(partSize)))
+	}
+
+	question := fmt.Sprintf("Found an interrupted upload to %s with %s done.  Resume it?", key, formatBytes(journal.Stream.Uploaded))
+	if isTerminal(os.Stdin) && !confirm(question, os.Stdin) {
+		return startOver("")
+	}
+
+	ui.Println("Found an interrupted upload, resuming it")
+	return journal, nil
+}
+
+// resumeTar archives dir again, from the checkpoint of the journal.  What
+// comes out of it up to where the upload got is checked against the
+// checkpoint, and skipped, so that reading the stream it returns carries on
+// with the part after the journaled ones.
+func resumeTar(s3session s3iface.S3API, dir string, compress string, input *streamInput, journal *uploadJournal) (*streamResume, error) {
+	resume := &streamResume{
+		journal:     journal,
+		checkpoints: map[int64]streamCheckpoint{},
+		pending:     map[int64]journaledPart{},
+	}
+
+	if journal.UploadID != "" {
+		uploaded, err := listUploadedParts(s3session, journal.Bucket, journal.Key, journal.UploadID)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range journal.Parts {
+			part := resumedPart(uploaded, int(p.Number), int(p.Size), p.MD5)
+			if part == nil {
+				return nil, fmt.Errorf("%w, part %d is missing", errPartsGone, p.Number)
+			}
+			resume.resumed = append(resume.resumed, part)
+		}
+	}
+
+	checkpoint := *journal.Stream
+	frames := &frameLog{}
+	stream := framedTarStream(dir, compress, input, checkpoint.Frame, frames)
+	buffered := bufio.NewReader(stream)
+	tail := md5.New()
+	if _, err := io.CopyN(tail, buffered, checkpoint.Uploaded-checkpoint.Frame.Output); err != nil {
+		stream.Close()
+		if err == io.EOF {
+			err = errStreamChanged
+		}
+		return nil, err
+	}
+	if checkpoint.Uploaded > 0 && hex.EncodeToString(tail.Sum(nil)) != checkpoint.TailMD5 {
+		stream.Close()
+		return nil, errStreamChanged
+	}
+	// A checkpoint at the start of a frame has no tail to compare, the
+	// archive before it is only checked once the next byte is read.
+	if _, err := buffered.Peek(1); err != nil && err != io.EOF {
+		stream.Close()
+		return nil, err
+	}
+
+	resume.stream = stream
+	resume.reader = &checkpointReader{r: buffered, frames: frames, frame: checkpoint.Frame, pos: checkpoint.Uploaded, tail: tail}
+	return resume, nil
+}
+
+// uploadResumableTar is uploadTar for archives which can be resumed.  One
+// which turns out not to be the same any more is started over.
+func uploadResumableTar(s3session s3iface.S3API, cleanup cleanupSession, bucket string, key string, dir string, compress string, total int64, metadata map[string]*string) error {
+	partSize := streamPartSize(0)
+	journal, err := journaledStream(cleanup, bucket, key, dir, partSize)
+	if err != nil {
+		return err
+	}
+
+	input := newStreamInput(dir, total, compress != "")
+	resume, err := resumeTar(s3session, dir, compress, input, journal)
+	if errors.Is(err, errStreamChanged) || errors.Is(err, errPartsGone) || isNoSuchUpload(err) {
+		ui.Printf("Can't resume the interrupted upload %s to %s, starting over.  %v\n", journal.UploadID, key, err)
+		if err := journal.startOver(cleanup); err != nil {
+			return err
+		}
+		if journal, err = newStreamJournal(bucket, key, dir, partSize); err != nil {
+			return err
+		}
+		input = newStreamInput(dir, total, compress != "")
+		resume, err = resumeTar(s3session, dir, compress, input, journal)
+	}
+	if err != nil {
+		return err
+	}
+	defer resume.stream.Close()
+
+	return uploadStreamFrom(s3session, cleanup, bucket, key, resume.reader, input, metadata, partSize, resume)
+}
+
+// CompletedParts are the parts uploaded before, and the digests of their
+// MD5s the ETag of the object is made of.
+func (r *streamResume) CompletedParts() ([]*s3.CompletedPart, []byte) {
+	var digests []byte
+	for _, p := range r.journal.Parts {
+		digest, _ := hex.DecodeString(p.MD5)
+		digests = append(digests, digest...)
+	}
+	return append([]*s3.CompletedPart(nil), r.resumed...), digests
+}
+
+func (r *streamResume) Uploaded() int64 {
+	return r.journal.Stream.Uploaded
+}
+
+// Started journals a new upload.
+func (r *streamResume) Started(uploadID string) {
+	r.journal.UploadID = uploadID
+	r.save()
+}
+
+// ReadPart takes the checkpoint at the end of the part which was just read.
+func (r *streamResume) ReadPart(partNum int) {
+	r.checkpoints[int64(partNum)] = r.reader.Checkpoint()
+}
+
+// Completed journals the part, and the parts which were waiting for it,
+// with the checkpoint after the last one.
+func (r *streamResume) Completed(part *s3.CompletedPart, size int, digest [md5.Size]byte) {
+	number := aws.Int64Value(part.PartNumber)
+	r.pending[number] = journaledPart{
+		Number: number,
+		ETag:   aws.StringValue(part.ETag),
+		Offset: (number - 1) * r.journal.PartSize,
+		Size:   int64(size),
+		MD5:    hex.EncodeToString(digest[:]),
+	}
+
+	advanced := false
+	for {
+		next := int64(len(r.journal.Parts)) + 1
+		p, ok := r.pending[next]
+		if !ok {
+			break
+		}
+		delete(r.pending, next)
+		r.journal.Parts = append(r.journal.Parts, p)
+		checkpoint := r.checkpoints[next]
+		delete(r.checkpoints, next)
+		r.journal.Stream = &checkpoint
+		advanced = true
+	}
+	if advanced {
+		r.save()
+	}
+}
+
+// save writes the journal out.  Losing it only costs the resume, so it
+// doesn't fail the upload.
+func (r *streamResume) save() {
+	if r.lost {
+		return
+	}
+	if err := r.journal.Save(); err != nil {
+		ui.Warnln("Failed to write the upload journal:", err)
+		r.lost = true
+	}
+}
+
+// Finished forgets the journal of an upload which is complete.
+func (r *streamResume) Finished() {
+	if err := r.journal.Remove(); err != nil {
+		ui.Warnln("Failed to remove the upload journal:", err)
+	}
+}
@@ -0,0 +1,202 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func framedOutput(data []byte, format string, from frameBoundary, log *frameLog) ([]byte, error) {
+	var out bytes.Buffer
+	frames := newFrameWriter(&out, format, from, log)
+	// Odd sized writes, so that they don't line up with the frames.
+	for left := data; len(left) > 0; {
+		n := 777
+		if n > len(left) {
+			n = len(left)
+		}
+		if _, err := frames.Write(left[:n]); err != nil {
+			return nil, err
+		}
+		left = left[n:]
+	}
+	err := frames.Close()
+	return out.Bytes(), err
+}
+
+func TestFrameWriter(t *testing.T) {
+	defer func(size int64) { streamFrameSize = size }(streamFrameSize)
+	streamFrameSize = 1000
+
+	data := bytes.Repeat([]byte("frames of an archive "), 250)
+	log := &frameLog{}
+	out, err := framedOutput(data, COMPRESS_GZIP, frameBoundary{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log.boundaries) != 6 || log.boundaries[5].Input != int64(len(data)) || log.boundaries[5].Output != int64(len(out)) {
+		t.Fatalf("got frames %+v", log.boundaries)
+	}
+
+	// The frames decompress as one.
+	r, err := gzip.NewReader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(r); err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("decompressed %d bytes: %v", len(decompressed), err)
+	}
+
+	// Starting at a frame compresses the rest the same.
+	from := log.boundaries[2]
+	rest, err := framedOutput(data, COMPRESS_GZIP, from, &frameLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, out[from.Output:]) {
+		t.Error("the frames after a boundary came out differently")
+	}
+
+	// Unless what comes before it has changed.
+	changed := append([]byte("F"), data[1:]...)
+	if _, err := framedOutput(changed, COMPRESS_GZIP, from, &frameLog{}); !errors.Is(err, errStreamChanged) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := framedOutput(data[:from.Input-1], COMPRESS_GZIP, from, &frameLog{}); !errors.Is(err, errStreamChanged) {
+		t.Errorf("got %v for a shorter archive", err)
+	}
+}
+
+func TestCheckpointReader(t *testing.T) {
+	data := randomData(1000)
+	log := &frameLog{boundaries: []frameBoundary{{Input: 500, Output: 300}, {Input: 1500, Output: 600}}}
+	c := &checkpointReader{r: bytes.NewReader(data), frames: log, tail: md5.New()}
+
+	buffer := make([]byte, 400)
+	if _, err := io.ReadFull(c, buffer); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := c.Checkpoint()
+	if checkpoint.Frame != log.boundaries[0] || checkpoint.Uploaded != 400 || checkpoint.TailMD5 != md5Hex(data[300:400]) {
+		t.Errorf("got %+v", checkpoint)
+	}
+
+	// A frame ending right where a part does is where the next one starts.
+	if _, err := io.ReadFull(c, buffer[:200]); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint = c.Checkpoint()
+	if checkpoint.Frame != log.boundaries[1] || checkpoint.TailMD5 != md5Hex(nil) {
+		t.Errorf("got %+v", checkpoint)
+	}
+}
+
+func resumableTree(t *testing.T) string {
+	dir := t.TempDir()
+	for i, size := range []int{PART_SIZE, 2 * PART_SIZE, PART_SIZE / 2} {
+		data := randomData(size)
+		data[0] = byte(i)
+		if err := os.WriteFile(filepath.Join(dir, string(rune('a'+i))+".bin"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func resumableSetup() {
+	Tar, Reproducible = true, true
+	streamFrameSize = 256 * 1024
+}
+
+func TestResumeTarUpload(t *testing.T) {
+	defer func(size int64) { Tar, Reproducible, Compress, streamFrameSize = false, false, "", size }(streamFrameSize)
+	resumableSetup()
+	Compress = COMPRESS_GZIP
+
+	dir := resumableTree(t)
+	fake := newFakeS3()
+	failing := &slowS3{fakeS3: fake, fail: 3}
+	if err := uploadTar(failing, fake.cleanup, "bucket", dir, COMPRESS_GZIP); err == nil {
+		t.Fatal("the upload didn't fail")
+	}
+	if len(fake.uploads) != 1 {
+		t.Fatal("the failed upload wasn't kept")
+	}
+	key := filepath.Base(dir) + ".tar.gz"
+	journal, err := loadJournal("bucket", key)
+	if err != nil || journal == nil || journal.Stream == nil || len(journal.Parts) < 2 {
+		t.Fatalf("got journal %+v: %v", journal, err)
+	}
+
+	// Part 1 failing doesn't matter any more, it's not uploaded again.
+	resumed := &slowS3{fakeS3: fake, fail: 1}
+	if err := uploadTar(resumed, fake.cleanup, "bucket", dir, COMPRESS_GZIP); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the upload wasn't resumed")
+	}
+	if journal, _ := loadJournal("bucket", key); journal != nil {
+		t.Error("the journal was left behind")
+	}
+
+	// The object is what an upload in one go would have been.
+	want, err := io.ReadAll(framedTarStream(dir, COMPRESS_GZIP, newStreamInput(dir, 0, true), frameBoundary{}, &frameLog{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects[key]; obj == nil || !bytes.Equal(obj.data, want) {
+		t.Error("the resumed object isn't the archive")
+	}
+}
+
+func TestResumeChangedTar(t *testing.T) {
+	defer func(size int64) { Tar, Reproducible, streamFrameSize = false, false, size }(streamFrameSize)
+	resumableSetup()
+
+	dir := resumableTree(t)
+	fake := newFakeS3()
+	if err := uploadTar(&slowS3{fakeS3: fake, fail: 3}, fake.cleanup, "bucket", dir, ""); err == nil {
+		t.Fatal("the upload didn't fail")
+	}
+
+	// The first file changing means the parts uploaded are of another
+	// archive: it's started over.
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), randomData(PART_SIZE+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadTar(fake, fake.cleanup, "bucket", dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(tarStream(dir, "", newStreamInput(dir, 0, false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects[filepath.Base(dir)+".tar"]; obj == nil || !bytes.Equal(obj.data, want) {
+		t.Error("the object isn't the changed archive")
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the upload of the old archive was kept")
+	}
+}
@@ -0,0 +1,550 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// sync flags
+var SyncPrefix string
+var SyncDryRun bool
+var SyncCompare string
+var SyncDelete bool
+var SyncTrash bool
+var SyncTrackRun bool
+var SyncPublish bool
+var SyncJob string
+
+const (
+	SYNC_COMPARE_MTIME    = "mtime"
+	SYNC_COMPARE_CHECKSUM = "checksum"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync directory",
+	Short: "Upload the files in a directory which aren't in the bucket yet, or have changed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cleanup s3iface.S3API
+		var err error
+		if SyncDelete && !SyncDryRun {
+			err = requireOperator("delete objects whose file is gone")
+		}
+		if SyncDelete && err == nil {
+			cleanup, err = newDestructiveS3Session(Region)
+		}
+		dir := args[0]
+		releaseSnapshot := func() {}
+		if err == nil {
+			dir, releaseSnapshot, err = sourceSnapshot(dir)
+			dir = longPath(dir)
+		}
+		syncRetrySession = func() s3iface.S3API { return newS3Session(Region) }
+		if err == nil {
+			err = Sync(newS3Session(Region), cleanup, lazyCleanup(Region), BucketName, dir, SyncPrefix, SyncCompare, SyncTrash, SyncDryRun)
+		}
+		releaseSnapshot()
+		reportRetries()
+		return err
+	},
+}
+
+// The size and modification time of the uploaded file are stored with the
+// object, so that we can tell whether a file has changed without relying on
+// when the object was uploaded.
+const (
+	SYNC_METADATA_MTIME = "source-mtime"
+	SYNC_METADATA_SIZE  = "source-size"
+)
+
+// sourceMetadata adds the size and modification time of the file to the
+// object's metadata.
+func sourceMetadata(metadata map[string]*string, info os.FileInfo) map[string]*string {
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	metadata[SYNC_METADATA_MTIME] = aws.String(info.ModTime().UTC().Format(time.RFC3339Nano))
+	metadata[SYNC_METADATA_SIZE] = aws.String(strconv.FormatInt(info.Size(), 10))
+	return metadata
+}
+
+// metadataValue looks up user metadata, whose keys come back from S3 with
+// their case changed (source-mtime turns into Source-Mtime).
+func metadataValue(metadata map[string]*string, name string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, name) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+// sourceInfo reads what sourceMetadata stored.  Objects uploaded before we
+// stored it don't have it.
+func sourceInfo(metadata map[string]*string) (int64, time.Time, bool) {
+	mtime, ok := metadataValue(metadata, SYNC_METADATA_MTIME)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	size, ok := metadataValue(metadata, SYNC_METADATA_SIZE)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, mtime)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return n, t, true
+}
+
+// localFile is a file found in the directory being synced.
+type localFile struct {
+	Path    string
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// syncKey is where a file in the directory goes: under prefix, at its path
+// relative to the directory, in its shard with --shard-prefix.
+// --key-command can say otherwise.
+func syncKey(dir string, filename string, prefix string) (string, error) {
+	if KeyCommand != "" {
+		return uploadKey(filename)
+	}
+
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(prefix, shardedName(filepath.ToSlash(rel))), nil
+}
+
+// scanDirectory finds the regular files under dir that --filter-command lets
+// through, in the order of their paths.
+func scanDirectory(dir string, prefix string) ([]localFile, error) {
+	var mu sync.Mutex
+	var files []localFile
+	err := walkTree(dir, func(filename string, entry fs.DirEntry) error {
+		if entry.Type()&fs.ModeSymlink != 0 {
+			warn(WARNING_SKIPPED, filename, "Skipping the symlink %s", filename)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		include, err := includeFile(filename)
+		if err != nil {
+			return err
+		}
+		if !include {
+			return nil
+		}
+		noteStreams(filename)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		key, err := syncKey(dir, filename, prefix)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		files = append(files, localFile{filename, key, info.Size(), info.ModTime()})
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+// fileChanged compares a file to the object it was uploaded to, by the size
+// and modification time stored with the object.  Filesystems keep times with
+// different precision, so they're compared to the second.  For objects
+// without them, an object newer than the file of the same size is taken as
+// up to date.
+func fileChanged(file localFile, obj archivedObject, metadata map[string]*string) bool {
+	if size, mtime, ok := sourceInfo(metadata); ok {
+		return size != file.Size || !mtime.Truncate(time.Second).Equal(file.ModTime.Truncate(time.Second))
+	}
+	return obj.Size != uploadedSize(file.Size) || obj.LastModified.Before(file.ModTime)
+}
+
+// syncPlan picks the files which have to be uploaded.  The bucket is listed
+// once, up front, instead of asking about every file on its own: for
+// hundreds of thousands of files the requests would take longer than the
+// upload.  Only files of the same size as their object can be unchanged, and
+// those are compared by unchanged, many at once.
+func syncPlan(files []localFile, remote map[string]archivedObject, unchanged func(localFile, archivedObject) (bool, error)) ([]localFile, error) {
+	var changed, same []localFile
+	for _, file := range files {
+		obj, ok := remote[file.Key]
+		if !ok || obj.Size != uploadedSize(file.Size) {
+			changed = append(changed, file)
+		} else {
+			same = append(same, file)
+		}
+	}
+
+	results := make([]bool, len(same))
+	errs := make(chan error, len(same))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < ListConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				ok, err := unchanged(same[j], remote[same[j].Key])
+				if err != nil {
+					errs <- fmt.Errorf("Failed to compare %s with %s: %w", same[j].Path, same[j].Key, err)
+					continue
+				}
+				results[j] = ok
+			}
+		}()
+	}
+	for j := range same {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+
+	for j, file := range same {
+		if !results[j] {
+			changed = append(changed, file)
+		}
+	}
+	return changed, nil
+}
+
+// syncComparison returns how --compare compares a file with its object.
+// Both look the object up; checksum also reads the whole file, unless cache
+// has it matching the object already.
+func syncComparison(s3session s3iface.S3API, bucket string, compare string, cache *scanCache) func(localFile, archivedObject) (bool, error) {
+	return func(file localFile, obj archivedObject) (bool, error) {
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if compare != SYNC_COMPARE_CHECKSUM {
+			return !fileChanged(file, obj, head.Metadata), nil
+		}
+
+		etag := strings.Trim(aws.StringValue(head.ETag), "\"")
+		if cache.Matched(file, etag) {
+			cache.Record(file, etag)
+			return true, nil
+		}
+
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+
+		ok, _, err := compareObject(s3session, bucket, file.Key, f, head)
+		if errors.Is(err, errUnverifiable) {
+			warn(WARNING_DOWNGRADE, file.Path, "Can't compare %s with %s by checksum, uploading it again", file.Path, file.Key)
+			return false, nil
+		}
+		if ok {
+			cache.Record(file, etag)
+		}
+		return ok, err
+	}
+}
+
+// listRemote lists what's under prefix by key, sidecars included.  Only the
+// few fields we compare are kept per object.  The trash, the uploaded audit
+// log, the run descriptors and the set pointers aren't part of what's synced.
+func listRemote(s3session s3iface.S3API, bucket string, prefix string) (map[string]archivedObject, error) {
+	remote := map[string]archivedObject{}
+	err := walkObjects(s3session, bucket, prefix, func(obj archivedObject) error {
+		if !isTrash(obj.Key) && !isAudit(obj.Key) && !isRun(obj.Key) && !isSetPointer(obj.Key) {
+			remote[obj.Key] = obj
+		}
+		return nil
+	})
+	return remote, err
+}
+
+// syncDeletions finds the objects without a file, leaving out sidecars (they
+// go with their object) and what's already in the trash.
+func syncDeletions(files []localFile, remote map[string]archivedObject, index trashIndex) []string {
+	local := map[string]bool{}
+	for _, file := range files {
+		local[file.Key] = true
+	}
+
+	var keys []string
+	for key := range remote {
+		if _, trashed := index[key]; !local[key] && !trashed && !isSidecar(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sync uploads the files in dir which have changed.  With a cleanup session,
+// objects whose file is gone are deleted, or with trash put into the trash.
+// Interrupted uploads of the files which aren't resumed are aborted with
+// aborts.
+func Sync(s3session s3iface.S3API, cleanup s3iface.S3API, aborts cleanupSession, bucket string, dir string, prefix string, compare string, trash bool, dryRun bool) error {
+	if compare != SYNC_COMPARE_MTIME && compare != SYNC_COMPARE_CHECKSUM {
+		return fmt.Errorf("--compare is either %s or %s", SYNC_COMPARE_MTIME, SYNC_COMPARE_CHECKSUM)
+	}
+	if cleanup != nil && KeyCommand != "" {
+		return fmt.Errorf("Can't tell which objects belong to the directory with --key-command, so --delete can't be used with it")
+	}
+	if trash && cleanup == nil {
+		return fmt.Errorf("--trash only goes with --delete")
+	}
+	if SyncTimeBudget < 0 {
+		return fmt.Errorf("--time-budget can't be negative")
+	}
+	if SyncFileRetries < 0 || SyncFileRetryWait < 0 {
+		return fmt.Errorf("--file-retries and --file-retry-wait can't be negative")
+	}
+
+	// The budget is for the whole run, scanning and comparing included.
+	budget := context.Background()
+	if SyncTimeBudget > 0 && !dryRun {
+		var stop func()
+		budget, stop = timeBox(SyncTimeBudget)
+		defer stop()
+	}
+
+	files, err := scanDirectory(dir, prefix)
+	if err != nil {
+		return err
+	}
+
+	// With --key-command, keys can be anywhere in the bucket.
+	listPrefix := prefix
+	if KeyCommand != "" {
+		listPrefix = ""
+	}
+	all, err := listRemote(s3session, bucket, listPrefix)
+	if err != nil {
+		return err
+	}
+	remote := map[string]archivedObject{}
+	for key, obj := range all {
+		if !isSidecar(key) {
+			remote[key] = obj
+		}
+	}
+
+	// Files which are back take their objects out of the trash, or
+	// empty-trash would delete them.
+	index, err := loadTrashIndex(s3session, bucket)
+	if err != nil {
+		return err
+	}
+	var rescued int
+	for _, file := range files {
+		if _, ok := index[file.Key]; ok {
+			delete(index, file.Key)
+			for _, sidecar := range sidecarsOf(file.Key, all) {
+				delete(index, sidecar)
+			}
+			rescued++
+		}
+	}
+	if rescued > 0 && !dryRun {
+		if err := putJSON(s3session, bucket, TRASH_INDEX_KEY, index); err != nil {
+			return fmt.Errorf("Failed to save the trash index: %w", err)
+		}
+		ui.Printf("Took %d objects out of the trash, their files are back\n", rescued)
+	}
+
+	// Files skipped for --case-collisions still keep their objects.
+	candidates, err := syncCaseCollisions(files, remote, cleanup != nil)
+	if err != nil {
+		return err
+	}
+
+	// Only reading the files is worth caching.
+	var cache *scanCache
+	if compare == SYNC_COMPARE_CHECKSUM {
+		if cache, err = loadScanCache(bucket, dir); err != nil {
+			return err
+		}
+	}
+	changed, err := syncPlan(candidates, remote, syncComparison(s3session, bucket, compare, cache))
+	if err != nil {
+		return err
+	}
+	// Losing the cache only costs reading the files again.
+	if cache != nil && !dryRun {
+		if err := cache.Save(); err != nil {
+			ui.Warnln("Failed to save the scan cache:", err)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Key < changed[j].Key
+	})
+	if SyncTimeBudget > 0 {
+		syncPriority(changed, remote)
+	}
+
+	var deletions []string
+	if cleanup != nil {
+		deletions = syncDeletions(files, remote, index)
+
+		// An empty directory, e.g. an unmounted disk, would throw away
+		// everything.
+		if len(files) == 0 && len(deletions) > 0 {
+			return fmt.Errorf("Refusing to delete all %d objects under %q, %s has no files", len(deletions), prefix, dir)
+		}
+	}
+
+	var size int64
+	for _, file := range changed {
+		size += file.Size
+	}
+	ui.Printf("%d of %d files are up to date, %d to upload (%s)\n", len(files)-len(changed), len(files), len(changed), formatBytes(size))
+	if cleanup != nil {
+		ui.Printf("%d objects have no file any more\n", len(deletions))
+	}
+
+	if dryRun {
+		return syncChanges(s3session, cleanup, aborts, bucket, changed, deletions, all, trash, budget, dryRun)
+	}
+
+	var run *runDescriptor
+	if SyncTrackRun {
+		run = newRunDescriptor(syncJob(dir), dir, prefix, changed, len(deletions))
+		previous, err := recentRuns(s3session, bucket, run.Job, RUN_HISTORY_USED)
+		if err != nil {
+			return fmt.Errorf("Failed to read the earlier runs of %s: %w", run.Job, err)
+		}
+		run.expect(previous)
+		if err := run.start(s3session, bucket); err != nil {
+			return fmt.Errorf("Failed to record the start of the run: %w", err)
+		}
+	}
+	err = syncChanges(s3session, cleanup, aborts, bucket, changed, deletions, all, trash, budget, dryRun)
+	// The run isn't complete until its set is published.  One which used
+	// up its time budget isn't complete either, but didn't fail.
+	if err == nil && SyncPublish {
+		err = publishSet(s3session, bucket, syncJob(dir), dir, prefix, listPrefix, candidates, run, time.Now())
+	}
+	if run != nil {
+		if finishErr := run.finish(s3session, bucket, err, time.Now()); finishErr != nil && err == nil {
+			err = fmt.Errorf("Failed to record the end of the run, it looks unfinished: %w", finishErr)
+		}
+	}
+	var spent *timeBudgetError
+	if errors.As(err, &spent) {
+		ui.Println(spent)
+		return nil
+	}
+	return err
+}
+
+// syncChanges uploads the changed files and deletes the objects whose files
+// are gone.  Files which fail are tried again after the others, see
+// uploadChanged.  Once budget is done, the files left are left for the next
+// run, and a *timeBudgetError says how many.
+func syncChanges(s3session s3iface.S3API, cleanup s3iface.S3API, aborts cleanupSession, bucket string, changed []localFile, deletions []string, all map[string]archivedObject, trash bool, budget context.Context, dryRun bool) error {
+	var failed []failedFile
+	var spent *timeBudgetError
+	if dryRun {
+		for _, file := range changed {
+			ui.Printf("Would upload %s to %s\n", file.Path, file.Key)
+		}
+	} else {
+		failed, spent = uploadChanged(s3session, aborts, bucket, changed, budget)
+	}
+
+	// Deletions send no data, so they're done even with the budget used up,
+	// and don't depend on the files which failed.
+	if len(deletions) > 0 {
+		if err := removeObjects(s3session, cleanup, bucket, deletions, all, trash, dryRun, time.Now()); err != nil {
+			return err
+		}
+	}
+	if spent != nil {
+		return spent
+	}
+	return failedError(failed)
+}
+
+// leftOver is what a run which used up its time budget didn't upload.
+func leftOver(files []localFile) *timeBudgetError {
+	spent := &timeBudgetError{Budget: SyncTimeBudget, Files: len(files)}
+	for _, file := range files {
+		spent.Bytes += file.Size
+	}
+	return spent
+}
+
+func init() {
+	syncCmd.Flags().StringVar(&SyncPrefix, "prefix", "", "upload under this prefix, e.g. {hostname}/")
+	syncCmd.Flags().StringVar(&SyncCompare, "compare", SYNC_COMPARE_MTIME, "how to tell whether a file has changed: mtime (size and modification time) or checksum (read every file of unchanged size)")
+	syncCmd.Flags().BoolVar(&SyncRehash, "rehash", false, "with --compare checksum, read every file again instead of trusting the scan cache")
+	syncCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts to upload in parallel")
+	syncCmd.Flags().BoolVar(&SyncDelete, "delete", false, "delete objects whose file is gone")
+	syncCmd.Flags().BoolVar(&SyncTrash, "trash", false, "with --delete, put objects into the trash instead, see empty-trash")
+	syncCmd.Flags().BoolVar(&SyncDryRun, "dry-run", false, "only show what would be uploaded")
+	syncCmd.Flags().BoolVar(&SyncTrackRun, "track-run", false, "upload a run descriptor under "+RUNS_PREFIX+" before the first file and mark it complete after the last, see the runs command")
+	syncCmd.Flags().BoolVar(&SyncPublish, "publish", false, "once every file is uploaded, point "+SETS_PREFIX+"<job>/latest.json at them, for restores to go by")
+	syncCmd.Flags().IntVar(&SyncFileRetries, "file-retries", 2, "how many more times to try files which failed to upload, after the others")
+	syncCmd.Flags().DurationVar(&SyncFileRetryWait, "file-retry-wait", time.Minute, "pause before trying failed files again, doubled before every pass after that")
+	syncCmd.Flags().DurationVar(&SyncTimeBudget, "time-budget", 0, "stop uploading after this long, e.g. 6h, and leave the rest to the next run; files the bucket doesn't have yet go first, oldest first")
+	syncCmd.Flags().StringVar(&SyncJob, "job", "", "with --track-run or --publish, the name of the job, instead of the directory's")
+	rootCmd.AddCommand(syncCmd)
+}
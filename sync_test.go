@@ -0,0 +1,182 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// writeTree creates files with the given contents under a new directory.
+func writeTree(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSyncPlan(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-24 * time.Hour)
+	files := []localFile{
+		{Key: "new"},
+		{Key: "same", Size: 10, ModTime: now.Add(-time.Hour)},
+		{Key: "grown", Size: 20, ModTime: now.Add(-time.Hour)},
+		{Key: "touched", Size: 10, ModTime: now},
+		{Key: "restored", Size: 10, ModTime: old},
+		{Key: "replaced", Size: 10, ModTime: now.Add(-time.Hour)},
+	}
+	remote := map[string]archivedObject{
+		"same":     {Key: "same", Size: 10, LastModified: now.Add(-time.Minute)},
+		"grown":    {Key: "grown", Size: 10, LastModified: now.Add(-time.Minute)},
+		"touched":  {Key: "touched", Size: 10, LastModified: now.Add(-time.Minute)},
+		"restored": {Key: "restored", Size: 10, LastModified: now.Add(-time.Minute)},
+		"replaced": {Key: "replaced", Size: 10, LastModified: now.Add(-time.Minute)},
+	}
+
+	// restored was downloaded with its original time; replaced was
+	// uploaded from a different file of the same size, before a newer
+	// one.
+	metadata := map[string]map[string]*string{
+		"restored": {"Source-Mtime": aws.String(old.UTC().Format(time.RFC3339Nano)), "Source-Size": aws.String("10")},
+		"replaced": {"Source-Mtime": aws.String(old.UTC().Format(time.RFC3339Nano)), "Source-Size": aws.String("10")},
+	}
+	var compared int32
+	unchanged := func(file localFile, obj archivedObject) (bool, error) {
+		atomic.AddInt32(&compared, 1)
+		return !fileChanged(file, obj, metadata[file.Key]), nil
+	}
+
+	changed, err := syncPlan(files, remote, unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, file := range changed {
+		keys = append(keys, file.Key)
+	}
+	if strings.Join(keys, " ") != "new grown touched replaced" {
+		t.Errorf("would upload %v", keys)
+	}
+	if compared != 4 {
+		t.Errorf("compared %d objects, only the 4 of the same size need it", compared)
+	}
+
+	failing := func(localFile, archivedObject) (bool, error) {
+		return false, errors.New("access denied")
+	}
+	if _, err := syncPlan(files, remote, failing); err == nil {
+		t.Error("a failed lookup was ignored")
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.jpg":        "a",
+		"2021/b.jpg":   "bb",
+		"2021/x/c.jpg": "ccc",
+	})
+	fake := newFakeS3()
+
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Error("a dry run uploaded files")
+	}
+
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"photos/a.jpg", "photos/2021/b.jpg", "photos/2021/x/c.jpg"} {
+		if fake.objects[key] == nil {
+			t.Errorf("%s wasn't uploaded", key)
+		}
+	}
+
+	// Nothing has changed, so nothing is uploaded.  The bucket is listed,
+	// not asked about every file.
+	uploaded := fake.nextID
+	listings := fake.listings
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded {
+		t.Errorf("%d files were uploaded again", fake.nextID-uploaded)
+	}
+	if fake.listings-listings > 4 {
+		t.Errorf("listed the bucket %d times", fake.listings-listings)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded+1 || string(fake.objects["photos/a.jpg"].data) != "changed" {
+		t.Error("the changed file wasn't uploaded")
+	}
+
+	if obj := fake.objects["photos/a.jpg"]; *obj.metadata[SYNC_METADATA_SIZE] != "7" {
+		t.Errorf("the object was stored with metadata %v", obj.metadata)
+	}
+
+	// Rewritten with the same size and time, which only a checksum notices.
+	filename := filepath.Join(dir, "2021", "b.jpg")
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("BB"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded = fake.nextID
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded {
+		t.Error("comparing times noticed the change")
+	}
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_CHECKSUM, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.nextID != uploaded+1 || string(fake.objects["photos/2021/b.jpg"].data) != "BB" {
+		t.Error("comparing checksums missed the change")
+	}
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", "content", false, false); err == nil {
+		t.Error("an unknown comparison was accepted")
+	}
+}
@@ -0,0 +1,213 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var Tags []string
+
+// retag flags
+var RetagPrefix string
+var RetagDryRun bool
+
+// S3 allows 10 tags per object, with keys of up to 128 and values of up to
+// 256 characters.
+const (
+	MAX_TAGS             = 10
+	MAX_TAG_KEY_LENGTH   = 128
+	MAX_TAG_VALUE_LENGTH = 256
+)
+
+// runStarted is what {run} in a tag value expands to, the same for every
+// object uploaded by one run.
+var runStarted = time.Now().UTC()
+
+var retagCmd = &cobra.Command{
+	Use:   "retag",
+	Short: "Add the --tag tags to objects that are already uploaded",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Retag(newS3Session(Region), BucketName, RetagPrefix, RetagDryRun)
+	},
+}
+
+func checkTags() error {
+	if len(Tags) > MAX_TAGS {
+		return fmt.Errorf("S3 allows at most %d tags per object, got %d", MAX_TAGS, len(Tags))
+	}
+
+	seen := map[string]bool{}
+	for _, spec := range Tags {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Tags look like key=value, got %q", spec)
+		}
+		key, value := parts[0], parts[1]
+		if strings.HasPrefix(key, "aws:") {
+			return fmt.Errorf("Tag keys starting with aws: are reserved")
+		}
+		if len(key) > MAX_TAG_KEY_LENGTH || len(value) > MAX_TAG_VALUE_LENGTH {
+			return fmt.Errorf("The tag %q is too long", spec)
+		}
+		if seen[key] {
+			return fmt.Errorf("The tag %s is given more than once", key)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// tagSet is the first directory of a key, the same grouping as the report.
+func tagSet(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// objectTags expands {set} and {run} in the --tag values for one key.
+func objectTags(key string) map[string]string {
+	if len(Tags) == 0 && expireAfterDays == 0 {
+		return nil
+	}
+
+	expand := strings.NewReplacer("{set}", tagSet(key), "{run}", runStarted.Format("20060102T150405Z"))
+
+	tags := map[string]string{}
+	for _, spec := range Tags {
+		parts := strings.SplitN(spec, "=", 2)
+		tags[parts[0]] = expand.Replace(parts[1])
+	}
+	if expireAfterDays > 0 {
+		tags[EXPIRE_TAG] = expiryTagValue(expireAfterDays)
+	}
+	return tags
+}
+
+// objectTagging is the tags of key in the form uploads take them.
+func objectTagging(key string) *string {
+	tags := objectTags(key)
+	if tags == nil {
+		return nil
+	}
+
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// mergeTags adds tags to the existing ones, and reports whether anything
+// changed.
+func mergeTags(existing []*s3.Tag, tags map[string]string) ([]*s3.Tag, bool) {
+	merged := map[string]string{}
+	for _, tag := range existing {
+		merged[*tag.Key] = *tag.Value
+	}
+
+	changed := false
+	for k, v := range tags {
+		if old, ok := merged[k]; !ok || old != v {
+			merged[k] = v
+			changed = true
+		}
+	}
+
+	var keys []string
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var result []*s3.Tag
+	for _, k := range keys {
+		result = append(result, &s3.Tag{Key: aws.String(k), Value: aws.String(merged[k])})
+	}
+	return result, changed
+}
+
+// Retag adds the tags to every object under prefix, keeping the tags they
+// already have.  Sidecars are tagged too, they're part of what a set costs.
+func Retag(s3session s3iface.S3API, bucket string, prefix string, dryRun bool) error {
+	if len(Tags) == 0 && expireAfterDays == 0 {
+		return fmt.Errorf("Give us some tags to add with --tag or --expire-after")
+	}
+
+	var seen, changed int
+	err := walkObjects(s3session, bucket, prefix, func(obj archivedObject) error {
+		seen++
+
+		resp, err := s3session.GetObjectTagging(&s3.GetObjectTaggingInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(obj.Key),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to read the tags of %s: %w", obj.Key, err)
+		}
+
+		tags, ok := mergeTags(resp.TagSet, objectTags(obj.Key))
+		if !ok {
+			return nil
+		}
+		if len(tags) > MAX_TAGS {
+			return fmt.Errorf("%s would end up with %d tags, S3 allows at most %d", obj.Key, len(tags), MAX_TAGS)
+		}
+
+		changed++
+		if dryRun {
+			ui.Println("Would tag", obj.Key)
+			return nil
+		}
+
+		_, err = s3session.PutObjectTagging(&s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(obj.Key),
+			Tagging: &s3.Tagging{TagSet: tags},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to tag %s: %w", obj.Key, err)
+		}
+		ui.Println("Tagged", obj.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("%d of %d objects needed new tags\n", changed, seen)
+	return nil
+}
+
+func init() {
+	retagCmd.Flags().StringVar(&RetagPrefix, "prefix", "", "only tag objects under this prefix")
+	retagCmd.Flags().BoolVar(&RetagDryRun, "dry-run", false, "only show which objects would be tagged")
+	rootCmd.AddCommand(retagCmd)
+}
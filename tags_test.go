@@ -0,0 +1,121 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckTags(t *testing.T) {
+	defer func() { Tags = nil }()
+
+	valid := [][]string{
+		nil,
+		{"project=photos"},
+		{"project={set}", "run={run}", "empty="},
+	}
+	for _, tags := range valid {
+		Tags = tags
+		if err := checkTags(); err != nil {
+			t.Errorf("%v: %s", tags, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"project"},
+		{"=photos"},
+		{"aws:project=photos"},
+		{"project=a", "project=b"},
+		{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6", "g=7", "h=8", "i=9", "j=10", "k=11"},
+	}
+	for _, tags := range invalid {
+		Tags = tags
+		if err := checkTags(); err == nil {
+			t.Errorf("%v was accepted", tags)
+		}
+	}
+}
+
+func TestObjectTags(t *testing.T) {
+	defer func() { Tags = nil }()
+
+	if objectTagging("photos/2021.tar") != nil {
+		t.Error("tagged without any --tag")
+	}
+
+	Tags = []string{"project={set}", "run={run}", "team=a&b"}
+	tags := objectTags("photos/2021.tar")
+	if tags["project"] != "photos" || tags["run"] != runStarted.Format("20060102T150405Z") || tags["team"] != "a&b" {
+		t.Errorf("got %v", tags)
+	}
+	if tags := objectTags("notes.txt"); tags["project"] != "" {
+		t.Errorf("a key without a directory is in set %q", tags["project"])
+	}
+	if got := *objectTagging("photos/2021.tar"); got != "project=photos&run="+tags["run"]+"&team=a%26b" {
+		t.Errorf("tagging is %s", got)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	existing := []*s3.Tag{{Key: aws.String("owner"), Value: aws.String("ops")}, {Key: aws.String("project"), Value: aws.String("photos")}}
+
+	if _, changed := mergeTags(existing, map[string]string{"project": "photos"}); changed {
+		t.Error("an existing tag counts as a change")
+	}
+
+	merged, changed := mergeTags(existing, map[string]string{"project": "mail", "run": "1"})
+	if !changed || len(merged) != 3 || *merged[0].Key != "owner" || *merged[1].Value != "mail" || *merged[2].Key != "run" {
+		t.Errorf("merged into %v", merged)
+	}
+}
+
+func TestUploadAndRetag(t *testing.T) {
+	defer func() { Tags = nil }()
+
+	fake := newFakeS3()
+	Tags = []string{"project=photos"}
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if tags := fake.objects["archive.bin"].tags; tags["project"] != "photos" {
+		t.Errorf("uploaded with tags %v", tags)
+	}
+
+	Tags = []string{"cost-center=42"}
+	if err := Retag(fake, "bucket", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["archive.bin"].tags["cost-center"]; ok {
+		t.Error("a dry run tagged the object")
+	}
+
+	if err := Retag(fake, "bucket", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if tags := fake.objects["archive.bin"].tags; tags["project"] != "photos" || tags["cost-center"] != "42" {
+		t.Errorf("retagged to %v", tags)
+	}
+}
+
+func TestTagsAlias(t *testing.T) {
+	if f := rootCmd.PersistentFlags().Lookup("tags"); f == nil || f.Name != "tag" {
+		t.Errorf("looked up %v", f)
+	}
+}
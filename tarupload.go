@@ -0,0 +1,635 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var Tar bool
+var Compress string
+var BagIt bool
+var Reproducible bool
+
+// sourceDate is SOURCE_DATE_EPOCH, the time --reproducible archives give all
+// their entries, if it's set.
+var sourceDate time.Time
+
+const (
+	COMPRESS_GZIP = "gzip"
+	COMPRESS_ZSTD = "zstd"
+)
+
+// Compressed uploads store the format in their metadata, for download to
+// know how to decompress them.
+const COMPRESSION_METADATA = "compression"
+
+// compressionMetadata adds format to metadata, if there is one.
+func compressionMetadata(metadata map[string]*string, format string) map[string]*string {
+	if format == "" {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	metadata[COMPRESSION_METADATA] = aws.String(format)
+	return metadata
+}
+
+func checkTarFlags() error {
+	if Compress != "" && Compress != COMPRESS_GZIP && Compress != COMPRESS_ZSTD {
+		return fmt.Errorf("--compress is either %s or %s", COMPRESS_GZIP, COMPRESS_ZSTD)
+	}
+	if Compress != "" && !Tar {
+		return fmt.Errorf("--compress only goes with --tar")
+	}
+	if BagIt && !Tar {
+		return fmt.Errorf("--bagit only goes with --tar")
+	}
+	if TarXattrs && !Tar {
+		return fmt.Errorf("--xattrs only goes with --tar")
+	}
+	if TarXattrs && !xattrsSupported {
+		return fmt.Errorf("--xattrs only works on Linux")
+	}
+	if TarWindowsACLs && !Tar {
+		return fmt.Errorf("--windows-acls only goes with --tar")
+	}
+	if TarWindowsACLs && !windowsACLsSupported {
+		return fmt.Errorf("--windows-acls only works on Windows")
+	}
+	if Reproducible && !Tar {
+		return fmt.Errorf("--reproducible only goes with --tar")
+	}
+	if Seekable && (!Tar || Compress != COMPRESS_ZSTD) {
+		return fmt.Errorf("--seekable only goes with --tar --compress %s", COMPRESS_ZSTD)
+	}
+	if Seekable && Encrypt {
+		return fmt.Errorf("--seekable doesn't go with --encrypt, the frames wouldn't decrypt on their own")
+	}
+	if Seekable && SplitSize != "" {
+		return fmt.Errorf("--seekable doesn't go with --split-size, which cuts the archive elsewhere")
+	}
+	sourceDate = time.Time{}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); Reproducible && epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q, it's seconds since 1970", epoch)
+		}
+		sourceDate = time.Unix(seconds, 0).UTC()
+	}
+	// A bag is dated, and today won't do.
+	if Reproducible && BagIt && sourceDate.IsZero() {
+		return fmt.Errorf("--reproducible --bagit needs SOURCE_DATE_EPOCH for the Bagging-Date")
+	}
+	if Tar && Nodes > 1 {
+		return fmt.Errorf("--tar can't be shared between --nodes, a stream can only be read once")
+	}
+	return nil
+}
+
+// tarKey is where a directory is archived: its name with the extension of the
+// archive, or what --key-command prints.
+func tarKey(dir string) (string, error) {
+	if KeyCommand != "" {
+		return uploadKey(dir)
+	}
+
+	key := filepath.Base(filepath.Clean(dir)) + ".tar"
+	switch Compress {
+	case COMPRESS_GZIP:
+		key += ".gz"
+	case COMPRESS_ZSTD:
+		key += ".zst"
+	}
+	return key, nil
+}
+
+// writeTar writes dir to w as a tar archive, with the directory itself as the
+// top level entry, the same as tar -C parent -c dir.  Files --filter-command
+// turns down are left out.  With --bagit, the archive is a BagIt bag.
+func writeTar(w io.Writer, dir string) error {
+	if BagIt {
+		now := time.Now()
+		if Reproducible {
+			now = sourceDate
+		}
+		return writeBag(w, dir, now)
+	}
+	dir = filepath.Clean(dir)
+	tw := tar.NewWriter(w)
+	if err := writeTarEntries(tw, dir, filepath.Base(dir), nil); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTarEntries archives what's in dir under the name prefix.  Every
+// regular file is also written to the writer file returns, if it isn't nil,
+// e.g. to hash it.  Names which only differ by case are dealt with as
+// --case-collisions says.
+func writeTarEntries(tw *tar.Writer, dir string, prefix string, file func(name string) io.Writer) error {
+	folder := newCaseFolder()
+	return filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() && p != dir && skipDir(p) {
+			return filepath.SkipDir
+		}
+
+		var link string
+		switch {
+		case info.Mode().IsRegular():
+			include, err := includeFile(p)
+			if err != nil {
+				return err
+			}
+			if !include {
+				warn(WARNING_SKIPPED, p, "Skipping %s", p)
+				return nil
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case !info.IsDir():
+			warn(WARNING_SKIPPED, p, "Skipping %s, which isn't a file, directory or link", p)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(name))
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else if other := folder.Add(hdr.Name); other != "" {
+			// Directories which only differ by case are merged on
+			// restore, it's the files in them which collide.
+			if skip, err := caseCollision(hdr.Name, other); skip || err != nil {
+				return err
+			}
+		}
+		reproducibleHeader(hdr)
+		if err := archiveXattrs(hdr, p); err != nil {
+			return fmt.Errorf("Failed to read the extended attributes of %s: %w", p, err)
+		}
+		if err := archiveSecurityDescriptor(hdr, p); err != nil {
+			return fmt.Errorf("Failed to read the security descriptor of %s: %w", p, err)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		noteStreams(p)
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var out io.Writer = tw
+		if file != nil {
+			out = io.MultiWriter(tw, file(hdr.Name))
+		}
+		// A file which grows while we read it would overrun its header.
+		if _, err := io.CopyN(out, f, hdr.Size); err != nil {
+			return fmt.Errorf("Failed to read %s: %w", p, err)
+		}
+		return nil
+	})
+}
+
+// reproducibleHeader leaves what changes without the files changing out of
+// hdr with --reproducible, so that archiving the same files again makes the
+// same archive, byte for byte: the owners, the access and change times, and
+// the modification times to SOURCE_DATE_EPOCH, or else to the second.  The
+// entries are in order already, WalkDir sorts them.  PAX is the one format
+// which takes any name and size, so the format doesn't depend on those.
+func reproducibleHeader(hdr *tar.Header) {
+	if !Reproducible {
+		return
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	if !sourceDate.IsZero() {
+		hdr.ModTime = sourceDate
+	}
+	hdr.Format = tar.FormatPAX
+}
+
+// zstdWriter compresses through the zstd program, as the standard library
+// can't.
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (z *zstdWriter) Close() error {
+	if err := z.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := z.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd failed: %w", err)
+	}
+	return nil
+}
+
+func compressWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case COMPRESS_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESS_ZSTD:
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Failed to run zstd (is it installed?): %w", err)
+		}
+		return &zstdWriter{stdin, cmd}, nil
+	}
+	return nil, fmt.Errorf("Unknown compression %s", format)
+}
+
+// tarStream archives dir, and compresses it, in the background.  Reading it
+// returns whatever error writing it ran into.  The archive is counted as
+// input before it's compressed.
+func tarStream(dir string, compress string, input *streamInput) io.ReadCloser {
+	return pipeStream(compress, func(w io.Writer) error { return writeTar(input.Writer(w), dir) })
+}
+
+// pipeStream runs write in the background and returns what it writes,
+// compressed if compress is set.
+func pipeStream(compress string, write func(io.Writer) error) io.ReadCloser {
+	r, w := io.Pipe()
+
+	go func() {
+		var out io.Writer = w
+		var compressor io.WriteCloser
+		if compress != "" {
+			var err error
+			compressor, err = compressWriter(w, compress)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			out = compressor
+		}
+
+		err := write(out)
+		if compressor != nil {
+			if closeErr := compressor.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		w.CloseWithError(err)
+	}()
+
+	return r
+}
+
+func UploadTar(bucket string, region string, dir string) error {
+	return uploadTar(newS3Session(region), lazyCleanup(region), bucket, dir, Compress)
+}
+
+// uploadTar streams dir as a tar archive straight into a multipart upload,
+// without writing the archive to disk first.
+func uploadTar(s3session s3iface.S3API, cleanup cleanupSession, bucket string, dir string, compress string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory, --tar is for directories", dir)
+	}
+
+	key, err := tarKey(dir)
+	if err != nil {
+		return err
+	}
+	metadata, err := uploadMetadata(dir)
+	if err != nil {
+		return err
+	}
+	metadata = compressionMetadata(metadata, compress)
+
+	ui.Println("Directory to upload:", dir)
+	total, err := treeSize(dir)
+	if err != nil {
+		return err
+	}
+	if streamResumable() {
+		return uploadResumableTar(s3session, cleanup, bucket, key, dir, compress, total, metadata)
+	}
+
+	input := newStreamInput(dir, total, compress != "")
+	partSize := streamPartSize(0)
+	var index *frameIndex
+	var stream io.ReadCloser
+	if Seekable {
+		index = &frameIndex{Key: key, Format: COMPRESS_ZSTD, PartSize: int64(partSize)}
+		stream = seekableTarStream(dir, input, partSize, index)
+	} else {
+		stream = tarStream(dir, compress, input)
+	}
+	defer stream.Close()
+
+	if splitBytes > 0 {
+		return uploadSplit(s3session, cleanup, bucket, key, stream, input, metadata)
+	}
+
+	var source io.Reader = stream
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		metadata = encryptionMetadata(metadata, c)
+		source = encryptReader(stream, c)
+	}
+
+	if err := uploadStream(s3session, cleanup, bucket, key, source, input, metadata, partSize); err != nil {
+		return err
+	}
+	if index != nil {
+		return saveFrameIndex(s3session, bucket, index)
+	}
+	return nil
+}
+
+// uploadStream uploads everything r returns to key, in parts of partSize.
+// The size isn't known in advance, and what has been read can't be read
+// again, so unlike files, a stream can't be resumed: when a part fails, the
+// upload is aborted with the session cleanup returns.  Progress is shown by how much of input has been read.
+func uploadStream(s3session s3iface.S3API, cleanup cleanupSession, bucket string, key string, r io.Reader, input *streamInput, metadata map[string]*string, partSize int) error {
+	return uploadStreamFrom(s3session, cleanup, bucket, key, r, input, metadata, partSize, nil)
+}
+
+// uploadStreamFrom is uploadStream, which with resume journals checkpoints
+// as parts finish, and keeps the upload for the next run to carry on from
+// the last of them instead of aborting it.
+func uploadStreamFrom(s3session s3iface.S3API, cleanup cleanupSession, bucket string, key string, r io.Reader, input *streamInput, metadata map[string]*string, partSize int, resume *streamResume) (err error) {
+	ctx, span := startSpan(interrupt, "upload", SPAN_KIND_INTERNAL, "key", key, "stream", true)
+	defer func() { span.End(err) }()
+
+	progress.Start(input.name, key, input.total, 0)
+	defer func() { progress.Finish(err) }()
+
+	metadata = partSizeMetadata(metadata, int64(partSize))
+	var uploadID string
+	if resume != nil && resume.journal.UploadID != "" {
+		uploadID = resume.journal.UploadID
+	} else {
+		createdResp, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			StorageClass:         uploadStorageClass(),
+			Metadata:             metadata,
+			ChecksumAlgorithm:    checksumAlgorithm(),
+			Tagging:              objectTagging(key),
+			ServerSideEncryption: serverSideEncryption(),
+			SSEKMSKeyId:          sseKMSKeyID(),
+		})
+		if err != nil {
+			return err
+		}
+		uploadID = *createdResp.UploadId
+		if resume != nil {
+			resume.Started(uploadID)
+		}
+	}
+	ui.Println("Upload ID:", uploadID)
+	progress.Uploading(uploadID)
+
+	abort := func(err error) error {
+		if resume != nil && !(AbortOnInterrupt && interrupted()) {
+			return fmt.Errorf("Upload %s not aborted, run again to resume it from %s.  Error: %w", uploadID, formatBytes(resume.Uploaded()), err)
+		}
+		if resume != nil {
+			resume.Finished()
+		}
+		session, abortErr := cleanup()
+		if abortErr != nil {
+			return fmt.Errorf("%w; the upload %s wasn't aborted: %v", err, uploadID, abortErr)
+		}
+		_, abortErr = session.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
+		if abortErr != nil {
+			return fmt.Errorf("%w; the upload %s wasn't aborted: %v", err, uploadID, abortErr)
+		}
+		return err
+	}
+
+	var completedParts []*s3.CompletedPart
+	var digestBytes []byte
+	var size, sent int64
+	partNum := 1
+	if resume != nil {
+		completedParts, digestBytes = resume.CompletedParts()
+		size = resume.Uploaded()
+		sent = size
+		partNum = len(completedParts) + 1
+	}
+
+	// Without the size of the input, the bar counts what's sent.
+	bar := ui.ByteBar(-1, "uploading")
+	if input.total > 0 {
+		bar = ui.ByteBar(input.total, "uploading")
+	}
+	parts := newUploader(s3session)
+
+	// Same as for files: every part in flight has a buffer of its own.
+	buffers := transfer.NewBufferPool(Concurrency, partSize)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var partErr error
+
+	for {
+		buffer := buffers.Get()
+
+		mu.Lock()
+		failed := partErr != nil
+		mu.Unlock()
+		if failed || ctx.Err() != nil {
+			break
+		}
+
+		n, err := io.ReadFull(r, buffer)
+		if err == io.EOF && partNum > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			wg.Wait()
+			return abort(fmt.Errorf("Failed to read %s: %w", key, err))
+		}
+		if partNum > MAX_PARTS {
+			wg.Wait()
+			return abort(fmt.Errorf("%s is over %s, the most S3 takes in parts of %s", key, formatBytes(int64(MAX_PARTS)*int64(partSize)), formatBytes(int64(partSize))))
+		}
+
+		data := buffer[:n]
+		db := md5.Sum(data)
+		digestBytes = append(digestBytes, db[:]...)
+		size += int64(n)
+
+		mu.Lock()
+		completedParts = append(completedParts, nil)
+		if resume != nil {
+			resume.ReadPart(partNum)
+		}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(partNum int, data []byte, db [md5.Size]byte) {
+			defer wg.Done()
+			defer buffers.Put(data)
+
+			partCtx, partSpan := startSpan(ctx, "part", SPAN_KIND_INTERNAL, "part", partNum, "size", len(data))
+			part, err := parts.UploadPart(partCtx, bucket, key, uploadID, partNum, data)
+			partSpan.End(err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if partErr == nil {
+					partErr = err
+				}
+				return
+			}
+			completedParts[partNum-1] = part
+			if resume != nil {
+				resume.Completed(part, len(data), db)
+			}
+			sent += int64(len(data))
+			if input.total > 0 {
+				bar.Set64(input.Done())
+			} else {
+				bar.Add(len(data))
+			}
+			bar.Describe(input.describe(sent))
+			progress.Streamed(input.Done(), sent, streamETA(input.started, time.Now(), input.Done(), input.total))
+		}(partNum, data, db)
+
+		partNum++
+
+		// The last part can be shorter, and an empty stream is one empty
+		// part.
+		if n < partSize {
+			break
+		}
+	}
+
+	wg.Wait()
+	if partErr == nil && ctx.Err() != nil {
+		partErr = ctx.Err()
+	}
+	if partErr != nil && resume != nil {
+		return abort(partErr)
+	}
+	if partErr != nil {
+		return abort(fmt.Errorf("Upload aborted, streams can't be resumed.  Error: %w", partErr))
+	}
+
+	etag := fmt.Sprintf("%s-%d", calculateMd5Digest(digestBytes), partNum-1)
+
+	resp, err := s3session.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	if resume != nil {
+		resume.Finished()
+	}
+
+	ui.Printf("Success!  Uploaded %s in %d parts\n", formatBytes(size), partNum-1)
+	if read := input.Read(); input.compressed && read > 0 {
+		ui.Printf("Compressed %s to %s (%.0f%%)\n", formatBytes(read), formatBytes(size), compressionRatio(read, size)*100)
+	}
+	if err := verifyCompleted(resp, etag, completedParts, fmt.Errorf("The uploaded object doesn't match what we sent")); err != nil {
+		return err
+	}
+
+	keyID, _ := metadataValue(metadata, ENCRYPTION_KEY_ID_METADATA)
+	entry := catalogEntry{
+		Bucket:          bucket,
+		Key:             key,
+		Path:            input.name,
+		Size:            size,
+		ETag:            strings.Trim(aws.StringValue(resp.ETag), "\""),
+		EncryptionKeyID: keyID,
+		SSE:             aws.StringValue(resp.ServerSideEncryption),
+		KMSKeyID:        aws.StringValue(resp.SSEKMSKeyId),
+	}
+	recordUpload(entry)
+	if err := uploadCompletionRecord(s3session, entry, uploadID); err != nil {
+		return err
+	}
+
+	ui.Println(*resp.Location)
+	return nil
+}
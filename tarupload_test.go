@@ -0,0 +1,266 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tarTree = map[string]string{
+	"a.txt":         "first",
+	"sub/b.txt":     "second",
+	"sub/deep/c.md": "third",
+}
+
+// checkExtracted compares what was extracted with tarTree, which is in the
+// top level directory named after the archived one.
+func checkExtracted(t *testing.T, dir string, name string) {
+	t.Helper()
+	for file, want := range tarTree {
+		got, err := os.ReadFile(filepath.Join(dir, name, filepath.FromSlash(file)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q %v, want %q", file, got, err, want)
+		}
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := writeTree(t, tarTree)
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := writeTar(&archive, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if _, err := extractTar(&archive, out); err != nil {
+		t.Fatal(err)
+	}
+	checkExtracted(t, out, filepath.Base(dir))
+	if link, err := os.Readlink(filepath.Join(out, filepath.Base(dir), "link")); err != nil || link != "a.txt" {
+		t.Errorf("link points to %q: %v", link, err)
+	}
+}
+
+func TestWriteTarReproducible(t *testing.T) {
+	defer func() { Tar, Reproducible, sourceDate = false, false, time.Time{} }()
+	dir := writeTree(t, tarTree)
+	archive := func() []byte {
+		t.Helper()
+		var archive bytes.Buffer
+		if err := writeTar(&archive, dir); err != nil {
+			t.Fatal(err)
+		}
+		return archive.Bytes()
+	}
+	touch := func(by time.Duration) {
+		t.Helper()
+		later := time.Now().Add(by)
+		if err := os.Chtimes(filepath.Join(dir, "a.txt"), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Tar, Reproducible = true, true
+	t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+	if err := checkTarFlags(); err != nil {
+		t.Fatal(err)
+	}
+	first := archive()
+	touch(time.Hour)
+	if !bytes.Equal(archive(), first) {
+		t.Error("touching a file changed the archive")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != 0 || hdr.Uname != "" || !hdr.ModTime.Equal(time.Unix(1000000000, 0)) {
+			t.Errorf("%s: owner %d %q, modified %v", hdr.Name, hdr.Uid, hdr.Uname, hdr.ModTime)
+		}
+	}
+
+	// Without SOURCE_DATE_EPOCH, the times are kept.
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	if err := checkTarFlags(); err != nil {
+		t.Fatal(err)
+	}
+	first = archive()
+	if !bytes.Equal(archive(), first) {
+		t.Error("archiving the same files twice made different archives")
+	}
+	touch(2 * time.Hour)
+	if bytes.Equal(archive(), first) {
+		t.Error("the time a file was modified isn't in the archive")
+	}
+}
+
+func TestUploadTar(t *testing.T) {
+	dir := writeTree(t, tarTree)
+
+	formats := []string{"", COMPRESS_GZIP}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		formats = append(formats, COMPRESS_ZSTD)
+	}
+
+	for _, format := range formats {
+		fake := newFakeS3()
+		Compress = format
+		if err := uploadTar(fake, fake.cleanup, "bucket", dir, format); err != nil {
+			t.Fatalf("%q: %v", format, err)
+		}
+		Compress = ""
+
+		key := filepath.Base(dir) + map[string]string{"": ".tar", COMPRESS_GZIP: ".tar.gz", COMPRESS_ZSTD: ".tar.zst"}[format]
+		obj := fake.objects[key]
+		if obj == nil {
+			t.Fatalf("%q: no %s in %v", format, key, fake.objects)
+		}
+
+		var archive io.Reader = bytes.NewReader(obj.data)
+		switch format {
+		case COMPRESS_GZIP:
+			gz, err := gzip.NewReader(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive = gz
+		case COMPRESS_ZSTD:
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = archive
+			data, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive = bytes.NewReader(data)
+		}
+
+		out := t.TempDir()
+		if _, err := extractTar(archive, out); err != nil {
+			t.Fatalf("%q: %v", format, err)
+		}
+		checkExtracted(t, out, filepath.Base(dir))
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	for _, size := range []int{0, PART_SIZE, 2*PART_SIZE + 10} {
+		fake := newFakeS3()
+		data := randomData(size)
+		if err := uploadStream(fake, fake.cleanup, "bucket", "stream", bytes.NewReader(data), newStreamInput("stream", 0, false), nil, PART_SIZE); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if obj := fake.objects["stream"]; obj == nil || !bytes.Equal(obj.data, data) {
+			t.Errorf("%d bytes: the object doesn't contain the stream", size)
+		}
+	}
+
+	// A stream can't be read again, so a failed upload isn't kept around.
+	fake := &slowS3{fakeS3: newFakeS3(), fail: 2}
+	if err := uploadStream(fake, fake.cleanup, "bucket", "stream", bytes.NewReader(randomData(3*PART_SIZE)), newStreamInput("stream", 0, false), nil, PART_SIZE); err == nil {
+		t.Fatal("the upload didn't fail")
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the failed upload wasn't aborted")
+	}
+}
+
+func TestUploadTarWriteOnce(t *testing.T) {
+	defer func() { WriteOnce = false }()
+	WriteOnce = true
+
+	// Nothing is deleted unless an upload fails, so --write-once doesn't
+	// get in the way.
+	fake := newFakeS3()
+	if err := uploadTar(fake, lazyCleanup("us-east-1"), "bucket", writeTree(t, tarTree), ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 1 {
+		t.Errorf("uploaded %d objects", len(fake.objects))
+	}
+
+	// A failed one is left as it is.
+	failing := &slowS3{fakeS3: newFakeS3(), fail: 2}
+	err := uploadStream(failing, lazyCleanup("us-east-1"), "bucket", "stream", bytes.NewReader(randomData(3*PART_SIZE)), newStreamInput("stream", 0, false), nil, PART_SIZE)
+	if err == nil || !strings.Contains(err.Error(), "--write-once") {
+		t.Errorf("got %v", err)
+	}
+	if len(failing.uploads) != 1 {
+		t.Error("the failed upload is gone")
+	}
+}
+
+func TestCheckTarFlags(t *testing.T) {
+	defer func() { Tar = false; Compress = ""; Reproducible = false; BagIt = false }()
+
+	for _, flags := range []struct {
+		tar          bool
+		compress     string
+		reproducible bool
+		bagit        bool
+		ok           bool
+	}{
+		{false, "", false, false, true},
+		{true, "", false, false, true},
+		{true, COMPRESS_ZSTD, false, false, true},
+		{true, "xz", false, false, false},
+		{false, COMPRESS_GZIP, false, false, false},
+		{true, "", true, false, true},
+		{false, "", true, false, false},
+		// A reproducible bag needs SOURCE_DATE_EPOCH.
+		{true, "", true, true, false},
+	} {
+		Tar, Compress, Reproducible, BagIt = flags.tar, flags.compress, flags.reproducible, flags.bagit
+		if err := checkTarFlags(); (err == nil) != flags.ok {
+			t.Errorf("--tar=%v --compress=%q --reproducible=%v --bagit=%v: %v", flags.tar, flags.compress, flags.reproducible, flags.bagit, err)
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	Tar, Compress, Reproducible, BagIt = true, "", true, false
+	if err := checkTarFlags(); err == nil {
+		t.Error("took SOURCE_DATE_EPOCH=yesterday")
+	}
+}
+
+func TestUploadDirectoryWithoutTar(t *testing.T) {
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTree(t, tarTree), ""); err == nil {
+		t.Error("uploaded a directory as a file")
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("started an upload of a directory")
+	}
+}
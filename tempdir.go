@@ -0,0 +1,107 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// CLI flags
+var TempDir string
+var MinFreeSpace string
+
+// checkTempDir points the temp dir at --temp-dir, for us and the programs we
+// run: zstd, database dumps, docker and snapshots spool there.
+func checkTempDir() error {
+	if _, err := parseSize(MinFreeSpace); err != nil {
+		return fmt.Errorf("Invalid --min-free-space: %w", err)
+	}
+	if TempDir == "" {
+		return nil
+	}
+
+	info, err := os.Stat(TempDir)
+	if err != nil {
+		return fmt.Errorf("Invalid --temp-dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("--temp-dir %s isn't a directory", TempDir)
+	}
+	vars := []string{"TMPDIR"}
+	if runtime.GOOS == "windows" {
+		vars = []string{"TMP", "TEMP"}
+	}
+	for _, name := range vars {
+		if err := os.Setenv(name, TempDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSpoolSpace fails before a stream is uploaded when the temp dir or the
+// state dir has less than --min-free-space free.  Running out halfway
+// through leaves a dump or an archive which has to be started over, as
+// streams can't be resumed.
+func checkSpoolSpace() error {
+	min, err := parseSize(MinFreeSpace)
+	if err != nil || min == 0 {
+		return err
+	}
+	state, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	for _, place := range []struct {
+		name string
+		dir  string
+		help string
+	}{
+		{"temp dir", os.TempDir(), "or use --temp-dir to spool elsewhere"},
+		{"state dir", state, "the journals and the catalog are kept there"},
+	} {
+		// Nothing spools with --in-memory.
+		if InMemory && place.name == "temp dir" {
+			continue
+		}
+		free, err := freeSpace(place.dir)
+		if err != nil {
+			ui.Warnf("Can't tell how much space is free in %s: %v\n", place.dir, err)
+			continue
+		}
+		if int64(free) < min {
+			return fmt.Errorf("Only %s is free in the %s %s, less than --min-free-space %s.  Free some space, %s", formatBytes(int64(free)), place.name, place.dir, formatBytes(min), place.help)
+		}
+	}
+	return nil
+}
+
+// checkUploadSpace checks the space for --tar and --recompress uploads.
+func checkUploadSpace() error {
+	if (!Tar && Recompress == "") || DryRun || VerifyOnly {
+		return nil
+	}
+	return checkSpoolSpace()
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&TempDir, "temp-dir", "", "directory for temporary files, ours and those of the programs we run, instead of $TMPDIR")
+	rootCmd.PersistentFlags().StringVar(&MinFreeSpace, "min-free-space", "1G", "refuse to start a --tar, --recompress or dump upload with less than this free in the temp dir or the state dir (0 not to check)")
+}
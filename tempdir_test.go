@@ -0,0 +1,58 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckTempDir(t *testing.T) {
+	defer func() { TempDir = "" }()
+	t.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+
+	TempDir = t.TempDir()
+	if err := checkTempDir(); err != nil || os.TempDir() != TempDir {
+		t.Errorf("the temp dir is %s, %v", os.TempDir(), err)
+	}
+
+	TempDir = filepath.Join(TempDir, "missing")
+	if err := checkTempDir(); err == nil {
+		t.Error("a missing --temp-dir was accepted")
+	}
+}
+
+func TestCheckSpoolSpace(t *testing.T) {
+	defer func() { MinFreeSpace = "1G" }()
+
+	MinFreeSpace = "1K"
+	if err := checkSpoolSpace(); err != nil {
+		t.Error(err)
+	}
+	MinFreeSpace = "0"
+	if err := checkSpoolSpace(); err != nil {
+		t.Error(err)
+	}
+
+	MinFreeSpace = "1000P"
+	err := checkSpoolSpace()
+	if err == nil || !strings.Contains(err.Error(), "--temp-dir") {
+		t.Errorf("got %v", err)
+	}
+}
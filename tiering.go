@@ -0,0 +1,227 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var StorageClass string
+
+// intelligent-tiering flags
+var TieringID string
+var TieringPrefix string
+var TieringArchiveDays int64
+var TieringDeepArchiveDays int64
+var TieringDelete bool
+
+// The limits S3 puts on the archive tiers of Intelligent-Tiering.
+const (
+	ARCHIVE_ACCESS_MIN_DAYS      = 90
+	DEEP_ARCHIVE_ACCESS_MIN_DAYS = 180
+	TIERING_MAX_DAYS             = 730
+)
+
+var tieringCmd = &cobra.Command{
+	Use:   "intelligent-tiering",
+	Short: "Show or set up the bucket's Intelligent-Tiering archive tiers",
+	Long: `Without flags, shows the bucket's Intelligent-Tiering archive configurations.
+With --archive-days and/or --deep-archive-days, creates or replaces the one
+called --id.  Objects only move into these tiers if they were uploaded with
+--storage-class INTELLIGENT_TIERING.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		switch {
+		case TieringDelete:
+			err = DeleteTiering(BucketName, Region, TieringID)
+		case TieringArchiveDays > 0 || TieringDeepArchiveDays > 0:
+			err = PutTiering(BucketName, Region, TieringID, TieringPrefix, TieringArchiveDays, TieringDeepArchiveDays)
+		default:
+			err = ShowTiering(newS3Session(Region), BucketName)
+		}
+		return err
+	},
+}
+
+func checkStorageClass() error {
+	if strings.EqualFold(StorageClass, STORAGE_CLASS_NONE) {
+		StorageClass = STORAGE_CLASS_NONE
+		return nil
+	}
+	if class, ok := storageClassNamed(StorageClass); ok {
+		StorageClass = class
+		return nil
+	}
+	return fmt.Errorf("Unknown --storage-class %q, use one of %s, or %s for the server's default", StorageClass, strings.Join(s3.StorageClass_Values(), ", "), STORAGE_CLASS_NONE)
+}
+
+// storageClassNamed finds a storage class regardless of case.
+func storageClassNamed(name string) (string, bool) {
+	for _, class := range s3.StorageClass_Values() {
+		if strings.EqualFold(name, class) {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+// tieringConfig builds an archive configuration, with 0 days meaning the
+// tier isn't used.
+func tieringConfig(id string, prefix string, archiveDays int64, deepArchiveDays int64) (*s3.IntelligentTieringConfiguration, error) {
+	config := &s3.IntelligentTieringConfiguration{
+		Id:     aws.String(id),
+		Status: aws.String(s3.IntelligentTieringStatusEnabled),
+	}
+	if prefix != "" {
+		config.Filter = &s3.IntelligentTieringFilter{Prefix: aws.String(prefix)}
+	}
+
+	if archiveDays > 0 {
+		if archiveDays < ARCHIVE_ACCESS_MIN_DAYS || archiveDays > TIERING_MAX_DAYS {
+			return nil, fmt.Errorf("--archive-days has to be between %d and %d", ARCHIVE_ACCESS_MIN_DAYS, TIERING_MAX_DAYS)
+		}
+		config.Tierings = append(config.Tierings, &s3.Tiering{
+			AccessTier: aws.String(s3.IntelligentTieringAccessTierArchiveAccess),
+			Days:       aws.Int64(archiveDays),
+		})
+	}
+
+	if deepArchiveDays > 0 {
+		if deepArchiveDays < DEEP_ARCHIVE_ACCESS_MIN_DAYS || deepArchiveDays > TIERING_MAX_DAYS {
+			return nil, fmt.Errorf("--deep-archive-days has to be between %d and %d", DEEP_ARCHIVE_ACCESS_MIN_DAYS, TIERING_MAX_DAYS)
+		}
+		if deepArchiveDays <= archiveDays {
+			return nil, fmt.Errorf("--deep-archive-days has to be more than --archive-days")
+		}
+		config.Tierings = append(config.Tierings, &s3.Tiering{
+			AccessTier: aws.String(s3.IntelligentTieringAccessTierDeepArchiveAccess),
+			Days:       aws.Int64(deepArchiveDays),
+		})
+	}
+
+	if len(config.Tierings) == 0 {
+		return nil, fmt.Errorf("Give --archive-days, --deep-archive-days or both")
+	}
+	return config, nil
+}
+
+func describeTiering(config *s3.IntelligentTieringConfiguration) string {
+	prefix := "the whole bucket"
+	if config.Filter != nil && config.Filter.Prefix != nil {
+		prefix = fmt.Sprintf("prefix %q", *config.Filter.Prefix)
+	} else if config.Filter != nil {
+		prefix = "a tag filter"
+	}
+
+	var tiers []string
+	for _, t := range config.Tierings {
+		tiers = append(tiers, fmt.Sprintf("%s after %d days", aws.StringValue(t.AccessTier), aws.Int64Value(t.Days)))
+	}
+
+	return fmt.Sprintf("%s (%s): %s, %s", aws.StringValue(config.Id), strings.ToLower(aws.StringValue(config.Status)), prefix, strings.Join(tiers, ", "))
+}
+
+func ShowTiering(s3session s3iface.S3API, bucket string) error {
+	var token *string
+	var count int
+
+	for {
+		resp, err := s3session.ListBucketIntelligentTieringConfigurations(&s3.ListBucketIntelligentTieringConfigurationsInput{
+			Bucket:            aws.String(bucket),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, config := range resp.IntelligentTieringConfigurationList {
+			ui.Println(describeTiering(config))
+			count++
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+
+	if count == 0 {
+		ui.Printf("%s has no Intelligent-Tiering archive configuration, objects stay in the frequent and infrequent access tiers\n", bucket)
+	}
+	return nil
+}
+
+// PutTiering replaces whatever configuration of that ID there was, so it
+// counts as destructive.
+func PutTiering(bucket string, region string, id string, prefix string, archiveDays int64, deepArchiveDays int64) error {
+	config, err := tieringConfig(id, prefix, archiveDays, deepArchiveDays)
+	if err != nil {
+		return err
+	}
+
+	s3session, err := newDestructiveS3Session(region)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.PutBucketIntelligentTieringConfiguration(&s3.PutBucketIntelligentTieringConfigurationInput{
+		Bucket:                          aws.String(bucket),
+		Id:                              aws.String(id),
+		IntelligentTieringConfiguration: config,
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Println("Configured", describeTiering(config))
+	return nil
+}
+
+func DeleteTiering(bucket string, region string, id string) error {
+	s3session, err := newDestructiveS3Session(region)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3session.DeleteBucketIntelligentTieringConfiguration(&s3.DeleteBucketIntelligentTieringConfigurationInput{
+		Bucket: aws.String(bucket),
+		Id:     aws.String(id),
+	})
+	if err != nil {
+		return err
+	}
+
+	ui.Println("Deleted", id)
+	return nil
+}
+
+func init() {
+	tieringCmd.Flags().StringVar(&TieringID, "id", "s3-glacier-uploader", "name of the configuration")
+	tieringCmd.Flags().StringVar(&TieringPrefix, "prefix", "", "only apply to objects under this prefix")
+	tieringCmd.Flags().Int64Var(&TieringArchiveDays, "archive-days", 0, "move objects to Archive Access after this many days without access (90-730)")
+	tieringCmd.Flags().Int64Var(&TieringDeepArchiveDays, "deep-archive-days", 0, "move objects to Deep Archive Access after this many days without access (180-730)")
+	tieringCmd.Flags().BoolVar(&TieringDelete, "delete", false, "delete the configuration called --id")
+	rootCmd.AddCommand(tieringCmd)
+}
@@ -0,0 +1,84 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestTieringConfig(t *testing.T) {
+	config, err := tieringConfig("archive", "photos/", 90, 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Tierings) != 2 || *config.Tierings[0].AccessTier != s3.IntelligentTieringAccessTierArchiveAccess || *config.Tierings[1].Days != 180 {
+		t.Errorf("got %v", config.Tierings)
+	}
+	if want := `archive (enabled): prefix "photos/", ARCHIVE_ACCESS after 90 days, DEEP_ARCHIVE_ACCESS after 180 days`; describeTiering(config) != want {
+		t.Errorf("described as %q", describeTiering(config))
+	}
+
+	config, err = tieringConfig("deep", "", 0, 365)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Tierings) != 1 || config.Filter != nil {
+		t.Errorf("got %v", config)
+	}
+
+	invalid := []struct{ archive, deep int64 }{
+		{0, 0},
+		{30, 0},
+		{0, 90},
+		{800, 0},
+		{200, 180},
+		{365, 365},
+	}
+	for _, test := range invalid {
+		if _, err := tieringConfig("x", "", test.archive, test.deep); err == nil {
+			t.Errorf("%d and %d days were accepted", test.archive, test.deep)
+		}
+	}
+}
+
+func TestCheckStorageClass(t *testing.T) {
+	defer func(class string) { StorageClass = class }(StorageClass)
+
+	StorageClass = s3.StorageClassIntelligentTiering
+	if err := checkStorageClass(); err != nil {
+		t.Error(err)
+	}
+
+	for _, class := range []string{"STANDARD", "STANDARD_IA", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"} {
+		StorageClass = class
+		if err := checkStorageClass(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	StorageClass = "glacier_ir"
+	if err := checkStorageClass(); err != nil || StorageClass != s3.StorageClassGlacierIr {
+		t.Errorf("glacier_ir became %q, %v", StorageClass, err)
+	}
+
+	StorageClass = "COLD"
+	if err := checkStorageClass(); err == nil {
+		t.Error("COLD was accepted")
+	}
+}
@@ -0,0 +1,70 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CLI flags
+var SyncTimeBudget time.Duration
+
+// timeBudgetError is a sync which stopped when its --time-budget was used
+// up.  It isn't a failure: the files it didn't get to are uploaded by the
+// next run, and the one it stopped in is resumed from its journal.
+type timeBudgetError struct {
+	Budget time.Duration
+	Files  int
+	Bytes  int64
+}
+
+func (e *timeBudgetError) Error() string {
+	return fmt.Sprintf("The time budget of %s is used up, %d files (%s) are left for the next run", e.Budget, e.Files, formatBytes(e.Bytes))
+}
+
+// timeBox makes uploads stop once budget is up, as they do on Ctrl-C,
+// leaving the one in flight to be resumed.  Call stop when done.
+func timeBox(budget time.Duration) (ctx context.Context, stop func()) {
+	saved := interrupt
+	ctx, cancel := context.WithTimeout(saved, budget)
+	interrupt = ctx
+	return ctx, func() {
+		cancel()
+		interrupt = saved
+	}
+}
+
+// syncPriority orders the files to upload for a run which may not get
+// through them all: files the bucket has no copy of at all go before those
+// with an older copy, and within each, the ones which have waited longest
+// go first.
+func syncPriority(changed []localFile, remote map[string]archivedObject) {
+	sort.SliceStable(changed, func(i, j int) bool {
+		_, iOld := remote[changed[i].Key]
+		_, jOld := remote[changed[j].Key]
+		if iOld != jOld {
+			return jOld
+		}
+		if !changed[i].ModTime.Equal(changed[j].ModTime) {
+			return changed[i].ModTime.Before(changed[j].ModTime)
+		}
+		return changed[i].Key < changed[j].Key
+	})
+}
@@ -0,0 +1,91 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncPriority(t *testing.T) {
+	now := time.Now()
+	changed := []localFile{
+		{Key: "a", ModTime: now},
+		{Key: "b", ModTime: now.Add(-time.Hour)},
+		{Key: "c", ModTime: now.Add(-2 * time.Hour)},
+		{Key: "d", ModTime: now},
+	}
+	remote := map[string]archivedObject{"c": {Key: "c"}, "d": {Key: "d"}}
+
+	syncPriority(changed, remote)
+	var order string
+	for _, file := range changed {
+		order += file.Key
+	}
+	if order != "bacd" {
+		t.Errorf("uploaded in the order %s, want bacd", order)
+	}
+}
+
+func TestSyncTimeBudget(t *testing.T) {
+	SyncTrackRun = true
+	SyncTimeBudget = time.Nanosecond
+	defer func() {
+		SyncTrackRun = false
+		SyncTimeBudget = 0
+	}()
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb"})
+	fake := newFakeS3()
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["photos/a.jpg"] != nil || fake.objects["photos/b.jpg"] != nil {
+		t.Error("files were uploaded after the budget was used up")
+	}
+	if interrupted() {
+		t.Error("the budget outlived the run")
+	}
+
+	key := runKey(filepath.Base(dir), runStarted, auditHost())
+	var run runDescriptor
+	if found, err := getJSON(fake, "bucket", key, &run); !found || err != nil {
+		t.Fatalf("no run descriptor at %s: %v", key, err)
+	}
+	if run.Status != RUN_PARTIAL || run.Error == "" {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	// The next run, with time to spare, uploads what's left.
+	SyncTimeBudget = time.Hour
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["photos/a.jpg"] == nil || fake.objects["photos/b.jpg"] == nil {
+		t.Error("the files left over weren't uploaded")
+	}
+	getJSON(fake, "bucket", key, &run)
+	if run.Status != RUN_COMPLETE {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	SyncTimeBudget = -time.Hour
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err == nil {
+		t.Error("a negative budget was accepted")
+	}
+}
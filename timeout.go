@@ -0,0 +1,103 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CLI flags
+var WaitTimeout time.Duration
+var CommandTimeout time.Duration
+
+// EXIT_TIMEOUT is the exit code of a command which ran out of time, the
+// same as timeout(1)'s, so that schedulers can tell it from a failure,
+// which exits with 1.
+const EXIT_TIMEOUT = 124
+
+// timeoutError is a wait, or a whole command, which gave up when the time
+// flag allows for it ran out.
+type timeoutError struct {
+	What string
+	Flag string
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("Gave up %s, %s ran out", e.What, e.Flag)
+}
+
+// exitCode is what a command which failed with err exits with.
+func exitCode(err error) int {
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		return EXIT_TIMEOUT
+	}
+	return 1
+}
+
+// waitLimit is when polling for something gives up, and the flag which set
+// it.  A zero Deadline waits for as long as it takes.
+type waitLimit struct {
+	Deadline time.Time
+	Flag     string
+}
+
+// waitUntil is the limit of a wait which starts at start: timeout, given
+// by flag, or --wait-timeout, whichever runs out first.  Zero is no limit.
+func waitUntil(start time.Time, timeout time.Duration, flag string) waitLimit {
+	var limit waitLimit
+	if timeout > 0 {
+		limit = waitLimit{start.Add(timeout), flag}
+	}
+	if WaitTimeout > 0 && (limit.Deadline.IsZero() || start.Add(WaitTimeout).Before(limit.Deadline)) {
+		limit = waitLimit{start.Add(WaitTimeout), "--wait-timeout"}
+	}
+	return limit
+}
+
+// Check fails when waiting interval more would take us past the limit.
+func (l waitLimit) Check(interval time.Duration, what string) error {
+	if !l.Deadline.IsZero() && time.Now().Add(interval).After(l.Deadline) {
+		return &timeoutError{What: what, Flag: l.Flag}
+	}
+	return nil
+}
+
+// startCommandTimeout ends the command once --command-timeout is up, the
+// way a scheduler's kill would, but saying why, with its metrics written
+// and EXIT_TIMEOUT.  An upload in flight is left to be resumed from its
+// journal.
+func startCommandTimeout() {
+	if CommandTimeout <= 0 {
+		return
+	}
+	time.AfterFunc(CommandTimeout, func() {
+		exit(&timeoutError{What: "the command", Flag: "--command-timeout"})
+	})
+}
+
+func checkTimeouts() error {
+	if WaitTimeout < 0 {
+		return fmt.Errorf("--wait-timeout can't be negative")
+	}
+	if CommandTimeout < 0 {
+		return fmt.Errorf("--command-timeout can't be negative")
+	}
+	return nil
+}
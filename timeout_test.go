@@ -0,0 +1,91 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestWaitUntil(t *testing.T) {
+	defer func() { WaitTimeout = 0 }()
+	start := time.Now()
+
+	if limit := waitUntil(start, 0, ""); !limit.Deadline.IsZero() {
+		t.Errorf("no timeouts, but a limit of %+v", limit)
+	}
+	if limit := waitUntil(start, time.Hour, "--timeout"); !limit.Deadline.Equal(start.Add(time.Hour)) || limit.Flag != "--timeout" {
+		t.Errorf("--timeout 1h is a limit of %+v", limit)
+	}
+
+	WaitTimeout = time.Minute
+	if limit := waitUntil(start, time.Hour, "--timeout"); !limit.Deadline.Equal(start.Add(time.Minute)) || limit.Flag != "--wait-timeout" {
+		t.Errorf("--wait-timeout 1m is a limit of %+v", limit)
+	}
+	WaitTimeout = 2 * time.Hour
+	if limit := waitUntil(start, time.Hour, "--timeout"); limit.Flag != "--timeout" {
+		t.Errorf("the later --wait-timeout won: %+v", limit)
+	}
+
+	limit := waitUntil(time.Now(), time.Second, "--timeout")
+	if err := limit.Check(time.Millisecond, "waiting"); err != nil {
+		t.Error(err)
+	}
+	err := limit.Check(time.Minute, "waiting for the restore of a")
+	if err == nil || err.Error() != "Gave up waiting for the restore of a, --timeout ran out" {
+		t.Errorf("got %v", err)
+	}
+	if code := exitCode(fmt.Errorf("dr-test: %w", err)); code != EXIT_TIMEOUT {
+		t.Errorf("a timeout exits with %d", code)
+	}
+	if code := exitCode(fmt.Errorf("failed")); code != 1 {
+		t.Errorf("a failure exits with %d", code)
+	}
+}
+
+func TestRestoreWaitTimeout(t *testing.T) {
+	defer func() { WaitTimeout = 0 }()
+
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["archive.bin"].storageClass = s3.StorageClassDeepArchive
+	fake.restoreHeads = 1000
+
+	WaitTimeout = 20 * time.Millisecond
+	err := Restore(fake, "bucket", "archive.bin", s3.TierBulk, 1, true, 5*time.Millisecond, "")
+	if exitCode(err) != EXIT_TIMEOUT {
+		t.Errorf("waiting forever for a restore ended with %v", err)
+	}
+}
+
+func TestTimeoutFlags(t *testing.T) {
+	defer func() { WaitTimeout, CommandTimeout = 0, 0 }()
+
+	WaitTimeout = -time.Second
+	if err := checkTimeouts(); err == nil {
+		t.Error("a negative --wait-timeout was accepted")
+	}
+	WaitTimeout, CommandTimeout = 0, -time.Second
+	if err := checkTimeouts(); err == nil {
+		t.Error("a negative --command-timeout was accepted")
+	}
+}
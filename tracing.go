@@ -0,0 +1,270 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// CLI flags
+var OTLPEndpoint string
+
+// How often finished spans are sent to the collector.
+const TRACE_FLUSH_INTERVAL = 5 * time.Second
+
+// We send spans to an OpenTelemetry collector ourselves, in the OTLP/HTTP JSON
+// encoding, rather than pulling in the whole OpenTelemetry SDK for a handful
+// of spans: one per file, one per part and one per attempt, and below those,
+// one per S3 request including the SDK's own retries.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+}
+
+// OTLP span kinds
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT   = 3
+)
+
+type spanKey struct{}
+
+// tracer collects finished spans until they're flushed.  It's nil unless
+// --otlp-endpoint was given, and all the span functions do nothing then.
+type tracer struct {
+	mu       sync.Mutex
+	endpoint string
+	root     *span
+	finished []map[string]interface{}
+	// S3 requests don't carry anything we could hang their span off, so
+	// they're looked up by the request.
+	requests sync.Map
+}
+
+var tracing *tracer
+
+func startTracing(endpoint string, name string) {
+	tracing = &tracer{endpoint: endpoint + "/v1/traces"}
+	_, tracing.root = startSpan(context.Background(), name, SPAN_KIND_INTERNAL)
+
+	go func() {
+		for range time.Tick(TRACE_FLUSH_INTERVAL) {
+			tracing.flush()
+		}
+	}()
+}
+
+// stopTracing ends the span of the whole run and sends everything left.
+func stopTracing() {
+	if tracing == nil {
+		return
+	}
+	tracing.root.End(nil)
+	tracing.flush()
+}
+
+// startSpan starts a span below the one in ctx, or below the span of the
+// whole run.
+func startSpan(ctx context.Context, name string, kind int, attributes ...interface{}) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+	rand.Read(s.spanID[:])
+
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		parent = tracing.root
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.attributes[attributes[i].(string)] = attributes[i+1]
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// traceUpload is the uploader package's Tracer: the parts of an upload, and
+// the attempts at them, in spans of their own.
+func traceUpload(ctx context.Context, name string, attributes ...interface{}) (context.Context, func(error, ...interface{})) {
+	ctx, s := startSpan(ctx, name, SPAN_KIND_INTERNAL, attributes...)
+	return ctx, func(err error, attributes ...interface{}) {
+		for i := 0; i+1 < len(attributes); i += 2 {
+			s.SetAttribute(attributes[i].(string), attributes[i+1])
+		}
+		s.End(err)
+	}
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+// End finishes the span, marking it as failed if err isn't nil.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	var attributes []map[string]interface{}
+	for key, value := range s.attributes {
+		attributes = append(attributes, map[string]interface{}{"key": key, "value": otlpValue(value)})
+	}
+
+	status := map[string]interface{}{"code": 1}
+	if err != nil {
+		status = map[string]interface{}{"code": 2, "message": err.Error()}
+	}
+
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        attributes,
+		"status":            status,
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+
+	tracing.mu.Lock()
+	tracing.finished = append(tracing.finished, encoded)
+	tracing.mu.Unlock()
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{
+					"key":   "service.name",
+					"value": otlpValue("s3-glacier-uploader"),
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "s3-glacier-uploader"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		ui.Warnln("Failed to encode spans:", err)
+		return
+	}
+
+	// Tracing must never get in the way of the upload, so failures are
+	// only reported.
+	resp, err := http.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		ui.Warnln("Failed to send spans:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		ui.Warnln("Failed to send spans:", resp.Status)
+	}
+}
+
+// traceRequests adds a span for every attempt of every S3 request of the
+// session.  The span starts once the request is signed, after any wait for
+// --request-rate.
+func traceRequests(handlers *request.Handlers) {
+	if tracing == nil {
+		return
+	}
+
+	handlers.Sign.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		_, s := startSpan(r.Context(), "S3."+r.Operation.Name, SPAN_KIND_CLIENT,
+			"rpc.system", "aws-api", "rpc.service", "S3", "rpc.method", r.Operation.Name, "retry", r.RetryCount)
+		tracing.requests.Store(r, s)
+	})
+
+	handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+		value, ok := tracing.requests.LoadAndDelete(r)
+		if !ok {
+			return
+		}
+		s := value.(*span)
+		if r.HTTPResponse != nil && r.HTTPResponse.StatusCode != 0 {
+			s.SetAttribute("http.status_code", r.HTTPResponse.StatusCode)
+		}
+		if r.RequestID != "" {
+			s.SetAttribute("aws.request_id", r.RequestID)
+		}
+		s.End(r.Error)
+	})
+
+	// Requests which fail before they're sent skip CompleteAttempt.
+	handlers.Complete.PushBack(func(r *request.Request) {
+		if value, ok := tracing.requests.LoadAndDelete(r); ok {
+			value.(*span).End(r.Error)
+		}
+	})
+}
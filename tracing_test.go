@@ -0,0 +1,124 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collectSpans points tracing at a collector which keeps what it's sent.
+func collectSpans(t *testing.T) func() []map[string]interface{} {
+	var mu sync.Mutex
+	var spans []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&payload) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, resource := range payload.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	// Like startTracing, without flushing in the background.
+	tracing = &tracer{endpoint: collector.URL + "/v1/traces"}
+	_, tracing.root = startSpan(context.Background(), "run", SPAN_KIND_INTERNAL)
+	t.Cleanup(func() { tracing = nil })
+
+	return func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func TestTraceUpload(t *testing.T) {
+	collected := collectSpans(t)
+
+	ctx, endPart := traceUpload(context.Background(), "part", "part", 1)
+	_, endAttempt := traceUpload(ctx, "attempt", "try", 0)
+	endAttempt(errors.New("connection reset by peer"), "stalled", false)
+	endPart(nil)
+	stopTracing()
+
+	byName := map[string]map[string]interface{}{}
+	for _, s := range collected() {
+		byName[s["name"].(string)] = s
+	}
+	run, part, attempt := byName["run"], byName["part"], byName["attempt"]
+	if run == nil || part == nil || attempt == nil {
+		t.Fatalf("got spans %v", byName)
+	}
+
+	if part["parentSpanId"] != run["spanId"] || attempt["parentSpanId"] != part["spanId"] {
+		t.Error("the attempt isn't below the part below the run")
+	}
+	if attempt["traceId"] != run["traceId"] {
+		t.Error("the spans aren't in one trace")
+	}
+	if status := attempt["status"].(map[string]interface{}); status["code"] != 2.0 || status["message"] != "connection reset by peer" {
+		t.Errorf("failed attempt with status %v", status)
+	}
+	if status := part["status"].(map[string]interface{}); status["code"] != 1.0 {
+		t.Errorf("part with status %v", status)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	// Without --otlp-endpoint, spans cost nothing and go nowhere.
+	ctx, end := traceUpload(context.Background(), "part")
+	if ctx.Value(spanKey{}) != nil {
+		t.Error("a span was started without tracing")
+	}
+	end(nil, "stalled", false)
+	stopTracing()
+}
+
+func TestOTLPValue(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  string
+	}{
+		{3, `{"intValue":"3"}`},
+		{int64(1) << 40, `{"intValue":"1099511627776"}`},
+		{true, `{"boolValue":true}`},
+		{"S3", `{"stringValue":"S3"}`},
+	} {
+		got, _ := json.Marshal(otlpValue(test.value))
+		if string(got) != test.want {
+			t.Errorf("%v encoded as %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// transitions flags
+var TransitionsPrefix string
+
+var transitionsCmd = &cobra.Command{
+	Use:   "transitions",
+	Short: "Show what the bucket's lifecycle rules will do to the objects under a prefix",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Transitions(newS3Session(Region), BucketName, TransitionsPrefix, time.Now())
+	},
+}
+
+// Lifecycle rules only ever move objects down this list.
+var storageClassRank = map[string]int{
+	s3.StorageClassStandard:           0,
+	s3.StorageClassReducedRedundancy:  0,
+	s3.StorageClassIntelligentTiering: 1,
+	s3.StorageClassStandardIa:         2,
+	s3.StorageClassOnezoneIa:          3,
+	s3.StorageClassGlacierIr:          4,
+	s3.StorageClassGlacier:            5,
+	s3.StorageClassDeepArchive:        6,
+}
+
+// How long objects are billed for at least, even if they're deleted sooner.
+var minimumStorageDays = map[string]int{
+	s3.StorageClassStandardIa:  30,
+	s3.StorageClassOnezoneIa:   30,
+	s3.StorageClassGlacierIr:   90,
+	s3.StorageClassGlacier:     90,
+	s3.StorageClassDeepArchive: 180,
+}
+
+// lifecycleEvent is something a rule will do to an object.
+type lifecycleEvent struct {
+	When   time.Time
+	Action string
+	Rule   string
+	Key    string
+	Size   int64
+}
+
+// lifecycleFilter pulls the prefix, size limits and whether there are tags
+// out of a rule, wherever they're written.
+func lifecycleFilter(rule *s3.LifecycleRule) (prefix string, greater int64, less int64, tagged bool) {
+	prefix = aws.StringValue(rule.Prefix)
+
+	if f := rule.Filter; f != nil {
+		if f.Prefix != nil {
+			prefix = *f.Prefix
+		}
+		greater, less = aws.Int64Value(f.ObjectSizeGreaterThan), aws.Int64Value(f.ObjectSizeLessThan)
+		tagged = f.Tag != nil
+
+		if a := f.And; a != nil {
+			if a.Prefix != nil {
+				prefix = *a.Prefix
+			}
+			greater, less = aws.Int64Value(a.ObjectSizeGreaterThan), aws.Int64Value(a.ObjectSizeLessThan)
+			tagged = len(a.Tags) > 0
+		}
+	}
+	return
+}
+
+// ruleApplies tells whether an enabled rule covers the object.  We don't
+// look up object tags, so rules filtering by tag are assumed to apply.
+func ruleApplies(rule *s3.LifecycleRule, obj archivedObject) bool {
+	if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled {
+		return false
+	}
+
+	prefix, greater, less, _ := lifecycleFilter(rule)
+	if !strings.HasPrefix(obj.Key, prefix) {
+		return false
+	}
+	if greater > 0 && obj.Size <= greater {
+		return false
+	}
+	if less > 0 && obj.Size >= less {
+		return false
+	}
+	return true
+}
+
+// lifecycleDate is when a rule acting after the given number of days gets to
+// an object: S3 counts from the upload and rounds up to the next midnight
+// UTC.
+func lifecycleDate(modified time.Time, days int64) time.Time {
+	t := modified.UTC().AddDate(0, 0, int(days))
+	midnight := t.Truncate(24 * time.Hour)
+	if t.After(midnight) {
+		midnight = midnight.Add(24 * time.Hour)
+	}
+	return midnight
+}
+
+func ruleName(rule *s3.LifecycleRule) string {
+	if rule.ID != nil && *rule.ID != "" {
+		return *rule.ID
+	}
+	return "(unnamed)"
+}
+
+// lifecycleEvents lists what the rules will do to the current versions of
+// the objects, in order.
+func lifecycleEvents(objects []archivedObject, rules []*s3.LifecycleRule) []lifecycleEvent {
+	var events []lifecycleEvent
+
+	for _, obj := range objects {
+		for _, rule := range rules {
+			if !ruleApplies(rule, obj) {
+				continue
+			}
+
+			for _, t := range rule.Transitions {
+				class := aws.StringValue(t.StorageClass)
+				if storageClassRank[class] <= storageClassRank[obj.StorageClass] {
+					continue
+				}
+
+				when := aws.TimeValue(t.Date)
+				if t.Days != nil {
+					when = lifecycleDate(obj.LastModified, *t.Days)
+				}
+				events = append(events, lifecycleEvent{when, "move to " + class, ruleName(rule), obj.Key, obj.Size})
+			}
+
+			if e := rule.Expiration; e != nil && (e.Days != nil || e.Date != nil) {
+				when := aws.TimeValue(e.Date)
+				if e.Days != nil {
+					when = lifecycleDate(obj.LastModified, *e.Days)
+				}
+				events = append(events, lifecycleEvent{when, "delete", ruleName(rule), obj.Key, obj.Size})
+			}
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].When.Before(events[j].When)
+	})
+	return events
+}
+
+// lifecycleWarnings points out rules which work against the archive.
+func lifecycleWarnings(objects []archivedObject, rules []*s3.LifecycleRule, events []lifecycleEvent, prefix string) []string {
+	var warnings []string
+
+	aborts := false
+	for _, rule := range rules {
+		rulePrefix, _, _, tagged := lifecycleFilter(rule)
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled {
+			continue
+		}
+		if rule.AbortIncompleteMultipartUpload != nil && strings.HasPrefix(prefix, rulePrefix) && !tagged {
+			aborts = true
+		}
+		if tagged {
+			warnings = append(warnings, fmt.Sprintf("Rule %s filters by tag, which we don't check; it's shown as if it applied to everything", ruleName(rule)))
+		}
+	}
+	if !aborts {
+		warnings = append(warnings, "No rule aborts incomplete multipart uploads, so the parts of failed uploads are billed until someone aborts them")
+	}
+
+	modified := map[string]archivedObject{}
+	for _, obj := range objects {
+		modified[obj.Key] = obj
+	}
+
+	early := map[string]bool{}
+	archived := map[string]bool{}
+	for _, e := range events {
+		obj := modified[e.Key]
+		if e.Action == "delete" && !early[e.Rule] {
+			if days := minimumStorageDays[obj.StorageClass]; days > 0 && e.When.Sub(obj.LastModified) < time.Duration(days)*24*time.Hour {
+				warnings = append(warnings, fmt.Sprintf("Rule %s deletes %s objects before their %d day minimum, which is billed anyway", e.Rule, obj.StorageClass, days))
+				early[e.Rule] = true
+			}
+		}
+		if isSidecar(e.Key) && strings.HasPrefix(e.Action, "move to") && isArchived(strings.TrimPrefix(e.Action, "move to ")) && !archived[e.Rule] {
+			warnings = append(warnings, fmt.Sprintf("Rule %s archives part manifests and signatures, which breaks --base, verify and --verify-key", e.Rule))
+			archived[e.Rule] = true
+		}
+	}
+
+	return warnings
+}
+
+func Transitions(s3session s3iface.S3API, bucket string, prefix string, now time.Time) error {
+	var rules []*s3.LifecycleRule
+
+	resp, err := s3session.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "NoSuchLifecycleConfiguration" {
+		ui.Printf("%s has no lifecycle rules, objects stay where they were uploaded\n", bucket)
+	} else if err != nil {
+		return err
+	} else {
+		rules = resp.Rules
+	}
+
+	// Sidecars are included on purpose, rules apply to them too.
+	objects, err := listAll(s3session, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	events := lifecycleEvents(objects, rules)
+	if len(rules) > 0 && len(events) == 0 {
+		ui.Printf("None of the %d objects will be moved or deleted\n", len(objects))
+	}
+
+	// One line per day, action and rule.  Whatever is overdue, because S3
+	// hasn't got round to it yet, goes on one line too.
+	type group struct {
+		label, action, rule string
+		count               int
+		size                int64
+	}
+	var groups []*group
+	index := map[string]*group{}
+
+	for _, e := range events {
+		label := e.When.Format("2006-01-02")
+		if e.When.Before(now) {
+			label = "due"
+		}
+
+		id := label + "\x00" + e.Action + "\x00" + e.Rule
+		g, ok := index[id]
+		if !ok {
+			g = &group{label: label, action: e.Action, rule: e.Rule}
+			index[id] = g
+			groups = append(groups, g)
+		}
+		g.count++
+		g.size += e.Size
+	}
+
+	for _, g := range groups {
+		ui.Printf("%-10s  %-26s  %6d objects  %10s  rule %s\n", g.label, g.action, g.count, formatBytes(g.size), g.rule)
+	}
+
+	for _, warning := range lifecycleWarnings(objects, rules, events, prefix) {
+		ui.Println("Warning:", warning)
+	}
+
+	return nil
+}
+
+func init() {
+	transitionsCmd.Flags().StringVar(&TransitionsPrefix, "prefix", "", "only look at objects under this prefix")
+	rootCmd.AddCommand(transitionsCmd)
+}
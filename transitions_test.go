@@ -0,0 +1,93 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLifecycleDate(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 15, 30, 0, 0, time.UTC)
+	if got, want := lifecycleDate(modified, 30), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	midnight := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got, want := lifecycleDate(midnight, 1), time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	objects := []archivedObject{
+		{"logs/a", 100, s3.StorageClassStandard, modified},
+		{"logs/b", 5000, s3.StorageClassStandard, modified},
+		{"backups/c", 100, s3.StorageClassDeepArchive, modified},
+		{"backups/c" + PART_MANIFEST_SUFFIX, 10, s3.StorageClassStandard, modified},
+	}
+
+	rules := []*s3.LifecycleRule{
+		{
+			ID:          aws.String("logs"),
+			Status:      aws.String(s3.ExpirationStatusEnabled),
+			Filter:      &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{Prefix: aws.String("logs/"), ObjectSizeGreaterThan: aws.Int64(1000)}},
+			Transitions: []*s3.Transition{{Days: aws.Int64(30), StorageClass: aws.String(s3.TransitionStorageClassGlacier)}},
+		},
+		{
+			ID:          aws.String("backups"),
+			Status:      aws.String(s3.ExpirationStatusEnabled),
+			Filter:      &s3.LifecycleRuleFilter{Prefix: aws.String("backups/")},
+			Transitions: []*s3.Transition{{Days: aws.Int64(0), StorageClass: aws.String(s3.TransitionStorageClassDeepArchive)}},
+			Expiration:  &s3.LifecycleExpiration{Days: aws.Int64(90)},
+		},
+		{
+			ID:         aws.String("disabled"),
+			Status:     aws.String(s3.ExpirationStatusDisabled),
+			Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+			Expiration: &s3.LifecycleExpiration{Days: aws.Int64(1)},
+		},
+	}
+
+	var got []string
+	events := lifecycleEvents(objects, rules)
+	for _, e := range events {
+		got = append(got, e.When.Format("2006-01-02")+" "+e.Key+" "+e.Action)
+	}
+
+	want := []string{
+		"2026-01-02 backups/c" + PART_MANIFEST_SUFFIX + " move to DEEP_ARCHIVE",
+		"2026-02-01 logs/b move to GLACIER",
+		"2026-04-02 backups/c delete",
+		"2026-04-02 backups/c" + PART_MANIFEST_SUFFIX + " delete",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	warnings := strings.Join(lifecycleWarnings(objects, rules, events, ""), "\n")
+	for _, want := range []string{"incomplete multipart uploads", "180 day minimum", "archives part manifests"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("no warning about %s in\n%s", want, warnings)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// Deleted objects can be moved under TRASH_PREFIX instead, and emptied from
+// there later.  S3 can't copy archived objects, so those stay where they are
+// and TRASH_INDEX_KEY records when they were thrown away.
+const (
+	TRASH_PREFIX    = "trash/"
+	TRASH_INDEX_KEY = TRASH_PREFIX + ".index.json"
+)
+
+// empty-trash flags
+var EmptyTrashDays int64
+var EmptyTrashDryRun bool
+
+var emptyTrashCmd = &cobra.Command{
+	Use:   "empty-trash",
+	Short: "Delete what sync --trash threw away more than --days ago",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if !EmptyTrashDryRun {
+			err = requireOperator("empty the trash")
+		}
+		var cleanup s3iface.S3API
+		if err == nil {
+			cleanup, err = newDestructiveS3Session(Region)
+		}
+		if err == nil {
+			err = EmptyTrash(newS3Session(Region), cleanup, BucketName, EmptyTrashDays, EmptyTrashDryRun, time.Now())
+		}
+		return err
+	},
+}
+
+// trashIndex maps the keys of archived objects thrown away in place to when
+// that happened.
+type trashIndex map[string]time.Time
+
+func loadTrashIndex(s3session s3iface.S3API, bucket string) (trashIndex, error) {
+	index := trashIndex{}
+	if _, err := getJSON(s3session, bucket, TRASH_INDEX_KEY, &index); err != nil {
+		return nil, fmt.Errorf("Failed to read the trash index: %w", err)
+	}
+	return index, nil
+}
+
+func isTrash(key string) bool {
+	return strings.HasPrefix(key, TRASH_PREFIX)
+}
+
+// sidecarsOf finds the sidecars which belong to key among keys.
+func sidecarsOf(key string, keys map[string]archivedObject) []string {
+	var sidecars []string
+	for k := range keys {
+		if strings.HasPrefix(k, key+".") && isSidecar(k) {
+			sidecars = append(sidecars, k)
+		}
+	}
+	sort.Strings(sidecars)
+	return sidecars
+}
+
+// copyObject copies an object within the bucket, keeping its storage class
+// and metadata.
+func copyObject(s3session s3iface.S3API, cleanup cleanupSession, bucket string, obj archivedObject, dest string) error {
+	return copyObjectTo(s3session, cleanup, bucket, obj, bucket, dest, obj.StorageClass)
+}
+
+// copyObjectTo copies an object to dest in destBucket, in storageClass,
+// keeping its metadata.  CopyObject only takes up to 5 GiB, bigger objects
+// are copied in parts, and the copy is aborted if one of them fails.
+func copyObjectTo(s3session s3iface.S3API, cleanup cleanupSession, bucket string, obj archivedObject, destBucket string, dest string, storageClass string) error {
+	source := (&url.URL{Path: bucket + "/" + obj.Key}).EscapedPath()
+
+	if obj.Size <= MAX_COPY_PART_SIZE {
+		_, err := s3session.CopyObject(&s3.CopyObjectInput{
+			Bucket:       aws.String(destBucket),
+			Key:          aws.String(dest),
+			CopySource:   aws.String(source),
+			StorageClass: aws.String(storageClass),
+		})
+		return err
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return err
+	}
+
+	created, err := s3session.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(destBucket),
+		Key:          aws.String(dest),
+		StorageClass: aws.String(storageClass),
+		Metadata:     head.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	return copyParts(s3session, cleanup, bucket, obj, strings.Trim(aws.StringValue(head.ETag), "\""), created)
+}
+
+// copyParts copies obj of bucket into the multipart upload created, in parts
+// of at most 5 GiB, and completes it.  If a part fails, the upload is
+// aborted.
+func copyParts(s3session s3iface.S3API, cleanup cleanupSession, bucket string, obj archivedObject, etag string, created *s3.CreateMultipartUploadOutput) error {
+	var parts []*s3.CompletedPart
+	var offset int64
+	for i, size := range splitSource(composeSource{Key: obj.Key, First: 0, Last: obj.Size - 1}) {
+		result := copyPart(s3session, created, bucket, obj.Key, etag, offset, size, i+1)
+		if result.err != nil {
+			if abortErr := abortCopy(cleanup, created); abortErr != nil {
+				return fmt.Errorf("%w; the upload %s wasn't aborted: %v", result.err, *created.UploadId, abortErr)
+			}
+			return result.err
+		}
+		parts = append(parts, result.completedPart)
+		offset += size
+	}
+
+	// Like CopyObject, a copy is audited.
+	_, err := s3session.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          created.Bucket,
+		Key:             created.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}, audited)
+	return err
+}
+
+func abortCopy(cleanup cleanupSession, upload *s3.CreateMultipartUploadOutput) error {
+	session, err := cleanup()
+	if err != nil {
+		return err
+	}
+
+	_, err = session.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   upload.Bucket,
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	})
+	return err
+}
+
+// removeObjects deletes the objects with their sidecars, or throws them into
+// the trash.  Sidecars share their object's fate, so that an archived object
+// kept in place keeps its part manifest.
+// MAX_DELETE_BATCH is how many keys a DeleteObjects request takes.
+const MAX_DELETE_BATCH = 1000
+
+// deleteObjects deletes keys a batch of MAX_DELETE_BATCH at a time, and
+// calls deleted for every key which is gone.  Keys S3 refuses to delete
+// don't hold up the rest, they're reported together at the end.
+func deleteObjects(cleanup s3iface.S3API, bucket string, keys []string, deleted func(key string)) error {
+	var failed []string
+	for start := 0; start < len(keys); start += MAX_DELETE_BATCH {
+		batch := keys[start:]
+		if len(batch) > MAX_DELETE_BATCH {
+			batch = batch[:MAX_DELETE_BATCH]
+		}
+		objects := make([]*s3.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+		}
+
+		resp, err := cleanup.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to delete %s and %d more: %w", batch[0], len(batch)-1, err)
+		}
+
+		refused := map[string]bool{}
+		for _, e := range resp.Errors {
+			key := aws.StringValue(e.Key)
+			refused[key] = true
+			failed = append(failed, fmt.Sprintf("%s (%s)", key, aws.StringValue(e.Message)))
+		}
+		for _, key := range batch {
+			if !refused[key] {
+				deleted(key)
+			}
+		}
+	}
+
+	switch {
+	case len(failed) == 1:
+		return fmt.Errorf("Failed to delete %s", failed[0])
+	case len(failed) > 10:
+		return fmt.Errorf("Failed to delete %d objects: %s and %d more", len(failed), strings.Join(failed[:10], ", "), len(failed)-10)
+	case len(failed) > 0:
+		return fmt.Errorf("Failed to delete %d objects: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func removeObjects(s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, keys []string, all map[string]archivedObject, trash bool, dryRun bool, now time.Time) error {
+	var index trashIndex
+	if trash {
+		var err error
+		if index, err = loadTrashIndex(s3session, bucket); err != nil {
+			return err
+		}
+	}
+	indexChanged := false
+
+	// What's deleted, and what's been copied to the trash, is deleted in
+	// batches once every object has been gone through.
+	var deletes []string
+	moved := map[string]bool{}
+	var copyErr error
+
+objects:
+	for _, key := range keys {
+		obj := all[key]
+		group := append([]string{key}, sidecarsOf(key, all)...)
+
+		switch {
+		case !trash:
+			for _, k := range group {
+				if dryRun {
+					ui.Println("Would delete", k)
+					continue
+				}
+				deletes = append(deletes, k)
+			}
+
+		case isArchived(obj.StorageClass):
+			for _, k := range group {
+				if dryRun {
+					ui.Println("Would put", k, "in the trash, in place")
+					continue
+				}
+				index[k] = now
+				indexChanged = true
+				ui.Println("Put", k, "in the trash, in place")
+			}
+
+		default:
+			for _, k := range group {
+				if dryRun {
+					ui.Println("Would move", k, "to", TRASH_PREFIX+k)
+					continue
+				}
+				if err := copyObject(s3session, func() (s3iface.S3API, error) { return cleanup, nil }, bucket, all[k], TRASH_PREFIX+k); err != nil {
+					// What's in the trash already is still moved.
+					copyErr = fmt.Errorf("Failed to move %s to the trash: %w", k, err)
+					break objects
+				}
+				deletes = append(deletes, k)
+				moved[k] = true
+			}
+		}
+	}
+
+	err := deleteObjects(cleanup, bucket, deletes, func(k string) {
+		if moved[k] {
+			ui.Println("Moved", k, "to", TRASH_PREFIX+k)
+		} else {
+			ui.Println("Deleted", k)
+		}
+	})
+
+	if indexChanged {
+		if err := putJSON(s3session, bucket, TRASH_INDEX_KEY, index); err != nil {
+			return fmt.Errorf("Failed to save the trash index: %w", err)
+		}
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	return err
+}
+
+// EmptyTrash deletes what has been in the trash for more than days.  Objects
+// thrown away in place which have been uploaded again since are taken out of
+// the trash instead.
+func EmptyTrash(s3session s3iface.S3API, cleanup s3iface.S3API, bucket string, days int64, dryRun bool, now time.Time) error {
+	cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+
+	var deleted, kept int
+	var deletes []string
+	err := walkObjects(s3session, bucket, TRASH_PREFIX, func(obj archivedObject) error {
+		if obj.Key == TRASH_INDEX_KEY {
+			return nil
+		}
+		if obj.LastModified.After(cutoff) {
+			kept++
+			return nil
+		}
+		if dryRun {
+			deleted++
+			ui.Println("Would delete", obj.Key)
+			return nil
+		}
+		deletes = append(deletes, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = deleteObjects(cleanup, bucket, deletes, func(key string) {
+		deleted++
+		ui.Println("Deleted", key)
+	})
+	if err != nil {
+		return err
+	}
+
+	index, err := loadTrashIndex(s3session, bucket)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changed := false
+	deletes = nil
+	for _, key := range keys {
+		trashed := index[key]
+		if trashed.After(cutoff) {
+			kept++
+			continue
+		}
+
+		head, err := s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if isNoSuchKey(err) || (err == nil && head.LastModified.After(trashed)) {
+			// Deleted, or uploaded again, since.
+			if !dryRun {
+				delete(index, key)
+				changed = true
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to look up %s: %w", key, err)
+		}
+
+		if dryRun {
+			deleted++
+			ui.Println("Would delete", key)
+			continue
+		}
+		deletes = append(deletes, key)
+	}
+	err = deleteObjects(cleanup, bucket, deletes, func(key string) {
+		deleted++
+		delete(index, key)
+		changed = true
+		ui.Println("Deleted", key)
+	})
+
+	if changed {
+		if err := putJSON(s3session, bucket, TRASH_INDEX_KEY, index); err != nil {
+			return fmt.Errorf("Failed to save the trash index: %w", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("Deleted %d objects, %d are staying in the trash for now\n", deleted, kept)
+	return nil
+}
+
+func init() {
+	emptyTrashCmd.Flags().Int64Var(&EmptyTrashDays, "days", 30, "keep what was thrown away in the last this many days")
+	emptyTrashCmd.Flags().BoolVar(&EmptyTrashDryRun, "dry-run", false, "only show what would be deleted")
+	rootCmd.AddCommand(emptyTrashCmd)
+}
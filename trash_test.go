@@ -0,0 +1,229 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// trashFixture is a synced directory with objects in the bucket whose files
+// are gone: a STANDARD one and an archived one, both with part manifests.
+func trashFixture(t *testing.T) (*fakeS3, string) {
+	dir := writeTree(t, map[string]string{"a.jpg": "a"})
+	fake := newFakeS3()
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for key, class := range map[string]string{
+		"photos/old.txt":                         s3.StorageClassStandard,
+		"photos/old.txt" + PART_MANIFEST_SUFFIX:  s3.StorageClassStandard,
+		"photos/cold.tar":                        s3.StorageClassDeepArchive,
+		"photos/cold.tar" + PART_MANIFEST_SUFFIX: s3.StorageClassStandard,
+		"elsewhere/unrelated.txt":                s3.StorageClassStandard,
+	} {
+		fake.objects[key] = &fakeObject{data: []byte(key), etag: md5Hex([]byte(key)), storageClass: class, modified: old}
+	}
+	return fake, dir
+}
+
+func TestSyncDelete(t *testing.T) {
+	fake, dir := trashFixture(t)
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 6 {
+		t.Error("a dry run deleted objects")
+	}
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"photos/old.txt", "photos/old.txt" + PART_MANIFEST_SUFFIX, "photos/cold.tar"} {
+		if fake.objects[key] != nil {
+			t.Errorf("%s wasn't deleted", key)
+		}
+	}
+	if fake.objects["photos/a.jpg"] == nil || fake.objects["elsewhere/unrelated.txt"] == nil {
+		t.Error("deleted too much")
+	}
+
+	empty := t.TempDir()
+	if err := Sync(fake, fake, fake.cleanup, "bucket", empty, "photos", SYNC_COMPARE_MTIME, false, false); err == nil {
+		t.Error("an empty directory deleted everything")
+	}
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, true, false); err == nil {
+		t.Error("--trash was accepted without --delete")
+	}
+}
+
+func TestSyncTrash(t *testing.T) {
+	fake, dir := trashFixture(t)
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The STANDARD object moves, the archived one can't be copied and
+	// stays where it is.
+	for _, key := range []string{"photos/old.txt", "photos/old.txt" + PART_MANIFEST_SUFFIX} {
+		if fake.objects[key] != nil || fake.objects[TRASH_PREFIX+key] == nil {
+			t.Errorf("%s wasn't moved to the trash", key)
+		}
+	}
+	if fake.objects["photos/cold.tar"] == nil {
+		t.Fatal("the archived object was deleted")
+	}
+	index, err := loadTrashIndex(fake, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index["photos/cold.tar"]; !ok || len(index) != 2 {
+		t.Errorf("the trash index is %v", index)
+	}
+
+	// Syncing again finds nothing more to throw away.
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects[TRASH_PREFIX+"photos/a.jpg"] != nil {
+		t.Error("a file which is still there was thrown away")
+	}
+
+	// Nothing is old enough yet.
+	if err := EmptyTrash(fake, fake, "bucket", 30, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects[TRASH_PREFIX+"photos/old.txt"] == nil || fake.objects["photos/cold.tar"] == nil {
+		t.Fatal("the trash was emptied too early")
+	}
+
+	if err := EmptyTrash(fake, fake, "bucket", 30, true, time.Now().Add(31*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["photos/cold.tar"] == nil {
+		t.Fatal("a dry run emptied the trash")
+	}
+
+	if err := EmptyTrash(fake, fake, "bucket", 30, false, time.Now().Add(31*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for key := range fake.objects {
+		if key != "photos/a.jpg" && key != "elsewhere/unrelated.txt" && key != TRASH_INDEX_KEY {
+			t.Errorf("%s is still there", key)
+		}
+	}
+	index, _ = loadTrashIndex(fake, "bucket")
+	if len(index) != 0 {
+		t.Errorf("the trash index still has %v", index)
+	}
+}
+
+func TestSyncRescuesFromTrash(t *testing.T) {
+	fake, dir := trashFixture(t)
+
+	if err := Sync(fake, fake, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is back, with the same contents.
+	filename := filepath.Join(dir, "cold.tar")
+	if err := os.WriteFile(filename, []byte("photos/cold.tar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	index, _ := loadTrashIndex(fake, "bucket")
+	if len(index) != 0 {
+		t.Errorf("the trash index still has %v", index)
+	}
+
+	if err := EmptyTrash(fake, fake, "bucket", 0, false, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["photos/cold.tar"] == nil {
+		t.Error("emptying the trash deleted an object whose file is back")
+	}
+}
+
+// uncopyableS3 fails to copy parts of objects.
+type uncopyableS3 struct {
+	*fakeS3
+}
+
+func (f *uncopyableS3) UploadPartCopyWithContext(ctx aws.Context, in *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	return nil, awserr.New("InternalError", "We encountered an internal error", nil)
+}
+
+func TestCopyObjectAbortsFailedCopy(t *testing.T) {
+	fake := &uncopyableS3{newFakeS3()}
+	fake.objects["big"] = &fakeObject{data: []byte("big"), etag: md5Hex([]byte("big")), storageClass: s3.StorageClassStandard}
+	big := archivedObject{Key: "big", Size: MAX_COPY_PART_SIZE + 1, StorageClass: s3.StorageClassStandard}
+
+	if err := copyObject(fake, fake.cleanup, "bucket", big, TRASH_PREFIX+"big"); err == nil {
+		t.Fatal("the copy succeeded")
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("the copy's upload wasn't aborted: %v", fake.uploads)
+	}
+
+	refused := func() (s3iface.S3API, error) { return nil, errors.New("No credentials") }
+	err := copyObject(fake, refused, "bucket", big, TRASH_PREFIX+"big")
+	if err == nil || !strings.Contains(err.Error(), "wasn't aborted: No credentials") {
+		t.Errorf("the error doesn't say the upload is left over: %v", err)
+	}
+}
+
+func TestDeleteObjectsBatches(t *testing.T) {
+	fake := newFakeS3()
+	var keys []string
+	for i := 0; i < 2*MAX_DELETE_BATCH+500; i++ {
+		key := fmt.Sprintf("photos/%05d.jpg", i)
+		fake.objects[key] = &fakeObject{}
+		keys = append(keys, key)
+	}
+	fake.refuseDeletes = map[string]bool{"photos/00007.jpg": true, "photos/02100.jpg": true}
+
+	var deleted int
+	err := deleteObjects(fake, "bucket", keys, func(string) { deleted++ })
+	if err == nil || !strings.Contains(err.Error(), "Failed to delete 2 objects: photos/00007.jpg (Access Denied), photos/02100.jpg") {
+		t.Errorf("got %v", err)
+	}
+	if fake.deleteBatches != 3 || deleted != len(keys)-2 || len(fake.objects) != 2 {
+		t.Errorf("%d batches deleted %d objects, %d are left", fake.deleteBatches, deleted, len(fake.objects))
+	}
+}
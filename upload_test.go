@@ -0,0 +1,289 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestMain keeps the state we save between runs out of the user's cache.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "s3-glacier-uploader-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", dir)
+	os.Setenv("XDG_CACHE_HOME", dir)
+
+	// Nothing should ask questions on the terminal running the tests.
+	if r, w, err := os.Pipe(); err == nil {
+		w.Close()
+		os.Stdin = r
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	p := filepath.Join(t.TempDir(), "archive.bin")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestUploadFile(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1024)
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["archive.bin"]
+	if obj == nil {
+		t.Fatal("no object was created")
+	}
+	if !bytes.Equal(obj.data, data) {
+		t.Error("the object doesn't contain the file")
+	}
+	if obj.storageClass != s3.StorageClassDeepArchive {
+		t.Errorf("storage class is %s", obj.storageClass)
+	}
+	if len(obj.partSizes) != 2 {
+		t.Errorf("uploaded in %d parts, want 2", len(obj.partSizes))
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("the multipart upload wasn't completed")
+	}
+
+	history, err := loadRunHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.Bucket != "bucket" || last.Bytes != int64(len(data)) {
+		t.Errorf("the upload was recorded as %+v", last)
+	}
+}
+
+func TestUploadFileKeyAndMetadata(t *testing.T) {
+	defer func() { ObjectKey, KeyPrefix, Metadata = "", "", nil }()
+	ObjectKey, KeyPrefix = "vm.img", "laptop/"
+	Metadata = []string{"host=laptop", "source=/var/lib/vm.img"}
+
+	fake := newFakeS3()
+	if err := uploadFile(fake, fake.cleanup, "bucket", writeTestFile(t, randomData(1024)), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.objects["laptop/vm.img"]
+	if obj == nil {
+		t.Fatal("nothing was uploaded to laptop/vm.img")
+	}
+	if aws.StringValue(obj.metadata["host"]) != "laptop" || aws.StringValue(obj.metadata["source"]) != "/var/lib/vm.img" {
+		t.Errorf("metadata %v", aws.StringValueMap(obj.metadata))
+	}
+}
+
+func TestUploadFileWithBase(t *testing.T) {
+	defer func() { PartManifest, BaseKey = false, "" }()
+
+	fake := newFakeS3()
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+
+	PartManifest = true
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["archive.bin"+PART_MANIFEST_SUFFIX]; !ok {
+		t.Fatal("no part manifest was written")
+	}
+
+	// Change the middle part only.
+	changed := append([]byte{}, data...)
+	changed[PART_SIZE+10] ^= 0xff
+	if err := os.WriteFile(filename, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	BaseKey = "archive.bin"
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err == nil {
+		t.Fatal("copied parts from an archived base")
+	}
+
+	fake.objects["archive.bin"].restored = true
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["archive.bin"].data, changed) {
+		t.Error("the object doesn't contain the changed file")
+	}
+	if fake.copies != 2 {
+		t.Errorf("copied %d parts, want the 2 unchanged ones", fake.copies)
+	}
+}
+
+func TestUploadFileRefusesReplacedBase(t *testing.T) {
+	defer func() { PartManifest, BaseKey, Force = false, "", false }()
+
+	fake := newFakeS3()
+	filename := writeTestFile(t, randomData(1024))
+
+	PartManifest = true
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone overwrites the base without updating its manifest.
+	fake.objects["archive.bin"].etag = md5Hex([]byte("something else"))
+	fake.objects["archive.bin"].restored = true
+
+	// The file is the same, it'd be skipped without --force.
+	BaseKey, Force = "archive.bin", true
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "")
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("got %v, want a complaint about the changed base", err)
+	}
+}
+
+func TestDownloadETagUnevenParts(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(3000)
+	sizes := []int64{1000, 1500, 500}
+
+	fake.objects["composed"] = &fakeObject{
+		data:         data,
+		etag:         multipartETag(data, sizes),
+		partSizes:    sizes,
+		storageClass: s3.StorageClassStandard,
+	}
+
+	got, err := objectPartSizes(fake, "bucket", "composed", multipartETag(data, sizes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	etag, err := downloadETag(fake, "bucket", "composed", *quote(multipartETag(data, sizes)), int64(len(data)), got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != multipartETag(data, sizes) {
+		t.Errorf("got %s, want %s", etag, multipartETag(data, sizes))
+	}
+}
+
+// slowS3 holds on to every part for a while, or until hold parts have been in
+// flight, and remembers how many it had at once.
+type slowS3 struct {
+	*fakeS3
+	mu       sync.Mutex
+	inFlight int
+	most     int
+	fail     int64
+	hold     int
+}
+
+func (f *slowS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.most {
+		f.most = f.inFlight
+	}
+	f.mu.Unlock()
+
+	if f.hold > 0 {
+		// Reading and hashing the other parts can take longer than any
+		// fixed sleep on a busy machine.
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			f.mu.Lock()
+			held := f.most >= f.hold
+			f.mu.Unlock()
+			if held {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	} else {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+
+	if *in.PartNumber == f.fail {
+		return nil, awserr.New("AccessDenied", "Access Denied", nil)
+	}
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+func TestUploadConcurrently(t *testing.T) {
+	defer func(concurrency int) { Concurrency = concurrency }(Concurrency)
+
+	data := randomData(2*PART_SIZE + 1024)
+	filename := writeTestFile(t, data)
+
+	for _, concurrency := range []int{1, 4} {
+		Concurrency = concurrency
+		// There are only 3 parts.
+		want := concurrency
+		if want > 3 {
+			want = 3
+		}
+		fake := &slowS3{fakeS3: newFakeS3(), hold: want}
+
+		if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+			t.Fatal(err)
+		}
+		if obj := fake.objects["archive.bin"]; obj == nil || !bytes.Equal(obj.data, data) {
+			t.Errorf("with %d workers, the object doesn't contain the file", concurrency)
+		}
+		if fake.most != want {
+			t.Errorf("with %d workers, %d parts were in flight at once", concurrency, fake.most)
+		}
+	}
+
+	fake := &slowS3{fakeS3: newFakeS3(), fail: 2}
+	err := uploadFile(fake, fake.cleanup, "bucket", filename, "")
+	if err == nil || !strings.Contains(err.Error(), "--upload-id upload-1") {
+		t.Errorf("got %v", err)
+	}
+	if len(fake.uploads) != 1 {
+		t.Error("the failed upload wasn't left in place to be resumed")
+	}
+}
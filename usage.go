@@ -0,0 +1,288 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// usage flags
+var UsagePrefix string
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show what's stored per storage class and prefix, and what it costs a month",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Usage(newS3Session(Region), BucketName, UsagePrefix, Inventory)
+	},
+}
+
+// inventoryManifest is the part of an S3 Inventory manifest.json we need.
+type inventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// parseS3URL splits s3://bucket/key.
+func parseS3URL(s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || len(u.Path) < 2 {
+		return "", "", fmt.Errorf("Expected an s3://bucket/key URL, got %q", s)
+	}
+	return u.Host, u.Path[1:], nil
+}
+
+// parseInventoryCSV reads one CSV file of an inventory report, whose columns
+// are listed in the manifest's fileSchema.  Keys are URL-encoded, and
+// versioned inventories have delete markers, which take no space.
+func parseInventoryCSV(r io.Reader, schema string, prefix string, fn func(archivedObject) error) error {
+	columns := map[string]int{}
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"Key", "Size", "StorageClass"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("The inventory doesn't have a %s column, add it to the inventory configuration", name)
+		}
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(columns)
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if i, ok := columns["IsDeleteMarker"]; ok && row[i] == "true" {
+			continue
+		}
+
+		key, err := url.QueryUnescape(row[columns["Key"]])
+		if err != nil {
+			return fmt.Errorf("Bad key in the inventory: %w", err)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		size, err := strconv.ParseInt(row[columns["Size"]], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad size of %s in the inventory: %w", key, err)
+		}
+
+		var modified time.Time
+		if i, ok := columns["LastModifiedDate"]; ok {
+			modified, _ = time.Parse(time.RFC3339, row[i])
+		}
+
+		if err := fn(archivedObject{key, size, row[columns["StorageClass"]], modified}); err != nil {
+			return err
+		}
+	}
+}
+
+// readInventory calls fn for every object listed in the inventory report the
+// manifest at manifestURL describes.
+func readInventory(s3session s3iface.S3API, manifestURL string, prefix string, fn func(archivedObject) error) error {
+	bucket, key, err := parseS3URL(manifestURL)
+	if err != nil {
+		return err
+	}
+	manifest, err := loadInventoryManifest(s3session, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	if manifest.FileFormat != "CSV" {
+		return fmt.Errorf("Only CSV inventories are supported, this one is %s", manifest.FileFormat)
+	}
+
+	for _, file := range manifest.Files {
+		resp, err := s3session.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %w", file.Key, err)
+		}
+
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("Failed to read %s: %w", file.Key, err)
+		}
+		err = parseInventoryCSV(gz, manifest.FileSchema, prefix, fn)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %w", file.Key, err)
+		}
+	}
+
+	return nil
+}
+
+func loadInventoryManifest(s3session s3iface.S3API, bucket string, key string) (*inventoryManifest, error) {
+	resp, err := s3session.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the inventory manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var manifest inventoryManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Failed to read the inventory manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+type usageRow struct {
+	Name    string
+	Objects int64
+	Bytes   int64
+	Cost    float64
+}
+
+type usageSummary struct {
+	Classes  []usageRow
+	Prefixes []usageRow
+	Total    usageRow
+}
+
+// usageCounter adds up objects as they're listed, so that only the totals
+// are kept in memory.
+type usageCounter struct {
+	prefix   string
+	classes  map[string]*usageRow
+	prefixes map[string]*usageRow
+	total    usageRow
+}
+
+func newUsageCounter(prefix string) *usageCounter {
+	return &usageCounter{prefix, map[string]*usageRow{}, map[string]*usageRow{}, usageRow{Name: "Total"}}
+}
+
+func (c *usageCounter) Add(obj archivedObject) error {
+	class := obj.StorageClass
+	if class == "" {
+		class = s3.StorageClassStandard
+	}
+	set := reportSet(obj.Key, c.prefix)
+
+	if c.classes[class] == nil {
+		c.classes[class] = &usageRow{Name: class}
+	}
+	if c.prefixes[set] == nil {
+		c.prefixes[set] = &usageRow{Name: set}
+	}
+
+	cost := storageCost(class, 1, obj.Size)
+	for _, row := range []*usageRow{c.classes[class], c.prefixes[set], &c.total} {
+		row.Objects++
+		row.Bytes += obj.Size
+		row.Cost += cost
+	}
+	return nil
+}
+
+// Summary has the storage classes and prefixes, most expensive first.
+func (c *usageCounter) Summary() usageSummary {
+	return usageSummary{sortUsage(c.classes), sortUsage(c.prefixes), c.total}
+}
+
+func sortUsage(rows map[string]*usageRow) []usageRow {
+	var sorted []usageRow
+	for _, row := range rows {
+		sorted = append(sorted, *row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Cost != sorted[j].Cost {
+			return sorted[i].Cost > sorted[j].Cost
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func printUsage(w io.Writer, title string, rows []usageRow) {
+	fmt.Fprintf(w, "%-40s %10s %12s %12s\n", title, "Objects", "Size", "Per month")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-40s %10d %12s %12s\n", row.Name, row.Objects, showBytes(row.Bytes), fmt.Sprintf("$%.2f", row.Cost))
+	}
+}
+
+func Usage(s3session s3iface.S3API, bucket string, prefix string, inventory string) error {
+	counter := newUsageCounter(prefix)
+
+	manifest, err := resolveInventory(s3session, inventory, bucket)
+	if err != nil {
+		return err
+	}
+	if manifest != "" {
+		err = readInventory(s3session, manifest, prefix, counter.Add)
+	} else {
+		// Sidecars are stored too, so they're counted.
+		err = walkObjects(s3session, bucket, prefix, counter.Add)
+	}
+	if err != nil {
+		return err
+	}
+
+	summary := counter.Summary()
+
+	w := ui.Writer()
+	printUsage(w, "Storage class", summary.Classes)
+	ui.Println()
+	printUsage(w, "Prefix", summary.Prefixes)
+	ui.Println()
+	printUsage(w, "", []usageRow{summary.Total})
+
+	ui.Println()
+	ui.Println("Estimated at us-east-1 list prices, without requests, retrievals or minimum storage durations.")
+	return nil
+}
+
+func init() {
+	usageCmd.Flags().StringVar(&UsagePrefix, "prefix", "", "only count objects under this prefix")
+	rootCmd.AddCommand(usageCmd)
+}
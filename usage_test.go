@@ -0,0 +1,125 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testInventorySchema = "Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size, LastModifiedDate, StorageClass"
+
+const testInventory = `"backups","photos/2021%20summer.tar","v1","true","false","1073741824","2022-01-10T00:00:00.000Z","DEEP_ARCHIVE"
+"backups","photos/2021.tar","v2","false","true","","2022-01-10T00:00:00.000Z",""
+"backups","mail/inbox.mbox","v3","true","false","2048","2022-02-10T00:00:00.000Z","STANDARD"
+`
+
+// collect gathers what a walk finds.
+func collect(objects *[]archivedObject) func(archivedObject) error {
+	return func(obj archivedObject) error {
+		*objects = append(*objects, obj)
+		return nil
+	}
+}
+
+func TestParseInventoryCSV(t *testing.T) {
+	var objects []archivedObject
+	err := parseInventoryCSV(strings.NewReader(testInventory), testInventorySchema, "", collect(&objects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("got %d objects, the delete marker should be skipped", len(objects))
+	}
+	if obj := objects[0]; obj.Key != "photos/2021 summer.tar" || obj.Size != GB || obj.StorageClass != "DEEP_ARCHIVE" || obj.LastModified.Month() != 1 {
+		t.Errorf("got %+v", obj)
+	}
+
+	objects = nil
+	err = parseInventoryCSV(strings.NewReader(testInventory), testInventorySchema, "mail/", collect(&objects))
+	if err != nil || len(objects) != 1 {
+		t.Errorf("got %v, %v under mail/", objects, err)
+	}
+
+	if err := parseInventoryCSV(strings.NewReader(testInventory), "Bucket, Key, Size", "", collect(&objects)); err == nil {
+		t.Error("an inventory without storage classes was accepted")
+	}
+}
+
+func TestStorageCost(t *testing.T) {
+	if cost := storageCost(s3.StorageClassStandard, 1, GB); cost != 0.023 {
+		t.Errorf("a GB in STANDARD costs %f", cost)
+	}
+
+	// A million tiny archived objects cost more in overhead than in data.
+	cost := storageCost(s3.StorageClassDeepArchive, 1000000, 1000000)
+	overhead := 1000000 * (32*1024*0.00099 + 8*1024*0.023) / GB
+	if math.Abs(cost-overhead) > 0.01 {
+		t.Errorf("a million small objects cost %f, want about %f", cost, overhead)
+	}
+}
+
+func TestSummarizeUsage(t *testing.T) {
+	counter := newUsageCounter("")
+	if err := parseInventoryCSV(strings.NewReader(testInventory), testInventorySchema, "", counter.Add); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := counter.Summary()
+	if summary.Total.Objects != 2 || summary.Total.Bytes != GB+2048 {
+		t.Errorf("total is %+v", summary.Total)
+	}
+	if len(summary.Classes) != 2 || summary.Classes[0].Name != "DEEP_ARCHIVE" {
+		t.Errorf("storage classes: %+v", summary.Classes)
+	}
+	if len(summary.Prefixes) != 2 || summary.Prefixes[0].Name != "photos/" || summary.Prefixes[1].Name != "mail/" {
+		t.Errorf("prefixes: %+v", summary.Prefixes)
+	}
+}
+
+func TestReadInventory(t *testing.T) {
+	fake := newFakeS3()
+
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	gz.Write([]byte(testInventory))
+	gz.Close()
+
+	manifest := `{"sourceBucket": "backups", "fileFormat": "CSV", "fileSchema": "` + testInventorySchema + `",
+		"files": [{"key": "inventory/data/1.csv.gz"}]}`
+	for key, body := range map[string][]byte{"inventory/manifest.json": []byte(manifest), "inventory/data/1.csv.gz": data.Bytes()} {
+		fake.PutObject(&s3.PutObjectInput{Bucket: aws.String("logs"), Key: aws.String(key), Body: bytes.NewReader(body)})
+	}
+
+	var objects []archivedObject
+	if err := readInventory(fake, "s3://logs/inventory/manifest.json", "", collect(&objects)); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("got %d objects", len(objects))
+	}
+
+	if err := readInventory(fake, "logs/inventory/manifest.json", "", collect(&objects)); err == nil {
+		t.Error("a manifest that isn't an s3:// URL was accepted")
+	}
+}
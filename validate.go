@@ -0,0 +1,142 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CLI flags
+var ValidateArchive bool
+
+// What archives start with.  Tar has its magic in the first header, after
+// the name and the other fields.
+var (
+	GZIP_MAGIC = []byte{0x1f, 0x8b}
+	ZSTD_MAGIC = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	TAR_MAGIC  = []byte("ustar")
+)
+
+const (
+	TAR_MAGIC_OFFSET = 257
+	TAR_BLOCK_SIZE   = 512
+)
+
+// validateArchive reads an archive from start to end before it's uploaded,
+// so that one which is already damaged isn't frozen in Deep Archive.
+// Compressed archives have their checksums checked while decompressing, tar
+// archives the checksum of every header and that every entry is complete.
+// It describes what it checked, or returns "" for files which aren't
+// archives.
+func validateArchive(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 64*1024)
+	head, _ := r.Peek(len(ZSTD_MAGIC))
+
+	var kind string
+	var stream io.Reader
+	switch {
+	case bytes.HasPrefix(head, GZIP_MAGIC):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", fmt.Errorf("%s is a damaged gzip file: %w", filename, err)
+		}
+		kind, stream = "gzip", gz
+	case bytes.HasPrefix(head, ZSTD_MAGIC):
+		zstd, err := startCommand([]string{"zstd", "-d", "-c", "-q", filename})
+		if err != nil {
+			return "", err
+		}
+		kind, stream = "zstd", zstd
+	default:
+		kind, stream = "", r
+	}
+
+	inner := bufio.NewReaderSize(stream, 64*1024)
+	header, _ := inner.Peek(TAR_MAGIC_OFFSET + len(TAR_MAGIC))
+	isTar := len(header) == TAR_MAGIC_OFFSET+len(TAR_MAGIC) && bytes.Equal(header[TAR_MAGIC_OFFSET:], TAR_MAGIC)
+
+	if !isTar {
+		if kind == "" {
+			return "", nil
+		}
+		n, err := io.Copy(io.Discard, inner)
+		if err != nil {
+			return "", fmt.Errorf("%s is a damaged %s file, after %s: %w", filename, kind, formatBytes(n), err)
+		}
+		return fmt.Sprintf("%s file, %s uncompressed", kind, formatBytes(n)), nil
+	}
+
+	// A tar archive ends with zero blocks, but Go's reader also returns
+	// io.EOF when it runs out of input at the start of an entry, which is
+	// where a cut off archive often ends.  So count what the last Next
+	// read besides the padding of the entry before it.
+	counted := &countingReader{r: inner}
+	tr := tar.NewReader(counted)
+	var entries int
+	var padding int64
+	for {
+		before := counted.n
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if counted.n-before-padding < TAR_BLOCK_SIZE {
+				return "", fmt.Errorf("%s is a damaged archive, it's cut off after %d entries", filename, entries)
+			}
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s is a damaged archive, after %d entries: %w", filename, entries, err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return "", fmt.Errorf("%s is a damaged archive, %s is cut off: %w", filename, hdr.Name, err)
+		}
+		entries++
+		padding = -hdr.Size & (TAR_BLOCK_SIZE - 1)
+	}
+
+	// Whatever follows the end of the tar archive still has to decompress.
+	if _, err := io.Copy(io.Discard, inner); err != nil {
+		return "", fmt.Errorf("%s is a damaged %s file: %w", filename, kind, err)
+	}
+
+	if kind != "" {
+		return fmt.Sprintf("tar archive in a %s file, %d entries", kind, entries), nil
+	}
+	return fmt.Sprintf("tar archive, %d entries", entries), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
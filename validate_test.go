@@ -0,0 +1,141 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// archiveBytes writes tarTree as a tar archive, gzipped if asked to, the
+// same every time.
+func archiveBytes(t *testing.T, gzipped bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	var names []string
+	for name := range tarTree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := tarTree[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg, Format: tar.FormatPAX}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeArchive(t *testing.T, name string, content []byte) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestValidateArchive(t *testing.T) {
+	plain := archiveBytes(t, false)
+	gzipped := archiveBytes(t, true)
+
+	var gzOnly bytes.Buffer
+	gz := gzip.NewWriter(&gzOnly)
+	gz.Write([]byte("not an archive"))
+	gz.Close()
+
+	for name, c := range map[string]struct {
+		content []byte
+		want    string
+	}{
+		"plain":     {plain, "tar archive, 3 entries"},
+		"gzipped":   {gzipped, "tar archive in a gzip file, 3 entries"},
+		"gzip only": {gzOnly.Bytes(), "gzip file, 14 B uncompressed"},
+		"other":     {[]byte("just some data"), ""},
+	} {
+		got, err := validateArchive(writeArchive(t, "archive", c.content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", name, got, c.want)
+		}
+	}
+}
+
+func TestValidateArchiveDamaged(t *testing.T) {
+	plain := archiveBytes(t, false)
+	gzipped := archiveBytes(t, true)
+
+	badHeader := append([]byte{}, plain...)
+	badHeader[0] ^= 0xff
+
+	badCRC := append([]byte{}, gzipped...)
+	badCRC[len(badCRC)-8] ^= 0xff
+
+	for name, content := range map[string][]byte{
+		"header checksum": badHeader,
+		"cut off":         plain[:700],
+		"between entries": plain[:1024],
+		"gzip checksum":   badCRC,
+		"gzip cut off":    gzipped[:len(gzipped)/2],
+	} {
+		_, err := validateArchive(writeArchive(t, "archive.tar", content))
+		if err == nil || !strings.Contains(err.Error(), "damaged") {
+			t.Errorf("%s: got %v, want a damaged archive", name, err)
+		}
+	}
+}
+
+func TestUploadRefusesDamagedArchive(t *testing.T) {
+	ValidateArchive = true
+	defer func() { ValidateArchive = false }()
+
+	s3 := newFakeS3()
+	gzipped := archiveBytes(t, true)
+	filename := writeArchive(t, "photos.tar.gz", gzipped[:len(gzipped)-4])
+
+	err := uploadObject(s3, s3.cleanup, "bucket", filename, "photos.tar.gz", "")
+	if err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Fatalf("got %v, want a damaged archive", err)
+	}
+	if len(s3.uploads) != 0 {
+		t.Errorf("an upload was started for a damaged archive")
+	}
+}
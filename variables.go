@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+// Keys, prefixes, tags and metadata can use {hostname}, {user}, {date} and
+// {run}, so that the same config file can go on every machine.  They're
+// expanded once, when the run starts.
+var variables = map[string]func() (string, error){
+	"hostname": os.Hostname,
+	"user": func() (string, error) {
+		u, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	},
+	"date": func() (string, error) { return runStarted.Format("2006-01-02"), nil },
+	"run":  func() (string, error) { return runStarted.Format("20060102T150405Z"), nil },
+}
+
+var variablePattern = regexp.MustCompile(`\{[a-z]+\}`)
+
+// expandVariables replaces the variables in s, leaving alone those in keep,
+// which are expanded later.  Anything else in braces is most likely a typo.
+func expandVariables(s string, keep ...string) (string, error) {
+	var err error
+	expanded := variablePattern.ReplaceAllStringFunc(s, func(v string) string {
+		name := strings.Trim(v, "{}")
+		for _, k := range keep {
+			if name == k {
+				return v
+			}
+		}
+		value, ok := variables[name]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("Unknown variable %s, use {hostname}, {user}, {date} or {run}", v)
+			}
+			return v
+		}
+		result, valueErr := value()
+		if valueErr != nil && err == nil {
+			err = fmt.Errorf("Failed to expand %s: %w", v, valueErr)
+		}
+		return result
+	})
+	return expanded, err
+}
+
+// checkVariables expands the variables in the flags which take them.
+func checkVariables() error {
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"--key", &ObjectKey}, {"--prefix", &KeyPrefix}, {"sync --prefix", &SyncPrefix}, {"watch --prefix", &WatchPrefix}} {
+		expanded, err := expandVariables(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*f.value = expanded
+	}
+
+	for i, spec := range Metadata {
+		expanded, err := expandVariables(spec)
+		if err != nil {
+			return fmt.Errorf("--metadata %s: %w", spec, err)
+		}
+		Metadata[i] = expanded
+	}
+	// {set} depends on the key of each object.
+	for i, spec := range Tags {
+		expanded, err := expandVariables(spec, "set")
+		if err != nil {
+			return fmt.Errorf("--tag %s: %w", spec, err)
+		}
+		Tags[i] = expanded
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandVariables(t *testing.T) {
+	hostname, _ := os.Hostname()
+	key, err := expandVariables("{hostname}/{date}/vm-{run}.img")
+	expected := hostname + "/" + runStarted.Format("2006-01-02") + "/vm-" + runStarted.Format("20060102T150405Z") + ".img"
+	if err != nil || key != expected {
+		t.Errorf("got %s, %v", key, err)
+	}
+
+	if _, err := expandVariables("{hostnme}/vm.img"); err == nil || !strings.Contains(err.Error(), "{hostnme}") {
+		t.Errorf("got %v", err)
+	}
+
+	// Only lower-case names in braces are variables.
+	if s, err := expandVariables("{set}-{Set}-{}", "set"); err != nil || s != "{set}-{Set}-{}" {
+		t.Errorf("got %s, %v", s, err)
+	}
+}
+
+func TestCheckVariables(t *testing.T) {
+	defer func() { KeyPrefix, Tags, Metadata = "", nil, nil }()
+	hostname, _ := os.Hostname()
+
+	KeyPrefix = "{hostname}/"
+	Tags = []string{"project={set}", "host={hostname}"}
+	Metadata = []string{"date={date}"}
+	if err := checkVariables(); err != nil {
+		t.Fatal(err)
+	}
+	// Expanding again changes nothing, config show and the upload both check.
+	if err := checkVariables(); err != nil {
+		t.Fatal(err)
+	}
+	if KeyPrefix != hostname+"/" || Tags[0] != "project={set}" || Tags[1] != "host="+hostname || Metadata[0] != "date="+runStarted.Format("2006-01-02") {
+		t.Errorf("got %s, %v, %v", KeyPrefix, Tags, Metadata)
+	}
+
+	KeyPrefix = "{host}/"
+	if err := checkVariables(); err == nil || !strings.HasPrefix(err.Error(), "--prefix: Unknown variable {host}") {
+		t.Errorf("got %v", err)
+	}
+}
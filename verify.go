@@ -0,0 +1,267 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// verify flags
+var VerifyObjectKey string
+
+const MiB = 1024 * 1024
+
+// Part sizes other tools upload with: ours, the AWS CLI's and boto3's
+// default, s3cmd's, and some round numbers people configure.
+var commonPartSizes = []int64{PART_SIZE, 5 * MiB, 8 * MiB, 15 * MiB, 16 * MiB, 32 * MiB, 64 * MiB, 100 * MiB, 128 * MiB, 256 * MiB, 512 * MiB}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify file",
+	Short: "Check a local file against its uploaded object, without downloading it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Verify(newS3Session(Region), BucketName, args[0], VerifyObjectKey)
+	},
+}
+
+// etagCandidate is one guess at how the object was split into parts.
+type etagCandidate struct {
+	how       string
+	partSizes []int64
+}
+
+// etagCandidates lists the ways the object might have been split into parts,
+// best guess first.  Our own uploads have a part manifest, or at least their
+// part size in the metadata.  Objects uploaded
+// by other tools usually have parts of the same size, which the first part
+// tells us; composed objects don't, so then every part is looked up.
+func etagCandidates(s3session s3iface.S3API, bucket string, key string, size int64, etag string, metadata map[string]*string) ([]etagCandidate, error) {
+	m, err := loadPartManifest(s3session, bucket, key)
+	if err != nil && (verifyPublicKey != nil || !isNoSuchKey(err)) {
+		return nil, err
+	}
+	if m != nil {
+		if m.ETag != etag {
+			return nil, fmt.Errorf("%s has changed since its part manifest was written (ETag %s, manifest %s)", key, etag, m.ETag)
+		}
+		parts, err := etagPartCount(m.ETag)
+		if err != nil {
+			return nil, err
+		}
+		if parts == 0 {
+			return []etagCandidate{{"part manifest, single part", nil}}, nil
+		}
+		return []etagCandidate{{fmt.Sprintf("part manifest, %s parts", formatBytes(m.PartSize)), transfer.PartSizes(m.Size, m.PartSize)}}, nil
+	}
+
+	parts, err := etagPartCount(etag)
+	if err != nil {
+		return nil, err
+	}
+	if parts == 0 {
+		return []etagCandidate{{"single part", nil}}, nil
+	}
+
+	var candidates []etagCandidate
+	seen := map[int64]bool{}
+
+	if recorded := recordedPartSize(metadata); recorded > 0 && len(transfer.PartSizes(size, recorded)) == parts {
+		candidates = append(candidates, etagCandidate{fmt.Sprintf("%s parts, from the metadata", formatBytes(recorded)), transfer.PartSizes(size, recorded)})
+		seen[recorded] = true
+	}
+
+	var head *s3.HeadObjectOutput
+	if len(candidates) == 0 {
+		head, err = s3session.HeadObject(&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int64(1),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if head != nil && head.PartsCount != nil && *head.PartsCount == int64(parts) {
+		first := *head.ContentLength
+		if len(transfer.PartSizes(size, first)) == parts {
+			candidates = append(candidates, etagCandidate{fmt.Sprintf("%s parts, from the first part", formatBytes(first)), transfer.PartSizes(size, first)})
+			seen[first] = true
+		} else {
+			sizes, err := objectPartSizes(s3session, bucket, key, etag)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, etagCandidate{"the size of every part", sizes})
+		}
+	}
+
+	// S3 compatible servers may not support HEAD by part number.  Our
+	// automatic part size is a guess of its own for large objects.
+	for _, partSize := range append(commonPartSizes, autoPartSize(size)) {
+		if !seen[partSize] && len(transfer.PartSizes(size, partSize)) == parts {
+			candidates = append(candidates, etagCandidate{fmt.Sprintf("%s parts", formatBytes(partSize)), transfer.PartSizes(size, partSize)})
+			seen[partSize] = true
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: none of the part sizes we know splits %d bytes into %d parts", errUnverifiable, size, parts)
+	}
+	return candidates, nil
+}
+
+// matchETag reads r once and returns the first candidate which gives the
+// ETag, or false if none does.
+func matchETag(r io.Reader, candidates []etagCandidate, etag string) (etagCandidate, bool, error) {
+	writers := make([]*transfer.PartHasher, len(candidates))
+	ws := make([]io.Writer, len(candidates))
+	for i, c := range candidates {
+		writers[i] = newETagWriter(c.partSizes)
+		ws[i] = writers[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(ws...), r); err != nil {
+		return etagCandidate{}, false, err
+	}
+
+	for i, w := range writers {
+		if sum, err := w.Sum(); err == nil && sum == etag {
+			return candidates[i], true, nil
+		}
+	}
+	return etagCandidate{}, false, nil
+}
+
+// Verify checks that the object has the same content as the local file by
+// recomputing its ETag, which also works for archived objects.
+func Verify(s3session s3iface.S3API, bucket string, filename string, key string) error {
+	if key == "" {
+		var err error
+		if key, err = uploadKey(filename); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	if isEncrypted(head.Metadata) {
+		size = encryptedSize(size)
+	}
+	if *head.ContentLength != size {
+		return fmt.Errorf("%s is %d bytes, %s is %d bytes", filename, size, key, *head.ContentLength)
+	}
+
+	ok, how, err := compareObject(s3session, bucket, key, file, head)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s doesn't match %s (%s)", filename, key, how)
+	}
+
+	ui.Printf("%s matches %s (%s)\n", filename, key, how)
+	return nil
+}
+
+// compareObject hashes r the way the object was hashed by S3 and says
+// whether they match, and how they were compared.  r has to be the same size
+// as the object, or for encrypted objects, the file it was encrypted from:
+// it's encrypted again the same way on the fly.
+func compareObject(s3session s3iface.S3API, bucket string, key string, r io.Reader, head *s3.HeadObjectOutput) (bool, string, error) {
+	if isEncrypted(head.Metadata) {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return false, "", err
+		}
+		if id, _ := metadataValue(head.Metadata, ENCRYPTION_KEY_ID_METADATA); id != c.id {
+			return false, "", fmt.Errorf("%s was encrypted with another key", key)
+		}
+		r = encryptReader(r, c)
+	}
+
+	// The ETags of SSE-KMS objects aren't MD5 digests, so compare with the
+	// checksum instead.
+	if isKMS(head) {
+		checksum, partSizes, err := objectChecksum(s3session, bucket, key)
+		if err != nil {
+			return false, "", err
+		}
+
+		ok, err := matchChecksum(r, checksum, partSizes)
+		if err != nil {
+			return false, "", err
+		}
+		if !ok {
+			return false, fmt.Sprintf("SHA-256 checksum %s", checksum), nil
+		}
+		return true, fmt.Sprintf("SHA-256 checksum %s, the object uses SSE-KMS", checksum), nil
+	}
+
+	etag := strings.Trim(*head.ETag, "\"")
+	candidates, err := etagCandidates(s3session, bucket, key, *head.ContentLength, etag, head.Metadata)
+	if err != nil {
+		return false, "", err
+	}
+
+	match, ok, err := matchETag(r, candidates, etag)
+	if err != nil {
+		return false, "", err
+	}
+
+	if !ok {
+		var tried []string
+		for _, c := range candidates {
+			tried = append(tried, c.how)
+		}
+		return false, fmt.Sprintf("ETag %s, tried %s", etag, strings.Join(tried, "; ")), nil
+	}
+
+	return true, fmt.Sprintf("ETag %s, %s", etag, match.how), nil
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&VerifyObjectKey, "key", "", "object to compare with (default: the key the file would be uploaded to)")
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,129 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestVerify(t *testing.T) {
+	data := randomData(8*MiB + 1000)
+
+	tests := []struct {
+		name      string
+		partSizes []int64
+		// byPart is false for servers which don't support HEAD by part
+		// number.
+		byPart bool
+	}{
+		{"aws cli", []int64{8 * MiB, 1000}, true},
+		{"composed", []int64{1000, 8 * MiB}, true},
+		{"no HEAD by part", []int64{5 * MiB, 3*MiB + 1000}, false},
+		{"single part", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3()
+			etag := md5Hex(data)
+			if test.partSizes != nil {
+				etag = multipartETag(data, test.partSizes)
+			}
+			obj := &fakeObject{data: data, etag: etag, storageClass: s3.StorageClassDeepArchive}
+			if test.byPart {
+				obj.partSizes = test.partSizes
+			}
+			fake.objects["archive.bin"] = obj
+
+			filename := writeTestFile(t, data)
+			if err := Verify(fake, "bucket", filename, ""); err != nil {
+				t.Error(err)
+			}
+
+			other := append([]byte{}, data...)
+			other[len(other)/2] ^= 1
+			err := Verify(fake, "bucket", writeTestFile(t, other), "archive.bin")
+			if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+				t.Errorf("a changed file got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyWithManifest(t *testing.T) {
+	defer func() { PartManifest = false }()
+	PartManifest = true
+
+	fake := newFakeS3()
+	data := randomData(PART_SIZE + 1000)
+	filename := writeTestFile(t, data)
+
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(fake, "bucket", filename, ""); err != nil {
+		t.Error(err)
+	}
+
+	// The object was replaced after the manifest was written.
+	fake.objects["archive.bin"].etag = md5Hex(data)
+	if err := Verify(fake, "bucket", filename, ""); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("a replaced object got %v", err)
+	}
+}
+
+func TestVerifyUnknownPartSize(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(3000)
+	fake.objects["archive.bin"] = &fakeObject{data: data, etag: multipartETag(data, []int64{1000, 1000, 1000}), storageClass: s3.StorageClassStandard}
+
+	err := Verify(fake, "bucket", writeTestFile(t, data), "")
+	if !errors.Is(err, errUnverifiable) {
+		t.Errorf("got %v, expected it to be unverifiable", err)
+	}
+}
+
+func TestVerifyRecordedPartSize(t *testing.T) {
+	fake := newFakeS3()
+	data := randomData(3000)
+	fake.objects["archive.bin"] = &fakeObject{data: data, etag: multipartETag(data, []int64{1000, 1000, 1000}), storageClass: s3.StorageClassDeepArchive,
+		metadata: partSizeMetadata(nil, 1000)}
+
+	head, err := fake.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("archive.bin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, how, err := compareObject(fake, "bucket", "archive.bin", bytes.NewReader(data), head)
+	if err != nil || !ok || !strings.Contains(how, "from the metadata") {
+		t.Errorf("got %v, %s, %v", ok, how, err)
+	}
+
+	// Uploads record it.
+	filename := writeTestFile(t, randomData(PART_SIZE+1000))
+	if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if size := recordedPartSize(fake.objects["archive.bin"].metadata); size != PART_SIZE {
+		t.Errorf("recorded part size %d", size)
+	}
+}
@@ -0,0 +1,167 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/honza/s3-glacier-uploader/internal/transfer"
+)
+
+// CLI flags
+var VerifyOnly bool
+
+// VerifyUploaded checks the object filename would be uploaded to the way an
+// upload checks what it's just sent.
+func VerifyUploaded(bucket string, region string, filename string) error {
+	if filename == STDIN || isRemoteSource(filename) || Tar || Recompress != "" || splitBytes > 0 {
+		return fmt.Errorf("--verify-only checks files uploaded as they are, not streams, --tar, --recompress or --split-size")
+	}
+	return verifyUploaded(newS3Session(region), bucket, filename)
+}
+
+// verifyUploaded does everything an upload of filename does locally: it
+// reads the file, encrypts it with --encrypt, cuts it into parts of the size
+// an upload would and hashes them.  Then it gives the object the verdict a
+// completed upload would get, by --verify.  Of S3 it only needs HeadObject,
+// and GetObjectAttributes for checksums, so it works with read-only
+// credentials, e.g. for a periodic audit.
+func verifyUploaded(s3session s3iface.S3API, bucket string, filename string) error {
+	key, err := uploadKey(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory, --verify-only checks files", filename)
+	}
+
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	var source io.Reader = file
+	size := stat.Size()
+	if Encrypt {
+		c, err := newObjectCipher(bucket, key)
+		if err != nil {
+			return err
+		}
+		if id, _ := metadataValue(head.Metadata, ENCRYPTION_KEY_ID_METADATA); id != c.id {
+			return fmt.Errorf("%s wasn't encrypted with our key", key)
+		}
+		source = encryptReader(source, c)
+		size = encryptedSize(size)
+	}
+	if aws.Int64Value(head.ContentLength) != size {
+		return fmt.Errorf("%s would be uploaded as %d bytes, %s is %d bytes", filename, size, key, aws.Int64Value(head.ContentLength))
+	}
+
+	partSize, err := filePartSize(size)
+	if err != nil {
+		return err
+	}
+
+	ui.Printf("Verifying %s against %s, in parts of %s\n", filename, key, formatBytes(int64(partSize)))
+	bar := ui.ByteBar(size, "verifying")
+	digests, parts, err := hashParts(io.TeeReader(source, bar), int64(partSize))
+	if err != nil {
+		return err
+	}
+
+	// What CompleteMultipartUpload would have said.
+	resp := &s3.CompleteMultipartUploadOutput{ETag: head.ETag}
+	if ChecksumAlgorithm != "" {
+		checksum, _, err := objectChecksum(s3session, bucket, key)
+		if err != nil {
+			return err
+		}
+		resp.ChecksumSHA256 = aws.String(checksum)
+	}
+
+	etag := transfer.MultipartETag(digests, len(parts))
+	if err := verifyCompleted(resp, etag, parts, fmt.Errorf("%s doesn't match %s", filename, key)); err != nil {
+		return err
+	}
+	ui.Printf("%s matches %s\n", filename, key)
+	return nil
+}
+
+// hashParts reads r in parts of partSize, like an upload does, and returns
+// the MD5 digests of the parts one after the other, and the parts with their
+// SHA-256 checksums if we send those.  An empty r is one empty part.
+func hashParts(r io.Reader, partSize int64) ([]byte, []*s3.CompletedPart, error) {
+	var digests []byte
+	var parts []*s3.CompletedPart
+
+	for number := int64(1); ; number++ {
+		md5sum := md5.New()
+		var checksum hash.Hash
+		w := io.Writer(md5sum)
+		if ChecksumAlgorithm != "" {
+			checksum = sha256.New()
+			w = io.MultiWriter(md5sum, checksum)
+		}
+
+		n, err := io.CopyN(w, r, partSize)
+		if err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("Failed to read part %d: %w", number, err)
+		}
+		if n == 0 && number > 1 {
+			break
+		}
+
+		digests = md5sum.Sum(digests)
+		part := &s3.CompletedPart{PartNumber: aws.Int64(number)}
+		if checksum != nil {
+			part.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(checksum.Sum(nil)))
+		}
+		parts = append(parts, part)
+
+		if n < partSize {
+			break
+		}
+	}
+	return digests, parts, nil
+}
+
+func init() {
+	rootCmd.Flags().BoolVar(&VerifyOnly, "verify-only", false, "don't upload, only check the uploaded object like an upload would, with read-only access")
+}
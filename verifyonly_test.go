@@ -0,0 +1,74 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// headOnlyS3 only has the calls --verify-only may make, anything else
+// panics.
+type headOnlyS3 struct {
+	s3iface.S3API
+	fake *fakeS3
+}
+
+func (r headOnlyS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return r.fake.HeadObject(in)
+}
+
+func (r headOnlyS3) GetObjectAttributes(in *s3.GetObjectAttributesInput) (*s3.GetObjectAttributesOutput, error) {
+	return r.fake.GetObjectAttributes(in)
+}
+
+func TestVerifyOnly(t *testing.T) {
+	for _, algorithm := range []string{"", s3.ChecksumAlgorithmSha256} {
+		t.Run("checksum "+algorithm, func(t *testing.T) {
+			defer func() { ChecksumAlgorithm = "" }()
+			ChecksumAlgorithm = algorithm
+
+			fake := newFakeS3()
+			data := randomData(2*PART_SIZE + 1000)
+			filename := writeTestFile(t, data)
+			if err := uploadFile(fake, fake.cleanup, "bucket", filename, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := verifyUploaded(headOnlyS3{fake: fake}, "bucket", filename); err != nil {
+				t.Error(err)
+			}
+
+			other := append([]byte{}, data...)
+			other[PART_SIZE+1] ^= 1
+			err := verifyUploaded(headOnlyS3{fake: fake}, "bucket", writeTestFile(t, other))
+			if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+				t.Errorf("a changed file got %v", err)
+			}
+		})
+	}
+}
+
+func TestHashPartsEmpty(t *testing.T) {
+	digests, parts, err := hashParts(strings.NewReader(""), PART_SIZE)
+	if err != nil || len(parts) != 1 || len(digests) != 16 {
+		t.Errorf("an empty file makes %d parts: %v", len(parts), err)
+	}
+}
@@ -0,0 +1,171 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// verify-set flags
+var VerifySetUpload bool
+
+var verifySetCmd = &cobra.Command{
+	Use:   "verify-set job",
+	Short: "Check that every object of the latest set of job is in the bucket as it was published, and record that it is",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return VerifySet(ui.Writer(), newS3Session(Region), BucketName, args[0], VerifySetUpload, time.Now())
+	},
+}
+
+type setFailure struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// setVerification is the record of a verify-set.  Signature is the ed25519
+// signature with --signing-key of the record's JSON without it.
+type setVerification struct {
+	Version   int          `json:"version"`
+	Job       string       `json:"job"`
+	Bucket    string       `json:"bucket"`
+	Published time.Time    `json:"published"`
+	Verified  time.Time    `json:"verified"`
+	Host      string       `json:"host"`
+	Objects   int          `json:"objects"`
+	Bytes     int64        `json:"bytes"`
+	Failures  []setFailure `json:"failures,omitempty"`
+	Signature string       `json:"signature,omitempty"`
+}
+
+func verificationKey(job string, verified time.Time) string {
+	return SETS_PREFIX + job + "/verifications/" + verified.UTC().Format("20060102T150405Z") + ".json"
+}
+
+// publishedETags are the ETags the catalog has for the objects of the set,
+// from the last uploads before it was published.
+func publishedETags(entries []catalogEntry, set *publishedSet, bucket string) map[string]string {
+	etags := map[string]string{}
+	for _, e := range entries {
+		if e.Bucket == bucket && e.ETag != "" && !e.Uploaded.After(set.Published) {
+			etags[e.Key] = strings.Trim(e.ETag, `"`)
+		}
+	}
+	return etags
+}
+
+// checkSetObject says what's wrong with obj, if anything.
+func checkSetObject(s3session s3iface.S3API, bucket string, set *publishedSet, obj publishedObject, etag string) string {
+	head, err := s3session.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if isNoSuchKey(err) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if size := aws.Int64Value(head.ContentLength); size != obj.Size {
+		return fmt.Sprintf("size is %d, expected %d", size, obj.Size)
+	}
+	if aws.TimeValue(head.LastModified).After(set.Published) {
+		return "changed after the set was published"
+	}
+	if got := strings.Trim(aws.StringValue(head.ETag), `"`); etag != "" && got != etag {
+		return fmt.Sprintf("ETag is %s, the catalog has %s", got, etag)
+	}
+	return ""
+}
+
+// VerifySet looks up every object of the latest published set of job, a
+// few at a time, and checks its size, that it didn't change since, and its
+// ETag against the catalog of this machine, where it has one.  The record of
+// that goes into the catalog, signed with --signing-key if there is one, and
+// with upload next to the set pointer as well.
+func VerifySet(w io.Writer, s3session s3iface.S3API, bucket string, job string, upload bool, now time.Time) error {
+	set, err := loadPublishedSet(s3session, bucket, job)
+	if err != nil {
+		return err
+	}
+	entries, err := loadCatalog()
+	if err != nil {
+		return err
+	}
+	etags := publishedETags(entries, set, bucket)
+
+	problems := make([]string, len(set.Objects))
+	forEachObject(len(set.Objects), func(i int) error {
+		obj := set.Objects[i]
+		problems[i] = checkSetObject(s3session, bucket, set, obj, etags[obj.Key])
+		return nil
+	})
+
+	record := setVerification{
+		Version:   1,
+		Job:       job,
+		Bucket:    bucket,
+		Published: set.Published,
+		Verified:  now.UTC(),
+		Host:      auditHost(),
+		Objects:   len(set.Objects),
+	}
+	for i, obj := range set.Objects {
+		record.Bytes += obj.Size
+		if problems[i] != "" {
+			record.Failures = append(record.Failures, setFailure{obj.Key, problems[i]})
+			fmt.Fprintf(w, "%s: %s\n", obj.Key, problems[i])
+		}
+	}
+	if signingPrivateKey != nil {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingPrivateKey, data))
+	}
+
+	key := verificationKey(job, now)
+	recordUpload(catalogEntry{Bucket: bucket, Key: key, Path: "verify-set " + job, Size: record.Bytes, StorageClass: s3.StorageClassStandard, Uploaded: record.Verified, Verification: &record})
+	if upload {
+		if err := putJSON(s3session, bucket, key, record); err != nil {
+			return fmt.Errorf("Failed to upload the verification record: %w", err)
+		}
+	}
+
+	if len(record.Failures) > 0 {
+		return fmt.Errorf("%d of the %d objects of the set of %s failed verification", len(record.Failures), record.Objects, job)
+	}
+	fmt.Fprintf(w, "All %d objects (%s) of the set of %s published %s are there\n", record.Objects, formatBytes(record.Bytes), job, set.Published.Local().Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+func init() {
+	verifySetCmd.Flags().BoolVar(&VerifySetUpload, "upload", false, "also store the verification record in the bucket, next to the set pointer")
+	rootCmd.AddCommand(verifySetCmd)
+}
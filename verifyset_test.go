@@ -0,0 +1,92 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySet(t *testing.T) {
+	SyncPublish = true
+	defer func() { SyncPublish = false }()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPrivateKey = private
+	defer func() { signingPrivateKey = nil }()
+
+	dir := writeTree(t, map[string]string{"a.jpg": "a", "b.jpg": "bb", "c.jpg": "ccc"})
+	fake := newFakeS3()
+	if err := Sync(fake, nil, fake.cleanup, "bucket", dir, "photos", SYNC_COMPARE_MTIME, false, false); err != nil {
+		t.Fatal(err)
+	}
+	job := filepath.Base(dir)
+
+	now := time.Now().Add(time.Minute)
+	var out bytes.Buffer
+	if err := VerifySet(&out, fake, "bucket", job, true, now); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	var record setVerification
+	if found, err := getJSON(fake, "bucket", verificationKey(job, now), &record); !found || err != nil {
+		t.Fatalf("the record wasn't uploaded: %v", err)
+	}
+	if record.Objects != 3 || record.Bytes != 6 || len(record.Failures) != 0 {
+		t.Errorf("unexpected record %+v", record)
+	}
+	signature, _ := base64.StdEncoding.DecodeString(record.Signature)
+	record.Signature = ""
+	data, _ := json.Marshal(record)
+	if !ed25519.Verify(public, data, signature) {
+		t.Error("the record's signature doesn't verify")
+	}
+
+	// b.jpg is gone, and c.jpg was replaced without changing its time.
+	delete(fake.objects, "photos/b.jpg")
+	fake.objects["photos/c.jpg"].etag = md5Hex([]byte("CCC"))
+	out.Reset()
+	if err := VerifySet(&out, fake, "bucket", job, false, now.Add(time.Minute)); err == nil {
+		t.Fatal("a damaged set was verified")
+	}
+	for _, expected := range []string{"photos/b.jpg: missing", "photos/c.jpg: ETag is"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+
+	entries, err := loadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if last.Verification == nil || len(last.Verification.Failures) != 2 || last.Key != verificationKey(job, now.Add(time.Minute)) {
+		t.Errorf("the catalog has %+v", last)
+	}
+	if fake.objects[last.Key] != nil {
+		t.Error("uploaded the record without --upload")
+	}
+}
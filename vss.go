@@ -0,0 +1,101 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// CLI flags
+var VSS bool
+
+func checkVSS() error {
+	if VSS && runtime.GOOS != "windows" {
+		return fmt.Errorf("--vss only works on Windows")
+	}
+	return nil
+}
+
+// snapshotSource creates a Volume Shadow Copy of the drive path is on and
+// returns where path is in it, so that files other programs have open, like
+// Outlook's PSTs or databases, are uploaded as they were at one moment.  The
+// returned function deletes the shadow copy; until it's called, the copy
+// takes up space on the drive.
+func snapshotSource(path string) (string, func(), error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	volume, rest, err := splitVolume(abs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, device, err := createShadowCopy(volume)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to create a shadow copy of %s (drop --vss to upload anyway): %w", volume, err)
+	}
+	ui.Warnf("Uploading from shadow copy %s of %s\n", id, volume)
+
+	release := func() {
+		if err := deleteShadowCopy(id); err != nil {
+			ui.Warnf("Failed to delete shadow copy %s, delete it with vssadmin: %v\n", id, err)
+		}
+	}
+	return shadowPath(device, rest), release, nil
+}
+
+// splitVolume splits an absolute Windows path into its drive, e.g. C:\, and
+// the rest.  Shadow copies are of local drives, so network paths are refused.
+func splitVolume(path string) (string, string, error) {
+	if len(path) < 3 || path[1] != ':' || (path[2] != '\\' && path[2] != '/') {
+		return "", "", fmt.Errorf("--vss only works for files on a local drive, not %s", path)
+	}
+	letter := strings.ToUpper(path[:1])
+	if letter < "A" || letter > "Z" {
+		return "", "", fmt.Errorf("--vss only works for files on a local drive, not %s", path)
+	}
+	return letter + `:\`, strings.TrimLeft(path[3:], `\/`), nil
+}
+
+// shadowPath is where a file is in a shadow copy, given the copy's device,
+// e.g. \\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy3.
+func shadowPath(device string, rest string) string {
+	device = strings.TrimRight(device, `\`)
+	if rest == "" {
+		return device + `\`
+	}
+	return device + `\` + strings.ReplaceAll(rest, "/", `\`)
+}
+
+// parseShadowCopy reads the ID and the device of a new shadow copy from what
+// the PowerShell script prints, one per line.
+func parseShadowCopy(out string) (string, string, error) {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], `\\?\`) {
+		return "", "", fmt.Errorf("Unexpected output from PowerShell: %q", out)
+	}
+	return lines[0], lines[1], nil
+}
@@ -0,0 +1,66 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestSplitVolume(t *testing.T) {
+	for path, want := range map[string][2]string{
+		`C:\Users\honza\Outlook.pst`: {`C:\`, `Users\honza\Outlook.pst`},
+		`d:/data/db`:                 {`D:\`, `data/db`},
+		`E:\`:                        {`E:\`, ``},
+	} {
+		volume, rest, err := splitVolume(path)
+		if err != nil || volume != want[0] || rest != want[1] {
+			t.Errorf("%s: got %q %q %v, want %q %q", path, volume, rest, err, want[0], want[1])
+		}
+	}
+
+	for _, path := range []string{`\\server\share\file`, `/home/honza`, `C:file`, `1:\x`} {
+		if _, _, err := splitVolume(path); err == nil {
+			t.Errorf("%s was taken for a local drive", path)
+		}
+	}
+}
+
+func TestShadowPath(t *testing.T) {
+	device := `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy3`
+	for rest, want := range map[string]string{
+		`Users\honza\Outlook.pst`: device + `\Users\honza\Outlook.pst`,
+		`data/db`:                 device + `\data\db`,
+		``:                        device + `\`,
+	} {
+		if got := shadowPath(device+`\`, rest); got != want {
+			t.Errorf("%q: got %s, want %s", rest, got, want)
+		}
+	}
+}
+
+func TestParseShadowCopy(t *testing.T) {
+	out := "\r\n{A1B2C3D4-0000-1111-2222-333344445555}\r\n\\\\?\\GLOBALROOT\\Device\\HarddiskVolumeShadowCopy7\r\n"
+	id, device, err := parseShadowCopy(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "{A1B2C3D4-0000-1111-2222-333344445555}" || device != `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy7` {
+		t.Errorf("got %s %s", id, device)
+	}
+
+	if _, _, err := parseShadowCopy("Access is denied.\r\n"); err == nil {
+		t.Error("parsed an error message")
+	}
+}
@@ -0,0 +1,57 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Win32_ShadowCopy.Create makes a shadow copy which stays until it's deleted,
+// also on desktop editions of Windows, where vssadmin can't create them.  It
+// takes an elevated prompt.
+const CREATE_SHADOW_COPY = `$ErrorActionPreference = 'Stop'
+$r = Invoke-CimMethod -ClassName Win32_ShadowCopy -MethodName Create -Arguments @{Volume = '%s'; Context = 'ClientAccessible'}
+if ($r.ReturnValue -ne 0) { Write-Error "Win32_ShadowCopy.Create returned $($r.ReturnValue)" }
+$s = Get-CimInstance Win32_ShadowCopy | Where-Object ID -eq $r.ShadowID
+$s.ID
+$s.DeviceObject`
+
+const DELETE_SHADOW_COPY = `$ErrorActionPreference = 'Stop'
+Get-CimInstance Win32_ShadowCopy | Where-Object ID -eq '%s' | Remove-CimInstance`
+
+func powershell(script string) (string, error) {
+	out, err := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func createShadowCopy(volume string) (string, string, error) {
+	out, err := powershell(fmt.Sprintf(CREATE_SHADOW_COPY, volume))
+	if err != nil {
+		return "", "", err
+	}
+	return parseShadowCopy(out)
+}
+
+func deleteShadowCopy(id string) error {
+	_, err := powershell(fmt.Sprintf(DELETE_SHADOW_COPY, id))
+	return err
+}
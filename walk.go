@@ -0,0 +1,131 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CLI flags
+var ScanWorkers int
+var SkipSnapshotDirs bool
+
+// The directories file servers and file systems show their snapshots in,
+// which --skip-snapshot-dirs leaves out: a tree's snapshots are copies of
+// it, many times over.
+var snapshotDirs = map[string]bool{
+	".snapshot":  true, // NetApp and other NFS servers
+	".snapshots": true, // snapper on btrfs
+	".zfs":       true,
+}
+
+// skipDir tells whether to leave out the directory p: a snapshot directory
+// with --skip-snapshot-dirs, or one of ours.
+func skipDir(p string) bool {
+	return (SkipSnapshotDirs && snapshotDirs[filepath.Base(p)]) || isOwnDir(p)
+}
+
+// walkTree calls fn for everything under dir, reading ScanWorkers
+// directories at a time.  On NFS every directory read and every stat is a
+// round trip to the server, which filepath.WalkDir makes one after the other.
+// fn is called from the workers, so it has to be safe for that, and in no
+// particular order.  The first error stops the walk and is returned.
+func walkTree(dir string, fn func(p string, entry fs.DirEntry) error) error {
+	w := &treeWalker{fn: fn, queue: []string{dir}, pending: 1}
+	w.cond = sync.NewCond(&w.mu)
+
+	workers := ScanWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	return w.err
+}
+
+// treeWalker is the directories walkTree has yet to read.
+type treeWalker struct {
+	fn func(p string, entry fs.DirEntry) error
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue is the directories found but not read, and pending those and
+	// the ones being read, which may find more.
+	queue   []string
+	pending int
+	err     error
+}
+
+func (w *treeWalker) work() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.pending > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 || w.err != nil {
+			w.mu.Unlock()
+			return
+		}
+		dir := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.mu.Unlock()
+
+		dirs, err := w.read(dir)
+
+		w.mu.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.queue = append(w.queue, dirs...)
+		w.pending += len(dirs) - 1
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// read calls fn for what's in dir, and returns the directories in it.
+func (w *treeWalker) read(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && skipDir(p) {
+			continue
+		}
+		if err := w.fn(p, entry); err != nil {
+			return nil, err
+		}
+		if entry.IsDir() {
+			dirs = append(dirs, p)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,100 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestWalkTree(t *testing.T) {
+	defer func() { ScanWorkers, SkipSnapshotDirs = 8, false }()
+
+	tree := map[string]string{
+		"top.txt":              "",
+		"a/one.txt":            "",
+		"a/b/two.txt":          "",
+		"a/b/c/three.txt":      "",
+		"d/four.txt":           "",
+		"d/.zfs/snap/four.txt": "",
+	}
+	for i := 0; i < 20; i++ {
+		tree[fmt.Sprintf("wide/%d/file.txt", i)] = ""
+	}
+	dir := writeTree(t, tree)
+
+	walk := func() []string {
+		t.Helper()
+		var mu sync.Mutex
+		var files []string
+		err := walkTree(dir, func(p string, entry fs.DirEntry) error {
+			if entry.Type().IsRegular() {
+				rel, _ := filepath.Rel(dir, p)
+				mu.Lock()
+				files = append(files, filepath.ToSlash(rel))
+				mu.Unlock()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(files)
+		return files
+	}
+
+	var want []string
+	for name := range tree {
+		want = append(want, name)
+	}
+	sort.Strings(want)
+
+	for _, workers := range []int{1, 4} {
+		ScanWorkers = workers
+		if got := walk(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%d workers found %v", workers, got)
+		}
+	}
+
+	SkipSnapshotDirs = true
+	got := walk()
+	if len(got) != len(want)-1 {
+		t.Errorf("found %v with --skip-snapshot-dirs", got)
+	}
+	for _, name := range got {
+		if name == "d/.zfs/snap/four.txt" {
+			t.Error("found the snapshot")
+		}
+	}
+
+	// The first error stops the walk.
+	failure := errors.New("failure")
+	err := walkTree(dir, func(p string, entry fs.DirEntry) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("got %v", err)
+	}
+	if err := walkTree(filepath.Join(dir, "missing"), func(string, fs.DirEntry) error { return nil }); err == nil {
+		t.Error("walked a directory which isn't there")
+	}
+}
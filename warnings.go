@@ -0,0 +1,118 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Warnings are what went wrong without failing the command: files left
+// out, metadata which couldn't be kept, checks done with less than we'd
+// like.  Printed as they happen, they scroll by among the messages, so
+// they're also collected and summarized when the command is done.
+const (
+	WARNING_SKIPPED   = "skipped"
+	WARNING_METADATA  = "metadata"
+	WARNING_DOWNGRADE = "downgrade"
+)
+
+// How many warnings of each kind the summary repeats.
+const WARNINGS_SHOWN = 5
+
+// runWarning is a warning with what it's about, for --format json.
+type runWarning struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"subject,omitempty"`
+	Message string `json:"warning"`
+}
+
+// warningsEvent is the summary for --format json.
+type warningsEvent struct {
+	Event    string       `json:"event"`
+	Warnings []runWarning `json:"warnings"`
+}
+
+var warnings struct {
+	mu         sync.Mutex
+	list       []runWarning
+	summarized bool
+}
+
+// warn tells the user about a warning of kind about subject, usually a
+// file or key, and keeps it for the summary.
+func warn(kind string, subject string, format string, args ...interface{}) {
+	w := runWarning{Kind: kind, Subject: subject, Message: strings.TrimRight(fmt.Sprintf(format, args...), "\n")}
+
+	warnings.mu.Lock()
+	warnings.list = append(warnings.list, w)
+	warnings.mu.Unlock()
+
+	ui.Warning(w)
+}
+
+// collectedWarnings are the warnings so far.
+func collectedWarnings() []runWarning {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	return append([]runWarning(nil), warnings.list...)
+}
+
+// summarizeWarnings repeats the warnings at the end of a command: how many
+// of each kind, and the first few of them.  It's only done once.
+func summarizeWarnings() {
+	warnings.mu.Lock()
+	list := append([]runWarning(nil), warnings.list...)
+	done := warnings.summarized
+	warnings.summarized = true
+	warnings.mu.Unlock()
+	if done || len(list) == 0 {
+		return
+	}
+
+	ui.Event(warningsEvent{Event: "warnings", Warnings: list})
+	if Format == FORMAT_JSON {
+		return
+	}
+
+	byKind := map[string][]runWarning{}
+	var kinds []string
+	for _, w := range list {
+		if byKind[w.Kind] == nil {
+			kinds = append(kinds, w.Kind)
+		}
+		byKind[w.Kind] = append(byKind[w.Kind], w)
+	}
+	sort.Strings(kinds)
+
+	var counts []string
+	for _, kind := range kinds {
+		counts = append(counts, fmt.Sprintf("%d %s", len(byKind[kind]), kind))
+	}
+	ui.Warnf("\n%d warnings: %s\n", len(list), strings.Join(counts, ", "))
+	for _, kind := range kinds {
+		for i, w := range byKind[kind] {
+			if i == WARNINGS_SHOWN {
+				ui.Warnf("  ... and %d more %s\n", len(byKind[kind])-WARNINGS_SHOWN, kind)
+				break
+			}
+			ui.Warnf("  %s\n", w.Message)
+		}
+	}
+}
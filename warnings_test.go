@@ -0,0 +1,83 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetWarnings() {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	warnings.list, warnings.summarized = nil, false
+}
+
+func TestWarningsJSON(t *testing.T) {
+	var out bytes.Buffer
+	ui = newJSONRenderer(&out)
+	Format = FORMAT_JSON
+	resetWarnings()
+	defer func() { Format, ui = FORMAT_HUMAN, humanRenderer{}; resetWarnings() }()
+
+	warn(WARNING_SKIPPED, "photos/link", "Skipping the symlink %s\n", "photos/link")
+	warn(WARNING_METADATA, "notes.txt", "Failed to restore the extended attribute user.a of notes.txt")
+	summarizeWarnings()
+	summarizeWarnings()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("printed %q", lines)
+	}
+	var first jsonLine
+	json.Unmarshal([]byte(lines[0]), &first)
+	if first.Warning != "Skipping the symlink photos/link" || first.Kind != WARNING_SKIPPED || first.Subject != "photos/link" {
+		t.Errorf("warned %s", lines[0])
+	}
+	var summary warningsEvent
+	json.Unmarshal([]byte(lines[2]), &summary)
+	if summary.Event != "warnings" || len(summary.Warnings) != 2 || summary.Warnings[1].Kind != WARNING_METADATA {
+		t.Errorf("summarized %s", lines[2])
+	}
+	if n := len(collectedWarnings()); n != 2 {
+		t.Errorf("%d warnings left for the metrics", n)
+	}
+}
+
+func TestSyncWarnsAboutSymlinks(t *testing.T) {
+	resetWarnings()
+	defer resetWarnings()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Skip(err)
+	}
+
+	files, err := scanDirectory(dir, "")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found %+v, %v", files, err)
+	}
+	found := collectedWarnings()
+	if len(found) != 1 || found[0].Kind != WARNING_SKIPPED || found[0].Subject != filepath.Join(dir, "link") {
+		t.Errorf("warned %+v", found)
+	}
+}
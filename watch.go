@@ -0,0 +1,229 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/cobra"
+)
+
+// watch flags
+var WatchPrefix string
+var WatchPoll time.Duration
+var WatchSettle time.Duration
+var WatchDelete bool
+var WatchMoveTo string
+
+var watchCmd = &cobra.Command{
+	Use:   "watch directory",
+	Short: "Upload every file dropped into a directory, once it has stopped changing",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stop := trapInterrupts()
+		err := checkWatchFlags()
+		if err == nil {
+			err = Watch(newS3Session(Region), lazyCleanup(Region), BucketName, longPath(args[0]))
+		}
+		stop()
+		return err
+	},
+}
+
+func checkWatchFlags() error {
+	if WatchPoll < time.Second {
+		return fmt.Errorf("--poll must be at least 1s")
+	}
+	if WatchDelete && WatchMoveTo != "" {
+		return fmt.Errorf("--delete-after-upload and --move-to don't go together")
+	}
+	if (WatchDelete || WatchMoveTo != "") && VerifyUpload == VERIFY_NONE {
+		return fmt.Errorf("--delete-after-upload and --move-to only let go of verified uploads, not with --verify none")
+	}
+	if WatchMoveTo != "" {
+		info, err := os.Stat(WatchMoveTo)
+		if err != nil {
+			return fmt.Errorf("Invalid --move-to: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("--move-to %s isn't a directory", WatchMoveTo)
+		}
+	}
+	return nil
+}
+
+// watchedFile is a file as the last scan found it: since when it's been the
+// same, and whether it's been uploaded like that.
+type watchedFile struct {
+	localFile
+	since    time.Time
+	uploaded bool
+}
+
+// watcher tells which files of a directory have stopped changing.  Files
+// are still being copied in while their size or modification time change;
+// those of the same size and time for settle are taken as complete.
+type watcher struct {
+	dir    string
+	prefix string
+	settle time.Duration
+	files  map[string]*watchedFile
+}
+
+func newWatcher(dir string, prefix string, settle time.Duration) *watcher {
+	return &watcher{dir: dir, prefix: prefix, settle: settle, files: map[string]*watchedFile{}}
+}
+
+// scan looks at the directory again, and returns the files which have
+// settled and aren't uploaded yet.
+func (w *watcher) scan(now time.Time) ([]localFile, error) {
+	files, err := scanDirectory(w.dir, w.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	var settled []localFile
+	for _, file := range files {
+		found[file.Path] = true
+		seen := w.files[file.Path]
+		if seen == nil || seen.Size != file.Size || !seen.ModTime.Equal(file.ModTime) {
+			w.files[file.Path] = &watchedFile{localFile: file, since: now}
+			continue
+		}
+		if !seen.uploaded && now.Sub(seen.since) >= w.settle {
+			settled = append(settled, file)
+		}
+	}
+	for path := range w.files {
+		if !found[path] {
+			delete(w.files, path)
+		}
+	}
+	sort.Slice(settled, func(i, j int) bool {
+		return settled[i].Path < settled[j].Path
+	})
+	return settled, nil
+}
+
+// uploaded remembers that the file went up as scanned, so it's only uploaded
+// again once it changes.
+func (w *watcher) uploaded(file localFile) {
+	if seen := w.files[file.Path]; seen != nil {
+		seen.uploaded = true
+	}
+}
+
+// Watch uploads the files of dir as they settle, until it's interrupted.  A
+// file which fails is tried again on the next scan.  Once one is uploaded
+// and verified, --delete-after-upload deletes it, and --move-to moves it
+// there, unless it changed while it was uploaded.
+func Watch(s3session s3iface.S3API, aborts cleanupSession, bucket string, dir string) error {
+	if WatchMoveTo != "" {
+		// Files moved within the directory would be found again.
+		abs, _ := filepath.Abs(dir)
+		moveTo, _ := filepath.Abs(WatchMoveTo)
+		rel, err := filepath.Rel(abs, moveTo)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("--move-to %s is in %s", WatchMoveTo, dir)
+		}
+	}
+	w := newWatcher(dir, WatchPrefix, WatchSettle)
+	ui.Printf("Watching %s, uploading files to %s once they haven't changed for %s\n", dir, bucket, WatchSettle)
+
+	ticker := time.NewTicker(WatchPoll)
+	defer ticker.Stop()
+	for {
+		settled, err := w.scan(time.Now())
+		if err != nil {
+			return err
+		}
+		for _, file := range settled {
+			if interrupted() {
+				return nil
+			}
+			if err := uploadObject(s3session, aborts, bucket, file.Path, file.Key, ""); err != nil {
+				if interrupted() {
+					return nil
+				}
+				ui.Warnf("Failed to upload %s, trying again later: %v\n", file.Path, err)
+				continue
+			}
+			w.uploaded(file)
+			if err := afterUpload(dir, file); err != nil {
+				ui.Warnf("%s is uploaded to %s, but: %v\n", file.Path, file.Key, err)
+				continue
+			}
+			ui.Printf("Uploaded %s to %s\n", file.Path, file.Key)
+		}
+
+		select {
+		case <-interrupt.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// afterUpload deletes or moves a file which has been uploaded, if it's still
+// what was uploaded.
+func afterUpload(dir string, file localFile) error {
+	if !WatchDelete && WatchMoveTo == "" {
+		return nil
+	}
+	if VerifyUpload == VERIFY_NONE {
+		return fmt.Errorf("it wasn't verified, --verify is none, keeping it")
+	}
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != file.Size || !info.ModTime().Equal(file.ModTime) {
+		return fmt.Errorf("it changed while it was uploaded, keeping it")
+	}
+
+	if WatchDelete {
+		ui.Printf("Deleting %s\n", file.Path)
+		return os.Remove(file.Path)
+	}
+	rel, err := filepath.Rel(dir, file.Path)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(WatchMoveTo, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	ui.Printf("Moving %s to %s\n", file.Path, target)
+	return os.Rename(file.Path, target)
+}
+
+func init() {
+	watchCmd.Flags().StringVar(&WatchPrefix, "prefix", "", "upload under this prefix, e.g. {hostname}/")
+	watchCmd.Flags().DurationVar(&WatchPoll, "poll", 10*time.Second, "how often to look for new files")
+	watchCmd.Flags().DurationVar(&WatchSettle, "settle", time.Minute, "upload a file once its size and modification time have been the same for this long")
+	watchCmd.Flags().BoolVar(&WatchDelete, "delete-after-upload", false, "delete files once they're uploaded and verified")
+	watchCmd.Flags().StringVar(&WatchMoveTo, "move-to", "", "move files to this directory once they're uploaded and verified, keeping their paths")
+	watchCmd.Flags().IntVar(&Concurrency, "concurrency", 4, "number of parts to upload in parallel")
+	rootCmd.AddCommand(watchCmd)
+}
@@ -0,0 +1,118 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherSettles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "photo.jpg")
+	os.WriteFile(filename, []byte("half"), 0644)
+
+	w := newWatcher(dir, "drop", time.Minute)
+	start := time.Now()
+	if settled, err := w.scan(start); err != nil || len(settled) != 0 {
+		t.Fatalf("a new file settled: %v, %v", settled, err)
+	}
+
+	// Still being copied in.
+	os.WriteFile(filename, []byte("half and the rest"), 0644)
+	if settled, _ := w.scan(start.Add(2 * time.Minute)); len(settled) != 0 {
+		t.Fatalf("a growing file settled: %v", settled)
+	}
+	if settled, _ := w.scan(start.Add(150 * time.Second)); len(settled) != 0 {
+		t.Fatalf("settled too early: %v", settled)
+	}
+	settled, _ := w.scan(start.Add(3 * time.Minute))
+	if len(settled) != 1 || settled[0].Key != "drop/photo.jpg" {
+		t.Fatalf("settled %v", settled)
+	}
+
+	w.uploaded(settled[0])
+	if settled, _ := w.scan(start.Add(time.Hour)); len(settled) != 0 {
+		t.Errorf("an uploaded file settled again: %v", settled)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	defer func(poll, settle time.Duration, moveTo string) {
+		WatchPoll, WatchSettle, WatchMoveTo = poll, settle, moveTo
+	}(WatchPoll, WatchSettle, WatchMoveTo)
+	WatchPoll, WatchSettle, WatchMoveTo = 10*time.Millisecond, 0, t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func(ctx context.Context) { interrupt = ctx }(interrupt)
+	interrupt = ctx
+
+	dir := t.TempDir()
+	data := randomData(1000)
+	os.MkdirAll(filepath.Join(dir, "2026"), 0755)
+	os.WriteFile(filepath.Join(dir, "2026", "scan.tif"), data, 0644)
+
+	moved := filepath.Join(WatchMoveTo, "2026", "scan.tif")
+	go func() {
+		for {
+			if _, err := os.Stat(moved); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	fake := newFakeS3()
+	if err := Watch(fake, fake.cleanup, "bucket", dir); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.objects["2026/scan.tif"]; obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("the file wasn't uploaded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026", "scan.tif")); !os.IsNotExist(err) {
+		t.Errorf("the file is still there: %v", err)
+	}
+}
+
+func TestWatchRefusesMovingIntoTheDirectory(t *testing.T) {
+	defer func() { WatchMoveTo = "" }()
+	dir := t.TempDir()
+	WatchMoveTo = filepath.Join(dir, "done")
+
+	fake := newFakeS3()
+	if err := Watch(fake, fake.cleanup, "bucket", dir); err == nil {
+		t.Error("--move-to in the watched directory was accepted")
+	}
+}
+
+func TestWatchFlagsNeedVerify(t *testing.T) {
+	defer func() { WatchPoll, WatchDelete, VerifyUpload = 10*time.Second, false, VERIFY_MD5 }()
+	WatchPoll, WatchDelete = 10*time.Second, true
+
+	if err := checkWatchFlags(); err != nil {
+		t.Error(err)
+	}
+	VerifyUpload = VERIFY_NONE
+	if err := checkWatchFlags(); err == nil {
+		t.Error("--delete-after-upload was accepted with --verify none")
+	}
+}
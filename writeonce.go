@@ -0,0 +1,52 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// CLI flags
+var WriteOnce bool
+
+// checkWriteOnce makes sure the bucket enforces Object Lock in compliance
+// mode by default, so nothing we upload can be deleted or overwritten before
+// its retention runs out, not even by the root account.
+func checkWriteOnce(s3session s3iface.S3API, bucket string) error {
+	resp, err := s3session.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("Can't read the Object Lock configuration of %s: %w", bucket, err)
+	}
+
+	config := resp.ObjectLockConfiguration
+	if config == nil || config.ObjectLockEnabled == nil || *config.ObjectLockEnabled != s3.ObjectLockEnabledEnabled {
+		return fmt.Errorf("%s doesn't have Object Lock enabled", bucket)
+	}
+
+	if config.Rule == nil || config.Rule.DefaultRetention == nil ||
+		config.Rule.DefaultRetention.Mode == nil || *config.Rule.DefaultRetention.Mode != s3.ObjectLockRetentionModeCompliance {
+		return fmt.Errorf("%s doesn't have a default retention in COMPLIANCE mode", bucket)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lockedS3 has the Object Lock configuration config, or none if it's nil.
+type lockedS3 struct {
+	*fakeS3
+	config *s3.ObjectLockConfiguration
+}
+
+func (f *lockedS3) GetObjectLockConfiguration(in *s3.GetObjectLockConfigurationInput) (*s3.GetObjectLockConfigurationOutput, error) {
+	if f.config == nil {
+		return nil, awserr.New("ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket", nil)
+	}
+	return &s3.GetObjectLockConfigurationOutput{ObjectLockConfiguration: f.config}, nil
+}
+
+func lockConfiguration(mode string) *s3.ObjectLockConfiguration {
+	return &s3.ObjectLockConfiguration{
+		ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+		Rule: &s3.ObjectLockRule{DefaultRetention: &s3.DefaultRetention{
+			Mode: aws.String(mode),
+			Days: aws.Int64(365),
+		}},
+	}
+}
+
+func TestCheckWriteOnce(t *testing.T) {
+	for name, test := range map[string]struct {
+		config *s3.ObjectLockConfiguration
+		ok     bool
+	}{
+		"no Object Lock":       {nil, false},
+		"no default retention": {&s3.ObjectLockConfiguration{ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled)}, false},
+		"governance mode":      {lockConfiguration(s3.ObjectLockRetentionModeGovernance), false},
+		"compliance mode":      {lockConfiguration(s3.ObjectLockRetentionModeCompliance), true},
+	} {
+		err := checkWriteOnce(&lockedS3{fakeS3: newFakeS3(), config: test.config}, "bucket")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestWriteOnceRefusesDeleting(t *testing.T) {
+	defer func() { WriteOnce, AbortOnFailure = false, false }()
+	WriteOnce = true
+
+	if _, err := newDestructiveS3Session("us-east-1"); err == nil {
+		t.Error("got a session which can delete in --write-once mode")
+	}
+
+	AbortOnFailure = true
+	if err := checkAbortFlags(); err == nil {
+		t.Error("--abort-on-failure was taken with --write-once")
+	}
+}
@@ -0,0 +1,80 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+// CLI flags
+var TarXattrs bool
+var DownloadXattrs bool
+
+// Extended attributes are archived as PAX records under this prefix, the
+// way GNU tar and bsdtar do.
+const PAX_XATTR_PREFIX = "SCHILY.xattr."
+
+// splitXattrNames splits what listxattr returns, names ending in NUL.
+func splitXattrNames(names []byte) []string {
+	var split []string
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" {
+			split = append(split, name)
+		}
+	}
+	return split
+}
+
+// archiveXattrs adds the extended attributes of the file p to hdr with
+// --xattrs.  Those of symlinks would be those they point to, so they're left
+// out.
+func archiveXattrs(hdr *tar.Header, p string) error {
+	if !TarXattrs || hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[PAX_XATTR_PREFIX+name] = value
+	}
+	return nil
+}
+
+// restoreXattrs sets the extended attributes hdr has on target with
+// download --xattrs.  Those only root may set, like security.selinux and
+// trusted.*, are warned about instead, so that an unprivileged restore still
+// gets the data back.
+func restoreXattrs(hdr *tar.Header, target string) {
+	if !DownloadXattrs {
+		return
+	}
+	for key, value := range hdr.PAXRecords {
+		name := strings.TrimPrefix(key, PAX_XATTR_PREFIX)
+		if name == key {
+			continue
+		}
+		if err := writeXattr(target, name, value); err != nil {
+			warn(WARNING_METADATA, hdr.Name, "Failed to restore the extended attribute %s of %s: %v", name, hdr.Name, err)
+		}
+	}
+}
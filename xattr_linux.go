@@ -0,0 +1,77 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// xattrsSupported tells whether --xattrs works here.
+const xattrsSupported = true
+
+// readXattrs returns the extended attributes of the file p, POSIX ACLs
+// (system.posix_acl_*) and SELinux contexts (security.selinux) included.
+// A file system without them has none.
+func readXattrs(p string) (map[string]string, error) {
+	names, err := xattrBuffer(func(buf []byte) (int, error) { return syscall.Listxattr(p, buf) })
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range splitXattrNames(names) {
+		value, err := xattrBuffer(func(buf []byte) (int, error) { return syscall.Getxattr(p, name, buf) })
+		// It may have been removed since it was listed.
+		if errors.Is(err, syscall.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+// xattrBuffer calls get with a buffer large enough for what it returns,
+// which may grow between asking for its size and getting it.
+func xattrBuffer(get func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := get(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// writeXattr sets the extended attribute name of the file p.
+func writeXattr(p string, name string, value string) error {
+	return syscall.Setxattr(p, name, []byte(value), 0)
+}
@@ -0,0 +1,34 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// xattrsSupported tells whether --xattrs works here.
+const xattrsSupported = false
+
+var errXattrs = errors.New("Extended attributes are only archived on Linux")
+
+func readXattrs(p string) (map[string]string, error) {
+	return nil, errXattrs
+}
+
+func writeXattr(p string, name string, value string) error {
+	return errXattrs
+}
@@ -0,0 +1,86 @@
+// s3-glacier-uploader --- upload large files to S3 Glacier
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarXattrs(t *testing.T) {
+	defer func() { Tar, TarXattrs, DownloadXattrs = false, false, false }()
+	if !xattrsSupported {
+		t.Skip("no extended attributes here")
+	}
+
+	dir := writeTree(t, tarTree)
+	filename := filepath.Join(dir, "a.txt")
+	if err := writeXattr(filename, "user.origin", "camera"); err != nil {
+		t.Skipf("the temporary directory has no extended attributes: %v", err)
+	}
+
+	Tar, TarXattrs = true, true
+	if err := checkTarFlags(); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := writeTar(&archive, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	var found bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == filepath.Base(dir)+"/a.txt" {
+			found = hdr.PAXRecords[PAX_XATTR_PREFIX+"user.origin"] == "camera"
+		}
+	}
+	if !found {
+		t.Error("the extended attribute isn't in the archive")
+	}
+
+	// Extracting only restores them when asked to.
+	for _, restore := range []bool{false, true} {
+		DownloadXattrs = restore
+		out := t.TempDir()
+		if _, err := extractTar(bytes.NewReader(archive.Bytes()), out); err != nil {
+			t.Fatal(err)
+		}
+		xattrs, err := readXattrs(filepath.Join(out, filepath.Base(dir), "a.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := xattrs["user.origin"]; (got == "camera") != restore {
+			t.Errorf("extracted with --xattrs=%v, the file has %q", restore, got)
+		}
+	}
+
+	TarXattrs, Tar = true, false
+	if err := checkTarFlags(); err == nil {
+		t.Error("took --xattrs without --tar")
+	}
+}